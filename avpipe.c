@@ -74,9 +74,15 @@ int     CDebug(char *);
 int     CInfo(char *);
 int     CWarn(char *);
 int     CError(char *);
+int     CAVLog(int, char *);
+int64_t AVPipeOpenRendition(char *);
+int     AVPipeCloseRendition(int64_t);
 
 #define MIN_VALID_FD      (-4)
 
+/* Returned by AVPipeReadInput() if the input handler timed out, readInputTimeout in avpipe.go */
+#define READ_INPUT_TIMEOUT (-2)
+
 #define MAX_TX  128    /* Maximum transcodings per system */
 
 typedef struct xc_entry_t {
@@ -212,7 +218,20 @@ in_read_packet(
     if (xcparams && xcparams->debug_frame_level)
         elv_dbg("IN READ read=%d pos=%"PRId64" total=%"PRId64", checksum=%u",
             r, inctx->read_pos, inctx->read_bytes, r > 0 ? checksum(buf, r) : 0);
-    return r > 0 ? r : -1;
+
+    if (r > 0)
+        return r;
+    if (r == 0)
+        return AVERROR_EOF;
+
+    /* A read error aborts the transcoding instead of finalizing the outputs as on EOF */
+    elv_err("IN READ failed r=%d, url=%s", r, inctx->url);
+    inctx->read_error = 1;
+    if (r == READ_INPUT_TIMEOUT) {
+        inctx->read_timeout = 1;
+        return AVERROR(ETIMEDOUT);
+    }
+    return AVERROR(EIO);
 }
 
 static int
@@ -293,6 +312,14 @@ in_stat(
         rc = AVPipeStatInput(fd, stream_index, stat_type, &c->video_frames_read);
         break;
 
+    case in_stat_video_frames_dropped:
+        rc = AVPipeStatInput(fd, stream_index, stat_type, &c->video_frames_dropped);
+        break;
+
+    case in_stat_decode_progress:
+        rc = AVPipeStatInput(fd, stream_index, stat_type, &c->decode_progress);
+        break;
+
     case in_stat_first_keyframe_pts:
         rc = AVPipeStatInput(fd, stream_index, stat_type, &c->first_key_frame_pts);
         break;
@@ -301,6 +328,20 @@ in_stat(
         rc = AVPipeStatInput(fd, stream_index, stat_type, c->data);
         break;
 
+    case in_stat_scte35:
+        rc = AVPipeStatInput(fd, stream_index, stat_type, &c->scte35_event);
+        break;
+
+    case in_stat_xc_timing:
+        rc = AVPipeStatInput(fd, stream_index, stat_type, &c->xc_timing);
+        break;
+
+    case in_stat_frame:
+        if (stream_index < 0 || stream_index >= MAX_STREAMS)
+            return -1;
+        rc = AVPipeStatInput(fd, stream_index, stat_type, &c->frame_info[stream_index]);
+        break;
+
     default:
         rc = -1;
     }
@@ -565,6 +606,18 @@ udp_in_stat(
             elv_dbg("IN STAT UDP fd=%d, video frame read=%"PRId64", url=%s", fd, c->video_frames_read, c->url);
         rc = AVPipeStatInput(fd, stream_index, stat_type, &c->video_frames_read);
         break;
+    case in_stat_video_frames_dropped:
+        if (debug_frame_level)
+            elv_dbg("IN STAT UDP fd=%d, video frames dropped=%"PRId64", url=%s", fd, c->video_frames_dropped, c->url);
+        rc = AVPipeStatInput(fd, stream_index, stat_type, &c->video_frames_dropped);
+        break;
+    case in_stat_decode_progress:
+        if (debug_frame_level)
+            elv_dbg("IN STAT UDP fd=%d, video frames decoded=%"PRId64", audio frames decoded=%"PRId64", input PTS=%"PRId64", url=%s",
+                fd, c->decode_progress.video_frames_decoded, c->decode_progress.audio_frames_decoded,
+                c->decode_progress.input_pts, c->url);
+        rc = AVPipeStatInput(fd, stream_index, stat_type, &c->decode_progress);
+        break;
     case in_stat_first_keyframe_pts:
         if (debug_frame_level)
             elv_dbg("IN STAT UDP fd=%d, first keyframe PTS=%"PRId64", url=%s", fd, c->first_key_frame_pts, c->url);
@@ -575,6 +628,19 @@ udp_in_stat(
             elv_dbg("IN STAT UDP SCTE35 fd=%d, stat_type=%d, url=%s", fd, stat_type, c->url);
         rc = AVPipeStatInput(fd, stream_index, stat_type, c->data);
         break;
+    case in_stat_scte35:
+        if (debug_frame_level)
+            elv_dbg("IN STAT UDP SCTE35 fd=%d, PTS=%"PRId64", command=%d, size=%d, url=%s",
+                fd, c->scte35_event.pts, c->scte35_event.command_type, c->scte35_event.data_len, c->url);
+        rc = AVPipeStatInput(fd, stream_index, stat_type, &c->scte35_event);
+        break;
+    case in_stat_xc_timing:
+        if (debug_frame_level)
+            elv_dbg("IN STAT UDP fd=%d, decode=%"PRId64" filter=%"PRId64" encode=%"PRId64" mux=%"PRId64" total=%"PRId64" (ns), url=%s",
+                fd, c->xc_timing.decode_ns, c->xc_timing.filter_ns, c->xc_timing.encode_ns,
+                c->xc_timing.mux_ns, c->xc_timing.total_ns, c->url);
+        rc = AVPipeStatInput(fd, stream_index, stat_type, &c->xc_timing);
+        break;
     default:
         elv_err("IN STAT UDP fd=%d, invalid input stat=%d, url=%s", stat_type, c->url);
         return 1;
@@ -597,7 +663,7 @@ out_opener(
     h = *((int64_t *)(inctx->opaque));
 
     /* Allocate the buffers. The data will be copied to the buffers */
-    outctx->bufsz = AVIO_OUT_BUF_SIZE;
+    outctx->bufsz = (xcparams && xcparams->io_buffer_size > 0) ? xcparams->io_buffer_size : AVIO_OUT_BUF_SIZE;
     outctx->buf = (unsigned char *)av_malloc(outctx->bufsz); /* Must be malloc'd - will be realloc'd by avformat */
 
     fd = AVPipeOpenOutput(h, outctx->stream_index, outctx->seg_index, outctx->pts, outctx->type);
@@ -741,6 +807,21 @@ out_stat(
     case out_stat_end_file:
         rc = AVPipeStatOutput(h, fd, stream_index, buftype, stat_type, &outctx->seg_index);
         break;
+    case out_stat_segment_verify_failed:
+        rc = AVPipeStatOutput(h, fd, stream_index, buftype, stat_type, &outctx->seg_index);
+        break;
+    case out_stat_segment_done:
+        {
+            segment_stats_t segment_stats = {
+                .seg_index = outctx->seg_index,
+                .start_pts = outctx->seg_start_pts,
+                .end_pts = outctx->seg_end_pts,
+                .bytes = outctx->written_bytes,
+                .frames = outctx->seg_frames,
+            };
+            rc = AVPipeStatOutput(h, fd, stream_index, buftype, stat_type, &segment_stats);
+        }
+        break;
     case out_stat_frame_written:
         {
             encoding_frame_stats_t encoding_frame_stats = {
@@ -763,6 +844,7 @@ set_loggers()
     elv_set_log_func(elv_log_debug, CDebug);
     elv_set_log_func(elv_log_warning, CWarn);
     elv_set_log_func(elv_log_error, CError);
+    set_ffmpeg_log_func(CAVLog);
 }
 
 static void
@@ -846,20 +928,30 @@ xc_table_free(
     pthread_mutex_unlock(&tx_mutex);
 }
 
+/*
+ * Cancels the transcoding of handle. If graceful is set the transcoding stops reading the input and
+ * finalizes its outputs (flushes the encoders and writes the trailers), otherwise it is aborted.
+ */
 static int
 xc_table_cancel(
-    int32_t handle)
+    int32_t handle,
+    int graceful)
 {
     int rc = eav_success;
-    elv_dbg("xc_table_cancel handle=%d", handle);
+    elv_dbg("xc_table_cancel handle=%d, graceful=%d", handle, graceful);
     pthread_mutex_lock(&tx_mutex);
     for (int i=0; i<MAX_TX; i++) {
         if (xc_table[i] != NULL && xc_table[i]->handle == handle) {
             xctx_t *xctx = xc_table[i]->xctx;
 
             if (xctx->index == i) {
-                xctx->decoder_ctx.cancelled = 1;
-                xctx->encoder_ctx.cancelled = 1;
+                if (graceful) {
+                    xctx->decoder_ctx.stop_requested = 1;
+                    xctx->encoder_ctx.stop_requested = 1;
+                } else {
+                    xctx->decoder_ctx.cancelled = 1;
+                    xctx->encoder_ctx.cancelled = 1;
+                }
                 /* If there is a UDP thread running wait for it to be finished */
                 if ( xctx->inctx && xctx->inctx->utid ) {
                     xctx->inctx->closed = 1;
@@ -997,6 +1089,7 @@ xc_run(
     }
 
     xctx_t *xctx = xe->xctx;
+    set_ffmpeg_log_prefix(xctx->params->log_prefix);
     if ((rc = avpipe_xc(xctx, 0)) != eav_success) {
         if (rc != eav_cancelled)
             elv_err("Error in transcoding, handle=%d, err=%d", handle, rc);
@@ -1004,6 +1097,7 @@ xc_run(
     }
 
 end_tx:
+    set_ffmpeg_log_prefix(NULL);
     xc_table_free(handle);
     avpipe_fini(&xctx);
 
@@ -1014,7 +1108,14 @@ int
 xc_cancel(
     int32_t handle)
 { 
-    return xc_table_cancel(handle);
+    return xc_table_cancel(handle, 0);
+}
+
+int
+xc_stop(
+    int32_t handle)
+{
+    return xc_table_cancel(handle, 1);
 }
 
 /*
@@ -1035,10 +1136,10 @@ xc(
         return eav_param;
 
     // Note: If log handler functions are set, log levels set through
-    //       av_log_set_level and elv_set_log_level are ignored
-    //av_log_set_level(AV_LOG_DEBUG);
+    //       elv_set_log_level are ignored. The ffmpeg log level is set by set_ffmpeg_log_level
     connect_ffmpeg_log();
     //elv_set_log_level(elv_log_debug);
+    set_ffmpeg_log_prefix(params->log_prefix);
 
     set_handlers(params->url, &in_handlers, &out_handlers);
 
@@ -1055,7 +1156,156 @@ xc(
     }
 
 end_tx:
+    set_ffmpeg_log_prefix(NULL);
+    avpipe_fini(&xctx);
+
+    return rc;
+}
+
+int
+xc_validate(
+    xcparams_t *params)
+{
+    xctx_t *xctx = NULL;
+    int rc = 0;
+    avpipe_io_handler_t *in_handlers;
+    avpipe_io_handler_t *out_handlers;
+
+    if (!params || !params->url || params->url[0] == '\0' )
+        return eav_param;
+
+    connect_ffmpeg_log();
+    set_ffmpeg_log_prefix(params->log_prefix);
+
+    set_handlers(params->url, &in_handlers, &out_handlers);
+
+    if ((rc = avpipe_init(&xctx, in_handlers, out_handlers, params)) != eav_success) {
+        goto end_validate;
+    }
+
+    if ((rc = avpipe_validate(xctx)) != eav_success) {
+        elv_err("Validating params failed url=%s, rc=%d", params->url, rc);
+        goto end_validate;
+    }
+
+end_validate:
+    set_ffmpeg_log_prefix(NULL);
+    avpipe_fini(&xctx);
+
+    return rc;
+}
+
+/*
+ * Opens the context the outputs of a rendition of xc_multi() are opened with. It has no input,
+ * it only routes the outputs of the rendition to the output opener of url.
+ */
+static int
+rendition_opener(
+    const char *url,
+    ioctx_t *inctx)
+{
+    inctx->opaque = (void *) calloc(1, sizeof(int64_t));
+    inctx->url = strdup(url);
+
+    int64_t fd = AVPipeOpenRendition((char *) url);
+    if (fd <= 0)
+        return -1;
+
+    elv_dbg("RENDITION OPEN url=%s, fd=%"PRId64, url, fd);
+    *((int64_t *)(inctx->opaque)) = fd;
+    return 0;
+}
+
+static void
+rendition_closer(
+    ioctx_t *inctx)
+{
+    if (!inctx)
+        return;
+
+    if (inctx->opaque && *((int64_t *)(inctx->opaque)) > 0)
+        AVPipeCloseRendition(*((int64_t *)(inctx->opaque)));
+    free(inctx->opaque);
+    free(inctx->url);
+    free(inctx);
+}
+
+/*
+ * The first rendition is the leader, it decodes the input and feeds the decoded frames to the other renditions.
+ * Each rendition has its own encoder and its outputs are routed by the context opened by rendition_opener().
+ */
+int
+xc_multi(
+    char *url,
+    xcparams_t *params,
+    int n_params)
+{
+    xctx_t *xctx = NULL;
+    ioctx_t *out_inctx[MAX_RENDITIONS] = { NULL };
+    xcparams_t leader_params;
+    int rc = 0;
+    avpipe_io_handler_t *in_handlers;
+    avpipe_io_handler_t *out_handlers;
+
+    if (!url || url[0] == '\0' || !params || n_params <= 0 || n_params > MAX_RENDITIONS)
+        return eav_param;
+
+    for (int i=0; i<n_params; i++) {
+        if (!params[i].url || params[i].url[0] == '\0')
+            return eav_param;
+    }
+
+    connect_ffmpeg_log();
+    set_ffmpeg_log_prefix(params[0].log_prefix);
+
+    if ((rc = set_handlers(url, &in_handlers, &out_handlers)) != eav_success)
+        goto end_xc_multi;
+
+    /* The leader reads url, the copy is shallow since avpipe_init() copies the params */
+    leader_params = params[0];
+    leader_params.url = url;
+    if ((rc = avpipe_init(&xctx, in_handlers, out_handlers, &leader_params)) != eav_success)
+        goto end_xc_multi;
+
+    xctx->handle = GenerateAndRegisterHandle();
+    xctx->associate_thread = AssociateCThreadWithHandle;
+    xctx->renditions = (xctx_t **) calloc(n_params, sizeof(xctx_t *));
+
+    for (int i=0; i<n_params; i++) {
+        xctx_t *rendition = xctx;
+
+        if (i > 0) {
+            avpipe_io_handler_t *rendition_out_handlers;
+
+            set_handlers(url, NULL, &rendition_out_handlers);
+            if ((rc = avpipe_init(&rendition, NULL, rendition_out_handlers, &params[i])) != eav_success)
+                goto end_xc_multi;
+            rendition->leader = xctx;
+            rendition->handle = xctx->handle;
+            xctx->renditions[xctx->n_renditions++] = rendition;
+        }
+
+        out_inctx[i] = (ioctx_t *) calloc(1, sizeof(ioctx_t));
+        out_inctx[i]->params = rendition->params;
+        if (rendition_opener(params[i].url, out_inctx[i]) < 0) {
+            elv_err("Failed to open rendition, url=%s", params[i].url);
+            rc = eav_param;
+            goto end_xc_multi;
+        }
+        rendition->out_inctx = out_inctx[i];
+    }
+
+    if ((rc = avpipe_xc(xctx, 0)) != eav_success) {
+        elv_err("Multi-rendition transcoding failed url=%s, rc=%d", url, rc);
+        goto end_xc_multi;
+    }
+
+end_xc_multi:
+    set_ffmpeg_log_prefix(NULL);
     avpipe_fini(&xctx);
+    /* The outputs are closed by avpipe_fini() */
+    for (int i=0; i<n_params; i++)
+        rendition_closer(out_inctx[i]);
 
     return rc;
 }
@@ -1210,7 +1460,7 @@ out_mux_opener(
     xcparams_t *xcparams = (inctx != NULL) ? inctx->params : NULL;
 
     /* Allocate the buffers. The data will be copied to the buffers */
-    outctx->bufsz = AVIO_OUT_BUF_SIZE;
+    outctx->bufsz = (xcparams != NULL && xcparams->io_buffer_size > 0) ? xcparams->io_buffer_size : AVIO_OUT_BUF_SIZE;
     outctx->buf = (unsigned char *)av_malloc(outctx->bufsz); /* Must be malloc'd - will be realloc'd by avformat */
 
     fd = AVPipeOpenMuxOutput((char *) url, outctx->type);
@@ -1348,6 +1598,7 @@ mux(
         return eav_param;
 
     connect_ffmpeg_log();
+    set_ffmpeg_log_prefix(params->log_prefix);
 
     set_mux_handlers(&in_handlers, &out_handlers);
     in_mux_ctx = (io_mux_ctx_t *)calloc(1, sizeof(io_mux_ctx_t));
@@ -1367,6 +1618,7 @@ mux(
     }
 
 end_mux:
+    set_ffmpeg_log_prefix(NULL);
     elv_dbg("Releasing all the muxing resources, url=%s", params->url);
     avpipe_mux_fini(&xctx);
     free(in_mux_ctx);
@@ -1389,6 +1641,86 @@ get_profile_name(
     return avcodec_profile_name((enum AVCodecID) codec_id, profile);
 }
 
+/*
+ * Appends name to the '\n' separated names, growing the buffer as needed.
+ * Returns -1 if it fails to allocate the buffer.
+ */
+static int
+append_name(
+    char **names,
+    size_t *len,
+    size_t *sz,
+    const char *name)
+{
+    size_t name_len = strlen(name);
+
+    if (*len + name_len + 2 > *sz) {
+        size_t new_sz = 2 * (*sz) + name_len + 2;
+        char *new_names = realloc(*names, new_sz);
+        if (!new_names)
+            return -1;
+        *names = new_names;
+        *sz = new_sz;
+    }
+
+    memcpy(*names + *len, name, name_len);
+    (*names)[*len + name_len] = '\n';
+    *len += name_len + 1;
+    (*names)[*len] = '\0';
+    return 0;
+}
+
+char *
+get_codec_names(
+    int encoders)
+{
+    const AVCodec *codec;
+    void *opaque = NULL;
+    char *names = calloc(1, 1);
+    size_t len = 0;
+    size_t sz = 1;
+
+    while (names && (codec = av_codec_iterate(&opaque))) {
+        if (encoders ? !av_codec_is_encoder(codec) : !av_codec_is_decoder(codec))
+            continue;
+        if (append_name(&names, &len, &sz, codec->name) < 0) {
+            free(names);
+            return NULL;
+        }
+    }
+
+    return names;
+}
+
+char *
+get_muxer_names()
+{
+    const AVOutputFormat *muxer;
+    void *opaque = NULL;
+    char *names = calloc(1, 1);
+    size_t len = 0;
+    size_t sz = 1;
+
+    while (names && (muxer = av_muxer_iterate(&opaque))) {
+        if (append_name(&names, &len, &sz, muxer->name) < 0) {
+            free(names);
+            return NULL;
+        }
+    }
+
+    return names;
+}
+
+int
+has_codec(
+    const char *name)
+{
+    if (!name || name[0] == '\0')
+        return 0;
+
+    return avcodec_find_encoder_by_name(name) != NULL || avcodec_find_decoder_by_name(name) != NULL;
+}
+
 int
 probe(
     xcparams_t *params,
@@ -1417,3 +1749,62 @@ end_probe:
     free(in_handlers);
     return rc;
 }
+
+int
+probe_header(
+    xcparams_t *params,
+    container_info_t *container_info)
+{
+    avpipe_io_handler_t *in_handlers = NULL;
+    int rc;
+
+    if (!params || !params->url || params->url[0] == '\0' )
+        return eav_param;
+
+    rc = set_handlers(params->url, &in_handlers, NULL);
+    if (rc != eav_success)
+        goto end_probe_header;
+
+    rc = avpipe_probe_header(in_handlers, params, container_info);
+
+end_probe_header:
+    elv_dbg("Releasing probe header resources, url=%s", params->url);
+    free(in_handlers);
+    return rc;
+}
+
+int
+probe_frames(
+    xcparams_t *params,
+    int stream_index,
+    int max_frames,
+    frame_info_t **frames,
+    int *n_frames)
+{
+    avpipe_io_handler_t *in_handlers = NULL;
+    int rc;
+
+    if (!params || !params->url || params->url[0] == '\0' )
+        return eav_param;
+
+    rc = set_handlers(params->url, &in_handlers, NULL);
+    if (rc != eav_success)
+        goto end_probe_frames;
+
+    rc = avpipe_probe_frames(in_handlers, params, stream_index, max_frames, frames, n_frames);
+
+end_probe_frames:
+    elv_dbg("Releasing probe frames resources, url=%s", params->url);
+    free(in_handlers);
+    return rc;
+}
+
+int
+verify_segment(
+    uint8_t *init_buf,
+    int64_t init_len,
+    uint8_t *seg_buf,
+    int64_t seg_len)
+{
+    return avpipe_verify_segment(init_buf, init_len, seg_buf, seg_len, "");
+}
@@ -34,13 +34,19 @@ package avpipe
 // #include <stdlib.h>
 // #include "avpipe_xc.h"
 // #include "avpipe.h"
+// #include "avpipe_utils.h"
 // #include "elv_log.h"
+// #include <libavutil/pixdesc.h>
 import "C"
 import (
+	"errors"
 	"fmt"
 	"io"
 	"math/big"
 	"math/rand"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
 	"unsafe"
 
@@ -49,6 +55,11 @@ import (
 
 const traceIo bool = false
 
+// readInputTimeout is returned by AVPipeReadInput() when the input handler times out (its read error is
+// EAV_IO_TIMEOUT), then in_read_packet() fails the read with ETIMEDOUT and the transcoding returns
+// EAV_IO_TIMEOUT instead of EAV_READ_INPUT
+const readInputTimeout = -2
+
 type SeekReadWriteCloser interface {
 	io.Seeker
 	io.Reader
@@ -73,6 +84,12 @@ const (
 	AV_OUT_STAT_START_FILE              = 10
 	AV_OUT_STAT_END_FILE                = 11
 	AV_IN_STAT_DATA_SCTE35              = 12
+	AV_IN_STAT_VIDEO_FRAMES_DROPPED     = 13
+	AV_OUT_STAT_SEGMENT_VERIFY_FAILED   = 14
+	AV_OUT_STAT_SEGMENT_DONE            = 15
+	AV_IN_STAT_DECODE_PROGRESS          = 16
+	AV_IN_STAT_SCTE35                   = 17
+	AV_IN_STAT_XC_TIMING                = 18
 )
 
 func (a AVStatType) Name() string {
@@ -101,6 +118,18 @@ func (a AVStatType) Name() string {
 		return "AV_OUT_STAT_END_FILE"
 	case AV_IN_STAT_DATA_SCTE35:
 		return "AV_IN_STAT_DATA_SCTE35"
+	case AV_IN_STAT_VIDEO_FRAMES_DROPPED:
+		return "AV_IN_STAT_VIDEO_FRAMES_DROPPED"
+	case AV_OUT_STAT_SEGMENT_VERIFY_FAILED:
+		return "AV_OUT_STAT_SEGMENT_VERIFY_FAILED"
+	case AV_OUT_STAT_SEGMENT_DONE:
+		return "AV_OUT_STAT_SEGMENT_DONE"
+	case AV_IN_STAT_DECODE_PROGRESS:
+		return "AV_IN_STAT_DECODE_PROGRESS"
+	case AV_IN_STAT_SCTE35:
+		return "AV_IN_STAT_SCTE35"
+	case AV_IN_STAT_XC_TIMING:
+		return "AV_IN_STAT_XC_TIMING"
 	default:
 		return fmt.Sprintf("Unknown(%d)", a)
 	}
@@ -113,6 +142,26 @@ type SideDataDisplayMatrix struct {
 	RotationCw float64 `json:"rotation_cw"`
 }
 
+type SideDataMasteringDisplay struct {
+	Type         string  `json:"side_data_type"`
+	RedX         float64 `json:"red_x"`
+	RedY         float64 `json:"red_y"`
+	GreenX       float64 `json:"green_x"`
+	GreenY       float64 `json:"green_y"`
+	BlueX        float64 `json:"blue_x"`
+	BlueY        float64 `json:"blue_y"`
+	WhitePointX  float64 `json:"white_point_x"`
+	WhitePointY  float64 `json:"white_point_y"`
+	MinLuminance float64 `json:"min_luminance"`
+	MaxLuminance float64 `json:"max_luminance"`
+}
+
+type SideDataContentLightLevel struct {
+	Type       string `json:"side_data_type"`
+	MaxContent int    `json:"max_content"`
+	MaxAverage int    `json:"max_average"`
+}
+
 type StreamInfo struct {
 	StreamIndex        int               `json:"stream_index"`
 	StreamId           int32             `json:"stream_id"`
@@ -137,21 +186,50 @@ type StreamInfo struct {
 	SampleAspectRatio  *big.Rat          `json:"sample_aspect_ratio,omitempty"`
 	DisplayAspectRatio *big.Rat          `json:"display_aspect_ratio,omitempty"`
 	FieldOrder         string            `json:"field_order,omitempty"`
+	ColorPrimaries     string            `json:"color_primaries,omitempty"`     // Video only
+	ColorTransfer      string            `json:"color_transfer,omitempty"`      // Video only
+	ColorSpace         string            `json:"color_space,omitempty"`         // Video only
+	ColorRange         string            `json:"color_range,omitempty"`         // Video only
+	BitsPerRawSample   int               `json:"bits_per_raw_sample,omitempty"` // Bits per sample (i.e 10 for 10-bit video), from the pixel format if not set by the codec
 	Profile            int               `json:"profile,omitempty"`
 	Level              int               `json:"level,omitempty"`
 	SideData           []interface{}     `json:"side_data,omitempty"`
+	Rotation           int               `json:"rotation,omitempty"` // Video only, CW rotation of the display matrix (0, 90, 180 or 270)
 	Tags               map[string]string `json:"tags,omitempty"`
+	Disposition        map[string]bool   `json:"disposition,omitempty"` // AV_DISPOSITION_* flags by their ffprobe name (i.e "default", "comment", "hearing_impaired")
+	IsVFR              bool              `json:"is_vfr,omitempty"`      // Video only, the frame durations of the first packets vary (variable frame rate)
 }
 
 type ContainerInfo struct {
-	Duration   float64 `json:"duration"`
-	FormatName string  `json:"format_name"`
+	Duration   float64           `json:"duration"`
+	FormatName string            `json:"format_name"`
+	BitRate    int64             `json:"bit_rate,omitempty"` // Overall bit rate in bits/s, 0 if unknown
+	IsImage    bool              `json:"is_image,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+// ProgramInfo is a program of a multi-program input, i.e. a service of an MPEG-TS. XcParams.ProgramID
+// selects the program to transcode.
+type ProgramInfo struct {
+	ProgramID     int               `json:"program_id"`     // Program number (the service ID of an MPEG-TS)
+	StreamIndexes []int             `json:"stream_indexes"` // Indexes of the streams of the program
+	Tags          map[string]string `json:"tags,omitempty"` // i.e. service_name and service_provider
 }
 
 // PENDING: use legacy_imf_dash_extract/media.Probe?
 type ProbeInfo struct {
 	ContainerInfo ContainerInfo `json:"format"`
 	StreamInfo    []StreamInfo  `json:"streams"`
+	Programs      []ProgramInfo `json:"programs,omitempty"` // All the programs of the input, even if XcParams.ProgramID is set
+}
+
+// FrameInfo describes one decoded frame of a stream, as returned by ProbeFrames
+type FrameInfo struct {
+	Pts        int64  `json:"pts"`
+	Dts        int64  `json:"dts"`
+	KeyFrame   bool   `json:"key_frame"`
+	PictType   string `json:"pict_type"` // "I", "P", "B", ... or "?" if unknown
+	PacketSize int    `json:"packet_size"`
 }
 
 // IOHandler defines handlers that will be called from the C interface functions
@@ -173,11 +251,14 @@ type InputOpener interface {
 }
 
 type InputHandler interface {
-	// Reads from input stream into buf.
-	// Returns (0, nil) to indicate EOF.
+	// Reads from input stream into buf, buf is only valid until Read returns.
+	// Returns (n, nil) with n > 0 if data was read, (0, nil) or (0, io.EOF) to indicate EOF, then the
+	// outputs are finalized. Any other error aborts the transcoding with EAV_READ_INPUT, so a transient
+	// error (i.e. of a network input) must be retried by the handler before returning it.
 	Read(buf []byte) (int, error)
 
 	// Seeks to specific offset of the input.
+	// It is not called if the input is not seekable (XcParams.Seekable is false).
 	Seek(offset int64, whence int) (int64, error)
 
 	// Closes the input.
@@ -203,6 +284,7 @@ type MuxOutputOpener interface {
 
 type OutputHandler interface {
 	// Writes encoded stream to the output.
+	// buf is only valid until Write returns, it must be copied to be kept.
 	Write(buf []byte) (int, error)
 
 	// Seeks to specific offset of the output.
@@ -218,8 +300,70 @@ type OutputHandler interface {
 // Implement IOHandler
 type ioHandler struct {
 	input    InputHandler // Input file
+	url      string       // URL of the input
 	mutex    *sync.Mutex
 	outTable map[int64]OutputHandler // Map of integer handle to output interfaces
+	frameCb  goavpipe.FrameCallback  // FrameCallback of the job, nil if the frames are not reported
+	outputs  map[int64]*outputState  // Outputs of outTable, to report the artifacts of the job
+	closed   []OutputArtifact        // Artifacts of the outputs closed so far, in closing order
+	segments map[segmentKey]*segmentSummary
+
+	// Output opener of the URL when the handler was opened, all the outputs of the handler are opened with it
+	outOpener OutputOpener
+}
+
+// OutputArtifact describes an output written by a transcoding job, see XcOutputs()
+type OutputArtifact struct {
+	Type        goavpipe.AVType `json:"type"`
+	StreamIndex int             `json:"stream_index"`
+	SegIndex    int             `json:"seg_index"`
+	Bytes       int64           `json:"bytes"` // Size of the output, the highest offset written
+}
+
+// outputState tracks the size of an open output
+type outputState struct {
+	artifact OutputArtifact
+	offset   int64 // Current write offset
+}
+
+// segmentKey identifies the segments of an output stream
+type segmentKey struct {
+	avType      goavpipe.AVType
+	streamIndex int
+}
+
+// segmentSummary sums up the segments of an output stream reported with AV_OUT_STAT_SEGMENT_DONE
+type segmentSummary struct {
+	last   SegmentStats // Segment with the highest index
+	frames int64        // Frames of all the segments
+}
+
+// xcReport collects the outputs written by the jobs of a URL, for XcOutputs() and XcContinue()
+type xcReport struct {
+	artifacts []OutputArtifact
+	segments  map[segmentKey]*segmentSummary
+}
+
+// add adds the outputs of the handler h to the report
+func (r *xcReport) add(h *ioHandler) {
+	r.artifacts = append(r.artifacts, h.artifacts()...)
+
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+	for key, s := range h.segments {
+		if r.segments == nil {
+			r.segments = make(map[segmentKey]*segmentSummary)
+		}
+		summary, ok := r.segments[key]
+		if !ok {
+			r.segments[key] = &segmentSummary{last: s.last, frames: s.frames}
+			continue
+		}
+		summary.frames += s.frames
+		if s.last.SegIndex > summary.last.SegIndex {
+			summary.last = s.last
+		}
+	}
 }
 
 // Global table of handlers
@@ -228,10 +372,13 @@ var gMuxHandlers map[int64]OutputHandler = make(map[int64]OutputHandler)
 var gURLInputOpeners map[string]InputOpener = make(map[string]InputOpener)             // Keeps InputOpener for specific URL
 var gURLOutputOpeners map[string]OutputOpener = make(map[string]OutputOpener)          // Keeps OutputOpener for specific URL
 var gURLMuxOutputOpeners map[string]MuxOutputOpener = make(map[string]MuxOutputOpener) // Keeps MuxOutputOpener for specific URL
-var gURLOutputOpenersByHandler map[int64]OutputOpener = make(map[int64]OutputOpener)   // Keeps OutputOpener for specific URL
+var gXcUrls map[int32]string = make(map[int32]string)                                  // Keeps URL of the sessions initialized by XcInit()
+var gXcReports map[string]*xcReport = make(map[string]*xcReport)                       // Outputs of the jobs run by XcOutputs() and XcContinue(), by URL
+// Keeps XcParams.FrameCallback of the job of a URL, until its IO handlers are released
+var gURLFrameCallbacks map[string]goavpipe.FrameCallback = make(map[string]goavpipe.FrameCallback)
 var gHandleNum int64
 var gFd int64
-var gMutex sync.Mutex
+var gMutex sync.RWMutex // Guards the global tables, lookups only take the read lock
 var gInputOpener InputOpener
 var gOutputOpener OutputOpener
 var gMuxOutputOpener MuxOutputOpener
@@ -239,53 +386,98 @@ var gMuxOutputOpener MuxOutputOpener
 // This is used to set global input/output opener for avpipe
 // If there is no specific input/output opener for a URL, the global
 // input/output opener will be used.
+// The jobs running already keep the openers they started with.
 func InitIOHandler(inputOpener InputOpener, outputOpener OutputOpener) {
+	gMutex.Lock()
+	defer gMutex.Unlock()
 	gInputOpener = inputOpener
 	gOutputOpener = outputOpener
 }
 
 // Sets the global handlers for muxing (similar to InitIOHandler for transcoding)
 func InitMuxIOHandler(inputOpener InputOpener, muxOutputOpener MuxOutputOpener) {
+	gMutex.Lock()
+	defer gMutex.Unlock()
 	gInputOpener = inputOpener
 	gMuxOutputOpener = muxOutputOpener
 }
 
 // This is used to set input/output opener specific to a URL.
 // The input/output opener set by this function, is only valid for the URL and will be unset after
-// Xc() or Probe() is complete.
+// Xc(), XcRun() or Probe() is complete. Setting an opener for a URL that already has one is
+// rejected (and logged), use RegisterUrlIOHandler() to get the error.
 func InitUrlIOHandler(url string, inputOpener InputOpener, outputOpener OutputOpener) {
+	if err := RegisterUrlIOHandler(url, inputOpener, outputOpener); err != nil {
+		log.Error("InitUrlIOHandler", "url", url, "error", err)
+	}
+}
+
+// RegisterUrlIOHandler is InitUrlIOHandler() returning an error if the URL already has an opener,
+// since it means two sessions are using the same URL at the same time.
+func RegisterUrlIOHandler(url string, inputOpener InputOpener, outputOpener OutputOpener) error {
+	gMutex.Lock()
+	defer gMutex.Unlock()
+
+	if _, ok := gURLInputOpeners[url]; ok && inputOpener != nil {
+		return fmt.Errorf("Input opener is already set, url=%s", url)
+	}
+	if _, ok := gURLOutputOpeners[url]; ok && outputOpener != nil {
+		return fmt.Errorf("Output opener is already set, url=%s", url)
+	}
+
 	if inputOpener != nil {
-		gMutex.Lock()
 		gURLInputOpeners[url] = inputOpener
-		gMutex.Unlock()
 	}
 
 	if outputOpener != nil {
-		gMutex.Lock()
 		gURLOutputOpeners[url] = outputOpener
-		gMutex.Unlock()
 	}
+	return nil
 }
 
 // Sets specific IO handler for muxing a url/file (similar to InitUrlIOHandler)
 func InitUrlMuxIOHandler(url string, inputOpener InputOpener, muxOutputOpener MuxOutputOpener) {
+	if err := RegisterUrlMuxIOHandler(url, inputOpener, muxOutputOpener); err != nil {
+		log.Error("InitUrlMuxIOHandler", "url", url, "error", err)
+	}
+}
+
+// RegisterUrlMuxIOHandler is InitUrlMuxIOHandler() returning an error if the URL already has an opener
+func RegisterUrlMuxIOHandler(url string, inputOpener InputOpener, muxOutputOpener MuxOutputOpener) error {
+	gMutex.Lock()
+	defer gMutex.Unlock()
+
+	if _, ok := gURLInputOpeners[url]; ok && inputOpener != nil {
+		return fmt.Errorf("Input opener is already set, url=%s", url)
+	}
+	if _, ok := gURLMuxOutputOpeners[url]; ok && muxOutputOpener != nil {
+		return fmt.Errorf("Mux output opener is already set, url=%s", url)
+	}
+
 	if inputOpener != nil {
-		gMutex.Lock()
 		gURLInputOpeners[url] = inputOpener
-		gMutex.Unlock()
 	}
 
 	if muxOutputOpener != nil {
-		gMutex.Lock()
 		gURLMuxOutputOpeners[url] = muxOutputOpener
-		gMutex.Unlock()
 	}
 	log.Debug("InitUrlMuxIOHandler", "url", url, "urlInputOpener", inputOpener == nil, "urlOutputOpener", muxOutputOpener == nil)
+	return nil
 }
 
-func getInputOpener(url string) InputOpener {
+// releaseUrlIOHandlers removes the openers set for url by InitUrlIOHandler() or InitUrlMuxIOHandler()
+func releaseUrlIOHandlers(url string) {
 	gMutex.Lock()
 	defer gMutex.Unlock()
+	delete(gURLInputOpeners, url)
+	delete(gURLOutputOpeners, url)
+	delete(gURLMuxOutputOpeners, url)
+	delete(gURLFrameCallbacks, url)
+}
+
+func getInputOpener(url string) InputOpener {
+	gMutex.RLock()
+	defer gMutex.RUnlock()
 	if inputOpener, ok := gURLInputOpeners[url]; ok {
 		return inputOpener
 	}
@@ -294,8 +486,8 @@ func getInputOpener(url string) InputOpener {
 }
 
 func getOutputOpener(url string) OutputOpener {
-	gMutex.Lock()
-	defer gMutex.Unlock()
+	gMutex.RLock()
+	defer gMutex.RUnlock()
 	if outputOpener, ok := gURLOutputOpeners[url]; ok {
 		return outputOpener
 	}
@@ -305,8 +497,8 @@ func getOutputOpener(url string) OutputOpener {
 
 func getMuxOutputOpener(url string) MuxOutputOpener {
 	log.Debug("getMuxOutputOpener", "url", url)
-	gMutex.Lock()
-	defer gMutex.Unlock()
+	gMutex.RLock()
+	defer gMutex.RUnlock()
 	if muxOutputOpener, ok := gURLMuxOutputOpeners[url]; ok {
 		return muxOutputOpener
 	}
@@ -320,50 +512,89 @@ func putMuxOutputOpener(fd int64, muxOutputHandler OutputHandler) {
 	gMutex.Unlock()
 }
 
-func getOutputOpenerByHandler(h int64) OutputOpener {
-	gMutex.Lock()
-	defer gMutex.Unlock()
-	if outputOpener, ok := gURLOutputOpenersByHandler[h]; ok {
-		return outputOpener
+//export AVPipeOpenInput
+func AVPipeOpenInput(url *C.char, size *C.int64_t) C.int64_t {
+	filename := C.GoString((*C.char)(unsafe.Pointer(url)))
+	fd, inputSize, err := openInput(filename)
+	if err != nil {
+		return C.int64_t(-1)
 	}
 
-	return gOutputOpener
+	*size = C.int64_t(inputSize)
+	return C.int64_t(fd)
 }
 
-//export AVPipeOpenInput
-func AVPipeOpenInput(url *C.char, size *C.int64_t) C.int64_t {
-	filename := C.GoString((*C.char)(unsafe.Pointer(url)))
+// openInput opens the input with the opener registered for filename and adds its handler
+// to the global table. Returns the fd of the handler and the size of the input.
+func openInput(filename string) (int64, int64, error) {
 	urlInputOpener := getInputOpener(filename)
 	urlOutputOpener := getOutputOpener(filename)
 
 	if urlInputOpener == nil || urlOutputOpener == nil {
 		log.Error("Input or output opener(s) are not set", "urlInputOpener", urlInputOpener, "urlOutputOpener", urlOutputOpener)
-		return C.int64_t(-1)
+		return -1, 0, fmt.Errorf("Input or output opener(s) are not set, url=%s", filename)
 	}
 	log.Debug("AVPipeOpenInput()", "url", filename)
 
 	gMutex.Lock()
 	gHandleNum++
 	fd := gHandleNum
-	gURLOutputOpenersByHandler[fd] = urlOutputOpener
 	gMutex.Unlock()
 
 	input, err := urlInputOpener.Open(fd, filename)
 	if err != nil {
-		return C.int64_t(-1)
+		return -1, 0, err
 	}
 
-	*size = C.int64_t(input.Size())
+	size := input.Size()
 
-	h := &ioHandler{input: input, outTable: make(map[int64]OutputHandler), mutex: &sync.Mutex{}}
-	log.Debug("AVPipeOpenInput()", "url", filename, "size", *size, "fd", fd)
+	h := &ioHandler{input: input, url: filename, outOpener: urlOutputOpener, outTable: make(map[int64]OutputHandler), mutex: &sync.Mutex{}}
+	log.Debug("AVPipeOpenInput()", "url", filename, "size", size, "fd", fd)
 
 	gMutex.Lock()
 	defer gMutex.Unlock()
+	h.frameCb = gURLFrameCallbacks[filename]
 	gHandlers[fd] = h
+	return fd, size, nil
+}
+
+//export AVPipeOpenRendition
+func AVPipeOpenRendition(url *C.char) C.int64_t {
+	fd, err := openRendition(C.GoString((*C.char)(unsafe.Pointer(url))))
+	if err != nil {
+		return C.int64_t(-1)
+	}
+
 	return C.int64_t(fd)
 }
 
+// openRendition adds a handler without input for a rendition of XcMulti(), the outputs of the
+// rendition are opened with the output opener of url. Returns the fd of the handler.
+func openRendition(url string) (int64, error) {
+	urlOutputOpener := getOutputOpener(url)
+	if urlOutputOpener == nil {
+		log.Error("Output opener is not set", "url", url)
+		return -1, fmt.Errorf("Output opener is not set, url=%s", url)
+	}
+
+	gMutex.Lock()
+	defer gMutex.Unlock()
+	gHandleNum++
+	fd := gHandleNum
+	gHandlers[fd] = &ioHandler{outOpener: urlOutputOpener, outTable: make(map[int64]OutputHandler), mutex: &sync.Mutex{}}
+	log.Debug("AVPipeOpenRendition()", "url", url, "fd", fd)
+	return fd, nil
+}
+
+//export AVPipeCloseRendition
+func AVPipeCloseRendition(fd C.int64_t) C.int {
+	gMutex.Lock()
+	defer gMutex.Unlock()
+	delete(gHandlers, int64(fd))
+	log.Debug("AVPipeCloseRendition()", "fd", fd)
+	return C.int(0)
+}
+
 //export AVPipeOpenMuxInput
 func AVPipeOpenMuxInput(out_url, url *C.char, size *C.int64_t) C.int64_t {
 	filename := C.GoString((*C.char)(unsafe.Pointer(url)))
@@ -401,31 +632,48 @@ func AVPipeOpenMuxInput(out_url, url *C.char, size *C.int64_t) C.int64_t {
 
 //export AVPipeReadInput
 func AVPipeReadInput(fd C.int64_t, buf *C.uint8_t, sz C.int) C.int {
-	gMutex.Lock()
+	gMutex.RLock()
 	h := gHandlers[int64(fd)]
 	if h == nil {
-		gMutex.Unlock()
+		gMutex.RUnlock()
 		return C.int(-1)
 	}
-	gMutex.Unlock()
+	gMutex.RUnlock()
 
 	if traceIo {
 		log.Debug("AVPipeReadInput()", "fd", fd, "buf", buf, "sz", sz)
 	}
+	if sz <= 0 {
+		return C.int(0)
+	}
 
-	//gobuf := C.GoBytes(unsafe.Pointer(buf), sz)
-	gobuf := make([]byte, sz)
+	// The input handler reads directly into the C buffer, which is not managed by the Go GC, instead of
+	// reading into a Go buffer allocated for each read and copying it. The handler must not keep buf.
+	gobuf := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(sz))
+	return C.int(h.readInput(gobuf))
+}
 
-	n, err := h.InReader(gobuf)
+// readInput reads from the input into buf and returns the number of bytes read, 0 on EOF, -1 on error or
+// readInputTimeout if the read timed out
+func (h *ioHandler) readInput(buf []byte) int {
+	n, err := h.InReader(buf)
+	if n > len(buf) {
+		log.Error("AVPipeReadInput() invalid read", "url", h.url, "n", n, "buf_size", len(buf))
+		return -1
+	}
 	if n > 0 {
-		C.memcpy(unsafe.Pointer(buf), unsafe.Pointer(&gobuf[0]), C.size_t(n))
+		return n
 	}
 
-	if err != nil {
-		return C.int(-1)
+	// 0 is EOF, a negative value is a read error that aborts the transcoding
+	if err == nil || err == io.EOF {
+		return 0
 	}
-
-	return C.int(n)
+	log.Error("AVPipeReadInput()", "url", h.url, "n", n, "error", err)
+	if errors.Is(err, EAV_IO_TIMEOUT) {
+		return readInputTimeout
+	}
+	return -1
 }
 
 func (h *ioHandler) InReader(buf []byte) (int, error) {
@@ -439,13 +687,13 @@ func (h *ioHandler) InReader(buf []byte) (int, error) {
 
 //export AVPipeSeekInput
 func AVPipeSeekInput(fd C.int64_t, offset C.int64_t, whence C.int) C.int64_t {
-	gMutex.Lock()
+	gMutex.RLock()
 	h := gHandlers[int64(fd)]
 	if h == nil {
-		gMutex.Unlock()
+		gMutex.RUnlock()
 		return C.int64_t(-1)
 	}
-	gMutex.Unlock()
+	gMutex.RUnlock()
 	if traceIo {
 		log.Debug("AVPipeSeekInput()", "h", h)
 	}
@@ -465,25 +713,34 @@ func (h *ioHandler) InSeeker(offset C.int64_t, whence C.int) (int64, error) {
 
 //export AVPipeCloseInput
 func AVPipeCloseInput(fd C.int64_t) C.int {
+	if err := closeInput(int64(fd)); err != nil {
+		return C.int(-1)
+	}
+
+	log.Debug("AVPipeCloseInput()", "fd", fd)
+
+	return C.int(0)
+}
+
+// closeInput closes the input of fd and removes its handler from the global table
+func closeInput(fd int64) error {
 	gMutex.Lock()
-	h := gHandlers[int64(fd)]
+	h := gHandlers[fd]
 	if h == nil {
 		gMutex.Unlock()
-		return C.int(-1)
+		return fmt.Errorf("No input handler, fd=%d", fd)
 	}
 	err := h.InCloser()
 
-	// Remove the handler from global table
-	delete(gHandlers, int64(fd))
-	delete(gURLOutputOpenersByHandler, int64(fd))
-	gMutex.Unlock()
-	if err != nil {
-		return C.int(-1)
+	if report, ok := gXcReports[h.url]; ok {
+		report.add(h)
 	}
 
-	log.Debug("AVPipeCloseInput()", "fd", fd)
+	// Remove the handler from global table
+	delete(gHandlers, fd)
+	gMutex.Unlock()
 
-	return C.int(0)
+	return err
 }
 
 func (h *ioHandler) InCloser() error {
@@ -494,13 +751,13 @@ func (h *ioHandler) InCloser() error {
 
 //export AVPipeStatInput
 func AVPipeStatInput(fd C.int64_t, stream_index C.int, avp_stat C.avp_stat_t, stat_args unsafe.Pointer) C.int {
-	gMutex.Lock()
+	gMutex.RLock()
 	h := gHandlers[int64(fd)]
 	if h == nil {
-		gMutex.Unlock()
+		gMutex.RUnlock()
 		return C.int(-1)
 	}
-	gMutex.Unlock()
+	gMutex.RUnlock()
 
 	err := h.InStat(stream_index, avp_stat, stat_args)
 	if err != nil {
@@ -536,6 +793,51 @@ func (h *ioHandler) InStat(stream_index C.int, avp_stat C.avp_stat_t, stat_args
 	case C.in_stat_data_scte35:
 		statArgs := C.GoString((*C.char)(stat_args))
 		err = h.input.Stat(streamIndex, AV_IN_STAT_DATA_SCTE35, statArgs)
+	case C.in_stat_video_frames_dropped:
+		statArgs := *(*uint64)(stat_args)
+		err = h.input.Stat(streamIndex, AV_IN_STAT_VIDEO_FRAMES_DROPPED, &statArgs)
+	case C.in_stat_decode_progress:
+		decodeProgress := (*C.decode_progress_t)(stat_args)
+		statArgs := &DecodeProgress{
+			VideoFramesDecoded: int64(decodeProgress.video_frames_decoded),
+			AudioFramesDecoded: int64(decodeProgress.audio_frames_decoded),
+			PacketsDropped:     int64(decodeProgress.video_packets_dropped + decodeProgress.audio_packets_dropped),
+			VideoFramesDropped: int64(decodeProgress.video_frames_dropped),
+			InputPTS:           int64(decodeProgress.input_pts),
+		}
+		err = h.input.Stat(streamIndex, AV_IN_STAT_DECODE_PROGRESS, statArgs)
+	case C.in_stat_scte35:
+		event := (*C.scte35_event_t)(stat_args)
+		statArgs := &SCTE35Event{
+			PTS:         int64(event.pts),
+			CommandType: uint8(event.command_type),
+			Data:        C.GoBytes(unsafe.Pointer(event.data), event.data_len),
+		}
+		err = h.input.Stat(streamIndex, AV_IN_STAT_SCTE35, statArgs)
+	case C.in_stat_xc_timing:
+		timing := (*C.xc_timing_t)(stat_args)
+		statArgs := &XcTiming{
+			DecodeNs: int64(timing.decode_ns),
+			FilterNs: int64(timing.filter_ns),
+			EncodeNs: int64(timing.encode_ns),
+			MuxNs:    int64(timing.mux_ns),
+			TotalNs:  int64(timing.total_ns),
+		}
+		err = h.input.Stat(streamIndex, AV_IN_STAT_XC_TIMING, statArgs)
+	case C.in_stat_frame:
+		if h.frameCb != nil {
+			info := (*C.frame_info_t)(stat_args)
+			h.frameCb(goavpipe.FrameDebugInfo{
+				StreamIndex: streamIndex,
+				IsAudio:     info.is_audio != 0,
+				PTS:         int64(info.pts),
+				DTS:         int64(info.dts),
+				Duration:    int64(info.duration),
+				Size:        int(info.size),
+				KeyFrame:    info.key_frame != 0,
+				Quantizer:   int(info.quantizer),
+			})
+		}
 	}
 
 	return err
@@ -549,7 +851,74 @@ func (h *ioHandler) putOutTable(fd int64, outHandler OutputHandler) {
 		h.outTable[fd] = outHandler
 	} else {
 		delete(h.outTable, fd)
+		if o, ok := h.outputs[fd]; ok {
+			h.closed = append(h.closed, o.artifact)
+			delete(h.outputs, fd)
+		}
+	}
+}
+
+// openOutput starts tracking the output fd
+func (h *ioHandler) openOutput(fd int64, streamIndex, segIndex int, outType goavpipe.AVType) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.outputs == nil {
+		h.outputs = make(map[int64]*outputState)
+	}
+	h.outputs[fd] = &outputState{artifact: OutputArtifact{Type: outType, StreamIndex: streamIndex, SegIndex: segIndex}}
+}
+
+// moveOutput moves the write offset of the output fd after writing (io.SeekCurrent) or seeking (io.SeekStart)
+func (h *ioHandler) moveOutput(fd int64, offset int64, whence int) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if o, ok := h.outputs[fd]; ok {
+		if whence == io.SeekCurrent {
+			offset += o.offset
+		}
+		o.offset = offset
+		if offset > o.artifact.Bytes {
+			o.artifact.Bytes = offset
+		}
+	}
+}
+
+// segmentDone accounts a segment of the output stream streamIndex in the segment summaries
+func (h *ioHandler) segmentDone(streamIndex int, avType goavpipe.AVType, stats SegmentStats) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	if h.segments == nil {
+		h.segments = make(map[segmentKey]*segmentSummary)
+	}
+	key := segmentKey{avType: avType, streamIndex: streamIndex}
+	summary, ok := h.segments[key]
+	if !ok {
+		summary = &segmentSummary{last: stats}
+		h.segments[key] = summary
+	} else if stats.SegIndex > summary.last.SegIndex {
+		summary.last = stats
+	}
+	summary.frames += stats.Frames
+}
+
+// artifacts returns the artifacts of the closed outputs followed by the ones still open
+func (h *ioHandler) artifacts() []OutputArtifact {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	artifacts := append([]OutputArtifact{}, h.closed...)
+	fds := make([]int64, 0, len(h.outputs))
+	for fd := range h.outputs {
+		fds = append(fds, fd)
 	}
+	sort.Slice(fds, func(i, j int) bool { return fds[i] < fds[j] })
+	for _, fd := range fds {
+		artifacts = append(artifacts, h.outputs[fd].artifact)
+	}
+	return artifacts
 }
 
 func (h *ioHandler) getOutTable(fd int64) OutputHandler {
@@ -595,6 +964,18 @@ func getAVType(av_type C.int) goavpipe.AVType {
 		return goavpipe.FrameImage
 	case C.avpipe_mpegts_segment:
 		return goavpipe.MpegtsSegment
+	case C.avpipe_webvtt_init_stream:
+		return goavpipe.WebVTTInit
+	case C.avpipe_webvtt_segment:
+		return goavpipe.WebVTTSegment
+	case C.avpipe_image_thumbnail:
+		return goavpipe.ImageThumbnail
+	case C.avpipe_video_webm_stream:
+		return goavpipe.WebMVideoStream
+	case C.avpipe_audio_webm_stream:
+		return goavpipe.WebMAudioStream
+	case C.avpipe_index_sidecar:
+		return goavpipe.IndexSidecar
 	default:
 		return goavpipe.Unknown
 	}
@@ -602,37 +983,50 @@ func getAVType(av_type C.int) goavpipe.AVType {
 
 //export AVPipeOpenOutput
 func AVPipeOpenOutput(handler C.int64_t, stream_index, seg_index C.int, pts C.int64_t, stream_type C.int) C.int64_t {
+	out_type := getAVType(stream_type)
+	if out_type == goavpipe.Unknown {
+		log.Error("AVPipeOpenOutput()", "invalid stream type", stream_type)
+		return C.int64_t(-1)
+	}
+
+	fd, err := openOutputHandler(int64(handler), int(stream_index), int(seg_index), int64(pts), out_type)
+	if err != nil {
+		return C.int64_t(-1)
+	}
+	return C.int64_t(fd)
+}
 
+// openOutputHandler opens an output of the input handler with the output opener of the handler and adds
+// it to the outputs of the handler. Returns the fd of the output.
+func openOutputHandler(handler int64, streamIndex, segIndex int, pts int64, outType goavpipe.AVType) (int64, error) {
 	gMutex.Lock()
-	h := gHandlers[int64(handler)]
+	h := gHandlers[handler]
 	if h == nil {
 		gMutex.Unlock()
-		return C.int64_t(-1)
+		return -1, fmt.Errorf("No input handler, handler=%d", handler)
 	}
 	gFd++
 	fd := gFd
 	gMutex.Unlock()
-	out_type := getAVType(stream_type)
-	if out_type == goavpipe.Unknown {
-		log.Error("AVPipeOpenOutput()", "invalid stream type", stream_type)
-		return C.int64_t(-1)
-	}
 
-	outputOpener := getOutputOpenerByHandler(int64(handler))
+	// The output opener resolved for the URL of the handler when it was opened, not the global one, so
+	// concurrent jobs with URL specific openers never open the outputs of another job
+	outputOpener := h.outOpener
 	if outputOpener == nil {
 		log.Error("AVPipeOpenOutput() nil outputOpener", "handler", handler)
-		return C.int64_t(-1)
+		return -1, fmt.Errorf("Output opener is not set, handler=%d", handler)
 	}
-	outHandler, err := outputOpener.Open(int64(handler), fd, int(stream_index), int(seg_index), int64(pts), out_type)
+	outHandler, err := outputOpener.Open(handler, fd, streamIndex, segIndex, pts, outType)
 	if err != nil {
-		log.Error("AVPipeOpenOutput()", "out_type", out_type, "error", err)
-		return C.int64_t(-1)
+		log.Error("AVPipeOpenOutput()", "out_type", outType, "error", err)
+		return -1, err
 	}
 
-	log.Debug("AVPipeOpenOutput()", "fd", fd, "stream_index", stream_index, "seg_index", seg_index, "pts", pts, "out_type", out_type)
+	log.Debug("AVPipeOpenOutput()", "fd", fd, "stream_index", streamIndex, "seg_index", segIndex, "pts", pts, "out_type", outType)
 	h.putOutTable(fd, outHandler)
+	h.openOutput(fd, streamIndex, segIndex, outType)
 
-	return C.int64_t(fd)
+	return fd, nil
 }
 
 //export AVPipeOpenMuxOutput
@@ -679,13 +1073,13 @@ func AVPipeWriteOutput(handler C.int64_t, fd C.int64_t, buf *C.uint8_t, sz C.int
 		return C.int(0)
 	}
 
-	gMutex.Lock()
+	gMutex.RLock()
 	h := gHandlers[int64(handler)]
 	if h == nil {
-		gMutex.Unlock()
+		gMutex.RUnlock()
 		return C.int(-1)
 	}
-	gMutex.Unlock()
+	gMutex.RUnlock()
 	if traceIo {
 		log.Debug("AVPipeWriteOutput", "fd", fd, "sz", sz)
 	}
@@ -695,11 +1089,9 @@ func AVPipeWriteOutput(handler C.int64_t, fd C.int64_t, buf *C.uint8_t, sz C.int
 		panic(msg)
 	}
 
-	//gobuf := C.GoBytes(unsafe.Pointer(buf), sz)
-	// This should be the equivalent of using GoBytes() but safer if the
-	// Go implementation uses C pointer to wrap a slice.
-	gobuf := make([]byte, sz)
-	C.memcpy(unsafe.Pointer(&gobuf[0]), unsafe.Pointer(buf), C.size_t(sz))
+	// The output handler writes the avio buffer directly instead of a copy allocated for each write, the
+	// buffer is only valid during the call
+	gobuf := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(sz))
 
 	n, err := h.OutWriter(fd, gobuf)
 	if err != nil {
@@ -715,16 +1107,19 @@ func AVPipeWriteMuxOutput(fd C.int64_t, buf *C.uint8_t, sz C.int) C.int {
 		log.Debug("AVPipeWriteMuxOutput", "fd", fd, "sz", sz)
 	}
 
-	gMutex.Lock()
+	gMutex.RLock()
 	outHandler := gMuxHandlers[int64(fd)]
 	if outHandler == nil {
-		gMutex.Unlock()
+		gMutex.RUnlock()
 		return C.int(-1)
 	}
-	gMutex.Unlock()
+	gMutex.RUnlock()
+	if sz <= 0 {
+		return C.int(0)
+	}
 
-	gobuf := C.GoBytes(unsafe.Pointer(buf), sz)
-	n, err := outHandler.Write(gobuf)
+	gobuf := unsafe.Slice((*byte)(unsafe.Pointer(buf)), int(sz))
+	n, err := writeFull(outHandler, gobuf)
 	if err != nil {
 		return C.int(-1)
 	}
@@ -732,9 +1127,33 @@ func AVPipeWriteMuxOutput(fd C.int64_t, buf *C.uint8_t, sz C.int) C.int {
 	return C.int(n)
 }
 
+// writeFull writes the whole buf to w like io.Writer requires: after a short write (i.e. by a network writer)
+// it writes the rest of buf, until it is written or w returns an error, since the AVIOContext doesn't retry
+// and the rest would be lost. A write of no byte without an error returns io.ErrShortWrite instead of looping.
+func writeFull(w io.Writer, buf []byte) (int, error) {
+	written := 0
+	for written < len(buf) {
+		n, err := w.Write(buf[written:])
+		if n < 0 || n > len(buf)-written {
+			return written, fmt.Errorf("invalid write count %d, size=%d", n, len(buf)-written)
+		}
+		written += n
+		if err != nil {
+			return written, err
+		}
+		if n == 0 {
+			return written, io.ErrShortWrite
+		}
+	}
+	return written, nil
+}
+
 func (h *ioHandler) OutWriter(fd C.int64_t, buf []byte) (int, error) {
 	outHandler := h.getOutTable(int64(fd))
-	n, err := outHandler.Write(buf)
+	n, err := writeFull(outHandler, buf)
+	if n > 0 {
+		h.moveOutput(int64(fd), int64(n), io.SeekCurrent)
+	}
 	if traceIo {
 		log.Debug("OutWriter written", "n", n, "error", err)
 	}
@@ -743,13 +1162,13 @@ func (h *ioHandler) OutWriter(fd C.int64_t, buf []byte) (int, error) {
 
 //export AVPipeSeekOutput
 func AVPipeSeekOutput(handler C.int64_t, fd C.int64_t, offset C.int64_t, whence C.int) C.int64_t {
-	gMutex.Lock()
+	gMutex.RLock()
 	h := gHandlers[int64(handler)]
 	if h == nil {
-		gMutex.Unlock()
+		gMutex.RUnlock()
 		return C.int64_t(-1)
 	}
-	gMutex.Unlock()
+	gMutex.RUnlock()
 	n, err := h.OutSeeker(fd, offset, whence)
 	if err != nil {
 		return C.int64_t(-1)
@@ -759,13 +1178,13 @@ func AVPipeSeekOutput(handler C.int64_t, fd C.int64_t, offset C.int64_t, whence
 
 //export AVPipeSeekMuxOutput
 func AVPipeSeekMuxOutput(fd C.int64_t, offset C.int64_t, whence C.int) C.int64_t {
-	gMutex.Lock()
+	gMutex.RLock()
 	outHandler := gMuxHandlers[int64(fd)]
 	if outHandler == nil {
-		gMutex.Unlock()
+		gMutex.RUnlock()
 		return C.int64_t(-1)
 	}
-	gMutex.Unlock()
+	gMutex.RUnlock()
 
 	n, err := outHandler.Seek(int64(offset), int(whence))
 	if err != nil {
@@ -778,18 +1197,21 @@ func (h *ioHandler) OutSeeker(fd C.int64_t, offset C.int64_t, whence C.int) (int
 	outHandler := h.getOutTable(int64(fd))
 	n, err := outHandler.Seek(int64(offset), int(whence))
 	log.Debug("OutSeeker", "err", err)
+	if err == nil {
+		h.moveOutput(int64(fd), n, io.SeekStart)
+	}
 	return n, err
 }
 
 //export AVPipeCloseOutput
 func AVPipeCloseOutput(handler C.int64_t, fd C.int64_t) C.int {
-	gMutex.Lock()
+	gMutex.RLock()
 	h := gHandlers[int64(handler)]
 	if h == nil {
-		gMutex.Unlock()
+		gMutex.RUnlock()
 		return C.int(-1)
 	}
-	gMutex.Unlock()
+	gMutex.RUnlock()
 	defer h.putOutTable(int64(fd), nil)
 	err := h.OutCloser(fd)
 	if err != nil {
@@ -803,15 +1225,20 @@ func AVPipeCloseOutput(handler C.int64_t, fd C.int64_t) C.int {
 
 //export AVPipeCloseMuxOutput
 func AVPipeCloseMuxOutput(fd C.int64_t) C.int {
-	gMutex.Lock()
+	gMutex.RLock()
 	outHandler := gMuxHandlers[int64(fd)]
 	if outHandler == nil {
-		gMutex.Unlock()
+		gMutex.RUnlock()
 		return C.int(-1)
 	}
-	gMutex.Unlock()
+	gMutex.RUnlock()
 
 	err := outHandler.Close()
+
+	// Remove the handler from global table
+	gMutex.Lock()
+	delete(gMuxHandlers, int64(fd))
+	gMutex.Unlock()
 	if err != nil {
 		return C.int(-1)
 	}
@@ -838,13 +1265,13 @@ func AVPipeStatOutput(handler C.int64_t,
 	avp_stat C.avp_stat_t,
 	stat_args unsafe.Pointer) C.int {
 
-	gMutex.Lock()
+	gMutex.RLock()
 	h := gHandlers[int64(handler)]
 	if h == nil {
-		gMutex.Unlock()
+		gMutex.RUnlock()
 		return C.int(-1)
 	}
-	gMutex.Unlock()
+	gMutex.RUnlock()
 
 	err := h.OutStat(fd, stream_index, buf_type, avp_stat, stat_args)
 	if err != nil {
@@ -856,13 +1283,13 @@ func AVPipeStatOutput(handler C.int64_t,
 
 //export AVPipeStatMuxOutput
 func AVPipeStatMuxOutput(fd C.int64_t, stream_index C.int, avp_stat C.avp_stat_t, stat_args unsafe.Pointer) C.int {
-	gMutex.Lock()
+	gMutex.RLock()
 	outHandler := gMuxHandlers[int64(fd)]
 	if outHandler == nil {
-		gMutex.Unlock()
+		gMutex.RUnlock()
 		return C.int(-1)
 	}
-	gMutex.Unlock()
+	gMutex.RUnlock()
 
 	streamIndex := (int)(stream_index)
 	var err error
@@ -887,6 +1314,48 @@ type EncodingFrameStats struct {
 	FramesWritten      int64 `json:"segment_frames_written"` // Number of frames encoded in current segment
 }
 
+// DecodeProgress is reported with AV_IN_STAT_DECODE_PROGRESS every XcParams.DecodeProgressInterval ms
+// while the input is read. The stream index of the stat is the stream of InputPTS.
+type DecodeProgress struct {
+	VideoFramesDecoded int64 `json:"video_frames_decoded"` // Video frames decoded so far
+	AudioFramesDecoded int64 `json:"audio_frames_decoded"` // Audio frames decoded so far
+	PacketsDropped     int64 `json:"packets_dropped"`      // Packets rejected by the decoders as invalid
+	VideoFramesDropped int64 `json:"video_frames_dropped"` // Video frames dropped by the live drop policy
+	InputPTS           int64 `json:"input_pts"`            // PTS of the last packet read, in the time base of its stream
+}
+
+// XcTiming is reported with AV_IN_STAT_XC_TIMING once when a transcoding ends, the stream index of the
+// stat is -1. The stage times are wall clock times summed over the audio and video streams (and the
+// renditions). Audio and video are transcoded in parallel, so the sum of the stages can exceed TotalNs.
+type XcTiming struct {
+	DecodeNs int64 `json:"decode_ns"` // Time spent decoding
+	FilterNs int64 `json:"filter_ns"` // Time spent in the filter graphs (scaling, watermarks, resampling)
+	EncodeNs int64 `json:"encode_ns"` // Time spent encoding
+	MuxNs    int64 `json:"mux_ns"`    // Time spent writing packets to the outputs, including the output handlers
+	TotalNs  int64 `json:"total_ns"`  // Time of the whole transcoding
+}
+
+// SCTE35Event is reported with AV_IN_STAT_SCTE35 for each splice_schedule, splice_insert and time_signal
+// section of the SCTE-35 stream of the input. The stream index of the stat is the SCTE-35 stream.
+// Data is the complete splice info section, it can be parsed with github.com/Comcast/gots/scte35 and
+// ts.ConvertGots. PTS is when the section arrived, the splice time of splice_insert and time_signal is
+// the pts_time plus the pts_adjustment of the section, on the same 90 kHz clock.
+type SCTE35Event struct {
+	PTS         int64  `json:"pts"`          // PTS of the SCTE-35 packet, in the time base of its stream (90 kHz)
+	CommandType uint8  `json:"command_type"` // Splice command type (4 splice_schedule, 5 splice_insert, 6 time_signal)
+	Data        []byte `json:"data"`         // Splice info section
+}
+
+// SegmentStats is reported with AV_OUT_STAT_SEGMENT_DONE when an output segment is complete.
+// The PTS are in the time base of the output stream.
+type SegmentStats struct {
+	SegIndex int   `json:"seg_index"` // Index of the segment
+	StartPTS int64 `json:"start_pts"` // PTS of the first frame of the segment
+	EndPTS   int64 `json:"end_pts"`   // PTS + duration of the last frame of the segment
+	Bytes    int64 `json:"bytes"`     // Size of the segment in bytes
+	Frames   int64 `json:"frames"`    // Number of frames in the segment
+}
+
 func (h *ioHandler) OutStat(fd C.int64_t,
 	stream_index C.int,
 	av_type C.avpipe_buftype_t,
@@ -914,6 +1383,9 @@ func (h *ioHandler) OutStat(fd C.int64_t,
 	case C.out_stat_end_file:
 		statArgs := *(*int)(stat_args)
 		err = outHandler.Stat(streamIndex, avType, AV_OUT_STAT_END_FILE, &statArgs)
+	case C.out_stat_segment_verify_failed:
+		statArgs := *(*int)(stat_args)
+		err = outHandler.Stat(streamIndex, avType, AV_OUT_STAT_SEGMENT_VERIFY_FAILED, &statArgs)
 	case C.out_stat_frame_written:
 		encodingFramesStats := (*C.encoding_frame_stats_t)(stat_args)
 		statArgs := &EncodingFrameStats{
@@ -921,6 +1393,17 @@ func (h *ioHandler) OutStat(fd C.int64_t,
 			FramesWritten:      int64(encodingFramesStats.frames_written),
 		}
 		err = outHandler.Stat(streamIndex, avType, AV_OUT_STAT_FRAME_WRITTEN, statArgs)
+	case C.out_stat_segment_done:
+		segmentStats := (*C.segment_stats_t)(stat_args)
+		statArgs := &SegmentStats{
+			SegIndex: int(segmentStats.seg_index),
+			StartPTS: int64(segmentStats.start_pts),
+			EndPTS:   int64(segmentStats.end_pts),
+			Bytes:    int64(segmentStats.bytes),
+			Frames:   int64(segmentStats.frames),
+		}
+		h.segmentDone(streamIndex, avType, *statArgs)
+		err = outHandler.Stat(streamIndex, avType, AV_OUT_STAT_SEGMENT_DONE, statArgs)
 	}
 
 	return err
@@ -977,85 +1460,259 @@ func CError(msg *C.char) C.int {
 	return C.int(len(m))
 }
 
-func SetCLoggers() {
-	C.set_loggers()
+// CAVLog logs an ffmpeg log message at the level of its native AV_LOG_* level (see avLogLevel)
+//
+//export CAVLog
+func CAVLog(level C.int, msg *C.char) C.int {
+	m := C.GoString((*C.char)(unsafe.Pointer(msg)))
+	switch avLogLevel(int(level)) {
+	case "error":
+		log.Error(m)
+	case "warn":
+		log.Warn(m)
+	case "info":
+		log.Info(m)
+	case "debug":
+		log.Debug(m)
+	case "trace":
+		log.Trace(m)
+	default:
+		return C.int(0)
+	}
+	return C.int(len(m))
 }
 
-// GetVersion ...
-func Version() string {
-	return C.GoString((*C.char)(unsafe.Pointer(C.avpipe_version())))
+// avLogLevel returns the level ffmpeg messages of the native av_log level are logged at: AV_LOG_PANIC to
+// AV_LOG_ERROR at "error", AV_LOG_WARNING at "warn", AV_LOG_INFO at "info", AV_LOG_DEBUG at "debug",
+// AV_LOG_VERBOSE and AV_LOG_TRACE at "trace", which suppresses them unless trace logging is enabled.
+// Levels in between go with the next less severe one. Returns "" for AV_LOG_QUIET, which is not logged.
+func avLogLevel(level int) string {
+	switch {
+	case level < C.AV_LOG_PANIC:
+		return ""
+	case level <= C.AV_LOG_ERROR:
+		return "error"
+	case level <= C.AV_LOG_WARNING:
+		return "warn"
+	case level <= C.AV_LOG_INFO:
+		return "info"
+	case level <= C.AV_LOG_VERBOSE:
+		return "trace"
+	case level <= C.AV_LOG_DEBUG:
+		return "debug"
+	default:
+		return "trace"
+	}
 }
 
-func getCParams(params *goavpipe.XcParams) (*C.xcparams_t, error) {
+func SetCLoggers() {
+	C.set_loggers()
+}
+
+// SetLogLevel sets the level of the ffmpeg logs forwarded to the loggers: one of "quiet", "panic", "fatal",
+// "error", "warning", "info" (default), "verbose", "debug" or "trace"
+func SetLogLevel(level string) error {
+	cLevel := C.CString(level)
+	defer C.free(unsafe.Pointer(cLevel))
+
+	if rc := C.set_ffmpeg_log_level(cLevel); rc < 0 {
+		return fmt.Errorf("Invalid log level %s", level)
+	}
+	return nil
+}
+
+// GetVersion ...
+func Version() string {
+	return C.GoString((*C.char)(unsafe.Pointer(C.avpipe_version())))
+}
+
+// streamMapIndexes returns the video, audio and subtitle input stream indexes of params.StreamMap. The video index
+// is -1 (the first video stream), and AudioIndex and SubtitleIndex are kept, if the map has no stream of their role.
+func streamMapIndexes(params *goavpipe.XcParams) (videoIndex int32, audioIndex []int32, subtitleIndex int32, err error) {
+	videoIndex, subtitleIndex = -1, params.SubtitleIndex
+	hasVideo, hasSubtitle := false, false
+	for _, m := range params.StreamMap {
+		if m.InputIndex < 0 {
+			return 0, nil, 0, fmt.Errorf("Invalid stream map, input_index=%d role=%s", m.InputIndex, m.Role)
+		}
+		switch m.Role {
+		case goavpipe.StreamRoleVideo:
+			if hasVideo {
+				return 0, nil, 0, fmt.Errorf("Invalid stream map, more than one video stream")
+			}
+			videoIndex, hasVideo = m.InputIndex, true
+		case goavpipe.StreamRoleAudio:
+			audioIndex = append(audioIndex, m.InputIndex)
+		case goavpipe.StreamRoleSubtitle:
+			if hasSubtitle {
+				return 0, nil, 0, fmt.Errorf("Invalid stream map, more than one subtitle stream")
+			}
+			subtitleIndex, hasSubtitle = m.InputIndex, true
+		default:
+			return 0, nil, 0, fmt.Errorf("Invalid stream map, role=%s", m.Role)
+		}
+	}
+
+	if len(audioIndex) == 0 {
+		audioIndex = params.AudioIndex
+	} else if len(params.AudioIndex) > 0 || params.AudioLanguage != "" {
+		return 0, nil, 0, fmt.Errorf("Invalid stream map, the audio streams are also set by AudioIndex or AudioLanguage")
+	}
+	return videoIndex, audioIndex, subtitleIndex, nil
+}
+
+// muxerOptsString returns opts as the key=value pairs separated by ':' of xcparams_t.muxer_opts, sorted by
+// key. The separators and the escape characters of the keys and values are escaped for av_dict_parse_string().
+func muxerOptsString(opts map[string]string) string {
+	keys := make([]string, 0, len(opts))
+	for k := range opts {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	escaper := strings.NewReplacer(`\`, `\\`, `'`, `\'`, "=", `\=`, ":", `\:`)
+	pairs := make([]string, len(keys))
+	for i, k := range keys {
+		pairs[i] = escaper.Replace(k) + "=" + escaper.Replace(opts[k])
+	}
+	return strings.Join(pairs, ":")
+}
+
+// getCParams converts params to C xcparams_t. The strings and arrays are allocated in C memory,
+// the caller releases them with avpipe_release_xcparams after the C call returns.
+func getCParams(params *goavpipe.XcParams) (*C.xcparams_t, error) {
 	extractImagesSize := len(params.ExtractImagesTs)
 
+	videoIndex, audioIndex, subtitleIndex, err := streamMapIndexes(params)
+	if err != nil {
+		return nil, err
+	}
+
 	// same field order as avpipe_xc.h
 	cparams := &C.xcparams_t{
-		url:                       C.CString(params.Url),
-		format:                    C.CString(params.Format),
-		start_time_ts:             C.int64_t(params.StartTimeTs),
-		start_pts:                 C.int64_t(params.StartPts),
-		duration_ts:               C.int64_t(params.DurationTs),
-		start_segment_str:         C.CString(params.StartSegmentStr),
-		video_bitrate:             C.int(params.VideoBitrate),
-		audio_bitrate:             C.int(params.AudioBitrate),
-		sample_rate:               C.int(params.SampleRate),
-		crf_str:                   C.CString(params.CrfStr),
-		preset:                    C.CString(params.Preset),
-		rc_max_rate:               C.int(params.RcMaxRate),
-		rc_buffer_size:            C.int(params.RcBufferSize),
-		audio_seg_duration_ts:     C.int64_t(params.AudioSegDurationTs),
-		video_seg_duration_ts:     C.int64_t(params.VideoSegDurationTs),
-		seg_duration:              C.CString(params.SegDuration),
-		start_fragment_index:      C.int(params.StartFragmentIndex),
-		force_keyint:              C.int(params.ForceKeyInt),
-		ecodec:                    C.CString(params.Ecodec),
-		ecodec2:                   C.CString(params.Ecodec2),
-		dcodec:                    C.CString(params.Dcodec),
-		dcodec2:                   C.CString(params.Dcodec2),
-		enc_height:                C.int(params.EncHeight),
-		enc_width:                 C.int(params.EncWidth),
-		crypt_iv:                  C.CString(params.CryptIV),
-		crypt_key:                 C.CString(params.CryptKey),
-		crypt_kid:                 C.CString(params.CryptKID),
-		crypt_key_url:             C.CString(params.CryptKeyURL),
-		crypt_scheme:              C.crypt_scheme_t(params.CryptScheme),
-		xc_type:                   C.xc_type_t(params.XcType),
-		watermark_text:            C.CString(params.WatermarkText),
-		watermark_timecode:        C.CString(params.WatermarkTimecode),
-		watermark_timecode_rate:   C.float(params.WatermarkTimecodeRate),
-		watermark_xloc:            C.CString(params.WatermarkXLoc),
-		watermark_yloc:            C.CString(params.WatermarkYLoc),
-		watermark_relative_sz:     C.float(params.WatermarkRelativeSize),
-		watermark_font_color:      C.CString(params.WatermarkFontColor),
-		watermark_shadow:          C.int(0),
-		watermark_shadow_color:    C.CString(params.WatermarkShadowColor),
-		watermark_overlay:         C.CString(params.WatermarkOverlay),
-		watermark_overlay_len:     C.int(params.WatermarkOverlayLen),
-		watermark_overlay_type:    C.image_type(params.WatermarkOverlayType),
-		n_audio:                   C.int(len(params.AudioIndex)),
-		channel_layout:            C.int(params.ChannelLayout),
-		stream_id:                 C.int(params.StreamId),
-		bypass_transcoding:        C.int(0),
-		seekable:                  C.int(0),
-		max_cll:                   C.CString(params.MaxCLL),
-		master_display:            C.CString(params.MasterDisplay),
-		bitdepth:                  C.int(params.BitDepth),
-		mux_spec:                  C.CString(params.MuxingSpec),
-		sync_audio_to_stream_id:   C.int(params.SyncAudioToStreamId),
-		gpu_index:                 C.int(params.GPUIndex),
-		listen:                    C.int(0),
-		connection_timeout:        C.int(params.ConnectionTimeout),
-		filter_descriptor:         C.CString(params.FilterDescriptor),
-		skip_decoding:             C.int(0),
-		extract_image_interval_ts: C.int64_t(params.ExtractImageIntervalTs),
-		extract_images_sz:         C.int(extractImagesSize),
-		video_time_base:           C.int(params.VideoTimeBase),
-		video_frame_duration_ts:   C.int(params.VideoFrameDurationTs),
-		rotate:                    C.int(params.Rotate),
-		profile:                   C.CString(params.Profile),
-		level:                     C.int(params.Level),
-		deinterlace:               C.dif_type(params.Deinterlace),
+		url:                        C.CString(params.Url),
+		format:                     C.CString(params.Format),
+		start_time_ts:              C.int64_t(params.StartTimeTs),
+		start_pts:                  C.int64_t(params.StartPts),
+		duration_ts:                C.int64_t(params.DurationTs),
+		start_segment_str:          C.CString(params.StartSegmentStr),
+		video_bitrate:              C.int(params.VideoBitrate),
+		audio_bitrate:              C.int(params.AudioBitrate),
+		sample_rate:                C.int(params.SampleRate),
+		crf_str:                    C.CString(params.CrfStr),
+		preset:                     C.CString(params.Preset),
+		rc_max_rate:                C.int(params.RcMaxRate),
+		rc_buffer_size:             C.int(params.RcBufferSize),
+		rate_control:               C.CString(params.RateControl),
+		audio_seg_duration_ts:      C.int64_t(params.AudioSegDurationTs),
+		video_seg_duration_ts:      C.int64_t(params.VideoSegDurationTs),
+		seg_duration:               C.CString(params.SegDuration),
+		start_fragment_index:       C.int(params.StartFragmentIndex),
+		force_keyint:               C.int(params.ForceKeyInt),
+		max_b_frames:               C.int(params.MaxBFrames),
+		ref_frames:                 C.int(params.RefFrames),
+		ecodec:                     C.CString(params.Ecodec),
+		ecodec2:                    C.CString(params.Ecodec2),
+		dcodec:                     C.CString(params.Dcodec),
+		dcodec2:                    C.CString(params.Dcodec2),
+		enc_height:                 C.int(params.EncHeight),
+		enc_width:                  C.int(params.EncWidth),
+		crypt_iv:                   C.CString(params.CryptIV),
+		crypt_key:                  C.CString(params.CryptKey),
+		crypt_kid:                  C.CString(params.CryptKID),
+		crypt_key_url:              C.CString(params.CryptKeyURL),
+		crypt_scheme:               C.crypt_scheme_t(params.CryptScheme),
+		xc_type:                    C.xc_type_t(params.XcType),
+		watermark_text:             C.CString(params.WatermarkText),
+		watermark_timecode:         C.CString(params.WatermarkTimecode),
+		watermark_timecode_rate:    C.float(params.WatermarkTimecodeRate),
+		watermark_xloc:             C.CString(params.WatermarkXLoc),
+		watermark_yloc:             C.CString(params.WatermarkYLoc),
+		watermark_relative_sz:      C.float(params.WatermarkRelativeSize),
+		watermark_font_color:       C.CString(params.WatermarkFontColor),
+		watermark_shadow:           C.int(0),
+		watermark_shadow_color:     C.CString(params.WatermarkShadowColor),
+		watermark_overlay:          C.CString(params.WatermarkOverlay),
+		watermark_overlay_len:      C.int(params.WatermarkOverlayLen),
+		watermark_overlay_type:     C.image_type(params.WatermarkOverlayType),
+		n_audio:                    C.int(len(audioIndex)),
+		channel_layout:             C.int(params.ChannelLayout),
+		stream_id:                  C.int(params.StreamId),
+		bypass_transcoding:         C.int(0),
+		seekable:                   C.int(0),
+		max_cll:                    C.CString(params.MaxCLL),
+		master_display:             C.CString(params.MasterDisplay),
+		bitdepth:                   C.int(params.BitDepth),
+		mux_spec:                   C.CString(params.MuxingSpec),
+		sync_audio_to_stream_id:    C.int(params.SyncAudioToStreamId),
+		gpu_index:                  C.int(params.GPUIndex),
+		listen:                     C.int(0),
+		connection_timeout:         C.int(params.ConnectionTimeout),
+		filter_descriptor:          C.CString(params.FilterDescriptor),
+		skip_decoding:              C.int(0),
+		extract_image_interval_ts:  C.int64_t(params.ExtractImageIntervalTs),
+		extract_images_sz:          C.int(extractImagesSize),
+		video_time_base:            C.int(params.VideoTimeBase),
+		video_frame_duration_ts:    C.int(params.VideoFrameDurationTs),
+		rotate:                     C.int(params.Rotate),
+		profile:                    C.CString(params.Profile),
+		level:                      C.int(params.Level),
+		deinterlace:                C.dif_type(params.Deinterlace),
+		subtitle_index:             C.int(subtitleIndex),
+		burn_subtitle_stream_index: C.int(params.BurnSubtitleStreamIndex),
+		burn_subtitle_font:         C.CString(params.BurnSubtitleFont),
+		burn_subtitle_relative_sz:  C.float(params.BurnSubtitleRelativeSize),
+		burn_subtitle_alignment:    C.int(params.BurnSubtitleAlignment),
+		burn_subtitle_margin_v:     C.int(params.BurnSubtitleMarginV),
+		live_drop_threshold:        C.int(params.LiveDropThreshold),
+		decode_progress_interval:   C.int(params.DecodeProgressInterval),
+		thumbnail_interval_sec:     C.float(params.ThumbnailIntervalSec),
+		thumbnail_width:            C.int(params.ThumbnailWidth),
+		output_base_pts:            C.int64_t(params.OutputBasePts),
+		lut_file:                   C.CString(params.LutFile),
+		crop_x:                     C.int(params.CropX),
+		crop_y:                     C.int(params.CropY),
+		crop_w:                     C.int(params.CropW),
+		crop_h:                     C.int(params.CropH),
+		pad_left:                   C.int(params.PadLeft),
+		pad_right:                  C.int(params.PadRight),
+		pad_top:                    C.int(params.PadTop),
+		pad_bottom:                 C.int(params.PadBottom),
+		pad_color:                  C.CString(params.PadColor),
+		enc_frame_rate:             C.CString(params.EncFrameRate),
+		scale_algo:                 C.CString(params.ScaleAlgo),
+		color_range:                C.CString(params.ColorRange),
+		color_space:                C.CString(params.ColorSpace),
+		tone_map:                   C.CString(params.ToneMap),
+		enc_pix_fmt:                C.CString(params.EncPixFmt),
+		input_format:               C.CString(params.InputFormat),
+		input_options:              C.CString(params.InputOptions),
+		trim_start_sec:             C.double(params.TrimStartSec),
+		trim_end_sec:               C.double(params.TrimEndSec),
+		watermark_image_xloc:       C.CString(params.WatermarkImageXLoc),
+		watermark_image_yloc:       C.CString(params.WatermarkImageYLoc),
+		log_prefix:                 C.CString(params.LogPrefix),
+		vfr_handling:               C.CString(params.VFRHandling),
+		decode_threads:             C.int(params.DecodeThreads),
+		encode_threads:             C.int(params.EncodeThreads),
+		thread_type:                C.CString(params.ThreadType),
+		opus_vbr:                   C.CString(params.OpusVbr),
+		audio_channel_bitrate:      C.int(params.AudioChannelBitrate),
+		bitstream_filters:          C.CString(strings.Join(params.BitstreamFilters, ",")),
+		audio_language:             C.CString(params.AudioLanguage),
+		video_index:                C.int(videoIndex),
+		io_buffer_size:             C.int(params.IOBufferSize),
+		chunk_key_frame_ts:         C.int64_t(params.ChunkKeyFrameTs),
+		muxer_opts:                 C.CString(muxerOptsString(params.MuxerOpts)),
+		gap_threshold_ms:           C.int(params.GapThresholdMs),
+		seg_origin_pts:             C.int64_t(params.SegOriginPts),
+		program_id:                 C.int(params.ProgramID),
+		audio_delay_ms:             C.int(params.AudioDelayMs),
+		video_filter:               C.CString(params.VideoFilter),
+		audio_filter:               C.CString(params.AudioFilter),
+		watermark_image_scale:      C.float(params.WatermarkImageScale),
+		watermark_image_opacity:    C.float(params.WatermarkImageOpacity),
+		tone_map_peak:              C.float(params.ToneMapPeak),
 
 		// All boolean params are handled below
 	}
@@ -1076,6 +1733,18 @@ func getCParams(params *goavpipe.XcParams) (*C.xcparams_t, error) {
 		cparams.force_equal_fduration = C.int(1)
 	}
 
+	if params.ClosedGOP {
+		cparams.closed_gop = C.int(1)
+	}
+
+	// The callback is kept until the IO handlers of the url are released, when the job is complete
+	if params.FrameCallback != nil {
+		cparams.frame_stats = C.int(1)
+		gMutex.Lock()
+		gURLFrameCallbacks[params.Url] = params.FrameCallback
+		gMutex.Unlock()
+	}
+
 	if params.CopyMpegts {
 		cparams.copy_mpegts = C.int(1)
 	}
@@ -1088,16 +1757,170 @@ func getCParams(params *goavpipe.XcParams) (*C.xcparams_t, error) {
 		cparams.listen = C.int(1)
 	}
 
-	if int32(len(params.AudioIndex)) > MaxAudioMux {
-		return nil, fmt.Errorf("Invalid number of audio streams NumAudio=%d", len(params.AudioIndex))
+	if params.ExtractThumbnails {
+		cparams.extract_thumbnails = C.int(1)
+	}
+
+	if params.DeinterlaceAuto {
+		cparams.deinterlace_auto = C.int(1)
+	}
+
+	if params.AutoRotate {
+		cparams.auto_rotate = C.int(1)
+	}
+
+	if params.PreserveHdrMetadata {
+		cparams.preserve_hdr_metadata = C.int(1)
+	}
+
+	if params.VerifySegments {
+		cparams.verify_segments = C.int(1)
+	}
+
+	if params.FailOnVerifyError {
+		cparams.fail_on_verify_error = C.int(1)
+	}
+
+	if params.FastStart {
+		cparams.faststart = C.int(1)
+	}
+
+	if params.FillGaps {
+		cparams.fill_gaps = C.int(1)
+	}
+
+	if params.SidecarIndex {
+		cparams.sidecar_index = C.int(1)
+	}
+
+	if params.AlignSegments {
+		cparams.align_segments = C.int(1)
+	}
+
+	if params.FrameAccurate {
+		cparams.frame_accurate = C.int(1)
+	}
+
+	if params.WatermarkTimecodeAuto {
+		cparams.watermark_timecode_auto = C.int(1)
+	}
+
+	if params.HandlePtsWraparound {
+		cparams.handle_pts_wraparound = C.int(1)
+	}
+
+	if params.LowLatency {
+		cparams.low_latency = C.int(1)
+	}
+
+	if params.IntraRefresh {
+		cparams.intra_refresh = C.int(1)
+	}
+
+	if int32(len(audioIndex)) > MaxAudioMux {
+		C.avpipe_release_xcparams(cparams)
+		return nil, fmt.Errorf("Invalid number of audio streams NumAudio=%d", len(audioIndex))
 	}
 
 	if params.DebugFrameLevel {
 		cparams.debug_frame_level = C.int(1)
 	}
 
-	for i := 0; i < len(params.AudioIndex); i++ {
-		cparams.audio_index[i] = C.int(params.AudioIndex[i])
+	for i := 0; i < len(audioIndex); i++ {
+		cparams.audio_index[i] = C.int(audioIndex[i])
+	}
+
+	if params.BurnSubtitleFile != "" {
+		subtitle, err := readInputFile(params.Url, params.BurnSubtitleFile)
+		if err != nil {
+			C.avpipe_release_xcparams(cparams)
+			return nil, fmt.Errorf("Failed to read burn subtitle file %s: %v", params.BurnSubtitleFile, err)
+		}
+		if len(subtitle) == 0 {
+			C.avpipe_release_xcparams(cparams)
+			return nil, fmt.Errorf("Burn subtitle file %s is empty", params.BurnSubtitleFile)
+		}
+		cparams.burn_subtitle = C.CString(string(subtitle))
+		cparams.burn_subtitle_len = C.int(len(subtitle))
+	}
+
+	imageFile := params.WatermarkImageFile
+	if imageFile == "" {
+		imageFile = params.OverlayImageFile
+	}
+	if imageFile != "" {
+		if params.WatermarkOverlay != "" ||
+			(params.OverlayImageFile != "" && params.OverlayImageFile != imageFile) {
+			C.avpipe_release_xcparams(cparams)
+			return nil, fmt.Errorf("Only one of WatermarkImageFile, OverlayImageFile and WatermarkOverlay can be set")
+		}
+		overlayType := goavpipe.ImageTypeFromFilename(imageFile)
+		if overlayType == goavpipe.UnknownImage {
+			overlayType = params.WatermarkOverlayType
+		}
+		overlay, err := readInputFile(params.Url, imageFile)
+		if err != nil {
+			C.avpipe_release_xcparams(cparams)
+			return nil, fmt.Errorf("Failed to read overlay image file %s: %v", imageFile, err)
+		}
+		C.free(unsafe.Pointer(cparams.watermark_overlay))
+		cparams.watermark_overlay = (*C.char)(C.CBytes(overlay))
+		cparams.watermark_overlay_len = C.int(len(overlay))
+		cparams.watermark_overlay_type = C.image_type(overlayType)
+	}
+
+	if len(params.KeyRotation) > 0 {
+		C.init_key_periods((*C.xcparams_t)(unsafe.Pointer(cparams)),
+			C.int(len(params.KeyRotation)))
+		for i, keyPeriod := range params.KeyRotation {
+			key := C.CString(keyPeriod.Key)
+			kid := C.CString(keyPeriod.KID)
+			iv := C.CString(keyPeriod.IV)
+			C.set_key_period((*C.xcparams_t)(unsafe.Pointer(cparams)),
+				C.int(i), C.int(keyPeriod.StartSegment), key, kid, iv)
+			C.free(unsafe.Pointer(key))
+			C.free(unsafe.Pointer(kid))
+			C.free(unsafe.Pointer(iv))
+		}
+	}
+
+	if len(params.DrmSystems) > 0 {
+		C.init_drm_systems((*C.xcparams_t)(unsafe.Pointer(cparams)),
+			C.int(len(params.DrmSystems)))
+		for i, drmSystem := range params.DrmSystems {
+			systemID := C.CString(drmSystem.SystemID)
+			var pssh unsafe.Pointer
+			if len(drmSystem.PSSH) > 0 {
+				pssh = C.CBytes(drmSystem.PSSH)
+			}
+			C.set_drm_system((*C.xcparams_t)(unsafe.Pointer(cparams)),
+				C.int(i), systemID, (*C.uint8_t)(pssh), C.int(len(drmSystem.PSSH)))
+			C.free(unsafe.Pointer(systemID))
+			C.free(pssh)
+		}
+	}
+
+	if len(params.InjectMetadata) > 0 {
+		C.init_inject_metadata((*C.xcparams_t)(unsafe.Pointer(cparams)),
+			C.int(len(params.InjectMetadata)))
+		for i, metadata := range params.InjectMetadata {
+			var payload unsafe.Pointer
+			if len(metadata.Payload) > 0 {
+				payload = C.CBytes(metadata.Payload)
+			}
+			C.set_inject_metadata((*C.xcparams_t)(unsafe.Pointer(cparams)),
+				C.int(i), C.int64_t(metadata.Pts), (*C.uint8_t)(payload), C.int(len(metadata.Payload)))
+			C.free(payload)
+		}
+	}
+
+	if len(params.ForceKeyframesAt) > 0 {
+		C.init_force_keyframes((*C.xcparams_t)(unsafe.Pointer(cparams)),
+			C.int(len(params.ForceKeyframesAt)))
+		for i, t := range params.ForceKeyframesAt {
+			C.set_force_keyframe((*C.xcparams_t)(unsafe.Pointer(cparams)),
+				C.int(i), C.double(t))
+		}
 	}
 
 	if extractImagesSize > 0 {
@@ -1112,6 +1935,40 @@ func getCParams(params *goavpipe.XcParams) (*C.xcparams_t, error) {
 	return cparams, nil
 }
 
+// readInputFile reads an auxiliary input file (i.e. a subtitle file) using the input opener of url,
+// so it goes through the same IO abstraction as the main input.
+func readInputFile(url, filename string) ([]byte, error) {
+	inputOpener := getInputOpener(url)
+	if inputOpener == nil {
+		return nil, fmt.Errorf("Input opener is not set, url=%s", url)
+	}
+
+	gMutex.Lock()
+	gHandleNum++
+	fd := gHandleNum
+	gMutex.Unlock()
+
+	input, err := inputOpener.Open(fd, filename)
+	if err != nil {
+		return nil, err
+	}
+	defer input.Close()
+
+	var data []byte
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := input.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF || (n == 0 && err == nil) {
+			break
+		} else if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
 func generateI32Handle() int32 {
 	// avpipe treats negative handles as evidence of an error, so we generate a non-negative handle
 	return rand.Int31()
@@ -1124,19 +1981,202 @@ func Xc(params *goavpipe.XcParams) error {
 		log.Error("Failed transcoding, params are not set.")
 		return EAV_PARAM
 	}
+	defer releaseUrlIOHandlers(params.Url)
+
+	if err := params.NormalizeCrypt(); err != nil {
+		log.Error("Failed transcoding, invalid crypt params.", err, "url", params.Url)
+		return err
+	}
 
 	// Convert XcParams to C.txparams_t
 	cparams, err := getCParams(params)
 	if err != nil {
 		log.Error("Transcoding failed", err, "url", params.Url)
+		return err
 	}
+	// The C layer copies the params it keeps (avpipe_init)
+	defer C.avpipe_release_xcparams(cparams)
 
 	rc := C.xc((*C.xcparams_t)(unsafe.Pointer(cparams)))
 
+	return avpipeError(rc)
+}
+
+// ValidateParams checks a transcoding of url with params can be set up without running it: the input is
+// opened and the decoder, the encoder and the filter graphs are built and torn down, no output is written.
+// It returns the first configuration error, or nil if Xc() could start transcoding with the same params.
+func ValidateParams(params *goavpipe.XcParams, url string) error {
+	if params == nil {
+		log.Error("Failed validating, params are not set.")
+		return EAV_PARAM
+	}
+	defer releaseUrlIOHandlers(url)
+
+	p := *params
+	p.Url = url
+	if err := p.NormalizeCrypt(); err != nil {
+		log.Error("Failed validating, invalid crypt params.", err, "url", url)
+		return err
+	}
+
+	cparams, err := getCParams(&p)
+	if err != nil {
+		log.Error("Validating failed", err, "url", url)
+		return err
+	}
+	defer C.avpipe_release_xcparams(cparams)
+
+	rc := C.xc_validate((*C.xcparams_t)(unsafe.Pointer(cparams)))
+
+	return avpipeError(rc)
+}
+
+// XcOutputs runs Xc() and returns the outputs the job wrote, in the order they were closed, so the caller
+// doesn't need to track them in its OutputOpener (i.e. to build a manifest of the segments).
+// The outputs are returned even if the transcoding fails.
+func XcOutputs(params *goavpipe.XcParams) ([]OutputArtifact, error) {
+	if params == nil {
+		log.Error("Failed transcoding, params are not set.")
+		return nil, EAV_PARAM
+	}
+
+	report, err := xcWithReport(params)
+	artifacts := report.artifacts
+	if artifacts == nil {
+		artifacts = []OutputArtifact{}
+	}
+	return artifacts, err
+}
+
+// xcWithReport runs Xc() and returns the report of the outputs of the job
+func xcWithReport(params *goavpipe.XcParams) (*xcReport, error) {
 	gMutex.Lock()
-	defer gMutex.Unlock()
-	delete(gURLInputOpeners, params.Url)
-	delete(gURLOutputOpeners, params.Url)
+	gXcReports[params.Url] = &xcReport{}
+	gMutex.Unlock()
+
+	err := Xc(params)
+
+	gMutex.Lock()
+	report := gXcReports[params.Url]
+	delete(gXcReports, params.Url)
+	gMutex.Unlock()
+
+	return report, err
+}
+
+// ContinuationState is the state of a transcoding job needed to continue its output with the next job,
+// i.e. when a live stream is recorded in windows of its input, one job per window. It is returned by
+// XcContinue() and passed to the XcContinue() of the next window, so the segments and fragments of the
+// next job continue the numbering and the timeline of the previous one instead of colliding with them.
+type ContinuationState struct {
+	LastPts           int64 `json:"last_pts"`            // End PTS (PTS + duration of the last frame) of the last segment, in the output time base
+	LastSegIndex      int   `json:"last_seg_index"`      // Index of the last segment
+	LastFragmentIndex int   `json:"last_fragment_index"` // Index of the last fragment, one fragment per frame
+}
+
+// Apply sets the params of the next job to continue after the state: StartPts is LastPts, StartSegmentStr
+// is LastSegIndex + 1 and StartFragmentIndex is LastFragmentIndex + 1.
+func (c *ContinuationState) Apply(params *goavpipe.XcParams) {
+	params.StartPts = c.LastPts
+	params.StartSegmentStr = strconv.Itoa(c.LastSegIndex + 1)
+	params.StartFragmentIndex = int32(c.LastFragmentIndex + 1)
+}
+
+// continuationState returns the continuation state of the job run with params from its report. The
+// state follows the video segments, or the audio segments of the lowest stream index if there is no video,
+// since StartPts is in the time base of each stream. It returns nil if the job completed no segment.
+func (r *xcReport) continuationState(params *goavpipe.XcParams) *ContinuationState {
+	isVideo := func(t goavpipe.AVType) bool {
+		return t == goavpipe.DASHVideoSegment || t == goavpipe.FMP4VideoSegment ||
+			t == goavpipe.MP4Segment || t == goavpipe.MpegtsSegment
+	}
+
+	var key *segmentKey
+	for k := range r.segments {
+		k := k
+		if key == nil || (isVideo(k.avType) && !isVideo(key.avType)) ||
+			(isVideo(k.avType) == isVideo(key.avType) && k.streamIndex < key.streamIndex) {
+			key = &k
+		}
+	}
+	if key == nil {
+		return nil
+	}
+
+	summary := r.segments[*key]
+	return &ContinuationState{
+		LastPts:           summary.last.EndPTS,
+		LastSegIndex:      summary.last.SegIndex,
+		LastFragmentIndex: int(params.StartFragmentIndex) + int(summary.frames) - 1,
+	}
+}
+
+// XcContinue runs Xc() as the continuation of the job of state, if state is not nil (see
+// ContinuationState.Apply), and returns the state to continue after this job. The fragment index assumes
+// one fragment per frame, as the "fmp4-segment" and "dash" formats write. The state is nil if the job
+// completed no segment. OutputBasePts is added to the output PTS, so it must not be set with StartPts.
+func XcContinue(params *goavpipe.XcParams, state *ContinuationState) (*ContinuationState, error) {
+	if params == nil {
+		log.Error("Failed transcoding, params are not set.")
+		return nil, EAV_PARAM
+	}
+	if state != nil {
+		state.Apply(params)
+	}
+
+	report, err := xcWithReport(params)
+	return report.continuationState(params), err
+}
+
+// XcMulti transcodes the video of the input url into multiple renditions (i.e. an ABR ladder) decoding the
+// input only once. The input is opened with the InputOpener of url, each params is a rendition and its
+// Url names the rendition: the outputs of the rendition are opened with the OutputOpener set for its Url by
+// InitUrlIOHandler() (or the global one), so the OutputOpener gets a different handle for each rendition.
+// The renditions are video only (XcType XcVideo) with the same start and duration.
+// Each rendition has its own Format and SegDuration, so one decode can produce i.e. 6 sec HLS and 4 sec DASH
+// segments: the renditions with the same Format (a format group) must have the same segment duration, and
+// the segment duration of each rendition must be a multiple of its key frame interval (ForceKeyInt),
+// otherwise XcMulti returns EAV_PARAM.
+func XcMulti(params []*goavpipe.XcParams, url string) error {
+	defer XCEnded()
+	defer releaseUrlIOHandlers(url)
+	for _, p := range params {
+		if p != nil {
+			defer releaseUrlIOHandlers(p.Url)
+		}
+	}
+
+	if len(params) == 0 || len(params) > C.MAX_RENDITIONS {
+		log.Error("Failed transcoding, invalid number of renditions", "renditions", len(params), "url", url)
+		return EAV_PARAM
+	}
+
+	cparams := make([]C.xcparams_t, len(params))
+	for i, p := range params {
+		if p == nil || len(p.Url) == 0 || p.Url == url {
+			log.Error("Failed transcoding, each rendition needs its own url", "rendition", i, "url", url)
+			return EAV_PARAM
+		}
+
+		if err := p.NormalizeCrypt(); err != nil {
+			log.Error("Failed transcoding, invalid crypt params.", err, "url", p.Url)
+			return err
+		}
+
+		cp, err := getCParams(p)
+		if err != nil {
+			log.Error("Transcoding failed", err, "url", p.Url)
+			return err
+		}
+		// The C layer copies the params it keeps (avpipe_init)
+		defer C.avpipe_release_xcparams(cp)
+		cparams[i] = *cp
+	}
+
+	cUrl := C.CString(url)
+	defer C.free(unsafe.Pointer(cUrl))
+
+	rc := C.xc_multi(cUrl, &cparams[0], C.int(len(cparams)))
 
 	return avpipeError(rc)
 }
@@ -1147,24 +2187,40 @@ func Mux(params *goavpipe.XcParams) error {
 		log.Error("Failed muxing, params are not set")
 		return EAV_PARAM
 	}
+	defer releaseUrlIOHandlers(params.Url)
 
 	params.XcType = goavpipe.XcMux
 	cparams, err := getCParams(params)
 	if err != nil {
 		log.Error("Muxing failed", err, "url", params.Url)
+		return err
 	}
+	defer C.avpipe_release_xcparams(cparams)
 
 	rc := C.mux((*C.xcparams_t)(unsafe.Pointer(cparams)))
 
-	gMutex.Lock()
-	defer gMutex.Unlock()
-	delete(gURLInputOpeners, params.Url)
-	delete(gURLOutputOpeners, params.Url)
-
 	return avpipeError(rc)
 
 }
 
+// MuxStreams muxes the video, audio and caption streams of params into a single MP4 (or fragmented MP4 if
+// params.Format is "fmp4-segment") without transcoding, i.e. a video-only and an audio-only file. The inputs
+// and outputURL are opened with the openers set for outputURL by InitUrlMuxIOHandler() or InitMuxIOHandler().
+func MuxStreams(params *goavpipe.MuxParams, outputURL string) error {
+	spec, err := muxingSpec(params)
+	if err != nil {
+		log.Error("Muxing failed", err, "url", outputURL)
+		releaseUrlIOHandlers(outputURL)
+		return err
+	}
+
+	return Mux(&goavpipe.XcParams{
+		Url:        outputURL,
+		Format:     params.Format,
+		MuxingSpec: spec,
+	})
+}
+
 func ChannelLayoutName(nbChannels, channelLayout int) string {
 	channelName := C.avpipe_channel_name(C.int(nbChannels), C.int(channelLayout))
 	if unsafe.Pointer(channelName) != C.NULL {
@@ -1190,6 +2246,75 @@ func GetPixelFormatName(pixFmt int) string {
 	return ""
 }
 
+// PixelFormatByName returns the pixel format id (AVPixelFormat) of a pixel format name, i.e. "yuv420p10le",
+// or -1 if the name is not a pixel format of the linked ffmpeg libraries. GetPixelFormatName converts it back.
+func PixelFormatByName(name string) int {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	return int(C.av_get_pix_fmt(cName))
+}
+
+// PixelFormat describes a pixel format of the linked ffmpeg libraries
+type PixelFormat struct {
+	Id           int    `json:"id"`            // AVPixelFormat
+	Name         string `json:"name"`          // i.e. "yuv420p10le"
+	NbComponents int    `json:"nb_components"` // Number of components (3 for YUV and RGB, 4 with alpha)
+	BitDepth     int    `json:"bit_depth"`     // Highest number of bits of a component
+	Log2ChromaW  int    `json:"log2_chroma_w"` // Chroma subsampling shift (1 for 4:2:0 and 4:2:2)
+	Log2ChromaH  int    `json:"log2_chroma_h"` // Chroma subsampling shift (1 for 4:2:0)
+	Planar       bool   `json:"planar"`        // At least one component is in a separate plane
+	RGB          bool   `json:"rgb"`           // RGB-like (not YUV)
+	Alpha        bool   `json:"alpha"`         // Has an alpha component
+	HWAccel      bool   `json:"hwaccel"`       // Hardware frames, not a memory layout an encoder takes
+	BigEndian    bool   `json:"big_endian"`
+}
+
+// PixelFormats returns all the pixel formats of the linked ffmpeg libraries, i.e. to validate the pixel
+// format of an encoder or list the formats in a UI
+func PixelFormats() []PixelFormat {
+	var formats []PixelFormat
+	for desc := C.av_pix_fmt_desc_next(nil); desc != nil; desc = C.av_pix_fmt_desc_next(desc) {
+		pf := PixelFormat{
+			Id:           int(C.av_pix_fmt_desc_get_id(desc)),
+			Name:         C.GoString(desc.name),
+			NbComponents: int(desc.nb_components),
+			Log2ChromaW:  int(desc.log2_chroma_w),
+			Log2ChromaH:  int(desc.log2_chroma_h),
+			Planar:       desc.flags&C.AV_PIX_FMT_FLAG_PLANAR != 0,
+			RGB:          desc.flags&C.AV_PIX_FMT_FLAG_RGB != 0,
+			Alpha:        desc.flags&C.AV_PIX_FMT_FLAG_ALPHA != 0,
+			HWAccel:      desc.flags&C.AV_PIX_FMT_FLAG_HWACCEL != 0,
+			BigEndian:    desc.flags&C.AV_PIX_FMT_FLAG_BE != 0,
+		}
+		for i := 0; i < pf.NbComponents && i < len(desc.comp); i++ {
+			if depth := int(desc.comp[i].depth); depth > pf.BitDepth {
+				pf.BitDepth = depth
+			}
+		}
+		formats = append(formats, pf)
+	}
+	return formats
+}
+
+// CodecIDByName returns the codec id (AVCodecID) of a codec name, i.e. "h264" or "hevc", or of an encoder or
+// decoder name, i.e. "libx264". It returns 0 (AV_CODEC_ID_NONE) if the name is not a codec of the linked
+// ffmpeg libraries. The codec id is the one GetProfileName takes.
+func CodecIDByName(name string) int {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+
+	if desc := C.avcodec_descriptor_get_by_name(cName); desc != nil {
+		return int(desc.id)
+	}
+	if codec := C.avcodec_find_encoder_by_name(cName); codec != nil {
+		return int(codec.id)
+	}
+	if codec := C.avcodec_find_decoder_by_name(cName); codec != nil {
+		return int(codec.id)
+	}
+	return 0
+}
+
 func GetProfileName(codecId int, profile int) string {
 	pName := C.get_profile_name(C.int(codecId), C.int(profile))
 	if unsafe.Pointer(pName) != C.NULL {
@@ -1200,6 +2325,128 @@ func GetProfileName(codecId int, profile int) string {
 	return ""
 }
 
+// SupportedEncoders returns the sorted names of the encoders of the linked ffmpeg libraries, i.e. "libx264"
+// or "h264_nvenc", so services can check the codecs of an avpipe build before starting a transcoding.
+func SupportedEncoders() []string {
+	return cNames(C.get_codec_names(C.int(1)))
+}
+
+// SupportedDecoders returns the sorted names of the decoders of the linked ffmpeg libraries
+func SupportedDecoders() []string {
+	return cNames(C.get_codec_names(C.int(0)))
+}
+
+// SupportedFormats returns the sorted names of the muxers (output formats) of the linked ffmpeg libraries,
+// i.e. "mp4" or "dash"
+func SupportedFormats() []string {
+	return cNames(C.get_muxer_names())
+}
+
+// HasCodec returns true if the linked ffmpeg libraries have an encoder or a decoder with this name
+func HasCodec(name string) bool {
+	cName := C.CString(name)
+	defer C.free(unsafe.Pointer(cName))
+	return C.has_codec(cName) != 0
+}
+
+// cNames converts and frees the '\n' separated names returned by the C layer
+func cNames(cStr *C.char) []string {
+	if cStr == nil {
+		return nil
+	}
+	defer C.free(unsafe.Pointer(cStr))
+
+	names := strings.Fields(C.GoString(cStr))
+	sort.Strings(names)
+	return names
+}
+
+// dispositionFlags are the AV_DISPOSITION_* flags reported in StreamInfo.Disposition, named as by ffprobe
+var dispositionFlags = []struct {
+	flag int
+	name string
+}{
+	{C.AV_DISPOSITION_DEFAULT, "default"},
+	{C.AV_DISPOSITION_DUB, "dub"},
+	{C.AV_DISPOSITION_ORIGINAL, "original"},
+	{C.AV_DISPOSITION_COMMENT, "comment"},
+	{C.AV_DISPOSITION_LYRICS, "lyrics"},
+	{C.AV_DISPOSITION_KARAOKE, "karaoke"},
+	{C.AV_DISPOSITION_FORCED, "forced"},
+	{C.AV_DISPOSITION_HEARING_IMPAIRED, "hearing_impaired"},
+	{C.AV_DISPOSITION_VISUAL_IMPAIRED, "visual_impaired"},
+	{C.AV_DISPOSITION_CLEAN_EFFECTS, "clean_effects"},
+	{C.AV_DISPOSITION_ATTACHED_PIC, "attached_pic"},
+	{C.AV_DISPOSITION_TIMED_THUMBNAILS, "timed_thumbnails"},
+	{C.AV_DISPOSITION_CAPTIONS, "captions"},
+	{C.AV_DISPOSITION_DESCRIPTIONS, "descriptions"},
+	{C.AV_DISPOSITION_METADATA, "metadata"},
+	{C.AV_DISPOSITION_DEPENDENT, "dependent"},
+}
+
+// dispositionToMap returns all the flags of dispositionFlags, set to true if they are set in disposition
+func dispositionToMap(disposition int) map[string]bool {
+	m := make(map[string]bool, len(dispositionFlags))
+	for _, f := range dispositionFlags {
+		m[f.name] = disposition&f.flag != 0
+	}
+	return m
+}
+
+// dictToTags converts AVDictionary data to Tags using the built in av_dict_get() iterator.
+// The values of duplicate keys are joined with ";" in the order they appear in the input,
+// so no value is dropped. Returns nil if the dictionary is empty.
+func dictToTags(dict *C.AVDictionary) map[string]string {
+	var tags map[string]string
+
+	empty := C.CString("")
+	defer C.free(unsafe.Pointer(empty))
+
+	tag := C.av_dict_get(dict, empty, nil, C.AV_DICT_IGNORE_SUFFIX)
+	for tag != nil {
+		if tags == nil {
+			tags = map[string]string{}
+		}
+		key := C.GoString(tag.key)
+		value := C.GoString(tag.value)
+		if prev, ok := tags[key]; ok {
+			tags[key] = prev + ";" + value
+		} else {
+			tags[key] = value
+		}
+		tag = C.av_dict_get(dict, empty, tag, C.AV_DICT_IGNORE_SUFFIX)
+	}
+
+	return tags
+}
+
+// probeError returns the error of a failed probe with the reason and the url. The error wraps the EAV_* error
+// of rc, which can be checked with errors.Is (i.e EAV_IO_TIMEOUT can be retried, EAV_UNSUPPORTED_FORMAT can't).
+func probeError(rc C.int, url string) error {
+	err := avpipeError(rc)
+
+	var reason string
+	switch err {
+	case EAV_OPEN_INPUT:
+		reason = "failed to open the input"
+	case EAV_UNSUPPORTED_FORMAT:
+		reason = "unsupported input format"
+	case EAV_NUM_STREAMS:
+		reason = "no streams found"
+	case EAV_STREAM_INFO:
+		reason = "failed to read the stream info"
+	case EAV_STREAM_INDEX:
+		reason = "invalid stream index"
+	case EAV_IO_TIMEOUT:
+		reason = "timeout reading the input"
+	case EAV_PARAM:
+		reason = "invalid params"
+	default:
+		reason = "probing failed"
+	}
+	return fmt.Errorf("Probe %s, url=%s: %w", reason, url, err)
+}
+
 func Probe(params *goavpipe.XcParams) (*ProbeInfo, error) {
 	var cprobe *C.xcprobe_t
 	var n_streams C.int
@@ -1208,15 +2455,18 @@ func Probe(params *goavpipe.XcParams) (*ProbeInfo, error) {
 		log.Error("Failed probing, params are not set.")
 		return nil, EAV_PARAM
 	}
+	defer releaseUrlIOHandlers(params.Url)
 
 	cparams, err := getCParams(params)
 	if err != nil {
 		log.Error("Probing failed", err, "url", params.Url)
+		return nil, err
 	}
+	defer C.avpipe_release_xcparams(cparams)
 
 	rc := C.probe((*C.xcparams_t)(unsafe.Pointer(cparams)), (**C.xcprobe_t)(unsafe.Pointer(&cprobe)), (*C.int)(unsafe.Pointer(&n_streams)))
 	if int(rc) != 0 {
-		return nil, avpipeError(rc)
+		return nil, probeError(rc, params.Url)
 	}
 
 	probeInfo := &ProbeInfo{}
@@ -1266,49 +2516,196 @@ func Probe(params *goavpipe.XcParams) (*ProbeInfo, error) {
 			probeInfo.StreamInfo[i].DisplayAspectRatio = big.NewRat(int64(probeArray[i].display_aspect_ratio.num), int64(1))
 		}
 		probeInfo.StreamInfo[i].FieldOrder = goavpipe.AVFieldOrderNames[goavpipe.AVFieldOrder(probeArray[i].field_order)]
+		probeInfo.StreamInfo[i].ColorPrimaries = C.GoString(probeArray[i].color_primaries)
+		probeInfo.StreamInfo[i].ColorTransfer = C.GoString(probeArray[i].color_trc)
+		probeInfo.StreamInfo[i].ColorSpace = C.GoString(probeArray[i].color_space)
+		probeInfo.StreamInfo[i].ColorRange = C.GoString(probeArray[i].color_range)
+		probeInfo.StreamInfo[i].BitsPerRawSample = int(probeArray[i].bits_per_raw_sample)
+		probeInfo.StreamInfo[i].IsVFR = int(probeArray[i].is_vfr) != 0
 		probeInfo.StreamInfo[i].Profile = int(probeArray[i].profile)
 		probeInfo.StreamInfo[i].Level = int(probeArray[i].level)
 
+		probeInfo.StreamInfo[i].Rotation = int(probeArray[i].rotation)
+		probeInfo.StreamInfo[i].SideData = make([]interface{}, 0)
 		rot := float64(probeArray[i].side_data.display_matrix.rotation)
 		if rot != 0.0 {
-			probeInfo.StreamInfo[i].SideData = make([]interface{}, 1)
 			displayMatrix := SideDataDisplayMatrix{
 				Type:       "Display Matrix",
 				Rotation:   rot,
 				RotationCw: float64(probeArray[i].side_data.display_matrix.rotation_cw),
 			}
-			probeInfo.StreamInfo[i].SideData[0] = displayMatrix
-		} else {
-			probeInfo.StreamInfo[i].SideData = make([]interface{}, 0)
+			probeInfo.StreamInfo[i].SideData = append(probeInfo.StreamInfo[i].SideData, displayMatrix)
 		}
-
-		// Convert AVDictionary data to Tags of type map[string]string using the built in av_dict_get() iterator
-		dict := (*C.AVDictionary)(unsafe.Pointer((probeArray[i].tags)))
-		var tag *C.AVDictionaryEntry = (*C.AVDictionaryEntry)(unsafe.Pointer(C.av_dict_get(dict, (*C.char)(C.CString("")), (*C.AVDictionaryEntry)(nil), C.AV_DICT_IGNORE_SUFFIX)))
-		if tag != nil {
-			probeInfo.StreamInfo[i].Tags = map[string]string{}
-			for tag != nil {
-				probeInfo.StreamInfo[i].Tags[C.GoString((*C.char)(unsafe.Pointer(tag.key)))] = C.GoString((*C.char)(unsafe.Pointer(tag.value)))
-				tag = (*C.AVDictionaryEntry)(unsafe.Pointer(C.av_dict_get(dict, (*C.char)(C.CString("")), tag, C.AV_DICT_IGNORE_SUFFIX)))
+		if md := probeArray[i].side_data.mastering_display; int(md.present) != 0 {
+			masteringDisplay := SideDataMasteringDisplay{
+				Type:         "Mastering display metadata",
+				RedX:         float64(md.red_x),
+				RedY:         float64(md.red_y),
+				GreenX:       float64(md.green_x),
+				GreenY:       float64(md.green_y),
+				BlueX:        float64(md.blue_x),
+				BlueY:        float64(md.blue_y),
+				WhitePointX:  float64(md.white_point_x),
+				WhitePointY:  float64(md.white_point_y),
+				MinLuminance: float64(md.min_luminance),
+				MaxLuminance: float64(md.max_luminance),
 			}
+			probeInfo.StreamInfo[i].SideData = append(probeInfo.StreamInfo[i].SideData, masteringDisplay)
 		}
+		if cl := probeArray[i].side_data.content_light; int(cl.present) != 0 {
+			contentLight := SideDataContentLightLevel{
+				Type:       "Content light level metadata",
+				MaxContent: int(cl.max_content),
+				MaxAverage: int(cl.max_average),
+			}
+			probeInfo.StreamInfo[i].SideData = append(probeInfo.StreamInfo[i].SideData, contentLight)
+		}
+
+		dict := (*C.AVDictionary)(unsafe.Pointer((probeArray[i].tags)))
+		probeInfo.StreamInfo[i].Tags = dictToTags(dict)
 		C.av_dict_free(&dict)
+		probeInfo.StreamInfo[i].Disposition = dispositionToMap(int(probeArray[i].disposition))
 	}
 
 	probeInfo.ContainerInfo.FormatName = C.GoString((*C.char)(unsafe.Pointer(cprobe.container_info.format_name)))
 	probeInfo.ContainerInfo.Duration = float64(cprobe.container_info.duration)
+	probeInfo.ContainerInfo.BitRate = int64(cprobe.container_info.bit_rate)
+	probeInfo.ContainerInfo.IsImage = int(cprobe.container_info.is_image) != 0
+	containerDict := (*C.AVDictionary)(unsafe.Pointer(cprobe.container_info.tags))
+	probeInfo.ContainerInfo.Tags = dictToTags(containerDict)
+	C.av_dict_free(&containerDict)
+
+	if int(cprobe.n_programs) > 0 {
+		programArray := unsafe.Slice(cprobe.program_info, int(cprobe.n_programs))
+		probeInfo.Programs = make([]ProgramInfo, len(programArray))
+		for i := range programArray {
+			probeInfo.Programs[i].ProgramID = int(programArray[i].program_id)
+			streamIndexes := unsafe.Slice(programArray[i].stream_indexes, int(programArray[i].n_stream_indexes))
+			probeInfo.Programs[i].StreamIndexes = make([]int, len(streamIndexes))
+			for j, index := range streamIndexes {
+				probeInfo.Programs[i].StreamIndexes[j] = int(index)
+			}
+			programDict := (*C.AVDictionary)(unsafe.Pointer(programArray[i].tags))
+			probeInfo.Programs[i].Tags = dictToTags(programDict)
+			C.av_dict_free(&programDict)
+			C.free(unsafe.Pointer(programArray[i].stream_indexes))
+		}
+		C.free(unsafe.Pointer(cprobe.program_info))
+	}
 
 	C.free(unsafe.Pointer(cprobe.stream_info))
 	C.free(unsafe.Pointer(cprobe))
 
-	gMutex.Lock()
-	defer gMutex.Unlock()
-	delete(gURLInputOpeners, params.Url)
-	delete(gURLOutputOpeners, params.Url)
-
 	return probeInfo, nil
 }
 
+// ProbeHeader probes only the container of url: the format name, the duration, the overall bit rate
+// and the tags, i.e. to compute DurationTs or estimate the size of the output before transcoding. Only
+// the header of the container is read (and the first packets if it has none, i.e. MPEG-TS) and the
+// streams are not probed, so much less of the input is read through the InputHandler than by Probe().
+// The input is opened as seekable, to read an mp4 moov box at the end of the file without reading
+// the whole file.
+func ProbeHeader(url string) (*ContainerInfo, error) {
+	var cinfo C.container_info_t
+
+	params := &goavpipe.XcParams{
+		Url:      url,
+		Seekable: true,
+	}
+	defer releaseUrlIOHandlers(url)
+
+	cparams, err := getCParams(params)
+	if err != nil {
+		log.Error("Probing header failed", err, "url", url)
+		return nil, err
+	}
+	defer C.avpipe_release_xcparams(cparams)
+
+	rc := C.probe_header((*C.xcparams_t)(unsafe.Pointer(cparams)), &cinfo)
+	if int(rc) != 0 {
+		return nil, probeError(rc, url)
+	}
+
+	info := &ContainerInfo{
+		Duration:   float64(cinfo.duration),
+		FormatName: C.GoString(cinfo.format_name),
+		BitRate:    int64(cinfo.bit_rate),
+		IsImage:    int(cinfo.is_image) != 0,
+	}
+	dict := (*C.AVDictionary)(unsafe.Pointer(cinfo.tags))
+	info.Tags = dictToTags(dict)
+	C.av_dict_free(&dict)
+	C.free(unsafe.Pointer(cinfo.format_name))
+
+	return info, nil
+}
+
+// ProbeFrames decodes the stream with index streamIndex of url and returns the timestamps, key frame flag,
+// picture type and packet size of each frame. If maxFrames > 0 only the first maxFrames frames are probed,
+// i.e to find the first GOP without reading the whole input.
+func ProbeFrames(url string, seekable bool, streamIndex int, maxFrames int) ([]FrameInfo, error) {
+	var cframes *C.frame_info_t
+	var n_frames C.int
+
+	params := &goavpipe.XcParams{
+		Url:      url,
+		Seekable: seekable,
+	}
+	defer releaseUrlIOHandlers(url)
+
+	cparams, err := getCParams(params)
+	if err != nil {
+		log.Error("Probing frames failed", err, "url", url)
+		return nil, err
+	}
+	defer C.avpipe_release_xcparams(cparams)
+
+	rc := C.probe_frames((*C.xcparams_t)(unsafe.Pointer(cparams)), C.int(streamIndex), C.int(maxFrames),
+		(**C.frame_info_t)(unsafe.Pointer(&cframes)), (*C.int)(unsafe.Pointer(&n_frames)))
+
+	if int(rc) != 0 {
+		return nil, probeError(rc, url)
+	}
+
+	frames := make([]FrameInfo, int(n_frames))
+	if n_frames > 0 {
+		frameArray := (*[1 << 30]C.frame_info_t)(unsafe.Pointer(cframes))[:n_frames:n_frames]
+		for i := range frames {
+			frames[i].Pts = int64(frameArray[i].pts)
+			frames[i].Dts = int64(frameArray[i].dts)
+			frames[i].KeyFrame = int(frameArray[i].key_frame) != 0
+			frames[i].PictType = string(rune(frameArray[i].pict_type))
+			frames[i].PacketSize = int(frameArray[i].packet_size)
+		}
+	}
+	C.free(unsafe.Pointer(cframes))
+
+	return frames, nil
+}
+
+// VerifySegment decodes all the packets of segment and returns an error if the segment can't be
+// decoded. Fragmented segments (m4s) need initSegment, it can be nil for self contained segments.
+func VerifySegment(initSegment []byte, segment []byte) error {
+	if len(segment) == 0 {
+		return EAV_PARAM
+	}
+
+	var cinit unsafe.Pointer
+	if len(initSegment) > 0 {
+		cinit = C.CBytes(initSegment)
+		defer C.free(cinit)
+	}
+	cseg := C.CBytes(segment)
+	defer C.free(cseg)
+
+	rc := C.verify_segment((*C.uint8_t)(cinit), C.int64_t(len(initSegment)), (*C.uint8_t)(cseg), C.int64_t(len(segment)))
+	if int(rc) != 0 {
+		return avpipeError(rc)
+	}
+
+	return nil
+}
+
 // Returns a handle and error (if there is any error)
 // In case of error the handle would be zero
 func XcInit(params *goavpipe.XcParams) (int32, error) {
@@ -1318,25 +2715,55 @@ func XcInit(params *goavpipe.XcParams) (int32, error) {
 		return -1, EAV_PARAM
 	}
 
+	if err := params.NormalizeCrypt(); err != nil {
+		log.Error("Initializing transcoder failed, invalid crypt params.", err, "url", params.Url)
+		releaseUrlIOHandlers(params.Url)
+		return -1, err
+	}
+
 	cparams, err := getCParams(params)
 	if err != nil {
 		log.Error("Initializing transcoder failed", err, "url", params.Url)
+		releaseUrlIOHandlers(params.Url)
+		return -1, err
 	}
+	// The C layer copies the params it keeps (avpipe_init)
+	defer C.avpipe_release_xcparams(cparams)
 
 	var handle C.int32_t
 	rc := C.xc_init((*C.xcparams_t)(unsafe.Pointer(cparams)), (*C.int32_t)(unsafe.Pointer(&handle)))
 	if rc != C.eav_success {
+		releaseUrlIOHandlers(params.Url)
 		return -1, avpipeError(rc)
 	}
 
+	// The input is opened by XcRun(), the openers of the url are released when it is complete,
+	// or by XcCancel() if the handle is cancelled before it runs
+	gMutex.Lock()
+	gXcUrls[int32(handle)] = params.Url
+	gMutex.Unlock()
+
 	return int32(handle), nil
 }
 
+// takeXcUrl removes and returns the url of the session of handle initialized by XcInit(). Only the
+// first of XcRun() and XcCancel() gets it and releases the openers of the url.
+func takeXcUrl(handle int32) (string, bool) {
+	gMutex.Lock()
+	defer gMutex.Unlock()
+	url, ok := gXcUrls[handle]
+	delete(gXcUrls, handle)
+	return url, ok
+}
+
 func XcRun(handle int32) error {
 	defer XCEnded()
 	if handle < 0 {
 		return EAV_BAD_HANDLE
 	}
+	if url, ok := takeXcUrl(handle); ok {
+		defer releaseUrlIOHandlers(url)
+	}
 	AssociateGIDWithHandle(handle)
 	rc := C.xc_run(C.int32_t(handle))
 	if rc == 0 {
@@ -1348,6 +2775,22 @@ func XcRun(handle int32) error {
 
 func XcCancel(handle int32) error {
 	rc := C.xc_cancel(C.int32_t(handle))
+	// XcRun() was never called for handle, nothing else releases the openers of its url
+	if url, ok := takeXcUrl(handle); ok {
+		releaseUrlIOHandlers(url)
+	}
+	if rc == 0 {
+		return nil
+	}
+
+	return EAV_CANCEL_FAILED
+}
+
+// XcStop stops the transcoding of handle gracefully, unlike XcCancel() which aborts it: the input is no
+// longer read, the encoders are flushed and the outputs are finalized, so the last segment of a live
+// recording is playable. XcRun() of the handle returns nil once the outputs are closed.
+func XcStop(handle int32) error {
+	rc := C.xc_stop(C.int32_t(handle))
 	if rc == 0 {
 		return nil
 	}
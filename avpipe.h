@@ -6,15 +6,22 @@
  * - APIs with handle: these APIs allow the client application to cancel a transcoding if it is necessary.
  *   - xc_init(): to initialize a transcoding and obtain a handle.
  *   - xc_run(): to start a transcoding with obtained handle.
- *   - xc_cancel(): to cancel/stop a transcoding with specified handle.
+ *   - xc_cancel(): to cancel/abort a transcoding with specified handle.
+ *   - xc_stop(): to stop a transcoding with specified handle, finalizing its outputs.
  * - APIs with no handle: these APIs are very simple to use and just need transcoding/probing params.
  *   - xc(): starts a transcoding with specified transcoding params.
+ *   - xc_multi(): starts a transcoding of multiple renditions from a single decoding of the input.
+ *   - xc_validate(): checks the params of a transcoding without running it.
  *   - mux(): starts a muxing job with specified params.
  *   - probe(): probs the specified stream/file.
+ *   - probe_header(): probes the container of the specified stream/file without probing its streams.
+ *   - probe_frames(): probes the frames of one stream of the specified stream/file.
+ *   - verify_segment(): checks an output segment can be decoded.
  *
  * Other miscellaneous APIs are:
  *   - get_pix_fmt_name(): to obtain pixel format name.
  *   - get_profile_name(): to obtain profile name.
+ *   - get_codec_names(), get_muxer_names(), has_codec(): to query the codecs and formats of the linked ffmpeg.
  */
 #pragma once
 
@@ -54,6 +61,18 @@ int
 xc_cancel(
     int32_t handle);
 
+/**
+ * @brief   Stops the transcoding specified by handle gracefully: the input is no longer read, the
+ *          encoders are flushed and the outputs are finalized (i.e. the last segment of a live recording
+ *          is closed), then xc_run() returns eav_success.
+ *
+ * @param   handle      The handle of transcoding context that is obtained by xc_init().
+ * @return  If it is successful it returns eav_success, otherwise eav_xc_table.
+ */
+int
+xc_stop(
+    int32_t handle);
+
 /**
  * @brief   Starts a transcoding job.
  *
@@ -64,6 +83,33 @@ int
 xc(
     xcparams_t *params);
 
+/**
+ * @brief   Checks a transcoding job can be set up with params: the input is opened and the decoder,
+ *          the encoder and the filter graphs are prepared and released without transcoding.
+ *
+ * @param   params      Transcoding parameters.
+ * @return  If the params are valid it returns eav_success, otherwise the first configuration error.
+ */
+int
+xc_validate(
+    xcparams_t *params);
+
+/**
+ * @brief   Starts a multi-rendition transcoding job: the input is decoded once and the decoded video
+ *          frames are encoded with the params of each rendition. The outputs of a rendition are opened
+ *          with the output opener of the url of its params.
+ *
+ * @param   url         The url of the input.
+ * @param   params      Transcoding parameters of the renditions (video only, same start and duration).
+ * @param   n_params    Number of renditions, at most MAX_RENDITIONS.
+ * @return  If it is successful it returns eav_success, otherwise corresponding error.
+ */
+int
+xc_multi(
+    char *url,
+    xcparams_t *params,
+    int n_params);
+
 /**
  * @brief   Starts a muxing job.
  *
@@ -96,6 +142,34 @@ get_profile_name(
     int codec_id,
     int profile);
 
+/**
+ * @brief   Returns the names of the encoders or decoders of the linked ffmpeg libraries.
+ *
+ * @param   encoders    1 for the encoders, 0 for the decoders.
+ * @return  Returns the names separated by '\n', allocated inside this API (the caller frees it).
+ */
+char *
+get_codec_names(
+    int encoders);
+
+/**
+ * @brief   Returns the names of the muxers (output formats) of the linked ffmpeg libraries.
+ *
+ * @return  Returns the names separated by '\n', allocated inside this API (the caller frees it).
+ */
+char *
+get_muxer_names();
+
+/**
+ * @brief   Checks if the linked ffmpeg libraries have an encoder or a decoder with this name.
+ *
+ * @param   name        codec name, i.e. "libx265" or "h264_nvenc".
+ * @return  Returns 1 if the codec exists, otherwise 0.
+ */
+int
+has_codec(
+    const char *name);
+
 /**
  * @brief   Starts a probing job.
  *
@@ -111,6 +185,56 @@ probe(
     xcprobe_t **xcprobe,
     int *n_streams);
 
+/**
+ * @brief   Probes the container only (format name, duration, bit rate and tags), reading as little of
+ *          the input as possible.
+ *
+ * @param   params          Probing parameters.
+ * @param   container_info  Container information, format_name and tags are allocated inside this API.
+ * @return  If it is successful it returns eav_success and fills container_info,
+ *          otherwise returns corresponding error.
+ */
+int
+probe_header(
+    xcparams_t *params,
+    container_info_t *container_info);
+
+/**
+ * @brief   Probes the frames of one stream.
+ *
+ * @param   params          Probing parameters.
+ * @param   stream_index    Index of the stream to probe.
+ * @param   max_frames      Maximum number of frames to probe, 0 probes all the frames.
+ * @param   frames          Frame information array, will be allocated inside this API.
+ * @param   n_frames        Number of entries in frame information array.
+ * @return  If it is successful it returns eav_success and fills frames array and n_frames,
+ *          otherwise returns corresponding error.
+ */
+int
+probe_frames(
+    xcparams_t *params,
+    int stream_index,
+    int max_frames,
+    frame_info_t **frames,
+    int *n_frames);
+
+/**
+ * @brief   Verifies a segment can be decoded, the init segment is prepended if it is set.
+ *
+ * @param   init_buf        Init segment, NULL if the segment is self contained.
+ * @param   init_len        Length of the init segment.
+ * @param   seg_buf         Segment bytes.
+ * @param   seg_len         Length of the segment.
+ * @return  If all the packets of the segment decode without error it returns eav_success,
+ *          otherwise returns corresponding error.
+ */
+int
+verify_segment(
+    uint8_t *init_buf,
+    int64_t init_len,
+    uint8_t *seg_buf,
+    int64_t seg_len);
+
 /**
  * @brief   Sets the Go loggers.
  *
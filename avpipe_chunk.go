@@ -0,0 +1,42 @@
+package avpipe
+
+import "sort"
+
+// ProbeKeyFrames decodes the stream with index streamIndex of url and returns the PTS of its key frames,
+// relative to the first frame of the stream (the same units as XcParams.StartTimeTs). It lets a splitter
+// pick the chunks of a parallel transcoding: a chunk starting on a key frame needs no priming, otherwise
+// ChunkKeyFrame() gives the XcParams.ChunkKeyFrameTs of the chunk.
+func ProbeKeyFrames(url string, seekable bool, streamIndex int) ([]int64, error) {
+	frames, err := ProbeFrames(url, seekable, streamIndex, 0)
+	if err != nil {
+		return nil, err
+	}
+	return keyFramesOf(frames), nil
+}
+
+// keyFramesOf returns the sorted PTS of the key frames of frames, relative to the first frame
+func keyFramesOf(frames []FrameInfo) []int64 {
+	keyFrames := []int64{}
+	if len(frames) == 0 {
+		return keyFrames
+	}
+	start := frames[0].Pts
+	for _, f := range frames {
+		if f.KeyFrame {
+			keyFrames = append(keyFrames, f.Pts-start)
+		}
+	}
+	sort.Slice(keyFrames, func(i, j int) bool { return keyFrames[i] < keyFrames[j] })
+	return keyFrames
+}
+
+// ChunkKeyFrame returns the last of the sorted keyFrames at or before startTs, the XcParams.ChunkKeyFrameTs
+// of a chunk starting at startTs (XcParams.StartTimeTs). It returns 0 (decoding from the start) if there is
+// no key frame before startTs.
+func ChunkKeyFrame(keyFrames []int64, startTs int64) int64 {
+	i := sort.Search(len(keyFrames), func(i int) bool { return keyFrames[i] > startTs })
+	if i == 0 || keyFrames[i-1] < 0 {
+		return 0
+	}
+	return keyFrames[i-1]
+}
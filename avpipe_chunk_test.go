@@ -0,0 +1,30 @@
+package avpipe
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyFramesOf(t *testing.T) {
+	frames := []FrameInfo{
+		{Pts: 1024, KeyFrame: true},
+		{Pts: 3072},
+		{Pts: 2048},
+		{Pts: 16384, KeyFrame: true},
+		{Pts: 31744, KeyFrame: true},
+	}
+	require.Equal(t, []int64{0, 15360, 30720}, keyFramesOf(frames))
+	require.Equal(t, []int64{}, keyFramesOf(nil))
+}
+
+func TestChunkKeyFrame(t *testing.T) {
+	keyFrames := []int64{0, 15360, 30720}
+	require.Equal(t, int64(0), ChunkKeyFrame(keyFrames, 0))
+	require.Equal(t, int64(0), ChunkKeyFrame(keyFrames, 15359))
+	require.Equal(t, int64(15360), ChunkKeyFrame(keyFrames, 15360))
+	require.Equal(t, int64(15360), ChunkKeyFrame(keyFrames, 20000))
+	require.Equal(t, int64(30720), ChunkKeyFrame(keyFrames, 100000))
+	require.Equal(t, int64(0), ChunkKeyFrame([]int64{5000}, 1000))
+	require.Equal(t, int64(0), ChunkKeyFrame(nil, 1000))
+}
@@ -0,0 +1,134 @@
+package avpipe
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+)
+
+// ConnInputOpener implements InputOpener for a live stream read from a connection the caller already
+// has, i.e. a net.Conn of a pull ingest. The input is not seekable, XcParams.Seekable must be false.
+// Conn is read with a deadline of ReadTimeout like the UDP reader of a live source: the job waits for
+// the stream to start, then if nothing is read for ReadTimeout the read fails with EAV_IO_TIMEOUT and the
+// transcoding returns EAV_IO_TIMEOUT. The deadline is only set if Conn implements SetReadDeadline, as
+// net.Conn and os.File do. A Conn that keeps returning no data and no error fails the read with
+// io.ErrNoProgress. Conn is opened once and closed when the input is closed.
+type ConnInputOpener struct {
+	Conn        io.ReadCloser // The connection, net.Conn or any other stream
+	ReadTimeout time.Duration // Timeout of each read once the stream started, no timeout if 0
+
+	mutex  sync.Mutex
+	opened bool
+}
+
+// maxEmptyReads is the number of consecutive reads returning no data and no error after which the
+// connection is considered broken, the same as bufio
+const maxEmptyReads = 100
+
+// readDeadliner is implemented by net.Conn and os.File
+type readDeadliner interface {
+	SetReadDeadline(t time.Time) error
+}
+
+func (o *ConnInputOpener) Open(fd int64, url string) (InputHandler, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.Conn == nil {
+		return nil, fmt.Errorf("conn input has no connection, url=%s", url)
+	}
+	if o.opened {
+		return nil, fmt.Errorf("conn input already opened, url=%s", url)
+	}
+	o.opened = true
+
+	log.Debug("ConnInputOpener.Open", "fd", fd, "url", url, "readTimeout", o.ReadTimeout)
+	return &connInput{
+		opener: o,
+		url:    url,
+	}, nil
+}
+
+// connInput implements InputHandler
+type connInput struct {
+	opener    *ConnInputOpener
+	url       string
+	read      int64  // Bytes read from the connection
+	bytesRead uint64 // Last read offset reported by avpipe
+}
+
+func (i *connInput) Read(buf []byte) (int, error) {
+	conn := i.opener.Conn
+	deadliner, hasDeadline := conn.(readDeadliner)
+	hasDeadline = hasDeadline && i.opener.ReadTimeout > 0
+
+	for emptyReads := 0; ; {
+		if hasDeadline {
+			if err := deadliner.SetReadDeadline(time.Now().Add(i.opener.ReadTimeout)); err != nil {
+				return 0, fmt.Errorf("conn input set deadline failed, url=%s: %w", i.url, err)
+			}
+		}
+
+		n, err := conn.Read(buf)
+		i.read += int64(n)
+		if n > 0 {
+			return n, nil
+		}
+		if err == nil {
+			emptyReads++
+			if emptyReads >= maxEmptyReads {
+				log.Error("Conn input returns no data", "url", i.url, "read", i.read, "emptyReads", emptyReads)
+				return 0, io.ErrNoProgress
+			}
+			continue
+		}
+		if err == io.EOF {
+			log.Info("Conn input EOF", "url", i.url, "read", i.read)
+			return 0, io.EOF
+		}
+		if isTimeout(err) {
+			if i.read == 0 {
+				continue // waiting for stream start
+			}
+			log.Error("Stopped receiving from conn input", "url", i.url, "timeout", i.opener.ReadTimeout,
+				"read", i.read)
+			return 0, EAV_IO_TIMEOUT
+		}
+		return 0, fmt.Errorf("conn input read failed, url=%s, read=%d: %w", i.url, i.read, err)
+	}
+}
+
+func (i *connInput) Seek(offset int64, whence int) (int64, error) {
+	return -1, fmt.Errorf("conn input is not seekable, url=%s", i.url)
+}
+
+func (i *connInput) Close() error {
+	err := i.opener.Conn.Close()
+	log.Info("Closing conn input", "url", i.url, "read", i.read, "err", err)
+	return err
+}
+
+func (i *connInput) Size() int64 {
+	return -1
+}
+
+func (i *connInput) Stat(streamIndex int, statType AVStatType, statArgs interface{}) error {
+	switch statType {
+	case AV_IN_STAT_BYTES_READ:
+		i.bytesRead = *statArgs.(*uint64)
+		log.Debug("Conn input stat", "url", i.url, "bytesRead", i.bytesRead, "streamIndex", streamIndex)
+	}
+	return nil
+}
+
+// isTimeout returns true if err is the timeout of a read deadline
+func isTimeout(err error) bool {
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	return errors.Is(err, os.ErrDeadlineExceeded)
+}
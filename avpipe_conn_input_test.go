@@ -0,0 +1,87 @@
+package avpipe
+
+import (
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnInputRead(t *testing.T) {
+	server, client := net.Pipe()
+	opener := &ConnInputOpener{Conn: client, ReadTimeout: 100 * time.Millisecond}
+	in, err := opener.Open(1, "conn://ingest")
+	require.NoError(t, err)
+	defer in.Close()
+	require.Equal(t, int64(-1), in.Size())
+	_, err = in.Seek(0, io.SeekStart)
+	require.Error(t, err)
+
+	_, err = opener.Open(2, "conn://ingest")
+	require.Error(t, err)
+
+	go func() {
+		// The stream starts after more than the read timeout
+		time.Sleep(300 * time.Millisecond)
+		server.Write([]byte("stream"))
+		server.Write([]byte("data"))
+	}()
+
+	buf := make([]byte, 64)
+	n, err := in.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "stream", string(buf[:n]))
+	n, err = in.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(buf[:n]))
+
+	// Nothing read for the read timeout after the stream started
+	start := time.Now()
+	n, err = in.Read(buf)
+	require.Equal(t, 0, n)
+	require.ErrorIs(t, err, EAV_IO_TIMEOUT)
+	require.Less(t, time.Since(start), time.Second)
+}
+
+// emptyConn returns no data and no error on each read
+type emptyConn struct{}
+
+func (emptyConn) Read(buf []byte) (int, error) { return 0, nil }
+func (emptyConn) Close() error                 { return nil }
+
+func TestConnInputNoProgress(t *testing.T) {
+	opener := &ConnInputOpener{Conn: emptyConn{}, ReadTimeout: time.Second}
+	in, err := opener.Open(1, "conn://ingest")
+	require.NoError(t, err)
+	defer in.Close()
+
+	n, err := in.Read(make([]byte, 64))
+	require.Equal(t, 0, n)
+	require.Equal(t, io.ErrNoProgress, err)
+}
+
+func TestConnInputEOF(t *testing.T) {
+	server, client := net.Pipe()
+	opener := &ConnInputOpener{Conn: client, ReadTimeout: time.Second}
+	in, err := opener.Open(1, "conn://ingest")
+	require.NoError(t, err)
+	defer in.Close()
+
+	go func() {
+		server.Write([]byte("data"))
+		server.Close()
+	}()
+
+	buf := make([]byte, 64)
+	n, err := in.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, "data", string(buf[:n]))
+	n, err = in.Read(buf)
+	require.Equal(t, 0, n)
+	require.Equal(t, io.EOF, err)
+
+	_, err = (&ConnInputOpener{}).Open(1, "conn://ingest")
+	require.Error(t, err)
+}
@@ -125,6 +125,15 @@ var EAV_IO_TIMEOUT = errors.New("EAV_IO_TIMEOUT")
 // EAV_BAD_HANDLE is the error returned when the transcoding session handle is not valid
 var EAV_BAD_HANDLE = errors.New("EAV_BAD_HANDLE")
 
+// EAV_VERIFY_SEGMENT is the error returned when an output segment fails decode verification.
+var EAV_VERIFY_SEGMENT = errors.New("EAV_VERIFY_SEGMENT")
+
+// EAV_UNSUPPORTED_FORMAT is the error returned when the input format is not recognized by any demuxer.
+var EAV_UNSUPPORTED_FORMAT = errors.New("EAV_UNSUPPORTED_FORMAT")
+
+// EAV_STREAM_LANGUAGE is the error returned when no input stream has the requested language (AudioLanguage).
+var EAV_STREAM_LANGUAGE = errors.New("EAV_STREAM_LANGUAGE")
+
 // EAV_UNKNOWN is the error returned when error code doesn't exist in avpipeErrors table (below).
 var EAV_UNKNOWN = errors.New("EAV_UNKNOWN")
 
@@ -155,6 +164,9 @@ var avpipeErrors = map[int]error{
 	int(C.eav_pts_wrapped):          EAV_PTS_WRAPPED,
 	int(C.eav_io_timeout):           EAV_IO_TIMEOUT,
 	int(C.eav_bad_handle):           EAV_BAD_HANDLE,
+	int(C.eav_verify_segment):       EAV_VERIFY_SEGMENT,
+	int(C.eav_unsupported_format):   EAV_UNSUPPORTED_FORMAT,
+	int(C.eav_stream_language):      EAV_STREAM_LANGUAGE,
 }
 
 func avpipeError(code C.int) error {
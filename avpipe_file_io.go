@@ -0,0 +1,184 @@
+package avpipe
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/eluv-io/avpipe/goavpipe"
+)
+
+// FileInputOpener implements InputOpener for local files, the url is the path of the file
+type FileInputOpener struct{}
+
+func (o *FileInputOpener) Open(fd int64, url string) (InputHandler, error) {
+	f, err := os.Open(url)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("FileInputOpener.Open", "fd", fd, "url", url)
+	return &fileInput{url: url, file: f}, nil
+}
+
+// fileInput implements InputHandler
+type fileInput struct {
+	url  string
+	file *os.File
+}
+
+func (i *fileInput) Read(buf []byte) (int, error) {
+	n, err := i.file.Read(buf)
+	if err == io.EOF {
+		return 0, nil
+	}
+	return n, err
+}
+
+func (i *fileInput) Seek(offset int64, whence int) (int64, error) {
+	if whence&avseekSize != 0 {
+		return i.Size(), nil
+	}
+	return i.file.Seek(offset, whence&0xFFFF)
+}
+
+func (i *fileInput) Close() error {
+	return i.file.Close()
+}
+
+func (i *fileInput) Size() int64 {
+	fi, err := i.file.Stat()
+	if err != nil {
+		return -1
+	}
+	return fi.Size()
+}
+
+func (i *fileInput) Stat(streamIndex int, statType AVStatType, statArgs interface{}) error {
+	switch statType {
+	case AV_IN_STAT_BYTES_READ:
+		log.Debug("File input stat", "url", i.url, "bytesRead", *statArgs.(*uint64), "streamIndex", streamIndex)
+	}
+	return nil
+}
+
+// FileOutputName is the data the file name templates of FileOutputOpener are executed with
+type FileOutputName struct {
+	Handle      int64           // Handle of the input the output is generated from
+	StreamIndex int             // Index of the output stream
+	SegIndex    int             // Index of the segment
+	PTS         int64           // PTS of the output (frame images)
+	Type        goavpipe.AVType // Type of the output
+}
+
+// DefaultFileNames are the file name templates FileOutputOpener uses for each output type
+var DefaultFileNames = map[goavpipe.AVType]string{
+	goavpipe.DASHManifest:     "dash.mpd",
+	goavpipe.DASHVideoInit:    "vinit-stream{{.StreamIndex}}.m4s",
+	goavpipe.DASHVideoSegment: `vchunk-stream{{.StreamIndex}}-{{printf "%05d" .SegIndex}}.m4s`,
+	goavpipe.DASHAudioInit:    "ainit-stream{{.StreamIndex}}.m4s",
+	goavpipe.DASHAudioSegment: `achunk-stream{{.StreamIndex}}-{{printf "%05d" .SegIndex}}.m4s`,
+	goavpipe.HLSMasterM3U:     "master.m3u8",
+	goavpipe.HLSVideoM3U:      "video-media_{{.StreamIndex}}.m3u8",
+	goavpipe.HLSAudioM3U:      "audio-media_{{.StreamIndex}}.m3u8",
+	goavpipe.AES128Key:        "key.bin",
+	goavpipe.MP4Stream:        "mp4-stream.mp4",
+	goavpipe.FMP4Stream:       "fmp4-stream.mp4",
+	goavpipe.MP4Segment:       `segment{{.StreamIndex}}-{{printf "%05d" .SegIndex}}.mp4`,
+	goavpipe.FMP4VideoSegment: "vsegment-{{.SegIndex}}.mp4",
+	goavpipe.FMP4AudioSegment: "asegment{{.StreamIndex}}-{{.SegIndex}}.mp4",
+	goavpipe.FrameImage:       "{{.PTS}}.jpeg",
+	goavpipe.MpegtsSegment:    `ts-segment-{{printf "%05d" .SegIndex}}.ts`,
+	goavpipe.WebVTTInit:       "vtt-init.vtt",
+	goavpipe.WebVTTSegment:    `vtt-segment-{{printf "%05d" .SegIndex}}.vtt`,
+	goavpipe.ImageThumbnail:   "thumbnail-{{.SegIndex}}.jpeg",
+	goavpipe.WebMVideoStream:  "webm-video.webm",
+	goavpipe.WebMAudioStream:  "webm-audio{{.StreamIndex}}.webm",
+	goavpipe.IndexSidecar:     "index-stream{{.StreamIndex}}.json",
+}
+
+// FileOutputOpener implements OutputOpener writing the outputs as files in Dir. The file name of
+// each output is generated by executing the template for its type in Names, or DefaultFileNames
+// if Names doesn't have one, with a FileOutputName.
+type FileOutputOpener struct {
+	Dir   string                     // Directory of the output files, created if it doesn't exist
+	Names map[goavpipe.AVType]string // File name templates overriding DefaultFileNames
+}
+
+// FileName returns the path of the output file with the given properties
+func (o *FileOutputOpener) FileName(h int64, stream_index, seg_index int, pts int64, out_type goavpipe.AVType) (string, error) {
+	name, ok := o.Names[out_type]
+	if !ok {
+		name, ok = DefaultFileNames[out_type]
+	}
+	if !ok {
+		return "", fmt.Errorf("No file name for output type %s", out_type.Name())
+	}
+
+	tmpl, err := template.New(out_type.Name()).Parse(name)
+	if err != nil {
+		return "", fmt.Errorf("Invalid file name template for output type %s: %w", out_type.Name(), err)
+	}
+
+	var sb strings.Builder
+	err = tmpl.Execute(&sb, &FileOutputName{
+		Handle:      h,
+		StreamIndex: stream_index,
+		SegIndex:    seg_index,
+		PTS:         pts,
+		Type:        out_type,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	return filepath.Join(o.Dir, sb.String()), nil
+}
+
+func (o *FileOutputOpener) Open(h, fd int64, stream_index, seg_index int, pts int64, out_type goavpipe.AVType) (OutputHandler, error) {
+	filename, err := o.FileName(h, stream_index, seg_index, pts, out_type)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	log.Debug("FileOutputOpener.Open", "h", h, "fd", fd, "filename", filename)
+	return &fileOutput{url: filename, file: f}, nil
+}
+
+// fileOutput implements OutputHandler
+type fileOutput struct {
+	url  string
+	file *os.File
+}
+
+func (o *fileOutput) Write(buf []byte) (int, error) {
+	return o.file.Write(buf)
+}
+
+func (o *fileOutput) Seek(offset int64, whence int) (int64, error) {
+	return o.file.Seek(offset, whence)
+}
+
+func (o *fileOutput) Close() error {
+	return o.file.Close()
+}
+
+func (o *fileOutput) Stat(streamIndex int, avType goavpipe.AVType, statType AVStatType, statArgs interface{}) error {
+	switch statType {
+	case AV_OUT_STAT_BYTES_WRITTEN:
+		log.Debug("File output stat", "url", o.url, "bytesWritten", *statArgs.(*uint64), "streamIndex", streamIndex)
+	}
+	return nil
+}
@@ -0,0 +1,86 @@
+package avpipe
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/avpipe/goavpipe"
+)
+
+func TestFileOutputOpenerNames(t *testing.T) {
+	o := &FileOutputOpener{
+		Dir: "out",
+		Names: map[goavpipe.AVType]string{
+			goavpipe.FMP4VideoSegment: "h{{.Handle}}/video-{{.SegIndex}}.mp4",
+		},
+	}
+
+	tests := []struct {
+		outType     goavpipe.AVType
+		streamIndex int
+		segIndex    int
+		pts         int64
+		want        string
+	}{
+		{goavpipe.DASHManifest, 0, 0, 0, "out/dash.mpd"},
+		{goavpipe.DASHVideoInit, 0, 0, 0, "out/vinit-stream0.m4s"},
+		{goavpipe.DASHVideoSegment, 0, 7, 0, "out/vchunk-stream0-00007.m4s"},
+		{goavpipe.DASHAudioSegment, 1, 12, 0, "out/achunk-stream1-00012.m4s"},
+		{goavpipe.HLSAudioM3U, 1, 0, 0, "out/audio-media_1.m3u8"},
+		{goavpipe.FrameImage, 0, 0, 96000, "out/96000.jpeg"},
+		{goavpipe.FMP4VideoSegment, 0, 3, 0, "out/h5/video-3.mp4"},
+	}
+	for _, tt := range tests {
+		name, err := o.FileName(5, tt.streamIndex, tt.segIndex, tt.pts, tt.outType)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, name)
+	}
+
+	_, err := o.FileName(5, 0, 0, 0, goavpipe.Unknown)
+	require.Error(t, err)
+
+	o.Names[goavpipe.MP4Stream] = "{{.Missing}}.mp4"
+	_, err = o.FileName(5, 0, 0, 0, goavpipe.MP4Stream)
+	require.Error(t, err)
+}
+
+func TestFileOpeners(t *testing.T) {
+	dir := t.TempDir()
+	content := []byte("avpipe file opener test")
+	url := filepath.Join(dir, "input.bin")
+	require.NoError(t, os.WriteFile(url, content, 0644))
+
+	in, err := (&FileInputOpener{}).Open(1, url)
+	require.NoError(t, err)
+	defer in.Close()
+	require.Equal(t, int64(len(content)), in.Size())
+
+	size, err := in.Seek(0, avseekSize)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), size)
+
+	_, err = in.Seek(7, io.SeekStart)
+	require.NoError(t, err)
+	buf := make([]byte, 100)
+	n, err := in.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, content[7:], buf[:n])
+	n, err = in.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, 0, n)
+
+	o := &FileOutputOpener{Dir: filepath.Join(dir, "out")}
+	out, err := o.Open(1, 2, 0, 4, 0, goavpipe.FMP4VideoSegment)
+	require.NoError(t, err)
+	_, err = out.Write(content)
+	require.NoError(t, err)
+	require.NoError(t, out.Close())
+
+	written, err := os.ReadFile(filepath.Join(dir, "out", "vsegment-4.mp4"))
+	require.NoError(t, err)
+	require.Equal(t, content, written)
+}
@@ -0,0 +1,307 @@
+package avpipe
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"math/big"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// FrameLogStats is the result of ParseFrameLog(), the stats of the frames and packets logged by a job run
+// with DebugFrameLevel set.
+type FrameLogStats struct {
+	Lines   int               // Frame and packet lines parsed
+	Streams []*FrameLogStream // Streams in order of their first line
+}
+
+// FrameLogStream are the stats of the frames (or packets) of a stream logged at the same stage of the job
+type FrameLogStream struct {
+	Stage       string // Where they are logged, i.e "IN", "OUT", "BYPASS", "REMUX" for packets or "IN", "FILT", "TOENC" for frames
+	IsPacket    bool   // Packets (PACKET lines) or decoded frames (FRAME lines)
+	MediaType   string // "video" or "audio"
+	StreamIndex int
+	// Time base of the PTS, from the DECODER dump for the input stages and the ENCODER dump for "OUT".
+	// It is nil if the log has no dump of the stream, then Bitrate is not computed.
+	TimeBase *big.Rat
+
+	Entries   []FrameLogEntry // In log order (DTS order for the packets)
+	KeyFrames int
+	Bytes     int64
+	FirstPTS  int64 // Lowest PTS
+	LastPTS   int64 // Highest PTS
+
+	// Gaps and overlaps of the PTS in presentation order, compared to the duration of the previous frame
+	Discontinuities []PTSDiscontinuity
+	DroppedFrames   int64 // Frames missing in the gaps, counted with the duration of the frame before the gap
+	NonMonotonicDTS int   // Packets whose DTS is not after the DTS of the previous packet
+	Bitrate         []BitrateSample
+}
+
+// FrameLogEntry is a frame or a packet line of the log
+type FrameLogEntry struct {
+	PTS      int64
+	DTS      int64
+	Duration int64
+	Size     int
+	Key      bool
+}
+
+// PTSDiscontinuity is a frame whose PTS doesn't follow the previous frame, Gap is PTS - (previous PTS +
+// previous duration): positive if frames are missing, negative if they overlap
+type PTSDiscontinuity struct {
+	PTS int64
+	Gap int64
+}
+
+// BitrateSample is the bitrate of the frames whose PTS is in the second Second (from FirstPTS)
+type BitrateSample struct {
+	Second  int64
+	Bitrate int64 // bits/s
+}
+
+// frameLogKey identifies the stream of a frame line
+type frameLogKey struct {
+	stage       string
+	isPacket    bool
+	mediaType   string
+	streamIndex int
+}
+
+// timeBaseKey identifies the stream of a DECODER or ENCODER dump line
+type timeBaseKey struct {
+	codecType   int
+	streamIndex int
+}
+
+// ParseFrameLog parses the log of a job run with DebugFrameLevel set (the VIDEO/AUDIO PACKET and FRAME
+// lines, and the DECODER and ENCODER dumps for the time bases) and returns the stats of each stream at
+// each stage: PTS, DTS and size of the frames, key frames, PTS discontinuities and dropped frames, and the
+// bitrate per second. The log must be of a single job. It returns an error if the log has no frame lines.
+func ParseFrameLog(r io.Reader) (*FrameLogStats, error) {
+	stats := &FrameLogStats{}
+	streams := map[frameLogKey]*FrameLogStream{}
+	decoderTimeBases := map[int]*big.Rat{}
+	encoderTimeBases := map[timeBaseKey]*big.Rat{}
+
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Text()
+
+		if i := strings.Index(line, "DECODER["); i >= 0 {
+			if key, tb, ok := parseTimeBaseLine(line[i:]); ok {
+				decoderTimeBases[key.streamIndex] = tb
+			}
+			continue
+		}
+		if i := strings.Index(line, "ENCODER["); i >= 0 {
+			if key, tb, ok := parseTimeBaseLine(line[i:]); ok {
+				encoderTimeBases[key] = tb
+			}
+			continue
+		}
+
+		key, entry, ok := parseFrameLine(line)
+		if !ok {
+			continue
+		}
+		stats.Lines++
+		s, ok := streams[key]
+		if !ok {
+			s = &FrameLogStream{
+				Stage:       key.stage,
+				IsPacket:    key.isPacket,
+				MediaType:   key.mediaType,
+				StreamIndex: key.streamIndex,
+			}
+			streams[key] = s
+			stats.Streams = append(stats.Streams, s)
+		}
+		s.Entries = append(s.Entries, entry)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if stats.Lines == 0 {
+		return nil, fmt.Errorf("no frame lines in the log, DebugFrameLevel must be set")
+	}
+
+	for _, s := range stats.Streams {
+		switch s.Stage {
+		case "IN", "IN THREAD", "BYPASS", "REMUX":
+			s.TimeBase = decoderTimeBases[s.StreamIndex]
+		case "OUT":
+			codecType := 0 // AVMEDIA_TYPE_VIDEO
+			if s.MediaType == "audio" {
+				codecType = 1 // AVMEDIA_TYPE_AUDIO
+			}
+			s.TimeBase = encoderTimeBases[timeBaseKey{codecType: codecType, streamIndex: s.StreamIndex}]
+		}
+		s.analyse()
+	}
+
+	return stats, nil
+}
+
+// analyse computes the stats of the entries of s
+func (s *FrameLogStream) analyse() {
+	for i, e := range s.Entries {
+		s.Bytes += int64(e.Size)
+		if e.Key {
+			s.KeyFrames++
+		}
+		if s.IsPacket && i > 0 && e.DTS <= s.Entries[i-1].DTS {
+			s.NonMonotonicDTS++
+		}
+	}
+
+	// The packets are in decoding order, the gaps are in presentation order
+	sorted := make([]FrameLogEntry, len(s.Entries))
+	copy(sorted, s.Entries)
+	sort.SliceStable(sorted, func(i, j int) bool { return sorted[i].PTS < sorted[j].PTS })
+	s.FirstPTS = sorted[0].PTS
+	s.LastPTS = sorted[len(sorted)-1].PTS
+
+	for i := 1; i < len(sorted); i++ {
+		prev := sorted[i-1]
+		if prev.Duration <= 0 {
+			continue
+		}
+		gap := sorted[i].PTS - (prev.PTS + prev.Duration)
+		if gap == 0 {
+			continue
+		}
+		s.Discontinuities = append(s.Discontinuities, PTSDiscontinuity{PTS: sorted[i].PTS, Gap: gap})
+		if gap > 0 {
+			s.DroppedFrames += gap / prev.Duration
+		}
+	}
+
+	if s.TimeBase == nil || s.TimeBase.Sign() <= 0 {
+		return
+	}
+	bits := map[int64]int64{}
+	var last int64
+	for _, e := range sorted {
+		sec := new(big.Rat).Mul(big.NewRat(e.PTS-s.FirstPTS, 1), s.TimeBase)
+		second := new(big.Int).Quo(sec.Num(), sec.Denom()).Int64()
+		bits[second] += int64(e.Size) * 8
+		last = second
+	}
+	for second := int64(0); second <= last; second++ {
+		s.Bitrate = append(s.Bitrate, BitrateSample{Second: second, Bitrate: bits[second]})
+	}
+}
+
+// parseFrameLine parses a line written by dump_packet() or dump_frame(), i.e.
+// "VIDEO PACKET OUT  pts=0 dts=-1024 duration=512 pos=-1 size=3264 stream_index=0 flags=1 data=0x..." or
+// "AUDIO FRAME IN , stream_index=1, [1] pts=0 pkt_dts=0 pkt_duration=1024 ... key=1 ... pkt_size=371 ..."
+func parseFrameLine(line string) (frameLogKey, FrameLogEntry, bool) {
+	var key frameLogKey
+	var entry FrameLogEntry
+
+	var rest string
+	if i := strings.Index(line, " PACKET "); i >= 0 {
+		key.isPacket = true
+		key.mediaType = mediaTypeBefore(line[:i])
+		rest = line[i+len(" PACKET "):]
+		j := strings.Index(rest, " pts=")
+		if j < 0 {
+			return key, entry, false
+		}
+		key.stage = strings.TrimSpace(rest[:j])
+	} else if i := strings.Index(line, " FRAME "); i >= 0 {
+		key.mediaType = mediaTypeBefore(line[:i])
+		rest = line[i+len(" FRAME "):]
+		j := strings.Index(rest, ", stream_index=")
+		if j < 0 {
+			return key, entry, false
+		}
+		key.stage = strings.TrimSpace(rest[:j])
+	} else {
+		return key, entry, false
+	}
+	if key.mediaType == "" {
+		return key, entry, false
+	}
+
+	fields := logFields(rest)
+	var err error
+	if key.streamIndex, err = strconv.Atoi(fields["stream_index"]); err != nil {
+		return key, entry, false
+	}
+	// Frames without PTS (AV_NOPTS_VALUE) are not in the stats
+	if entry.PTS, err = strconv.ParseInt(fields["pts"], 10, 64); err != nil || entry.PTS == math.MinInt64 {
+		return key, entry, false
+	}
+	if key.isPacket {
+		entry.DTS, _ = strconv.ParseInt(fields["dts"], 10, 64)
+		entry.Duration, _ = strconv.ParseInt(fields["duration"], 10, 64)
+		entry.Size, _ = strconv.Atoi(fields["size"])
+		flags, _ := strconv.ParseInt(fields["flags"], 16, 64)
+		entry.Key = flags&1 != 0 // AV_PKT_FLAG_KEY
+	} else {
+		entry.DTS, _ = strconv.ParseInt(fields["pkt_dts"], 10, 64)
+		entry.Duration, _ = strconv.ParseInt(fields["pkt_duration"], 10, 64)
+		entry.Size, _ = strconv.Atoi(fields["pkt_size"])
+		entry.Key = fields["key"] == "1"
+	}
+	return key, entry, true
+}
+
+// parseTimeBaseLine parses the codec type, the stream index and the time base of a line written by
+// dump_decoder() ("DECODER[0] url=... codec_type=0 ... time_base=1/24000 ...") or dump_encoder()
+// ("ENCODER[0] stream_index=0 url=... codec_type=0 ... time_base=1/90000 ...")
+func parseTimeBaseLine(line string) (timeBaseKey, *big.Rat, bool) {
+	var key timeBaseKey
+	end := strings.Index(line, "]")
+	if end < 0 {
+		return key, nil, false
+	}
+	index, err := strconv.Atoi(line[strings.Index(line, "[")+1 : end])
+	if err != nil {
+		return key, nil, false
+	}
+	fields := logFields(line[end+1:])
+	if s, ok := fields["stream_index"]; ok {
+		if index, err = strconv.Atoi(s); err != nil {
+			return key, nil, false
+		}
+	}
+	key.streamIndex = index
+	if key.codecType, err = strconv.Atoi(fields["codec_type"]); err != nil {
+		return key, nil, false
+	}
+	tb, ok := new(big.Rat).SetString(fields["time_base"])
+	if !ok || tb.Sign() <= 0 {
+		return key, nil, false
+	}
+	return key, tb, true
+}
+
+// mediaTypeBefore returns "video" or "audio" if s ends with VIDEO or AUDIO
+func mediaTypeBefore(s string) string {
+	if strings.HasSuffix(s, "VIDEO") {
+		return "video"
+	}
+	if strings.HasSuffix(s, "AUDIO") {
+		return "audio"
+	}
+	return ""
+}
+
+// logFields returns the key=value fields of s
+func logFields(s string) map[string]string {
+	fields := map[string]string{}
+	for _, token := range strings.Fields(s) {
+		kv := strings.SplitN(strings.TrimSuffix(token, ","), "=", 2)
+		if len(kv) == 2 {
+			fields[kv[0]] = kv[1]
+		}
+	}
+	return fields
+}
@@ -0,0 +1,77 @@
+package avpipe
+
+import (
+	"fmt"
+	"math/big"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// frameLog returns the log of 3 sec of video packets at 30 fps with the frame 31 missing, and of 2 audio
+// frames with the same PTS
+func frameLog() string {
+	b := &strings.Builder{}
+	b.WriteString("2024-05-02T10:00:00.000Z DBG ENCODER[0] stream_index=0 url=in.mp4 profile=100 level=31 id=0 " +
+		"codec_type=0 start_time=0 duration=0 nb_frames=0 time_base=1/15360 codec_time_base=1/30 " +
+		"frame_rate=30/1 avg_frame_rate=30/1\n")
+	for i := 0; i < 90; i++ {
+		if i == 31 {
+			continue
+		}
+		flags, size := 0, 1000
+		if i%30 == 0 {
+			flags, size = 1, 5000
+		}
+		fmt.Fprintf(b, "2024-05-02T10:00:00.000Z DBG VIDEO PACKET OUT  pts=%d dts=%d duration=512 pos=-1 "+
+			"size=%d stream_index=0 flags=%x data=0x7f0000\n", i*512, i*512-1024, size, flags)
+	}
+	b.WriteString("2024-05-02T10:00:00.000Z DBG AUDIO FRAME IN , stream_index=1, [0] pts=0 pkt_dts=0 " +
+		"pkt_duration=1024 be_time_stamp=0 key=1 pict_type=0 pkt_size=371 nb_samples=1024 width=0 height=0 " +
+		"linesize=4096 format=8 coded_pic_num=0 flags=0 channels=2\n")
+	b.WriteString("2024-05-02T10:00:00.000Z DBG AUDIO FRAME IN , stream_index=1, [1] pts=0 pkt_dts=0 " +
+		"pkt_duration=1024 be_time_stamp=0 key=1 pict_type=0 pkt_size=371 nb_samples=1024 width=0 height=0 " +
+		"linesize=4096 format=8 coded_pic_num=0 flags=0 channels=2\n")
+	b.WriteString("2024-05-02T10:00:00.000Z DBG encode_frame() EAGAIN in receiving packet, url=in.mp4\n")
+	return b.String()
+}
+
+func TestParseFrameLog(t *testing.T) {
+	stats, err := ParseFrameLog(strings.NewReader(frameLog()))
+	require.NoError(t, err)
+	require.Equal(t, 91, stats.Lines)
+	require.Equal(t, 2, len(stats.Streams))
+
+	video := stats.Streams[0]
+	require.Equal(t, "OUT", video.Stage)
+	require.True(t, video.IsPacket)
+	require.Equal(t, "video", video.MediaType)
+	require.Equal(t, 89, len(video.Entries))
+	require.Equal(t, 3, video.KeyFrames)
+	require.Equal(t, int64(86*1000+3*5000), video.Bytes)
+	require.Equal(t, int64(0), video.FirstPTS)
+	require.Equal(t, int64(89*512), video.LastPTS)
+	require.Equal(t, []PTSDiscontinuity{{PTS: 32 * 512, Gap: 512}}, video.Discontinuities)
+	require.Equal(t, int64(1), video.DroppedFrames)
+	require.Equal(t, 0, video.NonMonotonicDTS)
+	require.Equal(t, 0, video.TimeBase.Cmp(big.NewRat(1, 15360)))
+	require.Equal(t, []BitrateSample{
+		{Second: 0, Bitrate: (29*1000 + 5000) * 8},
+		{Second: 1, Bitrate: (28*1000 + 5000) * 8},
+		{Second: 2, Bitrate: (29*1000 + 5000) * 8},
+	}, video.Bitrate)
+
+	audio := stats.Streams[1]
+	require.Equal(t, "IN", audio.Stage)
+	require.False(t, audio.IsPacket)
+	require.Equal(t, "audio", audio.MediaType)
+	require.Equal(t, 1, audio.StreamIndex)
+	require.Equal(t, 2, audio.KeyFrames)
+	require.Equal(t, []PTSDiscontinuity{{PTS: 0, Gap: -1024}}, audio.Discontinuities)
+	require.Nil(t, audio.TimeBase)
+	require.Nil(t, audio.Bitrate)
+
+	_, err = ParseFrameLog(strings.NewReader("2024-05-02T10:00:00.000Z INF avpipe done\n"))
+	require.Error(t, err)
+}
@@ -0,0 +1,280 @@
+package avpipe
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/eluv-io/avpipe/goavpipe"
+)
+
+type nopInputOpener struct{}
+
+func (o *nopInputOpener) Open(fd int64, url string) (InputHandler, error) {
+	return &nopInput{}, nil
+}
+
+type nopInput struct{}
+
+func (i *nopInput) Read(buf []byte) (int, error) { return 0, nil }
+
+func (i *nopInput) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+
+func (i *nopInput) Close() error { return nil }
+
+func (i *nopInput) Size() int64 { return 0 }
+
+func (i *nopInput) Stat(streamIndex int, statType AVStatType, statArgs interface{}) error {
+	return nil
+}
+
+type nopOutputOpener struct{}
+
+func (o *nopOutputOpener) Open(h, fd int64, stream_index, seg_index int, pts int64, out_type goavpipe.AVType) (OutputHandler, error) {
+	return nil, fmt.Errorf("not supported")
+}
+
+// TestHandlersRemovedOnClose opens and closes many inputs concurrently and
+// checks the global handler tables are empty afterwards
+func TestHandlersRemovedOnClose(t *testing.T) {
+	const url = "test://handlers"
+	require.NoError(t, RegisterUrlIOHandler(url, &nopInputOpener{}, &nopOutputOpener{}))
+	defer releaseUrlIOHandlers(url)
+
+	wg := sync.WaitGroup{}
+	for i := 0; i < 16; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 500; j++ {
+				fd, _, err := openInput(url)
+				if assert.NoError(t, err) {
+					assert.NoError(t, closeInput(fd))
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	gMutex.RLock()
+	defer gMutex.RUnlock()
+	require.Equal(t, 0, len(gHandlers))
+}
+
+func TestRegisterUrlIOHandlerTwice(t *testing.T) {
+	const url = "test://twice"
+	require.NoError(t, RegisterUrlIOHandler(url, &nopInputOpener{}, &nopOutputOpener{}))
+	require.Error(t, RegisterUrlIOHandler(url, &nopInputOpener{}, &nopOutputOpener{}))
+
+	releaseUrlIOHandlers(url)
+	require.NoError(t, RegisterUrlIOHandler(url, &nopInputOpener{}, &nopOutputOpener{}))
+	releaseUrlIOHandlers(url)
+
+	gMutex.RLock()
+	defer gMutex.RUnlock()
+	require.NotContains(t, gURLInputOpeners, url)
+	require.NotContains(t, gURLOutputOpeners, url)
+}
+
+// InitUrlIOHandler() keeps the first opener of a url that is set twice
+func TestInitUrlIOHandlerTwice(t *testing.T) {
+	const url = "test://init-twice"
+	first := &recordingOutputOpener{}
+	InitUrlIOHandler(url, nil, first)
+	InitUrlIOHandler(url, nil, &recordingOutputOpener{})
+	require.Same(t, first, getOutputOpener(url))
+	releaseUrlIOHandlers(url)
+}
+
+// recordingOutputOpener records the handlers of the outputs it opens
+type recordingOutputOpener struct {
+	mutex    sync.Mutex
+	handlers map[int64]int
+}
+
+func (o *recordingOutputOpener) Open(h, fd int64, stream_index, seg_index int, pts int64, out_type goavpipe.AVType) (OutputHandler, error) {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+	if o.handlers == nil {
+		o.handlers = make(map[int64]int)
+	}
+	o.handlers[h]++
+	return &shortOutput{max: 1024}, nil
+}
+
+// TestConcurrentUrlOutputOpeners runs many jobs with URL specific output openers concurrently, while the
+// global opener changes, and checks each job opens its outputs with its own opener
+func TestConcurrentUrlOutputOpeners(t *testing.T) {
+	const jobs = 8
+	const outputs = 50
+
+	global := &recordingOutputOpener{}
+	InitIOHandler(&nopInputOpener{}, global)
+	defer InitIOHandler(nil, nil)
+
+	openers := make([]*recordingOutputOpener, jobs)
+	handlers := make([]int64, jobs)
+	wg := sync.WaitGroup{}
+	for i := 0; i < jobs; i++ {
+		openers[i] = &recordingOutputOpener{}
+		url := fmt.Sprintf("test://job-%d", i)
+		require.NoError(t, RegisterUrlIOHandler(url, &nopInputOpener{}, openers[i]))
+
+		wg.Add(1)
+		go func(i int, url string) {
+			defer wg.Done()
+			defer releaseUrlIOHandlers(url)
+
+			fd, _, err := openInput(url)
+			if !assert.NoError(t, err) {
+				return
+			}
+			handlers[i] = fd
+			for j := 0; j < outputs; j++ {
+				// Another job may set the global openers meanwhile
+				InitIOHandler(&nopInputOpener{}, global)
+				_, err := openOutputHandler(fd, 0, j, 0, goavpipe.FMP4VideoSegment)
+				assert.NoError(t, err)
+			}
+			assert.NoError(t, closeInput(fd))
+		}(i, url)
+	}
+	wg.Wait()
+
+	require.Empty(t, global.handlers)
+	for i, o := range openers {
+		require.Equal(t, map[int64]int{handlers[i]: outputs}, o.handlers)
+	}
+
+	// The outputs of a closed handler are not opened with the global opener
+	_, err := openOutputHandler(handlers[0], 0, 1, 0, goavpipe.FMP4VideoSegment)
+	require.Error(t, err)
+	require.Empty(t, global.handlers)
+}
+
+// TestOutputOpenerOfHandler opens the outputs of two jobs with URL specific output openers, the outputs
+// of each handler are opened with the opener of its URL even once the openers of the URLs are released
+func TestOutputOpenerOfHandler(t *testing.T) {
+	const url1 = "test://opener-1"
+	const url2 = "test://opener-2"
+	opener1 := &recordingOutputOpener{}
+	opener2 := &recordingOutputOpener{}
+	global := &recordingOutputOpener{}
+	InitIOHandler(&nopInputOpener{}, global)
+	defer InitIOHandler(nil, nil)
+
+	require.NoError(t, RegisterUrlIOHandler(url1, &nopInputOpener{}, opener1))
+	require.NoError(t, RegisterUrlIOHandler(url2, &nopInputOpener{}, opener2))
+	fd1, _, err := openInput(url1)
+	require.NoError(t, err)
+	fd2, err := openRendition(url2)
+	require.NoError(t, err)
+	releaseUrlIOHandlers(url1)
+	releaseUrlIOHandlers(url2)
+
+	for i := 0; i < 3; i++ {
+		_, err = openOutputHandler(fd1, 0, i, 0, goavpipe.FMP4VideoSegment)
+		require.NoError(t, err)
+		_, err = openOutputHandler(fd2, 1, i, 0, goavpipe.FMP4AudioSegment)
+		require.NoError(t, err)
+	}
+	require.Equal(t, map[int64]int{fd1: 3}, opener1.handlers)
+	require.Equal(t, map[int64]int{fd2: 3}, opener2.handlers)
+	require.Empty(t, global.handlers)
+
+	require.NoError(t, closeInput(fd1))
+	gMutex.Lock()
+	delete(gHandlers, fd2)
+	gMutex.Unlock()
+}
+
+// shortOutput writes at most max bytes per Write, and fails once it has written failAt bytes (if > 0)
+type shortOutput struct {
+	bytes.Buffer
+	max    int
+	failAt int
+}
+
+func (o *shortOutput) Write(buf []byte) (int, error) {
+	if o.failAt > 0 && o.Len() >= o.failAt {
+		return 0, fmt.Errorf("write failed")
+	}
+	if len(buf) > o.max {
+		buf = buf[:o.max]
+	}
+	return o.Buffer.Write(buf)
+}
+
+func (o *shortOutput) Seek(offset int64, whence int) (int64, error) { return 0, nil }
+
+func (o *shortOutput) Close() error { return nil }
+
+func (o *shortOutput) Stat(streamIndex int, avType goavpipe.AVType, statType AVStatType, statArgs interface{}) error {
+	return nil
+}
+
+func TestOutWriterShortWrite(t *testing.T) {
+	const fd = 1
+	data := []byte("0123456789abcdefghij")
+
+	out := &shortOutput{max: 3}
+	h := &ioHandler{outTable: make(map[int64]OutputHandler), mutex: &sync.Mutex{}}
+	h.putOutTable(fd, out)
+	h.openOutput(fd, 0, 1, goavpipe.FMP4VideoSegment)
+
+	n, err := h.OutWriter(fd, data)
+	require.NoError(t, err)
+	require.Equal(t, len(data), n)
+	require.Equal(t, data, out.Bytes())
+	h.putOutTable(fd, nil)
+	require.Equal(t, int64(len(data)), h.artifacts()[0].Bytes)
+
+	// The error of a write is returned with the bytes written before it
+	out = &shortOutput{max: 3, failAt: 6}
+	n, err = writeFull(out, data)
+	require.Error(t, err)
+	require.Equal(t, 6, n)
+
+	// A write of nothing without an error doesn't loop forever
+	out = &shortOutput{max: 0}
+	n, err = writeFull(out, data)
+	require.ErrorIs(t, err, io.ErrShortWrite)
+	require.Equal(t, 0, n)
+}
+
+// readerInput reads from r, or fails with err once r is read if err is set
+type readerInput struct {
+	nopInput
+	r   io.Reader
+	err error
+}
+
+func (i *readerInput) Read(buf []byte) (int, error) {
+	n, err := i.r.Read(buf)
+	if n == 0 && i.err != nil {
+		return 0, i.err
+	}
+	return n, err
+}
+
+func TestReadInput(t *testing.T) {
+	buf := make([]byte, 8)
+
+	h := &ioHandler{input: &readerInput{r: bytes.NewReader([]byte("0123456789"))}}
+	require.Equal(t, 8, h.readInput(buf))
+	require.Equal(t, []byte("01234567"), buf)
+	require.Equal(t, 2, h.readInput(buf))
+	require.Equal(t, 0, h.readInput(buf)) // io.EOF
+
+	h = &ioHandler{input: &readerInput{r: bytes.NewReader(nil), err: io.ErrUnexpectedEOF}}
+	require.Equal(t, -1, h.readInput(buf))
+
+	// (0, nil) is EOF too
+	h = &ioHandler{input: &nopInput{}}
+	require.Equal(t, 0, h.readInput(buf))
+}
@@ -0,0 +1,305 @@
+package avpipe
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// avseekSize is the AVSEEK_SIZE flag avpipe passes in whence to query the size of the input
+const avseekSize = 0x10000
+
+// HTTPInputOpener implements InputOpener for http(s) URLs. The size of the input is obtained
+// with a HEAD request, or with a range request of the first byte if the server rejects HEAD
+// requests (i.e. signed URLs only valid for GET), and seeks are served with range requests,
+// so the input is seekable if the server supports ranges.
+// Timeout only bounds connecting and receiving the response headers of a request: reading the
+// body is not bounded, since the body of a large or slow input is read as long as the transcoding.
+type HTTPInputOpener struct {
+	Client     *http.Client  // Client used for the requests, http.DefaultClient if not set
+	Header     http.Header   // Extra headers added to each request, i.e. authorization
+	Timeout    time.Duration // Timeout to get the response headers of each request, no timeout if 0
+	Retries    int           // Number of times a failed request is retried
+	RetryDelay time.Duration // Delay before the first retry, doubled for each following retry
+}
+
+func (o *HTTPInputOpener) Open(fd int64, url string) (InputHandler, error) {
+	i := &httpInput{
+		opener: o,
+		url:    url,
+		size:   -1,
+	}
+
+	resp, err := i.do(http.MethodHead, "")
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		if resp.ContentLength >= 0 {
+			i.size = resp.ContentLength
+		}
+	case http.StatusForbidden, http.StatusMethodNotAllowed:
+		if i.size, err = i.sizeFromRange(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("HTTP input open failed, url=%s, status=%s", url, resp.Status)
+	}
+
+	log.Debug("HTTPInputOpener.Open", "fd", fd, "url", url, "size", i.size)
+	return i, nil
+}
+
+// httpInput implements InputHandler
+type httpInput struct {
+	opener    *HTTPInputOpener
+	url       string
+	size      int64         // Size of the input, -1 if not known
+	offset    int64         // Current read offset
+	body      io.ReadCloser // Body of the response being read, starting at the read offset
+	bytesRead uint64        // Last read offset reported by avpipe
+}
+
+func (i *httpInput) Read(buf []byte) (int, error) {
+	if i.size >= 0 && i.offset >= i.size {
+		return 0, nil
+	}
+
+	for retry := 0; ; retry++ {
+		if i.body == nil {
+			if err := i.openBody(); err != nil {
+				return 0, err
+			}
+			if i.body == nil {
+				// The range starts after the end of the input
+				return 0, nil
+			}
+		}
+
+		n, err := i.body.Read(buf)
+		i.offset += int64(n)
+		if err == io.EOF {
+			i.closeBody()
+			if n > 0 || i.size < 0 || i.offset >= i.size {
+				return n, nil
+			}
+		} else if n > 0 || err == nil {
+			return n, nil
+		}
+
+		// The connection was lost before the end of the input, resume from the read offset
+		i.closeBody()
+		if retry >= i.opener.Retries {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return 0, fmt.Errorf("HTTP input read failed, url=%s, offset=%d: %w", i.url, i.offset, err)
+		}
+		log.Warn("HTTP input read failed, retrying", "url", i.url, "offset", i.offset, "error", err)
+		time.Sleep(i.opener.retryDelay(retry))
+	}
+}
+
+func (i *httpInput) Seek(offset int64, whence int) (int64, error) {
+	if whence&avseekSize != 0 {
+		return i.size, nil
+	}
+
+	var pos int64
+	switch whence & 0xFFFF {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = i.offset + offset
+	case io.SeekEnd:
+		if i.size < 0 {
+			return -1, fmt.Errorf("HTTP input seek from end with unknown size, url=%s", i.url)
+		}
+		pos = i.size + offset
+	default:
+		return -1, fmt.Errorf("HTTP input invalid seek whence=%d, url=%s", whence, i.url)
+	}
+	if pos < 0 {
+		return -1, fmt.Errorf("HTTP input invalid seek offset=%d, url=%s", pos, i.url)
+	}
+
+	if pos != i.offset {
+		// The next read opens a new range request at pos
+		i.closeBody()
+		i.offset = pos
+	}
+	return pos, nil
+}
+
+func (i *httpInput) Close() error {
+	i.closeBody()
+	return nil
+}
+
+func (i *httpInput) Size() int64 {
+	return i.size
+}
+
+func (i *httpInput) Stat(streamIndex int, statType AVStatType, statArgs interface{}) error {
+	switch statType {
+	case AV_IN_STAT_BYTES_READ:
+		i.bytesRead = *statArgs.(*uint64)
+		log.Debug("HTTP input stat", "url", i.url, "bytesRead", i.bytesRead, "streamIndex", streamIndex)
+	}
+	return nil
+}
+
+// openBody sends a GET request for the input starting at the read offset. The body stays nil
+// if the read offset is past the end of the input.
+func (i *httpInput) openBody() error {
+	resp, err := i.do(http.MethodGet, "bytes="+strconv.FormatInt(i.offset, 10)+"-")
+	if err != nil {
+		return err
+	}
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+	case http.StatusOK:
+		if i.offset > 0 {
+			// The server ignored the range, skip to the read offset
+			if _, err = io.CopyN(io.Discard, resp.Body, i.offset); err != nil {
+				resp.Body.Close()
+				return fmt.Errorf("HTTP input skip failed, url=%s, offset=%d: %w", i.url, i.offset, err)
+			}
+		}
+	case http.StatusRequestedRangeNotSatisfiable:
+		resp.Body.Close()
+		return nil
+	default:
+		resp.Body.Close()
+		return fmt.Errorf("HTTP input read failed, url=%s, offset=%d, status=%s", i.url, i.offset, resp.Status)
+	}
+
+	i.body = resp.Body
+	return nil
+}
+
+// sizeFromRange gets the size of the input from the Content-Range of a GET request of its first
+// byte. The size is -1 if the server doesn't tell it.
+func (i *httpInput) sizeFromRange() (int64, error) {
+	resp, err := i.do(http.MethodGet, "bytes=0-0")
+	if err != nil {
+		return -1, err
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		// Content-Range: bytes 0-0/size, the size is "*" if it is unknown
+		contentRange := resp.Header.Get("Content-Range")
+		if k := strings.LastIndexByte(contentRange, '/'); k >= 0 {
+			if size, err := strconv.ParseInt(contentRange[k+1:], 10, 64); err == nil {
+				return size, nil
+			}
+		}
+		return -1, nil
+	case http.StatusOK:
+		// The server ignored the range, the body is the whole input
+		return resp.ContentLength, nil
+	case http.StatusRequestedRangeNotSatisfiable:
+		// Empty input
+		return 0, nil
+	default:
+		return -1, fmt.Errorf("HTTP input open failed, url=%s, status=%s", i.url, resp.Status)
+	}
+}
+
+func (i *httpInput) closeBody() {
+	if i.body != nil {
+		i.body.Close()
+		i.body = nil
+	}
+}
+
+// do sends a request for the input, of the byte range rangeSpec if it is set (i.e. "bytes=100-"),
+// and retries on network errors and server errors (5xx)
+func (i *httpInput) do(method string, rangeSpec string) (*http.Response, error) {
+	o := i.opener
+	client := o.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	for retry := 0; ; retry++ {
+		req, err := http.NewRequest(method, i.url, nil)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range o.Header {
+			req.Header[k] = v
+		}
+		if rangeSpec != "" {
+			req.Header.Set("Range", rangeSpec)
+		}
+
+		resp, err := o.send(client, req)
+		if err == nil && resp.StatusCode < http.StatusInternalServerError {
+			return resp, nil
+		}
+		if err == nil {
+			resp.Body.Close()
+			err = fmt.Errorf("status=%s", resp.Status)
+		}
+
+		if retry >= o.Retries {
+			return nil, fmt.Errorf("HTTP input request failed, url=%s, method=%s: %w", i.url, method, err)
+		}
+		log.Warn("HTTP input request failed, retrying", "url", i.url, "method", method, "error", err)
+		time.Sleep(o.retryDelay(retry))
+	}
+}
+
+// send sends req with client, failing if the response headers are not received within Timeout.
+// Unlike http.Client.Timeout the timeout stops once the headers are received, the body can be read
+// for as long as needed.
+func (o *HTTPInputOpener) send(client *http.Client, req *http.Request) (*http.Response, error) {
+	if o.Timeout <= 0 {
+		return client.Do(req)
+	}
+
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(o.Timeout, cancel)
+	resp, err := client.Do(req.WithContext(ctx))
+	if !timer.Stop() {
+		if err == nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, fmt.Errorf("no response headers after %s: %w", o.Timeout, context.DeadlineExceeded)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	resp.Body = &cancelBody{ReadCloser: resp.Body, cancel: cancel}
+	return resp, nil
+}
+
+// cancelBody releases the context of the request of a response body once the body is closed
+type cancelBody struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.cancel()
+	return err
+}
+
+func (o *HTTPInputOpener) retryDelay(retry int) time.Duration {
+	return o.RetryDelay << uint(retry)
+}
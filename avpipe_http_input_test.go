@@ -0,0 +1,172 @@
+package avpipe
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func httpInputContent() []byte {
+	content := make([]byte, 100000)
+	for i := range content {
+		content[i] = byte(i % 251)
+	}
+	return content
+}
+
+func readHTTPInput(t *testing.T, in InputHandler, size int) []byte {
+	var out []byte
+	buf := make([]byte, 4096)
+	for len(out) <= size {
+		n, err := in.Read(buf)
+		require.NoError(t, err)
+		if n == 0 {
+			break
+		}
+		out = append(out, buf[:n]...)
+	}
+	return out
+}
+
+func TestHTTPInputReadSeek(t *testing.T) {
+	content := httpInputContent()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "input.mp4", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	opener := &HTTPInputOpener{Timeout: 5 * time.Second}
+	in, err := opener.Open(1, ts.URL)
+	require.NoError(t, err)
+	defer in.Close()
+	require.Equal(t, int64(len(content)), in.Size())
+
+	require.Equal(t, content, readHTTPInput(t, in, len(content)))
+
+	pos, err := in.Seek(5000, io.SeekStart)
+	require.NoError(t, err)
+	require.Equal(t, int64(5000), pos)
+	buf := make([]byte, 100)
+	n, err := in.Read(buf)
+	require.NoError(t, err)
+	require.Equal(t, content[5000:5000+n], buf[:n])
+
+	pos, err = in.Seek(-10, io.SeekEnd)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)-10), pos)
+	require.Equal(t, content[len(content)-10:], readHTTPInput(t, in, len(content)))
+
+	size, err := in.Seek(0, avseekSize)
+	require.NoError(t, err)
+	require.Equal(t, int64(len(content)), size)
+
+	bytesRead := uint64(1234)
+	require.NoError(t, in.Stat(0, AV_IN_STAT_BYTES_READ, &bytesRead))
+}
+
+func TestHTTPInputRetry(t *testing.T) {
+	content := httpInputContent()
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch atomic.AddInt32(&requests, 1) {
+		case 1:
+			// Transient server error on the HEAD request
+			w.WriteHeader(http.StatusServiceUnavailable)
+		case 3:
+			// The connection is lost in the middle of the body
+			w.Header().Set("Content-Length", "100000")
+			w.WriteHeader(http.StatusOK)
+			w.Write(content[:30000])
+		default:
+			http.ServeContent(w, r, "input.mp4", time.Time{}, bytes.NewReader(content))
+		}
+	}))
+	defer ts.Close()
+
+	opener := &HTTPInputOpener{Retries: 2, RetryDelay: time.Millisecond}
+	in, err := opener.Open(1, ts.URL)
+	require.NoError(t, err)
+	defer in.Close()
+
+	require.Equal(t, content, readHTTPInput(t, in, len(content)))
+}
+
+func TestHTTPInputHeadRejected(t *testing.T) {
+	content := httpInputContent()
+	for _, status := range []int{http.StatusForbidden, http.StatusMethodNotAllowed} {
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(status)
+				return
+			}
+			http.ServeContent(w, r, "input.mp4", time.Time{}, bytes.NewReader(content))
+		}))
+
+		opener := &HTTPInputOpener{Timeout: 5 * time.Second}
+		in, err := opener.Open(1, ts.URL)
+		require.NoError(t, err, "status %d", status)
+		require.Equal(t, int64(len(content)), in.Size(), "status %d", status)
+		require.Equal(t, content, readHTTPInput(t, in, len(content)), "status %d", status)
+		in.Close()
+		ts.Close()
+	}
+
+	// GET is rejected too
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer ts.Close()
+	_, err := (&HTTPInputOpener{}).Open(1, ts.URL)
+	require.Error(t, err)
+}
+
+func TestHTTPInputTimeout(t *testing.T) {
+	content := httpInputContent()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodHead {
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			return
+		}
+		// The body takes longer than the timeout to be sent
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		w.WriteHeader(http.StatusOK)
+		for k := 0; k < len(content); k += len(content) / 4 {
+			w.Write(content[k : k+len(content)/4])
+			w.(http.Flusher).Flush()
+			time.Sleep(100 * time.Millisecond)
+		}
+	}))
+	defer ts.Close()
+
+	opener := &HTTPInputOpener{Timeout: 200 * time.Millisecond}
+	in, err := opener.Open(1, ts.URL)
+	require.NoError(t, err)
+	defer in.Close()
+	require.Equal(t, content, readHTTPInput(t, in, len(content)))
+
+	// The response headers take longer than the timeout
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		time.Sleep(time.Second)
+	}))
+	defer slow.Close()
+
+	_, err = opener.Open(1, slow.URL)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestHTTPInputNotFound(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	opener := &HTTPInputOpener{Retries: 2, RetryDelay: time.Millisecond}
+	_, err := opener.Open(1, ts.URL)
+	require.Error(t, err)
+}
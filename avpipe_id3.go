@@ -0,0 +1,34 @@
+package avpipe
+
+import (
+	"fmt"
+)
+
+// Largest size of an ID3v2 tag or frame, sizes are 28 bit synchsafe integers
+const id3MaxSize = 1<<28 - 1
+
+// ID3PrivTag returns an ID3v2.4 tag with a single PRIV frame, the payload of a goavpipe.TimedMetadata.
+// The owner identifies the application the data belongs to, usually an URL or a reverse domain name
+// (e.g. "com.apple.streaming.transportStreamTimestamp").
+func ID3PrivTag(owner string, data []byte) ([]byte, error) {
+	frameSize := len(owner) + 1 + len(data)
+	tagSize := 10 + frameSize
+	if tagSize > id3MaxSize {
+		return nil, fmt.Errorf("ID3 PRIV frame too big, owner=%s, size=%d", owner, frameSize)
+	}
+
+	tag := make([]byte, 0, 10+tagSize)
+	tag = append(tag, 'I', 'D', '3', 4, 0, 0) // Version 2.4.0, no flags
+	tag = appendSynchsafe(tag, tagSize)
+	tag = append(tag, 'P', 'R', 'I', 'V')
+	tag = appendSynchsafe(tag, frameSize)
+	tag = append(tag, 0, 0) // Frame flags
+	tag = append(tag, owner...)
+	tag = append(tag, 0)
+	return append(tag, data...), nil
+}
+
+// appendSynchsafe appends v as a 32 bit synchsafe integer, 7 bits per byte
+func appendSynchsafe(b []byte, v int) []byte {
+	return append(b, byte(v>>21&0x7f), byte(v>>14&0x7f), byte(v>>7&0x7f), byte(v&0x7f))
+}
@@ -0,0 +1,28 @@
+package avpipe
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestID3PrivTag(t *testing.T) {
+	tag, err := ID3PrivTag("com.example.ad", []byte{0xde, 0xad})
+	require.NoError(t, err)
+
+	expected := []byte{
+		'I', 'D', '3', 4, 0, 0, 0, 0, 0, 27, // Header, tag size 10 + 17
+		'P', 'R', 'I', 'V', 0, 0, 0, 17, 0, 0, // Frame header, frame size 15 + 2
+	}
+	expected = append(expected, "com.example.ad"...)
+	expected = append(expected, 0, 0xde, 0xad)
+	require.Equal(t, expected, tag)
+
+	// Sizes of 128 bytes and more use the 7 low bits of each byte
+	tag, err = ID3PrivTag("o", bytes.Repeat([]byte{1}, 200))
+	require.NoError(t, err)
+	require.Equal(t, []byte{0, 0, 1, 0x54}, tag[6:10])  // 10 + 202 = 212
+	require.Equal(t, []byte{0, 0, 1, 0x4a}, tag[14:18]) // 202
+	require.Equal(t, 10+212, len(tag))
+}
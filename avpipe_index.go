@@ -0,0 +1,54 @@
+package avpipe
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// FragmentIndex is the index of the fragments of a "fmp4" or "cmaf" output written as an IndexSidecar
+// output when XcParams.SidecarIndex is set. It maps the time of the fragments starting with a key frame
+// to their byte range in the output, to serve time ranges of the output with range requests without
+// parsing it.
+type FragmentIndex struct {
+	Url           string          `json:"url"`            // Name of the indexed output as opened by the muxer (i.e "fmp4-stream.mp4")
+	StreamIndex   int             `json:"stream_index"`   // Input stream index of the indexed output, the same as the IndexSidecar output
+	Size          int64           `json:"size"`           // Size of the indexed output
+	HeaderSize    int64           `json:"header_size"`    // Size of the ftyp and moov boxes at the start of the output
+	TrailerOffset int64           `json:"trailer_offset"` // Offset of the boxes written after the last fragment (mfra), Size if there are none
+	Fragments     []IndexFragment `json:"fragments"`      // In time order
+}
+
+// IndexFragment is the byte range of a fragment (or of consecutive fragments, one per XcParams.SegDuration
+// if it is set) of the output. Time is the DTS of its first sample in microseconds, in the time of the
+// output.
+type IndexFragment struct {
+	TimeUs int64 `json:"time_us"`
+	Offset int64 `json:"offset"`
+	Size   int64 `json:"size"`
+}
+
+// ParseIndexSidecar parses the content of an IndexSidecar output
+func ParseIndexSidecar(data []byte) (*FragmentIndex, error) {
+	index := &FragmentIndex{}
+	if err := json.Unmarshal(data, index); err != nil {
+		return nil, err
+	}
+	for i, f := range index.Fragments {
+		if f.Offset < index.HeaderSize || f.Size < 0 || f.Offset+f.Size > index.Size ||
+			(i > 0 && f.TimeUs <= index.Fragments[i-1].TimeUs) {
+			return nil, fmt.Errorf("invalid fragment %d of index sidecar, url=%s", i, index.Url)
+		}
+	}
+	return index, nil
+}
+
+// Find returns the fragment containing timeUs, that is the last fragment starting at or before timeUs. It
+// returns false if there is none (timeUs is before the first fragment).
+func (index *FragmentIndex) Find(timeUs int64) (IndexFragment, bool) {
+	i := sort.Search(len(index.Fragments), func(i int) bool { return index.Fragments[i].TimeUs > timeUs })
+	if i == 0 {
+		return IndexFragment{}, false
+	}
+	return index.Fragments[i-1], true
+}
@@ -0,0 +1,33 @@
+package avpipe
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseIndexSidecar(t *testing.T) {
+	data := []byte(`{"url":"fmp4-stream.mp4","stream_index":0,"size":5000,"header_size":800,"trailer_offset":4900,` +
+		`"fragments":[{"time_us":0,"offset":800,"size":2100},{"time_us":2000000,"offset":2900,"size":2000}]}`)
+	index, err := ParseIndexSidecar(data)
+	require.NoError(t, err)
+	require.Equal(t, "fmp4-stream.mp4", index.Url)
+	require.Equal(t, int64(800), index.HeaderSize)
+	require.Equal(t, []IndexFragment{{TimeUs: 0, Offset: 800, Size: 2100}, {TimeUs: 2000000, Offset: 2900, Size: 2000}},
+		index.Fragments)
+
+	f, ok := index.Find(1999999)
+	require.True(t, ok)
+	require.Equal(t, int64(800), f.Offset)
+	f, ok = index.Find(2000000)
+	require.True(t, ok)
+	require.Equal(t, int64(2900), f.Offset)
+	_, ok = index.Find(-1)
+	require.False(t, ok)
+
+	// Fragment past the end of the output
+	_, err = ParseIndexSidecar([]byte(`{"size":1000,"header_size":800,"fragments":[{"time_us":0,"offset":800,"size":300}]}`))
+	require.Error(t, err)
+	_, err = ParseIndexSidecar([]byte(`{"size":`))
+	require.Error(t, err)
+}
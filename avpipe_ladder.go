@@ -0,0 +1,119 @@
+package avpipe
+
+import (
+	"math"
+
+	"github.com/eluv-io/avpipe/goavpipe"
+)
+
+// LadderHeights are the heights of the renditions SuggestLadder picks from, highest first
+var LadderHeights = []int{2160, 1440, 1080, 720, 540, 360, 240}
+
+const (
+	// Bitrate of a 1080p 30fps rendition of a source of average complexity
+	ladderReferenceBitrate = 5000000
+	ladderReferencePixels  = 1920 * 1080 * 30
+	// Bits per pixel of a source of average complexity
+	ladderReferenceBpp = 0.1
+	ladderMinBitrate   = 200000
+	// A rendition is dropped if its bitrate is within this ratio of the rendition above it
+	ladderMinBitrateStep = 1.25
+)
+
+// SuggestLadder returns the params of an encoding ladder for the video stream of probe, one XcParams for
+// each height of LadderHeights up to the source height and maxHeight (no limit if maxHeight <= 0), highest
+// first. The params are NewXcParams with EncWidth, EncHeight, VideoBitrate and RateControl "vbr" set, the
+// caller sets the url, format and the rest of the params. It returns nil if probe has no video stream.
+//
+// The bitrate of each rendition follows a per-title heuristic rather than a quality measurement:
+//   - the bitrate of the reference rendition (1080p 30fps) is 5 Mbps for a source of average complexity
+//   - the bitrate scales with (width * height * fps)^0.75, as lower resolutions need more bits per pixel
+//   - the complexity of the source is its bits per pixel relative to 0.1 bpp, clamped to 0.5 - 1.5, so
+//     sources that need few bits (i.e. animation) get lower bitrates
+//   - no rendition has a higher bitrate than the source, and renditions less than 25% apart from the one
+//     above them are dropped since they don't add a useful step
+func SuggestLadder(probe *ProbeInfo, maxHeight int) []goavpipe.XcParams {
+	if probe == nil {
+		return nil
+	}
+
+	var si *StreamInfo
+	for i := range probe.StreamInfo {
+		if probe.StreamInfo[i].CodecType == "video" && probe.StreamInfo[i].Width > 0 && probe.StreamInfo[i].Height > 0 {
+			si = &probe.StreamInfo[i]
+			break
+		}
+	}
+	if si == nil {
+		return nil
+	}
+
+	width, height := si.Width, si.Height
+	if si.Rotation == 90 || si.Rotation == 270 {
+		width, height = height, width
+	}
+
+	fps := ratFloat(si.AvgFrameRate)
+	if fps <= 0 {
+		fps = ratFloat(si.FrameRate)
+	}
+	if fps <= 0 {
+		fps = 30
+	}
+
+	complexity := 1.0
+	if si.BitRate > 0 {
+		bpp := float64(si.BitRate) / (float64(width*height) * fps)
+		complexity = math.Min(math.Max(bpp/ladderReferenceBpp, 0.5), 1.5)
+	}
+
+	topHeight := height
+	if maxHeight > 0 && maxHeight < topHeight {
+		topHeight = maxHeight
+	}
+
+	heights := []int{}
+	for _, h := range LadderHeights {
+		if h <= topHeight {
+			heights = append(heights, h)
+		}
+	}
+	if len(heights) == 0 {
+		// The source is smaller than the lowest rendition
+		heights = append(heights, topHeight)
+	}
+
+	var ladder []goavpipe.XcParams
+	lastBitrate := int64(0)
+	for _, h := range heights {
+		w := evenRound(float64(h) * float64(width) / float64(height))
+		h = evenRound(float64(h))
+
+		bitrate := int64(ladderReferenceBitrate * complexity *
+			math.Pow(float64(w*h)*fps/ladderReferencePixels, 0.75))
+		if si.BitRate > 0 && bitrate > si.BitRate {
+			bitrate = si.BitRate
+		}
+		if bitrate < ladderMinBitrate {
+			bitrate = ladderMinBitrate
+		}
+		if lastBitrate > 0 && float64(lastBitrate) < ladderMinBitrateStep*float64(bitrate) {
+			continue
+		}
+		lastBitrate = bitrate
+
+		params := goavpipe.NewXcParams()
+		params.EncWidth = int32(w)
+		params.EncHeight = int32(h)
+		params.VideoBitrate = int32(bitrate)
+		params.RateControl = "vbr"
+		ladder = append(ladder, *params)
+	}
+
+	return ladder
+}
+
+// evenRound rounds v to the nearest even integer, as most encoders need even dimensions
+func evenRound(v float64) int {
+	return int(math.Round(v/2)) * 2
+}
@@ -0,0 +1,93 @@
+package avpipe
+
+import (
+	"math/big"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func ladderProbe(width, height int, fps int64, bitRate int64) *ProbeInfo {
+	return &ProbeInfo{
+		StreamInfo: []StreamInfo{
+			{StreamIndex: 0, CodecType: "audio", BitRate: 128000},
+			{
+				StreamIndex:  1,
+				CodecType:    "video",
+				Width:        width,
+				Height:       height,
+				AvgFrameRate: big.NewRat(fps, 1),
+				BitRate:      bitRate,
+			},
+		},
+	}
+}
+
+func TestSuggestLadder(t *testing.T) {
+	type rendition struct {
+		width, height int32
+	}
+
+	tests := []struct {
+		name      string
+		probe     *ProbeInfo
+		maxHeight int
+		want      []rendition
+	}{
+		{
+			name:  "1080p",
+			probe: ladderProbe(1920, 1080, 30, 8000000),
+			want:  []rendition{{1920, 1080}, {1280, 720}, {960, 540}, {640, 360}, {426, 240}},
+		},
+		{
+			name:      "1080p up to 720p",
+			probe:     ladderProbe(1920, 1080, 30, 8000000),
+			maxHeight: 720,
+			want:      []rendition{{1280, 720}, {960, 540}, {640, 360}, {426, 240}},
+		},
+		{
+			name:  "non standard height",
+			probe: ladderProbe(1440, 1050, 25, 0),
+			want:  []rendition{{988, 720}, {740, 540}, {494, 360}, {330, 240}},
+		},
+		{
+			// The 720p rendition has the same bitrate as the 1080p one once capped at the source bitrate
+			name:  "low complexity",
+			probe: ladderProbe(1920, 1080, 24, 1000000),
+			want:  []rendition{{1920, 1080}, {960, 540}, {640, 360}, {426, 240}},
+		},
+		{
+			name:  "smaller than the lowest rendition",
+			probe: ladderProbe(320, 180, 30, 300000),
+			want:  []rendition{{320, 180}},
+		},
+	}
+
+	for _, tt := range tests {
+		ladder := SuggestLadder(tt.probe, tt.maxHeight)
+		require.Equal(t, len(tt.want), len(ladder), tt.name)
+
+		source := tt.probe.StreamInfo[1].BitRate
+		for i, params := range ladder {
+			require.Equal(t, tt.want[i], rendition{params.EncWidth, params.EncHeight}, tt.name)
+			require.Equal(t, "vbr", params.RateControl, tt.name)
+			require.GreaterOrEqual(t, params.VideoBitrate, int32(ladderMinBitrate), tt.name)
+			if source > 0 {
+				require.LessOrEqual(t, int64(params.VideoBitrate), source, tt.name)
+			}
+			if i > 0 {
+				require.GreaterOrEqual(t, float64(ladder[i-1].VideoBitrate), ladderMinBitrateStep*float64(params.VideoBitrate), tt.name)
+			}
+		}
+	}
+
+	// A rotated source keeps its display aspect ratio
+	probe := ladderProbe(1920, 1080, 30, 8000000)
+	probe.StreamInfo[1].Rotation = 90
+	ladder := SuggestLadder(probe, 1080)
+	require.Equal(t, int32(1080), ladder[0].EncHeight)
+	require.Equal(t, int32(608), ladder[0].EncWidth)
+
+	require.Nil(t, SuggestLadder(&ProbeInfo{StreamInfo: probe.StreamInfo[:1]}, 0))
+	require.Nil(t, SuggestLadder(nil, 0))
+}
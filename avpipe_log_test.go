@@ -119,3 +119,26 @@ func TestCorrectChanClosure(t *testing.T) {
 	wg.Wait()
 	require.True(t, AllLogMapsEmpty())
 }
+
+// TestAVLogLevel checks the level ffmpeg messages are logged at for each native av_log level
+func TestAVLogLevel(t *testing.T) {
+	tests := []struct {
+		avLevel int
+		level   string
+	}{
+		{avLevel: -8, level: ""},      // AV_LOG_QUIET
+		{avLevel: 0, level: "error"},  // AV_LOG_PANIC
+		{avLevel: 8, level: "error"},  // AV_LOG_FATAL
+		{avLevel: 16, level: "error"}, // AV_LOG_ERROR
+		{avLevel: 20, level: "warn"},  // Between AV_LOG_ERROR and AV_LOG_WARNING
+		{avLevel: 24, level: "warn"},  // AV_LOG_WARNING
+		{avLevel: 32, level: "info"},  // AV_LOG_INFO
+		{avLevel: 40, level: "trace"}, // AV_LOG_VERBOSE
+		{avLevel: 48, level: "debug"}, // AV_LOG_DEBUG
+		{avLevel: 56, level: "trace"}, // AV_LOG_TRACE
+	}
+
+	for _, tt := range tests {
+		require.Equal(t, tt.level, avLogLevel(tt.avLevel), fmt.Sprintf("av_log level %d", tt.avLevel))
+	}
+}
@@ -0,0 +1,373 @@
+package avpipe
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// RenditionInfo describes a rendition written in segments (i.e. by the "fmp4-segment" format), to generate
+// its manifests with WriteDashManifest, WriteHlsMaster and WriteHlsMedia.
+type RenditionInfo struct {
+	ID         string // Unique ID of the rendition, the DASH representation ID and the HLS NAME of audio
+	Type       string // "video" or "audio"
+	Codecs     string // RFC 6381 codecs, i.e "avc1.640028" or "mp4a.40.2"
+	Bandwidth  int64  // Peak bitrate in bits/s, 0 computes it from the segments
+	Width      int    // Video only
+	Height     int    // Video only
+	FrameRate  string // Video only, i.e "30" or "30000/1001"
+	SampleRate int    // Audio only
+	Channels   int    // Audio only
+	Language   string // Audio only, optional
+	Timescale  int64  // Time base of the PTS of the segments (i.e. 90000 for 1/90000)
+	InitURL    string // URL of the init segment, empty if the segments are self initializing
+	SegmentURL string // Template of the URLs of the segments, $Number$ is replaced by the segment index
+	MediaURL   string // URL of the HLS media playlist of the rendition, used by WriteHlsMaster
+	// Segments in order, as reported by AV_OUT_STAT_SEGMENT_DONE
+	Segments []SegmentStats
+}
+
+func (r *RenditionInfo) validate() error {
+	if r.Type != "video" && r.Type != "audio" {
+		return fmt.Errorf("invalid rendition type=%s, id=%s", r.Type, r.ID)
+	}
+	if r.Timescale <= 0 {
+		return fmt.Errorf("invalid rendition timescale=%d, id=%s", r.Timescale, r.ID)
+	}
+	if len(r.Segments) == 0 {
+		return fmt.Errorf("rendition has no segments, id=%s", r.ID)
+	}
+	for i, seg := range r.Segments {
+		if seg.EndPTS <= seg.StartPTS {
+			return fmt.Errorf("invalid segment start_pts=%d end_pts=%d, seg_index=%d, id=%s",
+				seg.StartPTS, seg.EndPTS, seg.SegIndex, r.ID)
+		}
+		if i > 0 && seg.SegIndex != r.Segments[i-1].SegIndex+1 {
+			return fmt.Errorf("segments are not consecutive, seg_index=%d after %d, id=%s",
+				seg.SegIndex, r.Segments[i-1].SegIndex, r.ID)
+		}
+	}
+	return nil
+}
+
+// duration returns the duration of the segments in seconds
+func (r *RenditionInfo) duration() float64 {
+	last := r.Segments[len(r.Segments)-1]
+	return float64(last.EndPTS-r.Segments[0].StartPTS) / float64(r.Timescale)
+}
+
+// bandwidth returns Bandwidth, or the peak bitrate of the segments if it is not set
+func (r *RenditionInfo) bandwidth() int64 {
+	if r.Bandwidth > 0 {
+		return r.Bandwidth
+	}
+	var peak int64
+	for _, seg := range r.Segments {
+		bps := int64(math.Ceil(float64(seg.Bytes*8) * float64(r.Timescale) / float64(seg.EndPTS-seg.StartPTS)))
+		if bps > peak {
+			peak = bps
+		}
+	}
+	return peak
+}
+
+// segmentURL returns the URL of the segment seg
+func (r *RenditionInfo) segmentURL(seg SegmentStats) string {
+	return strings.ReplaceAll(r.SegmentURL, "$Number$", strconv.Itoa(seg.SegIndex))
+}
+
+type mpd struct {
+	XMLName                   xml.Name `xml:"MPD"`
+	Xmlns                     string   `xml:"xmlns,attr"`
+	Profiles                  string   `xml:"profiles,attr"`
+	Type                      string   `xml:"type,attr"`
+	MediaPresentationDuration string   `xml:"mediaPresentationDuration,attr"`
+	MinBufferTime             string   `xml:"minBufferTime,attr"`
+	Period                    struct {
+		ID             string          `xml:"id,attr"`
+		Start          string          `xml:"start,attr"`
+		AdaptationSets []adaptationSet `xml:"AdaptationSet"`
+	} `xml:"Period"`
+}
+
+type adaptationSet struct {
+	ContentType      string           `xml:"contentType,attr"`
+	MimeType         string           `xml:"mimeType,attr"`
+	Lang             string           `xml:"lang,attr,omitempty"`
+	SegmentAlignment bool             `xml:"segmentAlignment,attr"`
+	Representations  []representation `xml:"Representation"`
+}
+
+type representation struct {
+	ID                string         `xml:"id,attr"`
+	Codecs            string         `xml:"codecs,attr,omitempty"`
+	Bandwidth         int64          `xml:"bandwidth,attr"`
+	Width             int            `xml:"width,attr,omitempty"`
+	Height            int            `xml:"height,attr,omitempty"`
+	FrameRate         string         `xml:"frameRate,attr,omitempty"`
+	AudioSamplingRate int            `xml:"audioSamplingRate,attr,omitempty"`
+	ChannelConfig     *channelConfig `xml:"AudioChannelConfiguration,omitempty"`
+	SegmentTemplate   struct {
+		Timescale              int64          `xml:"timescale,attr"`
+		PresentationTimeOffset int64          `xml:"presentationTimeOffset,attr,omitempty"`
+		Initialization         string         `xml:"initialization,attr,omitempty"`
+		Media                  string         `xml:"media,attr"`
+		StartNumber            int            `xml:"startNumber,attr"`
+		Timeline               []timelineItem `xml:"SegmentTimeline>S"`
+	} `xml:"SegmentTemplate"`
+}
+
+type channelConfig struct {
+	SchemeIDURI string `xml:"schemeIdUri,attr"`
+	Value       int    `xml:"value,attr"`
+}
+
+// timelineItem is an S element of a SegmentTimeline, R+1 segments of duration D starting at T
+type timelineItem struct {
+	T int64 `xml:"t,attr"`
+	D int64 `xml:"d,attr"`
+	R int   `xml:"r,attr,omitempty"`
+}
+
+// isoDuration formats seconds as an ISO 8601 duration, i.e "PT1M30.500S"
+func isoDuration(sec float64) string {
+	min := int(sec / 60)
+	sec -= float64(min * 60)
+	if min > 0 {
+		return fmt.Sprintf("PT%dM%.3fS", min, sec)
+	}
+	return fmt.Sprintf("PT%.3fS", sec)
+}
+
+// WriteDashManifest writes a static (VOD) DASH MPD of the renditions to w. The renditions of the same type
+// (and language for audio) are grouped in an adaptation set, each rendition is a representation with a
+// SegmentTemplate and a SegmentTimeline built from its segments, so the segment durations don't need to be
+// constant. The presentation of each rendition starts at the start PTS of its first segment.
+func WriteDashManifest(renditions []RenditionInfo, w io.Writer) error {
+	if len(renditions) == 0 {
+		return fmt.Errorf("no renditions")
+	}
+
+	m := &mpd{
+		Xmlns:         "urn:mpeg:dash:schema:mpd:2011",
+		Profiles:      "urn:mpeg:dash:profile:isoff-live:2011",
+		Type:          "static",
+		MinBufferTime: "PT2S",
+	}
+	m.Period.ID = "0"
+	m.Period.Start = "PT0S"
+
+	duration := 0.0
+	sets := map[string]int{} // Index of the adaptation set by type and language
+	for i := range renditions {
+		r := &renditions[i]
+		if err := r.validate(); err != nil {
+			return err
+		}
+		duration = math.Max(duration, r.duration())
+
+		key := r.Type + "/" + r.Language
+		idx, ok := sets[key]
+		if !ok {
+			idx = len(m.Period.AdaptationSets)
+			sets[key] = idx
+			m.Period.AdaptationSets = append(m.Period.AdaptationSets, adaptationSet{
+				ContentType:      r.Type,
+				MimeType:         r.Type + "/mp4",
+				Lang:             r.Language,
+				SegmentAlignment: true,
+			})
+		}
+
+		rep := representation{
+			ID:        r.ID,
+			Codecs:    r.Codecs,
+			Bandwidth: r.bandwidth(),
+		}
+		if r.Type == "video" {
+			rep.Width, rep.Height, rep.FrameRate = r.Width, r.Height, r.FrameRate
+		} else {
+			rep.AudioSamplingRate = r.SampleRate
+			if r.Channels > 0 {
+				rep.ChannelConfig = &channelConfig{"urn:mpeg:dash:23003:3:audio_channel_configuration:2011", r.Channels}
+			}
+		}
+
+		st := &rep.SegmentTemplate
+		st.Timescale = r.Timescale
+		st.Initialization = r.InitURL
+		st.Media = r.SegmentURL
+		st.PresentationTimeOffset = r.Segments[0].StartPTS
+		st.StartNumber = r.Segments[0].SegIndex
+		for j, seg := range r.Segments {
+			d := seg.EndPTS - seg.StartPTS
+			n := len(st.Timeline)
+			// Consecutive segments of the same duration are repeats of the same S element
+			if n > 0 && st.Timeline[n-1].D == d && r.Segments[j-1].EndPTS == seg.StartPTS {
+				st.Timeline[n-1].R++
+				continue
+			}
+			st.Timeline = append(st.Timeline, timelineItem{T: seg.StartPTS, D: d})
+		}
+
+		m.Period.AdaptationSets[idx].Representations = append(m.Period.AdaptationSets[idx].Representations, rep)
+	}
+	m.MediaPresentationDuration = isoDuration(duration)
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	enc := xml.NewEncoder(w)
+	enc.Indent("", "  ")
+	if err := enc.Encode(m); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
+
+// WriteHlsMaster writes the HLS master playlist of the renditions to w. The audio renditions are in the
+// "audio" group, the first one is the default, and each video rendition is a variant referring to the
+// group. Without video, each audio rendition is a variant. The MediaURL of the renditions are the URIs of
+// their media playlists (see WriteHlsMedia).
+func WriteHlsMaster(renditions []RenditionInfo, w io.Writer) error {
+	if len(renditions) == 0 {
+		return fmt.Errorf("no renditions")
+	}
+
+	var videos, audios []*RenditionInfo
+	for i := range renditions {
+		r := &renditions[i]
+		if err := r.validate(); err != nil {
+			return err
+		}
+		if r.MediaURL == "" {
+			return fmt.Errorf("rendition has no media playlist url, id=%s", r.ID)
+		}
+		if r.Type == "video" {
+			videos = append(videos, r)
+		} else {
+			audios = append(audios, r)
+		}
+	}
+
+	b := &strings.Builder{}
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n#EXT-X-INDEPENDENT-SEGMENTS\n\n")
+
+	if len(videos) == 0 {
+		for _, a := range audios {
+			fmt.Fprintf(b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", a.bandwidth())
+			if a.Codecs != "" {
+				fmt.Fprintf(b, ",CODECS=\"%s\"", a.Codecs)
+			}
+			fmt.Fprintf(b, "\n%s\n", a.MediaURL)
+		}
+		_, err := io.WriteString(w, b.String())
+		return err
+	}
+
+	var audioBandwidth int64
+	var audioCodecs string
+	for i, a := range audios {
+		name := a.ID
+		if a.Language != "" {
+			name = a.Language
+		}
+		def := "NO"
+		if i == 0 {
+			def = "YES"
+		}
+		fmt.Fprintf(b, "#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID=\"audio\",NAME=\"%s\",DEFAULT=%s,AUTOSELECT=YES", name, def)
+		if a.Language != "" {
+			fmt.Fprintf(b, ",LANGUAGE=\"%s\"", a.Language)
+		}
+		if a.Channels > 0 {
+			fmt.Fprintf(b, ",CHANNELS=\"%d\"", a.Channels)
+		}
+		fmt.Fprintf(b, ",URI=\"%s\"\n", a.MediaURL)
+
+		// The variants need the bandwidth of the highest audio rendition they may play
+		if bw := a.bandwidth(); bw > audioBandwidth {
+			audioBandwidth = bw
+			audioCodecs = a.Codecs
+		}
+	}
+	if len(audios) > 0 {
+		b.WriteString("\n")
+	}
+
+	for _, v := range videos {
+		fmt.Fprintf(b, "#EXT-X-STREAM-INF:BANDWIDTH=%d", v.bandwidth()+audioBandwidth)
+		codecs := v.Codecs
+		if codecs != "" && audioCodecs != "" {
+			codecs += "," + audioCodecs
+		}
+		if codecs != "" {
+			fmt.Fprintf(b, ",CODECS=\"%s\"", codecs)
+		}
+		if v.Width > 0 && v.Height > 0 {
+			fmt.Fprintf(b, ",RESOLUTION=%dx%d", v.Width, v.Height)
+		}
+		if fps := frameRate(v.FrameRate); fps > 0 {
+			fmt.Fprintf(b, ",FRAME-RATE=%.3f", fps)
+		}
+		if len(audios) > 0 {
+			b.WriteString(",AUDIO=\"audio\"")
+		}
+		fmt.Fprintf(b, "\n%s\n", v.MediaURL)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// WriteHlsMedia writes the VOD HLS media playlist of the rendition to w, with one EXTINF for each segment
+// and the init segment as EXT-X-MAP if InitURL is set.
+func WriteHlsMedia(rendition *RenditionInfo, w io.Writer) error {
+	if rendition == nil {
+		return fmt.Errorf("no rendition")
+	}
+	if err := rendition.validate(); err != nil {
+		return err
+	}
+
+	targetDuration := 0.0
+	for _, seg := range rendition.Segments {
+		targetDuration = math.Max(targetDuration, float64(seg.EndPTS-seg.StartPTS)/float64(rendition.Timescale))
+	}
+
+	b := &strings.Builder{}
+	b.WriteString("#EXTM3U\n#EXT-X-VERSION:7\n")
+	// The target duration is the longest segment duration rounded to the nearest integer (RFC 8216 4.3.3.1)
+	fmt.Fprintf(b, "#EXT-X-TARGETDURATION:%d\n", int(math.Round(targetDuration)))
+	fmt.Fprintf(b, "#EXT-X-MEDIA-SEQUENCE:%d\n", rendition.Segments[0].SegIndex)
+	b.WriteString("#EXT-X-PLAYLIST-TYPE:VOD\n#EXT-X-INDEPENDENT-SEGMENTS\n")
+	if rendition.InitURL != "" {
+		fmt.Fprintf(b, "#EXT-X-MAP:URI=\"%s\"\n", rendition.InitURL)
+	}
+	for _, seg := range rendition.Segments {
+		fmt.Fprintf(b, "#EXTINF:%.6f,\n%s\n",
+			float64(seg.EndPTS-seg.StartPTS)/float64(rendition.Timescale), rendition.segmentURL(seg))
+	}
+	b.WriteString("#EXT-X-ENDLIST\n")
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// frameRate returns the frame rate of s ("30" or "30000/1001"), 0 if it is not valid
+func frameRate(s string) float64 {
+	num, den := s, "1"
+	if i := strings.Index(s, "/"); i >= 0 {
+		num, den = s[:i], s[i+1:]
+	}
+	n, err1 := strconv.ParseFloat(num, 64)
+	d, err2 := strconv.ParseFloat(den, 64)
+	if err1 != nil || err2 != nil || d <= 0 {
+		return 0
+	}
+	return n / d
+}
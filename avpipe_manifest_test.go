@@ -0,0 +1,119 @@
+package avpipe
+
+import (
+	"bytes"
+	"encoding/xml"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+// manifestRenditions returns 2 video renditions and 1 audio rendition of 3 segments, the last one shorter
+func manifestRenditions() []RenditionInfo {
+	segments := func(duration, bytes int64) []SegmentStats {
+		return []SegmentStats{
+			{SegIndex: 1, StartPTS: 0, EndPTS: duration, Bytes: bytes},
+			{SegIndex: 2, StartPTS: duration, EndPTS: 2 * duration, Bytes: bytes},
+			{SegIndex: 3, StartPTS: 2 * duration, EndPTS: 2*duration + duration/2, Bytes: bytes / 2},
+		}
+	}
+	return []RenditionInfo{
+		{ID: "720p", Type: "video", Codecs: "avc1.64001f", Width: 1280, Height: 720, FrameRate: "30000/1001",
+			Timescale: 30000, SegmentURL: "720p/vsegment-$Number$.mp4", MediaURL: "720p.m3u8",
+			Segments: segments(180000, 2250000)},
+		{ID: "360p", Type: "video", Codecs: "avc1.64001e", Bandwidth: 800000, Width: 640, Height: 360,
+			FrameRate: "30000/1001", Timescale: 30000, SegmentURL: "360p/vsegment-$Number$.mp4", MediaURL: "360p.m3u8",
+			Segments: segments(180000, 600000)},
+		{ID: "audio", Type: "audio", Codecs: "mp4a.40.2", SampleRate: 48000, Channels: 2, Language: "en",
+			Timescale: 48000, SegmentURL: "audio/asegment-$Number$.mp4", MediaURL: "audio.m3u8",
+			Segments: segments(288000, 96000)},
+	}
+}
+
+func TestWriteDashManifest(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteDashManifest(manifestRenditions(), buf))
+
+	m := &mpd{}
+	require.NoError(t, xml.Unmarshal(buf.Bytes(), m))
+	require.Equal(t, "static", m.Type)
+	require.Equal(t, "PT15.000S", m.MediaPresentationDuration)
+	require.Equal(t, 2, len(m.Period.AdaptationSets))
+
+	video := m.Period.AdaptationSets[0]
+	require.Equal(t, "video", video.ContentType)
+	require.Equal(t, 2, len(video.Representations))
+	rep := video.Representations[0]
+	require.Equal(t, "720p", rep.ID)
+	require.Equal(t, int64(3000000), rep.Bandwidth) // 2250000 bytes in 6 sec
+	require.Equal(t, "30000/1001", rep.FrameRate)
+	require.Equal(t, "720p/vsegment-$Number$.mp4", rep.SegmentTemplate.Media)
+	require.Equal(t, 1, rep.SegmentTemplate.StartNumber)
+	require.Equal(t, []timelineItem{{T: 0, D: 180000, R: 1}, {T: 360000, D: 90000}}, rep.SegmentTemplate.Timeline)
+	require.Equal(t, int64(800000), video.Representations[1].Bandwidth)
+
+	audio := m.Period.AdaptationSets[1]
+	require.Equal(t, "audio", audio.ContentType)
+	require.Equal(t, "en", audio.Lang)
+	require.Equal(t, 48000, audio.Representations[0].AudioSamplingRate)
+	require.Equal(t, 2, audio.Representations[0].ChannelConfig.Value)
+
+	// The segments must be consecutive
+	renditions := manifestRenditions()
+	renditions[0].Segments[2].SegIndex = 4
+	require.Error(t, WriteDashManifest(renditions, buf))
+	require.Error(t, WriteDashManifest(nil, buf))
+}
+
+func TestWriteHlsMaster(t *testing.T) {
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteHlsMaster(manifestRenditions(), buf))
+	require.Equal(t, `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-INDEPENDENT-SEGMENTS
+
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="audio",NAME="en",DEFAULT=YES,AUTOSELECT=YES,LANGUAGE="en",CHANNELS="2",URI="audio.m3u8"
+
+#EXT-X-STREAM-INF:BANDWIDTH=3128000,CODECS="avc1.64001f,mp4a.40.2",RESOLUTION=1280x720,FRAME-RATE=29.970,AUDIO="audio"
+720p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=928000,CODECS="avc1.64001e,mp4a.40.2",RESOLUTION=640x360,FRAME-RATE=29.970,AUDIO="audio"
+360p.m3u8
+`, buf.String())
+
+	// Audio only
+	buf.Reset()
+	require.NoError(t, WriteHlsMaster(manifestRenditions()[2:], buf))
+	require.Equal(t, `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-INDEPENDENT-SEGMENTS
+
+#EXT-X-STREAM-INF:BANDWIDTH=128000,CODECS="mp4a.40.2"
+audio.m3u8
+`, buf.String())
+}
+
+func TestWriteHlsMedia(t *testing.T) {
+	rendition := manifestRenditions()[0]
+	rendition.InitURL = "720p/init.mp4"
+
+	buf := &bytes.Buffer{}
+	require.NoError(t, WriteHlsMedia(&rendition, buf))
+	require.Equal(t, `#EXTM3U
+#EXT-X-VERSION:7
+#EXT-X-TARGETDURATION:6
+#EXT-X-MEDIA-SEQUENCE:1
+#EXT-X-PLAYLIST-TYPE:VOD
+#EXT-X-INDEPENDENT-SEGMENTS
+#EXT-X-MAP:URI="720p/init.mp4"
+#EXTINF:6.000000,
+720p/vsegment-1.mp4
+#EXTINF:6.000000,
+720p/vsegment-2.mp4
+#EXTINF:3.000000,
+720p/vsegment-3.mp4
+#EXT-X-ENDLIST
+`, buf.String())
+
+	rendition.Timescale = 0
+	require.Error(t, WriteHlsMedia(&rendition, buf))
+}
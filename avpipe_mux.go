@@ -0,0 +1,57 @@
+package avpipe
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/eluv-io/avpipe/goavpipe"
+)
+
+const (
+	// Same as MAX_STREAMS and MAX_MUX_IN_STREAM in avpipe_xc.h
+	muxMaxStreams = 64
+	muxMaxParts   = 4 * 4096
+)
+
+// muxingSpec returns the muxing spec of XcParams.MuxingSpec for the streams of params
+func muxingSpec(params *goavpipe.MuxParams) (string, error) {
+	if params == nil || len(params.Video) == 0 {
+		return "", fmt.Errorf("Invalid mux params, no video stream")
+	}
+	if len(params.Audio) > muxMaxStreams || len(params.Captions) > muxMaxStreams {
+		return "", fmt.Errorf("Invalid mux params, too many streams audio=%d captions=%d",
+			len(params.Audio), len(params.Captions))
+	}
+
+	var sb strings.Builder
+	sb.WriteString("mez-mux\n")
+
+	add := func(streamType string, index int, parts []string) error {
+		if len(parts) == 0 || len(parts) > muxMaxParts {
+			return fmt.Errorf("Invalid mux params, %s stream %d has %d parts", streamType, index, len(parts))
+		}
+		for _, part := range parts {
+			if part == "" || strings.ContainsAny(part, ",\r\n") {
+				return fmt.Errorf("Invalid mux params, %s stream %d has an invalid url=%q", streamType, index, part)
+			}
+			fmt.Fprintf(&sb, "%s,%d,%s\n", streamType, index, part)
+		}
+		return nil
+	}
+
+	if err := add("video", 1, params.Video); err != nil {
+		return "", err
+	}
+	for i, parts := range params.Audio {
+		if err := add("audio", i+1, parts); err != nil {
+			return "", err
+		}
+	}
+	for i, parts := range params.Captions {
+		if err := add("caption", i+1, parts); err != nil {
+			return "", err
+		}
+	}
+
+	return sb.String(), nil
+}
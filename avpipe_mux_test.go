@@ -0,0 +1,37 @@
+package avpipe
+
+import (
+	"testing"
+
+	"github.com/eluv-io/avpipe/goavpipe"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMuxingSpec(t *testing.T) {
+	spec, err := muxingSpec(&goavpipe.MuxParams{
+		Video:    []string{"v/init.m4s", "v/chunk-1.m4s"},
+		Audio:    [][]string{{"a1.mp4"}, {"a2/init.m4s", "a2/chunk-1.m4s"}},
+		Captions: [][]string{{"en.vtt"}},
+	})
+	require.NoError(t, err)
+	require.Equal(t, "mez-mux\n"+
+		"video,1,v/init.m4s\n"+
+		"video,1,v/chunk-1.m4s\n"+
+		"audio,1,a1.mp4\n"+
+		"audio,2,a2/init.m4s\n"+
+		"audio,2,a2/chunk-1.m4s\n"+
+		"caption,1,en.vtt\n", spec)
+
+	for _, params := range []*goavpipe.MuxParams{
+		nil,
+		{Audio: [][]string{{"a.mp4"}}},
+		{Video: []string{"v.mp4"}, Audio: [][]string{{"a1.mp4"}, {}}},
+		{Video: []string{"v,1.mp4"}},
+		{Video: []string{"v.mp4\naudio,1,a.mp4"}},
+		{Video: []string{""}},
+		{Video: []string{"v.mp4"}, Audio: make([][]string, muxMaxStreams+1)},
+	} {
+		_, err = muxingSpec(params)
+		require.Error(t, err, "%+v", params)
+	}
+}
@@ -0,0 +1,204 @@
+/*
+ * Converts probe information to the JSON schema of ffprobe
+ * (ffprobe -print_format json -show_format -show_streams).
+ */
+package avpipe
+
+import (
+	"encoding/json"
+	"fmt"
+	"math/big"
+
+	"github.com/eluv-io/avpipe/goavpipe"
+)
+
+// FFProbeStream is a stream of FFProbeInfo, field names and formats match ffprobe
+type FFProbeStream struct {
+	Index              int               `json:"index"`
+	CodecName          string            `json:"codec_name,omitempty"`
+	Profile            string            `json:"profile,omitempty"`
+	CodecType          string            `json:"codec_type"`
+	Width              int               `json:"width,omitempty"`
+	Height             int               `json:"height,omitempty"`
+	HasBFrames         *int              `json:"has_b_frames,omitempty"` // Video only
+	SampleAspectRatio  string            `json:"sample_aspect_ratio,omitempty"`
+	DisplayAspectRatio string            `json:"display_aspect_ratio,omitempty"`
+	PixFmt             string            `json:"pix_fmt,omitempty"`
+	Level              *int              `json:"level,omitempty"` // Video only
+	FieldOrder         string            `json:"field_order,omitempty"`
+	ColorRange         string            `json:"color_range,omitempty"`
+	ColorSpace         string            `json:"color_space,omitempty"`
+	ColorTransfer      string            `json:"color_transfer,omitempty"`
+	ColorPrimaries     string            `json:"color_primaries,omitempty"`
+	SampleRate         string            `json:"sample_rate,omitempty"`
+	Channels           int               `json:"channels,omitempty"`
+	ChannelLayout      string            `json:"channel_layout,omitempty"`
+	Id                 string            `json:"id,omitempty"`
+	RFrameRate         string            `json:"r_frame_rate"`
+	AvgFrameRate       string            `json:"avg_frame_rate"`
+	TimeBase           string            `json:"time_base"`
+	StartPts           int64             `json:"start_pts"`
+	StartTime          string            `json:"start_time"`
+	DurationTs         int64             `json:"duration_ts,omitempty"`
+	Duration           string            `json:"duration,omitempty"`
+	BitRate            string            `json:"bit_rate,omitempty"`
+	NBFrames           string            `json:"nb_frames,omitempty"`
+	BitsPerRawSample   string            `json:"bits_per_raw_sample,omitempty"`
+	Disposition        map[string]int    `json:"disposition,omitempty"`
+	Tags               map[string]string `json:"tags,omitempty"`
+	SideDataList       []interface{}     `json:"side_data_list,omitempty"`
+}
+
+// FFProbeFormat is the format (container) section of FFProbeInfo
+type FFProbeFormat struct {
+	Filename   string            `json:"filename"`
+	NBStreams  int               `json:"nb_streams"`
+	FormatName string            `json:"format_name"`
+	StartTime  string            `json:"start_time,omitempty"`
+	Duration   string            `json:"duration,omitempty"`
+	Tags       map[string]string `json:"tags,omitempty"`
+}
+
+// FFProbeInfo has the same shape as the JSON output of ffprobe
+type FFProbeInfo struct {
+	Streams []FFProbeStream `json:"streams"`
+	Format  FFProbeFormat   `json:"format"`
+}
+
+// ProbeJSON probes url and returns the result as ffprobe JSON, with the top level 'streams'
+// and 'format' keys, rationals as "num/den" strings and times as strings in seconds.
+func ProbeJSON(url string, seekable bool) ([]byte, error) {
+	params := &goavpipe.XcParams{
+		Url:      url,
+		Seekable: seekable,
+	}
+
+	probeInfo, err := Probe(params)
+	if err != nil {
+		return nil, err
+	}
+
+	return json.MarshalIndent(probeInfo.FFProbe(url), "", "    ")
+}
+
+// FFProbe converts the probe information to the ffprobe schema
+func (p *ProbeInfo) FFProbe(url string) *FFProbeInfo {
+	info := &FFProbeInfo{
+		Streams: make([]FFProbeStream, 0, len(p.StreamInfo)),
+		Format: FFProbeFormat{
+			Filename:   url,
+			NBStreams:  len(p.StreamInfo),
+			FormatName: p.ContainerInfo.FormatName,
+			Duration:   ffprobeSeconds(p.ContainerInfo.Duration),
+			Tags:       p.ContainerInfo.Tags,
+		},
+	}
+
+	var startTime *big.Rat
+	for _, si := range p.StreamInfo {
+		stream := FFProbeStream{
+			Index:        si.StreamIndex,
+			CodecName:    si.CodecName,
+			Profile:      GetProfileName(si.CodecID, si.Profile),
+			CodecType:    si.CodecType,
+			Id:           fmt.Sprintf("0x%x", si.StreamId),
+			RFrameRate:   ffprobeRational(si.FrameRate, "/"),
+			AvgFrameRate: ffprobeRational(si.AvgFrameRate, "/"),
+			TimeBase:     ffprobeRational(si.TimeBase, "/"),
+			StartPts:     si.StartTime,
+			Tags:         si.Tags,
+			SideDataList: si.SideData,
+		}
+
+		if si.Disposition != nil {
+			stream.Disposition = make(map[string]int, len(si.Disposition))
+			for name, set := range si.Disposition {
+				stream.Disposition[name] = 0
+				if set {
+					stream.Disposition[name] = 1
+				}
+			}
+		}
+
+		if si.TimeBase != nil {
+			start := new(big.Rat).Mul(big.NewRat(si.StartTime, 1), si.TimeBase)
+			stream.StartTime = ffprobeSeconds(ratFloat(start))
+			if startTime == nil || start.Cmp(startTime) < 0 {
+				startTime = start
+			}
+			if si.DurationTs > 0 && uint64(si.DurationTs) != goavpipe.AvNoPtsValue {
+				stream.DurationTs = si.DurationTs
+				stream.Duration = ffprobeSeconds(ratFloat(new(big.Rat).Mul(big.NewRat(si.DurationTs, 1), si.TimeBase)))
+			}
+		}
+		if si.BitRate > 0 {
+			stream.BitRate = fmt.Sprintf("%d", si.BitRate)
+		}
+		if si.NBFrames > 0 {
+			stream.NBFrames = fmt.Sprintf("%d", si.NBFrames)
+		}
+		if si.BitsPerRawSample > 0 {
+			stream.BitsPerRawSample = fmt.Sprintf("%d", si.BitsPerRawSample)
+		}
+
+		switch si.CodecType {
+		case "video":
+			hasBFrames := 0
+			if si.Has_B_Frames {
+				hasBFrames = 1
+			}
+			level := si.Level
+			stream.Width = si.Width
+			stream.Height = si.Height
+			stream.HasBFrames = &hasBFrames
+			stream.Level = &level
+			stream.PixFmt = GetPixelFormatName(si.PixFmt)
+			stream.FieldOrder = si.FieldOrder
+			stream.ColorRange = si.ColorRange
+			stream.ColorSpace = si.ColorSpace
+			stream.ColorTransfer = si.ColorTransfer
+			stream.ColorPrimaries = si.ColorPrimaries
+			if si.SampleAspectRatio != nil && si.SampleAspectRatio.Sign() > 0 {
+				stream.SampleAspectRatio = ffprobeRational(si.SampleAspectRatio, ":")
+			}
+			if si.DisplayAspectRatio != nil && si.DisplayAspectRatio.Sign() > 0 {
+				stream.DisplayAspectRatio = ffprobeRational(si.DisplayAspectRatio, ":")
+			}
+		case "audio":
+			stream.SampleRate = fmt.Sprintf("%d", si.SampleRate)
+			stream.Channels = si.Channels
+			stream.ChannelLayout = ChannelLayoutName(si.Channels, si.ChannelLayout)
+		}
+
+		info.Streams = append(info.Streams, stream)
+	}
+
+	if startTime != nil {
+		info.Format.StartTime = ffprobeSeconds(ratFloat(startTime))
+	}
+
+	return info
+}
+
+// ffprobeRational formats r the way ffprobe does, i.e "30000/1001" for rates and "16:9" for aspect
+// ratios. Unknown (zero) rates are printed as "0/0".
+func ffprobeRational(r *big.Rat, sep string) string {
+	if r == nil || r.Sign() == 0 {
+		return "0" + sep + "0"
+	}
+	return r.Num().String() + sep + r.Denom().String()
+}
+
+// ffprobeSeconds formats a time in seconds with microsecond precision, like ffprobe
+func ffprobeSeconds(sec float64) string {
+	return fmt.Sprintf("%.6f", sec)
+}
+
+// ratFloat returns the float value of r, or 0 if r is nil
+func ratFloat(r *big.Rat) float64 {
+	if r == nil {
+		return 0
+	}
+	f, _ := r.Float64()
+	return f
+}
@@ -0,0 +1,151 @@
+package avpipe
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eluv-io/avpipe/goavpipe"
+)
+
+// StressResult is the result of WarmupStress()
+type StressResult struct {
+	Iterations int           // Transcodings run
+	Errors     int           // Transcodings that failed
+	Duration   time.Duration // Wall clock time of all the transcodings
+	Throughput float64       // Transcodings completed successfully per second
+	LatencyP50 time.Duration // Percentiles of the time of a transcoding, failed or not
+	LatencyP90 time.Duration
+	LatencyP99 time.Duration
+	LatencyMax time.Duration
+}
+
+// stressInputOpener opens url whatever the url of the run it is registered for, so each run of
+// WarmupStress() has its own url specific handlers
+type stressInputOpener struct {
+	opener InputOpener
+	url    string
+}
+
+func (o *stressInputOpener) Open(fd int64, url string) (InputHandler, error) {
+	return o.opener.Open(fd, o.url)
+}
+
+// WarmupStress runs the transcoding of url with params concurrency times in parallel, each of them
+// iterations times in a row, and returns the throughput and the latency percentiles of the transcodings.
+// It is the library counterpart of "elvxc stress", to run capacity tests programmatically (i.e. in Go
+// benchmarks).
+// Each transcoding goes through Xc() with the openers set for url by InitUrlIOHandler() (or the global
+// ones), registered for the url of the run and released once it completes, like any other job. The url
+// specific openers are released when WarmupStress() returns. It returns the first transcoding error along
+// with the result, or an error if the handlers of a transcoding were not released.
+func WarmupStress(params *goavpipe.XcParams, url string, concurrency int, iterations int) (StressResult, error) {
+	defer releaseUrlIOHandlers(url)
+
+	if params == nil || concurrency <= 0 || iterations <= 0 {
+		log.Error("Failed stress test, invalid params", "concurrency", concurrency, "iterations", iterations, "url", url)
+		return StressResult{}, EAV_PARAM
+	}
+
+	inputOpener := getInputOpener(url)
+	outputOpener := getOutputOpener(url)
+	if inputOpener == nil || outputOpener == nil {
+		return StressResult{}, fmt.Errorf("Input or output opener(s) are not set, url=%s", url)
+	}
+
+	// The url of each run shares the prefix of url, since the C layer detects the live protocols by prefix
+	runPrefix := url + "#stress-"
+	latencies := make([]time.Duration, concurrency*iterations)
+	errs := make([]error, concurrency*iterations)
+
+	start := time.Now()
+	wg := sync.WaitGroup{}
+	for worker := 0; worker < concurrency; worker++ {
+		wg.Add(1)
+		go func(worker int) {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				n := worker*iterations + i
+				p := *params
+				p.Url = fmt.Sprintf("%s%d-%d", runPrefix, worker, i)
+				// NormalizeCrypt() rewrites the key periods in place
+				p.KeyRotation = append([]goavpipe.KeyPeriod(nil), params.KeyRotation...)
+
+				runStart := time.Now()
+				errs[n] = RegisterUrlIOHandler(p.Url, &stressInputOpener{opener: inputOpener, url: url}, outputOpener)
+				if errs[n] == nil {
+					errs[n] = Xc(&p)
+				}
+				latencies[n] = time.Since(runStart)
+			}
+		}(worker)
+	}
+	wg.Wait()
+
+	result := StressResult{Iterations: len(latencies), Duration: time.Since(start)}
+	var err error
+	for _, e := range errs {
+		if e != nil {
+			result.Errors++
+			if err == nil {
+				err = e
+			}
+		}
+	}
+	if result.Duration > 0 {
+		result.Throughput = float64(result.Iterations-result.Errors) / result.Duration.Seconds()
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	result.LatencyP50 = latencyPercentile(latencies, 50)
+	result.LatencyP90 = latencyPercentile(latencies, 90)
+	result.LatencyP99 = latencyPercentile(latencies, 99)
+	result.LatencyMax = latencies[len(latencies)-1]
+
+	if leaked := stressLeakedHandlers(runPrefix); leaked > 0 {
+		log.Error("Stress test leaked handlers", "leaked", leaked, "url", url)
+		return result, fmt.Errorf("%d handlers were not released, url=%s", leaked, url)
+	}
+
+	log.Info("Stress test done", "url", url, "iterations", result.Iterations, "errors", result.Errors,
+		"duration", result.Duration, "throughput", result.Throughput, "p50", result.LatencyP50, "p99", result.LatencyP99)
+	return result, err
+}
+
+// latencyPercentile returns the nearest rank percentile p of the sorted latencies
+func latencyPercentile(sorted []time.Duration, p int) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	rank := (p*len(sorted) + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return sorted[rank-1]
+}
+
+// stressLeakedHandlers returns the number of input handlers and url specific openers left by the runs
+// whose url starts with prefix
+func stressLeakedHandlers(prefix string) int {
+	gMutex.RLock()
+	defer gMutex.RUnlock()
+
+	leaked := 0
+	for _, h := range gHandlers {
+		if strings.HasPrefix(h.url, prefix) {
+			leaked++
+		}
+	}
+	for u := range gURLInputOpeners {
+		if strings.HasPrefix(u, prefix) {
+			leaked++
+		}
+	}
+	for u := range gURLOutputOpeners {
+		if strings.HasPrefix(u, prefix) {
+			leaked++
+		}
+	}
+	return leaked
+}
@@ -0,0 +1,24 @@
+package avpipe
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLatencyPercentile(t *testing.T) {
+	latencies := make([]time.Duration, 100)
+	for i := range latencies {
+		latencies[i] = time.Duration(i+1) * time.Millisecond
+	}
+	require.Equal(t, 50*time.Millisecond, latencyPercentile(latencies, 50))
+	require.Equal(t, 90*time.Millisecond, latencyPercentile(latencies, 90))
+	require.Equal(t, 99*time.Millisecond, latencyPercentile(latencies, 99))
+
+	// Nearest rank of few samples
+	latencies = []time.Duration{time.Second, 2 * time.Second, 3 * time.Second}
+	require.Equal(t, 2*time.Second, latencyPercentile(latencies, 50))
+	require.Equal(t, 3*time.Second, latencyPercentile(latencies, 90))
+	require.Equal(t, time.Duration(0), latencyPercentile(nil, 50))
+}
@@ -1,8 +1,15 @@
 package avpipe_test
 
 import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/jpeg"
 	"io"
 	"io/fs"
 	"io/ioutil"
@@ -12,17 +19,23 @@ import (
 	"os/exec"
 	"path"
 	"path/filepath"
+	"regexp"
 	"runtime"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
+	"github.com/Comcast/gots"
+	"github.com/Comcast/gots/scte35"
 	"github.com/eluv-io/avpipe"
 	"github.com/eluv-io/avpipe/elvxc/cmd"
 	"github.com/eluv-io/avpipe/goavpipe"
 	"github.com/eluv-io/log-go"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 const baseOutPath = "test_out"
@@ -44,12 +57,20 @@ type XcTestResult struct {
 type testStatsInfo struct {
 	audioFramesRead         uint64
 	videoFramesRead         uint64
+	videoFramesDropped      uint64
 	firstKeyFramePTS        uint64
 	encodingAudioFrameStats avpipe.EncodingFrameStats
 	encodingVideoFrameStats avpipe.EncodingFrameStats
+	audioSegmentStats       []avpipe.SegmentStats
+	videoSegmentStats       []avpipe.SegmentStats
+	decodeProgressReports   int
+	decodeProgress          avpipe.DecodeProgress
+	scte35Events            []avpipe.SCTE35Event
+	xcTiming                *avpipe.XcTiming
 }
 
 var statsInfo testStatsInfo
+var segmentStatsMutex sync.Mutex
 
 // Implements avpipe.InputOpener
 type fileInputOpener struct {
@@ -163,6 +184,31 @@ func (i *fileInput) Stat(streamIndex int, statType avpipe.AVStatType, statArgs i
 			log.Debug("AVP TEST IN STAT", "video first keyframe PTS", *keyFramePTS, "streamIndex", streamIndex)
 		}
 		statsInfo.firstKeyFramePTS = *keyFramePTS
+	case avpipe.AV_IN_STAT_VIDEO_FRAMES_DROPPED:
+		videoFramesDropped := statArgs.(*uint64)
+		if debugFrameLevel {
+			log.Debug("AVP TEST IN STAT", "videoFramesDropped", *videoFramesDropped, "streamIndex", streamIndex)
+		}
+		statsInfo.videoFramesDropped = *videoFramesDropped
+	case avpipe.AV_IN_STAT_DECODE_PROGRESS:
+		decodeProgress := statArgs.(*avpipe.DecodeProgress)
+		if debugFrameLevel {
+			log.Debug("AVP TEST IN STAT", "decodeProgress", decodeProgress, "streamIndex", streamIndex)
+		}
+		statsInfo.decodeProgressReports++
+		statsInfo.decodeProgress = *decodeProgress
+	case avpipe.AV_IN_STAT_SCTE35:
+		event := statArgs.(*avpipe.SCTE35Event)
+		if debugFrameLevel {
+			log.Debug("AVP TEST IN STAT", "scte35", event, "streamIndex", streamIndex)
+		}
+		statsInfo.scte35Events = append(statsInfo.scte35Events, *event)
+	case avpipe.AV_IN_STAT_XC_TIMING:
+		xcTiming := statArgs.(*avpipe.XcTiming)
+		if debugFrameLevel {
+			log.Debug("AVP TEST IN STAT", "xcTiming", xcTiming, "streamIndex", streamIndex)
+		}
+		statsInfo.xcTiming = xcTiming
 	}
 	return nil
 }
@@ -203,8 +249,24 @@ func (oo *fileOutputOpener) Open(_, _ int64, streamIndex, segIndex int,
 		filename = fmt.Sprintf("./%s/vsegment-%d.mp4", oo.dir, segIndex)
 	case goavpipe.FMP4AudioSegment:
 		filename = fmt.Sprintf("./%s/asegment%d-%d.mp4", oo.dir, streamIndex, segIndex)
+	case goavpipe.FMP4Stream:
+		filename = fmt.Sprintf("./%s/fmp4-stream.mp4", oo.dir)
+	case goavpipe.MP4Stream:
+		filename = fmt.Sprintf("./%s/mp4-stream.mp4", oo.dir)
 	case goavpipe.FrameImage:
 		filename = fmt.Sprintf("./%s/%d.jpeg", oo.dir, pts)
+	case goavpipe.ImageThumbnail:
+		filename = fmt.Sprintf("./%s/thumbnail-%d.jpeg", oo.dir, segIndex)
+	case goavpipe.WebMVideoStream:
+		filename = fmt.Sprintf("./%s/webm-video.webm", oo.dir)
+	case goavpipe.WebMAudioStream:
+		filename = fmt.Sprintf("./%s/webm-audio%d.webm", oo.dir, streamIndex)
+	case goavpipe.IndexSidecar:
+		filename = fmt.Sprintf("./%s/index-stream%d.json", oo.dir, streamIndex)
+	case goavpipe.WebVTTInit:
+		filename = fmt.Sprintf("./%s/vttinit-stream.vtt", oo.dir)
+	case goavpipe.WebVTTSegment:
+		filename = fmt.Sprintf("./%s/vttsegment-%d.vtt", oo.dir, segIndex)
 	}
 
 	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
@@ -339,6 +401,16 @@ func (o *fileOutput) Stat(streamIndex int, avType goavpipe.AVType, statType avpi
 		} else {
 			statsInfo.encodingVideoFrameStats = *encodingStats
 		}
+	case avpipe.AV_OUT_STAT_SEGMENT_DONE:
+		segmentStats := statArgs.(*avpipe.SegmentStats)
+		doLog("segmentStats", segmentStats)
+		segmentStatsMutex.Lock()
+		if avType == goavpipe.FMP4AudioSegment {
+			statsInfo.audioSegmentStats = append(statsInfo.audioSegmentStats, *segmentStats)
+		} else {
+			statsInfo.videoSegmentStats = append(statsInfo.videoSegmentStats, *segmentStats)
+		}
+		segmentStatsMutex.Unlock()
 	}
 
 	return nil
@@ -454,6 +526,225 @@ func TestVideoSegWithRotate(t *testing.T) {
 
 }
 
+func TestAutoRotate(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	setupOutDir(t, outputDir)
+
+	// Make a short source that has a 90 degree display matrix, like the videos captured by phones
+	rotatedUrl := path.Join(outputDir, "rotated.mp4")
+	ffmpeg := exec.Command("ffmpeg", "-y", "-i", url, "-t", "2", "-map", "0:v", "-c", "copy",
+		"-metadata:s:v:0", "rotate=90", rotatedUrl)
+	if err := ffmpeg.Run(); err != nil {
+		t.Skip("ffmpeg is needed to make the rotated source", err)
+	}
+
+	probeInfo, err := avpipe.Probe(&goavpipe.XcParams{Url: rotatedUrl, Seekable: true})
+	failNowOnError(t, err)
+	assert.Equal(t, 90, probeInfo.StreamInfo[0].Rotation)
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		AutoRotate:          true,
+		Url:                 rotatedUrl,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	xcTestResult := &XcTestResult{
+		mezFile: []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+	}
+
+	// Keep rotated.mp4, boilerplate would remove it
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: rotatedUrl}, &fileOutputOpener{t: t, dir: outputDir})
+	boilerXc(t, params)
+	outProbe := boilerProbe(t, xcTestResult)
+	if assert.Len(t, outProbe, 1) {
+		assert.Equal(t, 1080, outProbe[0].StreamInfo[0].Width)
+		assert.Equal(t, 1920, outProbe[0].StreamInfo[0].Height)
+		assert.Equal(t, 0, outProbe[0].StreamInfo[0].Rotation)
+	}
+}
+
+// TestPtsWraparound transcodes MPEG-TS inputs made of 2 parts of 5 sec, the timestamps of the second part
+// wrap around (2^33) or jump forward after the first part. The output must be continuous.
+func TestPtsWraparound(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	setupOutDir(t, outputDir)
+
+	// The mpegts muxer starts at 1.4 sec, so the first part ends 0.6 sec before the PTS wraps around
+	// (2^33 / 90000 sec) and the second part starts 2 sec after it, or 1000 sec after the first part
+	wrapSec := float64(int64(1)<<33) / 90000
+	tests := []struct {
+		name             string
+		offset1, offset2 float64
+	}{
+		{name: "wraparound", offset1: wrapSec - 7, offset2: 0},
+		{name: "discontinuity", offset1: 0, offset2: 1000},
+	}
+
+	for _, tt := range tests {
+		var input []byte
+		for i, offset := range []float64{tt.offset1, tt.offset2} {
+			partUrl := path.Join(outputDir, fmt.Sprintf("%s-%d.ts", tt.name, i))
+			ffmpeg := exec.Command("ffmpeg", "-y", "-i", url, "-t", "5", "-map", "0:v", "-c", "copy",
+				"-f", "mpegts", "-output_ts_offset", fmt.Sprintf("%.3f", offset), partUrl)
+			if err := ffmpeg.Run(); err != nil {
+				t.Skip("ffmpeg is needed to make the MPEG-TS source", err)
+			}
+			part, err := ioutil.ReadFile(partUrl)
+			failNowOnError(t, err)
+			input = append(input, part...)
+		}
+		inputUrl := path.Join(outputDir, tt.name+".ts")
+		failNowOnError(t, ioutil.WriteFile(inputUrl, input, 0644))
+
+		dir := path.Join(outputDir, tt.name)
+		params := &goavpipe.XcParams{
+			Format:          "mp4",
+			DurationTs:      -1,
+			StartSegmentStr: "1",
+			VideoBitrate:    1000000,
+			Ecodec:          h264Codec,
+			EncHeight:       360,
+			EncWidth:        640,
+			XcType:          goavpipe.XcVideo,
+			StreamId:        -1,
+			Url:             inputUrl,
+			// NewXcParams() enables it
+			HandlePtsWraparound: true,
+			DebugFrameLevel:     debugFrameLevel,
+		}
+		setFastEncodeParams(params, false)
+		setupOutDir(t, dir)
+		avpipe.InitIOHandler(&fileInputOpener{t: t, url: inputUrl}, &fileOutputOpener{t: t, dir: dir})
+		boilerXc(t, params)
+
+		outUrl := path.Join(dir, "mp4-stream.mp4")
+		avpipe.InitIOHandler(&fileInputOpener{url: outUrl}, &fileOutputOpener{dir: dir})
+		probe, err := avpipe.Probe(&goavpipe.XcParams{Url: outUrl, Seekable: true})
+		failNowOnError(t, err)
+		si := probe.StreamInfo[0]
+		duration, _ := new(big.Rat).Mul(big.NewRat(si.DurationTs, 1), si.TimeBase).Float64()
+		// 10 sec at 30 fps, the duration is 12 sec at most with the 2 sec gap at the wrap around
+		assert.Equal(t, int64(300), si.NBFrames, tt.name)
+		assert.InDelta(t, 11, duration, 1.5, tt.name)
+	}
+}
+
+// The source is progressive, so auto deinterlacing must skip the filter
+func TestDeinterlaceAutoProgressive(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+
+	deinterlace, err := goavpipe.DeinterlaceFromString("yadif", true)
+	failNowOnError(t, err)
+	assert.Equal(t, goavpipe.DeinterlaceYadif, deinterlace)
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          60000,
+		StartSegmentStr:     "1",
+		SegDuration:         "2",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		// send_field needs VideoFrameDurationTs, the transcoding fails if the filter is used
+		Deinterlace:     deinterlace,
+		DeinterlaceAuto: true,
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	xcTestResult := &XcTestResult{
+		mezFile: []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+	}
+
+	xcTest(t, outputDir, params, xcTestResult, true)
+}
+
+// Converts a 23.976 fps source to 24 fps, the output must have a frame for every 1/24 sec of the source
+func TestEncFrameRate(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	setupOutDir(t, outputDir)
+
+	ntscUrl := path.Join(outputDir, "bbb_23976.mp4")
+	ffmpeg := exec.Command("ffmpeg", "-y", "-i", url, "-t", "10", "-an", "-r", "24000/1001",
+		"-c:v", "libx264", "-preset", "ultrafast", ntscUrl)
+	if err := ffmpeg.Run(); err != nil {
+		t.Skip("ffmpeg is needed to make the 23.976 fps source", err)
+	}
+
+	probeInfo, err := avpipe.Probe(&goavpipe.XcParams{Url: ntscUrl, Seekable: true})
+	failNowOnError(t, err)
+	si := probeInfo.StreamInfo[0]
+	assert.Equal(t, 0, si.AvgFrameRate.Cmp(big.NewRat(24000, 1001)), si.AvgFrameRate)
+	duration, _ := new(big.Rat).Mul(big.NewRat(si.DurationTs, 1), si.TimeBase).Float64()
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		EncFrameRate:        "24",
+		ForceKeyInt:         48,
+		Url:                 ntscUrl,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	xcTestResult := &XcTestResult{
+		mezFile:   []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+		timeScale: 12288,
+	}
+
+	// Keep bbb_23976.mp4, boilerplate would remove it
+	statsInfo = testStatsInfo{}
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: ntscUrl}, &fileOutputOpener{t: t, dir: outputDir})
+	boilerXc(t, params)
+	boilerProbe(t, xcTestResult)
+
+	// The fps filter may hold back the last frame until it sees the end of the stream
+	assert.InDelta(t, math.Round(duration*24), float64(statsInfo.encodingVideoFrameStats.TotalFramesWritten), 1)
+}
+
 func TestVideoSegDoubleTS(t *testing.T) {
 	url := videoBigBuckBunnyPath
 	outputDir := path.Join(baseOutPath, fn())
@@ -634,6 +925,80 @@ func TestSingleABRTranscodeWithOverlayWatermark(t *testing.T) {
 	xcTest(t, outputDir, params, nil, true)
 }
 
+func TestSingleABRTranscodeWithTextAndImageWatermark(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) || fileMissing("./media/avpipe.png", fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+
+	params := &goavpipe.XcParams{
+		Format:                "hls",
+		StartTimeTs:           0,
+		DurationTs:            -1,
+		StartSegmentStr:       "1",
+		VideoBitrate:          2560000,
+		VideoSegDurationTs:    60000,
+		Ecodec:                h264Codec,
+		EncHeight:             720,
+		EncWidth:              1280,
+		XcType:                goavpipe.XcVideo,
+		WatermarkText:         "This is avpipe text watermarking",
+		WatermarkYLoc:         "H*0.5",
+		WatermarkXLoc:         "W/2",
+		WatermarkRelativeSize: 0.05,
+		WatermarkFontColor:    "white",
+		WatermarkShadow:       true,
+		WatermarkShadowColor:  "black",
+		WatermarkImageFile:    "./media/avpipe.png",
+		WatermarkImageXLoc:    "main_w-overlay_w-20",
+		WatermarkImageYLoc:    "20",
+		WatermarkImageScale:   0.1,
+		WatermarkImageOpacity: 0.5,
+		StreamId:              -1,
+		Url:                   url,
+		DebugFrameLevel:       debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	xcTest(t, outputDir, params, nil, true)
+}
+
+func TestSingleABRTranscodeWithAutoTimecodeWatermark(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+
+	// The source has no tmcd track, the timecode starts at 00:00:00:00 with the frame rate of the video
+	params := &goavpipe.XcParams{
+		Format:                "hls",
+		StartTimeTs:           0,
+		DurationTs:            -1,
+		StartSegmentStr:       "1",
+		VideoBitrate:          2560000,
+		VideoSegDurationTs:    60000,
+		Ecodec:                h264Codec,
+		EncHeight:             720,
+		EncWidth:              1280,
+		XcType:                goavpipe.XcVideo,
+		WatermarkTimecodeAuto: true,
+		WatermarkYLoc:         "main_h*0.9",
+		WatermarkXLoc:         "main_w/2",
+		WatermarkRelativeSize: 0.05,
+		WatermarkFontColor:    "white",
+		WatermarkShadow:       true,
+		WatermarkShadowColor:  "black",
+		StreamId:              -1,
+		Url:                   url,
+		DebugFrameLevel:       debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	xcTest(t, outputDir, params, nil, true)
+}
+
 func TestV2SingleABRTranscode(t *testing.T) {
 	url := videoBigBuckBunnyPath
 	if fileMissing(url, fn()) {
@@ -762,6 +1127,57 @@ func TestV2SingleABRTranscodeCancelling(t *testing.T) {
 	assert.Error(t, err)
 }
 
+// TestV2SingleTranscodeStopping stops a transcoding gracefully, the last segment must be finalized
+func TestV2SingleTranscodeStopping(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, url)
+
+	params := &goavpipe.XcParams{
+		Format:             "fmp4-segment",
+		StartTimeTs:        0,
+		DurationTs:         -1,
+		StartSegmentStr:    "1",
+		VideoBitrate:       1000000,
+		VideoSegDurationTs: 60000, // 2 sec
+		Ecodec:             h264Codec,
+		EncHeight:          360,
+		EncWidth:           640,
+		XcType:             goavpipe.XcVideo,
+		StreamId:           -1,
+		Url:                url,
+		DebugFrameLevel:    debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	handle, err := avpipe.XcInit(params)
+	failNowOnError(t, err)
+	go func(handle int32) {
+		// Wait for 2 sec the transcoding starts, then stop it.
+		time.Sleep(2 * time.Second)
+		err := avpipe.XcStop(handle)
+		assert.NoError(t, err)
+	}(handle)
+	failNowOnError(t, avpipe.XcRun(handle))
+
+	files, err := ioutil.ReadDir(outputDir)
+	failNowOnError(t, err)
+	if !assert.Greater(t, len(files), 0) {
+		return
+	}
+
+	// The last segment is playable
+	segUrl := fmt.Sprintf("%s/vsegment-%d.mp4", outputDir, len(files))
+	avpipe.InitIOHandler(&fileInputOpener{url: segUrl}, &fileOutputOpener{dir: outputDir})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: segUrl, Seekable: true})
+	failNowOnError(t, err)
+	assert.Greater(t, probe.StreamInfo[0].NBFrames, int64(0))
+}
+
 func doTranscode(t *testing.T,
 	p *goavpipe.XcParams,
 	nThreads int,
@@ -894,7 +1310,8 @@ func TestConcurrentABRTranscode(t *testing.T) {
 	doTranscode(t, params, nThreads, outputDir, url)
 }
 
-func TestSettingProfileLevel(t *testing.T) {
+// Runs 3 x 2 short transcodings with WarmupStress(), each run must release its handlers
+func TestWarmupStress(t *testing.T) {
 	outputDir := path.Join(baseOutPath, fn())
 	boilerplate(t, outputDir, "")
 	url := videoBigBuckBunnyPath
@@ -903,56 +1320,602 @@ func TestSettingProfileLevel(t *testing.T) {
 	}
 
 	params := &goavpipe.XcParams{
-		Format:             "fmp4-segment",
+		Format:             "hls",
 		StartTimeTs:        0,
-		DurationTs:         -1,
+		DurationTs:         180000,
 		StartSegmentStr:    "1",
-		VideoBitrate:       2560000,
-		AudioBitrate:       64000,
-		VideoSegDurationTs: 900000,
-		AudioSegDurationTs: 1428480,
+		VideoBitrate:       1000000,
+		VideoSegDurationTs: 60000,
 		Ecodec:             h264Codec,
-		EncHeight:          480,
-		EncWidth:           720,
+		EncHeight:          360,
+		EncWidth:           640,
 		XcType:             goavpipe.XcVideo,
 		StreamId:           -1,
-		Url:                url,
 		DebugFrameLevel:    debugFrameLevel,
-		Profile:            "high",
-		Level:              51,
 	}
 	setFastEncodeParams(params, false)
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: outputDir})
 
-	xcTestResult := &XcTestResult{
-		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
-		level:    51,
-		profile:  "High",
-		pixelFmt: "yuv420p",
+	result, err := avpipe.WarmupStress(params, url, 3, 2)
+	failNowOnError(t, err)
+	assert.Equal(t, 6, result.Iterations)
+	assert.Equal(t, 0, result.Errors)
+	assert.Greater(t, result.Throughput, 0.0)
+	assert.LessOrEqual(t, result.LatencyP50, result.LatencyP99)
+	assert.LessOrEqual(t, result.LatencyP99, result.LatencyMax)
+
+	_, err = avpipe.WarmupStress(params, url, 0, 2)
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
+}
+
+// Implements avpipe.OutputOpener, fails the test if an output is opened with it
+type unexpectedOutputOpener struct {
+	t *testing.T
+}
+
+func (o *unexpectedOutputOpener) Open(h, fd int64, streamIndex, segIndex int,
+	pts int64, outType goavpipe.AVType) (avpipe.OutputHandler, error) {
+	o.t.Errorf("Unexpected output opened with the global output opener, handler=%d type=%s", h, outType.Name())
+	return nil, fmt.Errorf("unexpected output")
+}
+
+// Runs jobs with URL specific input and output openers concurrently, each job must write its outputs
+// with its own output opener and never with the global one
+func TestConcurrentUrlIOHandlers(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
 	}
-	xcTest(t, outputDir, params, xcTestResult, true)
+
+	// Different URLs of the same file
+	urls := []string{url, "./" + url, "./" + path.Dir(url) + "/./" + path.Base(url)}
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: url}, &unexpectedOutputOpener{t: t})
+
+	wg := sync.WaitGroup{}
+	for i, u := range urls {
+		outputDir := path.Join(baseOutPath, fn(), fmt.Sprintf("job%d", i))
+		setupOutDir(t, outputDir)
+		params := &goavpipe.XcParams{
+			Format:          "fmp4-segment",
+			DurationTs:      -1,
+			StartSegmentStr: "1",
+			SegDuration:     "30",
+			Ecodec:          h264Codec,
+			EncHeight:       360,
+			EncWidth:        640,
+			XcType:          goavpipe.XcVideo,
+			StreamId:        -1,
+			Url:             u,
+			DebugFrameLevel: debugFrameLevel,
+		}
+		setFastEncodeParams(params, true)
+		require.NoError(t, avpipe.RegisterUrlIOHandler(u, &fileInputOpener{t: t, url: u}, &fileOutputOpener{t: t, dir: outputDir}))
+
+		wg.Add(1)
+		go func(params *goavpipe.XcParams, outputDir string) {
+			defer wg.Done()
+			assert.NoError(t, avpipe.Xc(params))
+			assert.FileExists(t, path.Join(outputDir, "vsegment-1.mp4"))
+			assert.FileExists(t, path.Join(outputDir, "vsegment-2.mp4"))
+		}(params, outputDir)
+	}
+	wg.Wait()
 }
 
-func TestStartTimeTsWithSkipDecoding(t *testing.T) {
-	url := "./media/video-960.mp4"
+// Transcodes two renditions from a single decoding of the input, each rendition writes to its own directory
+func TestXcOutputs(t *testing.T) {
+	url := videoBigBuckBunnyPath
 	if fileMissing(url, fn()) {
 		return
 	}
 
 	outputDir := path.Join(baseOutPath, fn())
-	boilerplate(t, outputDir, "")
+	boilerplate(t, outputDir, url)
 
 	params := &goavpipe.XcParams{
-		BypassTranscoding:   false,
-		Format:              "dash",
-		StartTimeTs:         180000,
-		StartPts:            900000,
-		DurationTs:          720000,
+		Format:             "fmp4-segment",
+		StartTimeTs:        0,
+		DurationTs:         900000, // 30 sec
+		StartSegmentStr:    "1",
+		VideoBitrate:       1000000,
+		VideoSegDurationTs: 180000, // 6 sec
+		Ecodec:             h264Codec,
+		EncHeight:          360,
+		EncWidth:           640,
+		XcType:             goavpipe.XcVideo,
+		StreamId:           -1,
+		Url:                url,
+		DebugFrameLevel:    debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	artifacts, err := avpipe.XcOutputs(params)
+	failNowOnError(t, err)
+
+	files, err := ioutil.ReadDir(outputDir)
+	failNowOnError(t, err)
+	if assert.Equal(t, len(files), len(artifacts)) {
+		for i, artifact := range artifacts {
+			assert.Equal(t, goavpipe.FMP4VideoSegment, artifact.Type)
+			assert.Equal(t, i+1, artifact.SegIndex)
+			fi, err := os.Stat(fmt.Sprintf("%s/vsegment-%d.mp4", outputDir, artifact.SegIndex))
+			failNowOnError(t, err)
+			assert.Equal(t, fi.Size(), artifact.Bytes)
+		}
+	}
+
+	artifacts, err = avpipe.XcOutputs(nil)
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
+	assert.Nil(t, artifacts)
+}
+
+// TestValidateParams checks valid and invalid params without transcoding, no output must be written
+func TestValidateParams(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, url)
+
+	params := &goavpipe.XcParams{
+		Format:             "fmp4-segment",
+		StartTimeTs:        0,
+		DurationTs:         -1,
+		StartSegmentStr:    "1",
+		VideoBitrate:       1000000,
+		VideoSegDurationTs: 180000, // 6 sec
+		Ecodec:             h264Codec,
+		EncHeight:          360,
+		EncWidth:           640,
+		XcType:             goavpipe.XcVideo,
+		StreamId:           -1,
+		DebugFrameLevel:    debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	failNowOnError(t, avpipe.ValidateParams(params, url))
+	assert.Equal(t, "", params.Url)
+
+	files, err := ioutil.ReadDir(outputDir)
+	failNowOnError(t, err)
+	assert.Equal(t, 0, len(files))
+
+	invalid := *params
+	invalid.Ecodec = "nosuchcodec"
+	assert.Error(t, avpipe.ValidateParams(&invalid, url))
+
+	invalid = *params
+	invalid.VFRHandling = "nosuchmode"
+	assert.ErrorIs(t, avpipe.ValidateParams(&invalid, url), avpipe.EAV_PARAM)
+
+	invalid = *params
+	invalid.WatermarkText = "avpipe"
+	invalid.WatermarkFontColor = "nosuchcolor" // Fails in the filter graph
+	assert.Error(t, avpipe.ValidateParams(&invalid, url))
+
+	assert.ErrorIs(t, avpipe.ValidateParams(nil, url), avpipe.EAV_PARAM)
+}
+
+// TestThreadCount transcodes with a single decoder and encoder thread and slice threading
+func TestThreadCount(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:             "fmp4-segment",
+		StartTimeTs:        0,
+		DurationTs:         180000, // 6 sec
+		StartSegmentStr:    "1",
+		VideoBitrate:       1000000,
+		VideoSegDurationTs: 180000,
+		Ecodec:             h264Codec,
+		EncHeight:          360,
+		EncWidth:           640,
+		XcType:             goavpipe.XcVideo,
+		StreamId:           -1,
+		Url:                url,
+		DecodeThreads:      1,
+		EncodeThreads:      1,
+		ThreadType:         "slice",
+		DebugFrameLevel:    debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	xcTestResult := &XcTestResult{
+		mezFile: []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+	}
+	xcTest(t, outputDir, params, xcTestResult, true)
+
+	invalid := *params
+	invalid.ThreadType = "auto"
+	assert.ErrorIs(t, avpipe.ValidateParams(&invalid, url), avpipe.EAV_PARAM)
+
+	invalid = *params
+	invalid.EncodeThreads = -1
+	assert.ErrorIs(t, avpipe.ValidateParams(&invalid, url), avpipe.EAV_PARAM)
+}
+
+// TestLowLatency transcodes with the low latency mode, the output must have no B-frames
+func TestLowLatency(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:             "fmp4-segment",
+		StartTimeTs:        0,
+		DurationTs:         180000, // 6 sec
+		StartSegmentStr:    "1",
+		VideoBitrate:       1000000,
+		VideoSegDurationTs: 180000,
+		Ecodec:             h264Codec,
+		EncHeight:          360,
+		EncWidth:           640,
+		XcType:             goavpipe.XcVideo,
+		StreamId:           -1,
+		Url:                url,
+		LowLatency:         true,
+		DebugFrameLevel:    debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	xcTest(t, outputDir, params, nil, true)
+
+	segUrl := fmt.Sprintf("%s/vsegment-1.mp4", outputDir)
+	avpipe.InitIOHandler(&fileInputOpener{url: segUrl}, &fileOutputOpener{dir: outputDir})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: segUrl, Seekable: true})
+	failNowOnError(t, err)
+	assert.False(t, probe.StreamInfo[0].Has_B_Frames)
+
+	invalid := *params
+	invalid.MaxBFrames = 2
+	assert.ErrorIs(t, avpipe.ValidateParams(&invalid, url), avpipe.EAV_PARAM)
+
+	invalid = *params
+	invalid.LowLatency = false
+	invalid.IntraRefresh = true
+	assert.ErrorIs(t, avpipe.ValidateParams(&invalid, url), avpipe.EAV_PARAM)
+}
+
+// TestEncoderGOPParams checks max_b_frames, ref_frames and closed_gop reach the encoder, as shown by
+// the options the encoder writes in the stream, and max_b_frames -1 keeps the segment default (no B-frames)
+func TestEncoderGOPParams(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	baseDir := path.Join(baseOutPath, fn())
+	tests := []struct {
+		name       string
+		ecodec     string
+		maxBFrames int32
+		refFrames  int32
+		closedGOP  bool
+		options    []string // Options the encoder must report
+	}{
+		{name: "x264", ecodec: h264Codec, maxBFrames: 2, refFrames: 3, options: []string{"bframes=2", "ref=3"}},
+		{name: "x264_default", ecodec: h264Codec, maxBFrames: -1, options: []string{"bframes=0"}},
+		{name: "x265", ecodec: "libx265", maxBFrames: 3, refFrames: 2, closedGOP: true,
+			options: []string{"bframes=3", "ref=2", "no-open-gop"}},
+		{name: "x265_default", ecodec: "libx265", maxBFrames: -1, options: []string{"bframes=0", "open-gop"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			outputDir := path.Join(baseDir, tt.name)
+			params := &goavpipe.XcParams{
+				Format:             "fmp4-segment",
+				StartTimeTs:        0,
+				DurationTs:         180000, // 6 sec
+				StartSegmentStr:    "1",
+				VideoBitrate:       1000000,
+				VideoSegDurationTs: 180000,
+				Ecodec:             tt.ecodec,
+				EncHeight:          360,
+				EncWidth:           640,
+				XcType:             goavpipe.XcVideo,
+				StreamId:           -1,
+				Url:                url,
+				MaxBFrames:         tt.maxBFrames,
+				RefFrames:          tt.refFrames,
+				ClosedGOP:          tt.closedGOP,
+				DebugFrameLevel:    debugFrameLevel,
+			}
+			setFastEncodeParams(params, true)
+			xcTest(t, outputDir, params, nil, true)
+
+			segUrl := path.Join(outputDir, "vsegment-1.mp4")
+			options := encoderOptions(t, segUrl)
+			for _, o := range tt.options {
+				assert.True(t, options[o], "missing encoder option %s", o)
+			}
+
+			frames, err := avpipe.ProbeFrames(segUrl, true, 0, 0)
+			failNowOnError(t, err)
+			bFrames := 0
+			for _, f := range frames {
+				if f.PictType == "B" {
+					bFrames++
+				}
+			}
+			if tt.maxBFrames > 0 {
+				assert.Greater(t, bFrames, 0)
+			} else {
+				assert.Equal(t, 0, bFrames)
+			}
+		})
+	}
+}
+
+// encoderOptions returns the options that libx264 and libx265 write in a SEI of the stream
+// ("options: bframes=2 ref=3 ...") found in the file
+func encoderOptions(t *testing.T, filename string) map[string]bool {
+	data, err := ioutil.ReadFile(filename)
+	failNowOnError(t, err)
+	i := bytes.Index(data, []byte("options: "))
+	require.GreaterOrEqual(t, i, 0, "no encoder options in "+filename)
+	data = data[i+len("options: "):]
+	if end := bytes.IndexFunc(data, func(r rune) bool { return r < ' ' || r > '~' }); end >= 0 {
+		data = data[:end]
+	}
+
+	options := map[string]bool{}
+	for _, o := range strings.Fields(string(data)) {
+		options[o] = true
+	}
+	return options
+}
+
+// TestXcContinue records 2 windows of the input, the segments of the second one continue the first one
+func TestXcContinue(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, url)
+
+	params := &goavpipe.XcParams{
+		Format:             "fmp4-segment",
+		StartTimeTs:        0,
+		DurationTs:         360000, // 12 sec
+		StartSegmentStr:    "1",
+		StartFragmentIndex: 1,
+		VideoBitrate:       1000000,
+		VideoSegDurationTs: 180000, // 6 sec
+		Ecodec:             h264Codec,
+		EncHeight:          360,
+		EncWidth:           640,
+		XcType:             goavpipe.XcVideo,
+		StreamId:           -1,
+		Url:                url,
+		DebugFrameLevel:    debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	state, err := avpipe.XcContinue(params, nil)
+	failNowOnError(t, err)
+	if assert.NotNil(t, state) {
+		assert.Equal(t, 2, state.LastSegIndex)
+		assert.Equal(t, 360, state.LastFragmentIndex) // 12 sec at 30 fps
+		assert.Greater(t, state.LastPts, int64(0))
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: url}, &fileOutputOpener{t: t, dir: outputDir})
+	params.StartTimeTs = 360000
+	next, err := avpipe.XcContinue(params, state)
+	failNowOnError(t, err)
+	assert.Equal(t, "3", params.StartSegmentStr)
+	assert.Equal(t, int32(361), params.StartFragmentIndex)
+	assert.Equal(t, state.LastPts, params.StartPts)
+	if assert.NotNil(t, next) {
+		assert.Equal(t, 4, next.LastSegIndex)
+		assert.Equal(t, 720, next.LastFragmentIndex)
+		assert.Greater(t, next.LastPts, state.LastPts)
+	}
+
+	files, err := ioutil.ReadDir(outputDir)
+	failNowOnError(t, err)
+	assert.Equal(t, 4, len(files))
+}
+
+func TestXcMulti(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, url)
+
+	heights := []int32{720, 360}
+	var renditions []*goavpipe.XcParams
+	for _, height := range heights {
+		renditionDir := path.Join(outputDir, fmt.Sprintf("%dp", height))
+		setupOutDir(t, renditionDir)
+
+		params := &goavpipe.XcParams{
+			Format:             "fmp4-segment",
+			StartTimeTs:        0,
+			DurationTs:         -1,
+			StartSegmentStr:    "1",
+			VideoBitrate:       height * 2000,
+			VideoSegDurationTs: 900000,
+			Ecodec:             h264Codec,
+			EncHeight:          height,
+			EncWidth:           height * 16 / 9,
+			XcType:             goavpipe.XcVideo,
+			StreamId:           -1,
+			Url:                renditionDir,
+			DebugFrameLevel:    debugFrameLevel,
+		}
+		setFastEncodeParams(params, false)
+		err := avpipe.RegisterUrlIOHandler(renditionDir, nil, &fileOutputOpener{t: t, dir: renditionDir})
+		failNowOnError(t, err)
+		renditions = append(renditions, params)
+	}
+
+	err := avpipe.XcMulti(renditions, url)
+	failNowOnError(t, err)
+
+	for i, params := range renditions {
+		probeInfo, err := avpipe.Probe(&goavpipe.XcParams{
+			Url:      fmt.Sprintf("%s/vsegment-1.mp4", params.Url),
+			Seekable: true,
+		})
+		failNowOnError(t, err)
+		assert.Equal(t, int(heights[i]), probeInfo.StreamInfo[0].Height)
+	}
+
+	// The renditions must transcode the same part of the input
+	renditions[1].DurationTs = 900000
+	for _, params := range renditions {
+		err = avpipe.RegisterUrlIOHandler(params.Url, nil, &fileOutputOpener{t: t, dir: params.Url})
+		failNowOnError(t, err)
+	}
+	err = avpipe.XcMulti(renditions, url)
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
+}
+
+func TestXcMultiSegDurations(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, url)
+
+	// One decode, 6 sec HLS and 4 sec DASH segments, with a key frame every 2 sec of the 30 fps input
+	groups := []struct {
+		format      string
+		height      int32
+		segDuration string
+		frames      int64
+		segments    int
+	}{
+		{"hls", 720, "6", 180, 10},
+		{"dash", 360, "4", 120, 15},
+	}
+	renditionsFor := func(segDurations ...string) []*goavpipe.XcParams {
+		var renditions []*goavpipe.XcParams
+		for i, g := range groups {
+			renditionDir := path.Join(outputDir, fmt.Sprintf("%s-%dp", g.format, g.height))
+			setupOutDir(t, renditionDir)
+
+			params := &goavpipe.XcParams{
+				Format:          g.format,
+				StartTimeTs:     0,
+				DurationTs:      -1,
+				StartSegmentStr: "1",
+				VideoBitrate:    g.height * 2000,
+				SegDuration:     segDurations[i],
+				ForceKeyInt:     60,
+				Ecodec:          h264Codec,
+				EncHeight:       g.height,
+				EncWidth:        g.height * 16 / 9,
+				XcType:          goavpipe.XcVideo,
+				StreamId:        -1,
+				Url:             renditionDir,
+				DebugFrameLevel: debugFrameLevel,
+			}
+			setFastEncodeParams(params, false)
+			err := avpipe.RegisterUrlIOHandler(renditionDir, nil, &fileOutputOpener{t: t, dir: renditionDir})
+			failNowOnError(t, err)
+			renditions = append(renditions, params)
+		}
+		return renditions
+	}
+
+	statsInfo = testStatsInfo{}
+	renditions := renditionsFor(groups[0].segDuration, groups[1].segDuration)
+	err := avpipe.XcMulti(renditions, url)
+	failNowOnError(t, err)
+
+	// Each group has the segments of its own duration: 10 HLS and 15 DASH segments of the 60 sec input
+	frames := map[int64]int{}
+	for _, seg := range statsInfo.videoSegmentStats {
+		frames[seg.Frames]++
+	}
+	for i, g := range groups {
+		segments, err := filepath.Glob(path.Join(renditions[i].Url, "vchunk-stream0-*.m4s"))
+		failNowOnError(t, err)
+		assert.InDelta(t, g.segments, len(segments), 1)
+		assert.GreaterOrEqual(t, frames[g.frames], g.segments-1)
+	}
+
+	// The segment duration must be a multiple of the key frame interval
+	err = avpipe.XcMulti(renditionsFor("6", "5"), url)
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
+
+	// The renditions of a format group must have the same segment duration
+	groups[1].format = "hls"
+	err = avpipe.XcMulti(renditionsFor("6", "4"), url)
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
+}
+
+func TestSettingProfileLevel(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, "")
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	params := &goavpipe.XcParams{
+		Format:             "fmp4-segment",
+		StartTimeTs:        0,
+		DurationTs:         -1,
+		StartSegmentStr:    "1",
+		VideoBitrate:       2560000,
+		AudioBitrate:       64000,
+		VideoSegDurationTs: 900000,
+		AudioSegDurationTs: 1428480,
+		Ecodec:             h264Codec,
+		EncHeight:          480,
+		EncWidth:           720,
+		XcType:             goavpipe.XcVideo,
+		StreamId:           -1,
+		Url:                url,
+		DebugFrameLevel:    debugFrameLevel,
+		Profile:            "high",
+		Level:              51,
+	}
+	setFastEncodeParams(params, false)
+
+	xcTestResult := &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+		level:    51,
+		profile:  "High",
+		pixelFmt: "yuv420p",
+	}
+	xcTest(t, outputDir, params, xcTestResult, true)
+}
+
+func TestStartTimeTsWithSkipDecoding(t *testing.T) {
+	url := "./media/video-960.mp4"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, "")
+
+	params := &goavpipe.XcParams{
+		BypassTranscoding:   false,
+		Format:              "dash",
+		StartTimeTs:         180000,
+		StartPts:            900000,
+		DurationTs:          720000,
 		StartSegmentStr:     "19",
 		VideoSegDurationTs:  60000,
 		SkipDecoding:        true,
 		StartFragmentIndex:  1081,
 		ForceKeyInt:         60,
-		SegDuration:         "30",
 		Ecodec:              h264Codec,
 		EncHeight:           -1,
 		EncWidth:            -1,
@@ -963,7 +1926,7 @@ func TestStartTimeTsWithSkipDecoding(t *testing.T) {
 		DebugFrameLevel:     debugFrameLevel,
 	}
 
-	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	require.NoError(t, avpipe.RegisterUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir}))
 	boilerXc(t, params)
 
 	files, err := ioutil.ReadDir(outputDir)
@@ -1000,7 +1963,6 @@ func TestStartTimeTsWithoutSkipDecoding(t *testing.T) {
 		SkipDecoding:        false,
 		StartFragmentIndex:  1081,
 		ForceKeyInt:         60,
-		SegDuration:         "30",
 		Ecodec:              h264Codec,
 		EncHeight:           -1,
 		EncWidth:            -1,
@@ -1011,7 +1973,7 @@ func TestStartTimeTsWithoutSkipDecoding(t *testing.T) {
 		DebugFrameLevel:     debugFrameLevel,
 	}
 
-	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	require.NoError(t, avpipe.RegisterUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir}))
 	boilerXc(t, params)
 
 	files, err := ioutil.ReadDir(outputDir)
@@ -1139,7 +2101,130 @@ func TestAudioAC3Ts2AACMezMaker(t *testing.T) {
 	xcTest(t, outputDir, params, xcTestResult, true)
 }
 
-func TestAudioMP3Ts2AACMezMaker(t *testing.T) {
+// Implements avpipe.InputOpener, counts the seeks of the input
+type seekCountingInputOpener struct {
+	t     *testing.T
+	seeks int
+}
+
+func (o *seekCountingInputOpener) Open(_ int64, url string) (avpipe.InputHandler, error) {
+	f, err := os.Open(url)
+	if err != nil {
+		return nil, err
+	}
+	return &seekCountingInput{fileInput: fileInput{t: o.t, file: f}, opener: o}, nil
+}
+
+type seekCountingInput struct {
+	fileInput
+	opener *seekCountingInputOpener
+}
+
+func (i *seekCountingInput) Seek(offset int64, whence int) (int64, error) {
+	i.opener.seeks++
+	return i.fileInput.Seek(offset, whence)
+}
+
+// A non seekable input (i.e. a live pipe) is read forward and never seeked
+func TestNonSeekableInput(t *testing.T) {
+	url := "./media/bbb_sunflower_2160p_30fps_normal_2min.ts"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec2:             "aac",
+		Dcodec2:             "ac3",
+		AudioBitrate:        128000,
+		SampleRate:          48000,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              goavpipe.XcAudio,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		Seekable:            false,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	params.AudioIndex = []int32{2}
+
+	setupOutDir(t, outputDir)
+	sio := &seekCountingInputOpener{t: t}
+	avpipe.InitIOHandler(sio, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+	assert.Equal(t, 0, sio.seeks)
+}
+
+// Implements avpipe.InputOpener, records the largest buffer of the reads of the input
+type readSizeInputOpener struct {
+	t       *testing.T
+	maxRead int
+}
+
+func (o *readSizeInputOpener) Open(_ int64, url string) (avpipe.InputHandler, error) {
+	f, err := os.Open(url)
+	if err != nil {
+		return nil, err
+	}
+	return &readSizeInput{fileInput: fileInput{t: o.t, file: f}, opener: o}, nil
+}
+
+type readSizeInput struct {
+	fileInput
+	opener *readSizeInputOpener
+}
+
+func (i *readSizeInput) Read(buf []byte) (int, error) {
+	if len(buf) > i.opener.maxRead {
+		i.opener.maxRead = len(buf)
+	}
+	return i.fileInput.Read(buf)
+}
+
+func TestIOBufferSize(t *testing.T) {
+	url := "./media/bbb_sunflower_2160p_30fps_normal_2min.ts"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec2:             "aac",
+		Dcodec2:             "ac3",
+		AudioBitrate:        128000,
+		SampleRate:          48000,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              goavpipe.XcAudio,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		IOBufferSize:        64 * 1024,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	params.AudioIndex = []int32{2}
+
+	setupOutDir(t, outputDir)
+	rio := &readSizeInputOpener{t: t}
+	avpipe.InitIOHandler(rio, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+	assert.Greater(t, rio.maxRead, 0)
+	assert.LessOrEqual(t, rio.maxRead, 64*1024)
+
+	params.IOBufferSize = -1
+	assert.ErrorIs(t, avpipe.Xc(params), avpipe.EAV_PARAM)
+}
+
+func TestAudioMP3Ts2AACMezMaker(t *testing.T) {
 	url := "./media/bbb_sunflower_2160p_30fps_normal_2min.ts"
 	if fileMissing(url, fn()) {
 		return
@@ -2015,6 +3100,78 @@ func TestProbeWithReadInputError(t *testing.T) {
 
 }
 
+// Implements avpipe.InputOpener, the input fails (or ends with io.EOF) once half of the file is read
+type halfFileInputOpener struct {
+	t      *testing.T
+	eofErr bool // End the input with io.EOF instead of failing
+}
+
+func (o *halfFileInputOpener) Open(_ int64, url string) (avpipe.InputHandler, error) {
+	f, err := os.Open(url)
+	if err != nil {
+		return nil, err
+	}
+	fi, err := f.Stat()
+	require.NoError(o.t, err)
+	return &halfFileInput{fileInput: fileInput{t: o.t, file: f}, limit: fi.Size() / 2, eofErr: o.eofErr}, nil
+}
+
+type halfFileInput struct {
+	fileInput
+	limit  int64
+	read   int64
+	eofErr bool
+}
+
+func (i *halfFileInput) Read(buf []byte) (int, error) {
+	if i.read >= i.limit {
+		if i.eofErr {
+			return 0, io.EOF
+		}
+		return 0, io.ErrUnexpectedEOF
+	}
+	n, err := i.fileInput.Read(buf)
+	i.read += int64(n)
+	return n, err
+}
+
+// An input read error aborts the transcoding with EAV_READ_INPUT, while io.EOF finalizes the output
+func TestReadInputErrorVsEOF(t *testing.T) {
+	url := "./media/Rigify-2min.mp4"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	for _, eofErr := range []bool{false, true} {
+		outputDir := path.Join(baseOutPath, fn(), fmt.Sprintf("eof-%v", eofErr))
+		params := &goavpipe.XcParams{
+			Format:              "fmp4-segment",
+			DurationTs:          -1,
+			StartSegmentStr:     "1",
+			SegDuration:         "30",
+			Ecodec:              h264Codec,
+			EncHeight:           360,
+			EncWidth:            640,
+			XcType:              goavpipe.XcVideo,
+			StreamId:            -1,
+			SyncAudioToStreamId: -1,
+			Url:                 url,
+			Seekable:            true,
+			DebugFrameLevel:     debugFrameLevel,
+		}
+		setFastEncodeParams(params, true)
+
+		setupOutDir(t, outputDir)
+		avpipe.InitIOHandler(&halfFileInputOpener{t: t, eofErr: eofErr}, &fileOutputOpener{dir: outputDir})
+		err := avpipe.Xc(params)
+		if eofErr {
+			assert.NoError(t, err)
+		} else {
+			assert.ErrorIs(t, err, avpipe.EAV_READ_INPUT)
+		}
+	}
+}
+
 func TestHEVC_H265ABRTranscode(t *testing.T) {
 	f := fn()
 	if testing.Short() {
@@ -2054,11 +3211,347 @@ func TestHEVC_H265ABRTranscode(t *testing.T) {
 	log.Debug("STARTING video ABR for", "file", url)
 	params.XcType = goavpipe.XcVideo
 	params.Format = "dash"
+	params.SegDuration = ""
 	params.VideoSegDurationTs = 48000
 	params.Url = url
-	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: videoABRDir})
+	require.NoError(t, avpipe.RegisterUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: videoABRDir}))
+	boilerXc(t, params)
+
+}
+
+func TestDecodeProgress(t *testing.T) {
+	url := "./media/Rigify-2min.mp4"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:                 "fmp4-segment",
+		DurationTs:             -1,
+		StartSegmentStr:        "1",
+		SegDuration:            "30",
+		Ecodec:                 h264Codec,
+		EncHeight:              360,
+		EncWidth:               640,
+		XcType:                 goavpipe.XcVideo,
+		StreamId:               -1,
+		SyncAudioToStreamId:    -1,
+		Url:                    url,
+		DebugFrameLevel:        debugFrameLevel,
+		DecodeProgressInterval: 100,
+	}
+	setFastEncodeParams(params, true)
+
+	setupOutDir(t, outputDir)
+	statsInfo = testStatsInfo{}
+	start := time.Now()
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+	elapsed := time.Since(start)
+
+	// Reports are bounded by the interval, no matter how fast the input is read
+	assert.Greater(t, statsInfo.decodeProgressReports, 0)
+	assert.LessOrEqual(t, statsInfo.decodeProgressReports, int(elapsed/(100*time.Millisecond)))
+	assert.Greater(t, statsInfo.decodeProgress.VideoFramesDecoded, int64(0))
+	assert.LessOrEqual(t, statsInfo.decodeProgress.VideoFramesDecoded, int64(2880))
+	assert.Greater(t, statsInfo.decodeProgress.InputPTS, int64(0))
+
+	params.DecodeProgressInterval = 10
+	err := avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+// TestSCTE35Stat transcodes a MPEG-TS input with a SCTE-35 splice_insert, which must reach the input
+// handler with the PTS it arrived at and the splice info section
+func TestSCTE35Stat(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	setupOutDir(t, outputDir)
+
+	srcUrl := path.Join(outputDir, "src.ts")
+	ffmpeg := exec.Command("ffmpeg", "-y", "-f", "lavfi", "-i", "testsrc2=size=320x240:rate=25", "-t", "4",
+		"-c:v", "libx264", "-g", "25", "-f", "mpegts", "-mpegts_pmt_start_pid", "0x1000", "-mpegts_start_pid", "0x100", srcUrl)
+	if err := ffmpeg.Run(); err != nil {
+		t.Skip("ffmpeg is needed to make the MPEG-TS source", err)
+	}
+	src, err := ioutil.ReadFile(srcUrl)
+	failNowOnError(t, err)
+	ts, pcr, section := withSCTE35SpliceInsert(t, src)
+	url := path.Join(outputDir, "scte35.ts")
+	failNowOnError(t, ioutil.WriteFile(url, ts, 0644))
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, true)
+
+	statsInfo = testStatsInfo{}
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	require.Equal(t, 1, len(statsInfo.scte35Events))
+	event := statsInfo.scte35Events[0]
+	assert.Equal(t, pcr, event.PTS)
+	assert.Equal(t, uint8(scte35.SpliceInsert), event.CommandType)
+	assert.Equal(t, section, event.Data)
+
+	// The section parses with a pointer field in front, as at the start of a TS packet payload
+	splice, err := scte35.NewSCTE35(append([]byte{0}, event.Data...))
+	failNowOnError(t, err)
+	assert.Equal(t, scte35.SpliceCommandType(scte35.SpliceInsert), splice.Command())
+	assert.Equal(t, gots.PTS(pcr+2*90000), splice.PTS())
+	insert := splice.CommandInfo().(scte35.SpliceInsertCommand)
+	assert.True(t, insert.IsOut())
+	assert.Equal(t, uint32(1), insert.EventID())
+	assert.Equal(t, gots.PTS(30*90000), insert.Duration())
+}
+
+const scte35Pid = 0x1f0
+
+// withSCTE35SpliceInsert returns the MPEG-TS stream ts, made by ffmpeg with its PMT on PID 0x1000, with a
+// SCTE-35 stream added to the program and a splice_insert 2 sec ahead inserted after the first PCR one
+// second into the stream. It returns the PCR before the splice_insert (90 kHz) and its section.
+func withSCTE35SpliceInsert(t *testing.T, ts []byte) (out []byte, pcr int64, section []byte) {
+	require.Equal(t, 0, len(ts)%188)
+	firstPcr := int64(-1)
+	for i := 0; i < len(ts); i += 188 {
+		pkt := append([]byte{}, ts[i:i+188]...)
+		pid := int(pkt[1]&0x1f)<<8 | int(pkt[2])
+		payload := 4
+		if pkt[3]&0x20 != 0 {
+			payload += 1 + int(pkt[4])
+		}
+
+		if pid == 0x1000 && pkt[1]&0x40 != 0 {
+			// Add the CUEI registration descriptor, which ffmpeg needs to recognize SCTE-35, and the stream
+			pmt := pkt[payload+1+int(pkt[payload]):]
+			pmt = pmt[:3+(int(pmt[1]&0x0f)<<8|int(pmt[2]))-4]
+			programInfoLen := int(pmt[10]&0x0f)<<8 | int(pmt[11])
+			newPmt := append([]byte{}, pmt[:10]...)
+			newPmt = append(newPmt, 0xf0|byte((programInfoLen+6)>>8), byte(programInfoLen+6))
+			newPmt = append(newPmt, pmt[12:12+programInfoLen]...)
+			newPmt = append(newPmt, 0x05, 0x04, 'C', 'U', 'E', 'I')
+			newPmt = append(newPmt, pmt[12+programInfoLen:]...)
+			newPmt = append(newPmt, 0x86, 0xe0|byte(scte35Pid>>8), byte(scte35Pid&0xff), 0xf0, 0x00)
+			sectionLen := len(newPmt) + 4 - 3
+			newPmt[1] = newPmt[1]&0xf0 | byte(sectionLen>>8)
+			newPmt[2] = byte(sectionLen)
+			newPmt = append(newPmt, gots.ComputeCRC(newPmt)...)
+			pkt[payload] = 0
+			n := copy(pkt[payload+1:], newPmt)
+			require.Equal(t, len(newPmt), n)
+			for j := payload + 1 + n; j < 188; j++ {
+				pkt[j] = 0xff
+			}
+		}
+		out = append(out, pkt...)
+
+		if section != nil || pkt[3]&0x20 == 0 || pkt[4] < 7 || pkt[5]&0x10 == 0 {
+			continue
+		}
+		// PCR base, in 90 kHz
+		base := int64(pkt[6])<<25 | int64(pkt[7])<<17 | int64(pkt[8])<<9 | int64(pkt[9])<<1 | int64(pkt[10])>>7
+		if firstPcr < 0 {
+			firstPcr = base
+		} else if base >= firstPcr+90000 {
+			pcr = base
+			section = spliceInsertSection(1, pcr+2*90000)
+			scte := bytes.Repeat([]byte{0xff}, 188)
+			scte[0], scte[1], scte[2], scte[3] = 0x47, 0x40|byte(scte35Pid>>8), byte(scte35Pid&0xff), 0x10
+			scte[4] = 0 // Pointer field
+			copy(scte[5:], section)
+			out = append(out, scte...)
+		}
+	}
+	require.NotNil(t, section)
+	return
+}
+
+// spliceInsertSection returns a SCTE-35 splice info section with the splice_insert of the event going out
+// of network at ptsTime (90 kHz) for 30 sec
+func spliceInsertSection(eventID uint32, ptsTime int64) []byte {
+	command := make([]byte, 20)
+	binary.BigEndian.PutUint32(command[0:], eventID)
+	command[4] = 0x7f // Not cancelled
+	command[5] = 0xef // Out of network, program splice, with a duration, not immediate
+	command[6] = 0xfe | byte(ptsTime>>32&1)
+	binary.BigEndian.PutUint32(command[7:], uint32(ptsTime))
+	duration := int64(30 * 90000)
+	command[11] = 0xfe | byte(duration>>32&1) // Auto return
+	binary.BigEndian.PutUint32(command[12:], uint32(duration))
+	// unique_program_id, avail_num and avails_expected are 0
+
+	section := []byte{
+		0xfc, 0x30, 0x00, // table_id, section_length set below
+		0x00,                         // protocol_version
+		0x00, 0x00, 0x00, 0x00, 0x00, // Not encrypted, pts_adjustment 0
+		0x00,                           // cw_index
+		0xff, 0xf0, byte(len(command)), // tier, splice_command_length
+		scte35.SpliceInsert,
+	}
+	section = append(section, command...)
+	section = append(section, 0x00, 0x00) // descriptor_loop_length
+	section[2] = byte(len(section) + 4 - 3)
+	return append(section, gots.ComputeCRC(section)...)
+}
+
+func TestXcTiming(t *testing.T) {
+	url := "./media/Rigify-2min.mp4"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, true)
+
+	setupOutDir(t, outputDir)
+	statsInfo = testStatsInfo{}
+	start := time.Now()
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+	elapsed := time.Since(start)
+
+	timing := statsInfo.xcTiming
+	require.NotNil(t, timing)
+	assert.Greater(t, timing.DecodeNs, int64(0))
+	assert.Greater(t, timing.FilterNs, int64(0))
+	assert.Greater(t, timing.EncodeNs, int64(0))
+	assert.Greater(t, timing.MuxNs, int64(0))
+	assert.Greater(t, timing.TotalNs, int64(0))
+	assert.LessOrEqual(t, timing.TotalNs, elapsed.Nanoseconds())
+}
+
+// Reports the frames written to the output with FrameCallback, the video frames of libx264 have a QP
+func TestFrameCallback(t *testing.T) {
+	url := "./media/Rigify-2min.mp4"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	var mutex sync.Mutex
+	var frames []goavpipe.FrameDebugInfo
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+		FrameCallback: func(f goavpipe.FrameDebugInfo) {
+			mutex.Lock()
+			defer mutex.Unlock()
+			frames = append(frames, f)
+		},
+	}
+	setFastEncodeParams(params, true)
+
+	setupOutDir(t, outputDir)
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	require.NotEmpty(t, frames)
+	keyFrames := 0
+	for i, f := range frames {
+		assert.False(t, f.IsAudio)
+		assert.Greater(t, f.Size, 0)
+		assert.GreaterOrEqual(t, f.Quantizer, 0)
+		if i > 0 {
+			assert.Greater(t, f.DTS, frames[i-1].DTS)
+		}
+		if f.KeyFrame {
+			keyFrames++
+		}
+	}
+	// A key frame at the start of each 30 sec segment
+	assert.GreaterOrEqual(t, keyFrames, 4)
+}
+
+func TestRateControl(t *testing.T) {
+	url := "./media/Rigify-2min.mp4"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+		RateControl:         "cbr",
+		VideoBitrate:        500000,
+	}
+	setFastEncodeParams(params, true)
+
+	setupOutDir(t, outputDir)
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	params.RateControl = "cvbr"
+	params.VideoBitrate = -1
+	params.RcMaxRate = 1000000
 	boilerXc(t, params)
 
+	// Params that conflict with the rate control mode
+	for _, p := range []struct {
+		rateControl  string
+		videoBitrate int32
+		rcMaxRate    int32
+	}{
+		{"cbr", -1, 0},
+		{"cbr", 500000, 1000000},
+		{"vbr", 500000, 250000},
+		{"crf", -1, 1000000},
+		{"cvbr", -1, 0},
+		{"cvbr", 500000, 1000000},
+		{"abr", 500000, 0},
+	} {
+		params.RateControl = p.rateControl
+		params.VideoBitrate = p.videoBitrate
+		params.RcMaxRate = p.rcMaxRate
+		err := avpipe.Xc(params)
+		assert.Error(t, err, p.rateControl)
+	}
 }
 
 func TestAVPipeStats(t *testing.T) {
@@ -2099,6 +3592,7 @@ func TestAVPipeStats(t *testing.T) {
 		xcTestResult.mezFile = append(xcTestResult.mezFile, fmt.Sprintf("%s/vsegment-%d.mp4", outputDir, i))
 	}
 
+	statsInfo = testStatsInfo{}
 	xcTest(t, outputDir, params, xcTestResult, true)
 
 	assert.Equal(t, int64(2880), statsInfo.encodingVideoFrameStats.TotalFramesWritten)
@@ -2109,22 +3603,191 @@ func TestAVPipeStats(t *testing.T) {
 	//assert.Equal(t, int64(1406), statsInfo.encodingAudioFrameStats.FramesWritten)
 	assert.Equal(t, uint64(5625), statsInfo.audioFramesRead)
 	assert.Equal(t, uint64(2880), statsInfo.videoFramesRead)
+
+	// Each segment is reported once it is complete, and the segments cover the whole output
+	checkSegmentStats := func(segments []avpipe.SegmentStats, totalFrames int64, mezPrefix string) {
+		var frames int64
+		for i, s := range segments {
+			assert.Equal(t, i+1, s.SegIndex)
+			assert.Greater(t, s.Frames, int64(0))
+			assert.Greater(t, s.EndPTS, s.StartPTS)
+			if i > 0 {
+				assert.Equal(t, segments[i-1].EndPTS, s.StartPTS)
+			}
+			if len(mezPrefix) > 0 {
+				fi, err := os.Stat(fmt.Sprintf("%s/%s%d.mp4", outputDir, mezPrefix, s.SegIndex))
+				if assert.NoError(t, err) {
+					assert.Equal(t, fi.Size(), s.Bytes)
+				}
+			}
+			frames += s.Frames
+		}
+		assert.Equal(t, totalFrames, frames)
+	}
+	assert.Equal(t, 4, len(statsInfo.videoSegmentStats))
+	checkSegmentStats(statsInfo.videoSegmentStats, 2880, "vsegment-")
+	checkSegmentStats(statsInfo.audioSegmentStats, 5625, "")
 }
 
-// This unit test is almost a complete test for mez, abr, muxing and probing. It does:
-// 1) Creates audio and video mez files
-// 2) Creates ABR segments using audio and video mez files in step 1
-// 3) Mux the ABR audio and video segments from step 2
-// 4) Probes the initial mez file from step 1 and mux output from step 3. The duration has to be equal.
-func TestABRMuxing(t *testing.T) {
-	f := fn()
-	log.Info("STARTING " + f)
-	url := "./media/TOS8_FHD_51-2_PRHQ_60s_CCBYblendercloud.mov"
+// Reading a file is much faster than encoding it, which simulates a transcoder that can't keep up
+// with a live input. With a small drop threshold frames must be dropped instead of queueing up.
+func TestLiveDropPolicy(t *testing.T) {
+	url := videoBigBuckBunnyPath
 	if fileMissing(url, fn()) {
 		return
 	}
 
-	videoMezDir := path.Join(baseOutPath, f, "VideoMez4Muxing")
+	outputDir := path.Join(baseOutPath, fn())
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           720,
+		EncWidth:            1280,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		LiveDropThreshold:   4,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+
+	statsInfo = testStatsInfo{}
+	xcTest(t, outputDir, params, nil, true)
+
+	assert.Greater(t, statsInfo.videoFramesDropped, uint64(0))
+	assert.Equal(t, uint64(1800), statsInfo.videoFramesRead)
+	assert.Less(t, statsInfo.encodingVideoFrameStats.TotalFramesWritten, int64(statsInfo.videoFramesRead))
+}
+
+func TestExtractThumbnails(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+
+	params := &goavpipe.XcParams{
+		Format:               "fmp4-segment",
+		DurationTs:           -1,
+		StartSegmentStr:      "1",
+		SegDuration:          "30",
+		Ecodec:               h264Codec,
+		EncHeight:            720,
+		EncWidth:             1280,
+		XcType:               goavpipe.XcVideo,
+		StreamId:             -1,
+		SyncAudioToStreamId:  -1,
+		ExtractThumbnails:    true,
+		ThumbnailIntervalSec: 10,
+		ThumbnailWidth:       320,
+		Url:                  url,
+		DebugFrameLevel:      debugFrameLevel,
+	}
+
+	xcTest(t, outputDir, params, nil, true)
+
+	files, err := ioutil.ReadDir(outputDir)
+	failNowOnError(t, err)
+	var timestamps []int
+	for _, f := range files {
+		if !strings.HasPrefix(f.Name(), "thumbnail-") {
+			continue
+		}
+		ts, err2 := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(f.Name(), "thumbnail-"), ".jpeg"))
+		assert.NoError(t, err2)
+		assert.Equal(t, 0, ts%10000)
+		timestamps = append(timestamps, ts)
+	}
+	// One thumbnail every 10 sec of the 60 sec input
+	assert.Equal(t, 6, len(timestamps))
+}
+
+// Transcodes video and audio from separate sources with the same OutputBasePts and checks
+// that both outputs start at the same point of the common timeline.
+func TestOutputBasePts(t *testing.T) {
+	videoUrl := videoBigBuckBunnyPath
+	if fileMissing(videoUrl, fn()) {
+		return
+	}
+	audioUrl := "./media/bbb-audio-stereo-2min.aac"
+	if fileMissing(audioUrl, fn()) {
+		return
+	}
+
+	const basePts = 10 * 1000000 // 10 sec in microseconds
+	videoDir := path.Join(baseOutPath, fn(), "video")
+	audioDir := path.Join(baseOutPath, fn(), "audio")
+
+	videoParams := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           720,
+		EncWidth:            1280,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		OutputBasePts:       basePts,
+		Url:                 videoUrl,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(videoParams, false)
+	xcTest(t, videoDir, videoParams, nil, true)
+
+	audioParams := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec2:             "aac",
+		AudioBitrate:        128000,
+		SampleRate:          48000,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              goavpipe.XcAudio,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		OutputBasePts:       basePts,
+		Url:                 audioUrl,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	xcTest(t, audioDir, audioParams, nil, true)
+
+	startTime := func(mezFile string) float64 {
+		probeInfo := boilerProbe(t, &XcTestResult{mezFile: []string{mezFile}})
+		si := probeInfo[0].StreamInfo[0]
+		start, _ := new(big.Rat).Mul(big.NewRat(si.StartTime, 1), si.TimeBase).Float64()
+		return start
+	}
+
+	videoStart := startTime(fmt.Sprintf("%s/vsegment-1.mp4", videoDir))
+	audioStart := startTime(fmt.Sprintf("%s/asegment0-1.mp4", audioDir))
+	assert.InDelta(t, 10.0, videoStart, 0.05)
+	assert.InDelta(t, 10.0, audioStart, 0.05)
+	assert.InDelta(t, videoStart, audioStart, 0.05)
+}
+
+// This unit test is almost a complete test for mez, abr, muxing and probing. It does:
+// 1) Creates audio and video mez files
+// 2) Creates ABR segments using audio and video mez files in step 1
+// 3) Mux the ABR audio and video segments from step 2
+// 4) Probes the initial mez file from step 1 and mux output from step 3. The duration has to be equal.
+func TestABRMuxing(t *testing.T) {
+	f := fn()
+	log.Info("STARTING " + f)
+	url := "./media/TOS8_FHD_51-2_PRHQ_60s_CCBYblendercloud.mov"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	videoMezDir := path.Join(baseOutPath, f, "VideoMez4Muxing")
 	audioMezDir := path.Join(baseOutPath, f, "AudioMez4Muxing")
 	videoABRDir := path.Join(baseOutPath, f, "VideoABR4Muxing")
 	videoABRDir2 := path.Join(baseOutPath, f, "VideoABR4Mugooglexing2")
@@ -2155,7 +3818,7 @@ func TestABRMuxing(t *testing.T) {
 		ForceKeyInt:        48,
 	}
 	setFastEncodeParams(params, false)
-	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: videoMezDir})
+	require.NoError(t, avpipe.RegisterUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: videoMezDir}))
 	boilerXc(t, params)
 
 	log.Debug("STARTING audio mez for muxing", "file", url)
@@ -2164,7 +3827,7 @@ func TestABRMuxing(t *testing.T) {
 	params.XcType = goavpipe.XcAudio
 	params.Ecodec2 = "aac"
 	params.ChannelLayout = avpipe.ChannelLayout("stereo")
-	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: audioMezDir})
+	require.NoError(t, avpipe.RegisterUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: audioMezDir}))
 	boilerXc(t, params)
 
 	// Create video ABR files for the first mez segment
@@ -2175,7 +3838,7 @@ func TestABRMuxing(t *testing.T) {
 	params.Format = "dash"
 	params.VideoSegDurationTs = 48000
 	params.Url = url
-	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: videoABRDir})
+	require.NoError(t, avpipe.RegisterUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: videoABRDir}))
 	boilerXc(t, params)
 
 	// Create video ABR files for the second mez segment
@@ -2188,7 +3851,7 @@ func TestABRMuxing(t *testing.T) {
 	params.Url = url
 	params.StartSegmentStr = "16"
 	params.StartPts = 721720
-	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: videoABRDir2})
+	require.NoError(t, avpipe.RegisterUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: videoABRDir2}))
 	boilerXc(t, params)
 
 	// Create audio ABR files for the first mez segment
@@ -2202,7 +3865,7 @@ func TestABRMuxing(t *testing.T) {
 	params.Url = url
 	params.StartSegmentStr = "1"
 	params.StartPts = 0
-	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: audioABRDir})
+	require.NoError(t, avpipe.RegisterUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: audioABRDir}))
 	boilerXc(t, params)
 
 	// Create audio ABR files for the second mez segment
@@ -2216,7 +3879,7 @@ func TestABRMuxing(t *testing.T) {
 	params.Url = url
 	params.StartPts = 1441792
 	params.StartSegmentStr = "16"
-	avpipe.InitUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: audioABRDir2})
+	require.NoError(t, avpipe.RegisterUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: audioABRDir2}))
 	boilerXc(t, params)
 
 	// Create playable file by muxing audio/video segments
@@ -2241,7 +3904,7 @@ func TestABRMuxing(t *testing.T) {
 	params.MuxingSpec = muxSpec
 	log.Debug(f, "muxSpec", string(muxSpec))
 
-	avpipe.InitUrlMuxIOHandler(url, &cmd.AVCmdMuxInputOpener{URL: url}, &cmd.AVCmdMuxOutputOpener{})
+	require.NoError(t, avpipe.RegisterUrlMuxIOHandler(url, &cmd.AVCmdMuxInputOpener{URL: url}, &cmd.AVCmdMuxOutputOpener{}))
 	params.Url = url
 	err := avpipe.Mux(params)
 	failNowOnError(t, err)
@@ -2318,6 +3981,41 @@ func TestUnmarshalParamsNumAudioBackwardsCompat(t *testing.T) {
 	assert.Equal(t, len(params.AudioIndex), 8)
 }
 
+func TestUnmarshalParamsDeinterlace(t *testing.T) {
+	tests := []struct {
+		json        string
+		deinterlace int
+		auto        bool
+		wantErr     bool
+	}{
+		{json: `{}`, deinterlace: goavpipe.DeinterlaceNone},
+		{json: `{"deinterlace":null}`, deinterlace: goavpipe.DeinterlaceNone},
+		{json: `{"deinterlace":1}`, deinterlace: goavpipe.DeinterlaceBwdif},
+		{json: `{"deinterlace":4,"deinterlace_auto":true}`, deinterlace: goavpipe.DeinterlaceYadifFrame, auto: true},
+		{json: `{"deinterlace":"none"}`, deinterlace: goavpipe.DeinterlaceNone},
+		{json: `{"deinterlace":"bwdif"}`, deinterlace: goavpipe.DeinterlaceBwdifFrame},
+		{json: `{"deinterlace":"yadif"}`, deinterlace: goavpipe.DeinterlaceYadifFrame},
+		{json: `{"deinterlace":"bwdif","deinterlace_auto":true}`, deinterlace: goavpipe.DeinterlaceBwdifFrame, auto: true},
+		{json: `{"deinterlace":"auto"}`, deinterlace: goavpipe.DeinterlaceBwdifFrame, auto: true},
+		{json: `{"deinterlace":"w3fdif"}`, wantErr: true},
+		{json: `{"deinterlace":true}`, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.json, func(t *testing.T) {
+			var params goavpipe.XcParams
+			err := json.Unmarshal([]byte(tt.json), &params)
+			if tt.wantErr {
+				assert.Error(t, err)
+				return
+			}
+			assert.NoError(t, err)
+			assert.Equal(t, tt.deinterlace, params.Deinterlace)
+			assert.Equal(t, tt.auto, params.DeinterlaceAuto)
+		})
+	}
+}
+
 func TestProbe(t *testing.T) {
 	url := videoBigBuckBunnyPath
 	if fileMissing(url, fn()) {
@@ -2342,6 +4040,10 @@ func TestProbe(t *testing.T) {
 	assert.Equal(t, int64(3081772), probe.StreamInfo[0].BitRate)
 	assert.Equal(t, 1920, probe.StreamInfo[0].Width)
 	assert.Equal(t, 1080, probe.StreamInfo[0].Height)
+	assert.Equal(t, 8, probe.StreamInfo[0].BitsPerRawSample)
+	assert.True(t, probe.StreamInfo[0].Disposition["default"])
+	assert.False(t, probe.StreamInfo[0].Disposition["attached_pic"])
+	assert.False(t, probe.StreamInfo[0].IsVFR)
 	assert.Equal(t, int64(30000), probe.StreamInfo[0].TimeBase.Denom().Int64())
 
 	assert.Equal(t, 86017, probe.StreamInfo[1].CodecID)
@@ -2375,6 +4077,195 @@ func TestProbe(t *testing.T) {
 	assert.Equal(t, "ac3", a[2].CodecName)
 }
 
+// Implements avpipe.InputOpener, counts the bytes read from the inputs it opens
+type countingInputOpener struct {
+	t         *testing.T
+	bytesRead int64
+}
+
+func (o *countingInputOpener) Open(_ int64, url string) (avpipe.InputHandler, error) {
+	f, err := os.Open(url)
+	if err != nil {
+		return nil, err
+	}
+	return &countingInput{fileInput: fileInput{t: o.t, file: f}, opener: o}, nil
+}
+
+type countingInput struct {
+	fileInput
+	opener *countingInputOpener
+}
+
+func (i *countingInput) Read(buf []byte) (int, error) {
+	n, err := i.fileInput.Read(buf)
+	if n > 0 {
+		i.opener.bytesRead += int64(n)
+	}
+	return n, err
+}
+
+func TestProbeHeader(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	headerOpener := &countingInputOpener{t: t}
+	avpipe.InitIOHandler(headerOpener, &concurrentOutputOpener{dir: "O"})
+	info, err := avpipe.ProbeHeader(url)
+	failNowOnError(t, err)
+
+	probeOpener := &countingInputOpener{t: t}
+	avpipe.InitIOHandler(probeOpener, &concurrentOutputOpener{dir: "O"})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: url, Seekable: true})
+	failNowOnError(t, err)
+
+	assert.Equal(t, probe.ContainerInfo.FormatName, info.FormatName)
+	assert.InDelta(t, probe.ContainerInfo.Duration, info.Duration, 0.1)
+	assert.Greater(t, info.BitRate, int64(0))
+	assert.InEpsilon(t, float64(probe.ContainerInfo.BitRate), float64(info.BitRate), 0.01)
+	assert.False(t, info.IsImage)
+	assert.Less(t, headerOpener.bytesRead, probeOpener.bytesRead)
+
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: url, errorOnOpenInput: true}, &concurrentOutputOpener{dir: "O"})
+	_, err = avpipe.ProbeHeader(url)
+	assert.ErrorIs(t, err, avpipe.EAV_OPEN_INPUT)
+}
+
+func TestProbeErrors(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url, errorOnOpenInput: true}, &concurrentOutputOpener{dir: "O"})
+	_, err := avpipe.Probe(&goavpipe.XcParams{Url: url, Seekable: true})
+	assert.ErrorIs(t, err, avpipe.EAV_OPEN_INPUT)
+	assert.Contains(t, err.Error(), url)
+
+	// Not a media file
+	url = "./go.mod"
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
+	_, err = avpipe.Probe(&goavpipe.XcParams{Url: url, Seekable: true})
+	assert.ErrorIs(t, err, avpipe.EAV_UNSUPPORTED_FORMAT)
+	assert.Contains(t, err.Error(), url)
+}
+
+func TestProbeImage(t *testing.T) {
+	url := "./media/avpipe.png"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
+	xcparams := &goavpipe.XcParams{
+		Url:      url,
+		Seekable: true,
+	}
+	probe, err := avpipe.Probe(xcparams)
+	failNowOnError(t, err)
+	assert.Equal(t, 1, len(probe.StreamInfo))
+	assert.Equal(t, true, probe.ContainerInfo.IsImage)
+
+	assert.Equal(t, "video", probe.StreamInfo[0].CodecType)
+	assert.Equal(t, "png", probe.StreamInfo[0].CodecName)
+	assert.Equal(t, int64(1), probe.StreamInfo[0].NBFrames)
+	assert.Greater(t, probe.StreamInfo[0].Width, 0)
+	assert.Greater(t, probe.StreamInfo[0].Height, 0)
+	assert.NotEqual(t, -1, probe.StreamInfo[0].PixFmt) // AV_PIX_FMT_NONE
+}
+
+func TestProbeJSON(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
+	b, err := avpipe.ProbeJSON(url, true)
+	failNowOnError(t, err)
+
+	// Parse generically, the same way ffprobe JSON parsers do
+	var probe map[string]interface{}
+	failNowOnError(t, json.Unmarshal(b, &probe))
+
+	streams, ok := probe["streams"].([]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, 3, len(streams))
+	video := streams[0].(map[string]interface{})
+	assert.Equal(t, "video", video["codec_type"])
+	assert.Equal(t, "h264", video["codec_name"])
+	assert.Equal(t, "30/1", video["r_frame_rate"])
+	assert.Equal(t, "1/30000", video["time_base"])
+	assert.Equal(t, float64(1980), video["start_pts"])
+	assert.Equal(t, "0.066000", video["start_time"])
+	assert.Equal(t, "1800", video["nb_frames"])
+	assert.Equal(t, "High", video["profile"])
+	audio := streams[2].(map[string]interface{})
+	assert.Equal(t, "audio", audio["codec_type"])
+	assert.Equal(t, "48000", audio["sample_rate"])
+	assert.Equal(t, "5.1(side)", audio["channel_layout"])
+
+	format, ok := probe["format"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, url, format["filename"])
+	assert.Equal(t, float64(3), format["nb_streams"])
+	duration, err := strconv.ParseFloat(format["duration"].(string), 64)
+	assert.NoError(t, err)
+	assert.InDelta(t, 60.0, duration, 0.1)
+}
+
+func TestProbeTags(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
+	xcparams := &goavpipe.XcParams{
+		Url:      url,
+		Seekable: true,
+	}
+	probe, err := avpipe.Probe(xcparams)
+	failNowOnError(t, err)
+
+	// The mp4 demuxer always sets the brand of the container and the language of each track
+	assert.NotEmpty(t, probe.ContainerInfo.Tags["major_brand"])
+	for _, si := range probe.StreamInfo {
+		assert.NotEmpty(t, si.Tags["language"], "stream %d", si.StreamIndex)
+	}
+}
+
+func TestProbeFrames(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
+	frames, err := avpipe.ProbeFrames(url, true, 0, 60)
+	failNowOnError(t, err)
+	assert.Equal(t, 60, len(frames))
+
+	assert.Equal(t, true, frames[0].KeyFrame)
+	assert.Equal(t, "I", frames[0].PictType)
+	for i, f := range frames {
+		assert.Greater(t, f.PacketSize, 0)
+		if i > 0 {
+			assert.Greater(t, f.Pts, frames[i-1].Pts)
+		}
+	}
+
+	_, err = avpipe.ProbeFrames(url, true, 10, 0)
+	assert.ErrorIs(t, err, avpipe.EAV_STREAM_INDEX)
+	assert.Contains(t, err.Error(), url)
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url, errorOnOpenInput: true}, &concurrentOutputOpener{dir: "O"})
+	_, err = avpipe.ProbeFrames(url, true, 0, 60)
+	assert.ErrorIs(t, err, avpipe.EAV_OPEN_INPUT)
+	assert.Contains(t, err.Error(), url)
+}
+
 func TestProbeWithData(t *testing.T) {
 	url := "./media/TOS8_FHD_51-2_PRHQ_60s_CCBYblendercloud.mov"
 	if fileMissing(url, fn()) {
@@ -2538,152 +4429,2661 @@ func TestExtractImagesList(t *testing.T) {
 	assert.Equal(t, 1980+2980+72980+169980+339980, sum)
 }
 
-// Should exit after extracting the first frame
-func TestExtractImagesListFast(t *testing.T) {
-	url := videoBigBuckBunnyPath
-	if fileMissing(url, fn()) {
-		return
+// TestSubtitleWebVTT extracts the subtitles of a SRT input into WebVTT segments
+func TestSubtitleWebVTT(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	setupOutDir(t, outputDir)
+
+	// The first two cues are in the first 2 sec segment, then one cue per segment
+	url := path.Join(outputDir, "input.srt")
+	srt := "1\n00:00:00,000 --> 00:00:00,800\ncue 1\n\n" +
+		"2\n00:00:01,000 --> 00:00:01,800\ncue 2\n\n" +
+		"3\n00:00:02,500 --> 00:00:03,500\ncue 3\n\n" +
+		"4\n00:00:04,500 --> 00:00:05,500\ncue 4\n\n" +
+		"5\n00:00:06,500 --> 00:00:07,500\ncue 5\n"
+	failNowOnError(t, ioutil.WriteFile(url, []byte(srt), 0644))
+
+	params := &goavpipe.XcParams{
+		Format:          "segment",
+		DurationTs:      -1,
+		StartSegmentStr: "1",
+		SegDuration:     "2",
+		XcType:          goavpipe.XcSubtitle,
+		StreamId:        -1,
+		SubtitleIndex:   -1,
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
 	}
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: url}, &fileOutputOpener{t: t, dir: outputDir})
+	failNowOnError(t, avpipe.Xc(params))
 
-	outPath := path.Join(baseOutPath, fn())
+	init, err := ioutil.ReadFile(path.Join(outputDir, "vttinit-stream.vtt"))
+	failNowOnError(t, err)
+	assert.True(t, strings.HasPrefix(string(init), "WEBVTT"))
+
+	expected := [][]string{{"cue 1", "cue 2"}, {"cue 3"}, {"cue 4"}, {"cue 5"}}
+	for i, texts := range expected {
+		segment, err := ioutil.ReadFile(path.Join(outputDir, fmt.Sprintf("vttsegment-%d.vtt", i+1)))
+		failNowOnError(t, err)
+		cues := parseWebVTTCues(t, string(segment))
+		if assert.Len(t, cues, len(texts), "segment %d", i+1) {
+			for j, cue := range cues {
+				assert.Equal(t, texts[j], cue.text, "segment %d", i+1)
+				duration := 800 * time.Millisecond
+				if i > 0 {
+					duration = time.Second
+				}
+				assert.InDelta(t, duration, cue.end-cue.start, float64(time.Millisecond), "segment %d", i+1)
+			}
+		}
+	}
+	assert.False(t, fileExist(path.Join(outputDir, fmt.Sprintf("vttsegment-%d.vtt", len(expected)+1))))
+}
+
+type webVTTCue struct {
+	start, end time.Duration
+	text       string
+}
+
+var webVTTTiming = regexp.MustCompile(`^(?:(\d+):)?(\d{2}):(\d{2})\.(\d{3}) --> (?:(\d+):)?(\d{2}):(\d{2})\.(\d{3})`)
+
+// parseWebVTTCues parses the cues of a WebVTT segment (with or without the WEBVTT header), the test fails
+// if a cue is not valid
+func parseWebVTTCues(t *testing.T, data string) (cues []webVTTCue) {
+	duration := func(m []string) time.Duration {
+		var v [4]int
+		for i, s := range m {
+			if s != "" {
+				v[i], _ = strconv.Atoi(s)
+			}
+		}
+		return time.Duration(v[0])*time.Hour + time.Duration(v[1])*time.Minute +
+			time.Duration(v[2])*time.Second + time.Duration(v[3])*time.Millisecond
+	}
+
+	for _, block := range strings.Split(strings.ReplaceAll(data, "\r\n", "\n"), "\n\n") {
+		lines := strings.Split(strings.Trim(block, "\n"), "\n")
+		if lines[0] == "" || strings.HasPrefix(lines[0], "WEBVTT") {
+			continue
+		}
+		// The cue identifier is optional
+		if !webVTTTiming.MatchString(lines[0]) && len(lines) > 1 {
+			lines = lines[1:]
+		}
+		m := webVTTTiming.FindStringSubmatch(lines[0])
+		if !assert.NotNil(t, m, "invalid cue timing %q", lines[0]) ||
+			!assert.Greater(t, len(lines), 1, "cue without text %q", block) {
+			continue
+		}
+		cue := webVTTCue{start: duration(m[1:5]), end: duration(m[5:9]), text: strings.Join(lines[1:], "\n")}
+		assert.Less(t, cue.start, cue.end, "cue %q", block)
+		cues = append(cues, cue)
+	}
+	return
+}
+
+// Writes a 3D cube LUT that inverts the colors
+func writeInvertCubeLut(t *testing.T, filename string) {
+	var sb strings.Builder
+	sb.WriteString("TITLE \"invert\"\nLUT_3D_SIZE 2\n")
+	for b := 0; b < 2; b++ {
+		for g := 0; g < 2; g++ {
+			for r := 0; r < 2; r++ {
+				sb.WriteString(fmt.Sprintf("%d %d %d\n", 1-r, 1-g, 1-b))
+			}
+		}
+	}
+	failNowOnError(t, ioutil.WriteFile(filename, []byte(sb.String()), 0644))
+}
 
+// extractImage extracts the frame at pts 1980 of the big buck bunny video, setParams (if not nil) sets the
+// params of the filters to test
+func extractImage(t *testing.T, outPath string, setParams func(params *goavpipe.XcParams)) image.Image {
 	params := &goavpipe.XcParams{
 		Format:                 "image2",
-		AudioBitrate:           128000,
-		AudioSegDurationTs:     -1,
-		BitDepth:               8,
-		CrfStr:                 "23",
 		DurationTs:             -1,
 		Ecodec:                 "mjpeg",
-		Ecodec2:                "aac",
 		EncHeight:              -1,
 		EncWidth:               -1,
 		ExtractImageIntervalTs: -1,
-		GPUIndex:               -1,
-		SampleRate:             -1,
 		SegDuration:            "30",
-		StartFragmentIndex:     1,
 		StartSegmentStr:        "1",
 		StreamId:               -1,
 		SyncAudioToStreamId:    -1,
 		VideoBitrate:           -1,
 		VideoSegDurationTs:     -1,
 		XcType:                 goavpipe.XcExtractImages,
-		Url:                    url,
+		Url:                    videoBigBuckBunnyPath,
 		DebugFrameLevel:        debugFrameLevel,
 	}
 	params.ExtractImagesTs = []int64{1980}
+	if setParams != nil {
+		setParams(params)
+	}
 	setFastEncodeParams(params, true)
-
 	xcTest2(t, outPath, params, nil)
 
-	files, err := ioutil.ReadDir(outPath)
+	f, err := os.Open(path.Join(outPath, "1980.jpeg"))
 	failNowOnError(t, err)
-	assert.Equal(t, 1, len(files))
-	pts, err := strconv.ParseInt(strings.Split(files[0].Name(), ".")[0], 10, 32)
-	assert.NoError(t, err)
-	assert.Equal(t, int64(1980), pts)
+	defer f.Close()
+	img, err := jpeg.Decode(f)
+	failNowOnError(t, err)
+	return img
 }
 
-func TestExtractAllImages(t *testing.T) {
+func TestLutFile(t *testing.T) {
 	url := videoBigBuckBunnyPath
 	if fileMissing(url, fn()) {
 		return
 	}
 
 	outPath := path.Join(baseOutPath, fn())
+	setupOutDir(t, outPath)
+	lutFile := path.Join(outPath, "invert.cube")
+	writeInvertCubeLut(t, lutFile)
 
-	params := &goavpipe.XcParams{
-		Format:                 "image2",
-		AudioBitrate:           128000,
+	orig := extractImage(t, path.Join(outPath, "orig"), nil)
+	graded := extractImage(t, path.Join(outPath, "graded"), func(params *goavpipe.XcParams) {
+		params.LutFile = lutFile
+	})
+
+	// Each channel of the graded frame must be the inverse of the original at the sample pixel
+	bounds := orig.Bounds()
+	x, y := bounds.Dx()/2, bounds.Dy()/2
+	r1, g1, b1, _ := orig.At(x, y).RGBA()
+	r2, g2, b2, _ := graded.At(x, y).RGBA()
+	assert.InDelta(t, 255, int(r1>>8)+int(r2>>8), 24)
+	assert.InDelta(t, 255, int(g1>>8)+int(g2>>8), 24)
+	assert.InDelta(t, 255, int(b1>>8)+int(b2>>8), 24)
+}
+
+func TestLutFileInvalid(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outPath := path.Join(baseOutPath, fn())
+	boilerplate(t, outPath, url)
+	lutFile := path.Join(outPath, "bad.cube")
+	// Size 2 needs 8 entries
+	err := ioutil.WriteFile(lutFile, []byte("LUT_3D_SIZE 2\n0 0 0\n1 1 1\n"), 0644)
+	failNowOnError(t, err)
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		LutFile:             lutFile,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+// TestBurnSubtitleFile checks the subtitles are burnt at the bottom of the frame with alignment 2 and at the top
+// with alignment 8
+func TestBurnSubtitleFile(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outPath := path.Join(baseOutPath, fn())
+	setupOutDir(t, outPath)
+	srtFile := path.Join(outPath, "burn.srt")
+	err := ioutil.WriteFile(srtFile, []byte("1\n00:00:00,000 --> 00:01:00,000\nBURNT SUBTITLE\n"), 0644)
+	failNowOnError(t, err)
+
+	burn := func(alignment int32) func(params *goavpipe.XcParams) {
+		return func(params *goavpipe.XcParams) {
+			params.BurnSubtitleFile = srtFile
+			params.BurnSubtitleAlignment = alignment
+			params.BurnSubtitleMarginV = 10
+			params.BurnSubtitleRelativeSize = 0.1
+		}
+	}
+	orig := extractImage(t, path.Join(outPath, "orig"), nil)
+	bottom := extractImage(t, path.Join(outPath, "bottom"), burn(2))
+	top := extractImage(t, path.Join(outPath, "top"), burn(8))
+
+	b := orig.Bounds()
+	topRect := image.Rect(b.Min.X, b.Min.Y, b.Max.X, b.Min.Y+b.Dy()/4)
+	bottomRect := image.Rect(b.Min.X, b.Max.Y-b.Dy()/4, b.Max.X, b.Max.Y)
+
+	diff := imageDiff(orig, bottom, bottomRect)
+	assert.Greater(t, diff, 0.5)
+	assert.Greater(t, diff, 4*imageDiff(orig, bottom, topRect))
+
+	diff = imageDiff(orig, top, topRect)
+	assert.Greater(t, diff, 0.5)
+	assert.Greater(t, diff, 4*imageDiff(orig, top, bottomRect))
+}
+
+// imageDiff returns the mean absolute difference (0-255) of the gray levels of a and b in r
+func imageDiff(a, b image.Image, r image.Rectangle) float64 {
+	var sum float64
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			ga := color.GrayModel.Convert(a.At(x, y)).(color.Gray).Y
+			gb := color.GrayModel.Convert(b.At(x, y)).(color.Gray).Y
+			sum += math.Abs(float64(ga) - float64(gb))
+		}
+	}
+	return sum / float64(r.Dx()*r.Dy())
+}
+
+// TestBurnSubtitleFileInvalid checks XcInit fails, before transcoding, if the subtitle file can't be read or
+// is not a valid subtitle file, or if the subtitle params are invalid
+func TestBurnSubtitleFileInvalid(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outPath := path.Join(baseOutPath, fn())
+	setupOutDir(t, outPath)
+	// fileInputOpener fails the test if a file can't be opened
+	avpipe.InitIOHandler(&avpipe.FileInputOpener{}, &fileOutputOpener{t: t, dir: outPath})
+
+	writeFile := func(name, content string) string {
+		filename := path.Join(outPath, name)
+		failNowOnError(t, ioutil.WriteFile(filename, []byte(content), 0644))
+		return filename
+	}
+	srtFile := writeFile("valid.srt", "1\n00:00:00,000 --> 00:00:01,000\nsubtitle\n")
+
+	params := &goavpipe.XcParams{
+		Format:                   "fmp4-segment",
+		DurationTs:               -1,
+		StartSegmentStr:          "1",
+		SegDuration:              "30",
+		Ecodec:                   h264Codec,
+		EncHeight:                -1,
+		EncWidth:                 -1,
+		XcType:                   goavpipe.XcVideo,
+		StreamId:                 -1,
+		SyncAudioToStreamId:      -1,
+		BurnSubtitleAlignment:    2,
+		BurnSubtitleRelativeSize: 0.05,
+		Url:                      url,
+		DebugFrameLevel:          debugFrameLevel,
+	}
+
+	for _, tc := range []struct {
+		name         string
+		file         string
+		alignment    int32
+		relativeSize float32
+	}{
+		{"missing file", path.Join(outPath, "missing.srt"), 2, 0.05},
+		{"unreadable file", outPath, 2, 0.05},
+		{"empty file", writeFile("empty.srt", ""), 2, 0.05},
+		{"not a subtitle file", writeFile("text.srt", "not a subtitle file\n"), 2, 0.05},
+		{"bad srt timing", writeFile("bad.srt", "1\n00:00:0x,000 -> 1 sec\nsubtitle\n"), 2, 0.05},
+		{"vtt without cues", writeFile("bad.vtt", "WEBVTT\n\nno cue timing\n"), 2, 0.05},
+		{"bad alignment", srtFile, 10, 0.05},
+		{"bad relative size", srtFile, 2, 0},
+	} {
+		params.BurnSubtitleFile = tc.file
+		params.BurnSubtitleAlignment = tc.alignment
+		params.BurnSubtitleRelativeSize = tc.relativeSize
+		handle, err := avpipe.XcInit(params)
+		if !assert.Error(t, err, tc.name) {
+			avpipe.XcCancel(handle)
+		}
+	}
+
+	params.BurnSubtitleFile = srtFile
+	params.BurnSubtitleAlignment = 2
+	params.BurnSubtitleRelativeSize = 0.05
+	handle, err := avpipe.XcInit(params)
+	failNowOnError(t, err)
+	assert.NoError(t, avpipe.XcCancel(handle))
+}
+
+func TestCropPad(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          60000,
+		StartSegmentStr:     "1",
+		SegDuration:         "2",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		CropX:               480,
+		CropY:               270,
+		CropW:               960,
+		CropH:               540,
+		PadLeft:             40,
+		PadRight:            40,
+		PadTop:              20,
+		PadBottom:           20,
+		PadColor:            "black",
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	xcTestResult := &XcTestResult{
+		mezFile: []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+	}
+
+	boilerplate(t, outputDir, url)
+	boilerXc(t, params)
+	probeInfo := boilerProbe(t, xcTestResult)
+	if assert.Len(t, probeInfo, 1) {
+		assert.Equal(t, 720, probeInfo[0].StreamInfo[0].Width)
+		assert.Equal(t, 400, probeInfo[0].StreamInfo[0].Height)
+	}
+}
+
+func TestVerifySegments(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          60000,
+		StartSegmentStr:     "1",
+		SegDuration:         "2",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		VerifySegments:      true,
+		FailOnVerifyError:   true,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	boilerplate(t, outputDir, url)
+	boilerXc(t, params)
+
+	segment, err := ioutil.ReadFile(path.Join(outputDir, "vsegment-1.mp4"))
+	failNowOnError(t, err)
+	assert.NoError(t, avpipe.VerifySegment(nil, segment))
+
+	// Overwrite the middle of the media data to corrupt the coded frames
+	mdat := bytes.Index(segment, []byte("mdat"))
+	if assert.Greater(t, mdat, 0) {
+		corrupt := append([]byte{}, segment...)
+		for i := mdat + (len(corrupt)-mdat)/4; i < mdat+(len(corrupt)-mdat)/2; i++ {
+			corrupt[i] = 0xff
+		}
+		assert.Error(t, avpipe.VerifySegment(nil, corrupt))
+	}
+}
+
+func TestCropExceedsSource(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, url)
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          60000,
+		StartSegmentStr:     "1",
+		SegDuration:         "2",
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		CropX:               1000,
+		CropY:               0,
+		CropW:               1280,
+		CropH:               720,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	err := avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+func TestScaleOptions(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          60000,
+		StartSegmentStr:     "1",
+		SegDuration:         "2",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		ScaleAlgo:           "lanczos",
+		ColorRange:          "tv",
+		ColorSpace:          "bt709",
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	xcTestResult := &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+		pixelFmt: "yuv420p",
+	}
+
+	boilerplate(t, outputDir, url)
+	boilerXc(t, params)
+	outProbe := boilerProbe(t, xcTestResult)
+	if assert.Len(t, outProbe, 1) {
+		assert.Equal(t, 640, outProbe[0].StreamInfo[0].Width)
+		assert.Equal(t, 360, outProbe[0].StreamInfo[0].Height)
+	}
+}
+
+func TestScaleAlgoInvalid(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, url)
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          60000,
+		StartSegmentStr:     "1",
+		SegDuration:         "2",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		ScaleAlgo:           "sharp",
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	err := avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+// Each segment of fmp4-segment has its own init, the tenc box must carry the KID of its key period
+func TestKeyRotation(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, url)
+
+	kid1 := "a7e61c373e219033c21091fa607bf3b8"
+	kid2 := "76a6c65c5ea762046bd749a2e632ccbb"
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		CryptScheme:         goavpipe.CryptCENC,
+		KeyRotation: []goavpipe.KeyPeriod{
+			{StartSegment: 1, Key: "76a6c65c5ea762046bd749a2e632ccbb", KID: kid1},
+			{StartSegment: 2, Key: "a7e61c373e219033c21091fa607bf3b8", KID: kid2},
+		},
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	boilerXc(t, params)
+
+	for i, kid := range []string{kid1, kid2} {
+		seg, err := os.ReadFile(fmt.Sprintf("%s/vsegment-%d.mp4", outputDir, i+1))
+		failNowOnError(t, err)
+		kidBytes, _ := hex.DecodeString(kid)
+		assert.True(t, bytes.Contains(seg, kidBytes), "segment %d must use kid %s", i+1, kid)
+	}
+}
+
+func TestKeyRotationInvalid(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, url)
+
+	params := &goavpipe.XcParams{
+		Format:              "dash",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		VideoSegDurationTs:  48000,
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		CryptScheme:         goavpipe.CryptCENC,
+		KeyRotation: []goavpipe.KeyPeriod{
+			{StartSegment: 1, Key: "76a6c65c5ea762046bd749a2e632ccbb", KID: "a7e61c373e219033c21091fa607bf3b8"},
+		},
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
+	}
+	err := avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+func TestCryptParamsInvalid(t *testing.T) {
+	key := "76a6c65c5ea762046bd749a2e632ccbb"
+	kid := "a7e61c373e219033c21091fa607bf3b8"
+	cases := []struct {
+		name   string
+		scheme goavpipe.CryptScheme
+		key    string
+		kid    string
+		iv     string
+	}{
+		{"short key", goavpipe.CryptAES128, key[:30], "", ""},
+		{"long iv", goavpipe.CryptAES128, key, "", key + "00"},
+		{"not hex", goavpipe.CryptCENC, "x" + key[1:], kid, ""},
+		{"missing kid", goavpipe.CryptCENC, key, "", ""},
+		{"missing key", goavpipe.CryptCBCS, "", kid, key},
+		{"8 byte cbcs iv", goavpipe.CryptCBCS, key, kid, key[:16]},
+	}
+
+	for _, c := range cases {
+		params := &goavpipe.XcParams{
+			Format:      "fmp4-segment",
+			Url:         videoBigBuckBunnyPath,
+			XcType:      goavpipe.XcVideo,
+			CryptScheme: c.scheme,
+			CryptKey:    c.key,
+			CryptKID:    c.kid,
+			CryptIV:     c.iv,
+		}
+		// Fails before reaching the C layer, so the input is not opened
+		err := avpipe.Xc(params)
+		if assert.Error(t, err, c.name) {
+			assert.NotContains(t, err.Error(), "EAV_", c.name)
+		}
+	}
+
+	// UUID KIDs and upper case hex are normalized
+	params := &goavpipe.XcParams{
+		CryptScheme: goavpipe.CryptCENC,
+		CryptKey:    " 0x" + strings.ToUpper(key),
+		CryptKID:    "a7e61c37-3e21-9033-c210-91fa607bf3b8",
+		CryptIV:     key[:16],
+	}
+	assert.NoError(t, params.NormalizeCrypt())
+	assert.Equal(t, key, params.CryptKey)
+	assert.Equal(t, kid, params.CryptKID)
+}
+
+// The C strings of the params are released after each call, so RSS must not grow with the number of calls
+func TestXcInitReleasesParams(t *testing.T) {
+	if runtime.GOOS != "linux" {
+		t.Skip("RSS is read from /proc/self/statm")
+	}
+
+	rss := func() int64 {
+		statm, err := os.ReadFile("/proc/self/statm")
+		failNowOnError(t, err)
+		pages, err := strconv.ParseInt(strings.Fields(string(statm))[1], 10, 64)
+		failNowOnError(t, err)
+		return pages * int64(os.Getpagesize())
+	}
+
+	// The empty url fails in C after the params are converted
+	params := &goavpipe.XcParams{
+		Format:        "fmp4-segment",
+		XcType:        goavpipe.XcVideo,
+		WatermarkText: strings.Repeat("x", 1024*1024),
+		EncPixFmt:     strings.Repeat("x", 1024*1024),
+		InputFormat:   strings.Repeat("x", 1024*1024),
+		InputOptions:  strings.Repeat("x", 1024*1024),
+	}
+	for i := 0; i < 10; i++ {
+		avpipe.XcInit(params)
+	}
+
+	before := rss()
+	for i := 0; i < 500; i++ {
+		_, err := avpipe.XcInit(params)
+		assert.Error(t, err)
+	}
+	after := rss()
+
+	// Leaking any of the strings would add 500MB
+	assert.Less(t, after-before, int64(100*1024*1024))
+}
+
+// The url openers of XcInit() must be released if it fails, and by XcCancel() if XcRun() is never called,
+// otherwise the next session of the url fails to set its openers
+func TestXcInitReleasesUrlHandlers(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, "")
+
+	params := &goavpipe.XcParams{
+		Format:          "fmp4-segment",
+		StartTimeTs:     0,
+		DurationTs:      -1,
+		StartSegmentStr: "1",
+		SegDuration:     "30",
+		Ecodec:          h264Codec,
+		XcType:          goavpipe.XcVideo,
+		StreamId:        -1,
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
+		CryptScheme:     goavpipe.CryptCENC,
+		CryptKey:        "not a key",
+	}
+	setFastEncodeParams(params, false)
+
+	require.NoError(t, avpipe.RegisterUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir}))
+	_, err := avpipe.XcInit(params)
+	require.Error(t, err)
+
+	params.CryptScheme = goavpipe.CryptNone
+	params.CryptKey = ""
+	require.NoError(t, avpipe.RegisterUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir}))
+	handle, err := avpipe.XcInit(params)
+	require.NoError(t, err)
+	require.NoError(t, avpipe.XcCancel(handle))
+
+	require.NoError(t, avpipe.RegisterUrlIOHandler(url, &fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir}))
+	handle, err = avpipe.XcInit(params)
+	require.NoError(t, err)
+	require.NoError(t, avpipe.XcCancel(handle))
+}
+
+// mp4Boxes returns the payloads of the boxes of type boxType at the top level of buf
+func mp4Boxes(buf []byte, boxType string) (payloads [][]byte) {
+	for len(buf) >= 8 {
+		size := int(binary.BigEndian.Uint32(buf))
+		if size < 8 || size > len(buf) {
+			break
+		}
+		if string(buf[4:8]) == boxType {
+			payloads = append(payloads, buf[8:size])
+		}
+		buf = buf[size:]
+	}
+	return
+}
+
+func TestDrmSystemsPssh(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, url)
+
+	kid := "a7e61c373e219033c21091fa607bf3b8"
+	widevinePssh := []byte{0x12, 0x10, 0xa7, 0xe6, 0x1c, 0x37, 0x3e, 0x21, 0x90, 0x33, 0xc2, 0x10, 0x91, 0xfa, 0x60, 0x7b, 0xf3, 0xb8}
+	params := &goavpipe.XcParams{
+		Format:              "dash",
+		DurationTs:          180000,
+		StartSegmentStr:     "1",
+		VideoSegDurationTs:  60000,
+		ForceKeyInt:         60,
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		CryptScheme:         goavpipe.CryptCENC,
+		CryptKey:            "76a6c65c5ea762046bd749a2e632ccbb",
+		CryptKID:            kid,
+		DrmSystems: []goavpipe.DrmSystem{
+			{SystemID: goavpipe.WidevineSystemID, PSSH: widevinePssh},
+			{SystemID: goavpipe.PlayReadySystemID},
+		},
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	boilerXc(t, params)
+
+	initSeg, err := os.ReadFile(path.Join(outputDir, "vinit-stream0.m4s"))
+	failNowOnError(t, err)
+	kidBytes, _ := hex.DecodeString(kid)
+
+	moov := mp4Boxes(initSeg, "moov")
+	if !assert.Equal(t, 1, len(moov)) {
+		return
+	}
+	pssh := mp4Boxes(moov[0], "pssh")
+	if !assert.Equal(t, 2, len(pssh)) {
+		return
+	}
+	for i, systemID := range []string{goavpipe.WidevineSystemID, goavpipe.PlayReadySystemID} {
+		systemIDBytes, _ := hex.DecodeString(strings.ReplaceAll(systemID, "-", ""))
+		// Version 1 with one KID
+		assert.Equal(t, []byte{1, 0, 0, 0}, pssh[i][0:4])
+		assert.Equal(t, systemIDBytes, pssh[i][4:20])
+		assert.Equal(t, uint32(1), binary.BigEndian.Uint32(pssh[i][20:24]))
+		assert.Equal(t, kidBytes, pssh[i][24:40])
+		dataSize := int(binary.BigEndian.Uint32(pssh[i][40:44]))
+		assert.Equal(t, len(params.DrmSystems[i].PSSH), dataSize)
+		assert.Equal(t, len(pssh[i]), 44+dataSize)
+	}
+	assert.Equal(t, widevinePssh, pssh[0][44:])
+
+	// tenc is nested in the sample entry, the default KID follows version, flags and 4 bytes of defaults
+	tenc := bytes.Index(initSeg, []byte("tenc"))
+	if assert.True(t, tenc > 0, "tenc box is missing") {
+		assert.Equal(t, kidBytes, initSeg[tenc+12:tenc+28])
+	}
+}
+
+// The source is SDR, so tone mapping must be skipped
+func TestToneMapSDRSource(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          60000,
+		StartSegmentStr:     "1",
+		SegDuration:         "2",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		ToneMap:             "hable",
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	xcTestResult := &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+		pixelFmt: "yuv420p",
+	}
+
+	xcTest(t, outputDir, params, xcTestResult, true)
+}
+
+func TestToneMapHDR(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	setupOutDir(t, outputDir)
+
+	// Make a short HDR10 (BT.2020 PQ) source
+	hdrUrl := path.Join(outputDir, "hdr10.mp4")
+	ffmpeg := exec.Command("ffmpeg", "-y", "-f", "lavfi", "-i", "testsrc2=size=1280x720:rate=25", "-t", "2",
+		"-pix_fmt", "yuv420p10le", "-c:v", "libx265",
+		"-color_primaries", "bt2020", "-color_trc", "smpte2084", "-colorspace", "bt2020nc", hdrUrl)
+	if err := ffmpeg.Run(); err != nil {
+		t.Skip("ffmpeg with libx265 is needed to make the HDR source", err)
+	}
+	filters, err := exec.Command("ffmpeg", "-hide_banner", "-filters").Output()
+	if err != nil || !strings.Contains(string(filters), " zscale ") {
+		t.Skip("tone mapping needs FFmpeg built with libzimg")
+	}
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		ToneMap:             "hable",
+		Url:                 hdrUrl,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	xcTestResult := &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+		pixelFmt: "yuv420p",
+	}
+
+	// Keep hdr10.mp4, boilerplate would remove it
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: hdrUrl}, &fileOutputOpener{t: t, dir: outputDir})
+	boilerXc(t, params)
+	boilerProbe(t, xcTestResult)
+}
+
+func TestPreserveHdrMetadata(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	setupOutDir(t, outputDir)
+
+	// Make a short HDR10 source with mastering display and content light level metadata
+	hdrUrl := path.Join(outputDir, "hdr10.mp4")
+	ffmpeg := exec.Command("ffmpeg", "-y", "-f", "lavfi", "-i", "testsrc2=size=1280x720:rate=25", "-t", "2",
+		"-pix_fmt", "yuv420p10le", "-c:v", "libx265",
+		"-x265-params", "hdr10=1:master-display=G(13250,34500)B(7500,3000)R(34000,16000)WP(15635,16450)L(10000000,50):max-cll=1000,400",
+		"-color_primaries", "bt2020", "-color_trc", "smpte2084", "-colorspace", "bt2020nc", hdrUrl)
+	if err := ffmpeg.Run(); err != nil {
+		t.Skip("ffmpeg with libx265 is needed to make the HDR source", err)
+	}
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              "libx265",
+		BitDepth:            10,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		PreserveHdrMetadata: true,
+		Url:                 hdrUrl,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	xcTestResult := &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+		pixelFmt: "yuv420p10le",
+	}
+
+	// Keep hdr10.mp4, boilerplate would remove it
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: hdrUrl}, &fileOutputOpener{t: t, dir: outputDir})
+	boilerXc(t, params)
+	probeInfoArray := boilerProbe(t, xcTestResult)
+
+	si := probeInfoArray[0].StreamInfo[0]
+	assert.Equal(t, "bt2020", si.ColorPrimaries)
+	assert.Equal(t, "smpte2084", si.ColorTransfer)
+	assert.Equal(t, "bt2020nc", si.ColorSpace)
+	assert.Equal(t, 10, si.BitsPerRawSample)
+	for _, sd := range si.SideData {
+		if cl, ok := sd.(avpipe.SideDataContentLightLevel); ok {
+			assert.Equal(t, 1000, cl.MaxContent)
+			assert.Equal(t, 400, cl.MaxAverage)
+		}
+	}
+}
+
+// Should exit after extracting the first frame
+func TestExtractImagesListFast(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outPath := path.Join(baseOutPath, fn())
+
+	params := &goavpipe.XcParams{
+		Format:                 "image2",
+		AudioBitrate:           128000,
+		AudioSegDurationTs:     -1,
+		BitDepth:               8,
+		CrfStr:                 "23",
+		DurationTs:             -1,
+		Ecodec:                 "mjpeg",
+		Ecodec2:                "aac",
+		EncHeight:              -1,
+		EncWidth:               -1,
+		ExtractImageIntervalTs: -1,
+		GPUIndex:               -1,
+		SampleRate:             -1,
+		SegDuration:            "30",
+		StartFragmentIndex:     1,
+		StartSegmentStr:        "1",
+		StreamId:               -1,
+		SyncAudioToStreamId:    -1,
+		VideoBitrate:           -1,
+		VideoSegDurationTs:     -1,
+		XcType:                 goavpipe.XcExtractImages,
+		Url:                    url,
+		DebugFrameLevel:        debugFrameLevel,
+	}
+	params.ExtractImagesTs = []int64{1980}
+	setFastEncodeParams(params, true)
+
+	xcTest2(t, outPath, params, nil)
+
+	files, err := ioutil.ReadDir(outPath)
+	failNowOnError(t, err)
+	assert.Equal(t, 1, len(files))
+	pts, err := strconv.ParseInt(strings.Split(files[0].Name(), ".")[0], 10, 32)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1980), pts)
+}
+
+func TestExtractAllImages(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outPath := path.Join(baseOutPath, fn())
+
+	params := &goavpipe.XcParams{
+		Format:                 "image2",
+		AudioBitrate:           128000,
+		AudioSegDurationTs:     -1,
+		BitDepth:               8,
+		CrfStr:                 "23",
+		DurationTs:             -1,
+		Ecodec:                 "mjpeg",
+		EncHeight:              -1,
+		EncWidth:               -1,
+		ExtractImageIntervalTs: -1,
+		GPUIndex:               -1,
+		SampleRate:             -1,
+		SegDuration:            "30",
+		StartFragmentIndex:     1,
+		StartSegmentStr:        "1",
+		StreamId:               -1,
+		SyncAudioToStreamId:    -1,
+		VideoBitrate:           -1,
+		VideoSegDurationTs:     -1,
+		XcType:                 goavpipe.XcExtractAllImages,
+		Url:                    url,
+		DebugFrameLevel:        debugFrameLevel,
+	}
+
+	xcTest2(t, outPath, params, nil)
+
+	files, err := ioutil.ReadDir(outPath)
+	failNowOnError(t, err)
+	assert.Equal(t, 1800, len(files))
+	pts, err := strconv.ParseInt(strings.Split(files[0].Name(), ".")[0], 10, 32)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(1000980), pts)
+}
+
+type LevelParams struct {
+	profile       int
+	bitrate       int64
+	framerate     int
+	width         int
+	height        int
+	expectedLevel int
+}
+
+func TestLevel(t *testing.T) {
+	levelParams := []LevelParams{
+		{100, 7498181, 30, 3840, 2160, 51},
+		{100, 4001453, 60, 1920, 1080, 42},
+		{100, 3081772, 30, 1920, 1080, 40},
+		{100, 8173343, 24, 2048, 858, 40},
+		{77, 921161, 25, 2048, 864, 40},
+		{100, 207245, 25, 1532, 642, 32},
+		{100, 1530884, 30, 1280, 720, 31},
+		{100, 409778, 24, 720, 302, 30},
+		{100, 348377, 24, 640, 268, 21},
+		{100, 324552, 30, 480, 272, 21},
+		{100, 115986, 24, 320, 144, 12},
+	}
+
+	for i := 0; i < len(levelParams); i++ {
+		level := avpipe.H264GuessLevel(levelParams[i].profile, levelParams[i].bitrate, levelParams[i].framerate, levelParams[i].width, levelParams[i].height)
+		assert.Equal(t, levelParams[i].expectedLevel, level)
+	}
+}
+
+type ProfileParams struct {
+	bitDepth        int
+	width           int
+	height          int
+	expectedProfile int
+}
+
+func TestProfile(t *testing.T) {
+	profileParams := []ProfileParams{
+		{8, 320, 540, goavpipe.XcProfileH264BaseLine},
+		{8, 1280, 720, goavpipe.XcProfileH264Heigh},
+		{8, 1920, 1080, goavpipe.XcProfileH264Heigh},
+		{8, 3840, 2169, goavpipe.XcProfileH264Heigh},
+		{10, 3840, 2169, goavpipe.XcProfileH264Heigh10},
+	}
+
+	for i := 0; i < len(profileParams); i++ {
+		profile := avpipe.H264GuessProfile(profileParams[i].bitDepth, profileParams[i].width, profileParams[i].height)
+		assert.Equal(t, profileParams[i].expectedProfile, profile)
+	}
+}
+
+func TestMain(m *testing.M) {
+	// call flag.Parse() here if TestMain uses flags
+	setupLogging()
+	os.Exit(m.Run())
+}
+
+func TestForceKeyframesAt(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	keyframesAt := []float64{1.5, 3.7, 4.1}
+	params := &goavpipe.XcParams{
+		Format:                 "fmp4",
+		AudioSegDurationTs:     -1,
+		BitDepth:               8,
+		CrfStr:                 "23",
+		DurationTs:             -1,
+		Ecodec:                 "libx264",
+		EncHeight:              -1,
+		EncWidth:               -1,
+		ExtractImageIntervalTs: -1,
+		GPUIndex:               -1,
+		SampleRate:             -1,
+		StartFragmentIndex:     1,
+		StartSegmentStr:        "1",
+		StreamId:               -1,
+		SyncAudioToStreamId:    -1,
+		VideoBitrate:           -1,
+		VideoSegDurationTs:     -1,
+		MaxBFrames:             -1,
+		ForceKeyframesAt:       keyframesAt,
+		XcType:                 goavpipe.XcVideo,
+		Url:                    url,
+		DebugFrameLevel:        debugFrameLevel,
+	}
+	setFastEncodeParams(params, true)
+	setupOutDir(t, outputDir)
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	boilerXc(t, params)
+
+	outUrl := path.Join(outputDir, "fmp4-stream.mp4")
+	avpipe.InitIOHandler(&fileInputOpener{url: outUrl}, &concurrentOutputOpener{dir: "O"})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: outUrl, Seekable: true})
+	failNowOnError(t, err)
+	timeBase, _ := probe.StreamInfo[0].TimeBase.Float64()
+	frameDuration, _ := new(big.Rat).Inv(probe.StreamInfo[0].AvgFrameRate).Float64()
+
+	frames, err := avpipe.ProbeFrames(outUrl, true, 0, 0)
+	failNowOnError(t, err)
+	var keyframes []float64
+	for _, f := range frames {
+		if f.KeyFrame {
+			keyframes = append(keyframes, float64(f.Pts-frames[0].Pts)*timeBase)
+		}
+	}
+
+	// Each requested time has a key frame within one frame after it
+	for _, at := range keyframesAt {
+		found := false
+		for _, k := range keyframes {
+			if k >= at && k-at < frameDuration {
+				found = true
+			}
+		}
+		assert.True(t, found, "no key frame at %.3f, key frames %v", at, keyframes)
+	}
+
+	params.ForceKeyframesAt = []float64{3.7, 1.5}
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+// TestCMAF checks the "cmaf" format produces a single fragmented mp4 with a sidx box before
+// each fragment
+func TestCMAF(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:                 "cmaf",
 		AudioSegDurationTs:     -1,
 		BitDepth:               8,
 		CrfStr:                 "23",
 		DurationTs:             -1,
-		Ecodec:                 "mjpeg",
+		Ecodec:                 "libx264",
 		EncHeight:              -1,
 		EncWidth:               -1,
 		ExtractImageIntervalTs: -1,
 		GPUIndex:               -1,
 		SampleRate:             -1,
-		SegDuration:            "30",
 		StartFragmentIndex:     1,
 		StartSegmentStr:        "1",
 		StreamId:               -1,
 		SyncAudioToStreamId:    -1,
 		VideoBitrate:           -1,
 		VideoSegDurationTs:     -1,
-		XcType:                 goavpipe.XcExtractAllImages,
+		ForceKeyInt:            60,
+		XcType:                 goavpipe.XcVideo,
 		Url:                    url,
 		DebugFrameLevel:        debugFrameLevel,
 	}
+	setFastEncodeParams(params, true)
+	xcTest(t, outputDir, params, nil, true)
+
+	data, err := ioutil.ReadFile(path.Join(outputDir, "fmp4-stream.mp4"))
+	failNowOnError(t, err)
+
+	// Top level boxes
+	var boxes []string
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("invalid box size=%d, boxes=%v", size, boxes)
+		}
+		boxes = append(boxes, string(data[4:8]))
+		data = data[size:]
+	}
+
+	assert.Equal(t, []string{"ftyp", "moov"}, boxes[:2])
+	fragments := 0
+	for i, box := range boxes {
+		if box == "moof" {
+			fragments++
+			assert.Equal(t, "sidx", boxes[i-1], boxes)
+			assert.Equal(t, "mdat", boxes[i+1], boxes)
+		}
+	}
+	assert.Greater(t, fragments, 1)
+}
+
+func TestWebM(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:              "webm",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		Ecodec:              "libvpx-vp9",
+		Ecodec2:             "libopus",
+		AudioBitrate:        96000,
+		EncHeight:           360,
+		EncWidth:            640,
+		VideoBitrate:        500000,
+		XcType:              goavpipe.XcAll,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+
+	xcTestResult := &XcTestResult{
+		mezFile: []string{
+			fmt.Sprintf("%s/webm-video.webm", outputDir),
+			fmt.Sprintf("%s/webm-audio0.webm", outputDir),
+		},
+	}
+	xcTest(t, outputDir, params, nil, true)
+	probeInfo := boilerProbe(t, xcTestResult)
+	require.Equal(t, 2, len(probeInfo))
+	assert.Equal(t, "vp9", probeInfo[0].StreamInfo[0].CodecName)
+	assert.Equal(t, "opus", probeInfo[1].StreamInfo[0].CodecName)
+	assert.Equal(t, 48000, probeInfo[1].StreamInfo[0].SampleRate)
+
+	// WebM only carries VP8/VP9/AV1 and Opus/Vorbis
+	params.Ecodec = h264Codec
+	err := avpipe.Xc(params)
+	assert.Error(t, err)
+	params.Ecodec = "libvpx-vp9"
+	params.Ecodec2 = "aac"
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+	params.Ecodec2 = "libopus"
+	params.SampleRate = 44100
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+// TestAudioEAC3 encodes the 5.1 AC-3 stream of an MPEG-TS file to E-AC-3 with a per-channel bit rate, then copies it with bypass
+func TestAudioEAC3(t *testing.T) {
+	url := "./media/bbb_sunflower_2160p_30fps_normal_2min.ts"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec2:             "eac3",
+		AudioChannelBitrate: 64000,
+		XcType:              goavpipe.XcAudio,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	params.AudioIndex = []int32{2}
+
+	xcTestResult := &XcTestResult{
+		mezFile:    []string{fmt.Sprintf("%s/asegment0-1.mp4", outputDir)},
+		sampleRate: 48000,
+	}
+	xcTest(t, outputDir, params, nil, true)
+	probeInfo := boilerProbe(t, xcTestResult)
+	require.Equal(t, 1, len(probeInfo))
+	assert.Equal(t, "eac3", probeInfo[0].StreamInfo[0].CodecName)
+	assert.Equal(t, 6, probeInfo[0].StreamInfo[0].Channels)
+
+	// The audio codec must fit the container and the codec options the audio codec
+	params.Ecodec2 = "aac"
+	err := avpipe.Xc(params)
+	assert.Error(t, err)
+	params.Ecodec2 = "libvorbis"
+	params.AudioChannelBitrate = 0
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+	params.Ecodec2 = "eac3"
+	params.OpusVbr = "constrained"
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+	params.Ecodec2 = "libopus"
+	params.OpusVbr = "average"
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+
+	// Passthrough of the E-AC-3 output
+	url = xcTestResult.mezFile[0]
+	outputDir = path.Join(baseOutPath, fn(), "bypass")
+	params = &goavpipe.XcParams{
+		BypassTranscoding:   true,
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		XcType:              goavpipe.XcAudio,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	xcTestResult.mezFile = []string{fmt.Sprintf("%s/asegment0-1.mp4", outputDir)}
+	xcTest(t, outputDir, params, nil, true)
+	probeInfo = boilerProbe(t, xcTestResult)
+	require.Equal(t, 1, len(probeInfo))
+	assert.Equal(t, "eac3", probeInfo[0].StreamInfo[0].CodecName)
+	assert.Equal(t, 6, probeInfo[0].StreamInfo[0].Channels)
+}
+
+// TestAudioLanguage selects the audio stream by the language of the probe tags
+func TestAudioLanguage(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: url, Seekable: true})
+	failNowOnError(t, err)
+	language := ""
+	for _, si := range probe.StreamInfo {
+		if si.CodecType == "audio" {
+			language = si.Tags["language"]
+			break
+		}
+	}
+	require.NotEmpty(t, language)
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec2:             "aac",
+		AudioBitrate:        128000,
+		AudioLanguage:       language,
+		XcType:              goavpipe.XcAudio,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	xcTest(t, outputDir, params, nil, true)
+
+	// No audio stream has the language
+	params.AudioLanguage = "zzz"
+	err = avpipe.Xc(params)
+	assert.ErrorIs(t, err, avpipe.EAV_STREAM_LANGUAGE)
+
+	// The audio streams are set once
+	params.AudioLanguage = language
+	params.AudioIndex = []int32{1}
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+	params.AudioLanguage = ""
+	params.StreamMap = []goavpipe.StreamMapping{{InputIndex: 1, Role: goavpipe.StreamRoleAudio}}
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+
+	params.AudioIndex = nil
+	params.StreamMap = []goavpipe.StreamMapping{{InputIndex: 1, Role: "data"}}
+	err = avpipe.Xc(params)
+	// The error of the stream map is returned, not the one of the C params it couldn't make
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "Invalid stream map")
+	}
+}
+
+// TestProgramID transcodes the second program of a multi-program MPEG-TS
+func TestProgramID(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	setupOutDir(t, outputDir)
+
+	// Make a MPEG-TS with 2 programs, told apart by the size of the video and the sample rate of the audio
+	mptsUrl := path.Join(outputDir, "mpts.ts")
+	ffmpeg := exec.Command("ffmpeg", "-y",
+		"-f", "lavfi", "-i", "testsrc2=size=320x240:rate=25", "-f", "lavfi", "-i", "sine=frequency=440:sample_rate=44100",
+		"-f", "lavfi", "-i", "testsrc2=size=640x360:rate=25", "-f", "lavfi", "-i", "sine=frequency=1000:sample_rate=48000",
+		"-t", "4", "-map", "0:v", "-map", "1:a", "-map", "2:v", "-map", "3:a", "-c:v", "libx264", "-c:a", "aac",
+		"-program", "program_num=1:title=One:st=0:st=1", "-program", "program_num=2:title=Two:st=2:st=3", mptsUrl)
+	if err := ffmpeg.Run(); err != nil {
+		t.Skip("ffmpeg with libx264 is needed to make the MPEG-TS", err)
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: mptsUrl}, &fileOutputOpener{t: t, dir: outputDir})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: mptsUrl, Seekable: true})
+	failNowOnError(t, err)
+	require.Equal(t, 2, len(probe.Programs))
+	assert.Equal(t, 1, probe.Programs[0].ProgramID)
+	assert.ElementsMatch(t, []int{0, 1}, probe.Programs[0].StreamIndexes)
+	assert.Equal(t, 2, probe.Programs[1].ProgramID)
+	assert.ElementsMatch(t, []int{2, 3}, probe.Programs[1].StreamIndexes)
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		Ecodec2:             "aac",
+		AudioBitrate:        128000,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		ProgramID:           2,
+		Url:                 mptsUrl,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	boilerXc(t, params)
+	audioParams := *params
+	audioParams.XcType = goavpipe.XcAudio
+	boilerXc(t, &audioParams)
+
+	probeInfoArray := boilerProbe(t, &XcTestResult{mezFile: []string{path.Join(outputDir, "vsegment-1.mp4")}})
+	assert.Equal(t, 360, probeInfoArray[0].StreamInfo[0].Height)
+	files, err := filepath.Glob(path.Join(outputDir, "asegment*-1.mp4"))
+	failNowOnError(t, err)
+	require.NotEmpty(t, files)
+	boilerProbe(t, &XcTestResult{mezFile: files[:1], sampleRate: 48000})
+
+	// The video stream is not in the program
+	params.StreamMap = []goavpipe.StreamMapping{{InputIndex: 0, Role: goavpipe.StreamRoleVideo}}
+	err = avpipe.Xc(params)
+	assert.ErrorIs(t, err, avpipe.EAV_STREAM_INDEX)
+
+	// No program 3
+	params.StreamMap = nil
+	params.ProgramID = 3
+	err = avpipe.Xc(params)
+	assert.ErrorIs(t, err, avpipe.EAV_STREAM_INDEX)
+}
+
+// TestFlushTrailingFrames transcodes a short clip with a known number of frames and checks none of the last
+// frames, held by the decoder, the filtergraph or the encoder at the end of the input, is missing
+func TestFlushTrailingFrames(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	setupOutDir(t, outputDir)
+
+	// 47 video frames with B-frames, and 1.5 sec of audio (72000 samples, not a multiple of the 1024 samples
+	// of an aac frame)
+	clipUrl := path.Join(outputDir, "clip.mp4")
+	ffmpeg := exec.Command("ffmpeg", "-y",
+		"-f", "lavfi", "-i", "testsrc2=size=320x240:rate=30", "-f", "lavfi", "-i", "sine=frequency=440:sample_rate=48000",
+		"-frames:v", "47", "-t", "1.5", "-c:v", "libx264", "-bf", "3", "-c:a", "aac", clipUrl)
+	if err := ffmpeg.Run(); err != nil {
+		t.Skip("ffmpeg with libx264 is needed to make the clip", err)
+	}
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           -1,
+		EncWidth:            -1,
+		Ecodec2:             "aac",
+		AudioBitrate:        128000,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 clipUrl,
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: clipUrl}, &fileOutputOpener{t: t, dir: outputDir})
+	boilerXc(t, params)
+	audioParams := *params
+	audioParams.XcType = goavpipe.XcAudio
+	boilerXc(t, &audioParams)
+
+	videoUrl := path.Join(outputDir, "vsegment-1.mp4")
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: videoUrl}, &fileOutputOpener{t: t, dir: outputDir})
+	frames, err := avpipe.ProbeFrames(videoUrl, true, 0, 0)
+	failNowOnError(t, err)
+	assert.Equal(t, 47, len(frames))
+
+	files, err := filepath.Glob(path.Join(outputDir, "asegment*-1.mp4"))
+	failNowOnError(t, err)
+	require.NotEmpty(t, files)
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: files[0]}, &fileOutputOpener{t: t, dir: outputDir})
+	frames, err = avpipe.ProbeFrames(files[0], true, 0, 0)
+	failNowOnError(t, err)
+	// The last 320 samples are in a frame of their own
+	assert.GreaterOrEqual(t, len(frames), (72000+1023)/1024)
+}
+
+// TestCustomFilters checks the video and audio filtergraphs compose with the scaling and the resampling to the
+// encoder format, and that invalid filtergraphs fail the initialization
+func TestCustomFilters(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	setupOutDir(t, outputDir)
+
+	clipUrl := path.Join(outputDir, "clip.mp4")
+	ffmpeg := exec.Command("ffmpeg", "-y",
+		"-f", "lavfi", "-i", "testsrc2=size=320x240:rate=30", "-f", "lavfi", "-i", "sine=frequency=440:sample_rate=44100",
+		"-t", "2", "-c:v", "libx264", "-c:a", "aac", clipUrl)
+	if err := ffmpeg.Run(); err != nil {
+		t.Skip("ffmpeg with libx264 is needed to make the clip", err)
+	}
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		Ecodec2:             "aac",
+		AudioBitrate:        128000,
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 clipUrl,
+		DebugFrameLevel:     debugFrameLevel,
+		// The crop changes the size of the frames, they are still scaled to the encoder size
+		VideoFilter: "crop=iw/2:ih/2,hqdn3d=4,unsharp=5:5:0.8",
+		// The resampling of the filter is undone by the conversion to the encoder format
+		AudioFilter: "highpass=f=200,aresample=22050,volume=0.5",
+	}
+	setFastEncodeParams(params, false)
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: clipUrl}, &fileOutputOpener{t: t, dir: outputDir})
+	boilerXc(t, params)
+	audioParams := *params
+	audioParams.XcType = goavpipe.XcAudio
+	boilerXc(t, &audioParams)
+
+	probeInfoArray := boilerProbe(t, &XcTestResult{mezFile: []string{path.Join(outputDir, "vsegment-1.mp4")}})
+	assert.Equal(t, 640, probeInfoArray[0].StreamInfo[0].Width)
+	assert.Equal(t, 360, probeInfoArray[0].StreamInfo[0].Height)
+	files, err := filepath.Glob(path.Join(outputDir, "asegment*-1.mp4"))
+	failNowOnError(t, err)
+	require.NotEmpty(t, files)
+	boilerProbe(t, &XcTestResult{mezFile: files[:1], sampleRate: 44100})
+
+	for _, tc := range []struct {
+		videoFilter string
+		audioFilter string
+		xcType      goavpipe.XcType
+		err         error
+	}{
+		{videoFilter: "nosuchfilter", xcType: goavpipe.XcVideo, err: avpipe.EAV_FILTER_INIT},
+		{videoFilter: "unsharp=luma_msize_x=100", xcType: goavpipe.XcVideo, err: avpipe.EAV_FILTER_INIT},
+		{videoFilter: "volume=2", xcType: goavpipe.XcVideo, err: avpipe.EAV_FILTER_INIT},
+		{audioFilter: "hflip", xcType: goavpipe.XcAudio, err: avpipe.EAV_FILTER_INIT},
+		{audioFilter: "volume=2", xcType: goavpipe.XcVideo, err: avpipe.EAV_PARAM},
+	} {
+		p := *params
+		p.VideoFilter = tc.videoFilter
+		p.AudioFilter = tc.audioFilter
+		p.XcType = tc.xcType
+		avpipe.InitIOHandler(&fileInputOpener{t: t, url: clipUrl}, &fileOutputOpener{t: t, dir: outputDir})
+		_, err := avpipe.XcInit(&p)
+		assert.ErrorIs(t, err, tc.err, "video_filter=%s audio_filter=%s", tc.videoFilter, tc.audioFilter)
+	}
+}
+
+// TestRemux copies the video and audio of an MPEG-TS file into a single mp4 with the moov box first
+func TestRemux(t *testing.T) {
+	url := "./media/bbb_sunflower_2160p_30fps_normal_2min.ts"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		BypassTranscoding: true,
+		Format:            "mp4",
+		DurationTs:        10 * 90000,
+		StartSegmentStr:   "1",
+		XcType:            goavpipe.XcAll,
+		StreamId:          -1,
+		Url:               url,
+		DebugFrameLevel:   debugFrameLevel,
+	}
+	xcTest(t, outputDir, params, nil, true)
+
+	outUrl := path.Join(outputDir, "mp4-stream.mp4")
+	assert.Equal(t, []string{"ftyp", "moov", "mdat"}, mp4TopBoxes(t, outUrl))
+
+	avpipe.InitIOHandler(&fileInputOpener{url: outUrl}, &fileOutputOpener{dir: outputDir})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: outUrl, Seekable: true})
+	failNowOnError(t, err)
+
+	// The streams start together and last the duration
+	var codecTypes []string
+	for _, si := range probe.StreamInfo {
+		codecTypes = append(codecTypes, si.CodecType)
+		startTime, _ := new(big.Rat).Mul(big.NewRat(si.StartTime, 1), si.TimeBase).Float64()
+		duration, _ := new(big.Rat).Mul(big.NewRat(si.DurationTs, 1), si.TimeBase).Float64()
+		assert.InDelta(t, 0, startTime, 0.1, si.CodecType)
+		assert.InDelta(t, 10, duration, 0.2, si.CodecType)
+	}
+	assert.Contains(t, codecTypes, "video")
+	assert.Contains(t, codecTypes, "audio")
+}
+
+// TestRemuxBitstreamFilters remuxes with a filter of the h264 video and a filter of another codec, which is skipped
+func TestRemuxBitstreamFilters(t *testing.T) {
+	url := "./media/bbb_sunflower_2160p_30fps_normal_2min.ts"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		BypassTranscoding: true,
+		Format:            "mp4",
+		DurationTs:        10 * 90000,
+		StartSegmentStr:   "1",
+		XcType:            goavpipe.XcAll,
+		StreamId:          -1,
+		Url:               url,
+		BitstreamFilters:  []string{"h264_metadata=level=4.1", "hevc_metadata=level=4.1"},
+		DebugFrameLevel:   debugFrameLevel,
+	}
+	xcTest(t, outputDir, params, nil, true)
+
+	outUrl := path.Join(outputDir, "mp4-stream.mp4")
+	avpipe.InitIOHandler(&fileInputOpener{url: outUrl}, &fileOutputOpener{dir: outputDir})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: outUrl, Seekable: true})
+	failNowOnError(t, err)
+	for _, si := range probe.StreamInfo {
+		if si.CodecType == "video" {
+			assert.Equal(t, 41, si.Level)
+		}
+	}
+
+	// Unknown filter
+	params.BitstreamFilters = []string{"h264_mp4toannexb", "no_such_filter"}
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+
+	// Only the copied streams are filtered
+	params.BypassTranscoding = false
+	params.BitstreamFilters = []string{"h264_mp4toannexb"}
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+func TestSupportedCodecs(t *testing.T) {
+	encoders := avpipe.SupportedEncoders()
+	assert.Contains(t, encoders, h264Codec)
+	assert.Contains(t, encoders, "aac")
+	assert.True(t, sort.StringsAreSorted(encoders))
+	assert.Contains(t, avpipe.SupportedDecoders(), "h264")
+	assert.Contains(t, avpipe.SupportedFormats(), "mp4")
+	assert.Contains(t, avpipe.SupportedFormats(), "dash")
+
+	assert.True(t, avpipe.HasCodec(h264Codec))
+	assert.True(t, avpipe.HasCodec("h264"))
+	assert.False(t, avpipe.HasCodec("no_such_codec"))
+	assert.False(t, avpipe.HasCodec(""))
+}
+
+func TestPixelFormatAndCodecID(t *testing.T) {
+	pixFmt := avpipe.PixelFormatByName("yuv420p10le")
+	assert.Greater(t, pixFmt, 0)
+	assert.Equal(t, "yuv420p10le", avpipe.GetPixelFormatName(pixFmt))
+	assert.Equal(t, 0, avpipe.PixelFormatByName("yuv420p"))
+	assert.Equal(t, -1, avpipe.PixelFormatByName("no_such_format"))
+
+	var found bool
+	for _, pf := range avpipe.PixelFormats() {
+		if pf.Name == "yuv420p10le" {
+			found = true
+			assert.Equal(t, pixFmt, pf.Id)
+			assert.Equal(t, 3, pf.NbComponents)
+			assert.Equal(t, 10, pf.BitDepth)
+			assert.Equal(t, 1, pf.Log2ChromaW)
+			assert.Equal(t, 1, pf.Log2ChromaH)
+			assert.True(t, pf.Planar)
+			assert.False(t, pf.RGB)
+			assert.False(t, pf.BigEndian)
+		}
+	}
+	assert.True(t, found)
+
+	codecID := avpipe.CodecIDByName("h264")
+	assert.Greater(t, codecID, 0)
+	assert.Equal(t, codecID, avpipe.CodecIDByName(h264Codec))
+	assert.Equal(t, "High", avpipe.GetProfileName(codecID, 100))
+	assert.Equal(t, 0, avpipe.CodecIDByName("no_such_codec"))
+}
+
+// TestTrim checks the trim in seconds is converted to the input timebase and that it fails if it
+// conflicts with start_time_ts
+func TestTrim(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:          "mp4",
+		DurationTs:      -1,
+		TrimStartSec:    2,
+		TrimEndSec:      5,
+		StartSegmentStr: "1",
+		VideoBitrate:    2560000,
+		Ecodec:          h264Codec,
+		EncHeight:       360,
+		EncWidth:        640,
+		XcType:          goavpipe.XcVideo,
+		StreamId:        -1,
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+	xcTest(t, outputDir, params, nil, true)
+
+	outUrl := path.Join(outputDir, "mp4-stream.mp4")
+	avpipe.InitIOHandler(&fileInputOpener{url: outUrl}, &fileOutputOpener{dir: outputDir})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: outUrl, Seekable: true})
+	failNowOnError(t, err)
+	if assert.Equal(t, 1, len(probe.StreamInfo)) {
+		si := probe.StreamInfo[0]
+		duration, _ := new(big.Rat).Mul(big.NewRat(si.DurationTs, 1), si.TimeBase).Float64()
+		assert.InDelta(t, 3, duration, 0.1)
+	}
+
+	params.StartTimeTs = 1
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+
+	params.StartTimeTs = 0
+	params.TrimEndSec = 1
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+// TestChunkMode checks a chunk starting in the middle of a GOP is primed from the key frame before it and
+// starts exactly at start_time_ts
+func TestChunkMode(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{t: t, url: url}, &concurrentOutputOpener{dir: "O"})
+	keyFrames, err := avpipe.ProbeKeyFrames(url, true, 0)
+	failNowOnError(t, err)
+	if !assert.Greater(t, len(keyFrames), 2) {
+		return
+	}
+	assert.Equal(t, int64(0), keyFrames[0])
+
+	// 10 frames (30 fps with a 1/15360 timebase) after the second key frame, 2 sec long
+	startTs := keyFrames[1] + 10*512
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:          "mp4",
+		StartTimeTs:     startTs,
+		DurationTs:      2 * 15360,
+		ChunkKeyFrameTs: avpipe.ChunkKeyFrame(keyFrames, startTs),
+		StartSegmentStr: "1",
+		VideoBitrate:    2560000,
+		Ecodec:          h264Codec,
+		EncHeight:       360,
+		EncWidth:        640,
+		XcType:          goavpipe.XcVideo,
+		StreamId:        -1,
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
+	}
+	assert.Equal(t, keyFrames[1], params.ChunkKeyFrameTs)
+	setFastEncodeParams(params, false)
+	xcTest(t, outputDir, params, nil, true)
+
+	outUrl := path.Join(outputDir, "mp4-stream.mp4")
+	avpipe.InitIOHandler(&fileInputOpener{url: outUrl}, &fileOutputOpener{dir: outputDir})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: outUrl, Seekable: true})
+	failNowOnError(t, err)
+	if assert.Equal(t, 1, len(probe.StreamInfo)) {
+		assert.Equal(t, int64(60), probe.StreamInfo[0].NBFrames)
+	}
+
+	// The key frame must be at or before start_time_ts
+	params.ChunkKeyFrameTs = startTs + 512
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+// TestInputFormat checks a headerless raw PCM input is probed and transcoded with a forced demuxer
+func TestInputFormat(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	setupOutDir(t, outputDir)
+
+	// 5 sec of a 440 Hz tone, 48 kHz stereo s16le
+	url := path.Join(outputDir, "tone.pcm")
+	pcm := make([]byte, 5*48000*4)
+	for i := 0; i < len(pcm)/4; i++ {
+		v := uint16(int16(8000 * math.Sin(2*math.Pi*440*float64(i)/48000)))
+		binary.LittleEndian.PutUint16(pcm[4*i:], v)
+		binary.LittleEndian.PutUint16(pcm[4*i+2:], v)
+	}
+	failNowOnError(t, ioutil.WriteFile(url, pcm, 0644))
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{
+		Url:          url,
+		Seekable:     true,
+		InputFormat:  "s16le",
+		InputOptions: "sample_rate=48000:channels=2",
+	})
+	failNowOnError(t, err)
+	if assert.Equal(t, 1, len(probe.StreamInfo)) {
+		assert.Equal(t, "audio", probe.StreamInfo[0].CodecType)
+		assert.Equal(t, "pcm_s16le", probe.StreamInfo[0].CodecName)
+		assert.Equal(t, 48000, probe.StreamInfo[0].SampleRate)
+		assert.Equal(t, 2, probe.StreamInfo[0].Channels)
+	}
+
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "30",
+		Ecodec2:             "aac",
+		AudioBitrate:        128000,
+		SampleRate:          48000,
+		XcType:              goavpipe.XcAudio,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		InputFormat:         "s16le",
+		InputOptions:        "sample_rate=48000:channels=2",
+		DebugFrameLevel:     debugFrameLevel,
+	}
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	err = avpipe.Xc(params)
+	failNowOnError(t, err)
+	assert.True(t, fileExist(path.Join(outputDir, "asegment0-1.mp4")))
+
+	params.InputFormat = "no_such_format"
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+// TestEncPixFmt checks the encoder pixel format can be selected and that a pixel format the encoder
+// doesn't support fails
+func TestEncPixFmt(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:          "fmp4-segment",
+		DurationTs:      -1,
+		StartSegmentStr: "1",
+		SegDuration:     "30",
+		Ecodec:          "libx265",
+		EncHeight:       360,
+		EncWidth:        640,
+		EncPixFmt:       "yuv420p10le",
+		XcType:          goavpipe.XcVideo,
+		StreamId:        -1,
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	xcTestResult := &XcTestResult{
+		mezFile:  []string{fmt.Sprintf("%s/vsegment-1.mp4", outputDir)},
+		profile:  "Main 10",
+		pixelFmt: "yuv420p10le",
+	}
+	xcTest(t, outputDir, params, xcTestResult, true)
+
+	// libx265 has no nv12 support
+	params.EncPixFmt = "nv12"
+	_, err := avpipe.XcInit(params)
+	assert.Error(t, err)
+
+	params.EncPixFmt = "no_such_format"
+	_, err = avpipe.XcInit(params)
+	assert.Error(t, err)
+}
+
+// TestFastStart checks the moov box of the mp4 output is written before the mdat box with faststart
+func TestFastStart(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: url, Seekable: true})
+	failNowOnError(t, err)
+	var timebase int64
+	for _, si := range probe.StreamInfo {
+		if si.CodecType == "video" {
+			timebase = si.TimeBase.Denom().Int64()
+		}
+	}
+	if !assert.Greater(t, timebase, int64(0)) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:          "mp4",
+		DurationTs:      5 * timebase,
+		StartSegmentStr: "1",
+		VideoBitrate:    2560000,
+		Ecodec:          h264Codec,
+		EncHeight:       720,
+		EncWidth:        1280,
+		XcType:          goavpipe.XcVideo,
+		StreamId:        -1,
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	outUrl := path.Join(outputDir, "mp4-stream.mp4")
+	xcTest(t, outputDir, params, nil, true)
+	assert.NotEqual(t, "moov", mp4TopBoxes(t, outUrl)[1])
+
+	params.FastStart = true
+	xcTest(t, outputDir, params, nil, true)
+	boxes := mp4TopBoxes(t, outUrl)
+	assert.Equal(t, "ftyp", boxes[0])
+	assert.Equal(t, "moov", boxes[1])
+	assert.Contains(t, boxes, "mdat")
+
+	// Only the mp4 and segment formats are supported
+	params.Format = "dash"
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+
+	// The chunk offsets are shifted with the moov box, so the output is still valid
+	avpipe.InitIOHandler(&fileInputOpener{url: outUrl}, &fileOutputOpener{dir: outputDir})
+	probe, err = avpipe.Probe(&goavpipe.XcParams{Url: outUrl, Seekable: true})
+	failNowOnError(t, err)
+	if assert.Equal(t, 1, len(probe.StreamInfo)) {
+		assert.Greater(t, probe.StreamInfo[0].NBFrames, int64(0))
+	}
+}
+
+// TestFillGaps checks an input without gaps is not padded with FillGaps and that the threshold is validated
+func TestFillGaps(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:          "mp4",
+		DurationTs:      2 * 15360,
+		StartSegmentStr: "1",
+		VideoBitrate:    2560000,
+		Ecodec:          h264Codec,
+		EncHeight:       360,
+		EncWidth:        640,
+		XcType:          goavpipe.XcVideo,
+		StreamId:        -1,
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
+		FillGaps:        true,
+		GapThresholdMs:  50,
+	}
+	setFastEncodeParams(params, false)
+	xcTest(t, outputDir, params, nil, true)
+
+	outUrl := path.Join(outputDir, "mp4-stream.mp4")
+	avpipe.InitIOHandler(&fileInputOpener{url: outUrl}, &fileOutputOpener{dir: outputDir})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: outUrl, Seekable: true})
+	failNowOnError(t, err)
+	if assert.Equal(t, 1, len(probe.StreamInfo)) {
+		assert.Equal(t, int64(60), probe.StreamInfo[0].NBFrames)
+	}
+
+	params.GapThresholdMs = -1
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	err = avpipe.Xc(params)
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
+
+	// Nothing is decoded with bypass
+	params.GapThresholdMs = 0
+	params.BypassTranscoding = true
+	err = avpipe.Xc(params)
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
+}
+
+// TestAlignedSegments transcodes the video and the audio of the input with separate jobs and checks the
+// boundaries of their segments are aligned
+func TestAlignedSegments(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:              "fmp4-segment",
+		DurationTs:          -1,
+		StartSegmentStr:     "1",
+		SegDuration:         "6",
+		VideoBitrate:        2560000,
+		Ecodec:              h264Codec,
+		EncHeight:           360,
+		EncWidth:            640,
+		ForceKeyInt:         60,
+		AudioBitrate:        128000,
+		Ecodec2:             "aac",
+		XcType:              goavpipe.XcVideo,
+		StreamId:            -1,
+		SyncAudioToStreamId: -1,
+		Url:                 url,
+		DebugFrameLevel:     debugFrameLevel,
+		AlignSegments:       true,
+		SegOriginPts:        15360 + 7*512, // 1.23 sec, neither on a key frame of the input nor on an audio frame
+	}
+	setFastEncodeParams(params, false)
+	statsInfo = testStatsInfo{}
+	xcTest(t, outputDir, params, nil, true)
+
+	audioParams := *params
+	audioParams.XcType = goavpipe.XcAudio
+	xcTest(t, outputDir, &audioParams, nil, false)
+
+	// Start of the segments in seconds from the origin, in the time base of the output stream
+	starts := func(segments []avpipe.SegmentStats, pattern string) []float64 {
+		files, err := filepath.Glob(path.Join(outputDir, pattern))
+		failNowOnError(t, err)
+		if !assert.NotEmpty(t, files) {
+			return nil
+		}
+		avpipe.InitIOHandler(&fileInputOpener{url: files[0]}, &fileOutputOpener{dir: outputDir})
+		probe, err := avpipe.Probe(&goavpipe.XcParams{Url: files[0], Seekable: true})
+		failNowOnError(t, err)
+		var s []float64
+		for _, seg := range segments {
+			start, _ := new(big.Rat).Mul(big.NewRat(seg.StartPTS, 1), probe.StreamInfo[0].TimeBase).Float64()
+			s = append(s, start)
+		}
+		return s
+	}
+	videoStarts := starts(statsInfo.videoSegmentStats, "vsegment-1.mp4")
+	audioStarts := starts(statsInfo.audioSegmentStats, "asegment*-1.mp4")
+
+	// 10 segments of the 60 sec input from 1.23 sec, the last one may be missing in one of them
+	assert.GreaterOrEqual(t, len(videoStarts), 9)
+	assert.LessOrEqual(t, math.Abs(float64(len(videoStarts)-len(audioStarts))), float64(1))
+	if assert.NotEmpty(t, videoStarts) && assert.NotEmpty(t, audioStarts) {
+		assert.InDelta(t, 0, videoStarts[0], 1.0/30)
+	}
+	for i := 0; i < len(videoStarts) && i < len(audioStarts); i++ {
+		// Within an audio frame (1024 samples at 48 kHz)
+		assert.InDelta(t, videoStarts[i], audioStarts[i], 1024.0/48000, "segment %d", i+1)
+	}
+
+	params.Format = "fmp4"
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	err := avpipe.Xc(params)
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
+}
+
+// TestAudioDelay checks audio_delay_ms shifts the start of the audio and keeps the segment boundaries
+func TestAudioDelay(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	// Start of the audio segments in seconds with the audio delay
+	audioStarts := func(delayMs int32) []float64 {
+		outputDir := path.Join(baseOutPath, fn(), fmt.Sprintf("delay%d", delayMs))
+		params := &goavpipe.XcParams{
+			Format:          "fmp4-segment",
+			DurationTs:      -1,
+			StartSegmentStr: "1",
+			SegDuration:     "6",
+			AudioBitrate:    128000,
+			Ecodec2:         "aac",
+			XcType:          goavpipe.XcAudio,
+			StreamId:        -1,
+			Url:             url,
+			DebugFrameLevel: debugFrameLevel,
+			AudioDelayMs:    delayMs,
+		}
+		statsInfo = testStatsInfo{}
+		xcTest(t, outputDir, params, nil, true)
+
+		files, err := filepath.Glob(path.Join(outputDir, "asegment*-1.mp4"))
+		failNowOnError(t, err)
+		if !assert.NotEmpty(t, files) {
+			return nil
+		}
+		avpipe.InitIOHandler(&fileInputOpener{url: files[0]}, &fileOutputOpener{dir: outputDir})
+		probe, err := avpipe.Probe(&goavpipe.XcParams{Url: files[0], Seekable: true})
+		failNowOnError(t, err)
+		var starts []float64
+		for _, seg := range statsInfo.audioSegmentStats {
+			start, _ := new(big.Rat).Mul(big.NewRat(seg.StartPTS, 1), probe.StreamInfo[0].TimeBase).Float64()
+			starts = append(starts, start)
+		}
+		return starts
+	}
+
+	noDelay := audioStarts(0)
+	if !assert.GreaterOrEqual(t, len(noDelay), 9) {
+		return
+	}
+	for _, delayMs := range []int32{500, -500} {
+		starts := audioStarts(delayMs)
+		if !assert.LessOrEqual(t, math.Abs(float64(len(starts)-len(noDelay))), float64(1), "delay %d", delayMs) {
+			continue
+		}
+		// Within an audio frame (1024 samples at 48 kHz)
+		if delayMs > 0 {
+			assert.InDelta(t, noDelay[0]+float64(delayMs)/1000, starts[0], 1024.0/48000, "delay %d", delayMs)
+		} else {
+			assert.InDelta(t, 0, starts[0], 1024.0/48000, "delay %d", delayMs)
+		}
+		// The segments after the first one start on the same boundaries
+		for i := 1; i < len(starts) && i < len(noDelay); i++ {
+			assert.InDelta(t, noDelay[i], starts[i], 1024.0/48000, "delay %d segment %d", delayMs, i+1)
+		}
+	}
+
+	params := &goavpipe.XcParams{
+		Format:            "fmp4-segment",
+		DurationTs:        -1,
+		StartSegmentStr:   "1",
+		SegDuration:       "6",
+		XcType:            goavpipe.XcAudio,
+		StreamId:          -1,
+		Url:               url,
+		AudioDelayMs:      500,
+		BypassTranscoding: true,
+	}
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: path.Join(baseOutPath, fn())})
+	err := avpipe.Xc(params)
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
+}
 
-	xcTest2(t, outPath, params, nil)
+// TestSidecarIndex checks the index sidecar of a cmaf output points to the fragments of the output
+func TestSidecarIndex(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
 
-	files, err := ioutil.ReadDir(outPath)
+	outputDir := path.Join(baseOutPath, fn())
+	boilerplate(t, outputDir, url)
+
+	params := &goavpipe.XcParams{
+		Format:          "cmaf",
+		DurationTs:      10 * 15360,
+		StartSegmentStr: "1",
+		VideoBitrate:    2560000,
+		Ecodec:          h264Codec,
+		EncHeight:       360,
+		EncWidth:        640,
+		ForceKeyInt:     60,
+		XcType:          goavpipe.XcVideo,
+		StreamId:        -1,
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
+		SidecarIndex:    true,
+	}
+	setFastEncodeParams(params, false)
+	artifacts, err := avpipe.XcOutputs(params)
 	failNowOnError(t, err)
-	assert.Equal(t, 1800, len(files))
-	pts, err := strconv.ParseInt(strings.Split(files[0].Name(), ".")[0], 10, 32)
-	assert.NoError(t, err)
-	assert.Equal(t, int64(1000980), pts)
+
+	var sidecar *avpipe.OutputArtifact
+	for i := range artifacts {
+		if artifacts[i].Type == goavpipe.IndexSidecar {
+			sidecar = &artifacts[i]
+		}
+	}
+	if !assert.NotNil(t, sidecar) {
+		return
+	}
+	data, err := ioutil.ReadFile(path.Join(outputDir, fmt.Sprintf("index-stream%d.json", sidecar.StreamIndex)))
+	failNowOnError(t, err)
+	index, err := avpipe.ParseIndexSidecar(data)
+	failNowOnError(t, err)
+
+	out, err := ioutil.ReadFile(path.Join(outputDir, "fmp4-stream.mp4"))
+	failNowOnError(t, err)
+	assert.Equal(t, int64(len(out)), index.Size)
+	assert.Greater(t, index.HeaderSize, int64(0))
+	// A fragment per GOP of 2 sec
+	if assert.Equal(t, 5, len(index.Fragments)) {
+		for _, f := range index.Fragments {
+			box := string(out[f.Offset+4 : f.Offset+8])
+			assert.Contains(t, []string{"styp", "sidx", "moof"}, box)
+		}
+	}
+
+	// mp4 has no fragments, its moov box is the index
+	params.Format = "mp4"
+	err = avpipe.Xc(params)
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
 }
 
-type LevelParams struct {
-	profile       int
-	bitrate       int64
-	framerate     int
-	width         int
-	height        int
-	expectedLevel int
+// TestMuxerOpts checks the muxer options are set on the output and that unknown options fail the transcoding
+func TestMuxerOpts(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:          "mp4",
+		DurationTs:      2 * 15360,
+		StartSegmentStr: "1",
+		VideoBitrate:    2560000,
+		Ecodec:          h264Codec,
+		EncHeight:       360,
+		EncWidth:        640,
+		XcType:          goavpipe.XcVideo,
+		StreamId:        -1,
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
+		MuxerOpts:       map[string]string{"brand": "mp42", "movflags": "+negative_cts_offsets"},
+	}
+	setFastEncodeParams(params, false)
+	xcTest(t, outputDir, params, nil, true)
+
+	// The major brand follows the size and the type of the ftyp box
+	data, err := ioutil.ReadFile(path.Join(outputDir, "mp4-stream.mp4"))
+	failNowOnError(t, err)
+	if assert.Greater(t, len(data), 12) {
+		assert.Equal(t, "ftyp", string(data[4:8]))
+		assert.Equal(t, "mp42", string(data[8:12]))
+	}
+
+	params.MuxerOpts = map[string]string{"no_such_option": "1"}
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	err = avpipe.Xc(params)
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
+
+	params.MuxerOpts = map[string]string{"movflags": "+no_such_flag"}
+	err = avpipe.Xc(params)
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
 }
 
-func TestLevel(t *testing.T) {
-	levelParams := []LevelParams{
-		{100, 7498181, 30, 3840, 2160, 51},
-		{100, 4001453, 60, 1920, 1080, 42},
-		{100, 3081772, 30, 1920, 1080, 40},
-		{100, 8173343, 24, 2048, 858, 40},
-		{77, 921161, 25, 2048, 864, 40},
-		{100, 207245, 25, 1532, 642, 32},
-		{100, 1530884, 30, 1280, 720, 31},
-		{100, 409778, 24, 720, 302, 30},
-		{100, 348377, 24, 640, 268, 21},
-		{100, 324552, 30, 480, 272, 21},
-		{100, 115986, 24, 320, 144, 12},
+func TestStillImage(t *testing.T) {
+	url := "./media/avpipe.png"
+	if fileMissing(url, fn()) {
+		return
 	}
 
-	for i := 0; i < len(levelParams); i++ {
-		level := avpipe.H264GuessLevel(levelParams[i].profile, levelParams[i].bitrate, levelParams[i].framerate, levelParams[i].width, levelParams[i].height)
-		assert.Equal(t, levelParams[i].expectedLevel, level)
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:          "mp4",
+		InputOptions:    "framerate=25",
+		DurationTs:      50, // 2 sec in the 1/25 timebase of the image
+		StartSegmentStr: "1",
+		VideoBitrate:    1000000,
+		Ecodec:          h264Codec,
+		XcType:          goavpipe.XcStill,
+		StreamId:        -1,
+		Url:             url,
+		DebugFrameLevel: debugFrameLevel,
 	}
+	setFastEncodeParams(params, false)
+	xcTest(t, outputDir, params, nil, true)
+
+	outUrl := path.Join(outputDir, "mp4-stream.mp4")
+	avpipe.InitIOHandler(&fileInputOpener{url: outUrl}, &fileOutputOpener{dir: outputDir})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: outUrl, Seekable: true})
+	failNowOnError(t, err)
+	if assert.Equal(t, 1, len(probe.StreamInfo)) {
+		assert.Equal(t, int64(50), probe.StreamInfo[0].NBFrames)
+	}
+
+	// The duration is required
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	params.DurationTs = -1
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
 }
 
-type ProfileParams struct {
-	bitDepth        int
-	width           int
-	height          int
-	expectedProfile int
+// writeVFRGif writes an animated gif of 40 frames with alternating frame durations of 30ms and 70ms
+func writeVFRGif(t *testing.T, url string) {
+	anim := &gif.GIF{}
+	palette := color.Palette{color.Black, color.White}
+	for i := 0; i < 40; i++ {
+		img := image.NewPaletted(image.Rect(0, 0, 64, 64), palette)
+		for x := 0; x < 64; x++ {
+			img.SetColorIndex(x, i, 1)
+		}
+		anim.Image = append(anim.Image, img)
+		anim.Delay = append(anim.Delay, 3+4*(i%2))
+	}
+
+	f, err := os.Create(url)
+	failNowOnError(t, err)
+	defer f.Close()
+	failNowOnError(t, gif.EncodeAll(f, anim))
 }
 
-func TestProfile(t *testing.T) {
-	profileParams := []ProfileParams{
-		{8, 320, 540, goavpipe.XcProfileH264BaseLine},
-		{8, 1280, 720, goavpipe.XcProfileH264Heigh},
-		{8, 1920, 1080, goavpipe.XcProfileH264Heigh},
-		{8, 3840, 2169, goavpipe.XcProfileH264Heigh},
-		{10, 3840, 2169, goavpipe.XcProfileH264Heigh10},
+// TestVFRHandling transcodes a variable frame rate gif to a constant frame rate and with passthrough
+func TestVFRHandling(t *testing.T) {
+	outputDir := path.Join(baseOutPath, fn())
+	setupOutDir(t, outputDir)
+	url := path.Join(outputDir, "vfr.gif")
+	writeVFRGif(t, url)
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: url, Seekable: true})
+	failNowOnError(t, err)
+	assert.True(t, probe.StreamInfo[0].IsVFR)
+
+	for _, vfrHandling := range []string{"cfr", "passthrough"} {
+		dir := path.Join(outputDir, vfrHandling)
+		params := &goavpipe.XcParams{
+			Format:          "mp4",
+			DurationTs:      -1,
+			StartSegmentStr: "1",
+			VideoBitrate:    500000,
+			ForceKeyInt:     10,
+			Ecodec:          h264Codec,
+			XcType:          goavpipe.XcVideo,
+			StreamId:        -1,
+			Url:             url,
+			VFRHandling:     vfrHandling,
+			DebugFrameLevel: debugFrameLevel,
+		}
+		if vfrHandling == "cfr" {
+			params.EncFrameRate = "25"
+		}
+		setFastEncodeParams(params, false)
+		xcTest(t, dir, params, nil, true)
+
+		outUrl := path.Join(dir, "mp4-stream.mp4")
+		avpipe.InitIOHandler(&fileInputOpener{url: outUrl}, &fileOutputOpener{dir: dir})
+		probe, err := avpipe.Probe(&goavpipe.XcParams{Url: outUrl, Seekable: true})
+		failNowOnError(t, err)
+		if vfrHandling == "cfr" {
+			// 2 sec at 25 fps
+			assert.False(t, probe.StreamInfo[0].IsVFR)
+			assert.InDelta(t, 50, probe.StreamInfo[0].NBFrames, 2)
+		} else {
+			assert.True(t, probe.StreamInfo[0].IsVFR)
+			assert.Equal(t, int64(40), probe.StreamInfo[0].NBFrames)
+		}
 	}
 
-	for i := 0; i < len(profileParams); i++ {
-		profile := avpipe.H264GuessProfile(profileParams[i].bitDepth, profileParams[i].width, profileParams[i].height)
-		assert.Equal(t, profileParams[i].expectedProfile, profile)
+	// The constant frame rate conversion can't bypass the transcoding
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	err = avpipe.Xc(&goavpipe.XcParams{
+		Format:            "mp4",
+		DurationTs:        -1,
+		BypassTranscoding: true,
+		XcType:            goavpipe.XcVideo,
+		StreamId:          -1,
+		Url:               url,
+		VFRHandling:       "cfr",
+	})
+	assert.ErrorIs(t, err, avpipe.EAV_PARAM)
+}
+
+// mp4TopBoxes returns the types of the top level boxes of an mp4 file
+func mp4TopBoxes(t *testing.T, url string) []string {
+	data, err := ioutil.ReadFile(url)
+	failNowOnError(t, err)
+
+	var boxes []string
+	for len(data) >= 8 {
+		size := int(binary.BigEndian.Uint32(data))
+		if size < 8 || size > len(data) {
+			t.Fatalf("invalid box size=%d, boxes=%v, url=%s", size, boxes, url)
+		}
+		boxes = append(boxes, string(data[4:8]))
+		data = data[size:]
+	}
+	if len(boxes) < 2 {
+		t.Fatalf("missing boxes=%v, url=%s", boxes, url)
 	}
+	return boxes
 }
 
-func TestMain(m *testing.M) {
-	// call flag.Parse() here if TestMain uses flags
-	setupLogging()
-	os.Exit(m.Run())
+// TestRemuxFrameAccurate checks a trimmed remux starts exactly at the trim start with frame_accurate
+func TestRemuxFrameAccurate(t *testing.T) {
+	url := "./media/bbb_sunflower_2160p_30fps_normal_2min.ts"
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		BypassTranscoding: true,
+		Format:            "mp4",
+		DurationTs:        -1,
+		TrimStartSec:      1.5,
+		TrimEndSec:        4.5,
+		FrameAccurate:     true,
+		StartSegmentStr:   "1",
+		XcType:            goavpipe.XcAll,
+		StreamId:          -1,
+		Url:               url,
+		DebugFrameLevel:   debugFrameLevel,
+	}
+	xcTest(t, outputDir, params, nil, true)
+
+	outUrl := path.Join(outputDir, "mp4-stream.mp4")
+	avpipe.InitIOHandler(&fileInputOpener{url: outUrl}, &fileOutputOpener{dir: outputDir})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: outUrl, Seekable: true})
+	failNowOnError(t, err)
+
+	videoIndex := -1
+	for _, si := range probe.StreamInfo {
+		startTime, _ := new(big.Rat).Mul(big.NewRat(si.StartTime, 1), si.TimeBase).Float64()
+		duration, _ := new(big.Rat).Mul(big.NewRat(si.DurationTs, 1), si.TimeBase).Float64()
+		assert.InDelta(t, 0, startTime, 0.05, si.CodecType)
+		assert.InDelta(t, 3, duration, 0.1, si.CodecType)
+		if si.CodecType == "video" {
+			videoIndex = si.StreamIndex
+		}
+	}
+	if !assert.GreaterOrEqual(t, videoIndex, 0) {
+		return
+	}
+
+	// The output starts with the key frame, the first frame shown is at the trim start
+	frames, err := avpipe.ProbeFrames(outUrl, true, videoIndex, 0)
+	failNowOnError(t, err)
+	if assert.NotEmpty(t, frames) {
+		assert.True(t, frames[0].KeyFrame)
+		firstPts := int64(math.MaxInt64)
+		for _, f := range frames {
+			if f.Pts >= 0 && f.Pts < firstPts {
+				firstPts = f.Pts
+			}
+		}
+		assert.Equal(t, int64(0), firstPts)
+	}
+
+	// Only the bypass mp4 remux can be frame accurate
+	params.Format = "fmp4"
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+// TestSegDuration checks the segment duration can be set in seconds or in ts units, and that
+// conflicting durations fail
+func TestSegDuration(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: url, Seekable: true})
+	failNowOnError(t, err)
+	var timebase int64
+	for _, si := range probe.StreamInfo {
+		if si.CodecType == "video" {
+			timebase = si.TimeBase.Denom().Int64()
+		}
+	}
+	if !assert.Greater(t, timebase, int64(0)) {
+		return
+	}
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:             "dash",
+		DurationTs:         10 * timebase,
+		StartSegmentStr:    "1",
+		VideoBitrate:       2560000,
+		AudioSegDurationTs: -1,
+		VideoSegDurationTs: -1,
+		SegDuration:        "2",
+		Ecodec:             h264Codec,
+		EncHeight:          720,
+		EncWidth:           1280,
+		XcType:             goavpipe.XcVideo,
+		StreamId:           -1,
+		Url:                url,
+		DebugFrameLevel:    debugFrameLevel,
+	}
+	setFastEncodeParams(params, false)
+
+	countChunks := func() int {
+		files, err := ioutil.ReadDir(outputDir)
+		failNowOnError(t, err)
+		n := 0
+		for _, f := range files {
+			if strings.HasPrefix(f.Name(), "vchunk") {
+				n++
+			}
+		}
+		return n
+	}
+
+	// Seconds, the stale -1 ts is ignored
+	xcTest(t, outputDir, params, nil, true)
+	assert.Equal(t, 5, countChunks())
+
+	// Ts units
+	params.SegDuration = ""
+	params.VideoSegDurationTs = 2 * timebase
+	xcTest(t, outputDir, params, nil, true)
+	assert.Equal(t, 5, countChunks())
+
+	// Both, describing the same duration
+	params.SegDuration = "2"
+	xcTest(t, outputDir, params, nil, true)
+	assert.Equal(t, 5, countChunks())
+
+	// Both, conflicting
+	params.VideoSegDurationTs = 3 * timebase
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+
+	params.SegDuration = "-2"
+	params.VideoSegDurationTs = -1
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+// TestInjectMetadata checks the timed metadata is written as emsg boxes before the moof box of the
+// dash segments containing their PTS
+func TestInjectMetadata(t *testing.T) {
+	url := videoBigBuckBunnyPath
+	if fileMissing(url, fn()) {
+		return
+	}
+
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &concurrentOutputOpener{dir: "O"})
+	probe, err := avpipe.Probe(&goavpipe.XcParams{Url: url, Seekable: true})
+	failNowOnError(t, err)
+	var timebase int64
+	for _, si := range probe.StreamInfo {
+		if si.CodecType == "video" {
+			timebase = si.TimeBase.Denom().Int64()
+		}
+	}
+	if !assert.Greater(t, timebase, int64(0)) {
+		return
+	}
+
+	start, err := avpipe.ID3PrivTag("com.example.ad", []byte("start"))
+	failNowOnError(t, err)
+	end, err := avpipe.ID3PrivTag("com.example.ad", []byte("end"))
+	failNowOnError(t, err)
+
+	outputDir := path.Join(baseOutPath, fn())
+	params := &goavpipe.XcParams{
+		Format:             "dash",
+		DurationTs:         10 * timebase,
+		StartSegmentStr:    "1",
+		VideoBitrate:       2560000,
+		AudioSegDurationTs: -1,
+		VideoSegDurationTs: -1,
+		SegDuration:        "2",
+		Ecodec:             h264Codec,
+		EncHeight:          720,
+		EncWidth:           1280,
+		XcType:             goavpipe.XcVideo,
+		StreamId:           -1,
+		Url:                url,
+		DebugFrameLevel:    debugFrameLevel,
+		InjectMetadata: []goavpipe.TimedMetadata{
+			{Pts: timebase, Payload: start},
+			{Pts: 5 * timebase, Payload: end},
+		},
+	}
+	setFastEncodeParams(params, false)
+	xcTest(t, outputDir, params, nil, true)
+
+	// Segments are 2 sec, so the metadata is in the first and the third segment
+	for seg, metadata := range map[int]goavpipe.TimedMetadata{1: params.InjectMetadata[0], 3: params.InjectMetadata[1]} {
+		data, err := ioutil.ReadFile(path.Join(outputDir, fmt.Sprintf("vchunk-stream0-%05d.m4s", seg)))
+		failNowOnError(t, err)
+
+		var boxes []string
+		var emsg []byte
+		for len(data) >= 8 {
+			size := int(binary.BigEndian.Uint32(data))
+			if size < 8 || size > len(data) {
+				t.Fatalf("invalid box size=%d, boxes=%v", size, boxes)
+			}
+			boxes = append(boxes, string(data[4:8]))
+			if string(data[4:8]) == "emsg" {
+				emsg = data[:size]
+			}
+			data = data[size:]
+		}
+
+		i := 0
+		for i < len(boxes) && boxes[i] != "emsg" {
+			i++
+		}
+		if !assert.Less(t, i+1, len(boxes), boxes) {
+			continue
+		}
+		assert.Contains(t, []string{"sidx", "moof"}, boxes[i+1], boxes)
+
+		// Version 1: timescale, presentation_time, event_duration, id, scheme_id_uri, value, message_data
+		assert.Equal(t, byte(1), emsg[8])
+		assert.Equal(t, uint32(timebase), binary.BigEndian.Uint32(emsg[12:]))
+		assert.Equal(t, uint64(metadata.Pts), binary.BigEndian.Uint64(emsg[16:]))
+		fields := bytes.SplitN(emsg[32:], []byte{0}, 3)
+		assert.Equal(t, "https://aomedia.org/emsg/ID3", string(fields[0]))
+		assert.Equal(t, metadata.Payload, fields[2])
+	}
+
+	params.Format = "fmp4"
+	avpipe.InitIOHandler(&fileInputOpener{url: url}, &fileOutputOpener{dir: outputDir})
+	err = avpipe.Xc(params)
+	assert.Error(t, err)
+}
+
+func TestSetLogLevel(t *testing.T) {
+	for _, level := range []string{"quiet", "error", "warning", "warn", "debug", "trace", "info"} {
+		assert.NoError(t, avpipe.SetLogLevel(level), level)
+	}
+	assert.Error(t, avpipe.SetLogLevel("loud"))
+	assert.Error(t, avpipe.SetLogLevel(""))
 }
 
 func xcTest(t *testing.T, outputDir string, params *goavpipe.XcParams, xcTestResult *XcTestResult, isNewTest bool) {
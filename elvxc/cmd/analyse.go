@@ -8,6 +8,7 @@ import (
 	"strings"
 	"time"
 
+	"github.com/eluv-io/avpipe"
 	"github.com/spf13/cobra"
 )
 
@@ -260,6 +261,7 @@ func AnalyseLog(cmdRoot *cobra.Command) error {
 	}
 	cmdRoot.AddCommand(cmdAnalyse)
 	cmdAnalyse.PersistentFlags().StringP("log", "l", "", "(mandatory) log file to be analysed")
+	cmdAnalyse.PersistentFlags().Bool("frames", false, "analyse the frame level log of a transcoding (debug-frame-level) instead of a qfab log")
 	return nil
 }
 
@@ -275,6 +277,10 @@ func doAnalyseLog(cmd *cobra.Command, args []string) error {
 	}
 	defer file.Close()
 
+	if frames, _ := cmd.Flags().GetBool("frames"); frames {
+		return analyseFrameLog(file)
+	}
+
 	logAnalyser := newLogAnalyser()
 
 	reader := bufio.NewReader(file)
@@ -297,3 +303,28 @@ func doAnalyseLog(cmd *cobra.Command, args []string) error {
 
 	return nil
 }
+
+func analyseFrameLog(r io.Reader) error {
+	stats, err := avpipe.ParseFrameLog(r)
+	if err != nil {
+		return err
+	}
+
+	for _, s := range stats.Streams {
+		kind := "frames"
+		if s.IsPacket {
+			kind = "packets"
+		}
+		fmt.Printf("%s %s stream_index=%d %s=%d key=%d bytes=%d first_pts=%d last_pts=%d discontinuities=%d dropped=%d non_monotonic_dts=%d\n",
+			s.Stage, s.MediaType, s.StreamIndex, kind, len(s.Entries), s.KeyFrames, s.Bytes, s.FirstPTS, s.LastPTS,
+			len(s.Discontinuities), s.DroppedFrames, s.NonMonotonicDTS)
+		for _, d := range s.Discontinuities {
+			fmt.Printf("  discontinuity pts=%d gap=%d\n", d.PTS, d.Gap)
+		}
+		for _, b := range s.Bitrate {
+			fmt.Printf("  second=%d bitrate=%d\n", b.Second, b.Bitrate)
+		}
+	}
+
+	return nil
+}
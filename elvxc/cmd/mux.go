@@ -228,7 +228,9 @@ func doMux(cmd *cobra.Command, args []string) error {
 		Format:          format,
 	}
 
-	avpipe.InitUrlMuxIOHandler(filename, &AVCmdMuxInputOpener{URL: filename}, &AVCmdMuxOutputOpener{})
+	if err := avpipe.RegisterUrlMuxIOHandler(filename, &AVCmdMuxInputOpener{URL: filename}, &AVCmdMuxOutputOpener{}); err != nil {
+		return err
+	}
 
 	return avpipe.Mux(params)
 }
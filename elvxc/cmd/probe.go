@@ -2,6 +2,8 @@ package cmd
 
 import (
 	"fmt"
+	"sort"
+	"strings"
 
 	"github.com/eluv-io/avpipe"
 	"github.com/eluv-io/avpipe/goavpipe"
@@ -22,6 +24,12 @@ func Probe(cmdRoot *cobra.Command) error {
 	cmdProbe.PersistentFlags().BoolP("seekable", "", false, "(optional) seekable stream")
 	cmdProbe.PersistentFlags().BoolP("listen", "", false, "listen mode for RTMP.")
 	cmdProbe.PersistentFlags().Int32("connection-timeout", 0, "connection timeout for RTMP when listening on a port or MPEGTS to receive first UDP datagram.")
+	cmdProbe.PersistentFlags().String("input-format", "", "(optional) input demuxer of a headerless input, i.e \"h264\", \"aac\" or \"s16le\".")
+	cmdProbe.PersistentFlags().String("input-options", "", "(optional) options of the input demuxer as key=value pairs separated by ':', i.e \"sample_rate=48000:channels=2\".")
+	cmdProbe.PersistentFlags().Bool("json", false, "(optional) print the result as ffprobe JSON.")
+	cmdProbe.PersistentFlags().Int32("frames-stream-index", -1, "(optional) print the frames of the stream with this index.")
+	cmdProbe.PersistentFlags().Int32("program-id", 0, "(optional) probe only the streams of the program with this program number.")
+	cmdProbe.PersistentFlags().Int32("max-frames", 0, "(optional) maximum number of frames to print with frames-stream-index, 0 prints all the frames.")
 
 	return nil
 }
@@ -48,15 +56,47 @@ func doProbe(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Invalid listen flag")
 	}
 
+	framesStreamIndex, err := cmd.Flags().GetInt32("frames-stream-index")
+	if err != nil {
+		return fmt.Errorf("Invalid frames-stream-index flag")
+	}
+
+	maxFrames, err := cmd.Flags().GetInt32("max-frames")
+	if err != nil || maxFrames < 0 {
+		return fmt.Errorf("Invalid max-frames flag")
+	}
+
+	programID, err := cmd.Flags().GetInt32("program-id")
+	if err != nil || programID < 0 {
+		return fmt.Errorf("Invalid program-id flag")
+	}
+
 	params := &goavpipe.XcParams{
 		Url:               filename,
 		Seekable:          seekable,
 		Listen:            listen,
 		ConnectionTimeout: int(connectionTimeout),
+		InputFormat:       cmd.Flag("input-format").Value.String(),
+		InputOptions:      cmd.Flag("input-options").Value.String(),
+		ProgramID:         programID,
+	}
+
+	printJSON, err := cmd.Flags().GetBool("json")
+	if err != nil {
+		return fmt.Errorf("Invalid json flag")
 	}
 
 	avpipe.InitIOHandler(&elvxcInputOpener{url: filename}, &elvxcOutputOpener{dir: ""})
 
+	if printJSON {
+		b, err := avpipe.ProbeJSON(filename, seekable)
+		if err != nil {
+			return fmt.Errorf("Probing failed. file=%s", filename)
+		}
+		fmt.Println(string(b))
+		return nil
+	}
+
 	probe, err := avpipe.Probe(params)
 	if err != nil {
 		return fmt.Errorf("Probing failed. file=%s", filename)
@@ -99,27 +139,95 @@ func doProbe(cmd *cobra.Command, args []string) error {
 		fmt.Printf("\tsample_aspect_ratio: %d:%d\n", info.SampleAspectRatio.Num(), info.SampleAspectRatio.Denom())
 		fmt.Printf("\tdisplay_aspect_ratio: %d:%d\n", info.DisplayAspectRatio.Num(), info.DisplayAspectRatio.Denom())
 		fmt.Printf("\tfield_order: %s\n", info.FieldOrder)
-		/* TODO: Make this a switch based on different SideData */
-		if info.SideData != nil && len(info.SideData) > 0 {
-			displayMatrix, ok := info.SideData[0].(avpipe.SideDataDisplayMatrix)
-			if ok {
-				fmt.Printf("\tside_data:\n")
+		fmt.Printf("\trotation: %d\n", info.Rotation)
+		if info.CodecType == "video" {
+			fmt.Printf("\tcolor_primaries: %s\n", info.ColorPrimaries)
+			fmt.Printf("\tcolor_transfer: %s\n", info.ColorTransfer)
+			fmt.Printf("\tcolor_space: %s\n", info.ColorSpace)
+			fmt.Printf("\tcolor_range: %s\n", info.ColorRange)
+		}
+		if info.BitsPerRawSample > 0 {
+			fmt.Printf("\tbits_per_raw_sample: %d\n", info.BitsPerRawSample)
+		}
+		if info.IsVFR {
+			fmt.Printf("\tis_vfr: true\n")
+		}
+		if len(info.SideData) > 0 {
+			fmt.Printf("\tside_data:\n")
+		}
+		for _, sd := range info.SideData {
+			switch sd := sd.(type) {
+			case avpipe.SideDataDisplayMatrix:
 				fmt.Printf("\t\tdisplay_matrix:\n")
-				fmt.Printf("\t\t\trotation: %f\n", displayMatrix.Rotation)
-				fmt.Printf("\t\t\trotation_cw: %f\n", displayMatrix.RotationCw)
+				fmt.Printf("\t\t\trotation: %f\n", sd.Rotation)
+				fmt.Printf("\t\t\trotation_cw: %f\n", sd.RotationCw)
+			case avpipe.SideDataMasteringDisplay:
+				fmt.Printf("\t\tmastering_display:\n")
+				fmt.Printf("\t\t\tred: %.4f,%.4f green: %.4f,%.4f blue: %.4f,%.4f white_point: %.4f,%.4f\n",
+					sd.RedX, sd.RedY, sd.GreenX, sd.GreenY, sd.BlueX, sd.BlueY, sd.WhitePointX, sd.WhitePointY)
+				fmt.Printf("\t\t\tmin_luminance: %.4f\n", sd.MinLuminance)
+				fmt.Printf("\t\t\tmax_luminance: %.4f\n", sd.MaxLuminance)
+			case avpipe.SideDataContentLightLevel:
+				fmt.Printf("\t\tcontent_light_level:\n")
+				fmt.Printf("\t\t\tmax_content: %d\n", sd.MaxContent)
+				fmt.Printf("\t\t\tmax_average: %d\n", sd.MaxAverage)
 			}
 		}
-		if info.Tags != nil {
-			fmt.Printf("\ttags:\n")
-			for k, v := range info.Tags {
-				fmt.Printf("\t\t%s: %s\n", k, v)
+		var disposition []string
+		for name, set := range info.Disposition {
+			if set {
+				disposition = append(disposition, name)
 			}
 		}
+		if len(disposition) > 0 {
+			sort.Strings(disposition)
+			fmt.Printf("\tdisposition: %s\n", strings.Join(disposition, " "))
+		}
+		printTags("\t", info.Tags)
 	}
 
 	fmt.Printf("Container\n")
 	fmt.Printf("\tformat_name: %s\n", probe.ContainerInfo.FormatName)
 	fmt.Printf("\tduration: %.5f\n", probe.ContainerInfo.Duration)
+	printTags("\t", probe.ContainerInfo.Tags)
+
+	for _, program := range probe.Programs {
+		fmt.Printf("Program[%d]\n", program.ProgramID)
+		fmt.Printf("\tstream_indexes: %s\n", strings.Trim(fmt.Sprint(program.StreamIndexes), "[]"))
+		printTags("\t", program.Tags)
+	}
+
+	if framesStreamIndex >= 0 {
+		avpipe.InitIOHandler(&elvxcInputOpener{url: filename}, &elvxcOutputOpener{dir: ""})
+		frames, err := avpipe.ProbeFrames(filename, seekable, int(framesStreamIndex), int(maxFrames))
+		if err != nil {
+			return fmt.Errorf("Probing frames failed. file=%s", filename)
+		}
+
+		fmt.Printf("Frames[%d]\n", framesStreamIndex)
+		for _, f := range frames {
+			fmt.Printf("\tpts=%d dts=%d key_frame=%v pict_type=%s packet_size=%d\n",
+				f.Pts, f.Dts, f.KeyFrame, f.PictType, f.PacketSize)
+		}
+	}
 
 	return nil
 }
+
+// printTags prints the tags sorted by key
+func printTags(indent string, tags map[string]string) {
+	if len(tags) == 0 {
+		return
+	}
+
+	keys := make([]string, 0, len(tags))
+	for k := range tags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	fmt.Printf("%stags:\n", indent)
+	for _, k := range keys {
+		fmt.Printf("%s\t%s: %s\n", indent, k, tags[k])
+	}
+}
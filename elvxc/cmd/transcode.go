@@ -1,6 +1,8 @@
 package cmd
 
 import (
+	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -65,6 +67,16 @@ func (i *noopElvxcInput) Stat(streamIndex int, statType avpipe.AVStatType, statA
 		log.Info("AVCMD InputHandler.Stat", "video start PTS", *startPTS, "streamIndex", streamIndex)
 	case avpipe.AV_IN_STAT_DATA_SCTE35:
 		log.Info("AVCMD InputHandler.Stat", "scte35", statArgs, "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_VIDEO_FRAMES_DROPPED:
+		videoFramesDropped := statArgs.(*uint64)
+		log.Info("AVCMD InputHandler.Stat", "videoFramesDropped", *videoFramesDropped, "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_DECODE_PROGRESS:
+		decodeProgress := statArgs.(*avpipe.DecodeProgress)
+		log.Info("AVCMD InputHandler.Stat", "decodeProgress", decodeProgress, "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_SCTE35:
+		event := statArgs.(*avpipe.SCTE35Event)
+		log.Info("AVCMD InputHandler.Stat", "scte35 pts", event.PTS, "command", event.CommandType,
+			"data", hex.EncodeToString(event.Data), "streamIndex", streamIndex)
 	}
 
 	return nil
@@ -132,6 +144,16 @@ func (i *elvxcInput) Stat(streamIndex int, statType avpipe.AVStatType, statArgs
 		log.Info("AVCMD InputHandler.Stat", "video start PTS", *startPTS, "streamIndex", streamIndex)
 	case avpipe.AV_IN_STAT_DATA_SCTE35:
 		log.Info("AVCMD InputHandler.Stat", "scte35", statArgs, "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_VIDEO_FRAMES_DROPPED:
+		videoFramesDropped := statArgs.(*uint64)
+		log.Info("AVCMD InputHandler.Stat", "videoFramesDropped", *videoFramesDropped, "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_DECODE_PROGRESS:
+		decodeProgress := statArgs.(*avpipe.DecodeProgress)
+		log.Info("AVCMD InputHandler.Stat", "decodeProgress", decodeProgress, "streamIndex", streamIndex)
+	case avpipe.AV_IN_STAT_SCTE35:
+		event := statArgs.(*avpipe.SCTE35Event)
+		log.Info("AVCMD InputHandler.Stat", "scte35 pts", event.PTS, "command", event.CommandType,
+			"data", hex.EncodeToString(event.Data), "streamIndex", streamIndex)
 	}
 
 	return nil
@@ -190,6 +212,18 @@ func (oo *elvxcOutputOpener) Open(h, fd int64, stream_index, seg_index int,
 		filename = fmt.Sprintf("%s/%d.jpeg", dir, pts)
 	case goavpipe.MpegtsSegment:
 		filename = fmt.Sprintf("%s/ts-segment-%05d.ts", dir, seg_index)
+	case goavpipe.WebVTTInit:
+		filename = fmt.Sprintf("%s/vtt-init.vtt", dir)
+	case goavpipe.WebVTTSegment:
+		filename = fmt.Sprintf("%s/vtt-segment-%05d.vtt", dir, seg_index)
+	case goavpipe.ImageThumbnail:
+		filename = fmt.Sprintf("%s/thumbnail-%d.jpeg", dir, seg_index)
+	case goavpipe.WebMVideoStream:
+		filename = fmt.Sprintf("%s/webm-video.webm", dir)
+	case goavpipe.WebMAudioStream:
+		filename = fmt.Sprintf("%s/webm-audio%d.webm", dir, stream_index)
+	case goavpipe.IndexSidecar:
+		filename = fmt.Sprintf("%s/index-stream%d.json", dir, stream_index)
 	}
 
 	f, err := os.OpenFile(filename, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
@@ -252,6 +286,9 @@ func (o *elvxcOutput) Stat(streamIndex int, avType goavpipe.AVType, statType avp
 	case avpipe.AV_OUT_STAT_FRAME_WRITTEN:
 		encodingStats := statArgs.(*avpipe.EncodingFrameStats)
 		doLog("encodingStats", encodingStats)
+	case avpipe.AV_OUT_STAT_SEGMENT_DONE:
+		segmentStats := statArgs.(*avpipe.SegmentStats)
+		doLog("segmentStats", segmentStats)
 	}
 	return nil
 }
@@ -273,6 +310,24 @@ func getAudioIndexes(params *goavpipe.XcParams, audioIndexes string) (err error)
 	return nil
 }
 
+// parseForceKeyframesAt converts the force-keyframes-at string parameter, e.g.
+// "10,32.5,61.2", to a float64 array in goavpipe.XcParams
+func parseForceKeyframesAt(params *goavpipe.XcParams, s string) (err error) {
+	if len(s) == 0 {
+		return
+	}
+	times := strings.Split(s, ",")
+	params.ForceKeyframesAt = make([]float64, len(times))
+	for i, t := range times {
+		var v float64
+		if v, err = strconv.ParseFloat(t, 64); err != nil {
+			return fmt.Errorf("invalid key frame time %s", t)
+		}
+		params.ForceKeyframesAt[i] = v
+	}
+	return
+}
+
 // parseExtractImagesTs converts the extract-images-ts string parameter, e.g.
 // "0,64000,128000,1152000", to an int64 array in goavpipe.XcParams
 func parseExtractImagesTs(params *goavpipe.XcParams, s string) (err error) {
@@ -291,6 +346,100 @@ func parseExtractImagesTs(params *goavpipe.XcParams, s string) (err error) {
 	return
 }
 
+// parseStreamMap converts the stream-map string parameter, e.g.
+// "0:video,2:audio,3:audio", to stream mappings in goavpipe.XcParams
+func parseStreamMap(params *goavpipe.XcParams, s string) (err error) {
+	if len(s) == 0 {
+		return
+	}
+	mappings := strings.Split(s, ",")
+	params.StreamMap = make([]goavpipe.StreamMapping, len(mappings))
+	for i, mapping := range mappings {
+		fields := strings.Split(mapping, ":")
+		if len(fields) != 2 {
+			return fmt.Errorf("invalid stream mapping %s", mapping)
+		}
+		var index int
+		if index, err = strconv.Atoi(fields[0]); err != nil {
+			return fmt.Errorf("invalid stream mapping input index %s", fields[0])
+		}
+		params.StreamMap[i] = goavpipe.StreamMapping{InputIndex: int32(index), Role: fields[1]}
+	}
+	return
+}
+
+// parseKeyRotation converts the key-rotation string parameter, e.g.
+// "1:<key>:<kid>,11:<key>:<kid>:<iv>", to key periods in goavpipe.XcParams
+func parseKeyRotation(params *goavpipe.XcParams, s string) (err error) {
+	if len(s) == 0 {
+		return
+	}
+	periods := strings.Split(s, ",")
+	params.KeyRotation = make([]goavpipe.KeyPeriod, len(periods))
+	for i, period := range periods {
+		fields := strings.Split(period, ":")
+		if len(fields) != 3 && len(fields) != 4 {
+			return fmt.Errorf("invalid key period %s", period)
+		}
+		var startSegment int
+		if startSegment, err = strconv.Atoi(fields[0]); err != nil {
+			return fmt.Errorf("invalid key period start segment %s", fields[0])
+		}
+		params.KeyRotation[i] = goavpipe.KeyPeriod{
+			StartSegment: startSegment,
+			Key:          fields[1],
+			KID:          fields[2],
+		}
+		if len(fields) == 4 {
+			params.KeyRotation[i].IV = fields[3]
+		}
+	}
+	return
+}
+
+// parseDrmSystems converts the drm-systems string parameter, e.g.
+// "edef8ba9-79d6-4ace-a3c8-27dcd51d21ed:<base64 pssh data>", to DRM systems in goavpipe.XcParams
+func parseDrmSystems(params *goavpipe.XcParams, s string) (err error) {
+	if len(s) == 0 {
+		return
+	}
+	systems := strings.Split(s, ",")
+	params.DrmSystems = make([]goavpipe.DrmSystem, len(systems))
+	for i, system := range systems {
+		fields := strings.SplitN(system, ":", 2)
+		params.DrmSystems[i].SystemID = fields[0]
+		if len(fields) == 2 {
+			if params.DrmSystems[i].PSSH, err = base64.StdEncoding.DecodeString(fields[1]); err != nil {
+				return fmt.Errorf("invalid pssh data of DRM system %s", fields[0])
+			}
+		}
+	}
+	return
+}
+
+// parseInjectMetadata converts the inject-metadata string parameter, e.g.
+// "90000:com.example.ad:start,180000:com.example.ad:end", to ID3 PRIV tags in goavpipe.XcParams
+func parseInjectMetadata(params *goavpipe.XcParams, s string) (err error) {
+	if len(s) == 0 {
+		return
+	}
+	entries := strings.Split(s, ",")
+	params.InjectMetadata = make([]goavpipe.TimedMetadata, len(entries))
+	for i, entry := range entries {
+		fields := strings.SplitN(entry, ":", 3)
+		if len(fields) != 3 {
+			return fmt.Errorf("invalid timed metadata %s", entry)
+		}
+		if params.InjectMetadata[i].Pts, err = strconv.ParseInt(fields[0], 10, 64); err != nil {
+			return fmt.Errorf("invalid timed metadata PTS %s", fields[0])
+		}
+		if params.InjectMetadata[i].Payload, err = avpipe.ID3PrivTag(fields[1], []byte(fields[2])); err != nil {
+			return err
+		}
+	}
+	return
+}
+
 func InitTranscode(cmdRoot *cobra.Command) error {
 	cmdTranscode := &cobra.Command{
 		Use:   "transcode",
@@ -307,50 +456,89 @@ func InitTranscode(cmdRoot *cobra.Command) error {
 	cmdTranscode.PersistentFlags().BoolP("debug-frame-level", "", false, "debug frame level.")
 	cmdTranscode.PersistentFlags().BoolP("skip-decoding", "", false, "skip decoding when start-time-ts is set.")
 	cmdTranscode.PersistentFlags().BoolP("listen", "", false, "listen mode for RTMP.")
+	cmdTranscode.PersistentFlags().String("input-format", "", "Input demuxer of a headerless input, i.e \"h264\", \"aac\" or \"s16le\" (default detects it).")
+	cmdTranscode.PersistentFlags().String("input-options", "", "Options of the input demuxer as key=value pairs separated by ':', i.e \"sample_rate=48000:channels=2\".")
+	cmdTranscode.PersistentFlags().String("log-level", "info", "level of the ffmpeg logs, can be: quiet, panic, fatal, error, warning, info, verbose, debug, trace.")
 	cmdTranscode.PersistentFlags().Int32("connection-timeout", 0, "connection timeout for RTMP when listening on a port or MPEGTS to receive first UDP datagram.")
 	cmdTranscode.PersistentFlags().Int32P("threads", "t", 1, "transcoding threads.")
 	cmdTranscode.PersistentFlags().StringP("audio-index", "", "", "the indexes of audio stream (comma separated).")
+	cmdTranscode.PersistentFlags().String("audio-language", "", "Language tag of the audio stream to transcode (i.e \"eng\"), instead of audio-index.")
+	cmdTranscode.PersistentFlags().String("stream-map", "", "Input streams of the outputs as comma separated index:role, the role can be \"video\", \"audio\" or \"subtitle\" (i.e \"0:video,2:audio\").")
 	cmdTranscode.PersistentFlags().StringP("channel-layout", "", "", "audio channel layout.")
 	cmdTranscode.PersistentFlags().Int32P("gpu-index", "", -1, "Use the GPU with specified index for transcoding (export CUDA_DEVICE_ORDER=PCI_BUS_ID would use smi index).")
 	cmdTranscode.PersistentFlags().Int32P("sync-audio-to-stream-id", "", -1, "sync audio to video iframe of specific stream-id when input stream is mpegts")
-	cmdTranscode.PersistentFlags().StringP("encoder", "e", "libx264", "encoder codec, default is 'libx264', can be: 'libx264', 'libx265', 'h264_nvenc', 'h264_videotoolbox', or 'mjpeg'.")
-	cmdTranscode.PersistentFlags().StringP("audio-encoder", "", "aac", "audio encoder, default is 'aac', can be: 'aac', 'ac3', 'mp2', 'mp3'.")
+	cmdTranscode.PersistentFlags().StringP("encoder", "e", "libx264", "encoder codec, default is 'libx264', can be: 'libx264', 'libx265', 'h264_nvenc', 'h264_videotoolbox', 'mjpeg', or 'libvpx-vp9', 'libaom-av1' and 'libsvtav1' with 'webm' format.")
+	cmdTranscode.PersistentFlags().StringP("audio-encoder", "", "aac", "audio encoder, default is 'aac', can be: 'aac', 'ac3', 'mp2', 'mp3', or 'libopus' and 'libvorbis' with 'webm' format.")
 	cmdTranscode.PersistentFlags().StringP("decoder", "d", "", "video decoder, default is 'h264', can be: 'h264', 'h264_cuvid', 'jpeg2000', 'hevc'.")
 	cmdTranscode.PersistentFlags().StringP("audio-decoder", "", "", "audio decoder, default is '' and will be automatically chosen.")
-	cmdTranscode.PersistentFlags().StringP("format", "", "dash", "package format, can be 'dash', 'hls', 'mp4', 'fmp4', 'segment', 'fmp4-segment', or 'image2'.")
+	cmdTranscode.PersistentFlags().StringP("format", "", "dash", "package format, can be 'dash', 'hls', 'mp4', 'fmp4', 'cmaf', 'segment', 'fmp4-segment', 'image2', or 'webm'.")
 	cmdTranscode.PersistentFlags().StringP("filter-descriptor", "", "", " Audio filter descriptor the same as ffmpeg format")
 	cmdTranscode.PersistentFlags().Int32P("force-keyint", "", 0, "force IDR key frame in this interval.")
+	cmdTranscode.PersistentFlags().Int32("max-b-frames", -1, "Max consecutive B-frames, -1 keeps the default (0 for 'dash', 'hls', 'fmp4', 'cmaf' and 'fmp4-segment').")
+	cmdTranscode.PersistentFlags().Int32("ref-frames", 0, "Number of reference frames, 0 keeps the encoder default.")
+	cmdTranscode.PersistentFlags().Bool("closed-gop", false, "Close every GOP so that each segment is decodable on its own.")
+	cmdTranscode.PersistentFlags().String("force-keyframes-at", "", "Force key frames at these times in seconds from the start of the output, comma separated in ascending order (i.e \"10,32.5,61.2\").")
 	cmdTranscode.PersistentFlags().BoolP("equal-fduration", "", false, "force equal frame duration. Must be 0 or 1 and only valid for 'fmp4-segment' format.")
-	cmdTranscode.PersistentFlags().StringP("xc-type", "", "", "transcoding type, can be 'all', 'video', 'audio', 'audio-join', 'audio-pan', 'audio-merge', 'extract-images' or 'extract-all-images'.")
+	cmdTranscode.PersistentFlags().StringP("xc-type", "", "", "transcoding type, can be 'all', 'video', 'audio', 'audio-join', 'audio-pan', 'audio-merge', 'extract-images', 'extract-all-images', 'subtitle' or 'still'.")
 	cmdTranscode.PersistentFlags().Int32P("crf", "", 23, "mutually exclusive with video-bitrate.")
+	cmdTranscode.PersistentFlags().String("rate-control", "", "Rate control mode, can be 'cbr', 'vbr' (need video-bitrate), 'crf' or 'cvbr' (need crf and rc-max-rate). Empty derives it from the other rate params.")
 	cmdTranscode.PersistentFlags().StringP("preset", "", "medium", "Preset string to determine compression speed, can be: 'ultrafast', 'superfast', 'veryfast', 'faster', 'fast', 'medium', 'slow', 'slower', 'veryslow'")
 	cmdTranscode.PersistentFlags().Int64P("start-time-ts", "", 0, "offset to start transcoding")
+	cmdTranscode.PersistentFlags().Int64("chunk-key-frame-ts", 0, "Chunk mode, key frame at or before start-time-ts where the decoding starts (0 decodes from the start).")
 	cmdTranscode.PersistentFlags().Int32P("stream-id", "", -1, "if it is valid it will be used to transcode elementary stream with that stream-id")
 	cmdTranscode.PersistentFlags().Int64P("start-pts", "", 0, "starting PTS for output.")
+	cmdTranscode.PersistentFlags().Int64("output-base-pts", 0, "absolute start time of all output streams in microseconds, to align separate transcodes.")
 	cmdTranscode.PersistentFlags().Int32P("sample-rate", "", -1, "For aac output sample rate is set to input sample rate and this parameter is ignored.")
 	cmdTranscode.PersistentFlags().Int32P("start-segment", "", 1, "start segment number >= 1.")
 	cmdTranscode.PersistentFlags().Int32P("start-frag-index", "", 1, "start fragment index >= 1.")
 	cmdTranscode.PersistentFlags().Int32P("video-bitrate", "", -1, "output video bitrate, mutually exclusive with crf.")
 	cmdTranscode.PersistentFlags().Int32P("audio-bitrate", "", 128000, "output audio bitrate.")
+	cmdTranscode.PersistentFlags().Int32("audio-channel-bitrate", 0, "Bit rate per channel for ac3 and eac3, overrides audio-bitrate.")
+	cmdTranscode.PersistentFlags().String("opus-vbr", "", "VBR mode of libopus, can be \"on\" (default), \"off\" or \"constrained\".")
 	cmdTranscode.PersistentFlags().Int32P("rc-max-rate", "", 0, "maximum encoding bit rate, used in conjuction with rc-buffer-size.")
 	cmdTranscode.PersistentFlags().Int32P("rc-buffer-size", "", 0, "determines the interval used to limit bit rate.")
 	cmdTranscode.PersistentFlags().Int32P("enc-height", "", -1, "default -1 means use source height.")
 	cmdTranscode.PersistentFlags().Int32P("enc-width", "", -1, "default -1 means use source width.")
 	cmdTranscode.PersistentFlags().Int32P("video-time-base", "", 0, "Video encoder timebase, must be > 0 (the actual timebase would be 1/video-time-base).")
+	cmdTranscode.PersistentFlags().String("enc-pix-fmt", "", "Encoder pixel format, i.e \"yuv420p10le\" for 10-bit output (default picks the 4:2:0 pixel format of bitdepth).")
+	cmdTranscode.PersistentFlags().String("enc-frame-rate", "", "Output video frame rate, i.e \"30\" or \"30000/1001\" (default keeps the input frame rate).")
+	cmdTranscode.PersistentFlags().String("vfr-handling", "", "Variable frame rate input, can be \"cfr\" (convert to enc-frame-rate or the average frame rate), \"vfr\" (default) or \"passthrough\" (also force-keyint by time).")
+	cmdTranscode.PersistentFlags().Int32("decode-threads", 0, "Thread count of the decoders (default 8, 16 for live inputs).")
+	cmdTranscode.PersistentFlags().Int32("io-buffer-size", 0, "Size of the avio buffers of the input and the outputs in bytes (default 1MB).")
+	cmdTranscode.PersistentFlags().Int32("encode-threads", 0, "Thread count of the video encoder (default is the encoder default, auto for libx264/libx265).")
+	cmdTranscode.PersistentFlags().String("thread-type", "", "Threading of the decoders and the video encoder, can be \"frame\" or \"slice\" (lower latency), default is both.")
+	cmdTranscode.PersistentFlags().Bool("low-latency", false, "Encode with minimal latency (no B-frames, no lookahead, tune=zerolatency) and flush the outputs after each packet.")
+	cmdTranscode.PersistentFlags().StringToString("muxer-opts", nil, "Options of the output muxers as key=value pairs, i.e \"movflags=+negative_cts_offsets,frag_duration=2000000\" (unknown options fail the transcoding).")
+	cmdTranscode.PersistentFlags().String("bitstream-filters", "", "Comma separated bitstream filters of the copied streams with bypass, i.e \"h264_mp4toannexb\" (each applies to the streams of its codecs).")
+	cmdTranscode.PersistentFlags().Bool("intra-refresh", false, "Periodic intra refresh instead of IDR frames, only with low-latency and libx264.")
+	cmdTranscode.PersistentFlags().String("scale-algo", "", "Scaler algorithm, can be \"bilinear\", \"bicubic\", \"lanczos\", \"spline\", \"area\", \"neighbor\" or \"fast_bilinear\".")
+	cmdTranscode.PersistentFlags().String("color-range", "", "Output color range, can be \"tv\" or \"pc\" (default keeps the input range).")
+	cmdTranscode.PersistentFlags().String("tone-map", "", "Tone map HDR (PQ, HLG) input to SDR BT.709, can be \"hable\", \"mobius\" or \"reinhard\" (SDR input is not changed).")
+	cmdTranscode.PersistentFlags().Float32("tone-map-peak", 0, "Signal peak of tone mapping relative to 100 nits (0 uses the input metadata).")
+	cmdTranscode.PersistentFlags().Bool("preserve-hdr-metadata", false, "Keep the color signaling, mastering display and content light level metadata of the input.")
+	cmdTranscode.PersistentFlags().String("color-space", "", "Output color space, can be \"bt601\", \"smpte170m\", \"bt470bg\", \"bt709\", \"smpte240m\" or \"bt2020\".")
 	cmdTranscode.PersistentFlags().Int32P("video-frame-duration-ts", "", 0, "Frame duration of the output video in time base.")
 	cmdTranscode.PersistentFlags().Int64P("duration-ts", "", -1, "default -1 means entire stream.")
+	cmdTranscode.PersistentFlags().Float64("trim-start-sec", 0, "Start of the output in seconds from the start of the input, converted to start-time-ts.")
+	cmdTranscode.PersistentFlags().Float64("trim-end-sec", 0, "End of the output in seconds from the start of the input, converted to duration-ts.")
+	cmdTranscode.PersistentFlags().Bool("frame-accurate", false, "With bypass, xc-type all and mp4 format, start exactly at start-time-ts instead of at the key frame before it.")
 	cmdTranscode.PersistentFlags().Int64P("audio-seg-duration-ts", "", 0, "(mandatory if format is not 'segment' and transcoding audio) audio segment duration time base (positive integer).")
 	cmdTranscode.PersistentFlags().Int64P("video-seg-duration-ts", "", 0, "(mandatory if format is not 'segment' and transcoding video) video segment duration time base (positive integer).")
-	cmdTranscode.PersistentFlags().StringP("seg-duration", "", "30", "(mandatory if format is 'segment') segment duration seconds (positive integer), default is 30.")
+	cmdTranscode.PersistentFlags().StringP("seg-duration", "", "30", "(mandatory if format is 'segment') segment duration seconds, takes precedence over audio-seg-duration-ts and video-seg-duration-ts, default is 30 if they are not set.")
 	cmdTranscode.PersistentFlags().Int32P("seg-duration-fr", "", 0, "(mandatory if format is not 'segment') segment duration frame (positive integer).")
 	cmdTranscode.PersistentFlags().String("crypt-iv", "", "128-bit AES IV, as 32 char hex.")
 	cmdTranscode.PersistentFlags().String("crypt-key", "", "128-bit AES key, as 32 char hex.")
 	cmdTranscode.PersistentFlags().String("crypt-kid", "", "16-byte key ID, as 32 char hex.")
 	cmdTranscode.PersistentFlags().String("crypt-key-url", "", "specify a key URL in the manifest.")
+	cmdTranscode.PersistentFlags().String("key-rotation", "", "CENC key periods as start_segment:key:kid[:iv], comma separated (only segment and fmp4-segment formats).")
+	cmdTranscode.PersistentFlags().String("drm-systems", "", "pssh boxes as system_id[:base64 pssh data], comma separated (only dash, hls and fmp4-segment formats).")
+	cmdTranscode.PersistentFlags().String("inject-metadata", "", "ID3 PRIV timed metadata as pts:owner:data, comma separated, pts in the output video time base (only dash, hls and fmp4-segment formats).")
 	cmdTranscode.PersistentFlags().String("crypt-scheme", "none", "encryption scheme, default is 'none', can be: 'aes-128', 'cbc1', 'cbcs', 'cenc', 'cens'.")
 	cmdTranscode.PersistentFlags().String("wm-text", "", "add text to the watermark display.")
 	cmdTranscode.PersistentFlags().String("wm-timecode", "", "add timecode watermark to each frame.")
 	cmdTranscode.PersistentFlags().Float32("wm-timecode-rate", -1, "Watermark timecode frame rate.")
+	cmdTranscode.PersistentFlags().Bool("handle-pts-wraparound", true, "make the timestamps of inputs that wrap (i.e. MPEG-TS) monotonic across wraparounds and discontinuities.")
+	cmdTranscode.PersistentFlags().Bool("wm-timecode-auto", false, "add a timecode watermark starting at the source timecode (tmcd track), the rate defaults to the frame rate.")
 	cmdTranscode.PersistentFlags().String("wm-xloc", "", "the xLoc of the watermark as specified by a fraction of width.")
 	cmdTranscode.PersistentFlags().String("wm-yloc", "", "the yLoc of the watermark as specified by a fraction of height.")
 	cmdTranscode.PersistentFlags().Float32("wm-relative-size", 0.05, "font/shadow relative size based on frame height.")
@@ -359,6 +547,10 @@ func InitTranscode(cmdRoot *cobra.Command) error {
 	cmdTranscode.PersistentFlags().String("wm-shadow-color", "white", "watermark shadow color.")
 	cmdTranscode.PersistentFlags().String("wm-overlay", "", "watermark overlay image file.")
 	cmdTranscode.PersistentFlags().String("wm-overlay-type", "png", "watermark overlay image file type, can be 'png', 'jpg', 'gif'.")
+	cmdTranscode.PersistentFlags().String("wm-image-xloc", "", "the xLoc of the watermark overlay image, default is wm-xloc.")
+	cmdTranscode.PersistentFlags().String("wm-image-yloc", "", "the yLoc of the watermark overlay image, default is wm-yloc.")
+	cmdTranscode.PersistentFlags().Float32("wm-image-scale", 0, "width of the watermark overlay image relative to the frame width, 0 keeps the image size.")
+	cmdTranscode.PersistentFlags().Float32("wm-image-opacity", 0, "opacity of the watermark overlay image (0 - 1), 0 is opaque.")
 	cmdTranscode.PersistentFlags().String("max-cll", "", "Maximum Content Light Level and Maximum Frame Average Light Level, only valid if encoder is libx265.")
 	cmdTranscode.PersistentFlags().String("master-display", "", "Master display, only valid if encoder is libx265.")
 	cmdTranscode.PersistentFlags().Int32("bitdepth", 8, "Refers to number of colors each pixel can have, can be 8, 10, 12.")
@@ -366,9 +558,46 @@ func InitTranscode(cmdRoot *cobra.Command) error {
 	cmdTranscode.PersistentFlags().StringP("extract-images-ts", "", "", "the frames to extract (PTS, comma separated).")
 	cmdTranscode.PersistentFlags().BoolP("seekable", "", true, "seekable stream.")
 	cmdTranscode.PersistentFlags().Int32("rotate", 0, "Rotate the output video frame (valid values 0, 90, 180, 270).")
+	cmdTranscode.PersistentFlags().Bool("auto-rotate", false, "Rotate the output video frame by the display matrix of the input if rotate is not set.")
 	cmdTranscode.PersistentFlags().StringP("profile", "", "", "Encoding profile for video. If it is not determined, it will be set automatically.")
 	cmdTranscode.PersistentFlags().Int32("level", 0, "Encoding level for video. If it is not determined, it will be set automatically.")
-	cmdTranscode.PersistentFlags().Int32("deinterlace", 0, "Deinterlace filter (values 0 - none, 1 - bwdif_field, 2 - bwdif_frame send_frame).")
+	cmdTranscode.PersistentFlags().String("deinterlace", "none", "Deinterlace filter, can be \"none\", \"bwdif\", \"yadif\" or \"auto\" (bwdif only if the input is interlaced). The values 0 - none, 1 - bwdif_field, 2 - bwdif_frame are still accepted.")
+	cmdTranscode.PersistentFlags().Bool("deinterlace-send-field", false, "Deinterlace by sending one frame per field, which doubles the frame rate (needs video-frame-duration-ts).")
+	cmdTranscode.PersistentFlags().String("burn-subtitle", "", "subtitle file (SRT, WebVTT, ASS) to burn into the video.")
+	cmdTranscode.PersistentFlags().Int32("burn-subtitle-stream-index", 0, "subtitle stream index within the burn-subtitle file.")
+	cmdTranscode.PersistentFlags().String("burn-subtitle-font", "", "font name of burned subtitles.")
+	cmdTranscode.PersistentFlags().String("lut-file", "", "LUT file (.cube, .3dl, .dat, .m3d, .csp) to apply to the video for color grading.")
+	cmdTranscode.PersistentFlags().Int32("crop-x", 0, "left edge of the crop rectangle in source pixels.")
+	cmdTranscode.PersistentFlags().Int32("crop-y", 0, "top edge of the crop rectangle in source pixels.")
+	cmdTranscode.PersistentFlags().Int32("crop-w", 0, "width of the crop rectangle, applied before scaling (0 disables cropping).")
+	cmdTranscode.PersistentFlags().Int32("crop-h", 0, "height of the crop rectangle, applied before scaling (0 disables cropping).")
+	cmdTranscode.PersistentFlags().Int32("pad-left", 0, "padding left of the scaled video, added to the output width.")
+	cmdTranscode.PersistentFlags().Int32("pad-right", 0, "padding right of the scaled video, added to the output width.")
+	cmdTranscode.PersistentFlags().Int32("pad-top", 0, "padding above the scaled video, added to the output height.")
+	cmdTranscode.PersistentFlags().Int32("pad-bottom", 0, "padding below the scaled video, added to the output height.")
+	cmdTranscode.PersistentFlags().String("pad-color", "black", "color of the padding.")
+	cmdTranscode.PersistentFlags().Float32("burn-subtitle-relative-size", 0.05, "font size of burned subtitles relative to frame height.")
+	cmdTranscode.PersistentFlags().Int32("burn-subtitle-alignment", 2, "position of burned subtitles as an ASS numpad alignment (1-9), 2 is bottom center.")
+	cmdTranscode.PersistentFlags().Int32("burn-subtitle-margin-v", 10, "vertical margin of burned subtitles.")
+	cmdTranscode.PersistentFlags().Int32("live-drop-threshold", 0, "Drop video frames when more than this many video packets are queued, to keep up with a live input (0 disables).")
+	cmdTranscode.PersistentFlags().Int32("decode-progress-interval", 0, "Milliseconds between decode progress stats, at least 100 (0 disables).")
+	cmdTranscode.PersistentFlags().Bool("verify-segments", false, "Decode each output segment after it is written and report the ones that fail.")
+	cmdTranscode.PersistentFlags().Bool("fail-on-verify-error", false, "Fail the transcoding if a segment fails decode verification (needs verify-segments).")
+	cmdTranscode.PersistentFlags().Bool("frame-stats", false, "Log the pts, dts, size, key flag and quantizer of each frame written to the output.")
+	cmdTranscode.PersistentFlags().Bool("fill-gaps", false, "Fill the gaps of the input with silence (audio) and black frames (video) to keep them aligned.")
+	cmdTranscode.PersistentFlags().Int32("gap-threshold-ms", 0, "Gaps of the input larger than this are filled with fill-gaps (default 100 ms).")
+	cmdTranscode.PersistentFlags().Bool("sidecar-index", false, "Write a JSON index of the fragments of the fmp4 or cmaf output (index-stream<n>.json).")
+	cmdTranscode.PersistentFlags().Bool("align-segments", false, "Rebase the fmp4-segment outputs on seg-origin-pts, so separate audio and video transcodes have aligned segments.")
+	cmdTranscode.PersistentFlags().Int64("seg-origin-pts", 0, "Start of the first segment with align-segments, in the time base of the first video stream of the input.")
+	cmdTranscode.PersistentFlags().Int32("program-id", 0, "Program number of a multi-program MPEG-TS input to transcode (probe lists the programs).")
+	cmdTranscode.PersistentFlags().Int32("audio-delay-ms", 0, "Shift the audio by this many milliseconds to fix the lip-sync of the input, negative makes the audio earlier.")
+	cmdTranscode.PersistentFlags().String("video-filter", "", "FFmpeg filtergraph applied to the decoded video before scaling and watermarks (i.e \"hqdn3d,unsharp\").")
+	cmdTranscode.PersistentFlags().String("audio-filter", "", "FFmpeg filtergraph applied to the decoded audio before it is converted to the encoder format (i.e \"highpass=f=80\").")
+	cmdTranscode.PersistentFlags().Bool("faststart", false, "Write the moov box before the mdat box so the output can be played while it is downloaded (only mp4 and segment formats).")
+	cmdTranscode.PersistentFlags().Bool("extract-thumbnails", false, "Extract a JPEG thumbnail every thumbnail-interval-sec while transcoding video.")
+	cmdTranscode.PersistentFlags().Float32("thumbnail-interval-sec", 10, "Interval between extracted thumbnails in seconds.")
+	cmdTranscode.PersistentFlags().Int32("thumbnail-width", 0, "Width of extracted thumbnails, height keeps the aspect ratio (0 keeps the source width).")
+	cmdTranscode.PersistentFlags().Int32("subtitle-index", -1, "Subtitle stream index to extract as WebVTT when xc-type is 'subtitle' (-1 selects the first subtitle stream).")
 	cmdTranscode.PersistentFlags().Bool("copy-mpegts", false, "Create a copy of the MPEGTS input (for MPEGTS, SRT, RTP)")
 
 	return nil
@@ -406,6 +635,14 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Invalid listen flag")
 	}
 
+	inputFormat := cmd.Flag("input-format").Value.String()
+	inputOptions := cmd.Flag("input-options").Value.String()
+
+	logLevel := cmd.Flag("log-level").Value.String()
+	if err = avpipe.SetLogLevel(logLevel); err != nil {
+		return err
+	}
+
 	connectionTimeout, err := cmd.Flags().GetInt32("connection-timeout")
 	if err != nil {
 		return fmt.Errorf("Invalid connection-timeout flag")
@@ -456,15 +693,17 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 	audioDecoder := cmd.Flag("audio-decoder").Value.String()
 
 	format := cmd.Flag("format").Value.String()
-	if format != "dash" && format != "hls" && format != "mp4" && format != "fmp4" && format != "segment" && format != "fmp4-segment" && format != "image2" {
-		return fmt.Errorf("Package format is not valid, can be 'dash', 'hls', 'mp4', 'fmp4', 'segment', 'fmp4-segment', or 'image2'")
+	if format != "dash" && format != "hls" && format != "mp4" && format != "fmp4" && format != "cmaf" && format != "segment" && format != "fmp4-segment" && format != "image2" && format != "webm" {
+		return fmt.Errorf("Package format is not valid, can be 'dash', 'hls', 'mp4', 'fmp4', 'cmaf', 'segment', 'fmp4-segment', 'image2', or 'webm'")
 	}
 
 	filterDescriptor := cmd.Flag("filter-descriptor").Value.String()
 
 	watermarkTimecode := cmd.Flag("wm-timecode").Value.String()
 	watermarkTimecodeRate, _ := cmd.Flags().GetFloat32("wm-timecode-rate")
-	if len(watermarkTimecode) > 0 && watermarkTimecodeRate <= 0 {
+	watermarkTimecodeAuto, _ := cmd.Flags().GetBool("wm-timecode-auto")
+	handlePtsWraparound, _ := cmd.Flags().GetBool("handle-pts-wraparound")
+	if len(watermarkTimecode) > 0 && !watermarkTimecodeAuto && watermarkTimecodeRate <= 0 {
 		return fmt.Errorf("Watermark timecode rate is needed")
 	}
 	watermarkText := cmd.Flag("wm-text").Value.String()
@@ -475,6 +714,10 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 	watermarkShadow, _ := cmd.Flags().GetBool("watermark-shadow")
 	watermarkShadowColor := cmd.Flag("wm-shadow-color").Value.String()
 	watermarkOverlay := cmd.Flag("wm-overlay").Value.String()
+	watermarkImageXloc := cmd.Flag("wm-image-xloc").Value.String()
+	watermarkImageYloc := cmd.Flag("wm-image-yloc").Value.String()
+	watermarkImageScale, _ := cmd.Flags().GetFloat32("wm-image-scale")
+	watermarkImageOpacity, _ := cmd.Flags().GetFloat32("wm-image-opacity")
 
 	var watermarkOverlayType goavpipe.ImageType
 	watermarkOverlayTypeStr := cmd.Flag("wm-overlay-type").Value.String()
@@ -519,8 +762,10 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		xcTypeStr != "audio-pan" &&
 		xcTypeStr != "audio-merge" &&
 		xcTypeStr != "extract-images" &&
-		xcTypeStr != "extract-all-images" {
-		return fmt.Errorf("Transcoding type is not valid, with no stream-id can be 'all', 'video', 'audio', 'audio-join', 'audio-pan', 'audio-merge', or 'extract-images'")
+		xcTypeStr != "extract-all-images" &&
+		xcTypeStr != "subtitle" &&
+		xcTypeStr != "still" {
+		return fmt.Errorf("Transcoding type is not valid, with no stream-id can be 'all', 'video', 'audio', 'audio-join', 'audio-pan', 'audio-merge', 'extract-images', 'subtitle' or 'still'")
 	}
 	xcType := goavpipe.XcTypeFromString(xcTypeStr)
 	if xcType == goavpipe.XcAudio && len(encoder) == 0 {
@@ -550,11 +795,21 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("start-time-ts is not valid")
 	}
 
+	chunkKeyFrameTs, err := cmd.Flags().GetInt64("chunk-key-frame-ts")
+	if err != nil || chunkKeyFrameTs < 0 || chunkKeyFrameTs > startTimeTs {
+		return fmt.Errorf("chunk-key-frame-ts is not valid, must be >=0 and <= start-time-ts")
+	}
+
 	startPts, err := cmd.Flags().GetInt64("start-pts")
 	if err != nil || startPts < 0 {
 		return fmt.Errorf("start-pts is not valid, must be >=0")
 	}
 
+	outputBasePts, err := cmd.Flags().GetInt64("output-base-pts")
+	if err != nil || outputBasePts < 0 {
+		return fmt.Errorf("output-base-pts is not valid, must be >=0")
+	}
+
 	sampleRate, err := cmd.Flags().GetInt32("sample-rate")
 	if err != nil {
 		return fmt.Errorf("sample-rate is not valid")
@@ -570,6 +825,21 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("force-keyint is not valid")
 	}
 
+	maxBFrames, err := cmd.Flags().GetInt32("max-b-frames")
+	if err != nil || maxBFrames < -1 {
+		return fmt.Errorf("Invalid max-b-frames value")
+	}
+
+	refFrames, err := cmd.Flags().GetInt32("ref-frames")
+	if err != nil || refFrames < 0 {
+		return fmt.Errorf("Invalid ref-frames value")
+	}
+
+	closedGOP, err := cmd.Flags().GetBool("closed-gop")
+	if err != nil {
+		return fmt.Errorf("Invalid closed-gop flag")
+	}
+
 	startFragmentIndex, err := cmd.Flags().GetInt32("start-frag-index")
 	if err != nil {
 		return fmt.Errorf("start-frag-index is not valid")
@@ -585,6 +855,12 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("audio-bitrate is not valid")
 	}
 
+	audioChannelBitrate, err := cmd.Flags().GetInt32("audio-channel-bitrate")
+	if err != nil || audioChannelBitrate < 0 {
+		return fmt.Errorf("audio-channel-bitrate is not valid")
+	}
+	opusVbr := cmd.Flag("opus-vbr").Value.String()
+
 	rcMaxRate, err := cmd.Flags().GetInt32("rc-max-rate")
 	if err != nil {
 		return fmt.Errorf("rc-max-rate is not valid")
@@ -595,6 +871,11 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("rc-buffer-size is not valid")
 	}
 
+	rateControl := cmd.Flag("rate-control").Value.String()
+	if rateControl != "" && rateControl != "cbr" && rateControl != "vbr" && rateControl != "crf" && rateControl != "cvbr" {
+		return fmt.Errorf("rate-control is not valid, should be one of: 'cbr', 'vbr', 'crf', 'cvbr'")
+	}
+
 	encHeight, err := cmd.Flags().GetInt32("enc-height")
 	if err != nil {
 		return fmt.Errorf("enc-height is not valid")
@@ -615,23 +896,82 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("video-frame-duration-ts is not valid")
 	}
 
+	encFrameRate := cmd.Flag("enc-frame-rate").Value.String()
+	vfrHandling := cmd.Flag("vfr-handling").Value.String()
+	decodeThreads, err := cmd.Flags().GetInt32("decode-threads")
+	if err != nil || decodeThreads < 0 {
+		return fmt.Errorf("decode-threads is not valid")
+	}
+	encodeThreads, err := cmd.Flags().GetInt32("encode-threads")
+	if err != nil || encodeThreads < 0 {
+		return fmt.Errorf("encode-threads is not valid")
+	}
+	ioBufferSize, err := cmd.Flags().GetInt32("io-buffer-size")
+	if err != nil || ioBufferSize < 0 {
+		return fmt.Errorf("io-buffer-size is not valid")
+	}
+	threadType := cmd.Flag("thread-type").Value.String()
+	lowLatency, _ := cmd.Flags().GetBool("low-latency")
+	intraRefresh, _ := cmd.Flags().GetBool("intra-refresh")
+	var bitstreamFilters []string
+	if s := cmd.Flag("bitstream-filters").Value.String(); len(s) > 0 {
+		bitstreamFilters = strings.Split(s, ",")
+	}
+	muxerOpts, err := cmd.Flags().GetStringToString("muxer-opts")
+	if err != nil {
+		return fmt.Errorf("Invalid muxer-opts value")
+	}
+	encPixFmt := cmd.Flag("enc-pix-fmt").Value.String()
+	scaleAlgo := cmd.Flag("scale-algo").Value.String()
+	colorRange := cmd.Flag("color-range").Value.String()
+	colorSpace := cmd.Flag("color-space").Value.String()
+	toneMap := cmd.Flag("tone-map").Value.String()
+	toneMapPeak, err := cmd.Flags().GetFloat32("tone-map-peak")
+	if err != nil || toneMapPeak < 0 {
+		return fmt.Errorf("Invalid tone-map-peak value")
+	}
+
+	preserveHdrMetadata, err := cmd.Flags().GetBool("preserve-hdr-metadata")
+	if err != nil {
+		return fmt.Errorf("Invalid preserve-hdr-metadata flag")
+	}
+
 	durationTs, err := cmd.Flags().GetInt64("duration-ts")
 	if err != nil {
 		return fmt.Errorf("Duration ts is not valid")
 	}
 
+	trimStartSec, err := cmd.Flags().GetFloat64("trim-start-sec")
+	if err != nil || trimStartSec < 0 {
+		return fmt.Errorf("Invalid trim-start-sec value")
+	}
+
+	trimEndSec, err := cmd.Flags().GetFloat64("trim-end-sec")
+	if err != nil || trimEndSec < 0 {
+		return fmt.Errorf("Invalid trim-end-sec value")
+	}
+
+	frameAccurate, err := cmd.Flags().GetBool("frame-accurate")
+	if err != nil {
+		return fmt.Errorf("Invalid frame-accurate flag")
+	}
+
+	// The seg duration in seconds takes precedence over the seg duration ts, its default is only used
+	// when no seg duration ts is set
+	segDurationSet := cmd.Flags().Changed("seg-duration")
+
 	audioSegDurationTs, err := cmd.Flags().GetInt64("audio-seg-duration-ts")
 	if err != nil ||
-		(format != "segment" && format != "fmp4-segment" &&
-			audioSegDurationTs == 0 &&
+		(format != "segment" && format != "fmp4-segment" && format != "webm" &&
+			audioSegDurationTs == 0 && !segDurationSet &&
 			(xcType == goavpipe.XcAll || xcType == goavpipe.XcAudio ||
 				xcType == goavpipe.XcAudioJoin || xcType == goavpipe.XcAudioMerge)) {
 		return fmt.Errorf("Audio seg duration ts is not valid")
 	}
 
 	videoSegDurationTs, err := cmd.Flags().GetInt64("video-seg-duration-ts")
-	if err != nil || (format != "segment" && format != "fmp4-segment" && format != "mp4" &&
-		videoSegDurationTs == 0 && (xcType == goavpipe.XcAll || xcType == goavpipe.XcVideo)) {
+	if err != nil || (format != "segment" && format != "fmp4-segment" && format != "mp4" && format != "webm" &&
+		videoSegDurationTs == 0 && !segDurationSet && (xcType == goavpipe.XcAll || xcType == goavpipe.XcVideo)) {
 		return fmt.Errorf("Video seg duration ts is not valid")
 	}
 
@@ -639,6 +979,9 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 	if format == "segment" && len(segDuration) == 0 {
 		return fmt.Errorf("Seg duration ts is not valid")
 	}
+	if !segDurationSet && (audioSegDurationTs > 0 || videoSegDurationTs > 0) {
+		segDuration = ""
+	}
 
 	crfStr := strconv.Itoa(int(crf))
 	startSegmentStr := strconv.Itoa(int(startSegment))
@@ -648,6 +991,11 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		return fmt.Errorf("Invalid rotate value")
 	}
 
+	autoRotate, err := cmd.Flags().GetBool("auto-rotate")
+	if err != nil {
+		return fmt.Errorf("Invalid auto-rotate flag")
+	}
+
 	level, err := cmd.Flags().GetInt32("level")
 	if err != nil {
 		return fmt.Errorf("Invalid level value")
@@ -655,11 +1003,166 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 
 	profile := cmd.Flag("profile").Value.String()
 
-	deinterlace, err := cmd.Flags().GetInt32("deinterlace")
+	deinterlaceSendField, err := cmd.Flags().GetBool("deinterlace-send-field")
 	if err != nil {
+		return fmt.Errorf("Invalid deinterlace-send-field flag")
+	}
+
+	deinterlaceStr := cmd.Flag("deinterlace").Value.String()
+	deinterlaceAuto := deinterlaceStr == "auto"
+	if deinterlaceAuto {
+		deinterlaceStr = "bwdif"
+	}
+	deinterlace, err := strconv.Atoi(deinterlaceStr)
+	if err != nil {
+		deinterlace, err = goavpipe.DeinterlaceFromString(deinterlaceStr, deinterlaceSendField)
+	}
+	if err != nil || deinterlace < goavpipe.DeinterlaceNone || deinterlace > goavpipe.DeinterlaceYadifFrame {
 		return fmt.Errorf("Invalid deinterlace value")
 	}
 
+	subtitleIndex, err := cmd.Flags().GetInt32("subtitle-index")
+	if err != nil {
+		return fmt.Errorf("Invalid subtitle-index value")
+	}
+
+	liveDropThreshold, err := cmd.Flags().GetInt32("live-drop-threshold")
+	if err != nil || liveDropThreshold < 0 {
+		return fmt.Errorf("Invalid live-drop-threshold value")
+	}
+
+	decodeProgressInterval, err := cmd.Flags().GetInt32("decode-progress-interval")
+	if err != nil || decodeProgressInterval < 0 {
+		return fmt.Errorf("Invalid decode-progress-interval value")
+	}
+
+	verifySegments, err := cmd.Flags().GetBool("verify-segments")
+	if err != nil {
+		return fmt.Errorf("Invalid verify-segments flag")
+	}
+
+	failOnVerifyError, err := cmd.Flags().GetBool("fail-on-verify-error")
+	if err != nil {
+		return fmt.Errorf("Invalid fail-on-verify-error flag")
+	}
+
+	fastStart, err := cmd.Flags().GetBool("faststart")
+	if err != nil {
+		return fmt.Errorf("Invalid faststart flag")
+	}
+
+	fillGaps, err := cmd.Flags().GetBool("fill-gaps")
+	if err != nil {
+		return fmt.Errorf("Invalid fill-gaps flag")
+	}
+
+	gapThresholdMs, err := cmd.Flags().GetInt32("gap-threshold-ms")
+	if err != nil || gapThresholdMs < 0 {
+		return fmt.Errorf("Invalid gap-threshold-ms value")
+	}
+
+	sidecarIndex, err := cmd.Flags().GetBool("sidecar-index")
+	if err != nil {
+		return fmt.Errorf("Invalid sidecar-index flag")
+	}
+
+	alignSegments, err := cmd.Flags().GetBool("align-segments")
+	if err != nil {
+		return fmt.Errorf("Invalid align-segments flag")
+	}
+
+	segOriginPts, err := cmd.Flags().GetInt64("seg-origin-pts")
+	if err != nil || segOriginPts < 0 {
+		return fmt.Errorf("seg-origin-pts is not valid, must be >= 0")
+	}
+
+	programID, err := cmd.Flags().GetInt32("program-id")
+	if err != nil || programID < 0 {
+		return fmt.Errorf("program-id is not valid, must be >= 0")
+	}
+
+	audioDelayMs, err := cmd.Flags().GetInt32("audio-delay-ms")
+	if err != nil {
+		return fmt.Errorf("audio-delay-ms is not valid")
+	}
+
+	videoFilter := cmd.Flag("video-filter").Value.String()
+	audioFilter := cmd.Flag("audio-filter").Value.String()
+
+	extractThumbnails, err := cmd.Flags().GetBool("extract-thumbnails")
+	if err != nil {
+		return fmt.Errorf("Invalid extract-thumbnails flag")
+	}
+
+	thumbnailIntervalSec, err := cmd.Flags().GetFloat32("thumbnail-interval-sec")
+	if err != nil || thumbnailIntervalSec <= 0 {
+		return fmt.Errorf("Invalid thumbnail-interval-sec value")
+	}
+
+	thumbnailWidth, err := cmd.Flags().GetInt32("thumbnail-width")
+	if err != nil || thumbnailWidth < 0 {
+		return fmt.Errorf("Invalid thumbnail-width value")
+	}
+
+	cropX, err := cmd.Flags().GetInt32("crop-x")
+	if err != nil || cropX < 0 {
+		return fmt.Errorf("Invalid crop-x value")
+	}
+
+	cropY, err := cmd.Flags().GetInt32("crop-y")
+	if err != nil || cropY < 0 {
+		return fmt.Errorf("Invalid crop-y value")
+	}
+
+	cropW, err := cmd.Flags().GetInt32("crop-w")
+	if err != nil || cropW < 0 {
+		return fmt.Errorf("Invalid crop-w value")
+	}
+
+	cropH, err := cmd.Flags().GetInt32("crop-h")
+	if err != nil || cropH < 0 {
+		return fmt.Errorf("Invalid crop-h value")
+	}
+
+	padLeft, err := cmd.Flags().GetInt32("pad-left")
+	if err != nil || padLeft < 0 {
+		return fmt.Errorf("Invalid pad-left value")
+	}
+
+	padRight, err := cmd.Flags().GetInt32("pad-right")
+	if err != nil || padRight < 0 {
+		return fmt.Errorf("Invalid pad-right value")
+	}
+
+	padTop, err := cmd.Flags().GetInt32("pad-top")
+	if err != nil || padTop < 0 {
+		return fmt.Errorf("Invalid pad-top value")
+	}
+
+	padBottom, err := cmd.Flags().GetInt32("pad-bottom")
+	if err != nil || padBottom < 0 {
+		return fmt.Errorf("Invalid pad-bottom value")
+	}
+
+	padColor := cmd.Flag("pad-color").Value.String()
+
+	burnSubtitle := cmd.Flag("burn-subtitle").Value.String()
+	burnSubtitleFont := cmd.Flag("burn-subtitle-font").Value.String()
+	lutFile := cmd.Flag("lut-file").Value.String()
+	burnSubtitleRelativeSize, _ := cmd.Flags().GetFloat32("burn-subtitle-relative-size")
+	burnSubtitleStreamIndex, err := cmd.Flags().GetInt32("burn-subtitle-stream-index")
+	if err != nil || burnSubtitleStreamIndex < 0 {
+		return fmt.Errorf("Invalid burn-subtitle-stream-index value")
+	}
+	burnSubtitleAlignment, err := cmd.Flags().GetInt32("burn-subtitle-alignment")
+	if err != nil || burnSubtitleAlignment < 1 || burnSubtitleAlignment > 9 {
+		return fmt.Errorf("Invalid burn-subtitle-alignment value, must be 1 - 9")
+	}
+	burnSubtitleMarginV, err := cmd.Flags().GetInt32("burn-subtitle-margin-v")
+	if err != nil {
+		return fmt.Errorf("Invalid burn-subtitle-margin-v value")
+	}
+
 	copyMpegts, err := cmd.Flags().GetBool("copy-mpegts")
 	if err != nil {
 		return fmt.Errorf("Invalid copy-mpegts value")
@@ -701,76 +1204,165 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 	}
 
 	params := &goavpipe.XcParams{
-		Url:                    filename,
-		BypassTranscoding:      bypass,
-		Format:                 format,
-		StartTimeTs:            startTimeTs,
-		StartPts:               startPts,
-		DurationTs:             durationTs,
-		StartSegmentStr:        startSegmentStr,
-		StartFragmentIndex:     startFragmentIndex,
-		VideoBitrate:           videoBitrate,
-		AudioBitrate:           audioBitrate,
-		SampleRate:             sampleRate,
-		CrfStr:                 crfStr,
-		Preset:                 preset,
-		AudioSegDurationTs:     audioSegDurationTs,
-		VideoSegDurationTs:     videoSegDurationTs,
-		SegDuration:            segDuration,
-		Ecodec:                 encoder,
-		Ecodec2:                audioEncoder,
-		Dcodec:                 decoder,
-		Dcodec2:                audioDecoder,
-		EncHeight:              encHeight, // -1 means use source height, other values 2160, 720
-		EncWidth:               encWidth,  // -1 means use source width, other values 3840, 1280
-		CryptIV:                cryptIV,
-		CryptKey:               cryptKey,
-		CryptKID:               cryptKID,
-		CryptKeyURL:            cryptKeyURL,
-		CryptScheme:            cryptScheme,
-		XcType:                 xcType,
-		CopyMpegts:             copyMpegts,
-		WatermarkTimecode:      watermarkTimecode,
-		WatermarkTimecodeRate:  watermarkTimecodeRate,
-		WatermarkText:          watermarkText,
-		WatermarkXLoc:          watermarkXloc,
-		WatermarkYLoc:          watermarkYloc,
-		WatermarkRelativeSize:  watermarkRelativeSize,
-		WatermarkFontColor:     watermarkFontColor,
-		WatermarkShadow:        watermarkShadow,
-		WatermarkShadowColor:   watermarkShadowColor,
-		WatermarkOverlay:       string(overlayImage),
-		WatermarkOverlayType:   watermarkOverlayType,
-		ForceKeyInt:            forceKeyInterval,
-		RcMaxRate:              rcMaxRate,
-		RcBufferSize:           rcBufferSize,
-		GPUIndex:               gpuIndex,
-		MaxCLL:                 maxCLL,
-		MasterDisplay:          masterDisplay,
-		BitDepth:               bitDepth,
-		ForceEqualFDuration:    forceEqualFrameDuration,
-		SyncAudioToStreamId:    int(syncAudioToStreamId),
-		StreamId:               streamId,
-		Listen:                 listen,
-		ConnectionTimeout:      int(connectionTimeout),
-		FilterDescriptor:       filterDescriptor,
-		SkipDecoding:           skipDecoding,
-		ExtractImageIntervalTs: extractImageIntervalTs,
-		ChannelLayout:          channelLayout,
-		DebugFrameLevel:        debugFrameLevel,
-		VideoTimeBase:          int(videoTimeBase),
-		VideoFrameDurationTs:   int(videoFrameDurationTs),
-		Seekable:               seekable,
-		Rotate:                 int(rotate),
-		Profile:                profile,
-		Level:                  int(level),
-		Deinterlace:            int(deinterlace),
+		Url:                      filename,
+		BypassTranscoding:        bypass,
+		Format:                   format,
+		StartTimeTs:              startTimeTs,
+		StartPts:                 startPts,
+		DurationTs:               durationTs,
+		TrimStartSec:             trimStartSec,
+		TrimEndSec:               trimEndSec,
+		FrameAccurate:            frameAccurate,
+		StartSegmentStr:          startSegmentStr,
+		StartFragmentIndex:       startFragmentIndex,
+		VideoBitrate:             videoBitrate,
+		AudioBitrate:             audioBitrate,
+		SampleRate:               sampleRate,
+		CrfStr:                   crfStr,
+		Preset:                   preset,
+		AudioSegDurationTs:       audioSegDurationTs,
+		VideoSegDurationTs:       videoSegDurationTs,
+		SegDuration:              segDuration,
+		Ecodec:                   encoder,
+		Ecodec2:                  audioEncoder,
+		Dcodec:                   decoder,
+		Dcodec2:                  audioDecoder,
+		EncHeight:                encHeight, // -1 means use source height, other values 2160, 720
+		EncWidth:                 encWidth,  // -1 means use source width, other values 3840, 1280
+		CryptIV:                  cryptIV,
+		CryptKey:                 cryptKey,
+		CryptKID:                 cryptKID,
+		CryptKeyURL:              cryptKeyURL,
+		CryptScheme:              cryptScheme,
+		XcType:                   xcType,
+		CopyMpegts:               copyMpegts,
+		WatermarkTimecode:        watermarkTimecode,
+		WatermarkTimecodeRate:    watermarkTimecodeRate,
+		WatermarkText:            watermarkText,
+		WatermarkXLoc:            watermarkXloc,
+		WatermarkYLoc:            watermarkYloc,
+		WatermarkRelativeSize:    watermarkRelativeSize,
+		WatermarkFontColor:       watermarkFontColor,
+		WatermarkShadow:          watermarkShadow,
+		WatermarkShadowColor:     watermarkShadowColor,
+		WatermarkOverlay:         string(overlayImage),
+		WatermarkOverlayType:     watermarkOverlayType,
+		WatermarkImageXLoc:       watermarkImageXloc,
+		WatermarkImageYLoc:       watermarkImageYloc,
+		WatermarkImageScale:      watermarkImageScale,
+		WatermarkImageOpacity:    watermarkImageOpacity,
+		WatermarkTimecodeAuto:    watermarkTimecodeAuto,
+		HandlePtsWraparound:      handlePtsWraparound,
+		ForceKeyInt:              forceKeyInterval,
+		MaxBFrames:               maxBFrames,
+		RefFrames:                refFrames,
+		ClosedGOP:                closedGOP,
+		RcMaxRate:                rcMaxRate,
+		RcBufferSize:             rcBufferSize,
+		RateControl:              rateControl,
+		GPUIndex:                 gpuIndex,
+		MaxCLL:                   maxCLL,
+		MasterDisplay:            masterDisplay,
+		BitDepth:                 bitDepth,
+		ForceEqualFDuration:      forceEqualFrameDuration,
+		SyncAudioToStreamId:      int(syncAudioToStreamId),
+		StreamId:                 streamId,
+		Listen:                   listen,
+		InputFormat:              inputFormat,
+		InputOptions:             inputOptions,
+		ConnectionTimeout:        int(connectionTimeout),
+		FilterDescriptor:         filterDescriptor,
+		SkipDecoding:             skipDecoding,
+		ExtractImageIntervalTs:   extractImageIntervalTs,
+		ChannelLayout:            channelLayout,
+		DebugFrameLevel:          debugFrameLevel,
+		VideoTimeBase:            int(videoTimeBase),
+		VideoFrameDurationTs:     int(videoFrameDurationTs),
+		EncFrameRate:             encFrameRate,
+		VFRHandling:              vfrHandling,
+		DecodeThreads:            decodeThreads,
+		EncodeThreads:            encodeThreads,
+		IOBufferSize:             ioBufferSize,
+		ChunkKeyFrameTs:          chunkKeyFrameTs,
+		MuxerOpts:                muxerOpts,
+		ThreadType:               threadType,
+		LowLatency:               lowLatency,
+		IntraRefresh:             intraRefresh,
+		OpusVbr:                  opusVbr,
+		AudioChannelBitrate:      audioChannelBitrate,
+		BitstreamFilters:         bitstreamFilters,
+		EncPixFmt:                encPixFmt,
+		ScaleAlgo:                scaleAlgo,
+		ColorRange:               colorRange,
+		ColorSpace:               colorSpace,
+		ToneMap:                  toneMap,
+		ToneMapPeak:              toneMapPeak,
+		PreserveHdrMetadata:      preserveHdrMetadata,
+		Seekable:                 seekable,
+		Rotate:                   int(rotate),
+		AutoRotate:               autoRotate,
+		Profile:                  profile,
+		Level:                    int(level),
+		Deinterlace:              deinterlace,
+		DeinterlaceAuto:          deinterlaceAuto,
+		SubtitleIndex:            subtitleIndex,
+		BurnSubtitleFile:         burnSubtitle,
+		BurnSubtitleStreamIndex:  burnSubtitleStreamIndex,
+		BurnSubtitleFont:         burnSubtitleFont,
+		BurnSubtitleRelativeSize: burnSubtitleRelativeSize,
+		BurnSubtitleAlignment:    burnSubtitleAlignment,
+		BurnSubtitleMarginV:      burnSubtitleMarginV,
+		LiveDropThreshold:        liveDropThreshold,
+		DecodeProgressInterval:   decodeProgressInterval,
+		VerifySegments:           verifySegments,
+		FailOnVerifyError:        failOnVerifyError,
+		FastStart:                fastStart,
+		FillGaps:                 fillGaps,
+		GapThresholdMs:           gapThresholdMs,
+		SidecarIndex:             sidecarIndex,
+		AlignSegments:            alignSegments,
+		SegOriginPts:             segOriginPts,
+		ProgramID:                programID,
+		AudioDelayMs:             audioDelayMs,
+		VideoFilter:              videoFilter,
+		AudioFilter:              audioFilter,
+		ExtractThumbnails:        extractThumbnails,
+		ThumbnailIntervalSec:     thumbnailIntervalSec,
+		ThumbnailWidth:           thumbnailWidth,
+		OutputBasePts:            outputBasePts,
+		LutFile:                  lutFile,
+		CropX:                    cropX,
+		CropY:                    cropY,
+		CropW:                    cropW,
+		CropH:                    cropH,
+		PadLeft:                  padLeft,
+		PadRight:                 padRight,
+		PadTop:                   padTop,
+		PadBottom:                padBottom,
+		PadColor:                 padColor,
 	}
 
 	err = getAudioIndexes(params, audioIndex)
 	if err != nil {
 		return err
 	}
+	params.AudioLanguage = cmd.Flag("audio-language").Value.String()
+
+	streamMap := cmd.Flag("stream-map").Value.String()
+	if err = parseStreamMap(params, streamMap); err != nil {
+		return err
+	}
+
+	frameStats, err := cmd.Flags().GetBool("frame-stats")
+	if err != nil {
+		return fmt.Errorf("Invalid frame-stats flag")
+	}
+	if frameStats {
+		params.FrameCallback = func(f goavpipe.FrameDebugInfo) {
+			log.Info("AVCMD frame", "streamIndex", f.StreamIndex, "audio", f.IsAudio, "pts", f.PTS, "dts", f.DTS,
+				"duration", f.Duration, "size", f.Size, "key", f.KeyFrame, "qp", f.Quantizer)
+		}
+	}
 
 	params.WatermarkOverlayLen = len(params.WatermarkOverlay)
 
@@ -779,6 +1371,26 @@ func doTranscode(cmd *cobra.Command, args []string) error {
 		return err
 	}
 
+	forceKeyframesAt := cmd.Flag("force-keyframes-at").Value.String()
+	if err = parseForceKeyframesAt(params, forceKeyframesAt); err != nil {
+		return err
+	}
+
+	keyRotation := cmd.Flag("key-rotation").Value.String()
+	if err = parseKeyRotation(params, keyRotation); err != nil {
+		return err
+	}
+
+	drmSystems := cmd.Flag("drm-systems").Value.String()
+	if err = parseDrmSystems(params, drmSystems); err != nil {
+		return err
+	}
+
+	injectMetadata := cmd.Flag("inject-metadata").Value.String()
+	if err = parseInjectMetadata(params, injectMetadata); err != nil {
+		return err
+	}
+
 	avpipe.InitIOHandler(&elvxcInputOpener{url: filename}, &elvxcOutputOpener{dir: dir})
 
 	done := make(chan interface{})
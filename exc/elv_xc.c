@@ -12,6 +12,7 @@
 #include <fcntl.h>
 #include <libavutil/log.h>
 #include <libavutil/pixdesc.h>
+#include <libavutil/base64.h>
 #include <errno.h>
 #include <pthread.h>
 
@@ -362,6 +363,19 @@ in_stat(
         if (debug_frame_level)
             elv_dbg("IN STAT stream_index=%d, fd=%d, video frame read=%"PRId64, stream_index, fd, c->video_frames_read);
         break;
+    case in_stat_video_frames_dropped:
+        if (debug_frame_level)
+            elv_dbg("IN STAT stream_index=%d, fd=%d, video frames dropped=%"PRId64, stream_index, fd, c->video_frames_dropped);
+        break;
+    case in_stat_decode_progress:
+        elv_log("IN STAT stream_index=%d, fd=%d, decode progress video_frames_decoded=%"PRId64
+            ", audio_frames_decoded=%"PRId64", input_pts=%"PRId64", packets_dropped=%"PRId64
+            ", video_frames_dropped=%"PRId64,
+            stream_index, fd, c->decode_progress.video_frames_decoded, c->decode_progress.audio_frames_decoded,
+            c->decode_progress.input_pts,
+            c->decode_progress.video_packets_dropped + c->decode_progress.audio_packets_dropped,
+            c->decode_progress.video_frames_dropped);
+        break;
     case in_stat_first_keyframe_pts:
         if (debug_frame_level)
             elv_dbg("IN STAT fd=%d, first keyframe PTS=%"PRId64", url=%s", fd, c->first_key_frame_pts, c->url);
@@ -370,6 +384,21 @@ in_stat(
         if (debug_frame_level)
             elv_dbg("IN STAT stream_index=%d, fd=%d, data=%s", stream_index, fd, c->data);
         break;
+    case in_stat_scte35:
+        elv_log("IN STAT stream_index=%d, fd=%d, SCTE-35 PTS=%"PRId64", command=%d, size=%d",
+            stream_index, fd, c->scte35_event.pts, c->scte35_event.command_type, c->scte35_event.data_len);
+        break;
+    case in_stat_xc_timing:
+        elv_log("IN STAT fd=%d, timing decode=%"PRId64" filter=%"PRId64" encode=%"PRId64" mux=%"PRId64" total=%"PRId64" (ns)",
+            fd, c->xc_timing.decode_ns, c->xc_timing.filter_ns, c->xc_timing.encode_ns,
+            c->xc_timing.mux_ns, c->xc_timing.total_ns);
+        break;
+    case in_stat_frame:
+        elv_log("IN STAT stream_index=%d, fd=%d, %s frame pts=%"PRId64" dts=%"PRId64" duration=%"PRId64" size=%d key=%d qp=%d",
+            stream_index, fd, c->frame_info[stream_index].is_audio ? "audio" : "video",
+            c->frame_info[stream_index].pts, c->frame_info[stream_index].dts, c->frame_info[stream_index].duration,
+            c->frame_info[stream_index].size, c->frame_info[stream_index].key_frame, c->frame_info[stream_index].quantizer);
+        break;
     default:
         elv_err("IN STAT stream_index=%d, fd=%d, invalid input stat=%d", stream_index, fd, stat_type);
         return 1;
@@ -480,6 +509,30 @@ out_opener(
         }
         break;
 
+    case avpipe_webvtt_init_stream:
+        sprintf(segname, "./%s/vtt-init.vtt", dir);
+        break;
+
+    case avpipe_webvtt_segment:
+        sprintf(segname, "./%s/vtt-segment-%05d.vtt", dir, outctx->seg_index);
+        break;
+
+    case avpipe_image_thumbnail:
+        sprintf(segname, "./%s/thumbnail-%d.jpeg", dir, outctx->seg_index);
+        break;
+
+    case avpipe_video_webm_stream:
+        sprintf(segname, "./%s/webm-video.webm", dir);
+        break;
+
+    case avpipe_audio_webm_stream:
+        sprintf(segname, "./%s/webm-audio%d.webm", dir, outctx->stream_index);
+        break;
+
+    case avpipe_index_sidecar:
+        sprintf(segname, "./%s/index-stream%d.json", dir, outctx->stream_index);
+        break;
+
     case avpipe_image:
         {
             sprintf(segname, "%s/%s", dir, url);
@@ -499,7 +552,7 @@ out_opener(
     outctx->opaque = (int *) malloc(sizeof(int));
     *((int *)(outctx->opaque)) = fd;
 
-    outctx->bufsz = AVIO_OUT_BUF_SIZE;
+    outctx->bufsz = (inctx->params && inctx->params->io_buffer_size > 0) ? inctx->params->io_buffer_size : AVIO_OUT_BUF_SIZE;
     outctx->buf = (unsigned char *)malloc(outctx->bufsz); /* Must be malloc'd - will be realloc'd by avformat */
     elv_dbg("OUT OPEN outctx=%p, path=%s, type=%d, fd=%d, seg_index=%d\n", outctx, segname, outctx->type, fd, outctx->seg_index);
     return 0;
@@ -638,6 +691,8 @@ out_stat(
         outctx->type != avpipe_audio_segment &&
         outctx->type != avpipe_mp4_stream &&
         outctx->type != avpipe_fmp4_stream &&
+        outctx->type != avpipe_video_webm_stream &&
+        outctx->type != avpipe_audio_webm_stream &&
         outctx->type != avpipe_mp4_segment &&
         outctx->type != avpipe_video_fmp4_segment &&
         outctx->type != avpipe_audio_fmp4_segment)
@@ -656,6 +711,16 @@ out_stat(
                 stream_index, fd, outctx->encoder_ctx->video_last_pts_sent_encode,
                 outctx->encoder_ctx->audio_last_pts_sent_encode);
         break;
+    case out_stat_segment_verify_failed:
+        elv_log("OUT STAT stream_index=%d, fd=%d, type=%d, segment failed decode verification seg_index=%d",
+            stream_index, fd, outctx->type, outctx->seg_index);
+        break;
+    case out_stat_segment_done:
+        elv_log("OUT STAT stream_index=%d, fd=%d, type=%d, segment done seg_index=%d, start_pts=%"PRId64
+            ", end_pts=%"PRId64", bytes=%"PRId64", frames=%"PRId64,
+            stream_index, fd, outctx->type, outctx->seg_index, outctx->seg_start_pts,
+            outctx->seg_end_pts, outctx->written_bytes, outctx->seg_frames);
+        break;
     case out_stat_frame_written:
         if (xcparams->debug_frame_level)
             elv_dbg("OUT STAT stream_index=%d, fd=%d, type=%d, total_frames_written=%"PRId64
@@ -765,6 +830,12 @@ xc_type_from_string(
     if (!strcmp(xc_type_str, "extract-all-images"))
         return xc_extract_all_images;
 
+    if (!strcmp(xc_type_str, "subtitle"))
+        return xc_subtitle;
+
+    if (!strcmp(xc_type_str, "still"))
+        return xc_still;
+
     return xc_none;
 }
 
@@ -866,9 +937,35 @@ do_probe(
     }
     printf("Container\n"
         "\tformat_name: %s\n"
-        "\tduration: %.5f\n",
+        "\tduration: %.5f\n"
+        "\tis_image: %d\n",
         probe->container_info.format_name,
-        probe->container_info.duration);
+        probe->container_info.duration,
+        probe->container_info.is_image);
+
+    if (probe->container_info.tags != NULL) {
+        printf("\ttags:\n");
+        AVDictionaryEntry *tag = NULL;
+        while ((tag = av_dict_get(probe->container_info.tags, "", tag, AV_DICT_IGNORE_SUFFIX))) {
+            printf("\t\t%s: %s\n", tag->key, tag->value);
+        }
+    }
+
+    for (int i=0; i<probe->n_programs; i++) {
+        printf("Program[%d]\n"
+            "\tstream_indexes:", probe->program_info[i].program_id);
+        for (int j=0; j<probe->program_info[i].n_stream_indexes; j++)
+            printf(" %d", probe->program_info[i].stream_indexes[j]);
+        printf("\n");
+
+        if (probe->program_info[i].tags != NULL) {
+            printf("\ttags:\n");
+            AVDictionaryEntry *tag = NULL;
+            while ((tag = av_dict_get(probe->program_info[i].tags, "", tag, AV_DICT_IGNORE_SUFFIX))) {
+                printf("\t\t%s: %s\n", tag->key, tag->value);
+            }
+        }
+    }
 
 end_probe:
     elv_dbg("Releasing probe resources");
@@ -1013,6 +1110,118 @@ static int get_extract_images_ts(char *s, xcparams_t *params) {
     return i;
 }
 
+/*
+ * Parses the key frame times in sec, comma separated.
+ * Returns the number of times, or -1 if a time is invalid.
+ */
+static int
+get_force_keyframes_at(
+    char *s,
+    xcparams_t *params)
+{
+    int i;
+    char *lasts;
+    char *t;
+    int sz = 1;
+
+    for (i = 0; i < strlen(s); i++) {
+        if (s[i] == ',')
+            sz++;
+    }
+    init_force_keyframes(params, sz);
+
+    i = 0;
+    t = strtok_r(s, ",", &lasts);
+    while (t && i < sz) {
+        if (sscanf(t, "%lf", &params->force_keyframes_at[i]) != 1)
+            return -1;
+        i++;
+        t = strtok_r(NULL, ",", &lasts);
+    }
+
+    return i;
+}
+
+/*
+ * Parses the key periods "start_segment:key:kid[:iv]", comma separated.
+ * Returns the number of key periods, or -1 if a key period is invalid.
+ */
+static int
+get_key_periods(
+    char *s,
+    xcparams_t *params)
+{
+    char key[33], kid[33], iv[33];
+    char *lasts;
+    char *period;
+    int start_segment;
+    int i, n, sz = 1;
+
+    for (i = 0; i < strlen(s); i++) {
+        if (s[i] == ',')
+            sz++;
+    }
+    init_key_periods(params, sz);
+
+    i = 0;
+    period = strtok_r(s, ",", &lasts);
+    while (period && i < sz) {
+        iv[0] = '\0';
+        n = sscanf(period, "%d:%32[0-9a-fA-F]:%32[0-9a-fA-F]:%32[0-9a-fA-F]", &start_segment, key, kid, iv);
+        if (n != 3 && n != 4)
+            return -1;
+        set_key_period(params, i, start_segment, key, kid, iv);
+        i++;
+        period = strtok_r(NULL, ",", &lasts);
+    }
+
+    return i;
+}
+
+/*
+ * Parses the DRM systems "system_id[:base64 pssh data]", comma separated.
+ * Returns the number of DRM systems, or -1 if the pssh data is invalid.
+ */
+static int
+get_drm_systems(
+    char *s,
+    xcparams_t *params)
+{
+    char *lasts;
+    char *system;
+    int i, sz = 1;
+
+    for (i = 0; i < strlen(s); i++) {
+        if (s[i] == ',')
+            sz++;
+    }
+    init_drm_systems(params, sz);
+
+    i = 0;
+    system = strtok_r(s, ",", &lasts);
+    while (system && i < sz) {
+        char *pssh = strchr(system, ':');
+        uint8_t *pssh_data = NULL;
+        int pssh_data_len = 0;
+
+        if (pssh) {
+            *pssh++ = '\0';
+            pssh_data = (uint8_t *) calloc(1, AV_BASE64_DECODE_SIZE(strlen(pssh)));
+            pssh_data_len = av_base64_decode(pssh_data, pssh, AV_BASE64_DECODE_SIZE(strlen(pssh)));
+            if (pssh_data_len < 0) {
+                free(pssh_data);
+                return -1;
+            }
+        }
+        set_drm_system(params, i, system, pssh_data, pssh_data_len);
+        free(pssh_data);
+        i++;
+        system = strtok_r(NULL, ",", &lasts);
+    }
+
+    return i;
+}
+
 static void
 usage(
     char *progname,
@@ -1023,17 +1232,32 @@ usage(
     printf(
         "Invalid parameter: %s\n\n"
         "Usage: %s <params>\n"
+        "\t-align-segments :        (optional) Default 0. If 1, rebase the fmp4-segment outputs on -seg-origin-pts to align the segments of separate audio and video runs\n"
         "\t-audio-bitrate :         (optional) Default: 128000\n"
+        "\t-audio-channel-bitrate : (optional) Bit rate per channel for \"ac3\" and \"eac3\", overrides -audio-bitrate\n"
+        "\t-audio-delay-ms :        (optional) Default 0. Shift the audio by this many milliseconds to fix the lip-sync of the input, negative makes the audio earlier\n"
         "\t-audio-decoder :         (optional) Audio decoder name. For audio default is \"aac\", but for ts files should be set to \"ac3\"\n"
-        "\t-audio-encoder :         (optional) Audio encoder name. Default is \"aac\", can be \"ac3\", \"mp2\" or \"mp3\"\n"
+        "\t-audio-encoder :         (optional) Audio encoder name. Default is \"aac\", can be \"ac3\", \"eac3\", \"libopus\", \"mp2\" or \"mp3\"\n"
+        "\t-audio-filter :          (optional) FFmpeg filtergraph applied to the decoded audio before it is converted to the encoder format (i.e \"highpass=f=80\")\n"
         "\t-audio-index :           (optional) Default: the indexes of audio stream (comma separated)\n"
+        "\t-audio-language :        (optional) Language tag of the audio stream to transcode (i.e \"eng\"), instead of -audio-index\n"
         "\t-audio-seg-duration-ts : (mandatory If format is not \"segment\" and transcoding audio) audio segment duration time base (positive integer).\n"
+        "\t-auto-rotate :           (optional) Default 0. If 1, rotate the video by the display matrix of the input when -rotate is not set.\n"
         "\t-bitdepth :              (optional) Bitdepth of color space. Default is 8, can be 8, 10, or 12.\n"
+        "\t-bitstream-filters :     (optional) Comma separated bitstream filters of the copied streams with -bypass 1 (i.e \"h264_mp4toannexb\")\n"
         "\t-bypass :                (optional) Bypass transcoding. Default is 0, must be 0 or 1\n"
         "\t-channel-layout :        (optional) Channel layout for audio, can be \"mono\", \"stereo\", \"5.0\" or \"5.1\"....\n"
+        "\t-chunk-key-frame-ts :    (optional) Default 0. Chunk mode, key frame at or before -start-time-ts where the decoding starts\n"
+        "\t-closed-gop :            (optional) Default 0. If 1, close every GOP so that each segment is decodable on its own\n"
+        "\t-color-range :           (optional) Output color range, can be \"tv\" or \"pc\". Default keeps the source range\n"
+        "\t-color-space :           (optional) Output color space, can be \"bt601\", \"smpte170m\", \"bt470bg\", \"bt709\", \"smpte240m\" or \"bt2020\"\n"
         "\t-command :               (optional) Directing command of exc, can be \"transcode\", \"probe\" or \"mux\" (default is transcode).\n"
         "\t-connection-timeout:     (optional) Seconds (default 10). Connection timeout for rtmp or mpegts protocols.\n"
         "\t-crf :                   (optional) Mutually exclusive with video-bitrate. Default: 23\n"
+        "\t-crop-h :                (optional) Height of the crop rectangle, applied to the source before scaling. Must be set with crop-w.\n"
+        "\t-crop-w :                (optional) Width of the crop rectangle, applied to the source before scaling. Must be set with crop-h.\n"
+        "\t-crop-x :                (optional) Left edge of the crop rectangle in source pixels. Default is 0\n"
+        "\t-crop-y :                (optional) Top edge of the crop rectangle in source pixels. Default is 0\n"
         "\t-crypt-iv :              (optional) 128-bit AES IV, as hex\n"
         "\t-crypt-key :             (optional) 128-bit AES key, as hex\n"
         "\t-crypt-kid :             (optional) 16-byte key ID, as hex\n"
@@ -1042,66 +1266,126 @@ usage(
         "\t-d :                     (optional) Decoder name. For video default is \"h264\", can be: \"h264\", \"h264_cuvid\", \"jpeg2000\", \"hevc\"\n"
         "\t                                    For audio default is \"aac\", but for ts files should be set to \"ac3\"\n"
         "\t-debug-frame-level :     (optional) Enable/disable debug frame level. Default is 0, must be 0 or 1.\n"
-        "\t-deinterlace :           (optional) Deinterlace filter. Default is 0 (none), can be: 1 (bwdif send_field), 2 (bwdif send_frame)\n"
+        "\t-deinterlace :           (optional) Deinterlace filter. Default is 0 (none), can be: 1 (bwdif send_field), 2 (bwdif send_frame),\n"
+        "\t                                    3 (yadif send_field), 4 (yadif send_frame)\n"
+        "\t-decode-progress-interval : (optional) Default 0. Milliseconds between decode progress stats (at least 100), 0 disables them\n"
+        "\t-decode-threads :        (optional) Default 0 (8 threads, 16 for live inputs). Thread count of the decoders\n"
+        "\t-deinterlace-auto :      (optional) Default 0. If 1, deinterlace only if the input is interlaced (bwdif send_frame if -deinterlace is not set)\n"
+        "\t-drm-systems :           (optional) pssh boxes as system_id[:base64 pssh data], comma separated. Only with \"dash\", \"hls\" or \"fmp4-segment\" format\n"
         "\t-duration-ts :           (optional) Default: -1 (entire stream)\n"
         "\t-e :                     (optional) Video encoder name. Default is \"libx264\", can be: \"libx264\", \"libx265\", \"h264_nvenc\", \"hevc_nvenc\", \"h264_videotoolbox\", or \"mjpeg\"\n"
+        "\t-enc-frame-rate :        (optional) Output video frame rate (i.e \"30\" or \"30000/1001\"). Default: source frame rate\n"
         "\t-enc-height :            (optional) Default: -1 (use source height)\n"
+        "\t-enc-pix-fmt :           (optional) Encoder pixel format (i.e \"yuv420p10le\" for 10-bit output). Default: 4:2:0 pixel format of bitdepth\n"
         "\t-enc-width :             (optional) Default: -1 (use source width)\n"
+        "\t-encode-threads :        (optional) Default 0 (encoder default, auto for libx264/libx265). Thread count of the video encoder\n"
         "\t-equal-fduration :       (optional) Force equal frame duration. Must be 0 or 1 and only valid for \"fmp4-segment\" format.\n"
         "\t-extract-image-interval-ts : (optional) Write frames at this interval. Default: -1 (10 seconds)\n"
         "\t-extract-images-ts :     (optional) Write frames at these timestamps (comma separated). Mutually exclusive with extract-image-interval-ts\n"
+        "\t-extract-thumbnails :    (optional) Default 0. If 1, write a JPEG thumbnail every thumbnail-interval-sec while transcoding video\n"
         "\t-f :                     (mandatory) Input filename for transcoding. Valid formats are: a filename that points to a valid file, or udp://127.0.0.1:<port>.\n"
         "\t                                    Output goes to directory ./O\n"
+        "\t-fail-on-verify-error :  (optional) Default 0. If 1, fail the transcoding if a segment fails decode verification (needs verify-segments)\n"
+        "\t-faststart :             (optional) Default 0. If 1, write the moov box before the mdat box (only \"mp4\" and \"segment\" formats)\n"
+        "\t-fill-gaps :             (optional) Default 0. If 1, fill the gaps of the input with silence (audio) and black frames (video)\n"
         "\t-filter-descriptor :     (mandatory if xc-type is audio-pan). Audio filter descriptor the same as ffmpeg format.\n"
         "\t                                    For example: -filter-descriptor [0:1]pan=stereo|c0<c1+0.707*c2|c1<c2+0.707*c1[aout]\n"
-        "\t-format :                (optional) Package format. Default is \"dash\", can be: \"dash\", \"hls\", \"mp4\", \"fmp4\", \"segment\", \"fmp4-segment\", or \"image2\"\n"
+        "\t-format :                (optional) Package format. Default is \"dash\", can be: \"dash\", \"hls\", \"mp4\", \"fmp4\", \"cmaf\", \"segment\", \"fmp4-segment\", \"image2\", or \"webm\"\n"
         "\t                                    Using \"segment\" format produces self contained mp4 segments with start pts from 0 for each segment\n"
         "\t                                    Using \"fmp4-segment\" format produces self contained mp4 segments with continious pts.\n"
         "\t                                    Using \"fmp4-segment\" generates segments that are appropriate for live streaming.\n"
+        "\t-force-keyframes-at :    (optional) Force key frames at these times in sec from the start of the output, comma separated in ascending order\n"
         "\t-force-keyint :          (optional) Force IDR key frame in this interval.\n"
+        "\t-frame-accurate :       (optional) Default 0. If 1, a bypass \"mp4\" remux (xc-type all) starts exactly at start-time-ts instead of at the key frame before it\n"
+        "\t-frame-stats :           (optional) Default 0. If 1, log the pts, dts, size, key flag and quantizer of each frame written to the output\n"
+        "\t-gap-threshold-ms :      (optional) Gaps of the input larger than this are filled with -fill-gaps. Default 0 is 100 ms\n"
         "\t-gpu-index :             (optional) Use the GPU with specified index for transcoding (export CUDA_DEVICE_ORDER=PCI_BUS_ID would use smi index).\n"
+        "\t-handle-pts-wraparound : (optional) Default 1. If 1, make the timestamps of inputs that wrap (i.e. MPEG-TS) monotonic across wraparounds and discontinuities\n"
+        "\t-input-format :         (optional) Input demuxer of a headerless input (i.e \"h264\", \"aac\" or \"s16le\"). Default: detected\n"
+        "\t-input-options :        (optional) Options of the input demuxer as key=value pairs separated by ':' (i.e \"sample_rate=48000:channels=2\")\n"
+        "\t-intra-refresh :         (optional) Default 0. If 1, periodic intra refresh instead of IDR frames, only with -low-latency 1 and libx264\n"
+        "\t-io-buffer-size :        (optional) Default 0 (1MB). Size of the avio buffers of the input and the outputs\n"
+        "\t-key-rotation :          (optional) CENC key periods as start_segment:key:kid[:iv], comma separated. Only with \"segment\" or \"fmp4-segment\" format\n"
         "\t-level:                  (optional) Encoding level for video. If it is not determined, it will be set automatically.\n"
         "\t-listen:                 (optional) Listen mode for RTMP. Must be 0 or 1, by default is on (value 1)\n"
+        "\t-log-level:              (optional) Level of the ffmpeg logs: quiet, panic, fatal, error, warning, info, verbose, debug or trace. Default is info.\n"
         "\t-log-size:               (optional) Log size in MB. Default is 100MB.\n"
+        "\t-low-latency :           (optional) Default 0. If 1, encode with minimal latency (no B-frames, no lookahead) and flush the outputs after each packet\n"
+        "\t-lut-file :              (optional) LUT file (cube, 3dl, dat, m3d, csp) to apply to the video for color grading.\n"
         "\t-master-display :        (optional) Master display, only valid if encoder is libx265.\n"
+        "\t-max-b-frames :          (optional) Max consecutive B-frames. Default -1 keeps the encoder default (0 for \"dash\", \"hls\", \"fmp4\", \"cmaf\", \"fmp4-segment\")\n"
         "\t-max-cll :               (optional) Maximum Content Light Level and Maximum Frame Average Light Level, only valid if encoder is libx265.\n"
         "\t                                    This parameter is a comma separated of max-cll and max-fall (i.e \"1514,172\").\n"
         "\t-mux-spec :              (optional) Muxing spec file.\n"
+        "\t-muxer-opts :            (optional) Options of the output muxers as key=value pairs separated by ':' (i.e \"movflags=+negative_cts_offsets:frag_duration=2000000\")\n"
+        "\t-opus-vbr :              (optional) VBR mode of \"libopus\", can be \"on\" (default), \"off\" or \"constrained\"\n"
+        "\t-output-base-pts :       (optional) Absolute start time of all output streams in microseconds. Default is 0\n"
+        "\t-pad-bottom :            (optional) Padding below the scaled video, added to the output height. Default is 0\n"
+        "\t-pad-color :             (optional) Color of the padding. Default is \"black\"\n"
+        "\t-pad-left :              (optional) Padding left of the scaled video, added to the output width. Default is 0\n"
+        "\t-pad-right :             (optional) Padding right of the scaled video, added to the output width. Default is 0\n"
+        "\t-pad-top :               (optional) Padding above the scaled video, added to the output height. Default is 0\n"
+        "\t-preserve-hdr-metadata : (optional) Default 0. If 1, keep the color signaling, mastering display and content light level metadata of the input.\n"
         "\t-preset :                (optional) Preset string to determine compression speed. Default is \"medium\". Valid values are: \"ultrafast\", \"superfast\",\n"
         "\t                                    \"veryfast\", \"faster\", \"fast\", \"medium\", \"slow\", \"slower\", \"veryslow\".\n"
         "\t-profile :               (optional) Encoding profile for video. If it is not determined, it will be set automatically.\n"
         "\t                                    Valid H264 profiles: \"baseline\", \"main\", \"extended\", \"high\", \"high10\", \"high422\", \"high444\"\n"
         "\t                                    Valid H265 profiles: \"main\", \"main10\"\n"
         "\t                                    Valid NVIDIA H264 profiles: \"baseline\", \"main\", \"high\", \"high444p\"\n"
+        "\t-program-id :            (optional) Default 0. Program number of a multi-program MPEG-TS input to transcode (probe lists the programs)\n"
         "\t-r :                     (optional) number of repeats. Default is 1 repeat, must be bigger than 1\n"
+        "\t-rate-control :          (optional) Rate control mode, can be \"cbr\", \"vbr\" (need video-bitrate), \"crf\" or \"cvbr\" (need crf and rc-max-rate)\n"
         "\t-rc-buffer-size :        (optional) Determines the interval used to limit bit rate\n"
         "\t-rc-max-rate :           (optional) Maximum encoding bit rate, used in conjuction with rc-buffer-size\n"
+        "\t-ref-frames :            (optional) Number of reference frames. Default 0 keeps the encoder default\n"
         "\t-rotate :                (optional) Rotate the input video. Default is 0 with no rotation, other values 90, 180, 270.\n"
         "\t-sample-rate :           (optional) Default: -1. For aac output sample rate is set to input sample rate and this parameter is ignored.\n"
+        "\t-scale-algo :            (optional) Scaler algorithm, can be \"bilinear\", \"bicubic\", \"lanczos\", \"spline\", \"area\", \"neighbor\" or \"fast_bilinear\"\n"
         "\t-seekable :              (optional) Seekable stream. Default is 0, must be 0 or 1\n"
         "\t-seg-duration :          (mandatory if format is \"segment\") segment duration secs (positive integer). It is used for making mp4 segments.\n"
+        "\t-seg-origin-pts :        (optional) Default 0. Start of the first segment with -align-segments, in the time base of the first video stream\n"
+        "\t-sidecar-index :         (optional) Default 0. If 1, write a JSON index of the fragments of the fmp4 or cmaf output (index-stream<n>.json)\n"
         "\t-skip-decoding :         (optional) If start-time-ts is set and skip-decoding enabled, then will skip until start-time-ts without decoding.\n"
         "\t-start-pts :             (optional) Starting PTS for output. Default is 0\n"
         "\t-start-frag-index :      (optional) Start fragment index of first segment. Default is 0\n"
         "\t-start-segment :         (optional) Start segment number >= 1, Default is 1\n"
         "\t-start-time-ts :         (optional) Default: 0\n"
         "\t-stream-id :             (optional) Default: -1, if it is valid it will be used to transcode elementary stream with that stream-id.\n"
+        "\t-subtitle-index :        (optional) Default: -1, subtitle stream index to extract as WebVTT if xc-type is \"subtitle\".\n"
         "\t-sync-audio-to-stream-id:(optional) Default: -1, sync audio to video iframe of specific stream-id when input stream is mpegts.\n"
         "\t-t :                     (optional) Transcoding threads. Default is 1 thread, must be bigger than 1\n"
+        "\t-thread-type :           (optional) Threading of the decoders and the video encoder, can be \"frame\" or \"slice\". Default: both\n"
+        "\t-thumbnail-interval-sec : (optional) Default: 10, interval between thumbnails if extract-thumbnails is 1\n"
+        "\t-thumbnail-width :       (optional) Default: 0 (source width), thumbnail width. Height keeps the aspect ratio\n"
+        "\t-tone-map :              (optional) Tone map HDR (PQ, HLG) input to SDR BT.709, can be \"hable\", \"mobius\" or \"reinhard\"\n"
+        "\t-tone-map-peak :         (optional) Default: 0 (input metadata), signal peak of tone mapping relative to 100 nits\n"
+        "\t-trim-end-sec :          (optional) End of the output in sec from the start of the input, converted to duration-ts\n"
+        "\t-trim-start-sec :        (optional) Start of the output in sec from the start of the input, converted to start-time-ts\n"
         "\t-xc-type :               (optional) Transcoding type. Default is \"all\", can be \"video\", \"audio\", \"audio-merge\", \"audio-join\", \"audio-pan\", \"all\", \"extract-images\"\n"
-        "\t                                    or \"extract-all-images\". \"all\" means transcoding video and audio together.\n"
+        "\t                                    \"extract-all-images\", \"subtitle\" or \"still\". \"all\" means transcoding video and audio together.\n"
+        "\t                                    \"still\" encodes an image input as a video of duration-ts.\n"
         "\t-copy-mpegts :           (optional) Default 0. Create a copy of the MPEGTS input (for MPEGTS, SRT, RTP)\n"
         "\t-video-bitrate :         (optional) Mutually exclusive with crf. Default: -1 (unused)\n"
+        "\t-video-filter :          (optional) FFmpeg filtergraph applied to the decoded video before scaling and watermarks (i.e \"hqdn3d,unsharp\")\n"
         "\t-video-frame-duration-ts :  (optional) Frame duration of the output video in time base.\n"
+        "\t-video-index :           (optional) Index of the video stream to transcode. Default: -1 (first video stream)\n"
         "\t-video-seg-duration-ts : (mandatory If format is not \"segment\" and transcoding video) video segment duration time base (positive integer).\n"
+        "\t-verify-segments :       (optional) Default 0. If 1, decode each output segment after it is written and report the ones that fail\n"
         "\t-video-time-base :       (optional) Video encoder timebase, must be > 0 (the actual timebase would be 1/video-time-base).\n"
-        "\t-wm-text :               (optional) Watermark text that will be presented in every video frame if it exist. It has higher priority than overlay watermark.\n"
+        "\t-vfr-handling :          (optional) Variable frame rate input, can be \"cfr\" (convert to enc-frame-rate or the average frame rate),\n"
+        "\t                                    \"vfr\" (default, keep the timestamps) or \"passthrough\" (also force-keyint by time)\n"
+        "\t-wm-text :               (optional) Watermark text that will be presented in every video frame if it exist. It is drawn over the overlay watermark.\n"
         "\t-wm-timecode :           (optional) Watermark timecode string (i.e 00\\:00\\:00\\:00). It has higher priority than text watermark.\n"
+        "\t-wm-timecode-auto :      (optional) Default 0. If 1, the watermark timecode starts at the source timecode (tmcd track), the rate defaults to the frame rate.\n"
         "\t-wm-timecode-rate :      (optional) Watermark timecode frame rate. Only applies if watermark timecode is enabled.\n"
         "\t-wm-xloc :               (optional) Watermark X location\n"
         "\t-wm-yloc :               (optional) Watermark Y location\n"
         "\t-wm-color :              (optional) Watermark font color\n"
-        "\t-wm-overlay :            (optional) Watermark overlay image file. It has less priority than text watermark.\n"
+        "\t-wm-image-opacity :      (optional) Opacity of the overlay watermark (0 - 1). Default is 0, means opaque.\n"
+        "\t-wm-image-scale :        (optional) Width of the overlay watermark relative to the video width. Default is 0, means the image size.\n"
+        "\t-wm-image-xloc :         (optional) Overlay watermark X location. Default is -wm-xloc.\n"
+        "\t-wm-image-yloc :         (optional) Overlay watermark Y location. Default is -wm-yloc.\n"
+        "\t-wm-overlay :            (optional) Watermark overlay image file. It can be combined with the text watermark.\n"
         "\t-wm-overlay-type :       (optional) Watermark overlay image file type, can be \"png\", \"gif\", \"jpg\". Default is png.\n"
         "\t-wm-relative-size :      (optional) Watermark relative font/shadow size\n"
         "\t-wm-shadow :             (optional) Watermarking with shadow. Default is 1, means with shadow.\n"
@@ -1136,6 +1420,7 @@ main(
     int wm_shadow = 0;
     url_parser_t url_parser;
     u_int64_t log_size = 100;
+    char *log_level = "info";
     int rc = 0;
 
     /* Parameters */
@@ -1163,6 +1448,7 @@ main(
         .filter_descriptor = strdup(""),
         .force_equal_fduration = 0,
         .force_keyint = 0,
+        .max_b_frames = -1,                 /* Default -1 (encoder or format default) */
         .format = strdup("dash"),
         .listen = 1,
         .max_cll = NULL,
@@ -1181,9 +1467,14 @@ main(
         .start_segment_str = strdup("1"),   /* 1-based */
         .start_time_ts = 0,                 /* same units as input stream PTS */
         .start_fragment_index = 0,          /* Default is zero */
+        .handle_pts_wraparound = 1,         /* Default 1 (only inputs with wrapping timestamps are affected) */
         .sync_audio_to_stream_id = -1,      /* Default -1 (no sync to a video stream) */
         .rotate = 0,                        /* Default 0 (means no transpose/rotation) */
         .deinterlace = 0,                   /* Default 0 (no deinterlacing) */
+        .subtitle_index = -1,               /* Default -1 (first subtitle stream) */
+        .video_index = -1,                  /* Default -1 (first video stream) */
+        .thumbnail_interval_sec = 10,       /* Default 10 sec between thumbnails */
+        .pad_color = strdup("black"),
         .xc_type = xc_none,
         .video_bitrate = -1,                /* not used if using CRF */
         .watermark_text = NULL,
@@ -1209,10 +1500,25 @@ main(
         }
         switch ((int) argv[i][1]) {
         case 'a':
-            if (!strcmp(argv[i], "-audio-index")) {
+            if (!strcmp(argv[i], "-align-segments")) {
+                if (sscanf(argv[i+1], "%d", &p.align_segments) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.align_segments != 0 && p.align_segments != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-audio-delay-ms")) {
+                if (sscanf(argv[i+1], "%d", &p.audio_delay_ms) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-audio-filter")) {
+                p.audio_filter = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-audio-index")) {
                 if (get_audio_index(argv[i+1], &p) <= 0) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-audio-language")) {
+                p.audio_language = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-audio-decoder")) {
                 p.dcodec2 = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-audio-encoder")) {
@@ -1221,10 +1527,21 @@ main(
                 if (sscanf(argv[i+1], "%d", &p.audio_bitrate) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-audio-channel-bitrate")) {
+                if (sscanf(argv[i+1], "%d", &p.audio_channel_bitrate) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-audio-seg-duration-ts")) {
                 if (sscanf(argv[i+1], "%"PRId64, &p.audio_seg_duration_ts) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-auto-rotate")) {
+                if (sscanf(argv[i+1], "%d", &p.auto_rotate) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.auto_rotate != 0 && p.auto_rotate != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else {
                 usage(argv[0], argv[i], EXIT_FAILURE);
             }
@@ -1243,6 +1560,8 @@ main(
                 if (sscanf(argv[i+1], "%d", &p.bitdepth) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-bitstream-filters")) {
+                p.bitstream_filters = strdup(argv[i+1]);
             } else {
                 usage(argv[0], argv[i], EXIT_FAILURE);
             }
@@ -1253,12 +1572,27 @@ main(
                 if (strcmp(command, "transcode") && strcmp(command, "probe") && strcmp(command, "mux")) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-chunk-key-frame-ts")) {
+                if (sscanf(argv[i+1], "%"PRId64, &p.chunk_key_frame_ts) != 1 || p.chunk_key_frame_ts < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-closed-gop")) {
+                if (sscanf(argv[i+1], "%d", &p.closed_gop) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.closed_gop != 0 && p.closed_gop != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-copy-mpegts")) {
                 if (sscanf(argv[i+1], "%d", &p.copy_mpegts) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
             } else if (!strcmp(argv[i], "-crf")) {
                 p.crf_str = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-color-range")) {
+                p.color_range = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-color-space")) {
+                p.color_space = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-connection-timeout")) {
                 if (sscanf(argv[i+1], "%d", &p.connection_timeout) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1289,15 +1623,43 @@ main(
                 }
             } else if (strcmp(argv[i], "-crypt-url") == 0) {
                 p.crypt_key_url = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-crop-x")) {
+                if (sscanf(argv[i+1], "%d", &p.crop_x) != 1 || p.crop_x < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-crop-y")) {
+                if (sscanf(argv[i+1], "%d", &p.crop_y) != 1 || p.crop_y < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-crop-w")) {
+                if (sscanf(argv[i+1], "%d", &p.crop_w) != 1 || p.crop_w < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-crop-h")) {
+                if (sscanf(argv[i+1], "%d", &p.crop_h) != 1 || p.crop_h < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else {
                 usage(argv[0], argv[i], EXIT_FAILURE);
             }
             break;
         case 'd':
-            if (!strcmp(argv[i], "-duration-ts")) {
+            if (!strcmp(argv[i], "-drm-systems")) {
+                if (get_drm_systems(argv[i+1], &p) <= 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-duration-ts")) {
                 if (sscanf(argv[i+1], "%"PRId64, &p.duration_ts) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-decode-progress-interval")) {
+                if (sscanf(argv[i+1], "%d", &p.decode_progress_interval) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-decode-threads")) {
+                if (sscanf(argv[i+1], "%d", &p.decode_threads) != 1 || p.decode_threads < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-debug-frame-level")) {
                 if (sscanf(argv[i+1], "%d", &p.debug_frame_level) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1312,6 +1674,13 @@ main(
                 } else {
                     p.deinterlace = deinterlace;
                 }
+            } else if (!strcmp(argv[i], "-deinterlace-auto")) {
+                if (sscanf(argv[i+1], "%d", &p.deinterlace_auto) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.deinterlace_auto != 0 && p.deinterlace_auto != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             }
             else if (strlen(argv[i]) > 2) {
                 usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1320,7 +1689,11 @@ main(
             }
             break;
         case 'e':
-            if (!strcmp(argv[i], "-enc-height")) {
+            if (!strcmp(argv[i], "-enc-frame-rate")) {
+                p.enc_frame_rate = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-enc-pix-fmt")) {
+                p.enc_pix_fmt = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-enc-height")) {
                 if (sscanf(argv[i+1], "%d", &p.enc_height) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
@@ -1328,6 +1701,10 @@ main(
                 if (sscanf(argv[i+1], "%d", &p.enc_width) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-encode-threads")) {
+                if (sscanf(argv[i+1], "%d", &p.encode_threads) != 1 || p.encode_threads < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-equal-fduration")) {
                 if (sscanf(argv[i+1], "%d", &p.force_equal_fduration) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1343,6 +1720,13 @@ main(
                 if (get_extract_images_ts(argv[i+1], &p) <= 0) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-extract-thumbnails")) {
+                if (sscanf(argv[i+1], "%d", &p.extract_thumbnails) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.extract_thumbnails != 0 && p.extract_thumbnails != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (strlen(argv[i]) > 2) {
                 usage(argv[0], argv[i], EXIT_FAILURE);
             } else {
@@ -1350,10 +1734,42 @@ main(
             }
             break;
         case 'f':
-            if (!strcmp(argv[i], "-force-keyint")) {
+            if (!strcmp(argv[i], "-fail-on-verify-error")) {
+                if (sscanf(argv[i+1], "%d", &p.fail_on_verify_error) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.fail_on_verify_error != 0 && p.fail_on_verify_error != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-frame-accurate")) {
+                if (sscanf(argv[i+1], "%d", &p.frame_accurate) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.frame_accurate != 0 && p.frame_accurate != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-frame-stats")) {
+                if (sscanf(argv[i+1], "%d", &p.frame_stats) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.frame_stats != 0 && p.frame_stats != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-faststart")) {
+                if (sscanf(argv[i+1], "%d", &p.faststart) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.faststart != 0 && p.faststart != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-force-keyint")) {
                 if (sscanf(argv[i+1], "%d", &p.force_keyint) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-force-keyframes-at")) {
+                if (get_force_keyframes_at(argv[i+1], &p) <= 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-format")) {
                 if (strcmp(argv[i+1], "dash") == 0) {
                     p.format = strdup("dash");
@@ -1363,15 +1779,26 @@ main(
                     p.format = strdup("mp4");
                 } else if (strcmp(argv[i+1], "fmp4") == 0) {
                     p.format = strdup("fmp4");
+                } else if (strcmp(argv[i+1], "cmaf") == 0) {
+                    p.format = strdup("cmaf");
                 } else if (strcmp(argv[i+1], "segment") == 0) {
                     p.format = strdup("segment");
                 } else if (strcmp(argv[i+1], "fmp4-segment") == 0) {
                     p.format = strdup("fmp4-segment");
                 } else if (strcmp(argv[i+1], "image2") == 0) {
                     p.format = strdup("image2");
+                } else if (strcmp(argv[i+1], "webm") == 0) {
+                    p.format = strdup("webm");
                 } else {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-fill-gaps")) {
+                if (sscanf(argv[i+1], "%d", &p.fill_gaps) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.fill_gaps != 0 && p.fill_gaps != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-filter-descriptor")) {
                 p.filter_descriptor = strdup(argv[i+1]);
             } else if (strlen(argv[i]) > 2) {
@@ -1385,6 +1812,51 @@ main(
                 if (sscanf(argv[i+1], "%d", &p.gpu_index) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-gap-threshold-ms")) {
+                if (sscanf(argv[i+1], "%d", &p.gap_threshold_ms) != 1 || p.gap_threshold_ms < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else {
+                usage(argv[0], argv[i], EXIT_FAILURE);
+            }
+            break;
+        case 'h':
+            if (!strcmp(argv[i], "-handle-pts-wraparound")) {
+                if (sscanf(argv[i+1], "%d", &p.handle_pts_wraparound) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.handle_pts_wraparound != 0 && p.handle_pts_wraparound != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else {
+                usage(argv[0], argv[i], EXIT_FAILURE);
+            }
+            break;
+        case 'i':
+            if (!strcmp(argv[i], "-input-format")) {
+                p.input_format = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-input-options")) {
+                p.input_options = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-io-buffer-size")) {
+                if (sscanf(argv[i+1], "%d", &p.io_buffer_size) != 1 || p.io_buffer_size < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-intra-refresh")) {
+                if (sscanf(argv[i+1], "%d", &p.intra_refresh) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.intra_refresh != 0 && p.intra_refresh != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else {
+                usage(argv[0], argv[i], EXIT_FAILURE);
+            }
+            break;
+        case 'k':
+            if (!strcmp(argv[i], "-key-rotation")) {
+                if (get_key_periods(argv[i+1], &p) <= 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else {
                 usage(argv[0], argv[i], EXIT_FAILURE);
             }
@@ -1401,6 +1873,17 @@ main(
                 if (p.listen != 0 && p.listen != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-low-latency")) {
+                if (sscanf(argv[i+1], "%d", &p.low_latency) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.low_latency != 0 && p.low_latency != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-lut-file")) {
+                p.lut_file = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-log-level")) {
+                log_level = argv[i+1];
             } else if (!strcmp(argv[i], "-log-size")) {
                 if (sscanf(argv[i+1], "%"PRId64, &log_size) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1415,19 +1898,65 @@ main(
                 if (read_muxing_spec(argv[i+1], &p) < 0) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-muxer-opts")) {
+                p.muxer_opts = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-master-display")) {
                 p.master_display = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-max-b-frames")) {
+                if (sscanf(argv[i+1], "%d", &p.max_b_frames) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-max-cll")) {
                 p.max_cll = strdup(argv[i+1]);
             } else {
                 usage(argv[0], argv[i], EXIT_FAILURE);
             }
             break;
+        case 'o':
+            if (!strcmp(argv[i], "-opus-vbr")) {
+                p.opus_vbr = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-output-base-pts")) {
+                if (sscanf(argv[i+1], "%"PRId64, &p.output_base_pts) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else {
+                usage(argv[0], argv[i], EXIT_FAILURE);
+            }
+            break;
         case 'p':
             if (!strcmp(argv[i], "-preset")) {
                 p.preset = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-profile")) {
                 p.profile = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-pad-color")) {
+                p.pad_color = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-pad-left")) {
+                if (sscanf(argv[i+1], "%d", &p.pad_left) != 1 || p.pad_left < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-pad-right")) {
+                if (sscanf(argv[i+1], "%d", &p.pad_right) != 1 || p.pad_right < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-pad-top")) {
+                if (sscanf(argv[i+1], "%d", &p.pad_top) != 1 || p.pad_top < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-pad-bottom")) {
+                if (sscanf(argv[i+1], "%d", &p.pad_bottom) != 1 || p.pad_bottom < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-program-id")) {
+                if (sscanf(argv[i+1], "%d", &p.program_id) != 1 || p.program_id < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-preserve-hdr-metadata")) {
+                if (sscanf(argv[i+1], "%d", &p.preserve_hdr_metadata) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.preserve_hdr_metadata != 0 && p.preserve_hdr_metadata != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else {
                 usage(argv[0], argv[i], EXIT_FAILURE);
             }
@@ -1441,6 +1970,16 @@ main(
                 if (sscanf(argv[i+1], "%d", &p.rc_max_rate) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-rate-control")) {
+                if (strcmp(argv[i+1], "cbr") && strcmp(argv[i+1], "vbr") &&
+                    strcmp(argv[i+1], "crf") && strcmp(argv[i+1], "cvbr")) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                p.rate_control = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-ref-frames")) {
+                if (sscanf(argv[i+1], "%d", &p.ref_frames) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-rotate")) {
                 if (sscanf(argv[i+1], "%d", &p.rotate) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1455,13 +1994,26 @@ main(
             }
             break;
         case 's':
-            if (!strcmp(argv[i], "-stream-id")) {
+            if (!strcmp(argv[i], "-scale-algo")) {
+                p.scale_algo = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-stream-id")) {
                 if (sscanf(argv[i+1], "%d", &p.stream_id) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
                 if (p.stream_id < 0) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-seg-origin-pts")) {
+                if (sscanf(argv[i+1], "%"PRId64, &p.seg_origin_pts) != 1 || p.seg_origin_pts < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-sidecar-index")) {
+                if (sscanf(argv[i+1], "%d", &p.sidecar_index) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.sidecar_index != 0 && p.sidecar_index != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-skip-decoding")) {
                 if (sscanf(argv[i+1], "%d", &p.skip_decoding) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1497,6 +2049,10 @@ main(
                 if (sscanf(argv[i+1], "%"PRId64, &p.start_time_ts) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-subtitle-index")) {
+                if (sscanf(argv[i+1], "%d", &p.subtitle_index) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-sync-audio-to-stream-id")) {
                 if (sscanf(argv[i+1], "%d", &p.sync_audio_to_stream_id) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1514,6 +2070,30 @@ main(
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
                 if ( n_threads < 1 ) usage(argv[0], argv[i], EXIT_FAILURE);
+            } else if (!strcmp(argv[i], "-thread-type")) {
+                p.thread_type = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-thumbnail-interval-sec")) {
+                if (sscanf(argv[i+1], "%f", &p.thumbnail_interval_sec) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-thumbnail-width")) {
+                if (sscanf(argv[i+1], "%d", &p.thumbnail_width) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-tone-map")) {
+                p.tone_map = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-tone-map-peak")) {
+                if (sscanf(argv[i+1], "%f", &p.tone_map_peak) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-trim-start-sec")) {
+                if (sscanf(argv[i+1], "%lf", &p.trim_start_sec) != 1 || p.trim_start_sec < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-trim-end-sec")) {
+                if (sscanf(argv[i+1], "%lf", &p.trim_end_sec) != 1 || p.trim_end_sec < 0) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             }
             break;
         case 'v':
@@ -1521,10 +2101,16 @@ main(
                 if (sscanf(argv[i+1], "%d", &p.video_bitrate) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-video-filter")) {
+                p.video_filter = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-video-frame-duration-ts")) {
                 if (sscanf(argv[i+1], "%d", &p.video_frame_duration_ts) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
+            } else if (!strcmp(argv[i], "-video-index")) {
+                if (sscanf(argv[i+1], "%d", &p.video_index) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-video-seg-duration-ts")) {
                 if (sscanf(argv[i+1], "%"PRId64, &p.video_seg_duration_ts) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1535,6 +2121,15 @@ main(
                 }
                 if (p.video_time_base <= 0)
                     usage(argv[0], argv[i], EXIT_FAILURE);
+            } else if (!strcmp(argv[i], "-verify-segments")) {
+                if (sscanf(argv[i+1], "%d", &p.verify_segments) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.verify_segments != 0 && p.verify_segments != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-vfr-handling")) {
+                p.vfr_handling = strdup(argv[i+1]);
             } else {
                 usage(argv[0], argv[i], EXIT_FAILURE);
             }
@@ -1545,6 +2140,13 @@ main(
                 p.watermark_shadow = 1;
             } else if (!strcmp(argv[i], "-wm-timecode")) {
                 p.watermark_timecode = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-wm-timecode-auto")) {
+                if (sscanf(argv[i+1], "%d", &p.watermark_timecode_auto) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+                if (p.watermark_timecode_auto != 0 && p.watermark_timecode_auto != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
             } else if (!strcmp(argv[i], "-wm-timecode-rate")) {
                 if (sscanf(argv[i+1], "%f", &p.watermark_timecode_rate) != 1) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
@@ -1555,6 +2157,18 @@ main(
                 p.watermark_yloc = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-wm-color")) {
                 p.watermark_font_color = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-wm-image-opacity")) {
+                if (sscanf(argv[i+1], "%f", &p.watermark_image_opacity) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-wm-image-scale")) {
+                if (sscanf(argv[i+1], "%f", &p.watermark_image_scale) != 1) {
+                    usage(argv[0], argv[i], EXIT_FAILURE);
+                }
+            } else if (!strcmp(argv[i], "-wm-image-xloc")) {
+                p.watermark_image_xloc = strdup(argv[i+1]);
+            } else if (!strcmp(argv[i], "-wm-image-yloc")) {
+                p.watermark_image_yloc = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-wm-overlay")) {
                 p.overlay_filename = strdup(argv[i+1]);
             } else if (!strcmp(argv[i], "-wm-overlay-type")) {
@@ -1590,7 +2204,9 @@ main(
                     strcmp(argv[i+1], "audio-pan") &&
                     strcmp(argv[i+1], "audio-merge") &&
                     strcmp(argv[i+1], "extract-images") &&
-                    strcmp(argv[i+1], "extract-all-images")) {
+                    strcmp(argv[i+1], "extract-all-images") &&
+                    strcmp(argv[i+1], "subtitle") &&
+                    strcmp(argv[i+1], "still")) {
                     usage(argv[0], argv[i], EXIT_FAILURE);
                 }
                 p.xc_type = xc_type_from_string(argv[i+1]);
@@ -1608,7 +2224,9 @@ main(
     p.url = filename;
 
     // Set AV libs log level and handle using elv_log
-    av_log_set_level(AV_LOG_DEBUG);
+    if (set_ffmpeg_log_level(log_level) < 0) {
+        usage(argv[0], "-log-level", EXIT_FAILURE);
+    }
     connect_ffmpeg_log();
 
     elv_logger_open(NULL, "exc", 10, log_size*1024*1024, elv_log_file);
@@ -1,8 +1,11 @@
 package goavpipe
 
 import (
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
+	"path/filepath"
+	"strings"
 )
 
 // AVType ...
@@ -45,6 +48,18 @@ const (
 	FrameImage
 	// MpegtsSegment 17
 	MpegtsSegment
+	// WebVTTInit 18
+	WebVTTInit
+	// WebVTTSegment 19
+	WebVTTSegment
+	// ImageThumbnail 20
+	ImageThumbnail
+	// WebMVideoStream 21
+	WebMVideoStream
+	// WebMAudioStream 22
+	WebMAudioStream
+	// IndexSidecar 23 (JSON index of the fragments of a FMP4Stream or FMP4AudioSegment output)
+	IndexSidecar
 )
 
 func (a AVType) Name() string {
@@ -83,6 +98,18 @@ func (a AVType) Name() string {
 		return "FrameImage"
 	case MpegtsSegment:
 		return "MpegtsSegment"
+	case WebVTTInit:
+		return "WebVTTInit"
+	case WebVTTSegment:
+		return "WebVTTSegment"
+	case ImageThumbnail:
+		return "ImageThumbnail"
+	case WebMVideoStream:
+		return "WebMVideoStream"
+	case WebMAudioStream:
+		return "WebMAudioStream"
+	case IndexSidecar:
+		return "IndexSidecar"
 	default:
 		return fmt.Sprintf("Unknown(%d)", a)
 	}
@@ -110,11 +137,11 @@ func (a AVType) AVClass() AVClass {
 	switch a {
 	case FMP4AudioSegment, FMP4VideoSegment, MP4Segment:
 		return AVClassE.Mez
-	case DASHAudioInit, DASHAudioSegment, DASHVideoInit, DASHVideoSegment:
+	case DASHAudioInit, DASHAudioSegment, DASHVideoInit, DASHVideoSegment, WebVTTInit, WebVTTSegment:
 		return AVClassE.Abr
-	case HLSAudioM3U, HLSMasterM3U, HLSVideoM3U, DASHManifest:
+	case HLSAudioM3U, HLSMasterM3U, HLSVideoM3U, DASHManifest, IndexSidecar:
 		return AVClassE.Manifest
-	case FrameImage:
+	case FrameImage, ImageThumbnail:
 		return AVClassE.Frame
 	case MuxSegment, MP4Stream, FMP4Stream:
 		return AVClassE.Mux
@@ -140,6 +167,8 @@ const (
 	XcExtractImages    XcType = 65  // XcVideo | 2^6
 	XcExtractAllImages XcType = 129 // XcVideo | 2^7
 	Xcprobe            XcType = 256
+	XcSubtitle         XcType = 512
+	XcStill            XcType = 1025 // XcVideo | 2^10, encodes a still image input as a video of DurationTs
 )
 
 type XcProfile int
@@ -172,6 +201,10 @@ func XcTypeFromString(xcTypeStr string) XcType {
 		xcType = XcExtractImages
 	case "extract-all-images":
 		xcType = XcExtractAllImages
+	case "subtitle":
+		xcType = XcSubtitle
+	case "still":
+		xcType = XcStill
 	default:
 		xcType = XcNone
 	}
@@ -179,6 +212,53 @@ func XcTypeFromString(xcTypeStr string) XcType {
 	return xcType
 }
 
+// Deinterlacing filters of XcParams.Deinterlace, corresponding to dif_type in avpipe_xc.h
+const (
+	DeinterlaceNone       = 0 // No deinterlacing
+	DeinterlaceBwdif      = 1 // bwdif mode send_field (two frames per input frame)
+	DeinterlaceBwdifFrame = 2 // bwdif mode send_frame (one frame per input frame)
+	DeinterlaceYadif      = 3 // yadif mode send_field (two frames per input frame)
+	DeinterlaceYadifFrame = 4 // yadif mode send_frame (one frame per input frame)
+)
+
+// DeinterlaceFromString returns the XcParams.Deinterlace value of a filter name ("none", "bwdif"
+// or "yadif"). With sendField the filter outputs one frame per field, which doubles the frame rate.
+func DeinterlaceFromString(filter string, sendField bool) (int, error) {
+	switch filter {
+	case "", "none":
+		return DeinterlaceNone, nil
+	case "bwdif":
+		if sendField {
+			return DeinterlaceBwdif, nil
+		}
+		return DeinterlaceBwdifFrame, nil
+	case "yadif":
+		if sendField {
+			return DeinterlaceYadif, nil
+		}
+		return DeinterlaceYadifFrame, nil
+	}
+
+	return DeinterlaceNone, fmt.Errorf("invalid deinterlace filter %s", filter)
+}
+
+// SetDeinterlace sets Deinterlace and DeinterlaceAuto from a filter name: "none", "bwdif", "yadif" or "auto"
+// (bwdif, only if the source is interlaced). With sendField the filter outputs one frame per field, which
+// doubles the frame rate.
+func (p *XcParams) SetDeinterlace(filter string, sendField bool) error {
+	auto := filter == "auto"
+	if auto {
+		filter = "bwdif"
+	}
+	deinterlace, err := DeinterlaceFromString(filter, sendField)
+	if err != nil {
+		return err
+	}
+	p.Deinterlace = deinterlace
+	p.DeinterlaceAuto = auto
+	return nil
+}
+
 type ImageType int
 
 const (
@@ -188,6 +268,20 @@ const (
 	GifImage
 )
 
+// ImageTypeFromFilename returns the image type of filename based on its extension
+func ImageTypeFromFilename(filename string) ImageType {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".png":
+		return PngImage
+	case ".jpg", ".jpeg":
+		return JpgImage
+	case ".gif":
+		return GifImage
+	default:
+		return UnknownImage
+	}
+}
+
 // CryptScheme is the content encryption scheme
 type CryptScheme int
 
@@ -206,108 +300,283 @@ const (
 	CryptCBCS
 )
 
+func (c CryptScheme) String() string {
+	switch c {
+	case CryptNone:
+		return "none"
+	case CryptAES128:
+		return "aes-128"
+	case CryptCENC:
+		return "cenc"
+	case CryptCBC1:
+		return "cbc1"
+	case CryptCENS:
+		return "cens"
+	case CryptCBCS:
+		return "cbcs"
+	default:
+		return fmt.Sprintf("Unknown(%d)", int(c))
+	}
+}
+
+// KeyPeriod is a CENC key used from StartSegment until the StartSegment of the next period
+type KeyPeriod struct {
+	StartSegment int    `json:"start_segment"`
+	Key          string `json:"key"`          // 16-byte AES key in hex
+	KID          string `json:"kid"`          // 16-byte UUID in hex
+	IV           string `json:"iv,omitempty"` // 16-byte AES IV in hex, empty uses CryptIV
+}
+
+// DRM system IDs of the pssh boxes
+const (
+	WidevineSystemID  = "edef8ba9-79d6-4ace-a3c8-27dcd51d21ed"
+	PlayReadySystemID = "9a04f079-9840-4286-ab92-e65be0885f95"
+)
+
+// DrmSystem is signaled with a pssh box in the moov of the CENC outputs
+type DrmSystem struct {
+	SystemID string `json:"system_id"`      // 16-byte DRM system ID as UUID or hex
+	PSSH     []byte `json:"pssh,omitempty"` // Data of the pssh box, specific to the DRM system
+}
+
+// TimedMetadata is written as an emsg box (scheme "https://aomedia.org/emsg/ID3") in the video segment
+// containing its PTS
+type TimedMetadata struct {
+	Pts     int64  `json:"pts"`     // PTS in the time base of the output video stream
+	Payload []byte `json:"payload"` // ID3 tag, e.g. made with avpipe.ID3PrivTag
+}
+
+// Output roles of the input streams in StreamMapping
+const (
+	StreamRoleVideo    = "video"
+	StreamRoleAudio    = "audio"
+	StreamRoleSubtitle = "subtitle"
+)
+
+// StreamMapping assigns the input stream InputIndex to an output role, instead of picking the first stream
+// of each type (video and subtitle) or setting AudioIndex
+type StreamMapping struct {
+	InputIndex int32  `json:"input_index"`
+	Role       string `json:"role"` // StreamRoleVideo, StreamRoleAudio or StreamRoleSubtitle
+}
+
+// FrameDebugInfo describes a frame written to the output, the timestamps are in the time base of the output
+// stream. See XcParams.FrameCallback.
+type FrameDebugInfo struct {
+	StreamIndex int // Input stream index of the frame
+	IsAudio     bool
+	PTS         int64
+	DTS         int64
+	Duration    int64
+	Size        int // Size of the encoded frame in bytes
+	KeyFrame    bool
+	Quantizer   int // QP of the encoded video frame, -1 if the encoder doesn't report it or the frame is bypassed
+}
+
+// FrameCallback receives each frame written to the output, from the audio and video transcoding threads
+type FrameCallback func(FrameDebugInfo)
+
 // XcParams should match with txparams_t in avpipe_xc.h
 type XcParams struct {
-	Url                    string      `json:"url"`
-	BypassTranscoding      bool        `json:"bypass,omitempty"`
-	Format                 string      `json:"format,omitempty"`
-	StartTimeTs            int64       `json:"start_time_ts,omitempty"`
-	StartPts               int64       `json:"start_pts,omitempty"` // Start PTS for output
-	DurationTs             int64       `json:"duration_ts,omitempty"`
-	StartSegmentStr        string      `json:"start_segment_str,omitempty"`
-	VideoBitrate           int32       `json:"video_bitrate,omitempty"`
-	AudioBitrate           int32       `json:"audio_bitrate,omitempty"`
-	SampleRate             int32       `json:"sample_rate,omitempty"` // Audio sampling rate
-	RcMaxRate              int32       `json:"rc_max_rate,omitempty"`
-	RcBufferSize           int32       `json:"rc_buffer_size,omitempty"`
-	CrfStr                 string      `json:"crf_str,omitempty"`
-	Preset                 string      `json:"preset,omitempty"`
-	AudioSegDurationTs     int64       `json:"audio_seg_duration_ts,omitempty"`
-	VideoSegDurationTs     int64       `json:"video_seg_duration_ts,omitempty"`
-	SegDuration            string      `json:"seg_duration,omitempty"`
-	StartFragmentIndex     int32       `json:"start_fragment_index,omitempty"`
-	ForceKeyInt            int32       `json:"force_keyint,omitempty"`
-	Ecodec                 string      `json:"ecodec,omitempty"`    // Video encoder
-	Ecodec2                string      `json:"ecodec2,omitempty"`   // Audio encoder
-	Dcodec                 string      `json:"dcodec,omitempty"`    // Video decoder
-	Dcodec2                string      `json:"dcodec2,omitempty"`   // Audio decoder
-	GPUIndex               int32       `json:"gpu_index,omitempty"` // GPU index if encoder/decoder is GPU (nvidia)
-	EncHeight              int32       `json:"enc_height,omitempty"`
-	EncWidth               int32       `json:"enc_width,omitempty"`
-	CryptIV                string      `json:"crypt_iv,omitempty"`
-	CryptKey               string      `json:"crypt_key,omitempty"`
-	CryptKID               string      `json:"crypt_kid,omitempty"`
-	CryptKeyURL            string      `json:"crypt_key_url,omitempty"`
-	CryptScheme            CryptScheme `json:"crypt_scheme,omitempty"`
-	XcType                 XcType      `json:"xc_type,omitempty"`
-	CopyMpegts             bool        `json:"copy_mpegts,omitempty"`
-	Seekable               bool        `json:"seekable,omitempty"`
-	WatermarkText          string      `json:"watermark_text,omitempty"`
-	WatermarkTimecode      string      `json:"watermark_timecode,omitempty"`
-	WatermarkTimecodeRate  float32     `json:"watermark_timecode_rate,omitempty"`
-	WatermarkXLoc          string      `json:"watermark_xloc,omitempty"`
-	WatermarkYLoc          string      `json:"watermark_yloc,omitempty"`
-	WatermarkRelativeSize  float32     `json:"watermark_relative_size,omitempty"`
-	WatermarkFontColor     string      `json:"watermark_font_color,omitempty"`
-	WatermarkShadow        bool        `json:"watermark_shadow,omitempty"`
-	WatermarkShadowColor   string      `json:"watermark_shadow_color,omitempty"`
-	WatermarkOverlay       string      `json:"watermark_overlay,omitempty"`      // Buffer containing overlay image
-	WatermarkOverlayLen    int         `json:"watermark_overlay_len,omitempty"`  // Length of overlay image
-	WatermarkOverlayType   ImageType   `json:"watermark_overlay_type,omitempty"` // Type of overlay image (i.e PngImage, ...)
-	StreamId               int32       `json:"stream_id"`                        // Specify stream by ID (instead of index)
-	AudioIndex             []int32     `json:"audio_index"`                      // the length of this is equal to the number of audios
-	ChannelLayout          int         `json:"channel_layout"`                   // Audio channel layout
-	MaxCLL                 string      `json:"max_cll,omitempty"`
-	MasterDisplay          string      `json:"master_display,omitempty"`
-	BitDepth               int32       `json:"bitdepth,omitempty"`
-	SyncAudioToStreamId    int         `json:"sync_audio_to_stream_id"`
-	ForceEqualFDuration    bool        `json:"force_equal_frame_duration,omitempty"`
-	MuxingSpec             string      `json:"muxing_spec,omitempty"`
-	Listen                 bool        `json:"listen"`
-	ConnectionTimeout      int         `json:"connection_timeout"`
-	FilterDescriptor       string      `json:"filter_descriptor"`
-	SkipDecoding           bool        `json:"skip_decoding"`
-	DebugFrameLevel        bool        `json:"debug_frame_level"`
-	ExtractImageIntervalTs int64       `json:"extract_image_interval_ts,omitempty"`
-	ExtractImagesTs        []int64     `json:"extract_images_ts,omitempty"`
-	VideoTimeBase          int         `json:"video_time_base,omitempty"`
-	VideoFrameDurationTs   int         `json:"video_frame_duration_ts,omitempty"`
-	Rotate                 int         `json:"rotate,omitempty"`
-	Profile                string      `json:"profile,omitempty"`
-	Level                  int         `json:"level,omitempty"`
-	Deinterlace            int         `json:"deinterlace,omitempty"`
+	Url                      string      `json:"url"`
+	BypassTranscoding        bool        `json:"bypass,omitempty"` // Copy the packets without transcoding, with XcAll and format "mp4" or "fmp4" all the selected streams are remuxed into one output
+	Format                   string      `json:"format,omitempty"`
+	StartTimeTs              int64       `json:"start_time_ts,omitempty"`
+	StartPts                 int64       `json:"start_pts,omitempty"` // Start PTS for output, in the time base of each stream. Use OutputBasePts to align streams
+	DurationTs               int64       `json:"duration_ts,omitempty"`
+	StartSegmentStr          string      `json:"start_segment_str,omitempty"`
+	VideoBitrate             int32       `json:"video_bitrate,omitempty"`
+	AudioBitrate             int32       `json:"audio_bitrate,omitempty"`
+	SampleRate               int32       `json:"sample_rate,omitempty"` // Audio sampling rate
+	RcMaxRate                int32       `json:"rc_max_rate,omitempty"`
+	RcBufferSize             int32       `json:"rc_buffer_size,omitempty"`
+	RateControl              string      `json:"rate_control,omitempty"` // "cbr", "vbr", "crf" or "cvbr", empty derives the mode from VideoBitrate, CrfStr, RcMaxRate and RcBufferSize
+	CrfStr                   string      `json:"crf_str,omitempty"`
+	Preset                   string      `json:"preset,omitempty"`
+	AudioSegDurationTs       int64       `json:"audio_seg_duration_ts,omitempty"`
+	VideoSegDurationTs       int64       `json:"video_seg_duration_ts,omitempty"`
+	SegDuration              string      `json:"seg_duration,omitempty"` // In sec, takes precedence over AudioSegDurationTs and VideoSegDurationTs, which must not conflict with it
+	StartFragmentIndex       int32       `json:"start_fragment_index,omitempty"`
+	ForceKeyInt              int32       `json:"force_keyint,omitempty"`
+	Ecodec                   string      `json:"ecodec,omitempty"`    // Video encoder
+	Ecodec2                  string      `json:"ecodec2,omitempty"`   // Audio encoder
+	Dcodec                   string      `json:"dcodec,omitempty"`    // Video decoder
+	Dcodec2                  string      `json:"dcodec2,omitempty"`   // Audio decoder
+	GPUIndex                 int32       `json:"gpu_index,omitempty"` // GPU index if encoder/decoder is GPU (nvidia)
+	EncHeight                int32       `json:"enc_height,omitempty"`
+	EncWidth                 int32       `json:"enc_width,omitempty"`
+	CryptIV                  string      `json:"crypt_iv,omitempty"`
+	CryptKey                 string      `json:"crypt_key,omitempty"`
+	CryptKID                 string      `json:"crypt_kid,omitempty"`
+	CryptKeyURL              string      `json:"crypt_key_url,omitempty"`
+	CryptScheme              CryptScheme `json:"crypt_scheme,omitempty"`
+	XcType                   XcType      `json:"xc_type,omitempty"`
+	CopyMpegts               bool        `json:"copy_mpegts,omitempty"`
+	Seekable                 bool        `json:"seekable,omitempty"`
+	WatermarkText            string      `json:"watermark_text,omitempty"`
+	WatermarkTimecode        string      `json:"watermark_timecode,omitempty"`
+	WatermarkTimecodeRate    float32     `json:"watermark_timecode_rate,omitempty"`
+	WatermarkXLoc            string      `json:"watermark_xloc,omitempty"`
+	WatermarkYLoc            string      `json:"watermark_yloc,omitempty"`
+	WatermarkRelativeSize    float32     `json:"watermark_relative_size,omitempty"`
+	WatermarkFontColor       string      `json:"watermark_font_color,omitempty"`
+	WatermarkShadow          bool        `json:"watermark_shadow,omitempty"`
+	WatermarkShadowColor     string      `json:"watermark_shadow_color,omitempty"`
+	WatermarkOverlay         string      `json:"watermark_overlay,omitempty"`      // Buffer containing overlay image
+	WatermarkOverlayLen      int         `json:"watermark_overlay_len,omitempty"`  // Length of overlay image
+	WatermarkOverlayType     ImageType   `json:"watermark_overlay_type,omitempty"` // Type of overlay image (i.e PngImage, ...)
+	StreamId                 int32       `json:"stream_id"`                        // Specify stream by ID (instead of index)
+	AudioIndex               []int32     `json:"audio_index"`                      // the length of this is equal to the number of audios
+	ChannelLayout            int         `json:"channel_layout"`                   // Audio channel layout
+	MaxCLL                   string      `json:"max_cll,omitempty"`
+	MasterDisplay            string      `json:"master_display,omitempty"`
+	BitDepth                 int32       `json:"bitdepth,omitempty"`
+	SyncAudioToStreamId      int         `json:"sync_audio_to_stream_id"`
+	ForceEqualFDuration      bool        `json:"force_equal_frame_duration,omitempty"`
+	MuxingSpec               string      `json:"muxing_spec,omitempty"`
+	Listen                   bool        `json:"listen"`
+	ConnectionTimeout        int         `json:"connection_timeout"`
+	FilterDescriptor         string      `json:"filter_descriptor"`
+	SkipDecoding             bool        `json:"skip_decoding"`
+	DebugFrameLevel          bool        `json:"debug_frame_level"`
+	ExtractImageIntervalTs   int64       `json:"extract_image_interval_ts,omitempty"`
+	ExtractImagesTs          []int64     `json:"extract_images_ts,omitempty"`
+	VideoTimeBase            int         `json:"video_time_base,omitempty"`
+	VideoFrameDurationTs     int         `json:"video_frame_duration_ts,omitempty"`
+	Rotate                   int         `json:"rotate,omitempty"`
+	AutoRotate               bool        `json:"auto_rotate,omitempty"` // Rotate by the display matrix of the source if Rotate is 0
+	Profile                  string      `json:"profile,omitempty"`
+	Level                    int         `json:"level,omitempty"`
+	Deinterlace              int         `json:"deinterlace,omitempty"`                // Deinterlace* filter, or a filter name in JSON (see UnmarshalJSON)
+	DeinterlaceAuto          bool        `json:"deinterlace_auto,omitempty"`           // Deinterlace only interlaced sources (tt, bb, tb, bt field order), with bwdif send_frame if Deinterlace is not set
+	SubtitleIndex            int32       `json:"subtitle_index"`                       // Subtitle stream index for XcSubtitle (-1 selects the first subtitle stream)
+	BurnSubtitleFile         string      `json:"burn_subtitle_file,omitempty"`         // Subtitle file (SRT, WebVTT, ASS) to burn into the video, read through the InputOpener
+	BurnSubtitleStreamIndex  int32       `json:"burn_subtitle_stream_index,omitempty"` // Subtitle stream index within BurnSubtitleFile
+	BurnSubtitleFont         string      `json:"burn_subtitle_font,omitempty"`
+	BurnSubtitleRelativeSize float32     `json:"burn_subtitle_relative_size,omitempty"` // Font size relative to the video height
+	BurnSubtitleAlignment    int32       `json:"burn_subtitle_alignment,omitempty"`     // ASS numpad alignment (1-9), 2 is bottom center
+	BurnSubtitleMarginV      int32       `json:"burn_subtitle_margin_v,omitempty"`      // Vertical margin in ASS script pixels
+	LiveDropThreshold        int32       `json:"live_drop_threshold,omitempty"`         // Queued video packets before frames are dropped to keep up with live input (0 disables)
+	ExtractThumbnails        bool        `json:"extract_thumbnails,omitempty"`          // Emit a JPEG ImageThumbnail every ThumbnailIntervalSec while transcoding video
+	ThumbnailIntervalSec     float32     `json:"thumbnail_interval_sec,omitempty"`
+	ThumbnailWidth           int32       `json:"thumbnail_width,omitempty"` // Height keeps the aspect ratio, 0 keeps the source width
+	OutputBasePts            int64       `json:"output_base_pts,omitempty"` // Absolute start time of every output stream in microseconds, rescaled to each stream time base
+	LutFile                  string      `json:"lut_file,omitempty"`        // Local LUT file (.cube, .3dl, .dat, .m3d, .csp) applied to the video for color grading
+	CropX                    int32       `json:"crop_x,omitempty"`          // Crop rectangle in source pixels, applied before scaling
+	CropY                    int32       `json:"crop_y,omitempty"`
+	CropW                    int32       `json:"crop_w,omitempty"` // 0 disables cropping
+	CropH                    int32       `json:"crop_h,omitempty"`
+	PadLeft                  int32       `json:"pad_left,omitempty"` // Padding added after scaling, on top of EncWidth/EncHeight
+	PadRight                 int32       `json:"pad_right,omitempty"`
+	PadTop                   int32       `json:"pad_top,omitempty"`
+	PadBottom                int32       `json:"pad_bottom,omitempty"`
+	PadColor                 string      `json:"pad_color,omitempty"`
+	VerifySegments           bool        `json:"verify_segments,omitempty"`          // Decode each segment after it is written, failures are reported with AV_OUT_STAT_SEGMENT_VERIFY_FAILED
+	FailOnVerifyError        bool        `json:"fail_on_verify_error,omitempty"`     // Fail the transcoding with EAV_VERIFY_SEGMENT if a segment fails verification
+	EncFrameRate             string      `json:"enc_frame_rate,omitempty"`           // Output frame rate (i.e "30" or "30000/1001"), empty keeps the source frame rate
+	ScaleAlgo                string      `json:"scale_algo,omitempty"`               // Scaler algorithm ("bilinear", "bicubic", "lanczos", "spline", "area", "neighbor", "fast_bilinear"), empty keeps the libavfilter default
+	ColorRange               string      `json:"color_range,omitempty"`              // Output color range "tv" (limited) or "pc" (full), empty keeps the source range
+	ColorSpace               string      `json:"color_space,omitempty"`              // Output color matrix ("bt601", "smpte170m", "bt470bg", "bt709", "smpte240m", "bt2020"), empty keeps the source matrix
+	ToneMap                  string      `json:"tone_map,omitempty"`                 // Tone map HDR (PQ, HLG) sources to SDR BT.709 with "hable", "mobius" or "reinhard", SDR sources are not changed
+	ToneMapPeak              float32     `json:"tone_map_peak,omitempty"`            // Signal peak relative to 100 nits, 0 uses the source metadata
+	PreserveHdrMetadata      bool        `json:"preserve_hdr_metadata,omitempty"`    // Keep the source color signaling, mastering display and content light level metadata
+	KeyRotation              []KeyPeriod `json:"key_rotation,omitempty"`             // CENC keys switched at segment boundaries, sorted by StartSegment (only "segment" and "fmp4-segment" formats)
+	DrmSystems               []DrmSystem `json:"drm_systems,omitempty"`              // pssh boxes of the CENC outputs (only "dash", "hls" and "fmp4-segment" formats)
+	DecodeProgressInterval   int32       `json:"decode_progress_interval,omitempty"` // ms between AV_IN_STAT_DECODE_PROGRESS stats, at least 100 (0 disables)
+	MaxBFrames               int32       `json:"max_b_frames"`                       // Max consecutive B-frames, -1 keeps the default (0 for "dash", "hls", "fmp4", "cmaf" and "fmp4-segment")
+	RefFrames                int32       `json:"ref_frames,omitempty"`               // Reference frames, 0 keeps the encoder default
+	ClosedGOP                bool        `json:"closed_gop,omitempty"`               // Close every GOP so segments starting on a keyframe are decodable on their own
+	ForceKeyframesAt         []float64   `json:"force_keyframes_at,omitempty"`       // Force key frames at these times in seconds from the start of the output, in ascending order
+	EncPixFmt                string      `json:"enc_pix_fmt,omitempty"`              // Encoder pixel format (i.e "yuv420p10le" for 10-bit output), empty picks the 4:2:0 format of BitDepth. BitDepth is set from it
+	InputFormat              string      `json:"input_format,omitempty"`             // Forces the input demuxer for headerless inputs (i.e "h264", "aac", "s16le"), empty detects it
+	InputOptions             string      `json:"input_options,omitempty"`            // Options of the input demuxer as key=value pairs separated by ':' (i.e "sample_rate=48000:channels=2" for "s16le")
+	TrimStartSec             float64     `json:"trim_start_sec,omitempty"`           // Start of the output in sec from the start of the input, converted to StartTimeTs in the input timebase
+	TrimEndSec               float64     `json:"trim_end_sec,omitempty"`             // End of the output in sec from the start of the input, converted to DurationTs in the input timebase
+	FrameAccurate            bool        `json:"frame_accurate,omitempty"`           // Bypass "mp4" remux only, the output starts exactly at StartTimeTs (hidden by an edit list) instead of at the key frame before it
+	OverlayImageFile         string      `json:"overlay_image_file,omitempty"`       // Image (png, jpg, gif) overlaid on the video as WatermarkOverlay, read through the InputOpener
+	WatermarkImageFile       string      `json:"watermark_image_file,omitempty"`     // Same as OverlayImageFile, positioned by WatermarkImageXLoc and WatermarkImageYLoc
+	WatermarkImageXLoc       string      `json:"watermark_image_xloc,omitempty"`     // x of the image watermark (i.e "main_w-overlay_w-10"), empty uses WatermarkXLoc
+	WatermarkImageYLoc       string      `json:"watermark_image_yloc,omitempty"`     // y of the image watermark, empty uses WatermarkYLoc
+	WatermarkImageScale      float32     `json:"watermark_image_scale,omitempty"`    // Width of the image watermark relative to the video width, 0 keeps the image size
+	WatermarkImageOpacity    float32     `json:"watermark_image_opacity,omitempty"`  // Opacity of the image watermark (0 - 1), 0 is opaque
+	WatermarkTimecodeAuto    bool        `json:"watermark_timecode_auto,omitempty"`  // Burn a running timecode starting at the source timecode (tmcd track), WatermarkTimecodeRate defaults to the video frame rate
+	LogPrefix                string      `json:"log_prefix,omitempty"`               // Prefix of the ffmpeg logs of the job (i.e "qfab=hq__123"), to tell apart the logs of concurrent jobs, the logs of the ffmpeg frame and slice threads are not prefixed
+	VFRHandling              string      `json:"vfr_handling,omitempty"`             // Variable frame rate input: "cfr" converts to EncFrameRate (default the average frame rate), "vfr" (default) keeps the timestamps, "passthrough" also forces the key frames by time
+	HandlePtsWraparound      bool        `json:"handle_pts_wraparound"`              // Make the timestamps of inputs that wrap (i.e. MPEG-TS 33 bit PTS) monotonic across wraparounds and discontinuities, default true
+	DecodeThreads            int32       `json:"decode_threads,omitempty"`           // Thread count of the decoders, 0 is the default (8, 16 for live inputs), i.e. 1 for many small concurrent jobs
+	EncodeThreads            int32       `json:"encode_threads,omitempty"`           // Thread count of the video encoder, 0 is the default of the encoder (auto for libx264/libx265)
+	ThreadType               string      `json:"thread_type,omitempty"`              // Threading of the decoders and the video encoder: "frame", "slice" (lower latency) or empty for the default
+	LowLatency               bool        `json:"low_latency,omitempty"`              // Encode with minimal latency (no B-frames, no lookahead, tune=zerolatency) and flush the outputs after each packet
+	IntraRefresh             bool        `json:"intra_refresh,omitempty"`            // Periodic intra refresh instead of IDR frames, only with LowLatency and libx264
+	OpusVbr                  string      `json:"opus_vbr,omitempty"`                 // VBR mode of libopus: "on" (default), "off" or "constrained"
+	AudioChannelBitrate      int32       `json:"audio_channel_bitrate,omitempty"`    // Bit rate per channel for ac3 and eac3, overrides AudioBitrate
+	BitstreamFilters         []string    `json:"bitstream_filters,omitempty"`        // Bitstream filters of the copied streams with BypassTranscoding (i.e "h264_mp4toannexb"), each applies to the streams of its codecs
+	AudioLanguage            string      `json:"audio_language,omitempty"`           // Language tag (i.e "eng") of the audio stream to transcode instead of AudioIndex, the transcoding fails if there is none
+	FastStart                bool        `json:"faststart,omitempty"`                // Write the moov box before the mdat box, the output is held in memory until it is complete (only "mp4" and "segment" formats)
+	IOBufferSize             int32       `json:"io_buffer_size,omitempty"`           // Size of the avio buffers of the input and the outputs, 0 is the default (1MB). Larger buffers mean fewer calls to the Read() and Write() of the handlers
+	ChunkKeyFrameTs          int64       `json:"chunk_key_frame_ts,omitempty"`       // Chunk mode, key frame at or before StartTimeTs (same units) where the decoding starts, the packets before it are skipped without decoding (see ChunkKeyFrame())
+	FillGaps                 bool        `json:"fill_gaps,omitempty"`                // Fill the gaps of the input with silence (audio) and black frames (video) to keep them aligned, including a late start of a stream
+	GapThresholdMs           int32       `json:"gap_threshold_ms,omitempty"`         // Gaps of the input timestamps larger than this are filled with FillGaps, 0 is the default (100 ms)
+	SidecarIndex             bool        `json:"sidecar_index,omitempty"`            // Write a JSON index of the fragments (time and byte offset) of the "fmp4" and "cmaf" outputs as an IndexSidecar output (see ParseIndexSidecar())
+	AlignSegments            bool        `json:"align_segments,omitempty"`           // Rebase the "fmp4-segment" outputs on SegOriginPts instead of the start of each stream, so separate audio and video jobs have aligned segments
+	SegOriginPts             int64       `json:"seg_origin_pts,omitempty"`           // Start of the segment StartSegmentStr with AlignSegments, in the time base of the first video stream of the input (first audio stream if there is none)
+	ProgramID                int32       `json:"program_id,omitempty"`               // Program number of a multi-program MPEG-TS input to transcode (see ProbeInfo.Programs), 0 to not select a program
+	AudioDelayMs             int32       `json:"audio_delay_ms,omitempty"`           // Shift of the audio PTS in milliseconds to fix a constant lip-sync offset of the input, negative makes the audio earlier
+	VideoFilter              string      `json:"video_filter,omitempty"`             // FFmpeg filtergraph (i.e "hqdn3d,unsharp") applied to the decoded video before scaling and watermarks, not with WatermarkOverlay
+	AudioFilter              string      `json:"audio_filter,omitempty"`             // FFmpeg filtergraph (i.e "highpass=f=80,acompressor") applied to the decoded audio before it is converted to the encoder format
+
+	// Timed metadata in ascending Pts order (only "dash", "hls" and "fmp4-segment" formats)
+	InjectMetadata []TimedMetadata `json:"inject_metadata,omitempty"`
+
+	// Input streams of the video, audio and subtitle outputs, instead of AudioIndex and the first video and subtitle streams
+	StreamMap []StreamMapping `json:"stream_map,omitempty"`
+
+	// Options of the output muxers (i.e "movflags": "+negative_cts_offsets", "frag_duration": "2000000"), set after
+	// the options avpipe sets itself so they override them. The job fails if an option is unknown to the muxer
+	MuxerOpts map[string]string `json:"muxer_opts,omitempty"`
+
+	// Called for each frame written to the output (encoded or bypassed), the frames are not reported if it is nil
+	FrameCallback FrameCallback `json:"-"`
 }
 
 // NewXcParams initializes a XcParams struct with unset/default values
 func NewXcParams() *XcParams {
 	return &XcParams{
-		AudioBitrate:           128000,
-		AudioSegDurationTs:     -1,
-		BitDepth:               8,
-		CrfStr:                 "23",
-		DurationTs:             -1,
-		Ecodec:                 "libx264",
-		Ecodec2:                "aac",
-		EncHeight:              -1,
-		EncWidth:               -1,
-		ExtractImageIntervalTs: -1,
-		GPUIndex:               -1,
-		SampleRate:             -1,
-		SegDuration:            "30",
-		StartFragmentIndex:     1,
-		StartSegmentStr:        "1",
-		StreamId:               -1,
-		SyncAudioToStreamId:    -1,
-		VideoBitrate:           -1,
-		VideoSegDurationTs:     -1,
-		WatermarkFontColor:     "white",
-		WatermarkOverlayType:   JpgImage,
-		WatermarkRelativeSize:  0.05,
-		WatermarkShadow:        false,
-		WatermarkShadowColor:   "black",
-		WatermarkTimecodeRate:  -1,
-		WatermarkXLoc:          "W*0.05",
-		WatermarkYLoc:          "H*0.9",
+		AudioBitrate:             128000,
+		AudioSegDurationTs:       -1,
+		BurnSubtitleAlignment:    2,
+		BurnSubtitleMarginV:      10,
+		ThumbnailIntervalSec:     10,
+		PadColor:                 "black",
+		BurnSubtitleRelativeSize: 0.05,
+		BitDepth:                 8,
+		CrfStr:                   "23",
+		DurationTs:               -1,
+		Ecodec:                   "libx264",
+		Ecodec2:                  "aac",
+		EncHeight:                -1,
+		EncWidth:                 -1,
+		ExtractImageIntervalTs:   -1,
+		GPUIndex:                 -1,
+		HandlePtsWraparound:      true,
+		MaxBFrames:               -1,
+		SampleRate:               -1,
+		SegDuration:              "30",
+		StartFragmentIndex:       1,
+		StartSegmentStr:          "1",
+		StreamId:                 -1,
+		SubtitleIndex:            -1,
+		SyncAudioToStreamId:      -1,
+		VideoBitrate:             -1,
+		VideoSegDurationTs:       -1,
+		WatermarkFontColor:       "white",
+		WatermarkOverlayType:     JpgImage,
+		WatermarkRelativeSize:    0.05,
+		WatermarkShadow:          false,
+		WatermarkShadowColor:     "black",
+		WatermarkTimecodeRate:    -1,
+		WatermarkXLoc:            "W*0.05",
+		WatermarkYLoc:            "H*0.9",
 	}
 }
 
@@ -317,13 +586,19 @@ func NewXcParams() *XcParams {
 //  1. NEW: The number of audios is specified by the length of the `AudioIndex` slice.
 //     OLD: The number of audios was specified by a larger `AudioIndex` array and a `n_audio` field specifying the number.
 //     CONVERSION: If a `n_audio` field exists, the `AudioIndex` slice is shortened to be that length.
+//  2. NEW: `deinterlace` can also be a filter name: "none", "bwdif", "yadif" or "auto".
+//     OLD: `deinterlace` was only the numeric Deinterlace value (0 - none, 1 - bwdif_field, 2 - bwdif_frame,
+//     3 - yadif_field, 4 - yadif_frame), which is still accepted.
+//     CONVERSION: A filter name is set with SetDeinterlace() in send_frame mode, "auto" sets Deinterlace to
+//     DeinterlaceBwdifFrame and DeinterlaceAuto to true.
 func (p *XcParams) UnmarshalJSON(data []byte) error {
 	// The alias does not have the problematic unmarshal JSON that makes embedding XcParams into xcParamsDecoder bad
 	type xcpAlias XcParams
 
 	type xcParamsDecoder struct {
 		xcpAlias
-		NumAudio int32 `json:"n_audio"`
+		NumAudio    int32           `json:"n_audio"`
+		Deinterlace json.RawMessage `json:"deinterlace"`
 	}
 
 	var xcpd xcParamsDecoder
@@ -338,6 +613,20 @@ func (p *XcParams) UnmarshalJSON(data []byte) error {
 		p.AudioIndex = p.AudioIndex[:xcpd.NumAudio]
 	}
 
+	if len(xcpd.Deinterlace) > 0 && string(xcpd.Deinterlace) != "null" {
+		var filter string
+		if json.Unmarshal(xcpd.Deinterlace, &filter) == nil {
+			// Keep a `deinterlace_auto` set next to a filter name
+			auto := p.DeinterlaceAuto
+			if err := p.SetDeinterlace(filter, false); err != nil {
+				return err
+			}
+			p.DeinterlaceAuto = p.DeinterlaceAuto || auto
+		} else if err := json.Unmarshal(xcpd.Deinterlace, &p.Deinterlace); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
 
@@ -350,6 +639,108 @@ func (p *XcParams) UnmarshalMap(m map[string]interface{}) error {
 	return p.UnmarshalJSON(b)
 }
 
+// KeyPeriodOf returns the key period of the segment segIndex, or nil if there is no key rotation
+// or the segment comes before the first period
+func (p *XcParams) KeyPeriodOf(segIndex int) *KeyPeriod {
+	var keyPeriod *KeyPeriod
+	for i := range p.KeyRotation {
+		if p.KeyRotation[i].StartSegment > segIndex {
+			break
+		}
+		keyPeriod = &p.KeyRotation[i]
+	}
+	return keyPeriod
+}
+
+// NormalizeCrypt validates the hex encoded keys, KIDs and IVs used by the crypt scheme and normalizes
+// them to lower case hex, without spaces, a "0x" prefix or the dashes of the UUID form (KIDs).
+// The C layer passes them to the muxer as they are, so a bad key produces a corrupt stream.
+func (p *XcParams) NormalizeCrypt() (err error) {
+	if p.CryptScheme == CryptNone {
+		return nil
+	}
+	if p.CryptScheme < CryptNone || p.CryptScheme > CryptCBCS {
+		return fmt.Errorf("invalid crypt scheme %s", p.CryptScheme)
+	}
+
+	// CENC AES-CTR allows 8 byte IVs
+	ivSizes := []int{16}
+	if p.CryptScheme == CryptCENC || p.CryptScheme == CryptCENS {
+		ivSizes = []int{8, 16}
+	}
+	// AES-128 generates the key if it is not set, CENC needs the key and the KID unless they are rotated
+	cenc := p.CryptScheme != CryptAES128
+	required := cenc && len(p.KeyRotation) == 0
+
+	if p.CryptKey, err = normalizeHex("CryptKey", p.CryptKey, p.CryptScheme, required, 16); err != nil {
+		return err
+	}
+	if p.CryptIV, err = normalizeHex("CryptIV", p.CryptIV, p.CryptScheme, false, ivSizes...); err != nil {
+		return err
+	}
+	if cenc {
+		if p.CryptKID, err = normalizeHex("CryptKID", strings.ReplaceAll(p.CryptKID, "-", ""), p.CryptScheme, required, 16); err != nil {
+			return err
+		}
+	}
+
+	for i := range p.KeyRotation {
+		keyPeriod := &p.KeyRotation[i]
+		name := fmt.Sprintf("KeyRotation[%d]", i)
+		if keyPeriod.Key, err = normalizeHex(name+".Key", keyPeriod.Key, p.CryptScheme, true, 16); err != nil {
+			return err
+		}
+		if keyPeriod.KID, err = normalizeHex(name+".KID", strings.ReplaceAll(keyPeriod.KID, "-", ""), p.CryptScheme, true, 16); err != nil {
+			return err
+		}
+		if keyPeriod.IV, err = normalizeHex(name+".IV", keyPeriod.IV, p.CryptScheme, false, ivSizes...); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// normalizeHex returns s as lower case hex if it decodes to one of sizes bytes. An empty s is
+// returned as is if it is not required. The value is not part of the error since it may be a key.
+func normalizeHex(name, s string, scheme CryptScheme, required bool, sizes ...int) (string, error) {
+	s = strings.TrimSpace(s)
+	s = strings.TrimPrefix(strings.TrimPrefix(s, "0x"), "0X")
+	if s == "" {
+		if required {
+			return "", fmt.Errorf("%s is required for crypt scheme %s", name, scheme)
+		}
+		return "", nil
+	}
+
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		return "", fmt.Errorf("%s is not valid hex for crypt scheme %s", name, scheme)
+	}
+	for _, size := range sizes {
+		if len(b) == size {
+			return strings.ToLower(s), nil
+		}
+	}
+
+	sizeStrs := make([]string, len(sizes))
+	for i, size := range sizes {
+		sizeStrs[i] = fmt.Sprintf("%d", size)
+	}
+	return "", fmt.Errorf("%s must be %s bytes for crypt scheme %s, got %d bytes",
+		name, strings.Join(sizeStrs, " or "), scheme, len(b))
+}
+
+// MuxParams are the inputs of avpipe.MuxStreams. Each stream is made of one or more parts that are
+// concatenated in order, i.e. a single file or the init segment followed by the ABR segments. The first
+// stream of each part is copied without transcoding.
+type MuxParams struct {
+	Format   string     `json:"format,omitempty"`   // "fmp4-segment" makes a fragmented MP4, otherwise MP4
+	Video    []string   `json:"video"`              // Parts of the video stream
+	Audio    [][]string `json:"audio,omitempty"`    // Parts of each audio stream
+	Captions [][]string `json:"captions,omitempty"` // Parts of each caption stream
+}
+
 type AVMediaType int
 
 const (
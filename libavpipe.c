@@ -6,6 +6,7 @@
 #include "libavpipe/src/avpipe_utils.c"
 #include "libavpipe/src/avpipe_format.c"
 #include "libavpipe/src/avpipe_copy_mpegts.c"
+#include "libavpipe/src/avpipe_remux.c"
 #include "libavpipe/src/avpipe_xc.c"
 #include "libavpipe/src/scte35.c"
 
@@ -62,6 +62,48 @@ dump_trackers(
 void
 connect_ffmpeg_log();
 
+#define MAX_LOG_PREFIX_SIZE     128
+#define FFMPEG_LOG_BUFF_SIZE    (8*1024)
+
+typedef int
+(*ffmpeg_logger_f)(
+    int level,
+    char *msg);
+
+/*
+ * @brief   Sets the function the ffmpeg logs are forwarded to with their native AV_LOG_* level,
+ *          instead of the elv_log function of the mapped level.
+ *
+ * @param   logger_f    Log function, NULL forwards the ffmpeg logs to elv_log.
+ */
+void
+set_ffmpeg_log_func(
+    ffmpeg_logger_f logger_f);
+
+/*
+ * @brief   Sets the level of the ffmpeg logs forwarded by connect_ffmpeg_log().
+ *
+ * @param   level   One of "quiet", "panic", "fatal", "error", "warning", "info", "verbose", "debug" or "trace".
+ *
+ * @return  The AV_LOG_* level if successful, -1 if level is not valid.
+ */
+int
+set_ffmpeg_log_level(
+    const char *level);
+
+/*
+ * @brief   Sets the prefix of the ffmpeg logs of the current thread, to tell apart the logs of
+ *          concurrent jobs. The prefix is kept in a thread-local, the threads of a job started by avpipe
+ *          (decoding, encoding and MPEG-TS copy) set it when they start. The worker threads started by
+ *          ffmpeg itself (frame and slice threads of the decoders and encoders, i.e decode_threads and
+ *          encode_threads > 1) don't see it: their logs are not prefixed.
+ *
+ * @param   prefix  Prefix of the logs, NULL clears it.
+ */
+void
+set_ffmpeg_log_prefix(
+    const char *prefix);
+
 const char *
 stream_type_str(
     coderctx_t *c,
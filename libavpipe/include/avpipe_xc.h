@@ -64,7 +64,10 @@ typedef enum avpipe_error_t {
     eav_xc_table                = 23,   // Error in trancoding table
     eav_pts_wrapped             = 24,   // PTS wrapped error
     eav_io_timeout              = 25,   // IO timeout
-    eav_bad_handle              = 26    // Bad handle
+    eav_bad_handle              = 26,   // Bad handle
+    eav_verify_segment          = 27,   // Output segment failed decode verification
+    eav_unsupported_format      = 28,   // Input format is not recognized by any demuxer
+    eav_stream_language         = 29    // No input stream has the requested language
 } avpipe_error_t;
 
 typedef enum avpipe_buftype_t {
@@ -85,7 +88,13 @@ typedef enum avpipe_buftype_t {
     avpipe_audio_fmp4_segment = 14,     // segmented fmp4 audio stream
     avpipe_mux_segment = 15,            // Muxed audio/video segment
     avpipe_image = 16,                  // extracted images
-    avpipe_mpegts_segment = 17          // MPEGTS (muxed audio and video)
+    avpipe_mpegts_segment = 17,         // MPEGTS (muxed audio and video)
+    avpipe_webvtt_init_stream = 18,     // WebVTT header
+    avpipe_webvtt_segment = 19,         // WebVTT subtitle segment
+    avpipe_image_thumbnail = 20,        // JPEG thumbnail extracted at a fixed interval
+    avpipe_video_webm_stream = 21,      // WebM video stream
+    avpipe_audio_webm_stream = 22,      // WebM audio stream
+    avpipe_index_sidecar = 23           // JSON index of the fragments of a fragmented mp4 output
 } avpipe_buftype_t;
 
 #define BYTES_READ_REPORT               (10*1024*1024)
@@ -104,7 +113,14 @@ typedef enum avp_stat_t {
     out_stat_encoding_end_pts = 9,          // The last PTS encoded. This stat is recorded when a file is closed
     out_stat_start_file = 10,               // Sent when a new file is opened and reports the segment index
     out_stat_end_file = 11,                 // Sent when a file is closed and reports the segment index
-    in_stat_data_scte35 = 12               // SCTE data arrived
+    in_stat_data_scte35 = 12,               // SCTE data arrived
+    in_stat_video_frames_dropped = 13,      // # of video frames dropped to keep up with the input (live drop policy)
+    out_stat_segment_verify_failed = 14,    // Sent when an output segment fails decode verification and reports the segment index
+    out_stat_segment_done = 15,             // Sent when an output segment is complete and reports its segment_stats_t
+    in_stat_decode_progress = 16,           // Sent every params->decode_progress_interval ms and reports the decode_progress_t
+    in_stat_scte35 = 17,                    // Sent for each SCTE-35 splice_schedule, splice_insert or time_signal section and reports its scte35_event_t
+    in_stat_xc_timing = 18,                 // Sent once when a transcoding ends and reports its xc_timing_t
+    in_stat_frame = 19                      // Sent for each frame written to the output if params->frame_stats is set and reports its frame_info_t
 } avp_stat_t;
 
 typedef enum avp_live_proto_t {
@@ -160,6 +176,53 @@ typedef struct io_mux_ctx_t {
 
 typedef struct xcparams_t xcparams_t;
 
+typedef struct decode_progress_t {
+    int64_t video_frames_decoded;   /* Video frames received from the decoder */
+    int64_t audio_frames_decoded;   /* Audio frames received from the decoders */
+    int64_t video_packets_dropped;  /* Video packets rejected by the decoder as invalid */
+    int64_t audio_packets_dropped;  /* Audio packets rejected by the decoders as invalid */
+    int64_t video_frames_dropped;   /* Video frames dropped by the live drop policy */
+    int64_t input_pts;              /* PTS of the last packet read from the input, in its stream time base */
+} decode_progress_t;
+
+/*
+ * Wall clock time spent in each stage of a transcoding, summed over the audio and video streams (and the
+ * renditions). Audio and video are transcoded by separate threads, so the sum of the stages can exceed total_ns.
+ */
+typedef struct xc_timing_t {
+    int64_t decode_ns;              /* Sending packets to the decoders and receiving the decoded frames */
+    int64_t filter_ns;              /* Feeding the filter graphs (scaling, watermarks, resampling) and pulling the filtered frames */
+    int64_t encode_ns;              /* Sending frames to the encoders and receiving the encoded packets */
+    int64_t mux_ns;                 /* Writing the packets to the muxers, including the output handlers */
+    int64_t total_ns;               /* Whole transcoding, from opening the input to closing the outputs */
+} xc_timing_t;
+
+typedef struct scte35_event_t {
+    int64_t pts;                    /* PTS of the SCTE-35 packet, in the time base of its stream (90 kHz for MPEG-TS) */
+    uint8_t command_type;           /* Splice command type (4 splice_schedule, 5 splice_insert, 6 time_signal) */
+    uint8_t *data;                  /* Splice info section, only valid during the in_stat_scte35 callback */
+    int     data_len;               /* Length of data */
+} scte35_event_t;
+
+/*
+ * Frame written to the output, reported by in_stat_frame. The timestamps are in the time base of the output stream.
+ */
+typedef struct frame_info_t {
+    int     is_audio;
+    int64_t pts;
+    int64_t dts;
+    int64_t duration;
+    int     size;                   /* Size of the encoded frame in bytes */
+    int     key_frame;
+    int     quantizer;              /* Quantizer (QP) of the encoded video frame, -1 if the encoder doesn't report it or the frame is bypassed */
+} frame_info_t;
+
+/* Fragment of a fragmented mp4 output, recorded for the index sidecar (params->sidecar_index) */
+typedef struct index_entry_t {
+    int64_t time_us;                /* DTS of the first sample of the fragment in AV_TIME_BASE */
+    int64_t offset;                 /* Byte offset of the fragment in the output */
+} index_entry_t;
+
 typedef struct ioctx_t {
     /* Application specific IO context */
     void                *opaque;
@@ -184,6 +247,8 @@ typedef struct ioctx_t {
     int64_t read_bytes;
     int64_t read_pos;
     int64_t read_reported;
+    int     read_error;             /* Set if the input handler failed to read, as opposed to reaching EOF */
+    int     read_timeout;           /* Set if the read error is a timeout of the input handler */
     int64_t written_bytes;
     int64_t write_pos;
     int64_t write_reported;
@@ -191,6 +256,13 @@ typedef struct ioctx_t {
     int64_t total_frames_written;   /* Total frames written */
     int64_t audio_frames_read;      /* Total audio frames read from input */
     int64_t video_frames_read;      /* Total video frames read from input */
+    int64_t video_frames_dropped;   /* Total video frames dropped by the live drop policy */
+    int64_t seg_frames;             /* Frames muxed in the output segment */
+    int64_t seg_start_pts;          /* PTS of the first frame muxed in the output segment */
+    int64_t seg_end_pts;            /* PTS + duration of the last frame muxed in the output segment */
+    decode_progress_t decode_progress;      /* Decoding counters of the input, reported by in_stat_decode_progress */
+    int64_t decode_progress_reported;       /* av_gettime_relative() of the last in_stat_decode_progress */
+    xc_timing_t xc_timing;                  /* Time spent in each stage of the transcoding, reported by in_stat_xc_timing */
 
     /* Audio/video decoding start pts for stat reporting */
     int64_t decoding_start_pts;
@@ -202,6 +274,8 @@ typedef struct ioctx_t {
     int     seg_index;          /* segment index if this ioctx is a segment */
 
     uint8_t *data;  /* Data stream buffer (e.g. SCTE-35) */
+    scte35_event_t  scte35_event;   /* SCTE-35 section reported by in_stat_scte35 */
+    frame_info_t    frame_info[MAX_STREAMS];    /* Last frame of each stream reported by in_stat_frame */
 
     io_mux_ctx_t    *in_mux_ctx;   /* Input muxer context */
     int             in_mux_index;
@@ -215,6 +289,23 @@ typedef struct ioctx_t {
     xcparams_t      *params;
 
     volatile int    closed; /* If it is set that means inctx is closed */
+
+    /* Copy of the bytes written to an output segment, kept for decode verification (params->verify_segments) */
+    uint8_t         *verify_buf;
+    int64_t         verify_buf_sz;
+    int64_t         verify_len;
+    int64_t         verify_pos;
+    struct avpipe_io_handler_t *verify_handlers;    /* Output handlers the captured writes are passed on to */
+    int             hold;           /* The captured bytes are written when the output is closed, after adding the pssh or emsg boxes */
+
+    /* Fragments written to a fragmented mp4 output, written as an index sidecar when it is closed (params->sidecar_index) */
+    index_entry_t   *index_entries;
+    int             n_index_entries;
+    int             index_entries_sz;
+    int64_t         index_pos;              /* Bytes written to the output */
+    int64_t         index_marker_time;      /* Time of the last sync point marker */
+    int64_t         index_trailer_pos;      /* Offset of the trailer (mfra box), -1 if it is not written yet */
+    int             (*index_writer)(void *opaque, uint8_t *buf, int buf_size);  /* Writer the bytes are passed on to */
 } ioctx_t;
 
 typedef struct h264_level_descriptor {
@@ -275,6 +366,7 @@ typedef struct avpipe_io_handler_t {
 
 #define MAX_WRAP_PTS        ((int64_t)8589000000)
 #define MAX_AVFILENAME_LEN  128
+#define MAX_RENDITIONS      16              /* Max # of renditions of a multi-rendition transcoding */
 
 /*
  * Decoder/encoder context, keeps both video and audio stream ffmpeg contexts
@@ -358,6 +450,7 @@ typedef struct coderctx_t {
     int audio_stream_index[MAX_STREAMS];                /* Audio input stream indexes */
     int n_audio;                                        /* Number of audio streams that will be decoded */
 
+    int subtitle_stream_index;                          /* Index of the subtitle stream selected for extraction */
     int data_scte35_stream_index;                       /* Index of SCTE-35 data stream */
     int data_stream_index;                              /* Index of an unrecognized data stream */
 
@@ -392,6 +485,7 @@ typedef struct coderctx_t {
     int64_t video_frames_written;                       /* Total video frames written so far */
     int64_t audio_frames_written[MAX_STREAMS];          /* Total audio frames written so far */
     int64_t video_pts;                                  /* Video decoder/encoder pts */
+    int video_queue_size;                               /* # of video packets waiting to be transcoded */
     int64_t audio_pts[MAX_STREAMS];                     /* Audio decoder/encoder pts for each track/stream */
     int64_t video_input_start_pts;                      /* In case video input stream starts at PTS > 0 */
     int     video_input_start_pts_notified;             /* Will be set as soon as out_stat_decoding_video_start_pts is fired */
@@ -402,6 +496,11 @@ typedef struct coderctx_t {
     int64_t first_encoding_video_pts;                   /* PTS of first video frame sent to the encoder */
     int64_t first_encoding_audio_pts[MAX_STREAMS];      /* PTS of first audio frame sent to the encoder */
     int64_t first_read_packet_pts[MAX_STREAMS];         /* PTS of first packet read - which might not be decodable */
+    int64_t ts_offset[MAX_STREAMS];                     /* Added to the input timestamps to undo wraparounds and discontinuities */
+    int64_t last_ts[MAX_STREAMS];                       /* Last input DTS (or PTS) with ts_offset, if has_last_ts */
+    int64_t last_ts_duration[MAX_STREAMS];              /* Duration of the last input packet with a duration */
+    int     has_last_ts[MAX_STREAMS];
+    int64_t gap_next_video_pts;                         /* PTS of the video frame expected after the last one with fill_gaps */
 
     int64_t video_encoder_prev_pts;     /* Previous pts for video output (encoder) */
     int64_t video_duration;             /* Duration/pts of original frame */
@@ -416,7 +515,21 @@ typedef struct coderctx_t {
     int     frame_duration;             /* Will be > 0 if parameter set_equal_fduration is set and doing mez making */
     int     calculated_frame_duration;  /* Approximate/real frame duration of video stream, will be used to fill video frames */
 
+    AVCodecContext      *thumbnail_codec_context;   /* MJPEG encoder for thumbnails */
+    struct SwsContext   *thumbnail_sws_context;     /* Scaler from decoded frames to thumbnail size */
+    int64_t             next_thumbnail_pts;         /* PTS of the next thumbnail to extract */
+    volatile int        segments_verify_failed;     /* Number of output segments that failed decode verification */
+    int64_t             forced_keyframes_start_pts; /* PTS of the first video frame, force_keyframes_at is relative to it */
+    int                 next_forced_keyframe;       /* Index of the next entry of force_keyframes_at */
+    int                 next_inject_metadata;       /* Index of the next entry of inject_metadata to write */
+    int                 open_input_err;             /* AVERROR of avformat_open_input() if the input failed to open */
+
+    xc_timing_t         video_timing;               /* Time spent transcoding the video (video thread) */
+    xc_timing_t         audio_timing;               /* Time spent transcoding the audio (audio thread) */
+    AVBSFContext        *bsf_context[MAX_STREAMS];  /* Bitstream filters of the copied streams, indexed by output stream index */
+
     volatile int    cancelled;
+    volatile int    stop_requested;     /* Graceful stop, the input is closed and the outputs are finalized */
     volatile int    stopped;
 } coderctx_t;
 
@@ -429,6 +542,34 @@ typedef enum crypt_scheme_t {
     crypt_cbcs
 } crypt_scheme_t;
 
+/*
+ * A CENC key period, the key is used from start_segment until the start segment of the next period.
+ */
+typedef struct crypt_key_period_t {
+    int     start_segment;          // First segment encrypted with this key
+    char    *key;                   // 16-byte AES key in hex
+    char    *kid;                   // 16-byte UUID in hex
+    char    *iv;                    // 16-byte AES IV in hex [Optional, Default: crypt_iv]
+} crypt_key_period_t;
+
+/*
+ * A DRM system signaled with a pssh box in the moov of the CENC outputs.
+ */
+typedef struct drm_system_t {
+    char    *system_id;             // 16-byte DRM system ID as UUID or hex (i.e Widevine edef8ba9-79d6-4ace-a3c8-27dcd51d21ed)
+    uint8_t *pssh_data;             // Data of the pssh box, specific to the DRM system
+    int     pssh_data_len;          // Length of pssh_data
+} drm_system_t;
+
+/*
+ * Timed metadata (i.e an ID3 tag) written as an emsg box in the video segment containing its PTS.
+ */
+typedef struct timed_metadata_t {
+    int64_t pts;                    // PTS in the time base of the output video stream
+    uint8_t *payload;               // Message data of the emsg box (i.e an ID3 tag with a PRIV frame)
+    int     payload_len;            // Length of payload
+} timed_metadata_t;
+
 typedef enum xc_type_t {
     xc_none                 = 0,
     xc_video                = 1,
@@ -440,7 +581,9 @@ typedef enum xc_type_t {
     xc_mux                  = 32,
     xc_extract_images       = 65,   // 0x40 | xc_video
     xc_extract_all_images   = 129,  // 0x80 | xc_video
-    xc_probe                = 256
+    xc_probe                = 256,
+    xc_subtitle             = 512,  // Extract a subtitle stream as WebVTT segments
+    xc_still                = 1025  // 0x400 | xc_video, encode a still image input as a video of duration_ts
 } xc_type_t;
 
 /* handled image types in get_overlay_filter_string*/
@@ -455,7 +598,9 @@ typedef enum image_type {
 typedef enum dif_type {
     dif_none        = 0, // No deinterlacing
     dif_bwdif       = 1, // Use filter bwdif mode 'send_field' (two frames per input frame)
-    dif_bwdif_frame = 2  // Use filter bwdif mode 'send_frame' (one frame per input frame)
+    dif_bwdif_frame = 2, // Use filter bwdif mode 'send_frame' (one frame per input frame)
+    dif_yadif       = 3, // Use filter yadif mode 'send_field' (two frames per input frame)
+    dif_yadif_frame = 4  // Use filter yadif mode 'send_frame' (one frame per input frame)
 } dif_type;
 
 #define DRAW_TEXT_SHADOW_OFFSET     0.075
@@ -464,12 +609,18 @@ typedef enum dif_type {
 // Notes:
 //   * rc_max_rate and rc_buffer_size must be set together or not at all; they correspond to ffmpeg's bufsize and maxrate
 //   * setting video_bitrate clobbers rc_max_rate and rc_buffer_size
+//   * setting rate_control selects the rate control mode explicitly:
+//       "cbr"  - constant video_bitrate, rc_max_rate and rc_buffer_size are set to video_bitrate
+//       "vbr"  - average video_bitrate, rc_max_rate and rc_buffer_size default to 2 * video_bitrate
+//       "crf"  - constant quality crf_str without bit rate limits
+//       "cvbr" - constant quality crf_str capped at rc_max_rate, rc_buffer_size defaults to 2 * rc_max_rate
 typedef struct xcparams_t {
     char    *url;                   // URL of the input for transcoding
     int     bypass_transcoding;     // if 0 means do transcoding, otherwise bypass transcoding (only copy)
-    char    *format;                // Output format [Required, Values: dash, hls, mp4, fmp4]
+                                    // With xc_all and format "mp4" or "fmp4" the streams are remuxed into one output
+    char    *format;                // Output format [Required, Values: dash, hls, mp4, fmp4, webm]
     int64_t start_time_ts;          // Transcode the source starting from this time
-    int64_t start_pts;              // Starting PTS for output
+    int64_t start_pts;              // Starting PTS for output, in the time base of each stream (use output_base_pts to align streams)
     int64_t duration_ts;            // Transcode time period [-1 for entire source length from start_time_ts]
     char    *start_segment_str;     // Specify index of the first segment  TODO: change type to int
     int     video_bitrate;
@@ -480,12 +631,23 @@ typedef struct xcparams_t {
     char    *preset;                // Sets encoding speed to compression ratio
     int     rc_max_rate;            // Maximum encoding bit rate, used in conjuction with rc_buffer_size [Default: 0]
     int     rc_buffer_size;         // Determines the interval used to limit bit rate [Default: 0]
+    char    *rate_control;          // Rate control mode "cbr", "vbr", "crf" or "cvbr", default is NULL to derive it from the params above
+    /*
+     * Segment duration: seg_duration (sec) takes precedence and is converted to the timebase of each stream,
+     * audio_seg_duration_ts and video_seg_duration_ts are used if seg_duration is not set. Setting both to
+     * different durations is an error.
+     */
     int64_t audio_seg_duration_ts;  // In ts units. It is used for transcoding and producing audio ABR/mez segments
-    int64_t video_seg_duration_ts;  // In ts units. It is used for transcoding and producing video ABR/mez segments 
-    char    *seg_duration;          // In sec units. It is used for transcoding and producing mp4 segments
-    int     seg_duration_fr;
+    int64_t video_seg_duration_ts;  // In ts units. It is used for transcoding and producing video ABR/mez segments
+    char    *seg_duration;          // In sec units. It is used for transcoding and producing ABR/mez segments
+    int     seg_duration_fr;        // Not used
     int     start_fragment_index;
     int     force_keyint;           // Force a key (IDR) frame at this interval
+    int     max_b_frames;           // Max # of consecutive B-frames, -1 keeps the default (0 for dash, hls, fmp4, cmaf, fmp4-segment)
+    int     ref_frames;             // # of reference frames, 0 keeps the encoder default
+    int     closed_gop;             // If set, GOPs are closed so that each one is decodable on its own
+    double  *force_keyframes_at;    // Force key (IDR) frames at these times in sec from the start of the output, in ascending order
+    int     force_keyframes_at_sz;  // Size of the array force_keyframes_at
     int     force_equal_fduration;  // Force all frames to have equal frame duration 
     char    *ecodec;                // Video encoder
     char    *ecodec2;               // Audio encoder when xc_type & xc_audio
@@ -543,8 +705,91 @@ typedef struct xcparams_t {
     char        *profile;
     int         level;
     dif_type    deinterlace;                // Deinterlacing filter
+    int         subtitle_index;             // Subtitle stream index if xc_type == xc_subtitle [Default: -1 first subtitle stream]
+    char        *burn_subtitle;             // Subtitle file (SRT, WebVTT, ASS) to burn into the video, default is NULL
+    int         burn_subtitle_len;          // Length of burn_subtitle if there is any
+    int         burn_subtitle_stream_index; // Subtitle stream index within burn_subtitle [Default: 0]
+    char        *burn_subtitle_font;        // Font name of burned subtitles, default is the libass default font
+    float       burn_subtitle_relative_sz;  // Font size of burned subtitles relative to the video height
+    int         burn_subtitle_alignment;    // Position of burned subtitles as an ASS numpad alignment (1-9) [Default: 2 bottom center]
+    int         burn_subtitle_margin_v;     // Vertical margin of burned subtitles in ASS script pixels
+    int         live_drop_threshold;        // Max # of queued video packets before dropping frames to catch up, 0 disables [Default: 0]
+    int         extract_thumbnails;         // Extract a JPEG thumbnail every thumbnail_interval_sec while transcoding video
+    float       thumbnail_interval_sec;     // Interval between thumbnails in seconds [Default: 10]
+    int         thumbnail_width;            // Width of thumbnails, height keeps the aspect ratio. 0 keeps the source width [Default: 0]
+    int64_t     output_base_pts;            // Absolute start time of all output streams in AV_TIME_BASE units (microseconds)
+    char        *lut_file;                  // LUT file (cube, 3dl, dat, m3d, csp) for color grading the video, default is NULL
+    int         crop_x;                     // Left edge of the crop rectangle in source pixels
+    int         crop_y;                     // Top edge of the crop rectangle in source pixels
+    int         crop_w;                     // Width of the crop rectangle, 0 disables cropping
+    int         crop_h;                     // Height of the crop rectangle, 0 disables cropping
+    int         pad_left;                   // Padding added to the left of the scaled video, on top of enc_width
+    int         pad_right;                  // Padding added to the right of the scaled video, on top of enc_width
+    int         pad_top;                    // Padding added above the scaled video, on top of enc_height
+    int         pad_bottom;                 // Padding added below the scaled video, on top of enc_height
+    char        *pad_color;                 // Color of the padding [Default: black]
+    int         verify_segments;            // Decode each output segment after it is written and report the ones that fail
+    int         fail_on_verify_error;       // Fail the transcoding if a segment fails decode verification
+    int         auto_rotate;                // Rotate the video by the source display matrix if rotate is not set
+    int         deinterlace_auto;           // Deinterlace only if the source field order is interlaced (bwdif send_frame if deinterlace is not set)
+    char        *enc_frame_rate;            // Output video frame rate (i.e "30" or "30000/1001"), default is NULL to keep the source frame rate
+    char        *scale_algo;                // Scaler algorithm (i.e "bicubic", "lanczos", "bilinear"), default is NULL for the libavfilter default
+    char        *color_range;               // Output color range "tv" or "pc", default is NULL to keep the source range
+    char        *color_space;               // Output color space (i.e "bt709", "bt601", "bt2020"), default is NULL to keep the source matrix
+    char        *tone_map;                  // Tone mapping of HDR (PQ, HLG) sources to SDR BT.709, "hable", "mobius" or "reinhard", default is NULL
+    float       tone_map_peak;              // Signal peak of the tone mapping relative to 100 nits, 0 uses the source metadata [Default: 0]
+    int         preserve_hdr_metadata;      // Keep the color signaling, mastering display and content light level metadata of the source
+    crypt_key_period_t  *key_periods;       // CENC key rotation, sorted by start_segment (only segment and fmp4-segment formats)
+    int                 n_key_periods;      // Size of the array key_periods
+    drm_system_t        *drm_systems;       // pssh boxes added to the moov of CENC outputs (only dash, hls and fmp4-segment formats)
+    int                 n_drm_systems;      // Size of the array drm_systems
+    int         decode_progress_interval;   // ms between in_stat_decode_progress reports, 0 disables (min 100) [Default: 0]
+    timed_metadata_t    *inject_metadata;   // Timed metadata written as emsg boxes, in ascending pts order (only dash, hls and fmp4-segment formats)
+    int                 n_inject_metadata;  // Size of the array inject_metadata
+    int                 faststart;          // "mp4" and "segment" formats only, writes the moov box before the mdat box
+    char                *enc_pix_fmt;       // Encoder pixel format (i.e "yuv420p10le"), NULL picks it from bitdepth
+    char                *input_format;      // Forces the input demuxer (i.e "h264", "aac", "s16le"), NULL detects it
+    char                *input_options;     // Options of the input demuxer as key=value pairs separated by ':' (i.e "sample_rate=48000:channels=2")
+    double              trim_start_sec;     // Start of the output in sec from the start of the input, converted to start_time_ts. 0 is not set
+    double              trim_end_sec;       // End of the output in sec from the start of the input, converted to duration_ts. 0 is not set
+    int                 frame_accurate;     // Bypass "mp4" remux only, starts exactly at start_time_ts with an edit list instead of at the key frame before it
+    char                *watermark_image_xloc;    // x of the image watermark (overlay expression), NULL uses watermark_xloc
+    char                *watermark_image_yloc;    // y of the image watermark (overlay expression), NULL uses watermark_yloc
+    float               watermark_image_scale;    // Width of the image watermark relative to the video width, 0 keeps the image size
+    float               watermark_image_opacity;  // Opacity of the image watermark (0 - 1), 0 is opaque
+    int                 watermark_timecode_auto;  // Sets watermark_timecode from the source timecode (tmcd track) and the rate from the video frame rate
+    char                *log_prefix;        // Prefix of the ffmpeg logs of the job, to tell apart the logs of concurrent jobs (not the logs of the ffmpeg frame and slice threads)
+    char                *vfr_handling;      // Variable frame rate input: "cfr", "vfr" or "passthrough", NULL is "vfr"
+    int                 handle_pts_wraparound;  // Make the timestamps of inputs that wrap (i.e. MPEG-TS 33 bit PTS) monotonic across wraparounds and discontinuities
+    int                 decode_threads;     // Thread count of the decoders, 0 is the default (8, 16 for live inputs)
+    int                 encode_threads;     // Thread count of the video encoder, 0 is the default of the encoder (auto for libx264/libx265)
+    char                *thread_type;       // Threading of the decoders and video encoder: "frame", "slice" or NULL for both
+    int                 low_latency;        // Encode with minimal latency (no B-frames, no lookahead, tune=zerolatency) and flush the outputs after each packet
+    int                 intra_refresh;      // Periodic intra refresh instead of IDR frames, only with low_latency and libx264
+    char                *opus_vbr;          // VBR mode of libopus: "on" (default), "off" or "constrained"
+    int                 audio_channel_bitrate;  // Bit rate per channel for ac3 and eac3, overrides audio_bitrate
+    char                *bitstream_filters; // Bitstream filters of the copied streams (bypass_transcoding), comma separated (i.e "h264_mp4toannexb,dump_extra")
+    char                *audio_language;    // Language tag (i.e "eng") of the audio stream to transcode instead of audio_index
+    int                 video_index;        // Video stream index to transcode [Default: -1 first video stream]
+    int                 frame_stats;        // Report each frame written to the output with in_stat_frame [Default: 0]
+    int                 io_buffer_size;     // Size of the avio buffers of the input and the outputs, 0 is the default (1MB)
+    int64_t             chunk_key_frame_ts; // Chunk mode, key frame at or before start_time_ts (same units) where the decoding starts [Default: 0 decodes from the start]
+    char                *muxer_opts;        // Options of the output muxers as key=value pairs separated by ':' (i.e "movflags=+negative_cts_offsets:frag_duration=2000000"), unknown options fail the job
+    int                 fill_gaps;          // Fill the gaps of the input with silence (audio) and black frames (video), including a late start of a stream [Default: 0]
+    int                 gap_threshold_ms;   // Gaps of the input timestamps larger than this are filled with fill_gaps, 0 is the default (100 ms)
+    int                 sidecar_index;      // Write a JSON index of the fragments (time and byte offset) of the fmp4 and cmaf outputs as an avpipe_index_sidecar output [Default: 0]
+    int                 align_segments;     // Rebase the fmp4-segment outputs on seg_origin_pts so the segments of separate audio and video jobs are aligned [Default: 0]
+    int64_t             seg_origin_pts;     // Start of the segment start_segment with align_segments, in the time base of the first video stream of the input (first audio stream if there is none)
+    int                 program_id;         // Program number of a multi-program MPEG-TS input to transcode, its streams are the only ones selected [Default: 0 no program selection]
+    int                 audio_delay_ms;     // Shifts the audio PTS by this many milliseconds to fix a constant lip-sync offset of the input, negative makes the audio earlier [Default: 0]
+    char                *video_filter;      // FFmpeg filtergraph (i.e "hqdn3d,unsharp") applied to the decoded video after tone mapping, LUT and crop and before scaling and watermarks
+    char                *audio_filter;      // FFmpeg filtergraph (i.e "highpass=f=80,acompressor") applied to the decoded audio before it is converted to the encoder format
 } xcparams_t;
 
+#define MIN_DECODE_PROGRESS_INTERVAL    100
+#define MAX_B_FRAMES                    16
+#define MAX_REF_FRAMES                  16
+
 #define MAX_CODEC_NAME  256
 
 typedef struct side_data_display_matrix_t {
@@ -552,8 +797,26 @@ typedef struct side_data_display_matrix_t {
     double rotation_cw; // Computed CW rotation with values 0 to 360
 } side_data_display_matrix_t;
 
+typedef struct side_data_mastering_display_t {
+    int    present;
+    double red_x, red_y;
+    double green_x, green_y;
+    double blue_x, blue_y;
+    double white_point_x, white_point_y;
+    double min_luminance;   // cd/m2
+    double max_luminance;   // cd/m2
+} side_data_mastering_display_t;
+
+typedef struct side_data_content_light_t {
+    int      present;
+    unsigned max_content;   // MaxCLL in cd/m2
+    unsigned max_average;   // MaxFALL in cd/m2
+} side_data_content_light_t;
+
 typedef struct side_data_t {
-    side_data_display_matrix_t display_matrix;
+    side_data_display_matrix_t      display_matrix;
+    side_data_mastering_display_t   mastering_display;
+    side_data_content_light_t       content_light;
 } side_data_t;
 
 typedef struct stream_info_t {
@@ -584,20 +847,49 @@ typedef struct stream_info_t {
     int                 profile;
     int                 level;
     side_data_t         side_data;
-    AVDictionary        *tags;
+    int                 rotation;   // Video only, CW rotation of the display matrix rounded to 0, 90, 180 or 270
+    const char          *color_primaries;   // Video only, static name of the color primaries or NULL if unknown
+    const char          *color_trc;         // Video only, static name of the transfer characteristics or NULL if unknown
+    const char          *color_space;       // Video only, static name of the color space or NULL if unknown
+    const char          *color_range;       // Video only, static name of the color range or NULL if unknown
+    int                 bits_per_raw_sample;    // Bits per sample (i.e 10 for 10-bit video), from the pixel format if not set by the codec. 0 if unknown
+    int                 disposition;        // AV_DISPOSITION_* flags of the stream
+    int                 is_vfr;             // Video only, 1 if the frame durations of the first packets vary
+    AVDictionary        *tags;      // Stream metadata, duplicate keys are kept in the order of the input
 } stream_info_t;
 
 typedef struct container_info_t {
     float duration;
     char *format_name;
+    int64_t bit_rate;               // Overall bit rate of the container in bits/s, 0 if unknown
+    int is_image;                   // 1 if the input is a still or animated image (JPEG, PNG, WebP, GIF, APNG)
+    AVDictionary *tags;             // Container metadata, duplicate keys are kept in the order of the input
 } container_info_t;
 
+typedef struct program_info_t {
+    int program_id;                 // Program number (the service ID of an MPEG-TS program)
+    int *stream_indexes;            // Stream indexes of the program in AVFormatContext
+    int n_stream_indexes;
+    AVDictionary *tags;             // Program metadata, i.e. service_name and service_provider
+} program_info_t;
+
 /* The data structure that is filled by avpipe_probe */
 typedef struct xcprobe_t {
     container_info_t container_info;
     stream_info_t *stream_info;    // An array of stream_info_t (usually 2)
+    program_info_t *program_info;  // An array of n_programs program_info_t, NULL if the input has no programs
+    int n_programs;
 } xcprobe_t;
 
+/* The data structure that is filled by avpipe_probe_frames for each decoded frame */
+typedef struct frame_info_t {
+    int64_t pts;                    // Best effort presentation timestamp of the frame
+    int64_t dts;                    // DTS of the packet that produced the frame
+    int     key_frame;              // 1 if the frame is a key frame
+    char    pict_type;              // Picture type 'I', 'P', 'B', ... or '?' if unknown (i.e audio)
+    int     packet_size;            // Size of the packet that produced the frame
+} frame_info_t;
+
 
 /* Context for the source copy operations (MPEGTS) */
 typedef struct cp_ctx_t {
@@ -651,6 +943,15 @@ typedef struct xctx_t {
     volatile int        stop;
     volatile int        err;        // Return code of transcoding
 
+    /*
+     * Multi-rendition transcoding (xc_multi): the leader decodes the input once and feeds the decoded video frames
+     * to the filter graph and encoder of each rendition. A rendition shares the decoder of its leader.
+     */
+    struct xctx_t       **renditions;   // Renditions fed by this (leader) context
+    int                 n_renditions;
+    struct xctx_t       *leader;        // Leader context decoding the input of this rendition
+    ioctx_t             *out_inctx;     // Context the outputs are opened with if not inctx (one per rendition)
+
 } xctx_t;
 
 /* Params that are needed to decode/encode a frame in a thread */
@@ -683,6 +984,10 @@ typedef struct out_tracker_t {
     int audio_stream_index;
 
     int output_stream_index;
+
+    /* Last init segment written, prepended to the segments for decode verification */
+    uint8_t *verify_init_buf;
+    int64_t verify_init_len;
 } out_tracker_t;
 
 typedef struct encoding_frame_stats_t {
@@ -690,6 +995,14 @@ typedef struct encoding_frame_stats_t {
     int64_t frames_written;         /* Frames encoded in the current segment */
 } encoding_frame_stats_t;
 
+typedef struct segment_stats_t {
+    int     seg_index;              /* Index of the segment */
+    int64_t start_pts;              /* PTS of the first frame of the segment */
+    int64_t end_pts;                /* PTS + duration of the last frame of the segment */
+    int64_t bytes;                  /* Bytes written to the segment */
+    int64_t frames;                 /* Number of frames in the segment */
+} segment_stats_t;
+
 /**
  * @brief   Allocates and initializes a xctx_t (transcoder context) for pipelining the input stream.
  *          in_handlers, out_handlers, and params ownership is always on the caller, and will never
@@ -749,6 +1062,23 @@ avpipe_probe(
     xcprobe_t **xcprobe,
     int *n_streams);
 
+/**
+ * @brief   Probes the container of the input specified by input handler without probing the streams.
+ *          Only the header of the container is read (and the first packets if it has no global header,
+ *          i.e. MPEG-TS), no packet is decoded.
+ *
+ * @param   in_handlers     A pointer to input handlers that direct the probe
+ * @param   params          A pointer to the parameters for probing.
+ * @param   container_info  Will contain the format name, duration, bit rate and tags of the container if
+ *                          successful, format_name and tags must be freed by the caller.
+ * @return  Returns 0 if successful, otherwise corresponding eav error.
+ */
+int
+avpipe_probe_header(
+    avpipe_io_handler_t *in_handlers,
+    xcparams_t *params,
+    container_info_t *container_info);
+
 /**
  * @brief   Free all memory allocated by avpipe_probe
  *
@@ -761,9 +1091,137 @@ avpipe_probe_free(
     xcprobe_t *xcprobe,
     int n_streams);
 
+/**
+ * @brief   Probes the frames of one stream specified by input handler.
+ *          The frames are decoded in order to find the picture type of each frame.
+ *
+ * @param   in_handlers     A pointer to input handlers that direct the probe
+ * @param   params          A pointer to the parameters for probing.
+ * @param   stream_index    Index of the stream in the input container.
+ * @param   max_frames      Maximum number of frames to probe, 0 or negative probes all the frames.
+ * @param   frames          Will contain the array of frame_info_t if successful, must be freed by the caller.
+ * @param   n_frames        Will contain number of frames that are probed if successful.
+ * @return  Returns 0 if successful, otherwise corresponding eav error.
+ */
+int
+avpipe_probe_frames(
+    avpipe_io_handler_t *in_handlers,
+    xcparams_t *params,
+    int stream_index,
+    int max_frames,
+    frame_info_t **frames,
+    int *n_frames);
+
+/**
+ * @brief   Verifies an output segment can be decoded by demuxing and decoding all of its packets.
+ *          Fragmented segments (i.e DASH/HLS m4s) need the init segment to be decoded.
+ *
+ * @param   init_buf        Init segment that is prepended to the segment, NULL if the segment is self contained.
+ * @param   init_len        Length of the init segment.
+ * @param   seg_buf         Segment bytes.
+ * @param   seg_len         Length of the segment.
+ * @param   url             Url of the segment, used for logging.
+ * @return  Returns 0 if all the packets of the segment are decoded without error, otherwise corresponding eav error.
+ */
+int
+avpipe_verify_segment(
+    const uint8_t *init_buf,
+    int64_t init_len,
+    const uint8_t *seg_buf,
+    int64_t seg_len,
+    const char *url);
+
+/**
+ * @brief   Adds a pssh box for each of params->drm_systems at the end of the moov box of an output.
+ *          The pssh boxes reference the KID of the segment (crypt_kid or the KID of its key period).
+ *
+ * @param   params      Transcoding parameters with the DRM systems.
+ * @param   seg_index   Index of the segment, used to find the key period.
+ * @param   buf         Bytes of the output, starting with the first box.
+ * @param   len         Length of the output.
+ * @param   out_buf     Newly allocated output with the pssh boxes, the caller frees it.
+ * @param   out_len     Length of out_buf.
+ * @return  Returns 0 if the pssh boxes are added, otherwise corresponding eav error.
+ */
+int
+avpipe_insert_pssh(
+    xcparams_t *params,
+    int seg_index,
+    const uint8_t *buf,
+    int64_t len,
+    uint8_t **out_buf,
+    int64_t *out_len);
+
+/**
+ * @brief   Adds an emsg box for each entry of params->inject_metadata from *next_metadata with a PTS before
+ *          seg_end_pts, before the first sidx or moof box of a video segment.
+ *          The emsg boxes use the ID3 scheme "https://aomedia.org/emsg/ID3".
+ *
+ * @param   params          Transcoding parameters with the timed metadata.
+ * @param   next_metadata   Index of the next entry of inject_metadata to write, updated to the entry after the last one added.
+ * @param   time_base       Time base of the output video stream.
+ * @param   seg_start_pts   PTS of the first frame of the segment.
+ * @param   seg_end_pts     PTS + duration of the last frame of the segment.
+ * @param   relative        If set, the timestamps of the segment start at 0 and the emsg boxes (version 0) are
+ *                          relative to seg_start_pts, otherwise they have the PTS of the metadata (version 1).
+ * @param   buf             Bytes of the segment, starting with the first box.
+ * @param   len             Length of the segment.
+ * @param   out_buf         Newly allocated segment with the emsg boxes, the caller frees it. NULL if no box is added.
+ * @param   out_len         Length of out_buf.
+ * @return  Returns 0 if the emsg boxes are added or there is no metadata for the segment, otherwise corresponding eav error.
+ */
+int
+avpipe_insert_emsg(
+    xcparams_t *params,
+    int *next_metadata,
+    AVRational time_base,
+    int64_t seg_start_pts,
+    int64_t seg_end_pts,
+    int relative,
+    const uint8_t *buf,
+    int64_t len,
+    uint8_t **out_buf,
+    int64_t *out_len);
+
+/**
+ * @brief   Moves the moov box of an mp4 file before its first mdat box (faststart), so players can start
+ *          before the whole file is downloaded. The chunk offsets (stco and co64) are shifted by the size of
+ *          the moov box.
+ *
+ * @param   buf             Bytes of the mp4 file.
+ * @param   len             Length of the mp4 file.
+ * @param   out_buf         Newly allocated mp4 file with the moov box first, the caller frees it. NULL if the
+ *                          moov box is already before the mdat box.
+ * @param   out_len         Length of out_buf.
+ * @return  Returns 0 if the moov box is moved or is already first, otherwise corresponding eav error.
+ */
+int
+avpipe_mp4_faststart(
+    const uint8_t *buf,
+    int64_t len,
+    uint8_t **out_buf,
+    int64_t *out_len);
+
+/**
+ * @brief   Sets the CENC key, KID and IV of the key period of a segment on a segment muxer.
+ *          The muxer uses them from the next segment it starts.
+ *
+ * @param   format_context  Output format context of the segment muxer.
+ * @param   params          Transcoding parameters with the key periods.
+ * @param   seg_index       Index of the segment (same numbering as start_segment_str).
+ * @return  Returns 0 if the key is set or there is no key rotation, otherwise corresponding eav error.
+ */
+int
+avpipe_set_key_period(
+    AVFormatContext *format_context,
+    xcparams_t *params,
+    int seg_index);
+
 /**
  * @brief   Starts transcoding. Multiple transcoding operations on the same transcoding context is UB.
  *          In case of failure avpipe_fini() should be called to avoid resource leak.
+ *          If xctx has renditions, the decoded video frames are also encoded by each rendition and
+ *          avpipe_fini() releases the renditions with xctx.
  *
  * @param   xctx                A pointer to transcoding context.
  * @param   do_intrument        If 0 there will be no instrumentation, otherwise it does some instrumentation
@@ -775,6 +1233,18 @@ avpipe_xc(
     xctx_t *xctx,
     int do_instrument);
 
+/**
+ * @brief   Checks the params of a transcoding without running it: opens the input and prepares the
+ *          decoder, the encoder and the filter graphs the same way avpipe_xc() does, but doesn't start
+ *          the transcoding threads nor open any output. avpipe_fini() should be called afterwards.
+ *
+ * @param   xctx    A pointer to transcoding context initialized by avpipe_init().
+ * @return  Returns eav_success if the transcoding can be set up, otherwise the first configuration error.
+ */
+int
+avpipe_validate(
+    xctx_t *xctx);
+
 /**
  * @brief   Initializes the avpipe muxer.
  *
@@ -843,6 +1313,120 @@ set_extract_images(
     int index,
     int64_t value);
 
+/**
+ * @brief   Allocate memory for force_keyframes_at
+ *
+ * @param   params  Transcoding parameters
+ * @param   size    Array size
+ */
+void
+init_force_keyframes(
+    xcparams_t *params,
+    int size);
+
+/**
+ * @brief   Helper function avoid dealing with array pointers in Go to set
+ *          force_keyframes_at
+ *
+ * @param   params  Transcoding parameters.
+ * @param   index   Array index to set.
+ * @param   value   Array value (time in sec).
+ */
+void
+set_force_keyframe(
+    xcparams_t *params,
+    int index,
+    double value);
+
+/**
+ * @brief   Allocate memory for key_periods
+ *
+ * @param   params  Transcoding parameters
+ * @param   size    Array size
+ */
+void
+init_key_periods(
+    xcparams_t *params,
+    int size);
+
+/**
+ * @brief   Helper function avoid dealing with array pointers in Go to set
+ *          key_periods. The strings are copied.
+ *
+ * @param   params          Transcoding parameters.
+ * @param   index           Array index to set.
+ * @param   start_segment   First segment encrypted with the key.
+ * @param   key             16-byte AES key in hex.
+ * @param   kid             16-byte UUID in hex.
+ * @param   iv              16-byte AES IV in hex, can be NULL or empty.
+ */
+void
+set_key_period(
+    xcparams_t *params,
+    int index,
+    int start_segment,
+    char *key,
+    char *kid,
+    char *iv);
+
+/**
+ * @brief   Allocate memory for drm_systems
+ *
+ * @param   params  Transcoding parameters
+ * @param   size    Array size
+ */
+void
+init_drm_systems(
+    xcparams_t *params,
+    int size);
+
+/**
+ * @brief   Helper function avoid dealing with array pointers in Go to set
+ *          drm_systems. The system ID and the pssh data are copied.
+ *
+ * @param   params          Transcoding parameters.
+ * @param   index           Array index to set.
+ * @param   system_id       16-byte DRM system ID as UUID or hex.
+ * @param   pssh_data       Data of the pssh box.
+ * @param   pssh_data_len   Length of pssh_data.
+ */
+void
+set_drm_system(
+    xcparams_t *params,
+    int index,
+    char *system_id,
+    uint8_t *pssh_data,
+    int pssh_data_len);
+
+/**
+ * @brief   Allocate memory for inject_metadata
+ *
+ * @param   params  Transcoding parameters
+ * @param   size    Array size
+ */
+void
+init_inject_metadata(
+    xcparams_t *params,
+    int size);
+
+/**
+ * @brief   Helper function avoid dealing with array pointers in Go to set
+ *          inject_metadata. The payload is copied.
+ *
+ * @param   params          Transcoding parameters.
+ * @param   index           Array index to set.
+ * @param   pts             PTS in the time base of the output video stream.
+ * @param   payload         Message data of the emsg box.
+ * @param   payload_len     Length of payload.
+ */
+void
+set_inject_metadata(
+    xcparams_t *params,
+    int index,
+    int64_t pts,
+    uint8_t *payload,
+    int payload_len);
+
 /**
  * @brief   Returns the level based on the input values
  *
@@ -931,4 +1515,14 @@ xcparams_t *
 avpipe_copy_xcparams(
     xcparams_t *p);
 
+/**
+ * @brief   Frees the strings and arrays of an xc_params, but not the xc_params itself
+ *          (i.e the xc_params made by Go).
+ *
+ * @param   params  A pointer to the transcoding parameters.
+ */
+void
+avpipe_release_xcparams(
+    xcparams_t *params);
+
 #endif
@@ -29,18 +29,13 @@ copy_mpegts_set_encoder_options(
         return eav_timebase;
     }
 
-    int64_t seg_duration_ts = 0;
-    float seg_duration = 0;
-
-    /* Precalculate seg_duration_ts based on seg_duration if seg_duration is set */
-    if (params->seg_duration) {
-        seg_duration = atof(params->seg_duration);
-        if (stream_index == decoder_context->video_stream_index)
-            timebase = calc_timebase(params, 1, timebase);
-        seg_duration_ts = seg_duration * timebase;
-    }
-    if (params->video_seg_duration_ts > 0)
-        seg_duration_ts = params->video_seg_duration_ts;
+    int seg_timebase = timebase;
+    if (stream_index == decoder_context->video_stream_index)
+        seg_timebase = calc_timebase(params, 1, timebase);
+
+    int64_t seg_duration_ts = resolve_seg_duration_ts(params, params->video_seg_duration_ts, seg_timebase);
+    if (seg_duration_ts < 0)
+        return eav_param;
 
     av_opt_set_int(encoder_context->format_context->priv_data, "segment_duration_ts", seg_duration_ts, 0);
 
@@ -364,6 +359,7 @@ copy_mpegts_func(
     coderctx_t *encoder_context = &cp_ctx->encoder_ctx;
 
     format_context = encoder_context->format_context;
+    set_ffmpeg_log_prefix(params->log_prefix);
 
     while (!xctx->stop || elv_channel_size(cp_ctx->ch) > 0) {
 
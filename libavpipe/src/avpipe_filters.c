@@ -3,8 +3,48 @@
  */
 
 #include "avpipe_xc.h"
+#include "avpipe_format.h"
 #include "elv_log.h"
 
+/*
+ * @brief   Checks filters_descr (the video_filter or the audio_filter param) is a valid filtergraph with one
+ *          input and one output of the media type, so an invalid filter fails the initialization.
+ * @return  Returns 0 if it is valid, otherwise eav_filter_init.
+ */
+int
+check_filter_descr(
+    const char *filters_descr,
+    enum AVMediaType type,
+    xcparams_t *params)
+{
+    AVFilterGraph *filter_graph = avfilter_graph_alloc();
+    AVFilterInOut *inputs = NULL;
+    AVFilterInOut *outputs = NULL;
+    int rc = eav_success;
+    int ret;
+
+    if (!filter_graph)
+        return eav_filter_init;
+
+    if ((ret = avfilter_graph_parse2(filter_graph, filters_descr, &inputs, &outputs)) < 0) {
+        elv_err("Invalid %s filter \"%s\", ret=%d (%s), url=%s",
+            av_get_media_type_string(type), filters_descr, ret, av_err2str(ret), params->url);
+        rc = eav_filter_init;
+    } else if (!inputs || inputs->next || !outputs || outputs->next ||
+        avfilter_pad_get_type(inputs->filter_ctx->input_pads, inputs->pad_idx) != type ||
+        avfilter_pad_get_type(outputs->filter_ctx->output_pads, outputs->pad_idx) != type) {
+        elv_err("Invalid %s filter \"%s\", it must have one %s input and one %s output, url=%s",
+            av_get_media_type_string(type), filters_descr, av_get_media_type_string(type),
+            av_get_media_type_string(type), params->url);
+        rc = eav_filter_init;
+    }
+
+    avfilter_inout_free(&inputs);
+    avfilter_inout_free(&outputs);
+    avfilter_graph_free(&filter_graph);
+    return rc;
+}
+
 /*
  * @brief   Used to initialize video filter.
  * @return  Returns 0 if successful, otherwise eav_filter_init if there is an error.
@@ -175,9 +215,12 @@ init_audio_filters(
     AVFilterContext **abuffersrc_ctx = NULL;
     AVFilterContext *buffersink_ctx = NULL;
     AVFilterContext *format_ctx = NULL;
+    AVFilterContext *resample_ctx = NULL;
+    AVFilterContext *last_ctx = NULL;
     const AVFilter *buffersrc = avfilter_get_by_name("abuffer");
     const AVFilter *buffersink = avfilter_get_by_name("abuffersink");
     const AVFilter *aformat = avfilter_get_by_name("aformat");
+    const AVFilter *aresample = avfilter_get_by_name("aresample");
     AVFilterGraph *filter_graph;
 
     for (int i=0; i<encoder_context->n_audio_output; i++) {
@@ -209,6 +252,7 @@ init_audio_filters(
             elv_err("init_audio_filters, cannot create audio buffer source");
             goto end;
         }
+        last_ctx = abuffersrc_ctx[i];
 
         ret = avfilter_graph_create_filter(&buffersink_ctx, buffersink, "out", NULL, NULL, filter_graph);
         if (ret < 0) {
@@ -252,7 +296,61 @@ init_audio_filters(
             goto end;
         }
 
-        if ((ret = avfilter_link(abuffersrc_ctx[i], 0, format_ctx, 0)) < 0) {
+        if (params->fill_gaps) {
+            /*
+             * aresample pads the gaps of the timestamps larger than min_hard_comp with silence (async=1 fills
+             * and trims without stretching). first_pts pads the start if the audio starts after the input,
+             * unless the decoding doesn't start with the input.
+             */
+            int64_t start_time = decoder_context->format_context->start_time;
+            int n = snprintf(args, sizeof(args), "async=1:min_hard_comp=%f",
+                gap_threshold(params, (AVRational) {1, 1000}) / 1000.0);
+            if (start_time != AV_NOPTS_VALUE && params->chunk_key_frame_ts <= 0 && !params->skip_decoding)
+                snprintf(args + n, sizeof(args) - n, ":first_pts=%"PRId64,
+                    av_rescale_q(start_time, AV_TIME_BASE_Q, (AVRational) {1, dec_codec_ctx->sample_rate}));
+            elv_dbg("init_audio_filters, audio resample_filter args=%s", args);
+
+            ret = avfilter_graph_create_filter(&resample_ctx, aresample, "fill_gaps", args, NULL, filter_graph);
+            if (ret < 0) {
+                elv_err("init_audio_filters, cannot create audio resample filter");
+                goto end;
+            }
+
+            if ((ret = avfilter_link(abuffersrc_ctx[i], 0, resample_ctx, 0)) < 0) {
+                elv_err("init_audio_filters, failed to link audio src to resample, ret=%d", ret);
+                goto end;
+            }
+            last_ctx = resample_ctx;
+        }
+
+        if (params->audio_filter && params->audio_filter[0] != '\0') {
+            /* The audio_filter graph is linked between the source (or the gap filling) and the format filter */
+            AVFilterInOut *outputs = avfilter_inout_alloc();
+            AVFilterInOut *inputs = avfilter_inout_alloc();
+            if (!outputs || !inputs) {
+                avfilter_inout_free(&inputs);
+                avfilter_inout_free(&outputs);
+                ret = AVERROR(ENOMEM);
+                goto end;
+            }
+            outputs->name       = av_strdup("in");
+            outputs->filter_ctx = last_ctx;
+            outputs->pad_idx    = 0;
+            outputs->next       = NULL;
+
+            inputs->name        = av_strdup("out");
+            inputs->filter_ctx  = format_ctx;
+            inputs->pad_idx     = 0;
+            inputs->next        = NULL;
+
+            ret = avfilter_graph_parse_ptr(filter_graph, params->audio_filter, &inputs, &outputs, NULL);
+            avfilter_inout_free(&inputs);
+            avfilter_inout_free(&outputs);
+            if (ret < 0) {
+                elv_err("init_audio_filters, failed to parse audio_filter=\"%s\", ret=%d", params->audio_filter, ret);
+                goto end;
+            }
+        } else if ((ret = avfilter_link(last_ctx, 0, format_ctx, 0)) < 0) {
             elv_err("init_audio_filters, failed to link audio src to format, ret=%d", ret);
             goto end;
         }
@@ -12,6 +12,9 @@
 #include "avpipe_xc.h"
 #include "elv_log.h"
 
+#include <math.h>
+#include <stdlib.h>
+#include <string.h>
 #include <sys/time.h>
 
 
@@ -227,6 +230,47 @@ calc_timebase(
     return timebase;
 }
 
+/*
+ * Returns seg_duration in seconds, 0 if seg_duration is not set.
+ */
+double
+seg_duration_sec(
+    xcparams_t *params)
+{
+    if (!params->seg_duration || params->seg_duration[0] == '\0')
+        return 0;
+
+    return atof(params->seg_duration);
+}
+
+/*
+ * Returns the segment duration of a stream in timebase units.
+ * If seg_duration (sec) is set it is converted to the timebase, otherwise seg_duration_ts (the audio or
+ * video seg_duration_ts param) is returned as is. If both are set they must be the same duration, up to
+ * one tick of rounding, otherwise it returns -1.
+ */
+int64_t
+resolve_seg_duration_ts(
+    xcparams_t *params,
+    int64_t seg_duration_ts,
+    int timebase)
+{
+    double seg_duration = seg_duration_sec(params);
+    int64_t ts;
+
+    if (seg_duration <= 0)
+        return seg_duration_ts;
+
+    ts = llrint(seg_duration * timebase);
+    if (seg_duration_ts > 0 && llabs(seg_duration_ts - ts) > 1) {
+        elv_err("Conflicting segment duration, seg_duration=%s (%"PRId64" ts) seg_duration_ts=%"PRId64", timebase=%d, url=%s",
+            params->seg_duration, ts, seg_duration_ts, timebase, params->url);
+        return -1;
+    }
+
+    return ts;
+}
+
 int
 packet_clone(
     AVPacket *src,
@@ -334,3 +378,196 @@ void frame_rescale_time_base(
     if (frame->pkt_duration > 0)
         frame->pkt_duration = av_rescale_q(frame->pkt_duration, src_time_base, dst_time_base);
 }
+
+/*
+ * Returns 1 if the bitstream filter of spec (i.e "h264_mp4toannexb" or "hevc_metadata=level=5.1") can filter
+ * codec_id, 0 if it can't and -1 if there is no such filter. Filters that don't list their codecs take any codec.
+ */
+int
+bitstream_filter_supports_codec(
+    const char *spec,
+    enum AVCodecID codec_id
+) {
+    char name[64];
+    size_t len = strcspn(spec, "=");
+
+    if (len == 0 || len >= sizeof(name))
+        return -1;
+    memcpy(name, spec, len);
+    name[len] = '\0';
+
+    const AVBitStreamFilter *filter = av_bsf_get_by_name(name);
+    if (!filter)
+        return -1;
+    if (!filter->codec_ids)
+        return 1;
+
+    for (const enum AVCodecID *id = filter->codec_ids; *id != AV_CODEC_ID_NONE; id++) {
+        if (*id == codec_id)
+            return 1;
+    }
+    return 0;
+}
+
+/*
+ * Sets up the bitstream filters of params->bitstream_filters (comma separated) that apply to the codec of the
+ * copied stream, *bsf_context is NULL if none applies. The stream parameters are updated with the output of the
+ * filters, so this has to be called before the header of the output is written.
+ */
+int
+init_bitstream_filters(
+    xcparams_t *params,
+    AVStream *stream,
+    AVBSFContext **bsf_context
+) {
+    char *filters, *spec, *saveptr;
+    char *selected;
+    int rc = eav_success;
+
+    *bsf_context = NULL;
+    if (!params->bitstream_filters || params->bitstream_filters[0] == '\0')
+        return eav_success;
+
+    filters = strdup(params->bitstream_filters);
+    selected = calloc(1, strlen(params->bitstream_filters) + 1);
+    for (spec = strtok_r(filters, ",", &saveptr); spec; spec = strtok_r(NULL, ",", &saveptr)) {
+        if (bitstream_filter_supports_codec(spec, stream->codecpar->codec_id) <= 0)
+            continue;
+        if (selected[0] != '\0')
+            strcat(selected, ",");
+        strcat(selected, spec);
+    }
+    free(filters);
+
+    if (selected[0] == '\0')
+        goto done;
+
+    if (av_bsf_list_parse_str(selected, bsf_context) < 0) {
+        elv_err("Invalid bitstream_filters=%s, url=%s", selected, params->url);
+        rc = eav_param;
+        goto done;
+    }
+
+    if (avcodec_parameters_copy((*bsf_context)->par_in, stream->codecpar) < 0) {
+        rc = eav_codec_param;
+        goto done;
+    }
+    (*bsf_context)->time_base_in = stream->time_base;
+
+    if (av_bsf_init(*bsf_context) < 0) {
+        elv_err("Failed to initialize bitstream_filters=%s, codec=%s, url=%s",
+            selected, avcodec_get_name(stream->codecpar->codec_id), params->url);
+        rc = eav_param;
+        goto done;
+    }
+
+    if (avcodec_parameters_copy(stream->codecpar, (*bsf_context)->par_out) < 0) {
+        rc = eav_codec_param;
+        goto done;
+    }
+    stream->time_base = (*bsf_context)->time_base_out;
+
+    elv_log("Bitstream filters %s on stream %d (%s), url=%s",
+        selected, stream->index, avcodec_get_name(stream->codecpar->codec_id), params->url);
+
+done:
+    if (rc != eav_success)
+        av_bsf_free(bsf_context);
+    free(selected);
+    return rc;
+}
+
+/*
+ * Writes the packet through the bitstream filters of its stream, or as is if bsf_context is NULL.
+ * The packet is blank on return like with av_interleaved_write_frame(), except for its stream_index.
+ */
+int
+write_bitstream_filtered_packet(
+    AVFormatContext *format_context,
+    AVBSFContext *bsf_context,
+    AVPacket *packet
+) {
+    int stream_index = packet->stream_index;
+    int rc;
+
+    if (!bsf_context)
+        return av_interleaved_write_frame(format_context, packet);
+
+    if ((rc = av_bsf_send_packet(bsf_context, packet)) < 0)
+        return rc;
+
+    while ((rc = av_bsf_receive_packet(bsf_context, packet)) >= 0) {
+        packet->stream_index = stream_index;
+        if ((rc = av_interleaved_write_frame(format_context, packet)) < 0)
+            return rc;
+    }
+    packet->stream_index = stream_index;
+
+    if (rc == AVERROR(EAGAIN) || rc == AVERROR_EOF)
+        return 0;
+    return rc;
+}
+
+/*
+ * Sets params->muxer_opts on format_context (the generic AVFormatContext options and the private options of
+ * its muxer), after the options avpipe sets itself so they can be overridden, and writes the header of the
+ * output. Returns eav_param if an option is invalid or unknown to the muxer.
+ */
+int
+write_output_header(
+    xcparams_t *params,
+    AVFormatContext *format_context
+) {
+    AVDictionary *opts = NULL;
+    AVDictionaryEntry *unknown = NULL;
+    int rc;
+
+    if (params->muxer_opts && params->muxer_opts[0] != '\0') {
+        if (av_dict_parse_string(&opts, params->muxer_opts, "=", ":", 0) < 0) {
+            elv_err("Invalid muxer_opts=%s, url=%s", params->muxer_opts, params->url);
+            av_dict_free(&opts);
+            return eav_param;
+        }
+
+        rc = av_opt_set_dict2(format_context, &opts, AV_OPT_SEARCH_CHILDREN);
+        if (rc < 0) {
+            elv_err("Invalid muxer_opts=%s, muxer=%s, err=%s, url=%s",
+                params->muxer_opts, format_context->oformat->name, av_err2str(rc), params->url);
+            av_dict_free(&opts);
+            return eav_param;
+        }
+
+        /* The options that are left are not options of the muxer */
+        if ((unknown = av_dict_get(opts, "", NULL, AV_DICT_IGNORE_SUFFIX))) {
+            elv_err("Unknown muxer option %s=%s, muxer=%s, url=%s",
+                unknown->key, unknown->value, format_context->oformat->name, params->url);
+            av_dict_free(&opts);
+            return eav_param;
+        }
+        av_dict_free(&opts);
+    }
+
+    rc = avformat_write_header(format_context, NULL);
+    if (rc < 0) {
+        elv_err("Failed to write output header, muxer=%s, err=%s, url=%s",
+            format_context->oformat->name, av_err2str(rc), params->url);
+        return eav_write_header;
+    }
+    return eav_success;
+}
+
+/* Gaps of the input timestamps larger than this are filled with fill_gaps if gap_threshold_ms is not set */
+#define DEFAULT_GAP_THRESHOLD_MS    100
+
+/*
+ * Returns the threshold of the gaps filled with params->fill_gaps in time_base.
+ */
+int64_t
+gap_threshold(
+    xcparams_t *params,
+    AVRational time_base
+) {
+    int threshold_ms = params->gap_threshold_ms > 0 ? params->gap_threshold_ms : DEFAULT_GAP_THRESHOLD_MS;
+
+    return av_rescale_q(threshold_ms, (AVRational) {1, 1000}, time_base);
+}
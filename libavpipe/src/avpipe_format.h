@@ -66,6 +66,18 @@ calc_timebase(
     int timebase
 );
 
+double
+seg_duration_sec(
+    xcparams_t *params
+);
+
+int64_t
+resolve_seg_duration_ts(
+    xcparams_t *params,
+    int64_t seg_duration_ts,
+    int timebase
+);
+
 int
 packet_clone(
     AVPacket *src,
@@ -80,3 +92,25 @@ void frame_rescale_time_base(
     AVFrame *frame,
     AVRational src_time_base,
     AVRational dst_time_base);
+
+int bitstream_filter_supports_codec(
+    const char *spec,
+    enum AVCodecID codec_id);
+
+int init_bitstream_filters(
+    xcparams_t *params,
+    AVStream *stream,
+    AVBSFContext **bsf_context);
+
+int write_bitstream_filtered_packet(
+    AVFormatContext *format_context,
+    AVBSFContext *bsf_context,
+    AVPacket *packet);
+
+int write_output_header(
+    xcparams_t *params,
+    AVFormatContext *format_context);
+
+int64_t gap_threshold(
+    xcparams_t *params,
+    AVRational time_base);
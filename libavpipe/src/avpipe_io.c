@@ -11,6 +11,8 @@
 
 #include "avpipe_xc.h"
 #include "avpipe_utils.h"
+#include "avpipe_remux.h"
+#include "avpipe_format.h"
 #include "elv_log.h"
 
 #include <stdio.h>
@@ -22,8 +24,376 @@
 #include <unistd.h>
 #include <errno.h>
 #include <ctype.h>
+#include <limits.h>
 
 
+/*
+ * Returns 1 if the bytes written to outctx are captured for decode verification (params->verify_segments),
+ * for adding the pssh boxes (params->drm_systems) or for adding the emsg boxes (params->inject_metadata).
+ * Init segments are captured too since fragmented segments can't be decoded without them. Outputs with a
+ * moov box are held until they are closed when pssh boxes are added, video segments are held when emsg
+ * boxes are added and the mp4 outputs of a remux or with params->faststart are held to move their moov box first.
+ */
+static int
+elv_io_verify_capture(
+    ioctx_t *outctx,
+    out_tracker_t *out_tracker)
+{
+    xcparams_t *params = out_tracker->inctx ? out_tracker->inctx->params : NULL;
+
+    if (!params)
+        return 0;
+
+    switch (outctx->type) {
+    case avpipe_video_fmp4_segment:
+        outctx->hold = params->n_drm_systems > 0 || params->n_inject_metadata > 0;
+        break;
+    case avpipe_video_init_stream:
+    case avpipe_audio_init_stream:
+    case avpipe_audio_fmp4_segment:
+        outctx->hold = params->n_drm_systems > 0;
+        break;
+    case avpipe_video_segment:
+        outctx->hold = params->n_inject_metadata > 0;
+        break;
+    case avpipe_mp4_segment:
+        outctx->hold = params->faststart;
+        break;
+    case avpipe_audio_segment:
+    case avpipe_mpegts_segment:
+        break;
+    case avpipe_mp4_stream:
+        outctx->hold = params->faststart || (avpipe_is_remux(params) && !strcmp(params->format, "mp4"));
+        if (!outctx->hold)
+            return 0;
+        break;
+    default:
+        return 0;
+    }
+
+    if (!params->verify_segments && !outctx->hold)
+        return 0;
+
+    outctx->verify_handlers = out_tracker->out_handlers;
+    return 1;
+}
+
+/*
+ * Keeps a copy of the written bytes at the current write position and passes them on to the output handler.
+ */
+static int
+elv_io_verify_write(
+    void *opaque,
+    uint8_t *buf,
+    int buf_size)
+{
+    ioctx_t *outctx = (ioctx_t *) opaque;
+    int64_t end = outctx->verify_pos + buf_size;
+
+    if (end > outctx->verify_buf_sz) {
+        int64_t sz = outctx->verify_buf_sz > 0 ? outctx->verify_buf_sz : AVIO_OUT_BUF_SIZE;
+        while (sz < end)
+            sz *= 2;
+        uint8_t *verify_buf = (uint8_t *) realloc(outctx->verify_buf, sz);
+        if (!verify_buf) {
+            elv_err("Failed to allocate segment verification buffer, size=%"PRId64", url=%s", sz, outctx->url);
+            return AVERROR(ENOMEM);
+        }
+        outctx->verify_buf = verify_buf;
+        outctx->verify_buf_sz = sz;
+    }
+
+    memcpy(outctx->verify_buf + outctx->verify_pos, buf, buf_size);
+    outctx->verify_pos = end;
+    if (end > outctx->verify_len)
+        outctx->verify_len = end;
+
+    if (outctx->hold)
+        return buf_size;
+
+    return outctx->verify_handlers->avpipe_writer(opaque, buf, buf_size);
+}
+
+static int64_t
+elv_io_verify_seek(
+    void *opaque,
+    int64_t offset,
+    int whence)
+{
+    ioctx_t *outctx = (ioctx_t *) opaque;
+    int64_t rc;
+
+    /* Held bytes are not written yet, the seek is within the captured bytes */
+    if (outctx->hold && whence & AVSEEK_SIZE)
+        return outctx->verify_len;
+    else if (outctx->hold)
+        rc = 0;
+    else
+        rc = outctx->verify_handlers->avpipe_seeker(opaque, offset, whence);
+
+    if (rc < 0 || whence & AVSEEK_SIZE)
+        return rc;
+
+    switch (whence & 0xFFFF) {
+    case SEEK_SET:
+        outctx->verify_pos = offset; break;
+    case SEEK_CUR:
+        outctx->verify_pos += offset; break;
+    case SEEK_END:
+        outctx->verify_pos = outctx->verify_len + offset; break;
+    }
+
+    return outctx->hold ? outctx->verify_pos : rc;
+}
+
+/*
+ * Adds the pssh boxes and the emsg boxes to the held bytes of an output, or moves the moov box of an mp4
+ * output first, and writes them to the output handler. The bytes are written unchanged if the boxes
+ * can't be added or moved.
+ */
+static int
+elv_io_write_held(
+    ioctx_t *outctx,
+    out_tracker_t *out_tracker)
+{
+    xcparams_t *params = out_tracker->inctx->params;
+    coderctx_t *encoder_ctx = out_tracker->encoder_ctx;
+    uint8_t *out_buf = NULL;
+    int64_t out_len = 0;
+    int rc = eav_success;
+    int ret;
+
+    if (params->n_drm_systems > 0 && outctx->type != avpipe_video_segment) {
+        ret = avpipe_insert_pssh(params, outctx->seg_index, outctx->verify_buf, outctx->verify_len, &out_buf, &out_len);
+        if (ret == eav_success) {
+            free(outctx->verify_buf);
+            outctx->verify_buf = out_buf;
+            outctx->verify_buf_sz = out_len;
+            outctx->verify_len = out_len;
+        } else {
+            elv_err("Failed to add pssh boxes, seg_index=%d, rc=%d, url=%s", outctx->seg_index, ret, outctx->url);
+            rc = ret;
+        }
+    }
+
+    if (params->n_inject_metadata > 0 && outctx->seg_frames > 0 &&
+        (outctx->type == avpipe_video_segment || outctx->type == avpipe_video_fmp4_segment)) {
+        /* The segment muxer (fmp4-segment) resets the timestamps of each segment */
+        out_buf = NULL;
+        ret = avpipe_insert_emsg(params, &encoder_ctx->next_inject_metadata,
+            encoder_ctx->stream[encoder_ctx->video_stream_index]->time_base,
+            outctx->seg_start_pts, outctx->seg_end_pts, outctx->type == avpipe_video_fmp4_segment,
+            outctx->verify_buf, outctx->verify_len, &out_buf, &out_len);
+        if (ret == eav_success && out_buf) {
+            free(outctx->verify_buf);
+            outctx->verify_buf = out_buf;
+            outctx->verify_buf_sz = out_len;
+            outctx->verify_len = out_len;
+        } else if (ret != eav_success) {
+            elv_err("Failed to add emsg boxes, seg_index=%d, rc=%d, url=%s", outctx->seg_index, ret, outctx->url);
+            rc = ret;
+        }
+    }
+
+    if (outctx->type == avpipe_mp4_stream || outctx->type == avpipe_mp4_segment) {
+        out_buf = NULL;
+        ret = avpipe_mp4_faststart(outctx->verify_buf, outctx->verify_len, &out_buf, &out_len);
+        if (ret == eav_success && out_buf) {
+            free(outctx->verify_buf);
+            outctx->verify_buf = out_buf;
+            outctx->verify_buf_sz = out_len;
+        } else if (ret != eav_success) {
+            elv_err("Failed to move the moov box first, rc=%d, url=%s", ret, outctx->url);
+            rc = ret;
+        }
+    }
+
+    /* An mp4 output can be bigger than what a single write takes */
+    for (int64_t pos = 0; pos < outctx->verify_len; ) {
+        int sz = outctx->verify_len - pos > INT_MAX ? INT_MAX : (int) (outctx->verify_len - pos);
+        if (out_tracker->out_handlers->avpipe_writer(outctx, outctx->verify_buf + pos, sz) < 0) {
+            elv_err("Failed to write held output, seg_index=%d, url=%s", outctx->seg_index, outctx->url);
+            return eav_write_frame;
+        }
+        pos += sz;
+    }
+
+    return rc;
+}
+
+/*
+ * Decodes the captured bytes of a segment when it is closed and reports the segment if it fails.
+ * Init segments are kept in the out_tracker for the segments that follow.
+ */
+static void
+elv_io_verify_segment(
+    ioctx_t *outctx,
+    out_tracker_t *out_tracker)
+{
+    xcparams_t *params = out_tracker->inctx->params;
+    int rc;
+
+    if (outctx->type == avpipe_video_init_stream || outctx->type == avpipe_audio_init_stream) {
+        free(out_tracker->verify_init_buf);
+        out_tracker->verify_init_buf = outctx->verify_buf;
+        out_tracker->verify_init_len = outctx->verify_len;
+        outctx->verify_buf = NULL;
+        return;
+    }
+
+    /* Segments of the segment muxer (fmp4-segment) are self contained */
+    rc = avpipe_verify_segment(
+        outctx->type == avpipe_mp4_segment ? NULL : out_tracker->verify_init_buf,
+        outctx->type == avpipe_mp4_segment ? 0 : out_tracker->verify_init_len,
+        outctx->verify_buf, outctx->verify_len, outctx->url);
+    if (rc == eav_success)
+        return;
+
+    elv_err("Segment failed decode verification, seg_index=%d, rc=%d, url=%s, input=%s",
+        outctx->seg_index, rc, outctx->url, params->url);
+    if (out_tracker->encoder_ctx)
+        out_tracker->encoder_ctx->segments_verify_failed++;
+    if (out_tracker->out_handlers->avpipe_stater)
+        out_tracker->out_handlers->avpipe_stater(outctx, out_tracker->output_stream_index, out_stat_segment_verify_failed);
+}
+
+/*
+ * Returns 1 if the fragments written to outctx are indexed in a sidecar (params->sidecar_index), that is if
+ * it is the single file of a fmp4 or cmaf output. The audio of these formats is written to its own file
+ * named like a fmp4-segment audio segment.
+ */
+static int
+elv_io_index_capture(
+    ioctx_t *outctx,
+    out_tracker_t *out_tracker)
+{
+    xcparams_t *params = out_tracker->inctx ? out_tracker->inctx->params : NULL;
+
+    if (!params || !params->sidecar_index || !params->format ||
+        (strcmp(params->format, "fmp4") && strcmp(params->format, "cmaf")))
+        return 0;
+
+    return outctx->type == avpipe_fmp4_stream || outctx->type == avpipe_audio_fmp4_segment;
+}
+
+/*
+ * Records the fragments of a fragmented mp4 output and passes the bytes on to the output writer. The mp4
+ * muxer marks the start of each fragment, the output is not seekable so the offset of a fragment is the
+ * number of bytes written before it. Only the fragments starting with a key frame (sync points) are
+ * recorded, at most one per seg_duration if it is set since fmp4 writes a fragment per frame.
+ */
+static int
+elv_io_index_write(
+    void *opaque,
+    uint8_t *buf,
+    int buf_size,
+    enum AVIODataMarkerType type,
+    int64_t time)
+{
+    ioctx_t *outctx = (ioctx_t *) opaque;
+
+    if (type == AVIO_DATA_MARKER_SYNC_POINT && time != AV_NOPTS_VALUE && time != outctx->index_marker_time) {
+        double seg_duration = outctx->inctx ? seg_duration_sec(outctx->inctx->params) : 0;
+        outctx->index_marker_time = time;
+
+        if (outctx->n_index_entries == 0 || seg_duration <= 0 ||
+            time - outctx->index_entries[outctx->n_index_entries - 1].time_us >= (int64_t) (seg_duration * AV_TIME_BASE)) {
+            if (outctx->n_index_entries == outctx->index_entries_sz) {
+                int sz = outctx->index_entries_sz > 0 ? outctx->index_entries_sz * 2 : 64;
+                index_entry_t *entries = (index_entry_t *) realloc(outctx->index_entries, sz * sizeof(index_entry_t));
+                if (!entries) {
+                    elv_err("Failed to allocate index entries, size=%d, url=%s", sz, outctx->url);
+                    return AVERROR(ENOMEM);
+                }
+                outctx->index_entries = entries;
+                outctx->index_entries_sz = sz;
+            }
+            outctx->index_entries[outctx->n_index_entries].time_us = time;
+            outctx->index_entries[outctx->n_index_entries].offset = outctx->index_pos;
+            outctx->n_index_entries++;
+        }
+    } else if (type == AVIO_DATA_MARKER_TRAILER && outctx->index_trailer_pos < 0) {
+        outctx->index_trailer_pos = outctx->index_pos;
+    }
+
+    outctx->index_pos += buf_size;
+    return outctx->index_writer(opaque, buf, buf_size);
+}
+
+/*
+ * Writes the index of the fragments of outctx as a JSON output of type avpipe_index_sidecar, once all the
+ * bytes of outctx are written:
+ * {"url":"fmp4-stream.mp4","stream_index":0,"size":N,"header_size":H,"trailer_offset":T,
+ *  "fragments":[{"time_us":0,"offset":H,"size":S},...]}
+ * The header is the ftyp and moov boxes, a fragment ends where the next one (or the trailer) starts.
+ */
+static int
+elv_io_write_index(
+    ioctx_t *outctx,
+    out_tracker_t *out_tracker)
+{
+    avpipe_io_handler_t *out_handlers = out_tracker->out_handlers;
+    int64_t trailer_pos = outctx->index_trailer_pos >= 0 ? outctx->index_trailer_pos : outctx->index_pos;
+    int64_t header_size = outctx->n_index_entries > 0 ? outctx->index_entries[0].offset : trailer_pos;
+    ioctx_t *indexctx = NULL;
+    char url[MAX_AVFILENAME_LEN];
+    char *json = NULL;
+    int json_sz = 512 + outctx->n_index_entries * 128;
+    int len;
+    int rc = eav_success;
+
+    json = (char *) malloc(json_sz);
+    if (!json) {
+        elv_err("Failed to allocate index sidecar, url=%s", outctx->url);
+        return eav_mem_alloc;
+    }
+
+    len = snprintf(json, json_sz,
+        "{\"url\":\"%s\",\"stream_index\":%d,\"size\":%"PRId64",\"header_size\":%"PRId64",\"trailer_offset\":%"PRId64",\"fragments\":[",
+        outctx->url ? outctx->url : "", outctx->stream_index, outctx->index_pos, header_size, trailer_pos);
+    for (int i = 0; i < outctx->n_index_entries; i++) {
+        int64_t end = i + 1 < outctx->n_index_entries ? outctx->index_entries[i+1].offset : trailer_pos;
+        len += snprintf(json + len, json_sz - len, "%s{\"time_us\":%"PRId64",\"offset\":%"PRId64",\"size\":%"PRId64"}",
+            i > 0 ? "," : "", outctx->index_entries[i].time_us, outctx->index_entries[i].offset,
+            end - outctx->index_entries[i].offset);
+    }
+    len += snprintf(json + len, json_sz - len, "]}");
+
+    /* The sidecar has the input stream index of the indexed output, the video and the audio files are told apart */
+    indexctx = (ioctx_t *) calloc(1, sizeof(ioctx_t));
+    indexctx->type = avpipe_index_sidecar;
+    indexctx->stream_index = out_tracker->xc_type == xc_audio ? out_tracker->audio_stream_index : out_tracker->video_stream_index;
+    if (indexctx->stream_index < 0)
+        indexctx->stream_index = 0;
+    indexctx->seg_index = -1;
+    indexctx->inctx = out_tracker->inctx;
+    indexctx->encoder_ctx = out_tracker->encoder_ctx;
+    snprintf(url, sizeof(url), "index-stream%d.json", indexctx->stream_index);
+    indexctx->url = strdup(url);
+
+    if (out_handlers->avpipe_opener(url, indexctx) < 0) {
+        elv_err("Failed to open index sidecar, url=%s", outctx->url);
+        rc = eav_write_frame;
+        goto end_write_index;
+    }
+
+    if (out_handlers->avpipe_writer(indexctx, (uint8_t *) json, len) < 0) {
+        elv_err("Failed to write index sidecar, url=%s", outctx->url);
+        rc = eav_write_frame;
+    }
+    out_handlers->avpipe_closer(indexctx);
+
+    elv_dbg("INDEX SIDECAR url=%s, fragments=%d, size=%"PRId64", header_size=%"PRId64,
+        outctx->url, outctx->n_index_entries, outctx->index_pos, header_size);
+
+end_write_index:
+    av_freep(&indexctx->buf);
+    free(indexctx->url);
+    free(indexctx);
+    free(json);
+    return rc;
+}
+
 /*
  * Returns the AVIOContext as output argument 'pb'
  */
@@ -54,7 +424,7 @@ elv_io_open(
         outctx->stream_index = (int) strtol(stream_opt->value, &endptr, 10);
         outctx->url = strdup(url);
         assert(outctx->stream_index == 0 || outctx->stream_index == 1);
-        if (out_tracker->xc_type == xc_video)
+        if (out_tracker->xc_type == xc_video || out_tracker->xc_type == xc_still)
             outctx->type = avpipe_video_segment;
         else
             outctx->type = avpipe_audio_segment;
@@ -67,8 +437,11 @@ elv_io_open(
             return -1;
         }
 
+        int verify = elv_io_verify_capture(outctx, out_tracker);
         AVIOContext *avioctx = avio_alloc_context(outctx->buf, outctx->bufsz, AVIO_FLAG_WRITE, (void *)outctx,
-            out_handlers->avpipe_reader, out_handlers->avpipe_writer, out_handlers->avpipe_seeker);
+            out_handlers->avpipe_reader,
+            verify ? elv_io_verify_write : out_handlers->avpipe_writer,
+            verify ? elv_io_verify_seek : out_handlers->avpipe_seeker);
 
         avioctx->seekable = 0;
         avioctx->direct = 1;
@@ -118,14 +491,14 @@ elv_io_open(
                 outctx->seg_index = -1;     // Special index for manifest
             }
             else if (!strncmp(url, "media", 5)) {
-                if (out_tracker->xc_type == xc_video)
+                if (out_tracker->xc_type == xc_video || out_tracker->xc_type == xc_still)
                     outctx->type = avpipe_video_m3u;
                 else
                     outctx->type = avpipe_audio_m3u;
                 outctx->seg_index = -1;     // Special index for manifest
             }
             else if (!strncmp(url, "init", 4)) {
-                if (out_tracker->xc_type == xc_video)
+                if (out_tracker->xc_type == xc_video || out_tracker->xc_type == xc_still)
                     outctx->type = avpipe_video_init_stream;
                 else
                     outctx->type = avpipe_audio_init_stream;
@@ -134,8 +507,21 @@ elv_io_open(
                 outctx->type = avpipe_aes_128_key;
                 outctx->seg_index = -2;
             }
+            else if (!strncmp(url, "vttinit", 7)) {
+                outctx->type = avpipe_webvtt_init_stream;
+            }
             else if (!strncmp(url, "mp4", 3)) {
                 outctx->type = avpipe_mp4_stream;
+            } else if (!strncmp(url, "webm", 4)) {
+                if (out_tracker->xc_type == xc_audio)
+                    outctx->type = avpipe_audio_webm_stream;
+                else
+                    outctx->type = avpipe_video_webm_stream;
+            } else if (strstr(url, "vttsegment")) {
+                outctx->type = avpipe_webvtt_segment;
+                outctx->seg_index = out_tracker->seg_index;
+                out_tracker->seg_index++;
+                outctx->inctx = out_tracker->inctx;
             } else if (strstr(url, "fsegment")) {
                 if (strstr(url, "fsegment-video"))
                     outctx->type = avpipe_video_fmp4_segment;
@@ -154,7 +540,7 @@ elv_io_open(
                 outctx->seg_index = out_tracker->seg_index;
                 out_tracker->seg_index++;
                 outctx->inctx = out_tracker->inctx;
-            } else if (!strncmp(url, "fmp4", 4)) {
+            } else if (!strncmp(url, "fmp4", 4) || !strncmp(url, "cmaf", 4)) {
                 outctx->type = avpipe_fmp4_stream;
             } else if (strstr(url, "segment")) {
                 outctx->type = avpipe_mp4_segment;
@@ -167,9 +553,12 @@ elv_io_open(
         if (outctx->type == avpipe_mp4_segment ||
             outctx->type == avpipe_fmp4_stream ||
             outctx->type == avpipe_mp4_stream ||
+            outctx->type == avpipe_video_webm_stream ||
+            outctx->type == avpipe_audio_webm_stream ||
             outctx->type == avpipe_video_fmp4_segment ||
             outctx->type == avpipe_audio_fmp4_segment ||
-            outctx->type == avpipe_mpegts_segment)
+            outctx->type == avpipe_mpegts_segment ||
+            outctx->type == avpipe_webvtt_segment)
             // not set for outctx->type == avpipe_image because elv_io_close will free outctx for each frame extracted
             out_tracker->last_outctx = outctx;
         /* Manifest or init segments */
@@ -178,14 +567,27 @@ elv_io_open(
             return -1;
         }
 
+        int verify = elv_io_verify_capture(outctx, out_tracker);
         AVIOContext *avioctx = avio_alloc_context(outctx->buf, outctx->bufsz, AVIO_FLAG_WRITE, (void *)outctx,
-            out_handlers->avpipe_reader, out_handlers->avpipe_writer, out_handlers->avpipe_seeker);
+            out_handlers->avpipe_reader,
+            verify ? elv_io_verify_write : out_handlers->avpipe_writer,
+            verify ? elv_io_verify_seek : out_handlers->avpipe_seeker);
 
         elv_dbg("OUT elv_io_open url=%s, type=%d, stream_index=%d, seg_index=%d, last_outctx=%p, buf=%p",
             url, outctx->type, outctx->stream_index, outctx->seg_index, out_tracker->last_outctx, avioctx->buffer);
 
-        /* libavformat expects seekable streams for mp4 */
-        if (outctx->type == avpipe_mp4_stream || outctx->type == avpipe_mp4_segment)
+        /* The muxer marks the fragments written to the output with the marker writer */
+        if (elv_io_index_capture(outctx, out_tracker)) {
+            outctx->index_writer = verify ? elv_io_verify_write : out_handlers->avpipe_writer;
+            outctx->index_marker_time = AV_NOPTS_VALUE;
+            outctx->index_trailer_pos = -1;
+            avioctx->write_data_type = elv_io_index_write;
+            avioctx->ignore_boundary_point = 1;
+        }
+
+        /* libavformat expects seekable streams for mp4, matroska seeks back to write the duration and the cues */
+        if (outctx->type == avpipe_mp4_stream || outctx->type == avpipe_mp4_segment ||
+            outctx->type == avpipe_video_webm_stream || outctx->type == avpipe_audio_webm_stream)
             avioctx->seekable = 1;
         else
             avioctx->seekable = 0;
@@ -223,17 +625,46 @@ elv_io_close(
     elv_dbg("OUT elv_io_close url=%s, stream_index=%d, seg_index=%d avioctx=%p, avioctx->opaque=%p buf=%p outtracker->last_outctx=%p, outhandlers=%p",
         outctx != NULL ? outctx->url : "", outctx != NULL ? outctx->stream_index : -1, outctx != NULL ? outctx->seg_index : -1, pb, pb->opaque, avioctx->buffer,
 	    out_tracker != NULL ? out_tracker->last_outctx : 0, out_handlers);
+    if (out_handlers && outctx && outctx->verify_handlers) {
+        /* Flush the buffered bytes, so the whole segment is captured */
+        avio_flush(avioctx);
+        if (outctx->hold)
+            elv_io_write_held(outctx, out_tracker);
+        if (out_tracker->inctx->params->verify_segments)
+            elv_io_verify_segment(outctx, out_tracker);
+    }
+    if (out_handlers && outctx && outctx->index_writer)
+        /* Flush the buffered bytes, so the size and the trailer offset of the index are final */
+        avio_flush(avioctx);
+    if (out_tracker && outctx && out_tracker->inctx->params->n_key_periods > 0 &&
+        (outctx->type == avpipe_video_fmp4_segment || outctx->type == avpipe_audio_fmp4_segment ||
+         outctx->type == avpipe_mp4_segment)) {
+        /* Switch the key before the muxer starts the next segment */
+        AVFormatContext *enc_format_ctx = out_tracker->xc_type == xc_audio ?
+            out_tracker->encoder_ctx->format_context2[out_tracker->output_stream_index] :
+            out_tracker->encoder_ctx->format_context;
+        avpipe_set_key_period(enc_format_ctx, out_tracker->inctx->params, outctx->seg_index + 1);
+    }
     if (out_handlers) {
         // TODO(Nate): Separate out this stat into something more descriptive of the particular case
         // For now, this double-stat is fine because the 'out_stat_encoding_end_pts' is also used
         // for muxing, which doesn't have a meaningful value of 'seg_index'. Additionally, ABR and
         // mez should be pretty separate. But that can be done later.
         out_handlers->avpipe_stater(outctx, out_tracker->output_stream_index, out_stat_encoding_end_pts);
+        if (outctx && (outctx->type == avpipe_video_segment || outctx->type == avpipe_audio_segment ||
+            outctx->type == avpipe_mp4_segment || outctx->type == avpipe_video_fmp4_segment ||
+            outctx->type == avpipe_audio_fmp4_segment || outctx->type == avpipe_mpegts_segment))
+            out_handlers->avpipe_stater(outctx, out_tracker->output_stream_index, out_stat_segment_done);
         out_handlers->avpipe_stater(outctx, out_tracker->output_stream_index, out_stat_end_file);
         out_handlers->avpipe_closer(outctx);
     }
-    if (outctx)
+    if (out_handlers && outctx && outctx->index_writer)
+        elv_io_write_index(outctx, out_tracker);
+    if (outctx) {
         free(outctx->url);
+        free(outctx->verify_buf);
+        free(outctx->index_entries);
+    }
     free(outctx);
     pb->opaque = NULL;
     if (out_tracker)
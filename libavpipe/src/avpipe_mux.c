@@ -86,7 +86,8 @@ prepare_input(
     avpipe_io_handler_t *in_handlers,
     ioctx_t *inctx,
     coderctx_t *decoder_context,
-    int seekable);
+    int seekable,
+    int bufsz);
 
 
 static int
@@ -118,7 +119,7 @@ prepare_input_muxer(
     }
 
     /* set our custom reader */
-    prepare_input(in_handlers, inctx, muxer_ctx, params->seekable);
+    prepare_input(in_handlers, inctx, muxer_ctx, params->seekable, params->io_buffer_size);
 
     rc = avformat_open_input(&muxer_ctx->format_context, inctx->url, NULL, NULL);
     if (rc != 0) {
@@ -0,0 +1,302 @@
+/*
+ * Remux (stream copy) of the input into a single mp4 or fmp4 output.
+ *
+ * Used when bypass_transcoding is set with xc_type xc_all and format "mp4" or "fmp4". Unlike the regular
+ * bypass, which writes video and audio to separate outputs, the packets of the video stream and of the
+ * selected audio streams are copied into one output without decoding. The "mp4" output is held until it is
+ * closed and written with the moov box before the mdat box (faststart).
+ *
+ * If start_time_ts is set the output starts at the key frame at or before it, or exactly at start_time_ts with
+ * frame_accurate. A frame accurate "mp4" output still starts with the key frame, the frames before
+ * start_time_ts are copied (they are needed to decode the frames that follow) and hidden by an edit list, so
+ * no frame is decoded or encoded. Re-encoding the head of the GOP instead would need the encoder to produce
+ * the same SPS/PPS as the input, since an mp4 track has a single sample description.
+ *
+ * The packets go through the bitstream_filters that apply to their codec. The muxer inserts the ones it needs
+ * by itself (i.e. aac_adtstoasc for the ADTS AAC of an MPEG-TS input).
+ */
+
+#include "avpipe_xc.h"
+#include "avpipe_utils.h"
+#include "avpipe_format.h"
+#include "avpipe_io.h"
+#include "avpipe_remux.h"
+#include "elv_log.h"
+
+int
+avpipe_is_remux(
+    xcparams_t *params)
+{
+    return params->bypass_transcoding && params->xc_type == xc_all && params->format &&
+        (!strcmp(params->format, "mp4") || !strcmp(params->format, "fmp4"));
+}
+
+/*
+ * Allocates the output format context and adds an output stream for each input stream that is copied.
+ * out_index maps the input stream index to the output stream index, -1 if the stream is not copied.
+ */
+static int
+remux_prepare_output(
+    coderctx_t *encoder_context,
+    coderctx_t *decoder_context,
+    avpipe_io_handler_t *out_handlers,
+    ioctx_t *inctx,
+    xcparams_t *params,
+    int *out_index)
+{
+    int is_fmp4 = !strcmp(params->format, "fmp4");
+    out_tracker_t *out_tracker;
+    int n_streams = 0;
+
+    encoder_context->out_handlers = out_handlers;
+
+    avformat_alloc_output_context2(&encoder_context->format_context, NULL, "mp4",
+        is_fmp4 ? "fmp4-stream.mp4" : "mp4-stream.mp4");
+    if (!encoder_context->format_context) {
+        elv_dbg("remux - could not allocate memory for output format");
+        return eav_codec_context;
+    }
+
+    /* Custom output buffer */
+    encoder_context->format_context->io_open = elv_io_open;
+    encoder_context->format_context->io_close = elv_io_close;
+
+    if (is_fmp4)
+        av_opt_set(encoder_context->format_context->priv_data, "movflags", "+frag_keyframe+empty_moov+default_base_moof", 0);
+    else if (params->frame_accurate)
+        /* The frames before start_time_ts have negative timestamps, the edit list skips them */
+        av_opt_set(encoder_context->format_context->priv_data, "use_editlist", "1", 0);
+
+    for (int i = 0; i < MAX_STREAMS; i++)
+        out_index[i] = -1;
+
+    for (int i = 0; i < decoder_context->format_context->nb_streams && i < MAX_STREAMS; i++) {
+        if (i != decoder_context->video_stream_index && selected_decoded_audio(decoder_context, i) < 0)
+            continue;
+
+        AVStream *in_stream = decoder_context->format_context->streams[i];
+        AVStream *out_stream = avformat_new_stream(encoder_context->format_context, NULL);
+        if (!out_stream) {
+            elv_err("Failed allocating remux output stream, url=%s", params->url);
+            return eav_mem_alloc;
+        }
+
+        if (avcodec_parameters_copy(out_stream->codecpar, in_stream->codecpar) < 0) {
+            elv_err("Remux failed to copy codec parameters, stream_index=%d, url=%s", i, params->url);
+            return eav_codec_param;
+        }
+        /* The codec tag of the input container may not be valid in mp4 */
+        out_stream->codecpar->codec_tag = 0;
+        out_stream->time_base = in_stream->time_base;
+        out_stream->avg_frame_rate = in_stream->avg_frame_rate;
+        out_stream->disposition = in_stream->disposition;
+        av_dict_copy(&out_stream->metadata, in_stream->metadata, AV_DICT_DONT_OVERWRITE);
+
+        for (int j = 0; j < in_stream->nb_side_data; j++) {
+            const AVPacketSideData *sd_src = &in_stream->side_data[j];
+            uint8_t *out_data = av_stream_new_side_data(out_stream, sd_src->type, sd_src->size);
+            if (!out_data) {
+                elv_err("Failed to allocate side data, url=%s", params->url);
+                return eav_mem_alloc;
+            }
+            memcpy(out_data, sd_src->data, sd_src->size);
+        }
+
+        int rc = init_bitstream_filters(params, out_stream, &encoder_context->bsf_context[n_streams]);
+        if (rc != eav_success)
+            return rc;
+
+        encoder_context->stream[n_streams] = out_stream;
+        out_index[i] = n_streams++;
+        elv_log("Remux stream %d (%s) to output stream %d, url=%s",
+            i, av_get_media_type_string(in_stream->codecpar->codec_type), out_index[i], params->url);
+    }
+
+    if (n_streams == 0) {
+        elv_err("No stream to remux, url=%s", params->url);
+        return eav_num_streams;
+    }
+
+    out_tracker = (out_tracker_t *) calloc(1, sizeof(out_tracker_t));
+    out_tracker->out_handlers = out_handlers;
+    out_tracker->inctx = inctx;
+    out_tracker->video_stream_index = decoder_context->video_stream_index;
+    out_tracker->audio_stream_index = decoder_context->audio_stream_index[0];
+    out_tracker->seg_index = atoi(params->start_segment_str);
+    out_tracker->encoder_ctx = encoder_context;
+    out_tracker->xc_type = xc_all;
+    encoder_context->format_context->avpipe_opaque = out_tracker;
+
+    return eav_success;
+}
+
+int
+avpipe_remux(
+    xctx_t *xctx)
+{
+    coderctx_t *decoder_context = &xctx->decoder_ctx;
+    coderctx_t *encoder_context = &xctx->encoder_ctx;
+    xcparams_t *params = xctx->params;
+    avpipe_io_handler_t *in_handlers = xctx->in_handlers;
+    ioctx_t *inctx = xctx->inctx;
+    int out_index[MAX_STREAMS];
+    int video_index = decoder_context->video_stream_index;
+    AVStream *video_stream = video_index >= 0 ? decoder_context->format_context->streams[video_index] : NULL;
+    int64_t base_video_pts = AV_NOPTS_VALUE;    /* duration_ts starts at this video pts */
+    int64_t cut = AV_NOPTS_VALUE;               /* Trim start in AV_TIME_BASE, AV_NOPTS_VALUE if not trimmed */
+    int started = 0;                            /* Set once the first video key frame is read when trimmed */
+    int64_t start_time;
+    int64_t shift;
+    int rc;
+
+    rc = remux_prepare_output(encoder_context, decoder_context, xctx->out_handlers, inctx, params, out_index);
+    if (rc != eav_success)
+        return rc;
+
+    if ((rc = write_output_header(params, encoder_context->format_context)) != eav_success) {
+        elv_err("Failed to write remux output file header, url=%s", params->url);
+        return rc;
+    }
+
+    /*
+     * All the streams are shifted by the start time of the input (the smallest start time of its streams),
+     * or by the start of the trimmed output, to keep the audio and video in sync, so the output starts at 0.
+     */
+    start_time = decoder_context->format_context->start_time;
+    if (start_time == AV_NOPTS_VALUE)
+        start_time = 0;
+    shift = start_time;
+
+    /* The trimmed output starts with the key frame at or before start_time_ts (in the video time base) */
+    if (params->start_time_ts > 0 && video_stream) {
+        cut = start_time + av_rescale_q(params->start_time_ts, video_stream->time_base, AV_TIME_BASE_Q);
+        if (av_seek_frame(decoder_context->format_context, video_index,
+                av_rescale_q(cut, AV_TIME_BASE_Q, video_stream->time_base), AVSEEK_FLAG_BACKWARD) < 0) {
+            elv_err("Failed seeking to the key frame before start_time_ts=%"PRId64", url=%s",
+                params->start_time_ts, params->url);
+            return eav_seek;
+        }
+        shift = cut;
+        if (params->frame_accurate)
+            base_video_pts = av_rescale_q(cut, AV_TIME_BASE_Q, video_stream->time_base);
+    }
+
+    /* A graceful stop ends the remux as if the input ended, the output is finalized */
+    while (!decoder_context->stop_requested) {
+        AVPacket *packet = av_packet_alloc();
+        if (!packet) {
+            elv_err("Failed to allocated memory for AVPacket, url=%s", params->url);
+            return eav_mem_alloc;
+        }
+
+        rc = av_read_frame(decoder_context->format_context, packet);
+        if (rc < 0) {
+            av_packet_free(&packet);
+            if (((rc == AVERROR_EOF || rc == -1) && !inctx->read_error) ||
+                (decoder_context->stop_requested && !decoder_context->cancelled)) {
+                rc = eav_success;
+            } else {
+                elv_err("av_read_frame() rc=%d, url=%s", rc, params->url);
+                rc = (rc == AVERROR(ETIMEDOUT) || inctx->read_timeout) ? eav_io_timeout : eav_read_input;
+            }
+            break;
+        }
+
+        int stream_index = packet->stream_index;
+        if (stream_index >= MAX_STREAMS || out_index[stream_index] < 0 ||
+            (packet->flags & AV_PKT_FLAG_CORRUPT) || packet->data == NULL) {
+            av_packet_free(&packet);
+            continue;
+        }
+
+        if (packet->pts == AV_NOPTS_VALUE)
+            packet->pts = packet->dts;
+        if (packet->dts == AV_NOPTS_VALUE)
+            packet->dts = packet->pts;
+        if (packet->pts == AV_NOPTS_VALUE) {
+            elv_warn("INVALID PACKET (REMUX) pts=%"PRId64" dts=%"PRId64" stream_index=%d, url=%s",
+                packet->pts, packet->dts, stream_index, params->url);
+            av_packet_free(&packet);
+            continue;
+        }
+
+        AVStream *in_stream = decoder_context->format_context->streams[stream_index];
+
+        if (cut != AV_NOPTS_VALUE && stream_index == video_index && !started) {
+            /* The demuxer may not land on a key frame, the GOP can't be decoded without it */
+            if (!(packet->flags & AV_PKT_FLAG_KEY)) {
+                av_packet_free(&packet);
+                continue;
+            }
+            started = 1;
+            if (!params->frame_accurate)
+                shift = av_rescale_q(packet->pts, in_stream->time_base, AV_TIME_BASE_Q);
+            elv_log("Remux starts with key frame pts=%"PRId64", start_time_ts=%"PRId64", frame_accurate=%d, url=%s",
+                packet->pts, params->start_time_ts, params->frame_accurate, params->url);
+        }
+
+        /*
+         * When trimmed the other streams start with the output, only the video frames before it are kept since
+         * the frames that follow need them.
+         */
+        if (cut != AV_NOPTS_VALUE && stream_index != video_index &&
+            (!started || av_rescale_q(packet->pts, in_stream->time_base, AV_TIME_BASE_Q) < shift)) {
+            av_packet_free(&packet);
+            continue;
+        }
+
+        if (stream_index == decoder_context->video_stream_index) {
+            /* duration_ts is in the time base of the input video stream */
+            if (base_video_pts == AV_NOPTS_VALUE)
+                base_video_pts = packet->pts;
+            if (params->duration_ts > 0 && packet->pts - base_video_pts >= params->duration_ts) {
+                av_packet_free(&packet);
+                break;
+            }
+            inctx->video_frames_read++;
+            if (in_handlers->avpipe_stater)
+                in_handlers->avpipe_stater(inctx, stream_index, in_stat_video_frame_read);
+        } else {
+            inctx->audio_frames_read++;
+            if (in_handlers->avpipe_stater)
+                in_handlers->avpipe_stater(inctx, stream_index, in_stat_audio_frame_read);
+        }
+
+        int64_t offset = av_rescale_q(shift, AV_TIME_BASE_Q, in_stream->time_base);
+        packet->pts -= offset;
+        packet->dts -= offset;
+        packet->stream_index = out_index[stream_index];
+        packet->pos = -1;
+        av_packet_rescale_ts(packet, in_stream->time_base, encoder_context->stream[packet->stream_index]->time_base);
+
+        dump_packet(stream_index != decoder_context->video_stream_index, "REMUX ", packet, params->debug_frame_level);
+
+        rc = write_bitstream_filtered_packet(encoder_context->format_context,
+            encoder_context->bsf_context[packet->stream_index], packet);
+        av_packet_free(&packet);
+        if (rc < 0) {
+            elv_err("Failure in writing remux packet, rc=%d, %s, url=%s", rc, av_err2str(rc), params->url);
+            rc = eav_write_frame;
+            break;
+        }
+    }
+
+    if (decoder_context->cancelled) {
+        elv_warn("remux session cancelled, handle=%d, url=%s", xctx->handle, params->url);
+        return eav_cancelled;
+    }
+
+    if (rc != eav_success)
+        return rc;
+
+    /* The mp4 output is written with the moov box first when it is closed (see elv_io_write_held) */
+    if (av_write_trailer(encoder_context->format_context) < 0) {
+        elv_err("Failed to write remux output file trailer, url=%s", params->url);
+        return eav_write_frame;
+    }
+
+    elv_log("avpipe_remux done url=%s, video_frames_read=%"PRId64", audio_frames_read=%"PRId64,
+        params->url, inctx->video_frames_read, inctx->audio_frames_read);
+
+    return eav_success;
+}
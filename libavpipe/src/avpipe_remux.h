@@ -0,0 +1,13 @@
+#include "avpipe_xc.h"
+
+/*
+ * Returns 1 if the input is remuxed (stream copy of all the selected streams into one output)
+ * instead of transcoded, 0 otherwise.
+ */
+int avpipe_is_remux(
+    xcparams_t *params
+);
+
+int avpipe_remux(
+    xctx_t *xctx
+);
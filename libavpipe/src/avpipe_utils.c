@@ -13,6 +13,7 @@
 #include "elv_log.h"
 
 #include <sys/time.h>
+#include <string.h>
 
 const char *stream_type_str(
     coderctx_t *c,
@@ -265,12 +266,41 @@ dump_trackers(
         out_tracker->seg_index, out_tracker->last_outctx ? out_tracker->last_outctx->written_bytes:0);
 }
 
+/* Prefix of the ffmpeg logs of the job running on the current thread, empty if not set */
+static __thread char ffmpeg_log_prefix[MAX_LOG_PREFIX_SIZE];
+
+/* Logger of the ffmpeg logs with their AV_LOG_* level, the ffmpeg logs go to elv_log if not set */
+static ffmpeg_logger_f ffmpeg_logger;
+
 static void
 ffmpeg_log_handler(void* ptr, int level, const char* fmt, va_list vl) {
     elv_log_level_t elv_level;
-    switch (level) {
-    case AV_LOG_QUIET:
+    char prefix[MAX_LOG_PREFIX_SIZE+4];
+    char buf[FFMPEG_LOG_BUFF_SIZE];
+    int len;
+
+    /* The level set by av_log_set_level() is not applied when a callback is set */
+    if (level > av_log_get_level() || level == AV_LOG_QUIET)
         return;
+
+    if (ffmpeg_log_prefix[0] != '\0')
+        snprintf(prefix, sizeof(prefix), "FF %s", ffmpeg_log_prefix);
+    else
+        snprintf(prefix, sizeof(prefix), "FF");
+
+    if (ffmpeg_logger) {
+        len = snprintf(buf, sizeof(buf), "%s ", prefix);
+        len += vsnprintf(buf+len, sizeof(buf)-len, fmt, vl);
+        if (len >= sizeof(buf))
+            len = sizeof(buf) - 1;
+        // Trim newline
+        if (buf[len-1] == '\n')
+            buf[len-1] = '\0';
+        ffmpeg_logger(level, buf);
+        return;
+    }
+
+    switch (level) {
     case AV_LOG_PANIC:
     case AV_LOG_FATAL:
     case AV_LOG_ERROR:
@@ -282,14 +312,15 @@ ffmpeg_log_handler(void* ptr, int level, const char* fmt, va_list vl) {
     case AV_LOG_INFO:
         elv_level = elv_log_log;
         break;
-    case AV_LOG_DEBUG:
     case AV_LOG_VERBOSE:
+    case AV_LOG_DEBUG:
+    case AV_LOG_TRACE:
     default:
-        // TODO map to a trace level or something. AV_LOG_DEBUG is too verbose
-        // elv_level = elv_log_debug;
-        return;
+        elv_level = elv_log_debug;
+        break;
     }
-    elv_vlog(elv_level, "FF", fmt, vl);
+
+    elv_vlog(elv_level, prefix, fmt, vl);
 }
 
 void
@@ -297,6 +328,56 @@ connect_ffmpeg_log() {
     av_log_set_callback(ffmpeg_log_handler);
 }
 
+void
+set_ffmpeg_log_func(
+    ffmpeg_logger_f logger_f)
+{
+    ffmpeg_logger = logger_f;
+}
+
+int
+set_ffmpeg_log_level(
+    const char *level)
+{
+    static const struct {
+        const char *name;
+        int level;
+    } levels[] = {
+        { "quiet",   AV_LOG_QUIET },
+        { "panic",   AV_LOG_PANIC },
+        { "fatal",   AV_LOG_FATAL },
+        { "error",   AV_LOG_ERROR },
+        { "warning", AV_LOG_WARNING },
+        { "warn",    AV_LOG_WARNING },
+        { "info",    AV_LOG_INFO },
+        { "verbose", AV_LOG_VERBOSE },
+        { "debug",   AV_LOG_DEBUG },
+        { "trace",   AV_LOG_TRACE },
+    };
+
+    if (!level)
+        return -1;
+
+    for (int i = 0; i < sizeof(levels)/sizeof(levels[0]); i++) {
+        if (!strcmp(level, levels[i].name)) {
+            av_log_set_level(levels[i].level);
+            return levels[i].level;
+        }
+    }
+    return -1;
+}
+
+void
+set_ffmpeg_log_prefix(
+    const char *prefix)
+{
+    if (!prefix) {
+        ffmpeg_log_prefix[0] = '\0';
+        return;
+    }
+    snprintf(ffmpeg_log_prefix, sizeof(ffmpeg_log_prefix), "%s", prefix);
+}
+
 unsigned int
 checksum(byte *addr, unsigned int count)
 {
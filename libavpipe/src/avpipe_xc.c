@@ -13,12 +13,20 @@
 #include <libswscale/swscale.h>
 #include <libavutil/imgutils.h>
 #include <libavutil/display.h>
+#include <libavutil/parseutils.h>
+#include <libavutil/pixdesc.h>
+#include <libavutil/avstring.h>
+#include <libavutil/mastering_display_metadata.h>
+#include <libavutil/intreadwrite.h>
+#include <libavutil/time.h>
+#include <libavutil/timecode.h>
 
 #include "avpipe_xc.h"
 #include "avpipe_utils.h"
 #include "avpipe_format.h"
 #include "avpipe_io.h"
 #include "avpipe_copy_mpegts.h"
+#include "avpipe_remux.h"
 #include "elv_log.h"
 #include "elv_time.h"
 #include "url_parser.h"
@@ -35,8 +43,12 @@
 #include <unistd.h>
 #include <stdlib.h>
 #include <pthread.h>
+#include <errno.h>
+#include <ctype.h>
+#include <strings.h>
 
 #define AUDIO_BUF_SIZE              (128*1024)
+#define SUBTITLE_BUF_SIZE           (64*1024)
 #define INPUT_IS_SEEKABLE           0
 
 #define MPEGTS_THREAD_COUNT         16
@@ -46,6 +58,8 @@
 #define DEFAULT_FRAME_INTERVAL_S    10
 
 #define DEFAULT_ACC_SAMPLE_RATE     48000
+#define DEFAULT_OPUS_SAMPLE_RATE    48000
+#define DEFAULT_AC3_SAMPLE_RATE     48000
 
 extern int
 init_video_filters(
@@ -78,6 +92,12 @@ init_audio_join_filters(
     coderctx_t *encoder_context,
     xcparams_t *params);
 
+extern int
+check_filter_descr(
+    const char *filters_descr,
+    enum AVMediaType type,
+    xcparams_t *params);
+
 extern const char *
 av_get_pix_fmt_name(
     enum AVPixelFormat pix_fmt);
@@ -86,6 +106,28 @@ static const char*
 get_channel_name(
     int channel_layout);
 
+static void
+apply_output_base_pts(
+    AVPacket *packet,
+    AVRational time_base,
+    xcparams_t *params);
+
+static int
+get_video_filter_str(
+    char **filter_str,
+    coderctx_t *encoder_context,
+    xcparams_t *params);
+
+static void
+track_segment_packet(
+    AVFormatContext *format_context,
+    int64_t pts,
+    int64_t duration);
+
+static int
+is_image_format(
+    AVFormatContext *format_context);
+
 const char*
 avpipe_channel_layout_name(
     int channel_layout);
@@ -95,11 +137,12 @@ prepare_input(
     avpipe_io_handler_t *in_handlers,
     ioctx_t *inctx,
     coderctx_t *decoder_context,
-    int seekable)
+    int seekable,
+    int bufsz)
 {
     unsigned char *bufin;
     AVIOContext *avioctx;
-    int bufin_sz = AVIO_IN_BUF_SIZE;
+    int bufin_sz = bufsz > 0 ? bufsz : AVIO_IN_BUF_SIZE;
 
     /* For the live sources we don't use a custom input don't create input callbacks (RTMP, SRT, RTP) */
     switch (decoder_context->live_proto) {
@@ -113,8 +156,9 @@ prepare_input(
     }
 
     bufin = (unsigned char *) av_malloc(bufin_sz);  /* Must be malloc'd - will be realloc'd by avformat */
+    /* Without a seek function avformat never seeks a non seekable input (i.e. a live pipe), it reads forward instead */
     avioctx = avio_alloc_context(bufin, bufin_sz, 0, (void *)inctx,
-        in_handlers->avpipe_reader, in_handlers->avpipe_writer, in_handlers->avpipe_seeker);
+        in_handlers->avpipe_reader, in_handlers->avpipe_writer, seekable ? in_handlers->avpipe_seeker : NULL);
 
     avioctx->written = inctx->sz; /* Fake avio_size() to avoid calling seek to find size */
     avioctx->seekable = seekable;
@@ -140,6 +184,90 @@ selected_audio_index(
     return -1;
 }
 
+/*
+ * Returns the program of the input with the program number params->program_id (the service ID of an MPEG-TS
+ * program). Returns NULL and logs the program numbers of the input if none matches.
+ */
+static AVProgram *
+find_program(
+    AVFormatContext *format_context,
+    xcparams_t *params)
+{
+    char programs[256] = "";
+
+    for (int i = 0; i < format_context->nb_programs; i++) {
+        AVProgram *program = format_context->programs[i];
+        if (program->id == params->program_id)
+            return program;
+
+        char id[16];
+        snprintf(id, sizeof(id), "%s%d", programs[0] != '\0' ? "," : "", program->id);
+        if (strlen(programs) + strlen(id) < sizeof(programs))
+            strcat(programs, id);
+    }
+
+    elv_err("No program with program_id=%d, available programs=%s, url=%s",
+        params->program_id, programs[0] != '\0' ? programs : "none", params->url);
+    return NULL;
+}
+
+/*
+ * Returns 1 if the stream stream_index belongs to program, or if program is NULL (no program is selected).
+ */
+static int
+in_program(
+    AVProgram *program,
+    int stream_index)
+{
+    if (!program)
+        return 1;
+
+    for (unsigned int i = 0; i < program->nb_stream_indexes; i++) {
+        if (program->stream_index[i] == stream_index)
+            return 1;
+    }
+
+    return 0;
+}
+
+/*
+ * Selects the first audio stream with the language tag params->audio_language (i.e "eng") as the audio_index.
+ * Streams without a language tag are "und", the streams that are not in program are ignored.
+ * Fails with the languages of the input if none matches.
+ */
+static int
+select_audio_language(
+    AVFormatContext *format_context,
+    AVProgram *program,
+    xcparams_t *params)
+{
+    char languages[256] = "";
+
+    for (int i = 0; i < format_context->nb_streams && i < MAX_STREAMS; i++) {
+        if (format_context->streams[i]->codecpar->codec_type != AVMEDIA_TYPE_AUDIO || !in_program(program, i))
+            continue;
+
+        AVDictionaryEntry *tag = av_dict_get(format_context->streams[i]->metadata, "language", NULL, 0);
+        const char *language = tag && tag->value[0] != '\0' ? tag->value : "und";
+        if (!strcasecmp(language, params->audio_language)) {
+            params->audio_index[0] = i;
+            params->n_audio = 1;
+            elv_log("Selected audio stream %d with language=%s, url=%s", i, language, params->url);
+            return eav_success;
+        }
+
+        if (strlen(languages) + strlen(language) + 2 < sizeof(languages)) {
+            if (languages[0] != '\0')
+                strcat(languages, ",");
+            strcat(languages, language);
+        }
+    }
+
+    elv_err("No audio stream with audio_language=%s, available languages=%s, url=%s",
+        params->audio_language, languages[0] != '\0' ? languages : "none", params->url);
+    return eav_stream_language;
+}
+
 static int
 decode_interrupt_cb(
     void *ctx) 
@@ -147,7 +275,9 @@ decode_interrupt_cb(
     coderctx_t *decoder_ctx = (coderctx_t *)ctx;
     if (decoder_ctx->cancelled)
         elv_dbg("interrupt callback checked and stream decoding cancelled");
-    return decoder_ctx->cancelled;
+    else if (decoder_ctx->stop_requested)
+        elv_dbg("interrupt callback checked and stream decoding stopped");
+    return decoder_ctx->cancelled || decoder_ctx->stop_requested;
 }
 
 static int
@@ -222,6 +352,19 @@ check_input_stream(
     return eav_success;
 }
 
+/*
+ * Returns the ffmpeg thread type (FF_THREAD_FRAME or FF_THREAD_SLICE) of thread_type "frame" or "slice".
+ * Slice threading doesn't delay the frames, frame threading delays them by the number of threads.
+ */
+static int
+get_thread_type(
+    const char *thread_type)
+{
+    if (!strcmp(thread_type, "slice"))
+        return FF_THREAD_SLICE;
+    return FF_THREAD_FRAME;
+}
+
 static int
 prepare_decoder(
     coderctx_t *decoder_context,
@@ -239,6 +382,7 @@ prepare_decoder(
     decoder_context->in_handlers = in_handlers;
     decoder_context->inctx = inctx;
     decoder_context->video_stream_index = -1;
+    decoder_context->subtitle_stream_index = -1;
     decoder_context->data_scte35_stream_index = -1;
     decoder_context->data_stream_index = -1;
     for (int j=0; j<MAX_STREAMS; j++) {
@@ -258,7 +402,7 @@ prepare_decoder(
     decoder_context->live_proto = find_live_proto(inctx);
 
     /* Set our custom reader */
-    prepare_input(in_handlers, inctx, decoder_context, seekable);
+    prepare_input(in_handlers, inctx, decoder_context, seekable, params ? params->io_buffer_size : 0);
 
     AVDictionary *opts = NULL;
     if (params && params->listen && is_live_source(decoder_context))
@@ -289,13 +433,39 @@ prepare_decoder(
         }
     }
 
+    /* Headerless inputs (i.e. elementary streams or raw PCM) can't be detected, the demuxer is forced */
+    AVInputFormat *input_format = NULL;
+    if (params && params->input_format && params->input_format[0] != '\0') {
+        input_format = av_find_input_format(params->input_format);
+        if (!input_format) {
+            elv_err("Invalid input_format=%s, url=%s", params->input_format, url);
+            av_dict_free(&opts);
+            return eav_param;
+        }
+    }
+
+    if (params && params->input_options && params->input_options[0] != '\0' &&
+        av_dict_parse_string(&opts, params->input_options, "=", ":", 0) < 0) {
+        elv_err("Invalid input_options=%s, url=%s", params->input_options, url);
+        av_dict_free(&opts);
+        return eav_param;
+    }
+
     /* Allocate AVFormatContext in format_context and find input file format */
-    rc = avformat_open_input(&decoder_context->format_context, inctx->url, NULL, &opts);
+    rc = avformat_open_input(&decoder_context->format_context, inctx->url, input_format, &opts);
     if (rc != 0) {
         elv_err("Could not open input file, err=%s (%d), url=%s", av_err2str(rc), rc, url);
+        decoder_context->open_input_err = rc;
+        av_dict_free(&opts);
         return eav_open_input;
     }
 
+    /* The options that are left were not used by the demuxer */
+    AVDictionaryEntry *unused = NULL;
+    while ((unused = av_dict_get(opts, "", unused, AV_DICT_IGNORE_SUFFIX)))
+        elv_warn("Input option %s=%s not used by the demuxer, url=%s", unused->key, unused->value, url);
+    av_dict_free(&opts);
+
     /* Retrieve stream information */
     if (avformat_find_stream_info(decoder_context->format_context,  NULL) < 0) {
         elv_err("Could not get input stream info, url=%s", url);
@@ -307,6 +477,33 @@ prepare_decoder(
         return rc;
     }
 
+    /* The streams of the other programs are neither selected nor decoded */
+    AVProgram *program = NULL;
+    if (params && params->program_id > 0) {
+        program = find_program(decoder_context->format_context, params);
+        if (!program)
+            return eav_stream_index;
+
+        if (params->video_index >= 0 && !in_program(program, params->video_index)) {
+            elv_err("Invalid video_index=%d, not in program_id=%d, url=%s", params->video_index, params->program_id, url);
+            return eav_stream_index;
+        }
+        for (int j = 0; j < params->n_audio; j++) {
+            if (!in_program(program, params->audio_index[j])) {
+                elv_err("Invalid audio_index=%d, not in program_id=%d, url=%s",
+                    params->audio_index[j], params->program_id, url);
+                return eav_stream_index;
+            }
+        }
+        elv_log("Selected program_id=%d with %d streams, url=%s", program->id, program->nb_stream_indexes, url);
+    }
+
+    if (params && params->audio_language && params->audio_language[0] != '\0' && (params->xc_type & xc_audio)) {
+        rc = select_audio_language(decoder_context->format_context, program, params);
+        if (rc != eav_success)
+            return rc;
+    }
+
     // Here we used to set 'is_mpegts' if the codec name was "mpegts", so effectively from here on 'is_mpegts'
     // was set for both MPEGTS and SRT.
     // The live_container will be MPEGTS for all the protocols that encapsulate MPEGTS
@@ -314,6 +511,14 @@ prepare_decoder(
 
     for (int i = 0; i < decoder_context->format_context->nb_streams && i < MAX_STREAMS; i++) {
 
+        if (!in_program(program, i)) {
+            /* The demuxer drops the packets of the stream */
+            decoder_context->format_context->streams[i]->discard = AVDISCARD_ALL;
+            decoder_context->codec[i] = NULL;
+            elv_dbg("STREAM %d skipped, not in program_id=%d, url=%s", i, params->program_id, url);
+            continue;
+        }
+
         switch (decoder_context->format_context->streams[i]->codecpar->codec_type) {
         case AVMEDIA_TYPE_VIDEO:
             /* Video, copy codec params from stream format context */
@@ -321,7 +526,8 @@ prepare_decoder(
             decoder_context->stream[i] = decoder_context->format_context->streams[i];
 
             /* If no stream ID specified - choose the first video stream encountered */
-            if (params && (params->xc_type & xc_video) && params->stream_id < 0 && decoder_context->video_stream_index < 0) {
+            if (params && (params->xc_type & xc_video) && params->stream_id < 0 && decoder_context->video_stream_index < 0 &&
+                (params->video_index < 0 || params->video_index == i)) {
                 decoder_context->video_stream_index = i;
                 if (check_stream_index(params, decoder_context) != eav_success)
                     return eav_param;
@@ -398,6 +604,34 @@ prepare_decoder(
 
             break;
 
+        case AVMEDIA_TYPE_SUBTITLE:
+            /* Subtitle streams are only decoded when extracting subtitles */
+            if (!params || params->xc_type != xc_subtitle ||
+                decoder_context->subtitle_stream_index >= 0 ||
+                (params->subtitle_index >= 0 && params->subtitle_index != i)) {
+                decoder_context->codec[i] = NULL;
+                elv_dbg("SUBTITLE STREAM %d skipped, codec_id=%s, url=%s",
+                    i, avcodec_get_name(decoder_context->format_context->streams[i]->codecpar->codec_id), url);
+                continue;
+            }
+
+            decoder_context->codec_parameters[i] = decoder_context->format_context->streams[i]->codecpar;
+            decoder_context->stream[i] = decoder_context->format_context->streams[i];
+
+            /* The webvtt encoder only accepts text subtitles */
+            const AVCodecDescriptor *desc = avcodec_descriptor_get(decoder_context->codec_parameters[i]->codec_id);
+            if (!desc || (desc->props & AV_CODEC_PROP_BITMAP_SUB)) {
+                elv_err("Unsupported subtitle codec=%s, stream_index=%d, url=%s",
+                    avcodec_get_name(decoder_context->codec_parameters[i]->codec_id), i, url);
+                return eav_codec_param;
+            }
+
+            decoder_context->subtitle_stream_index = i;
+            elv_dbg("SUBTITLE STREAM %d, codec_id=%s, stream_id=%d, timebase=%d, url=%s",
+                i, avcodec_get_name(decoder_context->codec_parameters[i]->codec_id), decoder_context->stream[i]->id,
+                decoder_context->stream[i]->time_base.den, url);
+            break;
+
         default:
             decoder_context->codec[i] = NULL;
             elv_dbg("UNKNOWN STREAM type=%d, url=%s",
@@ -475,10 +709,19 @@ prepare_decoder(
          * furher thread_count is 1 which forces 1 thread.
          */
         decoder_context->codec_context[i]->active_thread_type = 1;
-        if (is_live_source(decoder_context))
+        if (params && params->decode_threads > 0)
+            decoder_context->codec_context[i]->thread_count = params->decode_threads;
+        else if (is_live_source(decoder_context))
             decoder_context->codec_context[i]->thread_count = MPEGTS_THREAD_COUNT;
         else
             decoder_context->codec_context[i]->thread_count = DEFAULT_THREAD_COUNT;
+        if (params && params->thread_type && params->thread_type[0] != '\0')
+            decoder_context->codec_context[i]->thread_type = get_thread_type(params->thread_type);
+        else if (params && params->low_latency)
+            /* Frame threading delays the decoded frames by the number of threads */
+            decoder_context->codec_context[i]->thread_type = FF_THREAD_SLICE;
+        if (params && params->low_latency)
+            decoder_context->codec_context[i]->flags |= AV_CODEC_FLAG_LOW_DELAY;
 
         /* Open the decoder (initialize the decoder codec_context[i] using given codec[i]). */
         if (decoder_context->codec_parameters[i]->codec_type != AVMEDIA_TYPE_DATA &&
@@ -515,6 +758,17 @@ prepare_decoder(
         dump_codec_context(decoder_context->codec_context[i]);
     }
 
+    if (params && (params->xc_type & xc_video) && params->stream_id < 0 && params->video_index >= 0 &&
+        decoder_context->video_stream_index != params->video_index) {
+        elv_err("Invalid video_index=%d, not a video stream, url=%s", params->video_index, url);
+        return eav_stream_index;
+    }
+
+    if (params && params->xc_type == xc_subtitle && decoder_context->subtitle_stream_index < 0) {
+        elv_err("No subtitle stream found, subtitle_index=%d, url=%s", params->subtitle_index, url);
+        return eav_stream_index;
+    }
+
     /* If it couldn't find identified stream with params->stream_id, then return an error */
     if (params && params->stream_id >= 0 && stream_id_index < 0) {
         elv_err("Invalid stream_id=%d, url=%s", params->stream_id, url);
@@ -611,24 +865,63 @@ set_encoder_options(
      */
     #define FRAG_OPTS "+frag_every_frame+empty_moov+default_base_moof"
 
-    if (!strcmp(params->format, "fmp4")) {
+    /*
+     * CMAF single file: one fragment per GOP, each preceded by a styp and a sidx box indexing it
+     * so players can address the fragments with byte ranges. A global sidx would need the output
+     * to be seekable and readable, which the output handlers are not.
+     * - frag_keyframe - start a new fragment at each key frame
+     * - dash - write a sidx box before each fragment
+     * - cmaf - CMAF compliant brands and boxes (styp)
+     */
+    #define CMAF_OPTS "+frag_keyframe+empty_moov+default_base_moof+dash+cmaf"
+
+    if (!strcmp(params->format, "fmp4") || !strcmp(params->format, "cmaf")) {
+        const char *movflags = !strcmp(params->format, "cmaf") ? CMAF_OPTS : FRAG_OPTS;
         if (stream_index == decoder_context->video_stream_index)
-            av_opt_set(encoder_context->format_context->priv_data, "movflags", FRAG_OPTS, 0);
+            av_opt_set(encoder_context->format_context->priv_data, "movflags", movflags, 0);
         if ((i = selected_decoded_audio(decoder_context, stream_index)) >= 0)
-            av_opt_set(encoder_context->format_context2[i]->priv_data, "movflags", FRAG_OPTS, 0);
+            av_opt_set(encoder_context->format_context2[i]->priv_data, "movflags", movflags, 0);
     }
 
-    // Segment duration (in ts) - notice it is set on the format context not codec
-    if (params->audio_seg_duration_ts > 0 && (!strcmp(params->format, "dash") || !strcmp(params->format, "hls"))) {
-        if ((i = selected_decoded_audio(decoder_context, stream_index)) >= 0)
-            av_opt_set_int(encoder_context->format_context2[i]->priv_data, "seg_duration_ts", params->audio_seg_duration_ts,
-                AV_OPT_FLAG_ENCODING_PARAM | AV_OPT_SEARCH_CHILDREN);
+    /*
+     * Low latency: flush the output after each packet so the fragments reach the output handler as soon as
+     * they are written, and don't let the muxer buffer packets to interleave them.
+     */
+    if (params->low_latency) {
+        if (stream_index == decoder_context->video_stream_index) {
+            encoder_context->format_context->flush_packets = 1;
+            encoder_context->format_context->max_delay = 0;
+        }
+        if ((i = selected_decoded_audio(decoder_context, stream_index)) >= 0) {
+            encoder_context->format_context2[i]->flush_packets = 1;
+            encoder_context->format_context2[i]->max_delay = 0;
+        }
     }
 
-    if (params->video_seg_duration_ts > 0 && (!strcmp(params->format, "dash") || !strcmp(params->format, "hls"))) {
-        if (stream_index == decoder_context->video_stream_index)
-            av_opt_set_int(encoder_context->format_context->priv_data, "seg_duration_ts", params->video_seg_duration_ts,
-                AV_OPT_FLAG_ENCODING_PARAM | AV_OPT_SEARCH_CHILDREN);
+    /*
+     * Segment duration (in ts) - notice it is set on the format context not codec.
+     * seg_duration (sec) is converted to the timebase of the stream, the frames are marked as key frames
+     * at the start of each segment in the same timebase (see set_idr_frame_key_flag()).
+     */
+    if (!strcmp(params->format, "dash") || !strcmp(params->format, "hls")) {
+        if ((i = selected_decoded_audio(decoder_context, stream_index)) >= 0) {
+            int64_t seg_duration_ts = resolve_seg_duration_ts(params, params->audio_seg_duration_ts, timebase);
+            if (seg_duration_ts < 0)
+                return eav_param;
+            if (seg_duration_ts > 0)
+                av_opt_set_int(encoder_context->format_context2[i]->priv_data, "seg_duration_ts", seg_duration_ts,
+                    AV_OPT_FLAG_ENCODING_PARAM | AV_OPT_SEARCH_CHILDREN);
+        }
+
+        if (stream_index == decoder_context->video_stream_index) {
+            int64_t seg_duration_ts = resolve_seg_duration_ts(params, params->video_seg_duration_ts, timebase);
+            if (seg_duration_ts < 0)
+                return eav_param;
+            params->video_seg_duration_ts = seg_duration_ts;
+            if (seg_duration_ts > 0)
+                av_opt_set_int(encoder_context->format_context->priv_data, "seg_duration_ts", seg_duration_ts,
+                    AV_OPT_FLAG_ENCODING_PARAM | AV_OPT_SEARCH_CHILDREN);
+        }
     }
 
     if ((i = selected_decoded_audio(decoder_context, stream_index)) >= 0) {
@@ -654,33 +947,25 @@ set_encoder_options(
     }
 
     if (!strcmp(params->format, "fmp4-segment") || !strcmp(params->format, "segment")) {
-        int64_t seg_duration_ts = 0;
-        float seg_duration = 0;
-        /* Precalculate seg_duration_ts based on seg_duration if seg_duration is set */
-        if (params->seg_duration) {
-            seg_duration = atof(params->seg_duration);
-            if (stream_index == decoder_context->video_stream_index)
-                timebase = calc_timebase(params, 1, timebase);
-            seg_duration_ts = seg_duration * timebase;
-        }
+        int64_t seg_duration_ts;
+        /* The segment muxer works in the output timebase, which is calculated the same way for seg_duration */
+        if (stream_index == decoder_context->video_stream_index)
+            timebase = calc_timebase(params, 1, timebase);
         if ((i = selected_decoded_audio(decoder_context, stream_index)) >= 0) {
-            if (params->audio_seg_duration_ts > 0)
-                seg_duration_ts = params->audio_seg_duration_ts;
+            seg_duration_ts = resolve_seg_duration_ts(params, params->audio_seg_duration_ts, timebase);
+            if (seg_duration_ts < 0)
+                return eav_param;
             av_opt_set_int(encoder_context->format_context2[i]->priv_data, "segment_duration_ts", seg_duration_ts, 0);
-            /* If audio_seg_duration_ts is not set, set it now */
-            if (params->audio_seg_duration_ts <= 0)
-                params->audio_seg_duration_ts = seg_duration_ts;
             elv_dbg("setting \"fmp4-segment\" audio segment_time to %s, seg_duration_ts=%"PRId64", url=%s",
                 params->seg_duration, seg_duration_ts, params->url);
             av_opt_set(encoder_context->format_context2[i]->priv_data, "reset_timestamps", "on", 0);
-        } 
+        }
         if (stream_index == decoder_context->video_stream_index) {
-            if (params->video_seg_duration_ts > 0)
-                seg_duration_ts = params->video_seg_duration_ts;
+            seg_duration_ts = resolve_seg_duration_ts(params, params->video_seg_duration_ts, timebase);
+            if (seg_duration_ts < 0)
+                return eav_param;
             av_opt_set_int(encoder_context->format_context->priv_data, "segment_duration_ts", seg_duration_ts, 0);
-            /* If video_seg_duration_ts is not set, set it now */
-            if (params->video_seg_duration_ts <= 0)
-                params->video_seg_duration_ts = seg_duration_ts;
+            params->video_seg_duration_ts = seg_duration_ts;
             elv_dbg("setting \"fmp4-segment\" video segment_time to %s, seg_duration_ts=%"PRId64", url=%s",
                 params->seg_duration, seg_duration_ts, params->url);
             av_opt_set(encoder_context->format_context->priv_data, "reset_timestamps", "on", 0);
@@ -736,6 +1021,47 @@ set_h264_params(
     av_opt_set(encoder_codec_context->priv_data, "x264-params", "stitchable=1", 0);
 }
 
+static int
+is_vp9_av1_encoder(
+    const char *ecodec)
+{
+    return ecodec && (!strcmp(ecodec, "libvpx-vp9") || !strcmp(ecodec, "libaom-av1") || !strcmp(ecodec, "libsvtav1"));
+}
+
+/*
+ * Set VP9/AV1 specific params. The default speed of libvpx-vp9 and libaom-av1 (deadline=best, cpu-used=1)
+ * is too slow for transcoding, use the good quality deadline with a faster speed and row based threading.
+ */
+static void
+set_vp9_av1_params(
+    coderctx_t *encoder_context,
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    int index = decoder_context->video_stream_index;
+    AVCodecContext *encoder_codec_context = encoder_context->codec_context[index];
+
+    if (!strcmp(params->ecodec, "libvpx-vp9")) {
+        av_opt_set(encoder_codec_context->priv_data, "deadline", "good", 0);
+        av_opt_set_int(encoder_codec_context->priv_data, "cpu-used", 2, 0);
+        av_opt_set_int(encoder_codec_context->priv_data, "row-mt", 1, 0);
+        /* Profile 2 is 4:2:0 with 10 or 12 bits */
+        encoder_codec_context->profile = params->bitdepth > 8 ? FF_PROFILE_VP9_2 : FF_PROFILE_VP9_0;
+    } else if (!strcmp(params->ecodec, "libaom-av1")) {
+        av_opt_set_int(encoder_codec_context->priv_data, "cpu-used", 6, 0);
+        av_opt_set_int(encoder_codec_context->priv_data, "row-mt", 1, 0);
+        encoder_codec_context->profile = FF_PROFILE_AV1_MAIN;
+    } else {
+        /* libsvtav1 is tuned with its own (numeric) preset */
+        encoder_codec_context->profile = FF_PROFILE_AV1_MAIN;
+    }
+
+    if (params->level > 0)
+        encoder_codec_context->level = params->level;
+}
+
+#define X265_HDR_PARAMS "hdr-opt=1:repeat-headers=1:colorprim=bt2020:transfer=smpte2084:colormatrix=bt2020nc"
+
 static void
 set_h265_params(
     coderctx_t *encoder_context,
@@ -750,35 +1076,48 @@ set_h265_params(
      * which is the most common type of video used with consumer devices
      * For HDR10 we need MAIN 10 that supports 10 bit profile.
      */
+    char x265_params[256] = "";
     int profile = avpipe_h265_profile(params->profile);
     if (profile > 0) {
         /* Can be only main or main10 profiles */
         av_opt_set(encoder_codec_context->priv_data, "profile", params->profile, 0);
-        if (params->bitdepth == 10) {
-            av_opt_set(encoder_codec_context->priv_data, "x265-params",
-                "hdr-opt=1:repeat-headers=1:colorprim=bt2020:transfer=smpte2084:colormatrix=bt2020nc", 0);
-        }
+        if (params->bitdepth == 10)
+            strcpy(x265_params, X265_HDR_PARAMS);
     } else if (params->bitdepth == 8) {
         av_opt_set(encoder_codec_context->priv_data, "profile", "main", 0);
     } else if (params->bitdepth == 10) {
         av_opt_set(encoder_codec_context->priv_data, "profile", "main10", 0);
-        av_opt_set(encoder_codec_context->priv_data, "x265-params",
-            "hdr-opt=1:repeat-headers=1:colorprim=bt2020:transfer=smpte2084:colormatrix=bt2020nc", 0);
+        strcpy(x265_params, X265_HDR_PARAMS);
     } else {
         /* bitdepth == 12 */
         av_opt_set(encoder_codec_context->priv_data, "profile", "main12", 0);
-        av_opt_set(encoder_codec_context->priv_data, "x265-params",
-            "hdr-opt=1:repeat-headers=1:colorprim=bt2020:transfer=smpte2084:colormatrix=bt2020nc", 0);
+        strcpy(x265_params, X265_HDR_PARAMS);
     }
 
+    /*
+     * Not every libx265 wrapper maps the GOP structure of the codec context, so it is passed in x265-params too.
+     * Constant bit rate needs strict-cbr, libx265 has no nal-hrd option.
+     */
+    if (params->max_b_frames >= 0)
+        sprintf(x265_params + strlen(x265_params), "%sbframes=%d", x265_params[0] ? ":" : "", params->max_b_frames);
+    if (params->ref_frames > 0)
+        sprintf(x265_params + strlen(x265_params), "%sref=%d", x265_params[0] ? ":" : "", params->ref_frames);
+    if (params->closed_gop)
+        sprintf(x265_params + strlen(x265_params), "%sopen-gop=0", x265_params[0] ? ":" : "");
+    if (params->rate_control && !strcmp(params->rate_control, "cbr"))
+        sprintf(x265_params + strlen(x265_params), "%sstrict-cbr=1", x265_params[0] ? ":" : "");
+    if (x265_params[0] != '\0')
+        av_opt_set(encoder_codec_context->priv_data, "x265-params", x265_params, 0);
+
     /* Set max_cll and master_display meta data for HDR content */
     if (params->max_cll && params->max_cll[0] != '\0')
         av_opt_set(encoder_codec_context->priv_data, "max-cll", params->max_cll, 0);
     if (params->master_display && params->master_display[0] != '\0')
         av_opt_set(encoder_codec_context->priv_data, "master-display", params->master_display, 0);
 
-    /* Set the number of bframes to 0 and avoid having bframes */
-    av_opt_set_int(encoder_codec_context->priv_data, "bframes", 0, 0);
+    /* Set the number of bframes to 0 and avoid having bframes, unless max_b_frames is set */
+    if (params->max_b_frames < 0)
+        av_opt_set_int(encoder_codec_context->priv_data, "bframes", 0, 0);
 
     /*
      * These are set according to
@@ -939,11 +1278,120 @@ set_nvidia_params(
      */
 }
 
+/* Scaler algorithms that can be set by params->scale_algo */
+static const struct {
+    const char *name;
+    int         flags;
+} scale_algos[] = {
+    { "fast_bilinear",  SWS_FAST_BILINEAR },
+    { "bilinear",       SWS_BILINEAR },
+    { "bicubic",        SWS_BICUBIC },
+    { "neighbor",       SWS_POINT },
+    { "area",           SWS_AREA },
+    { "lanczos",        SWS_LANCZOS },
+    { "spline",         SWS_SPLINE },
+};
+
+/*
+ * Output color spaces that can be set by params->color_space, with the matrix the scale filter
+ * converts to and the color space signaled by the encoder.
+ */
+static const struct {
+    const char          *name;
+    const char          *matrix;
+    enum AVColorSpace   colorspace;
+} color_spaces[] = {
+    { "bt601",      "bt601",        AVCOL_SPC_SMPTE170M },
+    { "smpte170m",  "smpte170m",    AVCOL_SPC_SMPTE170M },
+    { "bt470bg",    "bt470",        AVCOL_SPC_BT470BG },
+    { "bt709",      "bt709",        AVCOL_SPC_BT709 },
+    { "smpte240m",  "smpte240m",    AVCOL_SPC_SMPTE240M },
+    { "bt2020",     "bt2020",       AVCOL_SPC_BT2020_NCL },
+};
+
+/*
+ * @return  Returns the swscale flags of the scaler algorithm, or -1 if scale_algo is not valid.
+ */
+static int
+get_sws_flags(
+    const char *scale_algo)
+{
+    for (int i=0; i<sizeof(scale_algos)/sizeof(scale_algos[0]); i++) {
+        if (!strcmp(scale_algo, scale_algos[i].name))
+            return scale_algos[i].flags;
+    }
+
+    return -1;
+}
+
+/*
+ * @return  Returns the index of color_space in color_spaces[], or -1 if color_space is not valid.
+ */
+static int
+get_color_space_index(
+    const char *color_space)
+{
+    for (int i=0; i<sizeof(color_spaces)/sizeof(color_spaces[0]); i++) {
+        if (!strcmp(color_space, color_spaces[i].name))
+            return i;
+    }
+
+    return -1;
+}
+
+/*
+ * Checks the encoder params->ecodec supports the pixel format params->enc_pix_fmt. If it doesn't the error
+ * lists the pixel formats the encoder supports.
+ *
+ * @return  Returns eav_success if the encoder supports the pixel format (or doesn't list its pixel formats),
+ *          otherwise eav_param.
+ */
+static int
+check_enc_pix_fmt(
+    xcparams_t *params)
+{
+    enum AVPixelFormat pix_fmt = av_get_pix_fmt(params->enc_pix_fmt);
+    const AVCodec *codec = params->ecodec ? avcodec_find_encoder_by_name(params->ecodec) : NULL;
+    char supported[1024] = "";
+
+    if (pix_fmt == AV_PIX_FMT_NONE) {
+        elv_err("Invalid enc_pix_fmt=%s, url=%s", params->enc_pix_fmt, params->url);
+        return eav_param;
+    }
+
+    /* An encoder that is not found is reported when the encoder is opened */
+    if (!codec || !codec->pix_fmts)
+        return eav_success;
+
+    for (int i = 0; codec->pix_fmts[i] != AV_PIX_FMT_NONE; i++) {
+        if (codec->pix_fmts[i] == pix_fmt)
+            return eav_success;
+        av_strlcatf(supported, sizeof(supported), "%s%s", i > 0 ? "," : "", av_get_pix_fmt_name(codec->pix_fmts[i]));
+    }
+
+    elv_err("Encoder %s doesn't support enc_pix_fmt=%s, supported=%s, url=%s",
+        params->ecodec, params->enc_pix_fmt, supported, params->url);
+    return eav_param;
+}
+
+/*
+ * Sets the encoder pixel format to params->enc_pix_fmt if it is set, otherwise to the 4:2:0 pixel format
+ * of params->bitdepth. The filter graph converts the decoded frames to the encoder pixel format.
+ */
 static int
 set_pixel_fmt(
     AVCodecContext *encoder_codec_context,
     xcparams_t *params)
 {
+    if (params->enc_pix_fmt && params->enc_pix_fmt[0] != '\0') {
+        encoder_codec_context->pix_fmt = av_get_pix_fmt(params->enc_pix_fmt);
+        if (encoder_codec_context->pix_fmt == AV_PIX_FMT_NONE) {
+            elv_err("Invalid enc_pix_fmt=%s, url=%s", params->enc_pix_fmt, params->url);
+            return eav_param;
+        }
+        return 0;
+    }
+
     if (encoder_codec_context->codec_id == AV_CODEC_ID_MJPEG) {
         //                               AV_PIX_FMT_YUV420P does not work
         encoder_codec_context->pix_fmt = AV_PIX_FMT_YUVJ420P;
@@ -978,44 +1426,182 @@ set_pixel_fmt(
     return 0;
 }
 
+/*
+ * Returns the clockwise rotation of the stream display matrix rounded to 0, 90, 180 or 270 degrees.
+ */
 static int
-prepare_video_encoder(
-    coderctx_t *encoder_context,
-    coderctx_t *decoder_context,
-    xcparams_t *params)
+get_display_rotation(
+    AVStream *stream)
 {
-    int rc = 0;
-    int index = decoder_context->video_stream_index;
+    uint8_t *display_matrix = av_stream_get_side_data(stream, AV_PKT_DATA_DISPLAYMATRIX, NULL);
+    double rotation;
 
-    if (index < 0) {
-        elv_dbg("No video stream detected by decoder.");
-        return eav_stream_index;
-    }
+    if (!display_matrix)
+        return 0;
 
-    encoder_context->video_stream_index = index;
-    encoder_context->video_last_dts = AV_NOPTS_VALUE;
-    encoder_context->stream[index] = avformat_new_stream(encoder_context->format_context, NULL);
-    encoder_context->codec[index] = avcodec_find_encoder_by_name(params->ecodec);
+    /* The display matrix rotation is CCW with values from -180 to 180 */
+    rotation = av_display_rotation_get((int32_t *) display_matrix);
+    if (isnan(rotation))
+        return 0;
 
-    /* Custom output buffer */
-    encoder_context->format_context->io_open = elv_io_open;
-    encoder_context->format_context->io_close = elv_io_close;
+    return ((int) lround(-rotation / 90) * 90 % 360 + 360) % 360;
+}
 
-    if (!encoder_context->codec[index]) {
-        elv_dbg("could not find the proper codec");
-        return eav_codec_context;
+/*
+ * Sets params->master_display and params->max_cll (x265 syntax) from the mastering display and content
+ * light level side data of the stream, unless they are already set by the caller.
+ */
+static void
+set_hdr_metadata_params(
+    AVStream *stream,
+    xcparams_t *params)
+{
+    AVMasteringDisplayMetadata *mdm = (AVMasteringDisplayMetadata *)
+        av_stream_get_side_data(stream, AV_PKT_DATA_MASTERING_DISPLAY_METADATA, NULL);
+    AVContentLightMetadata *clm = (AVContentLightMetadata *)
+        av_stream_get_side_data(stream, AV_PKT_DATA_CONTENT_LIGHT_LEVEL, NULL);
+    char buf[256];
+
+    if (mdm && mdm->has_primaries && mdm->has_luminance &&
+        (!params->master_display || params->master_display[0] == '\0')) {
+        /* x265 expects the chromaticity in units of 0.00002 and the luminance in units of 0.0001 cd/m2 */
+        snprintf(buf, sizeof(buf), "G(%ld,%ld)B(%ld,%ld)R(%ld,%ld)WP(%ld,%ld)L(%ld,%ld)",
+            lround(av_q2d(mdm->display_primaries[1][0]) * 50000), lround(av_q2d(mdm->display_primaries[1][1]) * 50000),
+            lround(av_q2d(mdm->display_primaries[2][0]) * 50000), lround(av_q2d(mdm->display_primaries[2][1]) * 50000),
+            lround(av_q2d(mdm->display_primaries[0][0]) * 50000), lround(av_q2d(mdm->display_primaries[0][1]) * 50000),
+            lround(av_q2d(mdm->white_point[0]) * 50000), lround(av_q2d(mdm->white_point[1]) * 50000),
+            lround(av_q2d(mdm->max_luminance) * 10000), lround(av_q2d(mdm->min_luminance) * 10000));
+        free(params->master_display);
+        params->master_display = strdup(buf);
+    }
+
+    if (clm && (!params->max_cll || params->max_cll[0] == '\0')) {
+        snprintf(buf, sizeof(buf), "%u,%u", clm->MaxCLL, clm->MaxFALL);
+        free(params->max_cll);
+        params->max_cll = strdup(buf);
     }
-    elv_log("Found encoder index=%d, %s", index, params->ecodec);
+}
 
-    if (params->bypass_transcoding) {
-        AVStream *in_stream = decoder_context->stream[index];
-        AVStream *out_stream = encoder_context->stream[index];
-        AVCodecParameters *in_codecpar = in_stream->codecpar;
+/*
+ * Copies the mastering display and content light level side data of the input stream to the output
+ * stream, so the muxer can write them (i.e mdcv and clli boxes).
+ */
+static int
+copy_hdr_side_data(
+    AVStream *in_stream,
+    AVStream *out_stream,
+    xcparams_t *params)
+{
+    for (int i = 0; i < in_stream->nb_side_data; i++) {
+        const AVPacketSideData *sd_src = &in_stream->side_data[i];
+        uint8_t *out_data;
 
-        rc = avcodec_parameters_copy(out_stream->codecpar, in_codecpar);
-        if (rc < 0) {
-            elv_err("BYPASS failed to copy codec parameters, url=%s", params->url);
-            return eav_codec_param;
+        if (sd_src->type != AV_PKT_DATA_MASTERING_DISPLAY_METADATA &&
+            sd_src->type != AV_PKT_DATA_CONTENT_LIGHT_LEVEL)
+            continue;
+
+        out_data = av_stream_new_side_data(out_stream, sd_src->type, sd_src->size);
+        if (!out_data) {
+            elv_err("Failed to allocate side data, url=%s", params->url);
+            return eav_mem_alloc;
+        }
+        memcpy(out_data, sd_src->data, sd_src->size);
+    }
+
+    return eav_success;
+}
+
+/*
+ * Checks the crop rectangle against the dimensions of the source video.
+ */
+static int
+check_crop_params(
+    xcparams_t *params,
+    int src_width,
+    int src_height)
+{
+    if (params->crop_w <= 0 && params->crop_h <= 0)
+        return eav_success;
+
+    if (params->crop_x + params->crop_w > src_width ||
+        params->crop_y + params->crop_h > src_height) {
+        elv_err("Crop rectangle exceeds the source, crop_x=%d, crop_y=%d, crop_w=%d, crop_h=%d, src_width=%d, src_height=%d, url=%s",
+            params->crop_x, params->crop_y, params->crop_w, params->crop_h, src_width, src_height, params->url);
+        return eav_param;
+    }
+
+    return eav_success;
+}
+
+/*
+ * Configures the video encoder for minimal latency: no B-frames, no lookahead and no frame threading
+ * (tune=zerolatency for libx264/libx265, ultra low latency tuning for nvenc). Must be called after
+ * the codec specific params are set since it overrides some of them.
+ */
+static void
+set_low_latency_params(
+    AVCodecContext *encoder_codec_context,
+    xcparams_t *params)
+{
+    encoder_codec_context->max_b_frames = 0;
+    encoder_codec_context->flags |= AV_CODEC_FLAG_LOW_DELAY;
+
+    if (!strcmp(params->ecodec, "libx264") || !strcmp(params->ecodec, "libx265")) {
+        av_opt_set(encoder_codec_context->priv_data, "tune", "zerolatency", 0);
+        if (params->intra_refresh)
+            av_opt_set_int(encoder_codec_context->priv_data, "intra-refresh", 1, 0);
+    } else if (!strcmp(params->ecodec, "h264_nvenc") || !strcmp(params->ecodec, "hevc_nvenc")) {
+        av_opt_set(encoder_codec_context->priv_data, "tune", "ull", 0);
+        av_opt_set_int(encoder_codec_context->priv_data, "zerolatency", 1, 0);
+        av_opt_set_int(encoder_codec_context->priv_data, "delay", 0, 0);
+        av_opt_set_int(encoder_codec_context->priv_data, "rc-lookahead", 0, 0);
+    } else if (!strcmp(params->ecodec, "libvpx-vp9")) {
+        av_opt_set(encoder_codec_context->priv_data, "deadline", "realtime", 0);
+        av_opt_set_int(encoder_codec_context->priv_data, "lag-in-frames", 0, 0);
+    }
+    elv_log("Low latency encoding, ecodec=%s, intra_refresh=%d, url=%s",
+        params->ecodec, params->intra_refresh, params->url);
+}
+
+static int
+prepare_video_encoder(
+    coderctx_t *encoder_context,
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    int rc = 0;
+    int index = decoder_context->video_stream_index;
+    int src_width, src_height;
+
+    if (index < 0) {
+        elv_dbg("No video stream detected by decoder.");
+        return eav_stream_index;
+    }
+
+    encoder_context->video_stream_index = index;
+    encoder_context->video_last_dts = AV_NOPTS_VALUE;
+    encoder_context->stream[index] = avformat_new_stream(encoder_context->format_context, NULL);
+    encoder_context->codec[index] = avcodec_find_encoder_by_name(params->ecodec);
+
+    /* Custom output buffer */
+    encoder_context->format_context->io_open = elv_io_open;
+    encoder_context->format_context->io_close = elv_io_close;
+
+    if (!encoder_context->codec[index]) {
+        elv_dbg("could not find the proper codec");
+        return eav_codec_context;
+    }
+    elv_log("Found encoder index=%d, %s", index, params->ecodec);
+
+    if (params->bypass_transcoding) {
+        AVStream *in_stream = decoder_context->stream[index];
+        AVStream *out_stream = encoder_context->stream[index];
+        AVCodecParameters *in_codecpar = in_stream->codecpar;
+
+        rc = avcodec_parameters_copy(out_stream->codecpar, in_codecpar);
+        if (rc < 0) {
+            elv_err("BYPASS failed to copy codec parameters, url=%s", params->url);
+            return eav_codec_param;
         }
 
         /* Set output stream timebase when bypass encoding */
@@ -1027,6 +1613,10 @@ prepare_video_encoder(
         out_stream->avg_frame_rate = decoder_context->format_context->streams[decoder_context->video_stream_index]->avg_frame_rate;
         out_stream->codecpar->codec_tag = 0;
 
+        rc = init_bitstream_filters(params, out_stream, &encoder_context->bsf_context[index]);
+        if (rc < 0)
+            return rc;
+
         rc = set_encoder_options(encoder_context, decoder_context, params, decoder_context->video_stream_index,
             out_stream->time_base.den);
         if (rc < 0) {
@@ -1057,31 +1647,103 @@ prepare_video_encoder(
         av_opt_set(encoder_codec_context->priv_data, "preset", params->preset, AV_OPT_FLAG_ENCODING_PARAM | AV_OPT_SEARCH_CHILDREN);
     }
 
-    // TODO: Add a parameter for b-frames instead of using format
-    if (!strcmp(params->format, "fmp4-segment") || !strcmp(params->format, "fmp4") ||
-        !strcmp(params->format, "dash") || !strcmp(params->format, "hls")) {
+    /* The segmented formats have no B-frames unless max_b_frames is set */
+    if (params->max_b_frames >= 0) {
+        encoder_codec_context->max_b_frames = params->max_b_frames;
+    } else if (!strcmp(params->format, "fmp4-segment") || !strcmp(params->format, "fmp4") ||
+        !strcmp(params->format, "cmaf") || !strcmp(params->format, "dash") || !strcmp(params->format, "hls")) {
         encoder_codec_context->max_b_frames = 0;
     }
 
+    if (params->ref_frames > 0)
+        encoder_codec_context->refs = params->ref_frames;
+
+    if (params->closed_gop)
+        encoder_codec_context->flags |= AV_CODEC_FLAG_CLOSED_GOP;
+
     if (params->force_keyint > 0) {
         encoder_codec_context->gop_size = params->force_keyint;
     }
 
+    /* An explicit rotate param takes precedence over the rotation of the source */
+    if (params->auto_rotate && params->rotate == 0) {
+        params->rotate = get_display_rotation(decoder_context->stream[index]);
+        if (params->rotate != 0)
+            elv_log("Auto rotating video by %d degrees, url=%s", params->rotate, params->url);
+    }
+
+    if (params->deinterlace_auto) {
+        enum AVFieldOrder field_order = decoder_context->stream[index]->codecpar->field_order;
+        if (field_order == AV_FIELD_UNKNOWN)
+            field_order = decoder_context->codec_context[index]->field_order;
+
+        if (field_order == AV_FIELD_TT || field_order == AV_FIELD_BB ||
+            field_order == AV_FIELD_TB || field_order == AV_FIELD_BT) {
+            if (params->deinterlace == dif_none)
+                params->deinterlace = dif_bwdif_frame;
+            elv_log("Deinterlacing interlaced source, field_order=%d, deinterlace=%d, url=%s",
+                field_order, params->deinterlace, params->url);
+        } else {
+            params->deinterlace = dif_none;
+        }
+    }
+
+    /* Tone mapping only applies to HDR sources, SDR sources are transcoded as if it was not set */
+    if (params->tone_map && params->tone_map[0] != '\0') {
+        enum AVColorTransferCharacteristic color_trc = decoder_context->stream[index]->codecpar->color_trc;
+        if (color_trc == AVCOL_TRC_UNSPECIFIED)
+            color_trc = decoder_context->codec_context[index]->color_trc;
+
+        if (color_trc == AVCOL_TRC_SMPTE2084 || color_trc == AVCOL_TRC_ARIB_STD_B67) {
+            elv_log("Tone mapping HDR source to BT.709, color_trc=%s, tone_map=%s, url=%s",
+                av_color_transfer_name(color_trc), params->tone_map, params->url);
+        } else {
+            elv_log("Skipping tone mapping of SDR source, color_trc=%s, url=%s",
+                av_color_transfer_name(color_trc) ? av_color_transfer_name(color_trc) : "unknown", params->url);
+            free(params->tone_map);
+            params->tone_map = NULL;
+        }
+    }
+
+    /* Keep the HDR static metadata of the source unless it is tone mapped to SDR */
+    if (params->preserve_hdr_metadata && !(params->tone_map && params->tone_map[0] != '\0'))
+        set_hdr_metadata_params(decoder_context->stream[index], params);
+
+    /* The source is cropped before scaling */
+    src_width = decoder_context->codec_context[index]->width;
+    src_height = decoder_context->codec_context[index]->height;
+    if ((rc = check_crop_params(params, src_width, src_height)) != eav_success)
+        return rc;
+    if (params->crop_w > 0) {
+        src_width = params->crop_w;
+        src_height = params->crop_h;
+    }
+
     /* Set codec context parameters */
-    encoder_codec_context->height = params->enc_height != -1 ? params->enc_height : decoder_context->codec_context[index]->height;
-    encoder_codec_context->width = params->enc_width != -1 ? params->enc_width : decoder_context->codec_context[index]->width;
+    encoder_codec_context->height = params->enc_height != -1 ? params->enc_height : src_height;
+    encoder_codec_context->width = params->enc_width != -1 ? params->enc_width : src_width;
 
     /* If the rotation param is set to 90 or 270 degree then change width and hight */
     if (params->rotate == 90 || params->rotate == 270) {
         encoder_codec_context->height = params->enc_height != -1 ? params->enc_height : decoder_context->codec_context[index]->width;
         encoder_codec_context->width = params->enc_width != -1 ? params->enc_width : decoder_context->codec_context[index]->height;
     }
+
+    /* Padding is added after scaling, so the encoded frame includes the padding */
+    encoder_codec_context->width += params->pad_left + params->pad_right;
+    encoder_codec_context->height += params->pad_top + params->pad_bottom;
+
     if (params->video_time_base > 0)
         encoder_codec_context->time_base = (AVRational) {1, params->video_time_base};
     else
         encoder_codec_context->time_base = decoder_context->codec_context[index]->time_base;
 
     encoder_codec_context->sample_aspect_ratio = decoder_context->codec_context[index]->sample_aspect_ratio;
+    /* Transposing the frame transposes the pixels too */
+    if ((params->rotate == 90 || params->rotate == 270) && encoder_codec_context->sample_aspect_ratio.num > 0) {
+        encoder_codec_context->sample_aspect_ratio = (AVRational) {
+            encoder_codec_context->sample_aspect_ratio.den, encoder_codec_context->sample_aspect_ratio.num};
+    }
     if (params->video_bitrate > 0)
         encoder_codec_context->bit_rate = params->video_bitrate;
     if (params->rc_buffer_size > 0)
@@ -1089,8 +1751,27 @@ prepare_video_encoder(
     if (params->rc_max_rate > 0)
         encoder_codec_context->rc_max_rate = params->rc_max_rate;
 
+    /* Constant bit rate needs the minimum rate too, and the HRD signaling of x264 makes the encoder pad the stream */
+    if (params->rate_control && !strcmp(params->rate_control, "cbr")) {
+        encoder_codec_context->rc_min_rate = params->video_bitrate;
+        av_opt_set(encoder_codec_context->priv_data, "nal-hrd", "cbr", AV_OPT_SEARCH_CHILDREN);
+    }
+
     encoder_codec_context->framerate = decoder_context->codec_context[index]->framerate;
 
+    /*
+     * With frame rate conversion the encoder time base follows the output frame rate (unless video_time_base
+     * is set), so the segment duration and the frame durations are calculated from the output frame rate.
+     */
+    if (params->enc_frame_rate && params->enc_frame_rate[0] != '\0') {
+        av_parse_video_rate(&encoder_codec_context->framerate, params->enc_frame_rate);
+        if (params->video_time_base <= 0)
+            encoder_codec_context->time_base = (AVRational) {1, encoder_codec_context->framerate.num};
+        elv_log("Converting frame rate to %d/%d, time_base=%d/%d, url=%s",
+            encoder_codec_context->framerate.num, encoder_codec_context->framerate.den,
+            encoder_codec_context->time_base.num, encoder_codec_context->time_base.den, params->url);
+    }
+
     // This needs to be set before open (ffmpeg samples have it wrong)
     if (encoder_context->format_context->oformat->flags & AVFMT_GLOBALHEADER) {
         encoder_codec_context->flags |= AV_CODEC_FLAG_GLOBAL_HEADER;
@@ -1128,6 +1809,28 @@ prepare_video_encoder(
     if ((rc = set_pixel_fmt(encoder_codec_context, params)) != eav_success)
         return rc;
 
+    if (params->preserve_hdr_metadata && !(params->tone_map && params->tone_map[0] != '\0')) {
+        AVCodecParameters *codecpar = decoder_context->stream[index]->codecpar;
+        encoder_codec_context->color_primaries = codecpar->color_primaries;
+        encoder_codec_context->color_trc = codecpar->color_trc;
+        encoder_codec_context->colorspace = codecpar->color_space;
+        encoder_codec_context->color_range = codecpar->color_range;
+    }
+
+    /* The tone mapping filters convert to BT.709 limited range */
+    if (params->tone_map && params->tone_map[0] != '\0') {
+        encoder_codec_context->color_primaries = AVCOL_PRI_BT709;
+        encoder_codec_context->color_trc = AVCOL_TRC_BT709;
+        encoder_codec_context->colorspace = AVCOL_SPC_BT709;
+        encoder_codec_context->color_range = AVCOL_RANGE_MPEG;
+    }
+
+    /* Signal the color range and space the scale filter converts to, otherwise they are left unspecified */
+    if (params->color_range && params->color_range[0] != '\0')
+        encoder_codec_context->color_range = !strcmp(params->color_range, "pc") ? AVCOL_RANGE_JPEG : AVCOL_RANGE_MPEG;
+    if (params->color_space && params->color_space[0] != '\0')
+        encoder_codec_context->colorspace = color_spaces[get_color_space_index(params->color_space)].colorspace;
+
     if (!strcmp(params->ecodec, "h264_nvenc"))
         /* Set NVIDIA specific params if the encoder is NVIDIA */
         set_nvidia_params(encoder_context, decoder_context, params);
@@ -1140,15 +1843,26 @@ prepare_video_encoder(
     else if (!strcmp(params->ecodec, "h265_ni_enc"))
         /* Set netint H265 codensity params */
         set_netint_h265_params(encoder_context, decoder_context, params);
+    else if (is_vp9_av1_encoder(params->ecodec))
+        /* Set VP9/AV1 specific params (speed, row threading and profile) */
+        set_vp9_av1_params(encoder_context, decoder_context, params);
     else
         /* Set H264 specific params (profile and level) */
         set_h264_params(encoder_context, decoder_context, params);
 
+    if (params->low_latency)
+        set_low_latency_params(encoder_codec_context, params);
+
     elv_log("Output pixel_format=%s, profile=%d, level=%d",
         av_get_pix_fmt_name(encoder_codec_context->pix_fmt),
         encoder_codec_context->profile,
         encoder_codec_context->level);
 
+    if (params->encode_threads > 0)
+        encoder_codec_context->thread_count = params->encode_threads;
+    if (params->thread_type && params->thread_type[0] != '\0')
+        encoder_codec_context->thread_type = get_thread_type(params->thread_type);
+
     /* Set encoder options after setting all codec context parameters */
     rc = set_encoder_options(encoder_context, decoder_context, params, decoder_context->video_stream_index,
         encoder_codec_context->time_base.den);
@@ -1171,8 +1885,16 @@ prepare_video_encoder(
         return eav_codec_param;
     }
 
+    if (params->preserve_hdr_metadata && !(params->tone_map && params->tone_map[0] != '\0')) {
+        if ((rc = copy_hdr_side_data(decoder_context->stream[index], encoder_context->stream[index], params)) != eav_success)
+            return rc;
+    }
+
     encoder_context->stream[index]->time_base = encoder_codec_context->time_base;
-    encoder_context->stream[index]->avg_frame_rate = decoder_context->stream[decoder_context->video_stream_index]->avg_frame_rate;
+    if (params->enc_frame_rate && params->enc_frame_rate[0] != '\0')
+        encoder_context->stream[index]->avg_frame_rate = encoder_codec_context->framerate;
+    else
+        encoder_context->stream[index]->avg_frame_rate = decoder_context->stream[decoder_context->video_stream_index]->avg_frame_rate;
 
     return 0;
 }
@@ -1191,6 +1913,101 @@ is_valid_aac_sample_rate(
     return 0;
 }
 
+static int
+is_valid_opus_sample_rate(
+    int sample_rate)
+{
+    int valid_sample_rates[] = {8000, 12000, 16000, 24000, 48000};
+
+    for (int i=0; i<sizeof(valid_sample_rates)/sizeof(int); i++) {
+        if (sample_rate == valid_sample_rates[i])
+            return 1;
+    }
+
+    return 0;
+}
+
+static int
+is_valid_ac3_sample_rate(
+    int sample_rate)
+{
+    int valid_sample_rates[] = {32000, 44100, 48000};
+
+    for (int i=0; i<sizeof(valid_sample_rates)/sizeof(int); i++) {
+        if (sample_rate == valid_sample_rates[i])
+            return 1;
+    }
+
+    return 0;
+}
+
+static int
+is_ac3_encoder(
+    const char *ecodec)
+{
+    return !strcmp(ecodec, "ac3") || !strcmp(ecodec, "eac3");
+}
+
+static void
+set_audio_codec_params(
+    AVCodecContext *encoder_codec_context,
+    xcparams_t *params)
+{
+    if (!strcmp(params->ecodec2, "libopus")) {
+        if (params->opus_vbr && params->opus_vbr[0] != '\0')
+            av_opt_set(encoder_codec_context->priv_data, "vbr", params->opus_vbr, 0);
+    } else if (is_ac3_encoder(params->ecodec2) && params->audio_channel_bitrate > 0) {
+        encoder_codec_context->bit_rate = (int64_t) params->audio_channel_bitrate * encoder_codec_context->channels;
+    }
+}
+
+/*
+ * Copies the audio stream without decoding (i.e. E-AC-3 or Dolby Atmos passthrough).
+ * The encoder codec context only holds the input parameters, it is never opened.
+ */
+static int
+prepare_audio_bypass(
+    coderctx_t *encoder_context,
+    coderctx_t *decoder_context,
+    xcparams_t *params,
+    int stream_index,
+    int output_stream_index)
+{
+    AVStream *in_stream = decoder_context->stream[stream_index];
+    AVStream *out_stream = encoder_context->stream[output_stream_index];
+    int rc;
+
+    encoder_context->codec_context[output_stream_index] = avcodec_alloc_context3(NULL);
+    if (!encoder_context->codec_context[output_stream_index]) {
+        elv_err("BYPASS failed to allocate audio codec context, url=%s", params->url);
+        return eav_codec_context;
+    }
+
+    if (avcodec_parameters_to_context(encoder_context->codec_context[output_stream_index], in_stream->codecpar) < 0 ||
+        avcodec_parameters_copy(out_stream->codecpar, in_stream->codecpar) < 0) {
+        elv_err("BYPASS failed to copy audio codec parameters, url=%s", params->url);
+        return eav_codec_param;
+    }
+    out_stream->codecpar->codec_tag = 0;
+    out_stream->time_base = (AVRational){1, in_stream->codecpar->sample_rate};
+    encoder_context->codec_context[output_stream_index]->time_base = out_stream->time_base;
+
+    rc = init_bitstream_filters(params, out_stream, &encoder_context->bsf_context[output_stream_index]);
+    if (rc < 0)
+        return rc;
+
+    rc = set_encoder_options(encoder_context, decoder_context, params, stream_index, out_stream->time_base.den);
+    if (rc < 0) {
+        elv_err("Failed to set audio encoder options with bypass, url=%s", params->url);
+        return rc;
+    }
+
+    elv_log("BYPASS audio stream_index=%d, codec=%s, sample_rate=%d, channels=%d, url=%s",
+        stream_index, avcodec_get_name(in_stream->codecpar->codec_id), in_stream->codecpar->sample_rate,
+        in_stream->codecpar->channels, params->url);
+    return 0;
+}
+
 static int
 prepare_audio_encoder(
     coderctx_t *encoder_context,
@@ -1244,19 +2061,23 @@ prepare_audio_encoder(
         encoder_context->n_audio = 1;
 
         encoder_context->stream[output_stream_index] = avformat_new_stream(format_context, NULL);
-        if (params->bypass_transcoding)
-            encoder_context->codec[output_stream_index] = avcodec_find_encoder(decoder_context->codec_context[stream_index]->codec_id);
-        else
-            encoder_context->codec[output_stream_index] = avcodec_find_encoder_by_name(ecodec);
+        format_context->io_open = elv_io_open;
+        format_context->io_close = elv_io_close;
+
+        /* The input codec may have no encoder (i.e. E-AC-3 with Atmos), so the stream is copied as is */
+        if (params->bypass_transcoding) {
+            rc = prepare_audio_bypass(encoder_context, decoder_context, params, stream_index, output_stream_index);
+            if (rc < 0)
+                return rc;
+            continue;
+        }
+
+        encoder_context->codec[output_stream_index] = avcodec_find_encoder_by_name(ecodec);
         if (!encoder_context->codec[output_stream_index]) {
-            elv_err("Codec not found, codec_id=%s, url=%s",
-                avcodec_get_name(decoder_context->codec_context[stream_index]->codec_id), params->url);
+            elv_err("Codec not found, ecodec2=%s, url=%s", ecodec, params->url);
             return eav_codec_context;
         }
 
-        format_context->io_open = elv_io_open;
-        format_context->io_close = elv_io_close;
-
         encoder_context->codec_context[output_stream_index] = avcodec_alloc_context3(encoder_context->codec[output_stream_index]);
 
         /* By default use decoder parameters */
@@ -1266,10 +2087,7 @@ prepare_audio_encoder(
         encoder_context->codec_context[output_stream_index]->time_base = (AVRational){1, encoder_context->codec_context[output_stream_index]->sample_rate};
         encoder_context->stream[output_stream_index]->time_base = encoder_context->codec_context[output_stream_index]->time_base;
 
-        if (decoder_context->codec[stream_index] && 
-            decoder_context->codec[stream_index]->sample_fmts && params->bypass_transcoding)
-            encoder_context->codec_context[output_stream_index]->sample_fmt = decoder_context->codec[stream_index]->sample_fmts[0];
-        else if (encoder_context->codec[output_stream_index]->sample_fmts && encoder_context->codec[output_stream_index]->sample_fmts[0])
+        if (encoder_context->codec[output_stream_index]->sample_fmts && encoder_context->codec[output_stream_index]->sample_fmts[0])
             encoder_context->codec_context[output_stream_index]->sample_fmt = encoder_context->codec[output_stream_index]->sample_fmts[0];
         else
             encoder_context->codec_context[output_stream_index]->sample_fmt = AV_SAMPLE_FMT_FLTP;
@@ -1302,6 +2120,15 @@ prepare_audio_encoder(
             !is_valid_aac_sample_rate(encoder_context->codec_context[output_stream_index]->sample_rate) &&
             sample_rate <= 0)
             sample_rate = DEFAULT_ACC_SAMPLE_RATE;
+        /* Opus only encodes at 48000 and a few lower rates, 44100 inputs are resampled to 48000 */
+        if (!strcmp(ecodec, "libopus") &&
+            !is_valid_opus_sample_rate(encoder_context->codec_context[output_stream_index]->sample_rate) &&
+            sample_rate <= 0)
+            sample_rate = DEFAULT_OPUS_SAMPLE_RATE;
+        if (is_ac3_encoder(ecodec) &&
+            !is_valid_ac3_sample_rate(encoder_context->codec_context[output_stream_index]->sample_rate) &&
+            sample_rate <= 0)
+            sample_rate = DEFAULT_AC3_SAMPLE_RATE;
 
         /*
          *  If sample_rate is set and
@@ -1330,6 +2157,7 @@ prepare_audio_encoder(
             encoder_context->codec_context[output_stream_index]->sample_rate);
 
         encoder_context->codec_context[output_stream_index]->bit_rate = params->audio_bitrate;
+        set_audio_codec_params(encoder_context->codec_context[output_stream_index], params);
 
         /* Allow the use of the experimental AAC encoder. */
         encoder_context->codec_context[output_stream_index]->strict_std_compliance = FF_COMPLIANCE_EXPERIMENTAL;
@@ -1372,88 +2200,620 @@ prepare_audio_encoder(
     return 0;
 }
 
+/*
+ * Prepare a WebVTT encoder for the subtitle stream selected by the decoder.
+ * The output is split by the segment muxer using the same segment duration as video,
+ * so subtitle segments line up with the video segment boundaries.
+ */
 static int
-prepare_encoder(
+prepare_subtitle_encoder(
     coderctx_t *encoder_context,
     coderctx_t *decoder_context,
-    avpipe_io_handler_t *out_handlers,
-    ioctx_t *inctx,
     xcparams_t *params)
 {
-    out_tracker_t *out_tracker;
-    char *filename = "";
-    char *filename2 = "";
-    char *format = params->format;
     int rc = 0;
+    int index = decoder_context->subtitle_stream_index;
+    int64_t seg_duration_ts = 0;
 
-    encoder_context->live_proto = decoder_context->live_proto;
-    encoder_context->live_container = decoder_context->live_container;
-    encoder_context->out_handlers = out_handlers;
-    /*
-     * TODO: passing "hls" format needs some development in FF to produce stream index for audio/video.
-     * I will keep hls as before to go to dashenc.c
-     */
-    if (!strcmp(params->format, "hls"))
-        format = "dash";
-    else if (!strcmp(params->format, "mp4")) {
-        filename = "mp4-stream.mp4";
-        if (params->xc_type == xc_all)
-            filename2 = "mp4-astream.mp4";
-    } else if (!strcmp(params->format, "fmp4")) {
-        filename = "fmp4-stream.mp4";
-        /* fmp4 is actually mp4 format with a fragmented flag */
-        format = "mp4";
-        if (params->xc_type == xc_all)
-            filename2 = "fmp4-astream.mp4";
-    } else if (!strcmp(params->format, "segment")) {
-        filename = "segment-%05d.mp4";
-        if (params->xc_type == xc_all)
-            filename2 = "segment-audio-%05d.mp4";
-    } else if (!strcmp(params->format, "fmp4-segment")) {
-        /* Fragmented mp4 segment */
-        format = "segment";
-        if (params->xc_type & xc_video)
-            filename = "fsegment-video-%05d.mp4";
-        if (params->xc_type & xc_audio)
-            filename2 = "fsegment-audio-%05d.mp4";
-    } else if (!strcmp(params->format, "image2")) {
-        filename = "%d.jpeg";
+    if (index < 0) {
+        elv_dbg("No subtitle stream detected by decoder.");
+        return eav_stream_index;
     }
 
-    /*
-     * Allocate an AVFormatContext for output.
-     * Setting 3th paramter to "dash" determines the output file format and avoids guessing
-     * output file format using filename in ffmpeg library.
-     */
-    if (params->xc_type & xc_video) {
-        avformat_alloc_output_context2(&encoder_context->format_context, NULL, format, filename);
-        if (!encoder_context->format_context) {
-            elv_dbg("could not allocate memory for output format");
-            return eav_codec_context;
-        }
-    }
-    if (params->xc_type & xc_audio) {
-        encoder_context->n_audio_output = num_audio_output(decoder_context, params);
-        for (int i=0; i<encoder_context->n_audio_output; i++) {
-            if (!strcmp(params->format, "hls") || !strcmp(params->format, "dash")) {
-                avformat_alloc_output_context2(&encoder_context->format_context2[i], NULL, format, filename2);
-            } else {
-                snprintf(encoder_context->filename2[i], MAX_AVFILENAME_LEN, "fsegment-audio%d-%s.mp4", i, "%05d");
-                avformat_alloc_output_context2(&encoder_context->format_context2[i], NULL, format, encoder_context->filename2[i]);
-            }
-            if (!encoder_context->format_context2[i]) {
-                elv_dbg("could not allocate memory for audio output format stream_index=%d", params->audio_index[i]);
-                return eav_codec_context;
-            }
-        }
-    }
+    encoder_context->subtitle_stream_index = index;
+    encoder_context->stream[index] = avformat_new_stream(encoder_context->format_context, NULL);
+    encoder_context->codec[index] = avcodec_find_encoder_by_name("webvtt");
 
-    if (params->xc_type == xc_extract_images || params->xc_type == xc_extract_all_images) {
-        // Tell the image2 muxer to expand the filename with PTS instead of sequential numbering
-        av_opt_set(encoder_context->format_context->priv_data, "frame_pts", "true", 0);
-    }
+    /* Custom output buffer */
+    encoder_context->format_context->io_open = elv_io_open;
+    encoder_context->format_context->io_close = elv_io_close;
 
-    // Encryption applies to both audio and video
+    if (!encoder_context->codec[index]) {
+        elv_err("Could not find webvtt encoder, url=%s", params->url);
+        return eav_codec_context;
+    }
+
+    encoder_context->codec_context[index] = avcodec_alloc_context3(encoder_context->codec[index]);
+    if (!encoder_context->codec_context[index]) {
+        elv_err("Failed to allocate memory for subtitle encoder context, url=%s", params->url);
+        return eav_mem_alloc;
+    }
+
+    AVCodecContext *decoder_codec_context = decoder_context->codec_context[index];
+    AVCodecContext *encoder_codec_context = encoder_context->codec_context[index];
+
+    encoder_codec_context->time_base = decoder_context->stream[index]->time_base;
+    if (decoder_codec_context->subtitle_header) {
+        /* ASS header is required by the webvtt encoder to interpret the decoded events */
+        encoder_codec_context->subtitle_header = av_mallocz(decoder_codec_context->subtitle_header_size + 1);
+        if (!encoder_codec_context->subtitle_header)
+            return eav_mem_alloc;
+        memcpy(encoder_codec_context->subtitle_header, decoder_codec_context->subtitle_header,
+            decoder_codec_context->subtitle_header_size);
+        encoder_codec_context->subtitle_header_size = decoder_codec_context->subtitle_header_size;
+    }
+
+    if ((rc = avcodec_open2(encoder_codec_context, encoder_context->codec[index], NULL)) < 0) {
+        elv_err("Could not open encoder for subtitle, err=%d, url=%s", rc, params->url);
+        return eav_open_codec;
+    }
+
+    if (avcodec_parameters_from_context(encoder_context->stream[index]->codecpar, encoder_codec_context) < 0) {
+        elv_err("Failed to copy subtitle encoder parameters to output stream, url=%s", params->url);
+        return eav_codec_param;
+    }
+    encoder_context->stream[index]->time_base = encoder_codec_context->time_base;
+
+    if (params->seg_duration)
+        seg_duration_ts = atof(params->seg_duration) * encoder_codec_context->time_base.den /
+            encoder_codec_context->time_base.num;
+
+    av_opt_set(encoder_context->format_context->priv_data, "segment_format", "webvtt", 0);
+    av_opt_set(encoder_context->format_context->priv_data, "segment_header_filename", "vttinit-stream.vtt", 0);
+    av_opt_set(encoder_context->format_context->priv_data, "start_segment", params->start_segment_str, 0);
+    av_opt_set_int(encoder_context->format_context->priv_data, "segment_duration_ts", seg_duration_ts, 0);
+    av_opt_set(encoder_context->format_context->priv_data, "reset_timestamps", "on", 0);
+
+    elv_dbg("setting subtitle segment_time to %s, seg_duration_ts=%"PRId64", stream_index=%d, url=%s",
+        params->seg_duration, seg_duration_ts, index, params->url);
+
+    return 0;
+}
+
+/*
+ * Returns the key period of the segment seg_index, or NULL if the segment comes before the first period.
+ */
+static crypt_key_period_t *
+get_key_period(
+    xcparams_t *params,
+    int seg_index)
+{
+    crypt_key_period_t *key_period = NULL;
+
+    for (int i = 0; i < params->n_key_periods; i++) {
+        if (params->key_periods[i].start_segment > seg_index)
+            break;
+        key_period = &params->key_periods[i];
+    }
+    return key_period;
+}
+
+/*
+ * Parses a 16-byte ID in hex (i.e KID or DRM system ID), the dashes of the UUID form are skipped.
+ * Returns 0 if the ID is valid, otherwise -1.
+ */
+static int
+parse_hex_id(
+    const char *s,
+    uint8_t id[16])
+{
+    int n = 0;
+
+    memset(id, 0, 16);
+    for (const char *c = s; c && *c != '\0'; c++) {
+        int v;
+
+        if (*c == '-')
+            continue;
+        if (*c >= '0' && *c <= '9')
+            v = *c - '0';
+        else if (*c >= 'a' && *c <= 'f')
+            v = *c - 'a' + 10;
+        else if (*c >= 'A' && *c <= 'F')
+            v = *c - 'A' + 10;
+        else
+            return -1;
+        if (n == 32)
+            return -1;
+        id[n/2] |= n % 2 ? v : v << 4;
+        n++;
+    }
+
+    return n == 32 ? 0 : -1;
+}
+
+int
+avpipe_insert_pssh(
+    xcparams_t *params,
+    int seg_index,
+    const uint8_t *buf,
+    int64_t len,
+    uint8_t **out_buf,
+    int64_t *out_len)
+{
+    crypt_key_period_t *key_period = get_key_period(params, seg_index);
+    const char *kid_str = key_period ? key_period->kid : params->crypt_kid;
+    uint8_t kid[16];
+    int has_kid = kid_str && parse_hex_id(kid_str, kid) == 0;
+    int64_t pos = 0, moov_pos = -1, moov_end = 0;
+    int moov_header_size = 0;
+    int64_t pssh_size = 0;
+    uint8_t *out, *p;
+
+    /* Find the top level moov box */
+    while (pos + 8 <= len) {
+        uint64_t size = AV_RB32(buf + pos);
+        int header_size = 8;
+
+        if (size == 1) {
+            if (pos + 16 > len)
+                break;
+            size = AV_RB64(buf + pos + 8);
+            header_size = 16;
+        } else if (size == 0) {
+            size = len - pos;
+        }
+        if (size < header_size || pos + size > len)
+            break;
+        if (!memcmp(buf + pos + 4, "moov", 4)) {
+            moov_pos = pos;
+            moov_end = pos + size;
+            moov_header_size = AV_RB32(buf + pos) == 0 ? 0 : header_size;
+            break;
+        }
+        pos += size;
+    }
+
+    if (moov_pos < 0) {
+        elv_err("No moov box to add the pssh boxes, len=%"PRId64", url=%s", len, params->url);
+        return eav_write_header;
+    }
+
+    /* Version 1 pssh boxes list the KID, version 0 if there is no KID */
+    for (int i = 0; i < params->n_drm_systems; i++)
+        pssh_size += 12 + 16 + (has_kid ? 4 + 16 : 0) + 4 + params->drm_systems[i].pssh_data_len;
+
+    if (moov_header_size == 8 && moov_end - moov_pos + pssh_size > UINT32_MAX) {
+        elv_err("The moov box is too big to add the pssh boxes, url=%s", params->url);
+        return eav_write_header;
+    }
+
+    out = (uint8_t *) malloc(len + pssh_size);
+    if (!out)
+        return eav_mem_alloc;
+
+    memcpy(out, buf, moov_end);
+    if (moov_header_size == 8)
+        AV_WB32(out + moov_pos, moov_end - moov_pos + pssh_size);
+    else if (moov_header_size == 16)
+        AV_WB64(out + moov_pos + 8, moov_end - moov_pos + pssh_size);
+
+    p = out + moov_end;
+    for (int i = 0; i < params->n_drm_systems; i++) {
+        drm_system_t *drm_system = &params->drm_systems[i];
+        uint8_t system_id[16];
+
+        parse_hex_id(drm_system->system_id, system_id);
+        AV_WB32(p, 12 + 16 + (has_kid ? 4 + 16 : 0) + 4 + drm_system->pssh_data_len);
+        memcpy(p + 4, "pssh", 4);
+        AV_WB32(p + 8, has_kid ? 0x01000000 : 0);
+        memcpy(p + 12, system_id, 16);
+        p += 28;
+        if (has_kid) {
+            AV_WB32(p, 1);
+            memcpy(p + 4, kid, 16);
+            p += 20;
+        }
+        AV_WB32(p, drm_system->pssh_data_len);
+        if (drm_system->pssh_data_len > 0)
+            memcpy(p + 4, drm_system->pssh_data, drm_system->pssh_data_len);
+        p += 4 + drm_system->pssh_data_len;
+    }
+    memcpy(p, buf + moov_end, len - moov_end);
+
+    *out_buf = out;
+    *out_len = len + pssh_size;
+    return eav_success;
+}
+
+/* Scheme of the emsg boxes carrying ID3 tags (AOM "Carriage of ID3 Timed Metadata in CMAF") */
+#define EMSG_ID3_SCHEME "https://aomedia.org/emsg/ID3"
+
+int
+avpipe_insert_emsg(
+    xcparams_t *params,
+    int *next_metadata,
+    AVRational time_base,
+    int64_t seg_start_pts,
+    int64_t seg_end_pts,
+    int relative,
+    const uint8_t *buf,
+    int64_t len,
+    uint8_t **out_buf,
+    int64_t *out_len)
+{
+    int scheme_size = strlen(EMSG_ID3_SCHEME) + 1;
+    /* Version 0 has a 32 bit presentation_time_delta, version 1 a 64 bit presentation_time. The value is empty. */
+    int header_size = (relative ? 28 : 32) + scheme_size + 1;
+    int first = *next_metadata, last = *next_metadata;
+    int64_t pos = 0, insert_pos = -1;
+    int64_t emsg_size = 0;
+    uint8_t *out, *p;
+
+    *out_buf = NULL;
+    *out_len = 0;
+
+    while (last < params->n_inject_metadata && params->inject_metadata[last].pts < seg_end_pts) {
+        emsg_size += header_size + params->inject_metadata[last].payload_len;
+        last++;
+    }
+    if (last == first)
+        return eav_success;
+
+    /* Find the first top level sidx or moof box, the sidx offsets are relative to the boxes that follow it */
+    while (pos + 8 <= len) {
+        uint64_t size = AV_RB32(buf + pos);
+
+        if (!memcmp(buf + pos + 4, "sidx", 4) || !memcmp(buf + pos + 4, "moof", 4)) {
+            insert_pos = pos;
+            break;
+        }
+        if (size == 1 && pos + 16 <= len)
+            size = AV_RB64(buf + pos + 8);
+        if (size < 8 || pos + size > len)
+            break;
+        pos += size;
+    }
+
+    if (insert_pos < 0) {
+        elv_err("No moof box to add the emsg boxes, len=%"PRId64", url=%s", len, params->url);
+        return eav_write_frame;
+    }
+
+    out = (uint8_t *) malloc(len + emsg_size);
+    if (!out)
+        return eav_mem_alloc;
+
+    memcpy(out, buf, insert_pos);
+    p = out + insert_pos;
+    for (int i = first; i < last; i++) {
+        timed_metadata_t *metadata = &params->inject_metadata[i];
+
+        AV_WB32(p, header_size + metadata->payload_len);
+        memcpy(p + 4, "emsg", 4);
+        if (relative) {
+            AV_WB32(p + 8, 0);
+            memcpy(p + 12, EMSG_ID3_SCHEME, scheme_size);
+            p += 12 + scheme_size;
+            *p++ = '\0';
+            AV_WB32(p, time_base.den);
+            AV_WB32(p + 4, FFMAX(metadata->pts - seg_start_pts, 0) * time_base.num);
+            p += 8;
+        } else {
+            AV_WB32(p + 8, 0x01000000);
+            AV_WB32(p + 12, time_base.den);
+            AV_WB64(p + 16, metadata->pts * time_base.num);
+            p += 24;
+        }
+        AV_WB32(p, 0xFFFFFFFF);     // event_duration is unknown
+        AV_WB32(p + 4, i);          // id
+        p += 8;
+        if (!relative) {
+            memcpy(p, EMSG_ID3_SCHEME, scheme_size);
+            p += scheme_size;
+            *p++ = '\0';
+        }
+        memcpy(p, metadata->payload, metadata->payload_len);
+        p += metadata->payload_len;
+
+        elv_dbg("Add emsg id=%d pts=%"PRId64" payload_len=%d, seg_start_pts=%"PRId64", url=%s",
+            i, metadata->pts, metadata->payload_len, seg_start_pts, params->url);
+    }
+    memcpy(p, buf + insert_pos, len - insert_pos);
+
+    *next_metadata = last;
+    *out_buf = out;
+    *out_len = len + emsg_size;
+    return eav_success;
+}
+
+/*
+ * Adds shift to the chunk offsets (stco and co64 boxes) of the tracks in [pos, end) that are >= from.
+ */
+static int
+shift_chunk_offsets(
+    uint8_t *buf,
+    int64_t pos,
+    int64_t end,
+    int64_t from,
+    int64_t shift)
+{
+    while (pos + 8 <= end) {
+        uint64_t size = AV_RB32(buf + pos);
+        int header_size = 8;
+
+        if (size == 1) {
+            if (pos + 16 > end)
+                return eav_write_header;
+            size = AV_RB64(buf + pos + 8);
+            header_size = 16;
+        } else if (size == 0) {
+            size = end - pos;
+        }
+        if (size < header_size || pos + size > end)
+            return eav_write_header;
+
+        uint8_t *type = buf + pos + 4;
+        if (!memcmp(type, "trak", 4) || !memcmp(type, "mdia", 4) ||
+            !memcmp(type, "minf", 4) || !memcmp(type, "stbl", 4)) {
+            int rc = shift_chunk_offsets(buf, pos + header_size, pos + size, from, shift);
+            if (rc != eav_success)
+                return rc;
+        } else if (!memcmp(type, "stco", 4) || !memcmp(type, "co64", 4)) {
+            int entry_size = type[3] == 'o' ? 4 : 8;
+            uint8_t *p = buf + pos + header_size + 8;
+            int64_t count;
+
+            if (header_size + 8 > size)
+                return eav_write_header;
+            count = AV_RB32(buf + pos + header_size + 4);
+            if (header_size + 8 + count * entry_size > size)
+                return eav_write_header;
+
+            for (int64_t i = 0; i < count; i++, p += entry_size) {
+                uint64_t offset = entry_size == 4 ? AV_RB32(p) : AV_RB64(p);
+                if (offset < from)
+                    continue;
+                offset += shift;
+                if (entry_size == 4 && offset > UINT32_MAX) {
+                    elv_err("Chunk offset too big for stco after moving the moov box, offset=%"PRIu64, offset);
+                    return eav_write_header;
+                }
+                if (entry_size == 4)
+                    AV_WB32(p, offset);
+                else
+                    AV_WB64(p, offset);
+            }
+        }
+        pos += size;
+    }
+
+    return eav_success;
+}
+
+int
+avpipe_mp4_faststart(
+    const uint8_t *buf,
+    int64_t len,
+    uint8_t **out_buf,
+    int64_t *out_len)
+{
+    int64_t pos = 0, moov_pos = -1, moov_size = 0, mdat_pos = -1;
+    int moov_header_size = 0;
+    uint8_t *out;
+    int rc;
+
+    *out_buf = NULL;
+    *out_len = 0;
+
+    /* Find the top level moov box and the first mdat box */
+    while (pos + 8 <= len) {
+        uint64_t size = AV_RB32(buf + pos);
+        int header_size = 8;
+
+        if (size == 1) {
+            if (pos + 16 > len)
+                break;
+            size = AV_RB64(buf + pos + 8);
+            header_size = 16;
+        } else if (size == 0) {
+            size = len - pos;
+        }
+        if (size < header_size || pos + size > len)
+            break;
+        if (!memcmp(buf + pos + 4, "mdat", 4) && mdat_pos < 0)
+            mdat_pos = pos;
+        if (!memcmp(buf + pos + 4, "moov", 4)) {
+            moov_pos = pos;
+            moov_size = size;
+            moov_header_size = header_size;
+            break;
+        }
+        pos += size;
+    }
+
+    if (moov_pos < 0) {
+        elv_err("No moov box to move before the mdat box, len=%"PRId64, len);
+        return eav_write_header;
+    }
+
+    /* The moov box is already first */
+    if (mdat_pos < 0)
+        return eav_success;
+
+    out = (uint8_t *) malloc(len);
+    if (!out)
+        return eav_mem_alloc;
+
+    memcpy(out, buf, mdat_pos);
+    memcpy(out + mdat_pos, buf + moov_pos, moov_size);
+    memcpy(out + mdat_pos + moov_size, buf + mdat_pos, moov_pos - mdat_pos);
+    memcpy(out + moov_pos + moov_size, buf + moov_pos + moov_size, len - moov_pos - moov_size);
+
+    /* The media data after mdat_pos moves by the size of the moov box */
+    rc = shift_chunk_offsets(out, mdat_pos + moov_header_size, mdat_pos + moov_size, mdat_pos, moov_size);
+    if (rc != eav_success) {
+        free(out);
+        return rc;
+    }
+
+    *out_buf = out;
+    *out_len = len;
+    return eav_success;
+}
+
+int
+avpipe_set_key_period(
+    AVFormatContext *format_context,
+    xcparams_t *params,
+    int seg_index)
+{
+    crypt_key_period_t *key_period;
+    char *iv;
+
+    if (params->n_key_periods == 0 || !format_context)
+        return eav_success;
+
+    key_period = get_key_period(params, seg_index);
+    if (!key_period) {
+        elv_err("No key period for segment seg_index=%d, url=%s", seg_index, params->url);
+        return eav_param;
+    }
+
+    iv = (key_period->iv && key_period->iv[0] != '\0') ? key_period->iv : params->crypt_iv;
+    elv_dbg("Set key period seg_index=%d, start_segment=%d, kid=%s, url=%s",
+        seg_index, key_period->start_segment, key_period->kid, params->url);
+    av_opt_set(format_context->priv_data, "encryption_kid", key_period->kid, 0);
+    av_opt_set(format_context->priv_data, "encryption_key", key_period->key, 0);
+    if (iv && iv[0] != '\0')
+        av_opt_set(format_context->priv_data, "encryption_iv", iv, 0);
+
+    return eav_success;
+}
+
+static int
+prepare_encoder(
+    coderctx_t *encoder_context,
+    coderctx_t *decoder_context,
+    avpipe_io_handler_t *out_handlers,
+    ioctx_t *inctx,
+    xcparams_t *params)
+{
+    out_tracker_t *out_tracker;
+    char *filename = "";
+    char *filename2 = "";
+    char *format = params->format;
+    int rc = 0;
+
+    encoder_context->live_proto = decoder_context->live_proto;
+    encoder_context->live_container = decoder_context->live_container;
+    encoder_context->out_handlers = out_handlers;
+    /*
+     * TODO: passing "hls" format needs some development in FF to produce stream index for audio/video.
+     * I will keep hls as before to go to dashenc.c
+     */
+    if (!strcmp(params->format, "hls"))
+        format = "dash";
+    else if (!strcmp(params->format, "mp4")) {
+        filename = "mp4-stream.mp4";
+        if (params->xc_type == xc_all)
+            filename2 = "mp4-astream.mp4";
+    } else if (!strcmp(params->format, "fmp4")) {
+        filename = "fmp4-stream.mp4";
+        /* fmp4 is actually mp4 format with a fragmented flag */
+        format = "mp4";
+        if (params->xc_type == xc_all)
+            filename2 = "fmp4-astream.mp4";
+    } else if (!strcmp(params->format, "cmaf")) {
+        /* cmaf is a single fragmented mp4 file with styp and sidx boxes */
+        filename = "cmaf-stream.mp4";
+        format = "mp4";
+        if (params->xc_type == xc_all)
+            filename2 = "cmaf-astream.mp4";
+    } else if (!strcmp(params->format, "segment")) {
+        filename = "segment-%05d.mp4";
+        if (params->xc_type == xc_all)
+            filename2 = "segment-audio-%05d.mp4";
+    } else if (!strcmp(params->format, "fmp4-segment")) {
+        /* Fragmented mp4 segment */
+        format = "segment";
+        if (params->xc_type & xc_video)
+            filename = "fsegment-video-%05d.mp4";
+        if (params->xc_type & xc_audio)
+            filename2 = "fsegment-audio-%05d.mp4";
+    } else if (!strcmp(params->format, "image2")) {
+        filename = "%d.jpeg";
+    } else if (!strcmp(params->format, "webm")) {
+        /* Single WebM file (matroska muxer), audio goes to its own WebM file like mp4 */
+        filename = "webm-video.webm";
+    }
+
+    if (params->xc_type == xc_subtitle) {
+        /* Subtitles are always emitted as WebVTT segments */
+        format = "segment";
+        filename = "vttsegment-%05d.vtt";
+        avformat_alloc_output_context2(&encoder_context->format_context, NULL, format, filename);
+        if (!encoder_context->format_context) {
+            elv_dbg("could not allocate memory for subtitle output format");
+            return eav_codec_context;
+        }
+
+        if ((rc = prepare_subtitle_encoder(encoder_context, decoder_context, params)) != eav_success) {
+            elv_err("Failure in preparing subtitle encoder, rc=%d, url=%s", rc, params->url);
+            return rc;
+        }
+
+        out_tracker = (out_tracker_t *) calloc(1, sizeof(out_tracker_t));
+        out_tracker->out_handlers = out_handlers;
+        out_tracker->inctx = inctx;
+        out_tracker->video_stream_index = decoder_context->video_stream_index;
+        out_tracker->audio_stream_index = -1;
+        out_tracker->seg_index = atoi(params->start_segment_str);
+        out_tracker->encoder_ctx = encoder_context;
+        out_tracker->xc_type = xc_subtitle;
+        encoder_context->format_context->avpipe_opaque = out_tracker;
+
+        dump_encoder(inctx->url, encoder_context->format_context, params);
+        return 0;
+    }
+
+    /*
+     * Allocate an AVFormatContext for output.
+     * Setting 3th paramter to "dash" determines the output file format and avoids guessing
+     * output file format using filename in ffmpeg library.
+     */
+    if (params->xc_type & xc_video) {
+        avformat_alloc_output_context2(&encoder_context->format_context, NULL, format, filename);
+        if (!encoder_context->format_context) {
+            elv_dbg("could not allocate memory for output format");
+            return eav_codec_context;
+        }
+    }
+    if (params->xc_type & xc_audio) {
+        encoder_context->n_audio_output = num_audio_output(decoder_context, params);
+        for (int i=0; i<encoder_context->n_audio_output; i++) {
+            if (!strcmp(params->format, "hls") || !strcmp(params->format, "dash")) {
+                avformat_alloc_output_context2(&encoder_context->format_context2[i], NULL, format, filename2);
+            } else if (!strcmp(params->format, "webm")) {
+                snprintf(encoder_context->filename2[i], MAX_AVFILENAME_LEN, "webm-audio%d.webm", i);
+                avformat_alloc_output_context2(&encoder_context->format_context2[i], NULL, format, encoder_context->filename2[i]);
+            } else {
+                snprintf(encoder_context->filename2[i], MAX_AVFILENAME_LEN, "fsegment-audio%d-%s.mp4", i, "%05d");
+                avformat_alloc_output_context2(&encoder_context->format_context2[i], NULL, format, encoder_context->filename2[i]);
+            }
+            if (!encoder_context->format_context2[i]) {
+                elv_dbg("could not allocate memory for audio output format stream_index=%d", params->audio_index[i]);
+                return eav_codec_context;
+            }
+        }
+    }
+
+    if (params->xc_type == xc_extract_images || params->xc_type == xc_extract_all_images) {
+        // Tell the image2 muxer to expand the filename with PTS instead of sequential numbering
+        av_opt_set(encoder_context->format_context->priv_data, "frame_pts", "true", 0);
+    }
+
+    // Encryption applies to both audio and video
     // PENDING (RM) Set the keys for audio if xc_type == xc_all
     switch (params->crypt_scheme) {
     case crypt_aes128:
@@ -1586,6 +2946,21 @@ prepare_encoder(
         break;
     }
 
+    /* With key rotation the key of the first segment replaces crypt_key and crypt_kid */
+    if (params->n_key_periods > 0) {
+        int start_segment = atoi(params->start_segment_str);
+        if (params->xc_type & xc_video) {
+            if ((rc = avpipe_set_key_period(encoder_context->format_context, params, start_segment)) != eav_success)
+                return rc;
+        }
+        if (params->xc_type & xc_audio) {
+            for (int i=0; i<encoder_context->n_audio_output; i++) {
+                if ((rc = avpipe_set_key_period(encoder_context->format_context2[i], params, start_segment)) != eav_success)
+                    return rc;
+            }
+        }
+    }
+
     if (params->xc_type & xc_video) {
         if ((rc = prepare_video_encoder(encoder_context, decoder_context, params)) != eav_success) {
             elv_err("Failure in preparing video encoder, rc=%d, url=%s", rc, params->url);
@@ -1658,6 +3033,12 @@ set_idr_frame_key_flag(
     if ((params->xc_type & xc_video) == 0)
         return;
 
+    AVCodecContext *codec_context = encoder_context->codec_context[encoder_context->video_stream_index];
+    int vfr_passthrough = params->vfr_handling && !strcmp(params->vfr_handling, "passthrough");
+    int64_t keyint_duration = 0;
+    if (vfr_passthrough && codec_context->framerate.num > 0 && codec_context->framerate.den > 0)
+        keyint_duration = av_rescale_q(params->force_keyint, av_inv_q(codec_context->framerate), codec_context->time_base);
+
 #if 1
     /*
      * If format is "dash" or "hls" then don't clear the flag, because dash/hls uses pict_type to determine end of segment.
@@ -1680,8 +3061,11 @@ set_idr_frame_key_flag(
         if (frame->pts >= encoder_context->last_key_frame + params->video_seg_duration_ts) {
             int64_t diff = frame->pts - (encoder_context->last_key_frame + params->video_seg_duration_ts);
             int missing_frames = 0;
-            /* We can have some missing_frames only when transcoding a UDP live source */
-            if (is_live_source_udp(encoder_context) && encoder_context->calculated_frame_duration > 0)
+            /*
+             * We can have some missing_frames only when transcoding a UDP live source. The frame duration
+             * of a variable frame rate input is not constant, so they are not counted with vfr passthrough.
+             */
+            if (is_live_source_udp(encoder_context) && encoder_context->calculated_frame_duration > 0 && !vfr_passthrough)
                 missing_frames = diff / encoder_context->calculated_frame_duration;
             if (debug_frame_level) {
                 elv_dbg("FRAME SET KEY flag, seg_duration_ts=%d pts=%"PRId64", missing_frames=%d, last_key_frame_pts=%"PRId64,
@@ -1694,7 +3078,20 @@ set_idr_frame_key_flag(
     }
 
     if (params->force_keyint > 0) {
-        if (encoder_context->forced_keyint_countdown <= 0) {
+        /*
+         * With vfr passthrough the key frames are forced every force_keyint frame durations of the average
+         * frame rate rather than every force_keyint frames, so the GOPs keep the same duration.
+         */
+        if (vfr_passthrough && keyint_duration > 0) {
+            if (frame->pts >= encoder_context->last_key_frame + keyint_duration) {
+                if (debug_frame_level) {
+                    elv_dbg("FRAME SET KEY flag, forced_keyint=%d pts=%"PRId64", keyint_duration=%"PRId64,
+                        params->force_keyint, frame->pts, keyint_duration);
+                }
+                frame->pict_type = AV_PICTURE_TYPE_I;
+                encoder_context->last_key_frame = frame->pts;
+            }
+        } else if (encoder_context->forced_keyint_countdown <= 0) {
             if (debug_frame_level) {
                 elv_dbg("FRAME SET KEY flag, forced_keyint=%d pts=%"PRId64", forced_keyint_countdown=%d",
                     params->force_keyint, frame->pts, encoder_context->forced_keyint_countdown);
@@ -1707,6 +3104,35 @@ set_idr_frame_key_flag(
         }
         encoder_context->forced_keyint_countdown --;
     }
+
+    /*
+     * Force a key frame on the first frame at or after each time of force_keyframes_at. The times are
+     * relative to the first video frame, so they don't depend on the start PTS of the input.
+     */
+    if (params->force_keyframes_at_sz > 0) {
+        AVRational time_base = encoder_context->codec_context[encoder_context->video_stream_index]->time_base;
+        int forced = 0;
+
+        if (encoder_context->forced_keyframes_start_pts == AV_NOPTS_VALUE)
+            encoder_context->forced_keyframes_start_pts = frame->pts;
+
+        while (encoder_context->next_forced_keyframe < params->force_keyframes_at_sz) {
+            double t = params->force_keyframes_at[encoder_context->next_forced_keyframe];
+            int64_t wanted = encoder_context->forced_keyframes_start_pts + llrint(t * time_base.den / time_base.num);
+            if (frame->pts < wanted)
+                break;
+            forced = 1;
+            encoder_context->next_forced_keyframe++;
+        }
+
+        if (forced) {
+            if (debug_frame_level) {
+                elv_dbg("FRAME SET KEY flag, force_keyframes_at pts=%"PRId64", next_forced_keyframe=%d",
+                    frame->pts, encoder_context->next_forced_keyframe);
+            }
+            frame->pict_type = AV_PICTURE_TYPE_I;
+        }
+    }
 }
 
 static int
@@ -1773,6 +3199,37 @@ should_extract_frame(
     return 0;
 }
 
+/*
+ * Returns params->seg_origin_pts in the time base of the encoder of stream_index. The origin is in the time
+ * base of the first video stream of the input (or of the first audio stream if it has none) whatever the
+ * streams transcoded, so the audio and the video jobs of the same input share it.
+ */
+static int64_t
+segment_origin_pts(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    int stream_index,
+    xcparams_t *params)
+{
+    AVFormatContext *format_context = decoder_context->format_context;
+    int origin_index = -1;
+
+    for (int i = 0; i < format_context->nb_streams; i++) {
+        enum AVMediaType codec_type = format_context->streams[i]->codecpar->codec_type;
+        if (codec_type == AVMEDIA_TYPE_VIDEO) {
+            origin_index = i;
+            break;
+        }
+        if (codec_type == AVMEDIA_TYPE_AUDIO && origin_index < 0)
+            origin_index = i;
+    }
+    if (origin_index < 0)
+        return params->seg_origin_pts;
+
+    return av_rescale_q(params->seg_origin_pts, format_context->streams[origin_index]->time_base,
+        encoder_context->codec_context[stream_index]->time_base);
+}
+
 static int
 should_skip_encoding(
     coderctx_t *decoder_context,
@@ -1828,6 +3285,14 @@ should_skip_encoding(
         return 1;
     }
 
+    /* The segments of the jobs aligned with align_segments start at seg_origin_pts */
+    if (p->align_segments && frame->pts != AV_NOPTS_VALUE &&
+        frame->pts < segment_origin_pts(decoder_context, encoder_context, stream_index, p)) {
+        elv_dbg("ENCODE SKIP frame before segment origin pts=%" PRId64 ", seg_origin_pts=%" PRId64 ", stream_index=%d",
+            frame->pts, p->seg_origin_pts, stream_index);
+        return 1;
+    }
+
     /* To allow for packet reordering frames can come with pts past the desired duration */
     if (p->duration_ts > 0) {
         const int64_t max_valid_ts = p->start_time_ts + p->duration_ts;
@@ -1845,6 +3310,69 @@ should_skip_encoding(
     return 0;
 }
 
+/*
+ * Returns the timing of the thread transcoding stream_index, audio and video are transcoded by
+ * separate threads and each one has its own timing.
+ */
+static xc_timing_t *
+get_xc_timing(
+    coderctx_t *decoder_context,
+    coderctx_t *ctx,
+    int stream_index)
+{
+    if (selected_decoded_audio(decoder_context, stream_index) >= 0)
+        return &ctx->audio_timing;
+    return &ctx->video_timing;
+}
+
+/*
+ * Adds the wall clock time since start (returned by av_gettime_relative()) to *ns.
+ */
+static void
+add_elapsed_ns(
+    int64_t *ns,
+    int64_t start)
+{
+    *ns += (av_gettime_relative() - start) * 1000;
+}
+
+/*
+ * Reports the packet written to the output of stream_index with in_stat_frame, if params->frame_stats is set.
+ * The quantizer comes from the quality stats of the encoder (AV_PKT_DATA_QUALITY_STATS), the bypassed packets
+ * don't have any.
+ */
+static void
+report_frame_info(
+    coderctx_t *decoder_context,
+    AVPacket *packet,
+    int stream_index,
+    int is_audio,
+    xcparams_t *params)
+{
+    avpipe_io_handler_t *in_handlers = decoder_context->in_handlers;
+    ioctx_t *inctx = decoder_context->inctx;
+    frame_info_t *info;
+    uint8_t *quality;
+    size_t quality_size = 0;
+
+    if (!params->frame_stats || !inctx || !in_handlers || !in_handlers->avpipe_stater ||
+        stream_index < 0 || stream_index >= MAX_STREAMS)
+        return;
+
+    /* Each stream is written by a single thread, so the frame_info of the stream isn't shared */
+    info = &inctx->frame_info[stream_index];
+    info->is_audio = is_audio;
+    info->pts = packet->pts;
+    info->dts = packet->dts;
+    info->duration = packet->duration;
+    info->size = packet->size;
+    info->key_frame = (packet->flags & AV_PKT_FLAG_KEY) != 0;
+    quality = av_packet_get_side_data(packet, AV_PKT_DATA_QUALITY_STATS, &quality_size);
+    info->quantizer = quality && quality_size >= 4 ? (int) AV_RL32(quality) / FF_QP2LAMBDA : -1;
+
+    in_handlers->avpipe_stater(inctx, stream_index, in_stat_frame);
+}
+
 /*
  * encode_frame() encodes the frame and writes it to the output.
  * If the incoming stream is a mpeg-ts or a rtmp stream, encode_frame() adjusts the
@@ -1869,6 +3397,8 @@ encode_frame(
     out_tracker_t *out_tracker;
     avpipe_io_handler_t *out_handlers;
     ioctx_t *outctx;
+    xc_timing_t *timing = get_xc_timing(decoder_context, encoder_context, stream_index);
+    int64_t start;
 
     if (params->xc_type == xc_audio_merge ||
         params->xc_type == xc_audio_join ||
@@ -1896,8 +3426,21 @@ encode_frame(
 
         const char *st = stream_type_str(decoder_context, stream_index);
 
+        if (params->align_segments) {
+            /*
+             * Rebase all the streams on the same origin instead of the first frame of each stream, so the
+             * segments of the audio and the video (of this job or of separate jobs) start at the same time
+             */
+            int64_t origin = segment_origin_pts(decoder_context, encoder_context, stream_index, params);
+            if (frame->pts != AV_NOPTS_VALUE)
+                frame->pts -= origin;
+            if (frame->pkt_dts != AV_NOPTS_VALUE)
+                frame->pkt_dts -= origin;
+            if (frame->best_effort_timestamp != AV_NOPTS_VALUE)
+                frame->best_effort_timestamp -= origin;
+        }
         // Adjust PTS if input stream starts at an arbitrary value (i.e mostly for MPEG-TS/RTMP)
-        if ( is_live_source(decoder_context) && (!strcmp(params->format, "fmp4-segment"))) {
+        else if (is_live_source(decoder_context) && (!strcmp(params->format, "fmp4-segment"))) {
             if (stream_index == decoder_context->video_stream_index) {
                 if (encoder_context->first_encoding_video_pts == -1) {
                     /* Remember the first video PTS to use as an offset later */
@@ -1938,6 +3481,20 @@ encode_frame(
             }
         }
 
+        /*
+         * Shift the audio to fix a constant offset from the video in the input. The audio encoded before 0 with a
+         * negative delay is dropped (the encoded packets with a negative PTS are skipped).
+         */
+        if (params->audio_delay_ms != 0 && selected_decoded_audio(decoder_context, stream_index) >= 0) {
+            int64_t delay = av_rescale_q(params->audio_delay_ms, (AVRational){1, 1000}, codec_context->time_base);
+            if (frame->pts != AV_NOPTS_VALUE)
+                frame->pts += delay;
+            if (frame->pkt_dts != AV_NOPTS_VALUE)
+                frame->pkt_dts += delay;
+            if (frame->best_effort_timestamp != AV_NOPTS_VALUE)
+                frame->best_effort_timestamp += delay;
+        }
+
         // Signal if we need IDR frames
         if (params->xc_type & xc_video &&
             stream_index == decoder_context->video_stream_index) {
@@ -1960,7 +3517,9 @@ encode_frame(
     }
 
     // Send the frame to the encoder
+    start = av_gettime_relative();
     ret = avcodec_send_frame(codec_context, frame);
+    add_elapsed_ns(&timing->encode_ns, start);
     if (ret < 0) {
         elv_err("Failed to send frame for encoding err=%d, url=%s", ret, params->url);
     }
@@ -1980,7 +3539,9 @@ encode_frame(
 
     while (ret >= 0) {
         // Get the output packet from encoder
+        start = av_gettime_relative();
         ret = avcodec_receive_packet(codec_context, output_packet);
+        add_elapsed_ns(&timing->encode_ns, start);
 
         if (ret == AVERROR(EAGAIN) || ret == AVERROR_EOF) {
             if (debug_frame_level)
@@ -2027,7 +3588,7 @@ encode_frame(
          * always ends up one packet short and then all rate and duration calculcations are slightly skewed.
          * See get_cluster_duration()
          */
-        if (params->xc_type == xc_video)
+        if (params->xc_type == xc_video || params->xc_type == xc_still)
             assert(output_packet->duration == 0); /* Only to notice if this ever gets set */
         if (selected_decoded_audio(decoder_context, stream_index) >= 0 && params->xc_type == xc_all) {
             if (!output_packet->duration && encoder_context->audio_last_dts[stream_index] != AV_NOPTS_VALUE)
@@ -2115,8 +3676,13 @@ encode_frame(
                     output_packet->pts, encoder_context->video_frames_written);
         }
 
+        apply_output_base_pts(output_packet,
+            format_context->streams[output_packet->stream_index]->time_base, params);
+
         dump_packet(selected_decoded_audio(decoder_context, stream_index) >= 0,
             "OUT ", output_packet, debug_frame_level);
+        report_frame_info(decoder_context, output_packet, stream_index,
+            selected_decoded_audio(decoder_context, stream_index) >= 0, params);
 
         if (output_packet->pts == AV_NOPTS_VALUE ||
             output_packet->dts == AV_NOPTS_VALUE ||
@@ -2149,13 +3715,18 @@ encode_frame(
         }
 
         /* mux encoded frame */
+        int64_t pts = output_packet->pts;
+        int64_t duration = output_packet->duration;
+        start = av_gettime_relative();
         ret = av_interleaved_write_frame(format_context, output_packet);
+        add_elapsed_ns(&timing->mux_ns, start);
         if (ret != 0) {
             elv_err("Error %d writing output packet index=%d into stream_index=%d: %s, url=%s",
                 ret, output_packet->stream_index, stream_index, av_err2str(ret), params->url);
             rc = eav_write_frame;
             break;
         }
+        track_segment_packet(format_context, pts, duration);
 
         /* Reset the packet to receive the next frame */
         av_packet_unref(output_packet);
@@ -2167,6 +3738,86 @@ end_encode_frame:
     return rc;
 }
 
+/*
+ * Reports in_stat_decode_progress if params->decode_progress_interval ms passed since the last report.
+ * It is called by the input reading thread for each packet, the cadence bounds the number of reports
+ * on inputs that are read faster than real time.
+ */
+static void
+report_decode_progress(
+    ioctx_t *inctx,
+    avpipe_io_handler_t *in_handlers,
+    AVPacket *packet,
+    xcparams_t *params)
+{
+    int64_t now;
+
+    if (params->decode_progress_interval <= 0 || !in_handlers->avpipe_stater)
+        return;
+
+    if (packet->pts != AV_NOPTS_VALUE)
+        inctx->decode_progress.input_pts = packet->pts;
+
+    now = av_gettime_relative();
+    if (inctx->decode_progress_reported == 0) {
+        inctx->decode_progress_reported = now;
+        return;
+    }
+    if (now - inctx->decode_progress_reported < (int64_t) params->decode_progress_interval * 1000)
+        return;
+
+    inctx->decode_progress_reported = now;
+    inctx->decode_progress.video_frames_dropped = inctx->video_frames_dropped;
+    in_handlers->avpipe_stater(inctx, packet->stream_index, in_stat_decode_progress);
+}
+
+/*
+ * Shifts the packet by params->output_base_pts. Unlike start_pts, which is added in whatever time base
+ * the stream is in at that point (input time base for video, output time base for audio), the base PTS
+ * is in AV_TIME_BASE units and is rescaled to the output stream time base, so independent transcodes
+ * given the same base PTS start at the same point of a common timeline.
+ */
+static void
+apply_output_base_pts(
+    AVPacket *packet,
+    AVRational time_base,
+    xcparams_t *params)
+{
+    int64_t offset;
+
+    if (params->output_base_pts <= 0)
+        return;
+
+    offset = av_rescale_q(params->output_base_pts, AV_TIME_BASE_Q, time_base);
+    if (packet->pts != AV_NOPTS_VALUE)
+        packet->pts += offset;
+    if (packet->dts != AV_NOPTS_VALUE)
+        packet->dts += offset;
+}
+
+/*
+ * Accounts a muxed packet in the current output segment of format_context, for out_stat_segment_done.
+ * It must be called after the packet is muxed, since the muxer may start a new segment with it.
+ */
+static void
+track_segment_packet(
+    AVFormatContext *format_context,
+    int64_t pts,
+    int64_t duration)
+{
+    out_tracker_t *out_tracker = (out_tracker_t *) format_context->avpipe_opaque;
+    ioctx_t *outctx = out_tracker != NULL ? out_tracker->last_outctx : NULL;
+
+    if (!outctx || pts == AV_NOPTS_VALUE)
+        return;
+
+    if (outctx->seg_frames == 0 || pts < outctx->seg_start_pts)
+        outctx->seg_start_pts = pts;
+    if (outctx->seg_frames == 0 || pts + duration > outctx->seg_end_pts)
+        outctx->seg_end_pts = pts + duration;
+    outctx->seg_frames++;
+}
+
 static int
 do_bypass(
     int is_audio,
@@ -2182,8 +3833,10 @@ do_bypass(
 
     packet->pts += p->start_pts;
     packet->dts += p->start_pts;
+    apply_output_base_pts(packet, encoder_context->stream[packet->stream_index]->time_base, p);
 
     dump_packet(is_audio, "BYPASS ", packet, debug_frame_level);
+    report_frame_info(decoder_context, packet, packet->stream_index, is_audio, p);
 
     AVFormatContext *format_context;
 
@@ -2205,11 +3858,16 @@ do_bypass(
             packet->pos, packet->size, packet->stream_index,
             packet->flags, packet->data);
     } else {
-        int rc = av_interleaved_write_frame(format_context, packet);
+        int64_t pts = packet->pts;
+        int64_t duration = packet->duration;
+        int64_t start = av_gettime_relative();
+        int rc = write_bitstream_filtered_packet(format_context, encoder_context->bsf_context[packet->stream_index], packet);
+        add_elapsed_ns(is_audio ? &encoder_context->audio_timing.mux_ns : &encoder_context->video_timing.mux_ns, start);
         if (rc < 0) {
             elv_err("Failure in copying bypass packet xc_type=%d error=%s (%d) url=%s", p->xc_type, av_err2str(rc), rc, p->url);
             return eav_write_frame;
         }
+        track_segment_packet(format_context, pts, duration);
 
         out_tracker_t *out_tracker = (out_tracker_t *) format_context->avpipe_opaque;
         avpipe_io_handler_t *out_handlers = out_tracker->out_handlers;
@@ -2280,7 +3938,8 @@ transcode_audio(
     }
 
     AVCodecContext *enc_codec_context = encoder_context->codec_context[output_stream_index];
-
+    xc_timing_t *timing = &decoder_context->audio_timing;
+    int64_t start;
 
     if (debug_frame_level)
         elv_dbg("DECODE stream_index=%d send_packet pts=%"PRId64" dts=%"PRId64
@@ -2293,7 +3952,9 @@ transcode_audio(
     }
 
     // Send the packet to the decoder
+    start = av_gettime_relative();
     response = avcodec_send_packet(codec_context, packet);
+    add_elapsed_ns(&timing->decode_ns, start);
     if (response < 0) {
         /*
          * AVERROR_INVALIDDATA means the frame is invalid (mostly because of bad header).
@@ -2301,13 +3962,16 @@ transcode_audio(
          */
         elv_err("Failure while sending an audio packet to the decoder: err=%d, %s, url=%s",
             response, av_err2str(response), params->url);
+        decoder_context->inctx->decode_progress.audio_packets_dropped++;
         // Ignore the error and continue
         return eav_success;
     }
 
     while (response >= 0) {
         // Get decoded frame
+        start = av_gettime_relative();
         response = avcodec_receive_frame(codec_context, frame);
+        add_elapsed_ns(&timing->decode_ns, start);
         if (response == AVERROR(EAGAIN) || response == AVERROR_EOF) {
             break;
         } else if (response < 0) {
@@ -2316,6 +3980,8 @@ transcode_audio(
             return eav_receive_frame;
         }
 
+        decoder_context->inctx->decode_progress.audio_frames_decoded++;
+
         if (decoder_context->first_decoding_audio_pts[stream_index] == AV_NOPTS_VALUE) {
             decoder_context->first_decoding_audio_pts[stream_index] = frame->pts;
             avpipe_io_handler_t *in_handlers = decoder_context->in_handlers;
@@ -2340,7 +4006,10 @@ transcode_audio(
         frame_rescale_time_base(frame, codec_context->time_base, enc_codec_context->time_base);
 
         /* push the decoded frame into the filtergraph */
-        if (av_buffersrc_add_frame_flags(decoder_context->audio_buffersrc_ctx[i], frame, AV_BUFFERSRC_FLAG_KEEP_REF) < 0) {
+        start = av_gettime_relative();
+        ret = av_buffersrc_add_frame_flags(decoder_context->audio_buffersrc_ctx[i], frame, AV_BUFFERSRC_FLAG_KEEP_REF);
+        add_elapsed_ns(&timing->filter_ns, start);
+        if (ret < 0) {
             elv_err("Failure in feeding into audio filtergraph source %d, url=%s", i, params->url);
             break;
         }
@@ -2352,7 +4021,9 @@ transcode_audio(
                 params->xc_type == xc_audio_merge ||
                 params->xc_type == xc_audio_pan)
                 i = 0;
+            start = av_gettime_relative();
             ret = av_buffersink_get_frame(decoder_context->audio_buffersink_ctx[i], filt_frame);
+            add_elapsed_ns(&timing->filter_ns, start);
             if (ret == AVERROR(EAGAIN) || ret == AVERROR_EOF) {
                 //elv_dbg("av_buffersink_get_frame() ret=EAGAIN");
                 break;
@@ -2377,1873 +4048,4983 @@ transcode_audio(
     return eav_success;
 }
 
+/*
+ * Live drop policy: if the transcoder falls behind the input by more than params->live_drop_threshold
+ * queued video packets, drop decoded B-frames, and P-frames as well once the backlog is more than twice
+ * the threshold. Frames are dropped after decoding so the reference chain stays intact, and key frames
+ * are never dropped.
+ */
 static int
-transcode_video(
+should_drop_video_frame(
     coderctx_t *decoder_context,
-    coderctx_t *encoder_context,
-    AVPacket *packet,
     AVFrame *frame,
-    AVFrame *filt_frame,
-    int stream_index,
-    xcparams_t *p,
-    int do_instrument,
-    int debug_frame_level)
+    xcparams_t *params)
 {
-    int ret;
-    struct timeval tv;
-    u_int64_t since;
-    AVCodecContext *codec_context = decoder_context->codec_context[stream_index];
-    int response;
+    int threshold = params->live_drop_threshold;
+    int queued = decoder_context->video_queue_size;
 
-    if (debug_frame_level)
-        elv_dbg("DECODE stream_index=%d send_packet pts=%"PRId64" dts=%"PRId64" duration=%d",
-            stream_index, packet->pts, packet->dts, packet->duration);
+    if (threshold <= 0 || queued <= threshold || frame->key_frame)
+        return 0;
 
-    if (p->bypass_transcoding) {
-        /*
-         * The following code does an estimation of next pts and dts, but it is not accurate and
-         * causes player to hang when avpipe bypasses transcoding:
-         *
-         *  AVStream *in_stream = decoder_context->stream[packet->stream_index];
-         *  AVStream *out_stream = encoder_context->stream[packet->stream_index];
-         *  packet->pts = av_rescale_q_rnd(packet->pts, in_stream->time_base, out_stream->time_base, AV_ROUND_NEAR_INF|AV_ROUND_PASS_MINMAX);
-         *  packet->dts = av_rescale_q_rnd(packet->dts, in_stream->time_base, out_stream->time_base, AV_ROUND_NEAR_INF|AV_ROUND_PASS_MINMAX);
-         *  packet->duration = av_rescale_q(packet->duration, in_stream->time_base, out_stream->time_base);
-         *
-         * This function returns frame time stamp (but needs frame):
-         *  - av_frame_get_best_effort_timestamp()
-         *
-         * The following fields are interesting (but not initialized yet properly):
-         *  - in_stream->start_time
-         *  - in_stream->time_base // it always 1
-         *  - codec_context->ticks_per_frame
-         *
-         * The following fields are valid at this point:
-         *  - in_stream->avg_frame_rate.num
-         *  - in_stream->avg_frame_rate.den
-         *  - packet->duration
-         *
-         */
+    if (frame->pict_type == AV_PICTURE_TYPE_B)
+        return 1;
 
-        return do_bypass(0, decoder_context, encoder_context, packet, p, debug_frame_level);
-    }
+    if (frame->pict_type == AV_PICTURE_TYPE_P && queued > 2 * threshold)
+        return 1;
 
-    /* send packet to decoder */
-    response = avcodec_send_packet(codec_context, packet);
-    if (response < 0) {
-        elv_err("Failure while sending a video packet to the decoder: %s (%d), url=%s",
-            av_err2str(response), response, p->url);
-        if (response == AVERROR_INVALIDDATA)
-            /*
-             * AVERROR_INVALIDDATA means the frame is invalid (mostly because of bad header).
-             * To avoid premature termination jump over the bad frame and continue decoding.
-             */
-            return eav_success;
-        return eav_send_packet;
-    }
+    return 0;
+}
 
-    while (response >= 0) {
-        elv_get_time(&tv);
+/*
+ * Encodes a decoded video frame as a JPEG thumbnail and writes it through the output handlers.
+ * The thumbnail is scaled to params->thumbnail_width keeping the aspect ratio of the source, and
+ * the output handler receives the thumbnail timestamp in milliseconds as seg_index.
+ */
+static int
+write_thumbnail(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    AVFrame *frame,
+    xcparams_t *params)
+{
+    AVStream *in_stream = decoder_context->stream[decoder_context->video_stream_index];
+    avpipe_io_handler_t *out_handlers = encoder_context->out_handlers;
+    AVCodecContext *thumb_context = encoder_context->thumbnail_codec_context;
+    AVFrame *thumb_frame = NULL;
+    AVPacket *packet = NULL;
+    ioctx_t *outctx = NULL;
+    char url[64];
+    int rc = eav_success;
+    int ret;
 
-        /* read decoded frame from decoder */
-        response = avcodec_receive_frame(codec_context, frame);
-        if (response == AVERROR(EAGAIN) || response == AVERROR_EOF) {
-            break;
-        } else if (response < 0) {
-            elv_err("Failure while receiving a frame from the decoder: %s, url=%s",
-                av_err2str(response), p->url);
-            return eav_receive_frame;
-        }
+    if (!thumb_context) {
+        int width = params->thumbnail_width > 0 ? params->thumbnail_width : frame->width;
+        /* Keep the aspect ratio, the MJPEG encoder needs even dimensions for yuvj420p */
+        int height = (int) av_rescale(frame->height, width, frame->width) & ~1;
+        const AVCodec *codec = avcodec_find_encoder(AV_CODEC_ID_MJPEG);
 
-        if (decoder_context->first_decoding_video_pts == AV_NOPTS_VALUE) {
-            decoder_context->first_decoding_video_pts = frame->pts;
-            avpipe_io_handler_t *in_handlers = decoder_context->in_handlers;
-            decoder_context->inctx->decoding_start_pts = decoder_context->first_decoding_video_pts;
-            elv_log("first_decoding_video_pts=%"PRId64" pktdts=%"PRId64,
-                decoder_context->first_decoding_video_pts, frame->pkt_dts);
-            if (in_handlers->avpipe_stater)
-                in_handlers->avpipe_stater(decoder_context->inctx, stream_index, in_stat_decoding_video_start_pts);
+        if (!codec) {
+            elv_err("Thumbnail encoder mjpeg not found, url=%s", params->url);
+            return eav_codec_context;
         }
 
-        /* If force_equal_fduration is set then frame_duration > 0 is true */
-        if (decoder_context->frame_duration > 0) {
-            elv_dbg("SET VIDEO PTS frame_num=%d, old_pts=%"PRId64", new_pts=%"PRId64", diff=%"PRId64", dts=%"PRId64,
-                codec_context->frame_number,
-                frame->pts,
-                decoder_context->first_decoding_video_pts + decoder_context->frame_duration * (codec_context->frame_number - 1),
-                decoder_context->first_decoding_video_pts + decoder_context->frame_duration * (codec_context->frame_number - 1) - frame->pts,
-                frame->pkt_dts);
-            /* Set the PTS and DTS of the frame to equalize frame durations */
-            frame->pts = decoder_context->first_decoding_video_pts +
-                decoder_context->frame_duration * (codec_context->frame_number - 1);
-            frame->pkt_dts = frame->pts;
+        thumb_context = avcodec_alloc_context3(codec);
+        if (!thumb_context) {
+            elv_err("Failed to allocate thumbnail encoder context, url=%s", params->url);
+            return eav_mem_alloc;
         }
+        thumb_context->width = width;
+        thumb_context->height = height;
+        thumb_context->pix_fmt = AV_PIX_FMT_YUVJ420P;
+        thumb_context->time_base = in_stream->time_base;
+        encoder_context->thumbnail_codec_context = thumb_context;
 
-        dump_frame(0, stream_index, "IN ", codec_context->frame_number, frame, debug_frame_level);
-
-        ret = check_pts_wrapped(&decoder_context->audio_last_input_pts[stream_index], frame, stream_index);
-        if (ret == eav_pts_wrapped) {
-            av_frame_unref(frame);
-            return ret;
+        if ((ret = avcodec_open2(thumb_context, codec, NULL)) < 0) {
+            elv_err("Failed to open thumbnail encoder: %s, url=%s", av_err2str(ret), params->url);
+            return eav_open_codec;
         }
 
-        if (do_instrument) {
-            elv_since(&tv, &since);
-            elv_log("INSTRMNT avcodec_receive_frame time=%"PRId64, since);
+        encoder_context->thumbnail_sws_context = sws_getContext(frame->width, frame->height, frame->format,
+            width, height, AV_PIX_FMT_YUVJ420P,
+            params->scale_algo && params->scale_algo[0] != '\0' ? get_sws_flags(params->scale_algo) : SWS_BICUBIC,
+            NULL, NULL, NULL);
+        if (!encoder_context->thumbnail_sws_context) {
+            elv_err("Failed to allocate thumbnail scaler, url=%s", params->url);
+            return eav_mem_alloc;
         }
+        elv_log("Thumbnail encoder initialized width=%d, height=%d, interval=%.2f, url=%s",
+            width, height, params->thumbnail_interval_sec, params->url);
+    }
 
-        decoder_context->video_pts = packet->pts;
+    thumb_frame = av_frame_alloc();
+    packet = av_packet_alloc();
+    if (!thumb_frame || !packet) {
+        rc = eav_mem_alloc;
+        goto end_write_thumbnail;
+    }
 
-        /* push the decoded frame into the filtergraph */
-        elv_get_time(&tv);
-        if (av_buffersrc_add_frame_flags(decoder_context->video_buffersrc_ctx, frame, AV_BUFFERSRC_FLAG_KEEP_REF) < 0) {
-            elv_err("Failure in feeding the filtergraph, url=%s", p->url);
-            break;
-        }
+    thumb_frame->format = thumb_context->pix_fmt;
+    thumb_frame->width = thumb_context->width;
+    thumb_frame->height = thumb_context->height;
+    if (av_frame_get_buffer(thumb_frame, 0) < 0) {
+        rc = eav_mem_alloc;
+        goto end_write_thumbnail;
+    }
 
-        if (do_instrument) {
-            elv_since(&tv, &since);
-            elv_log("INSTRMNT av_buffersrc_add_frame_flags time=%"PRId64", url=%s", since, p->url);
-        }
+    sws_scale(encoder_context->thumbnail_sws_context, (const uint8_t * const *) frame->data, frame->linesize,
+        0, frame->height, thumb_frame->data, thumb_frame->linesize);
+    thumb_frame->pts = frame->pts;
 
-        /* pull filtered frames from the filtergraph */
-        while (1) {
-            elv_get_time(&tv);
-            ret = av_buffersink_get_frame(decoder_context->video_buffersink_ctx, filt_frame);
-            if (ret == AVERROR(EAGAIN) || ret == AVERROR_EOF) {
-                //elv_dbg("av_buffersink_get_frame() ret=EAGAIN");
-                break;
-            }
+    if ((ret = avcodec_send_frame(thumb_context, thumb_frame)) < 0) {
+        elv_err("Failed to send frame to thumbnail encoder: %s, url=%s", av_err2str(ret), params->url);
+        rc = eav_send_packet;
+        goto end_write_thumbnail;
+    }
 
-            if (ret < 0) {
-                elv_err("Failed to execute frame filter ret=%d, url=%s", ret, p->url);
-                return eav_receive_filter_frame;
-            }
+    if ((ret = avcodec_receive_packet(thumb_context, packet)) < 0) {
+        elv_err("Failed to receive thumbnail from encoder: %s, url=%s", av_err2str(ret), params->url);
+        rc = eav_receive_packet;
+        goto end_write_thumbnail;
+    }
 
-            if (do_instrument) {
-                elv_since(&tv, &since);
-                elv_log("INSTRMNT av_buffersink_get_frame time=%"PRId64, since);
-            }
+    outctx = (ioctx_t *) calloc(1, sizeof(ioctx_t));
+    outctx->type = avpipe_image_thumbnail;
+    outctx->pts = frame->pts;
+    outctx->seg_index = (int) av_rescale_q(frame->pts - decoder_context->first_decoding_video_pts,
+        in_stream->time_base, (AVRational) {1, 1000});
+    outctx->inctx = decoder_context->inctx;
+    outctx->encoder_ctx = encoder_context;
+    snprintf(url, sizeof(url), "thumbnail-%d.jpeg", outctx->seg_index);
+    outctx->url = strdup(url);
 
-#if 0
-            // TEST ONLY - save gray scale frame
-            save_gray_frame(filt_frame->data[0], filt_frame->linesize[0], filt_frame->width, filt_frame->height,
-            "frame-filt", codec_context->frame_number);
-#endif
+    if (out_handlers->avpipe_opener(url, outctx) < 0) {
+        elv_err("Failed to open thumbnail output, pts=%"PRId64", url=%s", frame->pts, params->url);
+        rc = eav_write_frame;
+        goto end_write_thumbnail;
+    }
 
-            dump_frame(0, stream_index, "FILT ", codec_context->frame_number, filt_frame, debug_frame_level);
-            filt_frame->pkt_dts = filt_frame->pts;
-
-            elv_get_time(&tv);
-            if (decoder_context->video_duration < filt_frame->pts) {
-                decoder_context->video_duration = filt_frame->pts;
-                ret = encode_frame(decoder_context, encoder_context, filt_frame, stream_index, p, debug_frame_level);
-                if (ret == eav_write_frame) {
-                    av_frame_unref(filt_frame);
-                    av_frame_unref(frame);
-                    return ret;
-                }
-            } else {
-                elv_log("ENCODE SKIP video frame pts=%"PRId64", duration=%"PRId64", url=%s",
-                    filt_frame->pts, decoder_context->video_duration, p->url);
-            }
+    if (out_handlers->avpipe_writer(outctx, packet->data, packet->size) < 0) {
+        elv_err("Failed to write thumbnail, pts=%"PRId64", url=%s", frame->pts, params->url);
+        rc = eav_write_frame;
+    }
+    out_handlers->avpipe_closer(outctx);
 
-            if (do_instrument) {
-                elv_since(&tv, &since);
-                elv_log("INSTRMNT encode_frame time=%"PRId64", url=%s", since, p->url);
-            }
+    elv_dbg("THUMBNAIL pts=%"PRId64", timestamp_ms=%d, size=%d, url=%s",
+        frame->pts, outctx->seg_index, packet->size, params->url);
 
-            av_frame_unref(filt_frame);
-        }
-        av_frame_unref(frame);
+end_write_thumbnail:
+    if (outctx) {
+        av_freep(&outctx->buf);
+        free(outctx->url);
+        free(outctx);
     }
-    return eav_success;
+    av_packet_free(&packet);
+    av_frame_free(&thumb_frame);
+    return rc;
 }
 
-void *
-transcode_video_func(
-    void *p)
+/*
+ * Extracts a thumbnail from the first decoded frame and then every params->thumbnail_interval_sec.
+ */
+static int
+extract_thumbnail(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    AVFrame *frame,
+    xcparams_t *params)
 {
-    xctx_t *xctx = (xctx_t *) p;
-    coderctx_t *decoder_context = &xctx->decoder_ctx;
-    coderctx_t *encoder_context = &xctx->encoder_ctx;
-    xcparams_t *params = xctx->params;
-    xc_frame_t *xc_frame;
-    int err = 0;
-
-    if (xctx->associate_thread != NULL) {
-        xctx->associate_thread(xctx->handle);
-    }
+    AVStream *in_stream = decoder_context->stream[decoder_context->video_stream_index];
+    int64_t interval = av_rescale_q((int64_t) (params->thumbnail_interval_sec * 1000),
+        (AVRational) {1, 1000}, in_stream->time_base);
 
-    AVFrame *frame = av_frame_alloc();
-    AVFrame *filt_frame = av_frame_alloc();
+    if (frame->pts == AV_NOPTS_VALUE)
+        return eav_success;
 
-    while (!xctx->stop || elv_channel_size(xctx->vc) > 0) {
+    if (encoder_context->next_thumbnail_pts == AV_NOPTS_VALUE)
+        encoder_context->next_thumbnail_pts = frame->pts;
 
-        xc_frame = elv_channel_receive(xctx->vc);
-        if (!xc_frame) {
-            elv_dbg("transcode_video_func, there is no frame, url=%s", params->url);
-            continue;
-        }
+    if (frame->pts < encoder_context->next_thumbnail_pts)
+        return eav_success;
 
-        AVPacket *packet = xc_frame->packet;
-        if (!packet) {
-            elv_err("transcode_video_func, packet is NULL, url=%s", params->url);
-            free(xc_frame);
-            continue;
-        }
+    while (encoder_context->next_thumbnail_pts <= frame->pts)
+        encoder_context->next_thumbnail_pts += interval;
 
-        // Image extraction optimization is possible here: By skipping the
-        // decoder unless the packet, 1) contains a keyframe, and 2) is not
-        // within the specified interval after the last frame was extracted.
-        // However, this flag might not be set reliably for all input video
-        // formats/codecs).
-        //
-        // else if (!(packet->flags & AV_PKT_FLAG_KEY) ...) {
-        //     continue;
-        // }
-        if (params->xc_type == xc_extract_images || params->xc_type == xc_extract_all_images) {
-            if (is_frame_extraction_done(encoder_context, params)) {
-                elv_dbg("all frames already extracted, url=%s", params->url);
-                av_packet_free(&packet);
-                free(xc_frame);
-                break;
-            }
-        }
+    return write_thumbnail(decoder_context, encoder_context, frame, params);
+}
 
-        dump_packet(0, "IN THREAD", packet, xctx->debug_frame_level);
+/*
+ * Pushes a decoded video frame into the filtergraph and encodes the filtered frames.
+ * Returns a negative value if the frame can't be fed to the filtergraph, otherwise eav_success or
+ * the error of encode_frame().
+ */
+static int
+filter_encode_video(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    AVFrame *frame,
+    AVFrame *filt_frame,
+    int stream_index,
+    xcparams_t *p,
+    int do_instrument,
+    int debug_frame_level)
+{
+    int ret;
+    struct timeval tv;
+    u_int64_t since;
+    AVCodecContext *codec_context = decoder_context->codec_context[stream_index];
+    int64_t start;
 
-        err = transcode_video(
-                decoder_context,
-                encoder_context,
-                packet,
-                frame,
-                filt_frame,
-                packet->stream_index,
-                params,
-                xctx->do_instrument,
-                xctx->debug_frame_level
-            );
+    /* push the decoded frame into the filtergraph */
+    elv_get_time(&tv);
+    start = av_gettime_relative();
+    ret = av_buffersrc_add_frame_flags(decoder_context->video_buffersrc_ctx, frame, AV_BUFFERSRC_FLAG_KEEP_REF);
+    add_elapsed_ns(&decoder_context->video_timing.filter_ns, start);
+    if (ret < 0) {
+        elv_err("Failure in feeding the filtergraph, url=%s", p->url);
+        return -1;
+    }
 
-        av_frame_unref(frame);
-        av_frame_unref(filt_frame);
-        av_packet_unref(packet);
-        av_packet_free(&packet);
-        free(xc_frame);
+    if (do_instrument) {
+        elv_since(&tv, &since);
+        elv_log("INSTRMNT av_buffersrc_add_frame_flags time=%"PRId64", url=%s", since, p->url);
+    }
 
-        if (err != eav_success) {
-            elv_err("Stop video transcoding, err=%d, url=%s", err, params->url);
+    /* pull filtered frames from the filtergraph */
+    while (1) {
+        elv_get_time(&tv);
+        start = av_gettime_relative();
+        ret = av_buffersink_get_frame(decoder_context->video_buffersink_ctx, filt_frame);
+        add_elapsed_ns(&decoder_context->video_timing.filter_ns, start);
+        if (ret == AVERROR(EAGAIN) || ret == AVERROR_EOF) {
+            //elv_dbg("av_buffersink_get_frame() ret=EAGAIN");
             break;
         }
-    }
-
-    av_frame_free(&frame);
-    av_frame_free(&filt_frame);
-    if (!xctx->err)
-        xctx->err = err;
-
-    elv_channel_close(xctx->vc, 0);
-    elv_dbg("transcode_video_func err=%d, stop=%d, url=%s", err, xctx->stop, params->url);
 
-    return NULL;
-}
+        if (ret < 0) {
+            elv_err("Failed to execute frame filter ret=%d, url=%s", ret, p->url);
+            return eav_receive_filter_frame;
+        }
 
-void *
-transcode_audio_func(
-    void *p)
-{
-    xctx_t *xctx = (xctx_t *) p;
-    coderctx_t *decoder_context = &xctx->decoder_ctx;
-    coderctx_t *encoder_context = &xctx->encoder_ctx;
-    xcparams_t *params = xctx->params;
-    xc_frame_t *xc_frame;
-    int err = 0;
+        if (do_instrument) {
+            elv_since(&tv, &since);
+            elv_log("INSTRMNT av_buffersink_get_frame time=%"PRId64, since);
+        }
 
-    if (xctx->associate_thread != NULL) {
-        xctx->associate_thread(xctx->handle);
-    }
+#if 0
+        // TEST ONLY - save gray scale frame
+        save_gray_frame(filt_frame->data[0], filt_frame->linesize[0], filt_frame->width, filt_frame->height,
+        "frame-filt", codec_context->frame_number);
+#endif
 
-    AVFrame *frame = av_frame_alloc();
-    AVFrame *filt_frame = av_frame_alloc();
+        /* Frame rate conversion changes the time base, the rest of the pipeline uses the stream time base */
+        frame_rescale_time_base(filt_frame, av_buffersink_get_time_base(decoder_context->video_buffersink_ctx),
+            decoder_context->stream[stream_index]->time_base);
 
-    while (!xctx->stop || elv_channel_size(xctx->ac) > 0) {
+        dump_frame(0, stream_index, "FILT ", codec_context->frame_number, filt_frame, debug_frame_level);
+        filt_frame->pkt_dts = filt_frame->pts;
 
-        xc_frame = elv_channel_receive(xctx->ac);
-        if (!xc_frame) {
-            elv_dbg("trancode_audio_func, there is no frame, url=%s", params->url);
-            continue;
+        elv_get_time(&tv);
+        if (decoder_context->video_duration < filt_frame->pts) {
+            decoder_context->video_duration = filt_frame->pts;
+            ret = encode_frame(decoder_context, encoder_context, filt_frame, stream_index, p, debug_frame_level);
+            if (ret == eav_write_frame) {
+                av_frame_unref(filt_frame);
+                return ret;
+            }
+        } else {
+            elv_log("ENCODE SKIP video frame pts=%"PRId64", duration=%"PRId64", url=%s",
+                filt_frame->pts, decoder_context->video_duration, p->url);
         }
 
-        AVPacket *packet = xc_frame->packet;
-        if (!packet) {
-            elv_err("transcode_audio_func, packet is NULL, url=%s", params->url);
-            free(xc_frame);
-            continue;
+        if (do_instrument) {
+            elv_since(&tv, &since);
+            elv_log("INSTRMNT encode_frame time=%"PRId64", url=%s", since, p->url);
         }
 
-        dump_packet(1, "IN THREAD", packet, xctx->debug_frame_level);
-
-        err = transcode_audio(
-            decoder_context,
-            encoder_context,
-            packet,
-            frame,
-            filt_frame,
-            packet->stream_index,
-            params,
-            xctx->debug_frame_level);
         av_frame_unref(filt_frame);
-        av_frame_unref(frame);
-        av_packet_free(&packet);
-        free(xc_frame);
-
-        if (err != eav_success) {
-            elv_err("Stop audio transcoding, err=%d, url=%s", err, params->url);
-            break;
-        }
-
     }
 
-    av_frame_free(&frame);
-    av_frame_free(&filt_frame);
-    if (!xctx->err)
-        xctx->err = err;
+    return eav_success;
+}
 
-    elv_channel_close(xctx->ac, 0);
-    elv_dbg("transcode_audio_func err=%d, xctx->err=%d, stop=%d", err, xctx->err, xctx->stop);
+/*
+ * Copies the decoding state of the leader to the decoder context of a rendition, the rendition
+ * doesn't decode but its encoding depends on the timestamps of the decoded input.
+ */
+static void
+sync_rendition_decoder(
+    coderctx_t *rendition,
+    coderctx_t *leader)
+{
+    rendition->video_input_start_pts = leader->video_input_start_pts;
+    rendition->first_decoding_video_pts = leader->first_decoding_video_pts;
+    rendition->first_key_frame_pts = leader->first_key_frame_pts;
+    rendition->video_pts = leader->video_pts;
+    rendition->is_av_synced = leader->is_av_synced;
+    rendition->cancelled = leader->cancelled;
+    rendition->stop_requested = leader->stop_requested;
+}
 
-    return NULL;
+/*
+ * Filters and encodes a decoded video frame for each rendition of a multi-rendition transcoding.
+ * A rendition that fails to feed its filtergraph drops the frame, a write error stops the transcoding.
+ */
+static int
+encode_renditions(
+    xctx_t **renditions,
+    int n_renditions,
+    coderctx_t *decoder_context,
+    AVFrame *frame,
+    AVFrame *filt_frame,
+    int stream_index,
+    int do_instrument,
+    int debug_frame_level)
+{
+    for (int i=0; i<n_renditions; i++) {
+        xctx_t *rendition = renditions[i];
+
+        sync_rendition_decoder(&rendition->decoder_ctx, decoder_context);
+        int ret = filter_encode_video(&rendition->decoder_ctx, &rendition->encoder_ctx,
+            frame, filt_frame, stream_index, rendition->params, do_instrument, debug_frame_level);
+        if (ret == eav_write_frame || ret == eav_receive_filter_frame)
+            return ret;
+    }
+    return eav_success;
 }
 
+/*
+ * Fills the gap before the decoded video frame with black frames if params->fill_gaps is set, so the video
+ * stays aligned with the audio when the input drops the video for a while. The first frame is compared to
+ * the start of the input (the start of its earliest stream) and the next ones to the frame expected after
+ * the previous one. The black frames have the format of frame and go through the filtergraph and the
+ * encoder like the decoded frames.
+ */
 static int
-flush_decoder(
+fill_video_gap(
     coderctx_t *decoder_context,
     coderctx_t *encoder_context,
+    xctx_t **renditions,
+    int n_renditions,
+    AVFrame *frame,
+    AVFrame *filt_frame,
     int stream_index,
     xcparams_t *p,
+    int do_instrument,
     int debug_frame_level)
 {
+    AVStream *stream = decoder_context->stream[stream_index];
+    AVRational frame_rate = stream->avg_frame_rate.num > 0 ? stream->avg_frame_rate : stream->r_frame_rate;
+    int64_t next_pts = decoder_context->gap_next_video_pts;
+    int64_t frame_duration, n_frames;
+    ptrdiff_t linesize[4];
+    AVFrame *black;
+    int rc = eav_success;
     int ret;
-    int i = selected_decoded_audio(decoder_context, stream_index);
-    AVFrame *frame, *filt_frame;
-    AVFilterContext *buffersink_ctx = decoder_context->video_buffersink_ctx;
-    AVFilterContext *buffersrc_ctx = decoder_context->video_buffersrc_ctx;
-    AVCodecContext *codec_context = decoder_context->codec_context[stream_index];
 
-    int response = 0;
+    if (!p->fill_gaps || frame->pts == AV_NOPTS_VALUE || frame_rate.num <= 0 || frame_rate.den <= 0)
+        return eav_success;
+    frame_duration = av_rescale_q(1, av_inv_q(frame_rate), stream->time_base);
+    if (frame_duration <= 0)
+        return eav_success;
 
-    if (codec_context == NULL)
+    /* The input start is only known if the decoding starts with the input (no skipping before start_time_ts) */
+    if (next_pts == AV_NOPTS_VALUE && decoder_context->format_context->start_time != AV_NOPTS_VALUE &&
+        p->chunk_key_frame_ts <= 0 && !p->skip_decoding)
+        next_pts = av_rescale_q(decoder_context->format_context->start_time, AV_TIME_BASE_Q, stream->time_base);
+    decoder_context->gap_next_video_pts = frame->pts + frame_duration;
+
+    if (next_pts == AV_NOPTS_VALUE || frame->pts - next_pts <= gap_threshold(p, stream->time_base))
         return eav_success;
 
-    response = avcodec_send_packet(codec_context, NULL);    /* Passing NULL means flush the decoder buffers */
-    frame = av_frame_alloc();
-    filt_frame = av_frame_alloc();
+    n_frames = (frame->pts - next_pts) / frame_duration;
+    elv_warn("FILL GAP video stream_index=%d, pts=%"PRId64", gap=%"PRId64", black_frames=%"PRId64", url=%s",
+        stream_index, frame->pts, frame->pts - next_pts, n_frames, p->url);
 
-    if (!p->bypass_transcoding && (i >= 0)) {
-        buffersrc_ctx = decoder_context->audio_buffersrc_ctx[i];
-        buffersink_ctx = decoder_context->audio_buffersink_ctx[i];
+    black = av_frame_alloc();
+    if (!black)
+        return eav_mem_alloc;
+    black->format = frame->format;
+    black->width = frame->width;
+    black->height = frame->height;
+    black->sample_aspect_ratio = frame->sample_aspect_ratio;
+    black->color_range = frame->color_range;
+    black->colorspace = frame->colorspace;
+    black->color_primaries = frame->color_primaries;
+    black->color_trc = frame->color_trc;
+    if (av_frame_get_buffer(black, 0) < 0) {
+        /* i.e. hardware frames */
+        elv_warn("Failed to fill video gap, can't allocate a %s frame, url=%s",
+            av_get_pix_fmt_name(frame->format), p->url);
+        av_frame_free(&black);
+        return eav_success;
     }
+    for (int i=0; i<4; i++)
+        linesize[i] = black->linesize[i];
+    av_image_fill_black(black->data, linesize, frame->format, frame->color_range, frame->width, frame->height);
 
-    while (response >=0) {
-        response = avcodec_receive_frame(codec_context, frame);
-        if (response == AVERROR(EAGAIN)) {
-            break;
-        }
+    for (int64_t i=0; i<n_frames; i++) {
+        black->pts = next_pts + i * frame_duration;
+        black->pkt_dts = black->pts;
+        dump_frame(0, stream_index, "GAP ", (int) i, black, debug_frame_level);
 
-        if (response == AVERROR_EOF) {
-            elv_log("GOT EOF url=%s, xc_type=%d, format=%s", p->url, p->xc_type, p->format);
-            continue; // PENDING(SSS) why continue and not break?
+        ret = filter_encode_video(decoder_context, encoder_context, black, filt_frame,
+            stream_index, p, do_instrument, debug_frame_level);
+        if (ret == eav_write_frame || ret == eav_receive_filter_frame) {
+            rc = ret;
+            break;
         }
 
-        dump_frame(i >= 0, stream_index,
-            "IN FLUSH", codec_context->frame_number, frame, debug_frame_level);
+        rc = encode_renditions(renditions, n_renditions, decoder_context, black, filt_frame,
+            stream_index, do_instrument, debug_frame_level);
+        if (rc != eav_success)
+            break;
+    }
 
-        if (codec_context->codec_type == AVMEDIA_TYPE_VIDEO ||
-            codec_context->codec_type == AVMEDIA_TYPE_AUDIO) {
+    av_frame_free(&black);
+    return rc;
+}
 
-            /* Rescale audio before sending to the filter (filter is initialized with the encoder timebase */
-            /* PENDING(SS) video should also be rescaled here */
-            if (i >= 0) {
-                int output_stream_index = audio_output_stream_index(decoder_context, p, i);
-                AVCodecContext *enc_codec_context = encoder_context->codec_context[output_stream_index];
-                frame_rescale_time_base(frame, codec_context->time_base, enc_codec_context->time_base);
-            }
+static int
+transcode_video(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xctx_t **renditions,
+    int n_renditions,
+    AVPacket *packet,
+    AVFrame *frame,
+    AVFrame *filt_frame,
+    int stream_index,
+    xcparams_t *p,
+    int do_instrument,
+    int debug_frame_level)
+{
+    int ret;
+    struct timeval tv;
+    u_int64_t since;
+    AVCodecContext *codec_context = decoder_context->codec_context[stream_index];
+    int response;
+    int64_t start;
 
-            /* push the decoded frame into the filtergraph */
-            if (av_buffersrc_add_frame_flags(buffersrc_ctx, frame, AV_BUFFERSRC_FLAG_KEEP_REF) < 0) {
-                elv_err("Failure in feeding the filtergraph, url=%s", p->url);
-                break;
-            }
-
-            /* pull filtered frames from the filtergraph */
-            while (1) {
-                ret = av_buffersink_get_frame(buffersink_ctx, filt_frame);
-                if (ret == AVERROR(EAGAIN)) {
-                    break;
-                }
+    if (debug_frame_level)
+        elv_dbg("DECODE stream_index=%d send_packet pts=%"PRId64" dts=%"PRId64" duration=%d",
+            stream_index, packet->pts, packet->dts, packet->duration);
 
-                if (ret == AVERROR_EOF) {
-                    elv_log("GOT EOF buffersink url=%s, xc_type=%d, format=%s", p->url, p->xc_type, p->format);
-                    break;
-                }
+    if (p->bypass_transcoding) {
+        /*
+         * The following code does an estimation of next pts and dts, but it is not accurate and
+         * causes player to hang when avpipe bypasses transcoding:
+         *
+         *  AVStream *in_stream = decoder_context->stream[packet->stream_index];
+         *  AVStream *out_stream = encoder_context->stream[packet->stream_index];
+         *  packet->pts = av_rescale_q_rnd(packet->pts, in_stream->time_base, out_stream->time_base, AV_ROUND_NEAR_INF|AV_ROUND_PASS_MINMAX);
+         *  packet->dts = av_rescale_q_rnd(packet->dts, in_stream->time_base, out_stream->time_base, AV_ROUND_NEAR_INF|AV_ROUND_PASS_MINMAX);
+         *  packet->duration = av_rescale_q(packet->duration, in_stream->time_base, out_stream->time_base);
+         *
+         * This function returns frame time stamp (but needs frame):
+         *  - av_frame_get_best_effort_timestamp()
+         *
+         * The following fields are interesting (but not initialized yet properly):
+         *  - in_stream->start_time
+         *  - in_stream->time_base // it always 1
+         *  - codec_context->ticks_per_frame
+         *
+         * The following fields are valid at this point:
+         *  - in_stream->avg_frame_rate.num
+         *  - in_stream->avg_frame_rate.den
+         *  - packet->duration
+         *
+         */
 
-                dump_frame(i >= 0, stream_index,
-                    "FILT ", codec_context->frame_number, filt_frame, debug_frame_level);
+        return do_bypass(0, decoder_context, encoder_context, packet, p, debug_frame_level);
+    }
 
-                ret = encode_frame(decoder_context, encoder_context, filt_frame, stream_index, p, debug_frame_level);
-                av_frame_unref(filt_frame);
-                if (ret == eav_write_frame) {
-                    av_frame_free(&filt_frame);
-                    av_frame_free(&frame);
-                    return ret;
-                }
-            }
+    /* send packet to decoder */
+    start = av_gettime_relative();
+    response = avcodec_send_packet(codec_context, packet);
+    add_elapsed_ns(&decoder_context->video_timing.decode_ns, start);
+    if (response < 0) {
+        elv_err("Failure while sending a video packet to the decoder: %s (%d), url=%s",
+            av_err2str(response), response, p->url);
+        if (response == AVERROR_INVALIDDATA) {
+            /*
+             * AVERROR_INVALIDDATA means the frame is invalid (mostly because of bad header).
+             * To avoid premature termination jump over the bad frame and continue decoding.
+             */
+            decoder_context->inctx->decode_progress.video_packets_dropped++;
+            return eav_success;
         }
-        av_frame_unref(frame);
+        return eav_send_packet;
     }
 
-    av_frame_free(&filt_frame);
-    av_frame_free(&frame);
-    return eav_success;
-}
-
-int
-should_stop_decoding(
-    AVPacket *input_packet,
-    coderctx_t *decoder_context,
-    coderctx_t *encoder_context,
-    xcparams_t *params,
-    int64_t audio_frames_read,
-    int64_t video_frames_read,
-    int *frames_read_past_duration,
-    int frames_allowed_past_duration)
-{
-    int64_t input_packet_rel_pts = 0;
-    int stream_index = input_packet->stream_index;
+    while (response >= 0) {
+        elv_get_time(&tv);
 
-    if (decoder_context->cancelled)
-        return 1;
+        /* read decoded frame from decoder */
+        start = av_gettime_relative();
+        response = avcodec_receive_frame(codec_context, frame);
+        add_elapsed_ns(&decoder_context->video_timing.decode_ns, start);
+        if (response == AVERROR(EAGAIN) || response == AVERROR_EOF) {
+            break;
+        } else if (response < 0) {
+            elv_err("Failure while receiving a frame from the decoder: %s, url=%s",
+                av_err2str(response), p->url);
+            return eav_receive_frame;
+        }
 
-    if (stream_index != decoder_context->video_stream_index &&
-        selected_decoded_audio(decoder_context, stream_index) < 0)
-        return 0;
+        decoder_context->inctx->decode_progress.video_frames_decoded++;
 
-    if (stream_index == decoder_context->video_stream_index &&
-        (params->xc_type & xc_video)) {
-        if (decoder_context->video_input_start_pts == AV_NOPTS_VALUE) {
-            decoder_context->video_input_start_pts = input_packet->pts;
-            elv_log("video_input_start_pts=%"PRId64" flags=%d dts=%"PRId64,
-                decoder_context->video_input_start_pts, input_packet->flags, input_packet->dts);
+        if (decoder_context->first_decoding_video_pts == AV_NOPTS_VALUE) {
+            decoder_context->first_decoding_video_pts = frame->pts;
+            avpipe_io_handler_t *in_handlers = decoder_context->in_handlers;
+            decoder_context->inctx->decoding_start_pts = decoder_context->first_decoding_video_pts;
+            elv_log("first_decoding_video_pts=%"PRId64" pktdts=%"PRId64,
+                decoder_context->first_decoding_video_pts, frame->pkt_dts);
+            if (in_handlers->avpipe_stater)
+                in_handlers->avpipe_stater(decoder_context->inctx, stream_index, in_stat_decoding_video_start_pts);
         }
 
-        input_packet_rel_pts = input_packet->pts - decoder_context->video_input_start_pts;
-    } else if (selected_decoded_audio(decoder_context, stream_index) >= 0 &&
-        params->xc_type & xc_audio) {
-        if (decoder_context->audio_input_start_pts[stream_index] == AV_NOPTS_VALUE) {
-            decoder_context->audio_input_start_pts[stream_index] = input_packet->pts;
-            elv_log("stream_index=%d audio_input_start_pts=%"PRId64,
-                stream_index, decoder_context->audio_input_start_pts[stream_index]);
+        /* If force_equal_fduration is set then frame_duration > 0 is true */
+        if (decoder_context->frame_duration > 0) {
+            elv_dbg("SET VIDEO PTS frame_num=%d, old_pts=%"PRId64", new_pts=%"PRId64", diff=%"PRId64", dts=%"PRId64,
+                codec_context->frame_number,
+                frame->pts,
+                decoder_context->first_decoding_video_pts + decoder_context->frame_duration * (codec_context->frame_number - 1),
+                decoder_context->first_decoding_video_pts + decoder_context->frame_duration * (codec_context->frame_number - 1) - frame->pts,
+                frame->pkt_dts);
+            /* Set the PTS and DTS of the frame to equalize frame durations */
+            frame->pts = decoder_context->first_decoding_video_pts +
+                decoder_context->frame_duration * (codec_context->frame_number - 1);
+            frame->pkt_dts = frame->pts;
         }
 
-        input_packet_rel_pts = input_packet->pts - decoder_context->audio_input_start_pts[stream_index];
-    }
-
-    /* PENDING (RM) for some of the live feeds (like RTMP) we need to scale input_packet_rel_pts */
-    if (params->duration_ts != -1 &&
-        input_packet->pts != AV_NOPTS_VALUE &&
-        input_packet_rel_pts >= params->start_time_ts + params->duration_ts) {
-
-        (*frames_read_past_duration) ++;
-        elv_dbg("DURATION OVER param start_time=%"PRId64" duration=%"PRId64" pkt pts=%"PRId64" rel_pts=%"PRId64" "
-                "audio_frames_read=%"PRId64", video_frames_read=%"PRId64", past_duration=%d",
-                params->start_time_ts, params->duration_ts, input_packet->pts, input_packet_rel_pts,
-                audio_frames_read, video_frames_read, *frames_read_past_duration);
+        dump_frame(0, stream_index, "IN ", codec_context->frame_number, frame, debug_frame_level);
 
-        /* If it is a bypass simply return since there is no decoding/encoding involved */
-        if (params->bypass_transcoding)
-            return 1;
+        ret = check_pts_wrapped(&decoder_context->audio_last_input_pts[stream_index], frame, stream_index);
+        if (ret == eav_pts_wrapped) {
+            av_frame_unref(frame);
+            return ret;
+        }
 
-        /* Allow decoding past specified duration to accommodate reordered packets */
-        if (*frames_read_past_duration > frames_allowed_past_duration) {
-            elv_dbg("frames_read_past_duration=%d, frames_allowed_past_duration=%d",
-                        *frames_read_past_duration, frames_allowed_past_duration);
-            return 1;
+        if (do_instrument) {
+            elv_since(&tv, &since);
+            elv_log("INSTRMNT avcodec_receive_frame time=%"PRId64, since);
         }
-    }
 
-    if (input_packet->pts != AV_NOPTS_VALUE) {
-        if (selected_decoded_audio(decoder_context, stream_index) >= 0 &&
-            params->xc_type & xc_audio)
-            encoder_context->audio_last_pts_read[stream_index] = input_packet->pts;
-        else if (stream_index == decoder_context->video_stream_index &&
-            params->xc_type & xc_video)
-            encoder_context->video_last_pts_read = input_packet->pts;
-    }
-    return 0;
-}
+        if (should_drop_video_frame(decoder_context, frame, p)) {
+            avpipe_io_handler_t *in_handlers = decoder_context->in_handlers;
+            decoder_context->inctx->video_frames_dropped++;
+            if (debug_frame_level)
+                elv_dbg("DROP video frame pts=%"PRId64" pict_type=%c queued=%d, url=%s",
+                    frame->pts, av_get_picture_type_char(frame->pict_type), decoder_context->video_queue_size, p->url);
+            if (in_handlers->avpipe_stater)
+                in_handlers->avpipe_stater(decoder_context->inctx, stream_index, in_stat_video_frames_dropped);
+            av_frame_unref(frame);
+            continue;
+        }
 
-static int
-skip_until_start_time_pts(
-    coderctx_t *decoder_context,
-    AVPacket *input_packet,
-    xcparams_t *params)
-{
-    /* If start_time_ts > 0 and it is a bypass skip here
-     * Also if start_time_ts > 0 and skip_decoding is set then skip here
-     */
-    if (params->start_time_ts <= 0 || (!params->skip_decoding && !params->bypass_transcoding))
-        return 0;
+        if (p->extract_thumbnails) {
+            ret = extract_thumbnail(decoder_context, encoder_context, frame, p);
+            if (ret != eav_success) {
+                av_frame_unref(frame);
+                return ret;
+            }
+        }
 
-    /* If the format is not dash/hls then return.
-     * For dash/hls format, we know the mezzanines are generated by avpipe
-     * and there is no BFrames in mezzanines. Therefore, it is safe to skip
-     * the frame without decoding the frame.
-     */
-    if (strcmp(params->format, "dash") && strcmp(params->format, "hls"))
-        return 0;
+        decoder_context->video_pts = packet->pts;
 
-    int64_t input_start_pts;
-    if (params->xc_type == xc_video)
-        input_start_pts = decoder_context->video_input_start_pts;
-    else
-        input_start_pts = decoder_context->audio_input_start_pts[input_packet->stream_index];
+        ret = fill_video_gap(decoder_context, encoder_context, renditions, n_renditions, frame, filt_frame,
+            stream_index, p, do_instrument, debug_frame_level);
+        if (ret != eav_success) {
+            av_frame_unref(frame);
+            return ret;
+        }
 
-    const int64_t packet_in_pts_offset = input_packet->pts - input_start_pts;
+        ret = filter_encode_video(decoder_context, encoder_context, frame, filt_frame,
+            stream_index, p, do_instrument, debug_frame_level);
+        if (ret == eav_write_frame || ret == eav_receive_filter_frame) {
+            av_frame_unref(frame);
+            return ret;
+        }
 
-    int tolerance = segmentation_tolerance(decoder_context, input_packet->stream_index);
+        int rc = encode_renditions(renditions, n_renditions, decoder_context, frame, filt_frame,
+            stream_index, do_instrument, debug_frame_level);
+        if (rc != eav_success) {
+            av_frame_unref(frame);
+            return rc;
+        }
 
-    /* Drop frames before the desired 'start_time' */
-    if (packet_in_pts_offset + tolerance < params->start_time_ts) {
-        elv_dbg("PREDECODE SKIP frame early stream_index=%d, pts=%" PRId64 ", start_time_ts=%" PRId64
-            ", input_start_pts=%" PRId64 ", packet_in_pts_offset=%" PRId64,
-            input_packet->stream_index,
-            input_packet->pts, params->start_time_ts,
-            input_start_pts, packet_in_pts_offset);
-        return 1;
+        if (ret < 0)
+            break;
+        av_frame_unref(frame);
     }
-
-    return 0;
+    return eav_success;
 }
 
-static int
-skip_for_sync(
-    coderctx_t *decoder_context,
-    AVPacket *input_packet,
-    xcparams_t *params)
+void *
+transcode_video_func(
+    void *p)
 {
-    if (params->sync_audio_to_stream_id < 0)
-        return 0;
+    xctx_t *xctx = (xctx_t *) p;
+    coderctx_t *decoder_context = &xctx->decoder_ctx;
+    coderctx_t *encoder_context = &xctx->encoder_ctx;
+    xcparams_t *params = xctx->params;
+    xc_frame_t *xc_frame;
+    int err = 0;
 
-    /* No need to sync if:
-     * - it is not a live source (mpegts, rtmp, srt, rtp)
-     * - or it is already synced
-     * - or format is not fmp4-segment.
-     */
-    if (!is_live_source(decoder_context) ||
-        decoder_context->is_av_synced ||
-        strcmp(params->format, "fmp4-segment"))
-        return 0;
+    if (xctx->associate_thread != NULL) {
+        xctx->associate_thread(xctx->handle);
+    }
+    /* The log prefix is per thread, the decoding and encoding threads set it again */
+    set_ffmpeg_log_prefix(params->log_prefix);
 
-    /* Check if the packet is video and it is a key frame */
-    if (input_packet->stream_index == decoder_context->video_stream_index) {
-        /* first_key_frame_pts points to first video key frame. */
-        if (decoder_context->first_key_frame_pts == AV_NOPTS_VALUE &&
-            input_packet->flags == AV_PKT_FLAG_KEY) {
-            avpipe_io_handler_t *in_handlers = decoder_context->in_handlers;
-            decoder_context->first_key_frame_pts = input_packet->pts;
-            decoder_context->inctx->first_key_frame_pts = decoder_context->first_key_frame_pts;
-            elv_log("PTS first_key_frame_pts=%"PRId64" sidx=%d flags=%d dts=%"PRId64,
-                decoder_context->first_key_frame_pts, input_packet->stream_index, input_packet->flags, input_packet->dts);
+    AVFrame *frame = av_frame_alloc();
+    AVFrame *filt_frame = av_frame_alloc();
 
-            if (in_handlers->avpipe_stater)
-                in_handlers->avpipe_stater(decoder_context->inctx, input_packet->stream_index, in_stat_first_keyframe_pts);
+    while (!xctx->stop || elv_channel_size(xctx->vc) > 0) {
 
-            dump_packet(0, "SYNC ", input_packet, 1);
-            return 0;
+        xc_frame = elv_channel_receive(xctx->vc);
+        if (!xc_frame) {
+            elv_dbg("transcode_video_func, there is no frame, url=%s", params->url);
+            continue;
         }
-        if (decoder_context->first_key_frame_pts == AV_NOPTS_VALUE) {
-            dump_packet(0, "SYNC SKIP ", input_packet, 1);
-            return 1;
+
+        AVPacket *packet = xc_frame->packet;
+        if (!packet) {
+            elv_err("transcode_video_func, packet is NULL, url=%s", params->url);
+            free(xc_frame);
+            continue;
         }
-        return 0;
-    }
 
-    /* We are processing the audio packets now.
-     * Skip until the audio PTS has reached the first video key frame PTS
-     * PENDING(SSS) - this is incorrect if audio PTS is muxed ahead of video
-     */
-    if (decoder_context->first_key_frame_pts == AV_NOPTS_VALUE ||
-        input_packet->pts < decoder_context->first_key_frame_pts) {
-        elv_log("PTS SYNC SKIP audio_pts=%"PRId64" first_key_frame_pts=%"PRId64,
-            input_packet->pts, decoder_context->first_key_frame_pts);
-        dump_packet(1, "SYNC SKIP ", input_packet, 1);
-        return 1;
-    }
+        // Image extraction optimization is possible here: By skipping the
+        // decoder unless the packet, 1) contains a keyframe, and 2) is not
+        // within the specified interval after the last frame was extracted.
+        // However, this flag might not be set reliably for all input video
+        // formats/codecs).
+        //
+        // else if (!(packet->flags & AV_PKT_FLAG_KEY) ...) {
+        //     continue;
+        // }
+        if (params->xc_type == xc_extract_images || params->xc_type == xc_extract_all_images) {
+            if (is_frame_extraction_done(encoder_context, params)) {
+                elv_dbg("all frames already extracted, url=%s", params->url);
+                av_packet_free(&packet);
+                free(xc_frame);
+                break;
+            }
+        }
 
-    decoder_context->is_av_synced = 1;
-    elv_log("PTS first_audio_frame_pts=%"PRId64, input_packet->pts);
-    return 0;
-}
+        dump_packet(0, "IN THREAD", packet, xctx->debug_frame_level);
 
+        /* Used by the live drop policy to tell how far behind the input the transcoder is */
+        decoder_context->video_queue_size = elv_channel_size(xctx->vc);
 
-/**
- * @brief   formats a base64 encoded data url.
- *
- * @param   filt_buf            buffer to receive the base64 encoded data url, caller has to free the buffer
- * @param   filt_buf_size       size of output buffer
- * @param   img_buf             input buffer containing binary image data
- * @param   img_buf_size        size of input buffer
- * @param   img_type            value from enum image_type
- *
- * @return  Returns length of filt_buf if transcoding is successful, otherwise -1.
- */
-static int
-get_overlay_filter_string(
-    char **filt_buf,
-    char *img_buf,
-    int img_buf_size,
-    int img_type)
-{
-    const char* data_template = "data\\:%s;base64,%s";
-    char* encoded_data = NULL;
-    int encoded_data_length = base64encode_len(img_buf_size);
-    int ret = 0;
-    int n = 0;
-    int filt_buf_size;
+        err = transcode_video(
+                decoder_context,
+                encoder_context,
+                xctx->renditions,
+                xctx->n_renditions,
+                packet,
+                frame,
+                filt_frame,
+                packet->stream_index,
+                params,
+                xctx->do_instrument,
+                xctx->debug_frame_level
+            );
 
-    encoded_data = malloc(encoded_data_length + 1);
-    base64encode(encoded_data, img_buf, img_buf_size);
+        av_frame_unref(frame);
+        av_frame_unref(filt_frame);
+        av_packet_unref(packet);
+        av_packet_free(&packet);
+        free(xc_frame);
 
-    ret = filt_buf_size = encoded_data_length + 128;
-    *filt_buf = (char *) calloc(filt_buf_size, 1);
-    switch(img_type){
-        case png_image:
-        {
-            n = snprintf(*filt_buf, filt_buf_size, data_template, "image/png", encoded_data);
-            if (n < 0 || n >= filt_buf_size){
-                elv_err("snprintf overflow for png, need %u", n);
-                ret = -1;
-            }
-            goto cleanup;
-        }
-        case jpg_image:
-        {
-            n = snprintf(*filt_buf, filt_buf_size, data_template, "image/jpg", encoded_data);
-            if (n < 0 || n >= filt_buf_size){
-                elv_err("snprintf overflow for jpg, need %u", n);
-                ret = -1;
-            }
-            goto cleanup;
-        }
-        case gif_image:
-        {
-            snprintf(*filt_buf, filt_buf_size, data_template, "image/gif", encoded_data);
-            if (n < 0 || n >= filt_buf_size){
-                elv_err("snprintf overflow for gif, need %u", n);
-                ret = -1;
-            }
-            goto cleanup;
+        if (err != eav_success) {
+            elv_err("Stop video transcoding, err=%d, url=%s", err, params->url);
+            break;
         }
-        default:
-            elv_log("get_overlay_filter_string passed invalid type %d", img_type);
-            ret = -1;
-            goto cleanup;
     }
-cleanup:
-    free(encoded_data);
-    return ret;
+
+    av_frame_free(&frame);
+    av_frame_free(&filt_frame);
+    if (!xctx->err)
+        xctx->err = err;
+
+    elv_channel_close(xctx->vc, 0);
+    elv_dbg("transcode_video_func err=%d, stop=%d, url=%s", err, xctx->stop, params->url);
+
+    return NULL;
 }
 
-static int
-get_filter_str(
-    char **filter_str,
-    coderctx_t *encoder_context,
-    xcparams_t *params)
+void *
+transcode_audio_func(
+    void *p)
 {
-    *filter_str = NULL;
-
-    // Validate filter compatibility
-    // Note these filters can theoretically be made to work together but not a real use case
-    if (params->rotate > 0 || params->deinterlace != dif_none) {
-        if ((params->watermark_text && *params->watermark_text != '\0') ||
-            (params->watermark_overlay && params->watermark_overlay[0] != '\0')) {
-            elv_err("Incompatible filter parameters - watermark not supported with rotate and deinterlacing");
-            return eav_param;
-        }
-        if (params->rotate > 0 && params->deinterlace != dif_none) {
-            elv_err("Incompatible filter parameters - both rotate and deinterlacing");
-            return eav_param;
-        }
-        if (params->deinterlace == dif_bwdif) {
-            // This filter needs to create two output frames for each input frame and
-            // requires the caller to specify the new frame duration (1/2 of input frame duration)
-            if (params->video_frame_duration_ts == 0) {
-                elv_err("Incorrect filter spec - deinterlacing requires frame duration");
-                return eav_param;
-            }
-        }
-    }
+    xctx_t *xctx = (xctx_t *) p;
+    coderctx_t *decoder_context = &xctx->decoder_ctx;
+    coderctx_t *encoder_context = &xctx->encoder_ctx;
+    xcparams_t *params = xctx->params;
+    xc_frame_t *xc_frame;
+    int err = 0;
 
-    //  General syntax for the bwdif filter:
-    //  "bwdif=mode=send_frame:parity=auto:deint=all"
-    switch (params->deinterlace) {
-        case dif_bwdif:
-            *filter_str = strdup("bwdif=mode=send_field");
-            return eav_success;
-        case dif_bwdif_frame:
-            *filter_str = strdup("bwdif=mode=send_frame");
-            return eav_success;
-        default:
-            // Nothing to do
-            break;
+    if (xctx->associate_thread != NULL) {
+        xctx->associate_thread(xctx->handle);
     }
+    /* The log prefix is per thread, the decoding and encoding threads set it again */
+    set_ffmpeg_log_prefix(params->log_prefix);
 
-    if (params->rotate > 0) {
-        switch (params->rotate) {
-        case 90:
-            *filter_str = strdup("transpose=1");                // 90 degree rotation
-            return eav_success;
-        case 180:
-            *filter_str = strdup("transpose=1,transpose=1");    // 180 degree rotation
-            return eav_success;
-        case 270:
-            *filter_str = strdup("transpose=2");                // 270 degree rotation
-            return eav_success;
-        default:
-            elv_err("Invalid param rotate=%d", params->rotate);
-            return eav_param;
-        }
-    }
+    AVFrame *frame = av_frame_alloc();
+    AVFrame *filt_frame = av_frame_alloc();
 
-    if ((params->watermark_text && *params->watermark_text != '\0') ||
-            (params->watermark_timecode && *params->watermark_timecode != '\0')) {
-        char local_filter_str[FILTER_STRING_SZ];
-        int shadow_x = 0;
-        int shadow_y = 0;
-        int font_size = 0;
-        const char* filterTemplate =
-            "scale=%d:%d, drawtext=text='%s':fontcolor=%s:fontsize=%d:x=%s:y=%s:shadowx=%d:shadowy=%d:shadowcolor=%s:alpha=0.65";
-        int ret = 0;
+    while (!xctx->stop || elv_channel_size(xctx->ac) > 0) {
 
-        /* Return an error if one of the watermark params is not set properly */
-        if ((!params->watermark_font_color || *params->watermark_font_color == '\0') ||
-            (!params->watermark_xloc || *params->watermark_xloc == '\0') ||
-            (params->watermark_relative_sz > 1 || params->watermark_relative_sz < 0) ||
-            (!params->watermark_yloc || *params->watermark_yloc == '\0') ||
-            (params->watermark_shadow && (!params->watermark_shadow_color || *params->watermark_shadow_color == '\0'))) {
-            elv_err("Watermark params are not set correctly. color=\"%s\", relative_size=\"%f\", xloc=\"%s\", yloc=\"%s\", shadow=%d, shadow_color=\"%s\", url=%s",
-                params->watermark_font_color != NULL ? params->watermark_font_color : "",
-                params->watermark_relative_sz,
-                params->watermark_xloc != NULL ? params->watermark_xloc : "",
-                params->watermark_yloc != NULL ? params->watermark_yloc : "",
-                params->watermark_shadow,
-                params->watermark_shadow_color != NULL ? params->watermark_shadow_color : "", params->url);
-            return eav_filter_string_init;
+        xc_frame = elv_channel_receive(xctx->ac);
+        if (!xc_frame) {
+            elv_dbg("trancode_audio_func, there is no frame, url=%s", params->url);
+            continue;
         }
 
-        font_size = (int) (params->watermark_relative_sz * encoder_context->codec_context[encoder_context->video_stream_index]->height);
-        if (params->watermark_shadow) {
-            /* Calculate shadow x and y */
-            shadow_x = shadow_y = font_size*DRAW_TEXT_SHADOW_OFFSET;
+        AVPacket *packet = xc_frame->packet;
+        if (!packet) {
+            elv_err("transcode_audio_func, packet is NULL, url=%s", params->url);
+            free(xc_frame);
+            continue;
         }
 
-        /* If timecode params are set then apply them, otherwise apply text watermark params */
-        if (params->watermark_timecode && *params->watermark_timecode != '\0') {
-            filterTemplate = "scale=%d:%d, drawtext=timecode='%s':rate=%f:fontcolor=%s:fontsize=%d:x=%s:y=%s:shadowx=%d:shadowy=%d:shadowcolor=%s:alpha=0.65";
-
-            if (params->watermark_timecode_rate <= 0) {
-                elv_err("Watermark timecode params are not set correctly, rate=%f, url=%s", params->watermark_timecode_rate, params->url);
-                return eav_filter_string_init;
-            }
+        dump_packet(1, "IN THREAD", packet, xctx->debug_frame_level);
 
-            ret = snprintf(local_filter_str, FILTER_STRING_SZ, filterTemplate,
-                encoder_context->codec_context[encoder_context->video_stream_index]->width,
-                encoder_context->codec_context[encoder_context->video_stream_index]->height,
-                params->watermark_timecode, params->watermark_timecode_rate, params->watermark_font_color, font_size,
-                params->watermark_xloc, params->watermark_yloc,
-                shadow_x, shadow_y, params->watermark_shadow_color);
-        } else {
-            ret = snprintf(local_filter_str, FILTER_STRING_SZ, filterTemplate,
-                encoder_context->codec_context[encoder_context->video_stream_index]->width,
-                encoder_context->codec_context[encoder_context->video_stream_index]->height,
-                params->watermark_text, params->watermark_font_color, font_size,
-                params->watermark_xloc, params->watermark_yloc,
-                shadow_x, shadow_y, params->watermark_shadow_color);
-        }
+        err = transcode_audio(
+            decoder_context,
+            encoder_context,
+            packet,
+            frame,
+            filt_frame,
+            packet->stream_index,
+            params,
+            xctx->debug_frame_level);
+        av_frame_unref(filt_frame);
+        av_frame_unref(frame);
+        av_packet_free(&packet);
+        free(xc_frame);
 
-        elv_dbg("filterstr=%s, len=%d, x=%s, y=%s, relative-size=%f, ret=%d",
-            local_filter_str, strlen(local_filter_str), params->watermark_xloc,
-            params->watermark_yloc, params->watermark_relative_sz, ret);
-        if (ret < 0) {
-            return eav_filter_string_init;
-        } else if (ret >= FILTER_STRING_SZ) {
-            elv_dbg("Not enough memory for watermark filter");
-            return eav_filter_string_init;
+        if (err != eav_success) {
+            elv_err("Stop audio transcoding, err=%d, url=%s", err, params->url);
+            break;
         }
-        *filter_str = (char *) calloc(strlen(local_filter_str)+1, 1);
-        strcpy(*filter_str, local_filter_str);
-    } else if (params->watermark_overlay && params->watermark_overlay[0] != '\0') {
-        char *filt_buf = NULL;
-        int filt_buf_size;
-        int filt_str_len;
-        const char* filt_template =
-            "[in] scale=%d:%d [in-1]; movie='%s', setpts=PTS [over]; [in-1] setpts=PTS [in-1a]; [in-1a][over]  overlay='%s:%s:alpha=0.1' [out]";
 
-        /* Return an error if one of the watermark params is not set properly */
-        if ((!params->watermark_xloc || *params->watermark_xloc == '\0') ||
-            (params->watermark_overlay_type == unknown_image) ||
-            (!params->watermark_yloc || *params->watermark_yloc == '\0')) {
-            elv_err("Watermark overlay params are not set correctly. overlay_type=\"%d\", xloc=\"%s\", yloc=\"%s\", url=%s",
-                params->watermark_overlay_type,
-                params->watermark_xloc != NULL ? params->watermark_xloc : "",
-                params->watermark_yloc != NULL ? params->watermark_yloc : "", params->url);
-            return eav_filter_string_init;
-        }
+    }
 
-        filt_buf_size = get_overlay_filter_string(&filt_buf,
-            params->watermark_overlay, params->watermark_overlay_len, params->watermark_overlay_type);
-        if (filt_buf_size < 0)
-            return eav_filter_string_init;
+    av_frame_free(&frame);
+    av_frame_free(&filt_frame);
+    if (!xctx->err)
+        xctx->err = err;
 
-        filt_str_len = filt_buf_size+FILTER_STRING_SZ;
-        *filter_str = (char *) calloc(filt_str_len, 1);
-        int ret = snprintf(*filter_str, filt_str_len, filt_template,
-                        encoder_context->codec_context[encoder_context->video_stream_index]->width,
-                        encoder_context->codec_context[encoder_context->video_stream_index]->height,
-                        filt_buf,
-                        params->watermark_xloc, params->watermark_yloc);
-        free(filt_buf);
-        if (ret < 0) {
-            free(*filter_str);
-            return eav_filter_string_init;
-        } else if (ret >= filt_str_len) {
-            free(*filter_str);
-            elv_dbg("Not enough memory for overlay watermark filter");
-            return eav_filter_string_init;
-        }
-    } else {
-        if (!encoder_context->codec_context[encoder_context->video_stream_index]) {
-            elv_err("Failed to make filter string, invalid codec context (check params), url=%s", params->url);
-            return eav_filter_string_init;
-        }
-        *filter_str = (char *) calloc(FILTER_STRING_SZ, 1);
-        sprintf(*filter_str, "scale=%d:%d",
-            encoder_context->codec_context[encoder_context->video_stream_index]->width,
-            encoder_context->codec_context[encoder_context->video_stream_index]->height);
-            elv_dbg("FILTER scale=%s", *filter_str);
-    }
+    elv_channel_close(xctx->ac, 0);
+    elv_dbg("transcode_audio_func err=%d, xctx->err=%d, stop=%d", err, xctx->err, xctx->stop);
 
-    return 0;
+    return NULL;
 }
 
 /*
- * The general flow of transcoding:
- *
- * - read a packet from the input - the packet PTS/DTS is in the timebase of the source
- * - decode the packet into a frame - the frame PTS is in the timebase of the source (some decoders will preserve
- *   the DTS of the original packet in frame->packet_dts, also in the timebase of the source)
- * - rescale it to the desired timebase of the encoder using the decoder codec_context timebase as a source
- *   and the encoder codec_context timebase as a target
- * - send the frame to the filter (if applicable) - the filter will interpret the frame in the
- *   timebase specified in filter args (so filter args timebase must specify the timebase of the encoder)
- *   and will return the filtered frame in the timebase of the encoder
- * - send the frame to the encoder - the encoder will output the frame in its timebase
- * - in special cases where the output package format requires a specific timebase (for example MPEGTS
- *   requires 1/90000) so the frame can be rescaled before sending to the packager using the encoder
- *   codec context timebase as source and the output stream timebase as target
+ * Filters and encodes a frame drained from the decoder at the end of the input. A NULL frame closes the
+ * filtergraph, so the frames it still holds are encoded before the encoder is flushed (i.e. the audio samples
+ * short of a full encoder frame or the frames held by the frame rate conversion).
+ * Returns eav_success, or the error of a rendition or eav_write_frame if writing the output fails.
  */
-int
-avpipe_xc(
-    xctx_t *xctx,
-    int do_instrument)
+static int
+flush_filter_encode(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xctx_t **renditions,
+    int n_renditions,
+    AVFrame *frame,
+    AVFrame *filt_frame,
+    int stream_index,
+    xcparams_t *p,
+    int debug_frame_level)
 {
-    /* Set scale filter */
-    char *filter_str = NULL;
-    coderctx_t *decoder_context = &xctx->decoder_ctx;
-    coderctx_t *encoder_context = &xctx->encoder_ctx;
-    xcparams_t *params = xctx->params;
-    int debug_frame_level = params->debug_frame_level;
-    avpipe_io_handler_t *in_handlers = xctx->in_handlers;
-    avpipe_io_handler_t *out_handlers = xctx->out_handlers;
-    ioctx_t *inctx = xctx->inctx;
-    int rc = 0;
-    int av_read_frame_rc = 0;
-    AVPacket *input_packet = NULL;
-
-    if (!params->url || params->url[0] == '\0' ||
-        in_handlers->avpipe_opener(params->url, inctx) < 0) {
-        elv_err("Failed to open avpipe input \"%s\"", params->url != NULL ? params->url : "");
-        rc = eav_open_input;
-        return rc;
-    }
-
-    if ((rc = prepare_decoder(&xctx->decoder_ctx,
-            in_handlers, inctx, params, params->seekable)) != eav_success) {
-        elv_err("Failure in preparing decoder, url=%s, rc=%d", params->url, rc);
-        return rc;
-    }
+    int ret;
+    int i = selected_decoded_audio(decoder_context, stream_index);
+    AVCodecContext *codec_context = decoder_context->codec_context[stream_index];
+    xc_timing_t *timing = get_xc_timing(decoder_context, decoder_context, stream_index);
+    int64_t start;
 
-    // Set up "copy" (bypass) encoder for MPEGTS
-    if (params->copy_mpegts) {
-        cp_ctx_t *cp_ctx = &xctx->cp_ctx;
+    if (i < 0) {
+        if (!decoder_context->video_buffersrc_ctx)
+            return eav_success;
 
-        rc = copy_mpegts_prepare_encoder(cp_ctx, &xctx->decoder_ctx, out_handlers, inctx, params);
+        ret = filter_encode_video(decoder_context, encoder_context, frame, filt_frame, stream_index, p, 0,
+            debug_frame_level);
+        if (ret == eav_write_frame)
+            return ret;
 
-        if (rc != eav_success) {
-            elv_err("Failure in preparing copy encoder, url=%s, rc=%d", params->url, rc);
-            return rc;
+        /* The decoder is flushed once, the renditions get the same frames */
+        if (n_renditions > 0) {
+            ret = encode_renditions(renditions, n_renditions, decoder_context, frame, filt_frame,
+                stream_index, 0, debug_frame_level);
+            if (ret != eav_success)
+                return ret;
         }
+        return eav_success;
+    }
 
-        elv_channel_init(&cp_ctx->ch, 10000, (free_elem_f) av_packet_free);
+    AVFilterContext *buffersrc_ctx = decoder_context->audio_buffersrc_ctx[i];
+    /* For audio join, merge or pan there is only one buffer sink (0) */
+    AVFilterContext *buffersink_ctx = decoder_context->audio_buffersink_ctx[
+        (p->xc_type == xc_audio_join || p->xc_type == xc_audio_merge || p->xc_type == xc_audio_pan) ? 0 : i];
+    if (!buffersrc_ctx || !buffersink_ctx)
+        return eav_success;
 
-        /* Create threads for the MPEGTS bypass encoder */
-        pthread_create(&cp_ctx->thread_id, NULL, copy_mpegts_func, xctx);
+    if (frame) {
+        /* Rescale audio before sending to the filter (filter is initialized with the encoder timebase) */
+        int output_stream_index = audio_output_stream_index(decoder_context, p, i);
+        AVCodecContext *enc_codec_context = encoder_context->codec_context[output_stream_index];
+        frame_rescale_time_base(frame, codec_context->time_base, enc_codec_context->time_base);
     }
 
-    if ((rc = prepare_encoder(&xctx->encoder_ctx,
-        &xctx->decoder_ctx, out_handlers, inctx, params)) != eav_success) {
-        elv_err("Failure in preparing encoder, url=%s, rc=%d", params->url, rc);
-        return rc;
+    /* push the decoded frame into the filtergraph */
+    start = av_gettime_relative();
+    ret = av_buffersrc_add_frame_flags(buffersrc_ctx, frame, AV_BUFFERSRC_FLAG_KEEP_REF);
+    add_elapsed_ns(&timing->filter_ns, start);
+    if (ret < 0) {
+        elv_err("Failure in feeding the audio filtergraph %d, url=%s", i, p->url);
+        return eav_success;
     }
 
-    elv_channel_init(&xctx->vc, 10000, (free_elem_f) av_packet_free);
-    elv_channel_init(&xctx->ac, 10000, (free_elem_f) av_packet_free);
-
-    /* Create threads for decoder and encoder */
-    pthread_create(&xctx->vthread_id, NULL, transcode_video_func, xctx);
-    pthread_create(&xctx->athread_id, NULL, transcode_audio_func, xctx);
-
-    if (!params->bypass_transcoding &&
-        (params->xc_type & xc_video)) {
-        if ((rc = get_filter_str(&filter_str, encoder_context, params)) != eav_success) {
-            goto xc_done;
+    /* pull filtered frames from the filtergraph */
+    while (1) {
+        start = av_gettime_relative();
+        ret = av_buffersink_get_frame(buffersink_ctx, filt_frame);
+        add_elapsed_ns(&timing->filter_ns, start);
+        if (ret == AVERROR(EAGAIN)) {
+            break;
         }
 
-        if ((rc = init_video_filters(filter_str, decoder_context, encoder_context, xctx->params)) != eav_success) {
-            free(filter_str);
-            elv_err("Failed to initialize video filter, url=%s", params->url);
-            goto xc_done;
+        if (ret == AVERROR_EOF) {
+            elv_log("GOT EOF buffersink url=%s, xc_type=%d, format=%s", p->url, p->xc_type, p->format);
+            break;
         }
-        free(filter_str);
-    }
 
-    if (!params->bypass_transcoding &&
-        (params->xc_type & xc_audio) &&
-        params->xc_type != xc_audio_join &&
-        params->xc_type != xc_audio_pan &&
-        params->xc_type != xc_audio_merge &&
-        (rc = init_audio_filters(decoder_context, encoder_context, xctx->params)) != eav_success) {
-        elv_err("Failed to initialize audio filter, url=%s", params->url);
-        goto xc_done;
-    }
+        if (ret < 0) {
+            elv_err("Failed to execute audio frame filter ret=%d, url=%s", ret, p->url);
+            break;
+        }
 
-    if (!params->bypass_transcoding &&
-        params->xc_type == xc_audio_pan &&
-        (rc = init_audio_pan_filters(xctx->params->filter_descriptor, decoder_context, encoder_context)) != eav_success) {
-        elv_err("Failed to initialize audio pan filter, url=%s", params->url);
-        goto xc_done;
-    }
+        dump_frame(1, stream_index, "FILT ", codec_context->frame_number, filt_frame, debug_frame_level);
 
-    if (!params->bypass_transcoding &&
-        params->xc_type == xc_audio_join &&
-        (rc = init_audio_join_filters(decoder_context, encoder_context, xctx->params)) != eav_success) {
-        elv_err("Failed to initialize audio join filter, url=%s", params->url);
-        goto xc_done;
+        ret = encode_frame(decoder_context, encoder_context, filt_frame, stream_index, p, debug_frame_level);
+        av_frame_unref(filt_frame);
+        if (ret == eav_write_frame)
+            return ret;
     }
 
-    if (!params->bypass_transcoding &&
-        params->xc_type == xc_audio_merge &&
-        (rc = init_audio_merge_pan_filters(xctx->params->filter_descriptor, decoder_context, encoder_context)) != eav_success) {
-        elv_err("Failed to initialize audio merge pan filter, url=%s", params->url);
-        goto xc_done;
-    }
+    return eav_success;
+}
 
-    if ((params->xc_type & xc_video) &&
-        avformat_write_header(encoder_context->format_context, NULL) != eav_success) {
-        elv_err("Failed to write video output file header, url=%s", params->url);
-        rc = eav_write_header;
-        goto xc_done;
-    }
+/*
+ * Drains the decoder of stream_index at the end of the input and encodes the drained frames, then closes the
+ * filtergraph of the stream so the frames it holds are encoded too. The encoders are flushed afterwards with
+ * encode_frame() of a NULL frame.
+ */
+static int
+flush_decoder(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xctx_t **renditions,
+    int n_renditions,
+    int stream_index,
+    xcparams_t *p,
+    int debug_frame_level)
+{
+    int i = selected_decoded_audio(decoder_context, stream_index);
+    AVFrame *frame, *filt_frame;
+    AVCodecContext *codec_context = decoder_context->codec_context[stream_index];
+    xc_timing_t *timing = get_xc_timing(decoder_context, decoder_context, stream_index);
+    int64_t start;
+    int rc = eav_success;
 
-    if (params->xc_type & xc_audio) {
-        for (int i=0; i<encoder_context->n_audio_output; i++) {
-            if (avformat_write_header(encoder_context->format_context2[i], NULL) != eav_success) {
-                elv_err("Failed to write audio output file header, url=%s", params->url);
-                rc = eav_write_header;
-                goto xc_done;
-            }
-        }
-    }
+    int response = 0;
 
-    if (params->copy_mpegts) {
-        cp_ctx_t *cp_ctx = &xctx->cp_ctx;
-        rc = avformat_write_header(cp_ctx->encoder_ctx.format_context, NULL);
-        if (rc != eav_success) {
-            rc = eav_write_header;
-            goto xc_done;
-        }
+    if (codec_context == NULL)
+        return eav_success;
 
-    }
+    start = av_gettime_relative();
+    response = avcodec_send_packet(codec_context, NULL);    /* Passing NULL means flush the decoder buffers */
+    add_elapsed_ns(&timing->decode_ns, start);
+    frame = av_frame_alloc();
+    filt_frame = av_frame_alloc();
 
-    int video_stream_index = decoder_context->video_stream_index;
-    if (params->xc_type & xc_video) {
-        if (encoder_context->format_context->streams[0]->avg_frame_rate.num != 0 &&
-            decoder_context->stream[video_stream_index]->time_base.num != 0) {
-            encoder_context->calculated_frame_duration =
-                /* In very rare cases this might overflow, so type cast to 64bit int to avoid overflow */
-                ((int64_t)decoder_context->stream[video_stream_index]->time_base.den * (int64_t)encoder_context->format_context->streams[0]->avg_frame_rate.den) /
-                    ((int64_t)encoder_context->format_context->streams[0]->avg_frame_rate.num * (int64_t) decoder_context->stream[video_stream_index]->time_base.num);
+    while (response >=0) {
+        start = av_gettime_relative();
+        response = avcodec_receive_frame(codec_context, frame);
+        add_elapsed_ns(&timing->decode_ns, start);
+        if (response == AVERROR(EAGAIN)) {
+            break;
         }
-        elv_log("calculated_frame_duration=%d", encoder_context->calculated_frame_duration);
-    }
-
-    xctx->do_instrument = do_instrument;
-    xctx->debug_frame_level = debug_frame_level;
 
-#if INPUT_IS_SEEKABLE
-    /* Seek to start position */
-    if (params->start_time_ts > 0) {
-        if (av_seek_frame(decoder_context->format_context,
-                decoder_context->video_stream_index, params->start_time_ts, SEEK_SET) < 0) {
-            elv_err("Failed seeking to desired start frame, url=%s", params->url);
-            rc = eav_seek;
-            goto xc_done;
+        if (response == AVERROR_EOF) {
+            elv_log("GOT EOF url=%s, xc_type=%d, format=%s", p->url, p->xc_type, p->format);
+            break;
         }
-    }
-#endif
 
-    if (params->start_time_ts != -1) {
-        if (params->xc_type == xc_video)
-            encoder_context->format_context->start_time = params->start_time_ts;
-        if (params->xc_type & xc_audio) {
-            for (int i=0; i<encoder_context->n_audio_output; i++)
-               encoder_context->format_context2[i]->start_time = params->start_time_ts;
+        if (response < 0) {
+            elv_err("Failure while flushing the decoder: %s, url=%s", av_err2str(response), p->url);
+            break;
         }
-        /* PENDING (RM) add new start_time_ts for audio */
-    }
 
-    decoder_context->video_input_start_pts = AV_NOPTS_VALUE;
-    decoder_context->video_duration = -1;
-    encoder_context->audio_duration = -1;
-    encoder_context->video_encoder_prev_pts = -1;
-    decoder_context->first_decoding_video_pts = AV_NOPTS_VALUE;
-    encoder_context->first_encoding_video_pts = -1;
-    encoder_context->video_pts = AV_NOPTS_VALUE;
+        dump_frame(i >= 0, stream_index,
+            "IN FLUSH", codec_context->frame_number, frame, debug_frame_level);
 
-    for (int j=0; j<MAX_STREAMS; j++) {
-        decoder_context->first_decoding_audio_pts[j] = AV_NOPTS_VALUE;
-        encoder_context->first_encoding_audio_pts[j] = AV_NOPTS_VALUE;
-        decoder_context->audio_input_start_pts[j] = AV_NOPTS_VALUE;
-        encoder_context->audio_pts[j] = AV_NOPTS_VALUE;
-        encoder_context->first_read_packet_pts[j] = AV_NOPTS_VALUE;
-        encoder_context->audio_last_pts_sent_encode[j] = AV_NOPTS_VALUE;
-        encoder_context->audio_last_pts_encoded[j] = AV_NOPTS_VALUE;
+        if (!p->bypass_transcoding &&
+            (codec_context->codec_type == AVMEDIA_TYPE_VIDEO ||
+            codec_context->codec_type == AVMEDIA_TYPE_AUDIO)) {
+            rc = flush_filter_encode(decoder_context, encoder_context, renditions, n_renditions,
+                frame, filt_frame, stream_index, p, debug_frame_level);
+            if (rc != eav_success)
+                goto flush_decoder_end;
+        }
+        av_frame_unref(frame);
     }
-    decoder_context->first_key_frame_pts = AV_NOPTS_VALUE;
-    decoder_context->is_av_synced = 0;
-    encoder_context->video_last_pts_sent_encode = -1;
 
-    int64_t video_last_dts = 0;
-    int frames_read_past_duration = 0;
-    const int frames_allowed_past_duration = 5;
+    /* Close the filtergraph, the frames it holds would be lost otherwise */
+    if (!p->bypass_transcoding &&
+        (codec_context->codec_type == AVMEDIA_TYPE_VIDEO ||
+        codec_context->codec_type == AVMEDIA_TYPE_AUDIO))
+        rc = flush_filter_encode(decoder_context, encoder_context, renditions, n_renditions,
+            NULL, filt_frame, stream_index, p, debug_frame_level);
 
-    /* If there is a transcoding error, break the main loop */
-    while (!xctx->err) {
-        input_packet = av_packet_alloc();
-        if (!input_packet) {
-            elv_err("Failed to allocated memory for AVPacket, url=%s", params->url);
-            return eav_mem_alloc;
-        }
+flush_decoder_end:
+    av_frame_free(&filt_frame);
+    av_frame_free(&frame);
+    return rc;
+}
 
-        rc = av_read_frame(decoder_context->format_context, input_packet);
-        if (rc < 0) {
-            av_packet_free(&input_packet);
-            av_read_frame_rc = rc;
-            if (rc == AVERROR_EOF || rc == -1) {
-                elv_log("av_read_frame() EOF or -1 rc=%d, url=%s", rc, params->url);
-                rc = eav_success;
-            } else {
-                elv_err("av_read_frame() rc=%d, url=%s", rc, params->url);
-                if (rc == AVERROR(ETIMEDOUT))
-                    rc = eav_io_timeout;
-                else
-                    rc = eav_read_input;
-            }
-            break;
-        }
+int
+should_stop_decoding(
+    AVPacket *input_packet,
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int64_t audio_frames_read,
+    int64_t video_frames_read,
+    int *frames_read_past_duration,
+    int frames_allowed_past_duration)
+{
+    int64_t input_packet_rel_pts = 0;
+    int stream_index = input_packet->stream_index;
 
-        if (input_packet->flags & AV_PKT_FLAG_CORRUPT) {
-            elv_warn("packet corrupt pts=%"PRId64, input_packet->pts);
-            av_packet_free(&input_packet);
-            continue;
-        }
+    if (decoder_context->cancelled || decoder_context->stop_requested)
+        return 1;
 
-        const char *st = stream_type_str(encoder_context, input_packet->stream_index);
-        int stream_index = input_packet->stream_index;
+    if (stream_index != decoder_context->video_stream_index &&
+        selected_decoded_audio(decoder_context, stream_index) < 0)
+        return 0;
 
-        // Record PTS of first frame read - excute only for the desired stream
-        if ((stream_index == decoder_context->video_stream_index && (params->xc_type & xc_video)) ||
-            (selected_decoded_audio(decoder_context, stream_index) >= 0 && (params->xc_type & xc_audio))) {
+    if (stream_index == decoder_context->video_stream_index &&
+        (params->xc_type & xc_video)) {
+        if (decoder_context->video_input_start_pts == AV_NOPTS_VALUE) {
+            decoder_context->video_input_start_pts = input_packet->pts;
+            elv_log("video_input_start_pts=%"PRId64" flags=%d dts=%"PRId64,
+                decoder_context->video_input_start_pts, input_packet->flags, input_packet->dts);
+        }
 
-            if (encoder_context->first_read_packet_pts[stream_index] == AV_NOPTS_VALUE && input_packet->pts != AV_NOPTS_VALUE) {
-                encoder_context->first_read_packet_pts[stream_index] = input_packet->pts;
-                elv_log("PTS first_read_packet_pts=%"PRId64" stream=%d:%d:%s sidx=%d, url=%s",
-                    encoder_context->first_read_packet_pts[stream_index], params->xc_type, params->stream_id,
-                    st, stream_index, params->url);
-            } else if (input_packet->pts != AV_NOPTS_VALUE && input_packet->pts < encoder_context->first_read_packet_pts[stream_index]) {
-                /* Due to b-frame reordering */
-                encoder_context->first_read_packet_pts[stream_index] = input_packet->pts;
-                elv_log("PTS first_read_packet reorder new=%"PRId64" stream=%d:%d:%s, url=%s",
-                    encoder_context->first_read_packet_pts, params->xc_type, params->stream_id, st, params->url);
-            }
+        input_packet_rel_pts = input_packet->pts - decoder_context->video_input_start_pts;
+    } else if (selected_decoded_audio(decoder_context, stream_index) >= 0 &&
+        params->xc_type & xc_audio) {
+        if (decoder_context->audio_input_start_pts[stream_index] == AV_NOPTS_VALUE) {
+            decoder_context->audio_input_start_pts[stream_index] = input_packet->pts;
+            elv_log("stream_index=%d audio_input_start_pts=%"PRId64,
+                stream_index, decoder_context->audio_input_start_pts[stream_index]);
         }
 
-        /* This is a very special case, sometimes pts is not set but dts has a value. */
-        if (input_packet->pts == AV_NOPTS_VALUE &&
-            input_packet->dts != AV_NOPTS_VALUE)
-            input_packet->pts = input_packet->dts;
+        input_packet_rel_pts = input_packet->pts - decoder_context->audio_input_start_pts[stream_index];
+    }
 
-        /* Execute for both audio and video streams:
-         * - used for syncing audio to first video key frame
-         */
-        if (input_packet->stream_index == decoder_context->video_stream_index ||
-            selected_decoded_audio(decoder_context, input_packet->stream_index) >= 0) {
-            if (skip_for_sync(decoder_context, input_packet, params)) {
-                av_packet_unref(input_packet);
-                av_packet_free(&input_packet);
-                continue;
-            }
-        }
+    /* PENDING (RM) for some of the live feeds (like RTMP) we need to scale input_packet_rel_pts */
+    if (params->duration_ts != -1 &&
+        input_packet->pts != AV_NOPTS_VALUE &&
+        input_packet_rel_pts >= params->start_time_ts + params->duration_ts) {
 
-        // Excute only for the desired stream
-        if ((input_packet->stream_index == decoder_context->video_stream_index && (params->xc_type & xc_video)) ||
-            (selected_decoded_audio(decoder_context, input_packet->stream_index) >= 0 && (params->xc_type & xc_audio))) {
-            // Stop when we reached the desired duration (duration -1 means 'entire input stream')
-            // PENDING(SSS) - this logic can be done after decoding where we know concretely that we decoded all frames
-            // we need to encode.
-            if (should_stop_decoding(input_packet, decoder_context, encoder_context,
-                    params, inctx->audio_frames_read, inctx->video_frames_read,
-                    &frames_read_past_duration, frames_allowed_past_duration)) {
-                av_packet_free(&input_packet);
-                if (decoder_context->cancelled)
-                    rc = eav_cancelled;
-                break;
-            }
+        (*frames_read_past_duration) ++;
+        elv_dbg("DURATION OVER param start_time=%"PRId64" duration=%"PRId64" pkt pts=%"PRId64" rel_pts=%"PRId64" "
+                "audio_frames_read=%"PRId64", video_frames_read=%"PRId64", past_duration=%d",
+                params->start_time_ts, params->duration_ts, input_packet->pts, input_packet_rel_pts,
+                audio_frames_read, video_frames_read, *frames_read_past_duration);
 
-            /*
-             * Skip the input packet if the packet timestamp is smaller than start_time_ts.
-             * The fact that avpipe mezzanine generated files don't have B-frames let us to skip before decoding.
-             * The assumption here is that the input stream does not have any B-frames, otherwise we can not skip
-             * the input packets without decoding.
-             * Having this logic (here) before decoding increases the performance and saves CPU.
-             * PENDING(RM) - add a validation to check input stream doesn't have any B-frames.
-             */
-            if (input_packet &&
-                params->start_time_ts > 0 &&
-                (params->xc_type == xc_video || params->xc_type == xc_audio) &&
-                skip_until_start_time_pts(decoder_context, input_packet, params)) {
-                    av_packet_unref(input_packet);
-                    av_packet_free(&input_packet);
-                    continue;
-            }
-        }
+        /* If it is a bypass simply return since there is no decoding/encoding involved */
+        if (params->bypass_transcoding)
+            return 1;
 
-        // Copy MPEGTS first
-        if (params->copy_mpegts) {
-            xc_frame_t *xc_frame_cp = (xc_frame_t *) calloc(1, sizeof(xc_frame_t));
-            (void)packet_clone(input_packet, &xc_frame_cp->packet);
-            xc_frame_cp->stream_index = input_packet->stream_index;
-            elv_channel_send(xctx->cp_ctx.ch, xc_frame_cp);
+        /* Allow decoding past specified duration to accommodate reordered packets */
+        if (*frames_read_past_duration > frames_allowed_past_duration) {
+            elv_dbg("frames_read_past_duration=%d, frames_allowed_past_duration=%d",
+                        *frames_read_past_duration, frames_allowed_past_duration);
+            return 1;
         }
+    }
 
-        if (input_packet->stream_index == decoder_context->video_stream_index &&
-            (params->xc_type & xc_video)) {
-            // Video packet
-            dump_packet(0, "IN ", input_packet, debug_frame_level);
+    if (input_packet->pts != AV_NOPTS_VALUE) {
+        if (selected_decoded_audio(decoder_context, stream_index) >= 0 &&
+            params->xc_type & xc_audio)
+            encoder_context->audio_last_pts_read[stream_index] = input_packet->pts;
+        else if (stream_index == decoder_context->video_stream_index &&
+            params->xc_type & xc_video)
+            encoder_context->video_last_pts_read = input_packet->pts;
+    }
+    return 0;
+}
 
-            inctx->video_frames_read++;
-            if (in_handlers->avpipe_stater)
-                in_handlers->avpipe_stater(inctx, input_packet->stream_index, in_stat_video_frame_read);
+static int
+skip_until_start_time_pts(
+    coderctx_t *decoder_context,
+    AVPacket *input_packet,
+    xcparams_t *params)
+{
+    if (params->start_time_ts <= 0)
+        return 0;
 
-            if (decoder_context->first_key_frame_pts == AV_NOPTS_VALUE &&
-                    input_packet->flags == AV_PKT_FLAG_KEY) {
-                decoder_context->first_key_frame_pts = input_packet->pts;
-                decoder_context->inctx->first_key_frame_pts = decoder_context->first_key_frame_pts;
-                elv_log("PTS first_key_frame_pts=%"PRId64" sidx=%d flags=%d dts=%"PRId64,
-                    decoder_context->first_key_frame_pts, input_packet->stream_index, input_packet->flags, input_packet->dts);
-                if (in_handlers->avpipe_stater)
-                    in_handlers->avpipe_stater(decoder_context->inctx, input_packet->stream_index, in_stat_first_keyframe_pts);
-            }
+    /* Chunk mode: skip the packets before the key frame at or before start_time_ts without decoding them.
+     * The packets from the key frame are decoded to prime the decoder and the frames before start_time_ts
+     * are dropped before encoding, so the chunk starts exactly at start_time_ts and stitches with the
+     * chunk before it.
+     */
+    if (params->chunk_key_frame_ts > 0 && !params->bypass_transcoding) {
+        int64_t chunk_start_pts;
+        if (params->xc_type == xc_video || params->xc_type == xc_still)
+            chunk_start_pts = decoder_context->video_input_start_pts;
+        else
+            chunk_start_pts = decoder_context->audio_input_start_pts[input_packet->stream_index];
 
-            // Assert DTS is growing as expected (accommodate non integer and irregular frame duration)
-            if (video_last_dts + input_packet->duration * 1.5 < input_packet->dts &&
-                video_last_dts != 0 && input_packet->duration > 0) {
-                elv_log("Expected dts == last_dts + duration - video_last_dts=%" PRId64 " duration=%" PRId64 " dts=%" PRId64 " url=%s",
-                    video_last_dts, input_packet->duration, input_packet->dts, params->url);
-            }
-            video_last_dts = input_packet->dts;
+        if (input_packet->pts != AV_NOPTS_VALUE &&
+            input_packet->pts - chunk_start_pts < params->chunk_key_frame_ts) {
+            elv_dbg("CHUNK SKIP packet before key frame stream_index=%d, pts=%" PRId64 ", chunk_key_frame_ts=%" PRId64,
+                input_packet->stream_index, input_packet->pts, params->chunk_key_frame_ts);
+            return 1;
+        }
+        return 0;
+    }
 
-            xc_frame_t *xc_frame = (xc_frame_t *) calloc(1, sizeof(xc_frame_t));
-            xc_frame->packet = input_packet;
-            xc_frame->stream_index = input_packet->stream_index;
-            elv_channel_send(xctx->vc, xc_frame);
+    /* If start_time_ts > 0 and it is a bypass skip here
+     * Also if start_time_ts > 0 and skip_decoding is set then skip here
+     */
+    if (!params->skip_decoding && !params->bypass_transcoding)
+        return 0;
 
-        } else if (selected_decoded_audio(decoder_context, input_packet->stream_index) >= 0 &&
-            params->xc_type & xc_audio) {
+    /* If the format is not dash/hls then return.
+     * For dash/hls format, we know the mezzanines are generated by avpipe
+     * and there is no BFrames in mezzanines. Therefore, it is safe to skip
+     * the frame without decoding the frame.
+     */
+    if (strcmp(params->format, "dash") && strcmp(params->format, "hls"))
+        return 0;
 
-            encoder_context->audio_last_dts[input_packet->stream_index] = input_packet->dts;
+    int64_t input_start_pts;
+    if (params->xc_type == xc_video || params->xc_type == xc_still)
+        input_start_pts = decoder_context->video_input_start_pts;
+    else
+        input_start_pts = decoder_context->audio_input_start_pts[input_packet->stream_index];
 
-            dump_packet(1, "IN ", input_packet, debug_frame_level);
+    const int64_t packet_in_pts_offset = input_packet->pts - input_start_pts;
 
-            inctx->audio_frames_read++;
-            if (in_handlers->avpipe_stater)
-                in_handlers->avpipe_stater(inctx, input_packet->stream_index, in_stat_audio_frame_read);
+    int tolerance = segmentation_tolerance(decoder_context, input_packet->stream_index);
 
-            xc_frame_t *xc_frame = (xc_frame_t *) calloc(1, sizeof(xc_frame_t));
-            xc_frame->packet = input_packet;
-            xc_frame->stream_index = input_packet->stream_index;
-            elv_channel_send(xctx->ac, xc_frame);
+    /* Drop frames before the desired 'start_time' */
+    if (packet_in_pts_offset + tolerance < params->start_time_ts) {
+        elv_dbg("PREDECODE SKIP frame early stream_index=%d, pts=%" PRId64 ", start_time_ts=%" PRId64
+            ", input_start_pts=%" PRId64 ", packet_in_pts_offset=%" PRId64,
+            input_packet->stream_index,
+            input_packet->pts, params->start_time_ts,
+            input_start_pts, packet_in_pts_offset);
+        return 1;
+    }
 
-        } else {
-            if (stream_index == decoder_context->data_scte35_stream_index) {
-                uint8_t scte35_command_type;
-                int res = parse_scte35_pkt(&scte35_command_type, input_packet);
-                if (res < 0) {
-                    elv_warn("SCTE [%d] fail to parse pts=%"PRId64" size=%d",
-                        input_packet->stream_index, input_packet->pts, input_packet->size);
-                } else {
-                    char hex_str[2 * input_packet->size + 1];
-                    switch (scte35_command_type) {
-                    case 4:
-                    case 5:
-                    case 6:
-                        hex_encode(input_packet->data, input_packet->size, hex_str);
-                        elv_dbg("SCTE [%d] pts=%"PRId64" duration=%"PRId64" flag=%d size=%d "
-                            "data=%s command=%d",
-                            input_packet->stream_index, input_packet->pts, input_packet->duration,
-                            input_packet->flags, input_packet->size,
-                            hex_str, scte35_command_type);
+    return 0;
+}
 
-                        if (in_handlers->avpipe_stater) {
-                            inctx->data = (uint8_t *)hex_str;
-                            in_handlers->avpipe_stater(inctx, input_packet->stream_index, in_stat_data_scte35);
+static int
+skip_for_sync(
+    coderctx_t *decoder_context,
+    AVPacket *input_packet,
+    xcparams_t *params)
+{
+    if (params->sync_audio_to_stream_id < 0)
+        return 0;
+
+    /* No need to sync if:
+     * - it is not a live source (mpegts, rtmp, srt, rtp)
+     * - or it is already synced
+     * - or format is not fmp4-segment.
+     */
+    if (!is_live_source(decoder_context) ||
+        decoder_context->is_av_synced ||
+        strcmp(params->format, "fmp4-segment"))
+        return 0;
+
+    /* Check if the packet is video and it is a key frame */
+    if (input_packet->stream_index == decoder_context->video_stream_index) {
+        /* first_key_frame_pts points to first video key frame. */
+        if (decoder_context->first_key_frame_pts == AV_NOPTS_VALUE &&
+            input_packet->flags == AV_PKT_FLAG_KEY) {
+            avpipe_io_handler_t *in_handlers = decoder_context->in_handlers;
+            decoder_context->first_key_frame_pts = input_packet->pts;
+            decoder_context->inctx->first_key_frame_pts = decoder_context->first_key_frame_pts;
+            elv_log("PTS first_key_frame_pts=%"PRId64" sidx=%d flags=%d dts=%"PRId64,
+                decoder_context->first_key_frame_pts, input_packet->stream_index, input_packet->flags, input_packet->dts);
+
+            if (in_handlers->avpipe_stater)
+                in_handlers->avpipe_stater(decoder_context->inctx, input_packet->stream_index, in_stat_first_keyframe_pts);
+
+            dump_packet(0, "SYNC ", input_packet, 1);
+            return 0;
+        }
+        if (decoder_context->first_key_frame_pts == AV_NOPTS_VALUE) {
+            dump_packet(0, "SYNC SKIP ", input_packet, 1);
+            return 1;
+        }
+        return 0;
+    }
+
+    /* We are processing the audio packets now.
+     * Skip until the audio PTS has reached the first video key frame PTS
+     * PENDING(SSS) - this is incorrect if audio PTS is muxed ahead of video
+     */
+    if (decoder_context->first_key_frame_pts == AV_NOPTS_VALUE ||
+        input_packet->pts < decoder_context->first_key_frame_pts) {
+        elv_log("PTS SYNC SKIP audio_pts=%"PRId64" first_key_frame_pts=%"PRId64,
+            input_packet->pts, decoder_context->first_key_frame_pts);
+        dump_packet(1, "SYNC SKIP ", input_packet, 1);
+        return 1;
+    }
+
+    decoder_context->is_av_synced = 1;
+    elv_log("PTS first_audio_frame_pts=%"PRId64, input_packet->pts);
+    return 0;
+}
+
+
+/**
+ * @brief   formats a base64 encoded data url.
+ *
+ * @param   filt_buf            buffer to receive the base64 encoded data url, caller has to free the buffer
+ * @param   filt_buf_size       size of output buffer
+ * @param   img_buf             input buffer containing binary image data
+ * @param   img_buf_size        size of input buffer
+ * @param   img_type            value from enum image_type
+ *
+ * @return  Returns length of filt_buf if transcoding is successful, otherwise -1.
+ */
+static int
+get_overlay_filter_string(
+    char **filt_buf,
+    char *img_buf,
+    int img_buf_size,
+    int img_type)
+{
+    const char* data_template = "data\\:%s;base64,%s";
+    char* encoded_data = NULL;
+    int encoded_data_length = base64encode_len(img_buf_size);
+    int ret = 0;
+    int n = 0;
+    int filt_buf_size;
+
+    encoded_data = malloc(encoded_data_length + 1);
+    base64encode(encoded_data, img_buf, img_buf_size);
+
+    ret = filt_buf_size = encoded_data_length + 128;
+    *filt_buf = (char *) calloc(filt_buf_size, 1);
+    switch(img_type){
+        case png_image:
+        {
+            n = snprintf(*filt_buf, filt_buf_size, data_template, "image/png", encoded_data);
+            if (n < 0 || n >= filt_buf_size){
+                elv_err("snprintf overflow for png, need %u", n);
+                ret = -1;
+            }
+            goto cleanup;
+        }
+        case jpg_image:
+        {
+            n = snprintf(*filt_buf, filt_buf_size, data_template, "image/jpg", encoded_data);
+            if (n < 0 || n >= filt_buf_size){
+                elv_err("snprintf overflow for jpg, need %u", n);
+                ret = -1;
+            }
+            goto cleanup;
+        }
+        case gif_image:
+        {
+            snprintf(*filt_buf, filt_buf_size, data_template, "image/gif", encoded_data);
+            if (n < 0 || n >= filt_buf_size){
+                elv_err("snprintf overflow for gif, need %u", n);
+                ret = -1;
+            }
+            goto cleanup;
+        }
+        default:
+            elv_log("get_overlay_filter_string passed invalid type %d", img_type);
+            ret = -1;
+            goto cleanup;
+    }
+cleanup:
+    free(encoded_data);
+    return ret;
+}
+
+/*
+ * Returns the dimensions the video is scaled to, which is the encoder size without the padding.
+ */
+static void
+get_scale_dims(
+    coderctx_t *encoder_context,
+    xcparams_t *params,
+    int *width,
+    int *height)
+{
+    AVCodecContext *codec_context = encoder_context->codec_context[encoder_context->video_stream_index];
+
+    *width = codec_context->width - params->pad_left - params->pad_right;
+    *height = codec_context->height - params->pad_top - params->pad_bottom;
+}
+
+/*
+ * Makes the scale filter with the scaler algorithm and output color options. If none of
+ * params->scale_algo, params->color_range and params->color_space is set, the filter is only
+ * "scale=width:height" so the libavfilter defaults are used.
+ */
+static void
+get_scale_filter_str(
+    char *scale_filter,
+    int scale_filter_sz,
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    int scale_width, scale_height;
+    int n;
+
+    get_scale_dims(encoder_context, params, &scale_width, &scale_height);
+    n = snprintf(scale_filter, scale_filter_sz, "scale=%d:%d", scale_width, scale_height);
+
+    if (params->scale_algo && params->scale_algo[0] != '\0')
+        n += snprintf(scale_filter + n, scale_filter_sz - n, ":flags=%s", params->scale_algo);
+    if (params->color_range && params->color_range[0] != '\0')
+        n += snprintf(scale_filter + n, scale_filter_sz - n, ":out_range=%s", params->color_range);
+    if (params->color_space && params->color_space[0] != '\0')
+        snprintf(scale_filter + n, scale_filter_sz - n, ":out_color_matrix=%s",
+            color_spaces[get_color_space_index(params->color_space)].matrix);
+}
+
+static int
+has_scale_options(
+    xcparams_t *params)
+{
+    return (params->scale_algo && params->scale_algo[0] != '\0') ||
+        (params->color_range && params->color_range[0] != '\0') ||
+        (params->color_space && params->color_space[0] != '\0');
+}
+
+/*
+ * Makes the subtitles filter string for burning params->burn_subtitle into the video.
+ * Like the overlay watermark, the subtitle file is passed inline as a base64 data URI.
+ *
+ * @return  Returns eav_success if the filter string is made successfully, otherwise eav_filter_string_init.
+ */
+static int
+get_burn_subtitle_filter_str(
+    char **filter_str,
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    const char* filt_template =
+        "%s, subtitles=filename='data\\:text/plain;base64,%s':si=%d:force_style='%s'";
+    char scale_filter[FILTER_STRING_SZ];
+    char force_style[1024];
+    char *encoded_data = NULL;
+    int filt_str_len;
+    int font_size;
+    int ret;
+
+    get_scale_filter_str(scale_filter, sizeof(scale_filter), encoder_context, params);
+
+    /* libass scales font sizes to the script height, which is 288 for converted SRT/WebVTT subtitles */
+    font_size = (int) (params->burn_subtitle_relative_sz * 288);
+    ret = snprintf(force_style, sizeof(force_style), "FontSize=%d,Alignment=%d,MarginV=%d%s%s",
+        font_size, params->burn_subtitle_alignment, params->burn_subtitle_margin_v,
+        params->burn_subtitle_font && *params->burn_subtitle_font != '\0' ? ",FontName=" : "",
+        params->burn_subtitle_font ? params->burn_subtitle_font : "");
+    if (ret < 0 || ret >= sizeof(force_style)) {
+        elv_err("Burn subtitle style is too long, url=%s", params->url);
+        return eav_filter_string_init;
+    }
+
+    encoded_data = malloc(base64encode_len(params->burn_subtitle_len) + 1);
+    base64encode(encoded_data, params->burn_subtitle, params->burn_subtitle_len);
+
+    filt_str_len = strlen(encoded_data) + FILTER_STRING_SZ;
+    *filter_str = (char *) calloc(filt_str_len, 1);
+    ret = snprintf(*filter_str, filt_str_len, filt_template,
+        scale_filter,
+        encoded_data, params->burn_subtitle_stream_index, force_style);
+    free(encoded_data);
+    if (ret < 0 || ret >= filt_str_len) {
+        free(*filter_str);
+        *filter_str = NULL;
+        elv_err("Failed to make burn subtitle filter, ret=%d, url=%s", ret, params->url);
+        return eav_filter_string_init;
+    }
+
+    elv_dbg("burn subtitle filter len=%d, force_style=%s, url=%s", ret, force_style, params->url);
+    return eav_success;
+}
+
+/*
+ * Parses a .cube LUT and sets *is_1d if the file is a 1D LUT. The header must have either LUT_1D_SIZE
+ * or LUT_3D_SIZE and the number of data lines (3 floats each) must match the size.
+ *
+ * @return  Returns eav_success if the LUT is well formed, otherwise eav_param.
+ */
+static int
+parse_cube_lut(
+    const char *lut_file,
+    int *is_1d,
+    xcparams_t *params)
+{
+    FILE *fp;
+    char line[512];
+    int size = 0;
+    int64_t expected = 0;
+    int64_t entries = 0;
+    int line_num = 0;
+    int rc = eav_success;
+
+    if ((fp = fopen(lut_file, "r")) == NULL) {
+        elv_err("Failed to open LUT file %s: %s, url=%s", lut_file, strerror(errno), params->url);
+        return eav_param;
+    }
+
+    *is_1d = 0;
+    while (fgets(line, sizeof(line), fp)) {
+        char *p = line;
+        float r, g, b;
+
+        line_num++;
+        while (isspace((unsigned char) *p))
+            p++;
+        if (*p == '\0' || *p == '#')
+            continue;
+
+        if (!strncmp(p, "LUT_1D_SIZE", 11) || !strncmp(p, "LUT_3D_SIZE", 11)) {
+            if (size > 0 || sscanf(p + 11, "%d", &size) != 1 || size < 2) {
+                elv_err("Invalid LUT size at line %d of LUT file %s, url=%s", line_num, lut_file, params->url);
+                rc = eav_param;
+                break;
+            }
+            *is_1d = p[4] == '1';
+            if (*is_1d && size > 65536) {
+                elv_err("LUT_1D_SIZE=%d is too big in LUT file %s, url=%s", size, lut_file, params->url);
+                rc = eav_param;
+                break;
+            } else if (!*is_1d && size > 256) {
+                elv_err("LUT_3D_SIZE=%d is too big in LUT file %s, url=%s", size, lut_file, params->url);
+                rc = eav_param;
+                break;
+            }
+            expected = *is_1d ? size : (int64_t) size * size * size;
+            continue;
+        }
+
+        if (isalpha((unsigned char) *p)) {
+            /* Other keywords (TITLE, DOMAIN_MIN, DOMAIN_MAX, LUT_xD_INPUT_RANGE) */
+            continue;
+        }
+
+        if (sscanf(p, "%f %f %f", &r, &g, &b) != 3) {
+            elv_err("Invalid data at line %d of LUT file %s, url=%s", line_num, lut_file, params->url);
+            rc = eav_param;
+            break;
+        }
+        entries++;
+    }
+    fclose(fp);
+
+    if (rc != eav_success)
+        return rc;
+
+    if (size == 0) {
+        elv_err("LUT file %s has no LUT_1D_SIZE or LUT_3D_SIZE, url=%s", lut_file, params->url);
+        return eav_param;
+    }
+
+    if (entries != expected) {
+        elv_err("LUT file %s has %"PRId64" entries, expected %"PRId64", url=%s", lut_file, entries, expected, params->url);
+        return eav_param;
+    }
+
+    return eav_success;
+}
+
+/*
+ * Makes the color grading filter for params->lut_file. Cube files are parsed up front so a bad LUT is
+ * reported clearly, and 1D cube LUTs use the lut1d filter. Other formats supported by lut3d (3dl, dat,
+ * m3d, csp) are passed to lut3d as is.
+ *
+ * @return  Returns eav_success if the filter string is made successfully, otherwise eav_param.
+ */
+static int
+get_lut_filter_str(
+    char *lut_filter,
+    int lut_filter_sz,
+    xcparams_t *params)
+{
+    const char *ext = strrchr(params->lut_file, '.');
+    int is_1d = 0;
+    int ret;
+
+    if (!ext || (strcasecmp(ext, ".cube") && strcasecmp(ext, ".3dl") && strcasecmp(ext, ".dat") &&
+        strcasecmp(ext, ".m3d") && strcasecmp(ext, ".csp"))) {
+        elv_err("Unsupported LUT file format %s (must be cube, 3dl, dat, m3d or csp), url=%s",
+            params->lut_file, params->url);
+        return eav_param;
+    }
+
+    if (strchr(params->lut_file, '\'')) {
+        elv_err("Invalid LUT file name %s, url=%s", params->lut_file, params->url);
+        return eav_param;
+    }
+
+    if (!strcasecmp(ext, ".cube")) {
+        if (parse_cube_lut(params->lut_file, &is_1d, params) != eav_success)
+            return eav_param;
+    } else if (access(params->lut_file, R_OK) != 0) {
+        elv_err("Failed to access LUT file %s: %s, url=%s", params->lut_file, strerror(errno), params->url);
+        return eav_param;
+    }
+
+    ret = snprintf(lut_filter, lut_filter_sz, "%s=file='%s'", is_1d ? "lut1d" : "lut3d", params->lut_file);
+    if (ret < 0 || ret >= lut_filter_sz) {
+        elv_err("LUT file name is too long %s, url=%s", params->lut_file, params->url);
+        return eav_param;
+    }
+
+    return eav_success;
+}
+
+/*
+ * Makes the filters that tone map an HDR (PQ or HLG) source to SDR BT.709. The frames are linearized
+ * and converted to BT.709 primaries in float RGB, tone mapped with params->tone_map, and converted back
+ * to BT.709 YUV in the encoder pixel format.
+ *
+ * @return  Returns eav_success if the filter string is made successfully, otherwise eav_filter_string_init.
+ */
+static int
+get_tone_map_filter_str(
+    char *tone_map_filter,
+    int tone_map_filter_sz,
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    AVCodecContext *codec_context = encoder_context->codec_context[encoder_context->video_stream_index];
+    int ret;
+
+    if (!avfilter_get_by_name("zscale") || !avfilter_get_by_name("tonemap")) {
+        elv_err("Tone mapping needs the zscale and tonemap filters (FFmpeg built with libzimg), url=%s", params->url);
+        return eav_filter_string_init;
+    }
+
+    ret = snprintf(tone_map_filter, tone_map_filter_sz,
+        "zscale=t=linear:npl=100,format=gbrpf32le,zscale=p=bt709,tonemap=tonemap=%s:desat=0:peak=%g,"
+        "zscale=t=bt709:m=bt709:r=tv,format=%s",
+        params->tone_map, params->tone_map_peak, av_get_pix_fmt_name(codec_context->pix_fmt));
+    if (ret < 0 || ret >= tone_map_filter_sz) {
+        elv_err("Failed to make tone map filter, ret=%d, url=%s", ret, params->url);
+        return eav_filter_string_init;
+    }
+
+    return eav_success;
+}
+
+/*
+ * Makes the video filter string. Tone mapping comes first so the other filters work on SDR frames.
+ * If params->lut_file is set the LUT is applied next so color grading happens on the source frames,
+ * then the crop (before scaling) and the pad (after scaling, watermark and burned subtitles).
+ * The params->video_filter graph comes right before scaling, so the frames it outputs are scaled
+ * to the encoder size whatever their size. The frame rate conversion comes last, so frames are dropped or duplicated only after all the
+ * other filters.
+ */
+static int
+get_filter_str(
+    char **filter_str,
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    char tone_map_filter[FILTER_STRING_SZ];
+    char lut_filter[FILTER_STRING_SZ];
+    char crop_filter[FILTER_STRING_SZ];
+    char pad_filter[FILTER_STRING_SZ];
+    char fps_filter[FILTER_STRING_SZ];
+    char *base_filter_str = NULL;
+    int has_tone_map = params->tone_map && params->tone_map[0] != '\0';
+    int has_lut = params->lut_file && params->lut_file[0] != '\0';
+    int has_crop = params->crop_w > 0 && params->crop_h > 0;
+    int has_pad = params->pad_left > 0 || params->pad_right > 0 || params->pad_top > 0 || params->pad_bottom > 0;
+    int has_fps = params->enc_frame_rate && params->enc_frame_rate[0] != '\0';
+    int has_video_filter = params->video_filter && params->video_filter[0] != '\0';
+    int filt_str_len;
+    int rc;
+
+    *filter_str = NULL;
+    tone_map_filter[0] = '\0';
+    lut_filter[0] = '\0';
+    crop_filter[0] = '\0';
+    pad_filter[0] = '\0';
+    fps_filter[0] = '\0';
+
+    if (!has_tone_map && !has_lut && !has_crop && !has_pad && !has_fps && !has_video_filter)
+        return get_video_filter_str(filter_str, encoder_context, params);
+
+    if (params->watermark_overlay && params->watermark_overlay[0] != '\0') {
+        elv_err("Incompatible filter parameters - overlay watermark not supported with tone mapping, LUT, crop, pad, frame rate or video filter, url=%s",
+            params->url);
+        return eav_param;
+    }
+
+    if (has_tone_map) {
+        if ((rc = get_tone_map_filter_str(tone_map_filter, sizeof(tone_map_filter) - 1, encoder_context, params)) != eav_success)
+            return rc;
+        strcat(tone_map_filter, ",");
+    }
+
+    if ((has_crop || has_pad) && params->rotate > 0) {
+        elv_err("Incompatible filter parameters - crop and pad not supported with rotate, url=%s", params->url);
+        return eav_param;
+    }
+
+    if (has_lut) {
+        if ((rc = get_lut_filter_str(lut_filter, sizeof(lut_filter) - 1, params)) != eav_success)
+            return rc;
+        strcat(lut_filter, ",");
+    }
+
+    if (has_crop)
+        snprintf(crop_filter, sizeof(crop_filter), "crop=%d:%d:%d:%d,",
+            params->crop_w, params->crop_h, params->crop_x, params->crop_y);
+
+    if (has_pad) {
+        AVCodecContext *codec_context = encoder_context->codec_context[encoder_context->video_stream_index];
+        if (!codec_context) {
+            elv_err("Failed to make filter string, invalid codec context (check params), url=%s", params->url);
+            return eav_filter_string_init;
+        }
+        snprintf(pad_filter, sizeof(pad_filter), ",pad=%d:%d:%d:%d:%s",
+            codec_context->width, codec_context->height, params->pad_left, params->pad_top,
+            params->pad_color && params->pad_color[0] != '\0' ? params->pad_color : "black");
+    }
+
+    /* The fps filter outputs frames in 1/frame_rate time base, they are rescaled back after filtering */
+    if (has_fps)
+        snprintf(fps_filter, sizeof(fps_filter), ",fps=%s", params->enc_frame_rate);
+
+    if ((rc = get_video_filter_str(&base_filter_str, encoder_context, params)) != eav_success)
+        return rc;
+
+    filt_str_len = strlen(tone_map_filter) + strlen(lut_filter) + strlen(crop_filter) +
+        (has_video_filter ? strlen(params->video_filter) + 1 : 0) + strlen(base_filter_str) +
+        strlen(pad_filter) + strlen(fps_filter) + 1;
+    *filter_str = (char *) calloc(filt_str_len, 1);
+    snprintf(*filter_str, filt_str_len, "%s%s%s%s%s%s%s%s",
+        tone_map_filter, lut_filter, crop_filter,
+        has_video_filter ? params->video_filter : "", has_video_filter ? "," : "",
+        base_filter_str, pad_filter, fps_filter);
+    free(base_filter_str);
+
+    elv_dbg("FILTER with tone map/LUT/crop/video filter/pad/fps=%s, url=%s", *filter_str, params->url);
+    return eav_success;
+}
+
+/*
+ * Makes the drawtext filter of the text watermark, or of the timecode watermark if watermark_timecode is set.
+ */
+static int
+get_drawtext_filter_str(
+    char *filter_str,
+    int filter_str_sz,
+    int scale_height,
+    xcparams_t *params)
+{
+    int shadow_x = 0;
+    int shadow_y = 0;
+    int font_size = 0;
+    const char* filterTemplate =
+        "drawtext=text='%s':fontcolor=%s:fontsize=%d:x=%s:y=%s:shadowx=%d:shadowy=%d:shadowcolor=%s:alpha=0.65";
+    int ret = 0;
+
+    /* Return an error if one of the watermark params is not set properly */
+    if ((!params->watermark_font_color || *params->watermark_font_color == '\0') ||
+        (!params->watermark_xloc || *params->watermark_xloc == '\0') ||
+        (params->watermark_relative_sz > 1 || params->watermark_relative_sz < 0) ||
+        (!params->watermark_yloc || *params->watermark_yloc == '\0') ||
+        (params->watermark_shadow && (!params->watermark_shadow_color || *params->watermark_shadow_color == '\0'))) {
+        elv_err("Watermark params are not set correctly. color=\"%s\", relative_size=\"%f\", xloc=\"%s\", yloc=\"%s\", shadow=%d, shadow_color=\"%s\", url=%s",
+            params->watermark_font_color != NULL ? params->watermark_font_color : "",
+            params->watermark_relative_sz,
+            params->watermark_xloc != NULL ? params->watermark_xloc : "",
+            params->watermark_yloc != NULL ? params->watermark_yloc : "",
+            params->watermark_shadow,
+            params->watermark_shadow_color != NULL ? params->watermark_shadow_color : "", params->url);
+        return eav_filter_string_init;
+    }
+
+    font_size = (int) (params->watermark_relative_sz * scale_height);
+    if (params->watermark_shadow) {
+        /* Calculate shadow x and y */
+        shadow_x = shadow_y = font_size*DRAW_TEXT_SHADOW_OFFSET;
+    }
+
+    /* If timecode params are set then apply them, otherwise apply text watermark params */
+    if (params->watermark_timecode && *params->watermark_timecode != '\0') {
+        filterTemplate = "drawtext=timecode='%s':rate=%f:fontcolor=%s:fontsize=%d:x=%s:y=%s:shadowx=%d:shadowy=%d:shadowcolor=%s:alpha=0.65";
+
+        if (params->watermark_timecode_rate <= 0) {
+            elv_err("Watermark timecode params are not set correctly, rate=%f, url=%s", params->watermark_timecode_rate, params->url);
+            return eav_filter_string_init;
+        }
+
+        ret = snprintf(filter_str, filter_str_sz, filterTemplate,
+            params->watermark_timecode, params->watermark_timecode_rate, params->watermark_font_color, font_size,
+            params->watermark_xloc, params->watermark_yloc,
+            shadow_x, shadow_y, params->watermark_shadow_color);
+    } else {
+        ret = snprintf(filter_str, filter_str_sz, filterTemplate,
+            params->watermark_text, params->watermark_font_color, font_size,
+            params->watermark_xloc, params->watermark_yloc,
+            shadow_x, shadow_y, params->watermark_shadow_color);
+    }
+
+    elv_dbg("filterstr=%s, len=%d, x=%s, y=%s, relative-size=%f, ret=%d",
+        filter_str, strlen(filter_str), params->watermark_xloc,
+        params->watermark_yloc, params->watermark_relative_sz, ret);
+    if (ret < 0) {
+        return eav_filter_string_init;
+    } else if (ret >= filter_str_sz) {
+        elv_dbg("Not enough memory for watermark filter");
+        return eav_filter_string_init;
+    }
+    return eav_success;
+}
+
+static int
+get_video_filter_str(
+    char **filter_str,
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    int burn_subtitle = params->burn_subtitle && params->burn_subtitle_len > 0;
+    int has_text = (params->watermark_text && *params->watermark_text != '\0') ||
+        (params->watermark_timecode && *params->watermark_timecode != '\0');
+    int has_overlay = params->watermark_overlay && params->watermark_overlay[0] != '\0';
+    char scale_filter[FILTER_STRING_SZ];
+    char drawtext_filter[FILTER_STRING_SZ];
+    const char *transform_filter = NULL;
+    int scale_width, scale_height;
+    int rc;
+
+    *filter_str = NULL;
+    drawtext_filter[0] = '\0';
+
+    if (!encoder_context->codec_context[encoder_context->video_stream_index]) {
+        elv_err("Failed to make filter string, invalid codec context (check params), url=%s", params->url);
+        return eav_filter_string_init;
+    }
+    get_scale_dims(encoder_context, params, &scale_width, &scale_height);
+    get_scale_filter_str(scale_filter, sizeof(scale_filter), encoder_context, params);
+
+    // Validate filter compatibility
+    // Note these filters can theoretically be made to work together but not a real use case
+    if (burn_subtitle &&
+        ((params->watermark_text && *params->watermark_text != '\0') ||
+         (params->watermark_timecode && *params->watermark_timecode != '\0') ||
+         (params->watermark_overlay && params->watermark_overlay[0] != '\0'))) {
+        elv_err("Incompatible filter parameters - watermark not supported with burning subtitles");
+        return eav_param;
+    }
+
+    if (params->rotate > 0 || params->deinterlace != dif_none) {
+        if ((params->watermark_text && *params->watermark_text != '\0') ||
+            (params->watermark_overlay && params->watermark_overlay[0] != '\0')) {
+            elv_err("Incompatible filter parameters - watermark not supported with rotate and deinterlacing");
+            return eav_param;
+        }
+        if (burn_subtitle) {
+            elv_err("Incompatible filter parameters - burning subtitles not supported with rotate and deinterlacing");
+            return eav_param;
+        }
+        if (params->rotate > 0 && params->deinterlace != dif_none) {
+            elv_err("Incompatible filter parameters - both rotate and deinterlacing");
+            return eav_param;
+        }
+        if (params->deinterlace == dif_bwdif || params->deinterlace == dif_yadif) {
+            // This filter needs to create two output frames for each input frame and
+            // requires the caller to specify the new frame duration (1/2 of input frame duration)
+            if (params->video_frame_duration_ts == 0) {
+                elv_err("Incorrect filter spec - deinterlacing requires frame duration");
+                return eav_param;
+            }
+        }
+    }
+
+    //  General syntax for the bwdif filter:
+    //  "bwdif=mode=send_frame:parity=auto:deint=all"
+    switch (params->deinterlace) {
+        case dif_bwdif:
+            transform_filter = "bwdif=mode=send_field";
+            break;
+        case dif_bwdif_frame:
+            transform_filter = "bwdif=mode=send_frame";
+            break;
+        case dif_yadif:
+            transform_filter = "yadif=mode=send_field";
+            break;
+        case dif_yadif_frame:
+            transform_filter = "yadif=mode=send_frame";
+            break;
+        default:
+            // Nothing to do
+            break;
+    }
+
+    if (params->rotate > 0) {
+        switch (params->rotate) {
+        case 90:
+            transform_filter = "transpose=1";                   // 90 degree rotation
+            break;
+        case 180:
+            transform_filter = "transpose=1,transpose=1";       // 180 degree rotation
+            break;
+        case 270:
+            transform_filter = "transpose=2";                   // 270 degree rotation
+            break;
+        default:
+            elv_err("Invalid param rotate=%d", params->rotate);
+            return eav_param;
+        }
+    }
+
+    /*
+     * Deinterlacing and rotation leave the scaling to the scaler that libavfilter inserts automatically,
+     * the scale filter is only added to apply the scaler options.
+     */
+    if (transform_filter) {
+        *filter_str = (char *) calloc(FILTER_STRING_SZ, 1);
+        if (has_scale_options(params))
+            snprintf(*filter_str, FILTER_STRING_SZ, "%s,%s", transform_filter, scale_filter);
+        else
+            snprintf(*filter_str, FILTER_STRING_SZ, "%s", transform_filter);
+        return eav_success;
+    }
+
+    /* The text (or timecode) watermark is drawn after the image watermark if both are set */
+    if (has_text && (rc = get_drawtext_filter_str(drawtext_filter, sizeof(drawtext_filter), scale_height, params)) != eav_success)
+        return rc;
+
+    if (burn_subtitle) {
+        return get_burn_subtitle_filter_str(filter_str, encoder_context, params);
+    } else if (has_overlay) {
+        char *filt_buf = NULL;
+        char image_filter[128];
+        int filt_buf_size;
+        int filt_str_len;
+        const char *xloc = params->watermark_image_xloc && *params->watermark_image_xloc != '\0' ?
+            params->watermark_image_xloc : params->watermark_xloc;
+        const char *yloc = params->watermark_image_yloc && *params->watermark_image_yloc != '\0' ?
+            params->watermark_image_yloc : params->watermark_yloc;
+        const char* filt_template =
+            "[in] %s [in-1]; movie='%s', setpts=PTS%s [over]; [in-1] setpts=PTS [in-1a]; [in-1a][over]  overlay='%s:%s:alpha=0.1'%s%s [out]";
+
+        /* Return an error if one of the watermark params is not set properly */
+        if ((!xloc || *xloc == '\0') ||
+            (params->watermark_overlay_type == unknown_image) ||
+            (!yloc || *yloc == '\0') ||
+            (params->watermark_image_scale > 1 || params->watermark_image_scale < 0) ||
+            (params->watermark_image_opacity > 1 || params->watermark_image_opacity < 0)) {
+            elv_err("Watermark overlay params are not set correctly. overlay_type=\"%d\", xloc=\"%s\", yloc=\"%s\", "
+                "scale=%f, opacity=%f, url=%s",
+                params->watermark_overlay_type,
+                xloc != NULL ? xloc : "",
+                yloc != NULL ? yloc : "",
+                params->watermark_image_scale, params->watermark_image_opacity, params->url);
+            return eav_filter_string_init;
+        }
+
+        /* The image is scaled relative to the video width and made translucent before the overlay */
+        image_filter[0] = '\0';
+        if (params->watermark_image_scale > 0)
+            snprintf(image_filter, sizeof(image_filter), ", scale=%d:-1",
+                (int) (params->watermark_image_scale * scale_width));
+        if (params->watermark_image_opacity > 0 && params->watermark_image_opacity < 1)
+            snprintf(image_filter + strlen(image_filter), sizeof(image_filter) - strlen(image_filter),
+                ", format=rgba, colorchannelmixer=aa=%.3f", params->watermark_image_opacity);
+
+        filt_buf_size = get_overlay_filter_string(&filt_buf,
+            params->watermark_overlay, params->watermark_overlay_len, params->watermark_overlay_type);
+        if (filt_buf_size < 0)
+            return eav_filter_string_init;
+
+        filt_str_len = filt_buf_size+2*FILTER_STRING_SZ;
+        *filter_str = (char *) calloc(filt_str_len, 1);
+        int ret = snprintf(*filter_str, filt_str_len, filt_template,
+                        scale_filter,
+                        filt_buf,
+                        image_filter,
+                        xloc, yloc,
+                        has_text ? ", " : "", drawtext_filter);
+        free(filt_buf);
+        if (ret < 0) {
+            free(*filter_str);
+            return eav_filter_string_init;
+        } else if (ret >= filt_str_len) {
+            free(*filter_str);
+            elv_dbg("Not enough memory for overlay watermark filter");
+            return eav_filter_string_init;
+        }
+    } else if (has_text) {
+        *filter_str = (char *) calloc(FILTER_STRING_SZ, 1);
+        if (snprintf(*filter_str, FILTER_STRING_SZ, "%s, %s", scale_filter, drawtext_filter) >= FILTER_STRING_SZ) {
+            free(*filter_str);
+            *filter_str = NULL;
+            elv_dbg("Not enough memory for watermark filter");
+            return eav_filter_string_init;
+        }
+    } else {
+        *filter_str = (char *) calloc(FILTER_STRING_SZ, 1);
+        sprintf(*filter_str, "%s", scale_filter);
+            elv_dbg("FILTER scale=%s", *filter_str);
+    }
+
+    return 0;
+}
+
+/*
+ * The general flow of transcoding:
+ *
+ * - read a packet from the input - the packet PTS/DTS is in the timebase of the source
+ * - decode the packet into a frame - the frame PTS is in the timebase of the source (some decoders will preserve
+ *   the DTS of the original packet in frame->packet_dts, also in the timebase of the source)
+ * - rescale it to the desired timebase of the encoder using the decoder codec_context timebase as a source
+ *   and the encoder codec_context timebase as a target
+ * - send the frame to the filter (if applicable) - the filter will interpret the frame in the
+ *   timebase specified in filter args (so filter args timebase must specify the timebase of the encoder)
+ *   and will return the filtered frame in the timebase of the encoder
+ * - send the frame to the encoder - the encoder will output the frame in its timebase
+ * - in special cases where the output package format requires a specific timebase (for example MPEGTS
+ *   requires 1/90000) so the frame can be rescaled before sending to the packager using the encoder
+ *   codec context timebase as source and the output stream timebase as target
+ */
+/*
+ * Decode a subtitle packet and write it out as a WebVTT cue. Timestamps are made relative to the
+ * start of the input so subtitle segments share the same timeline as the video segments.
+ */
+static int
+transcode_subtitle(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context,
+    AVPacket *packet,
+    xcparams_t *params)
+{
+    int index = decoder_context->subtitle_stream_index;
+    AVStream *out_stream = encoder_context->stream[index];
+    AVSubtitle subtitle;
+    int got_subtitle = 0;
+    int rc;
+
+    rc = avcodec_decode_subtitle2(decoder_context->codec_context[index], &subtitle, &got_subtitle, packet);
+    if (rc < 0) {
+        elv_warn("Failed to decode subtitle packet, err=%s, pts=%"PRId64", url=%s",
+            av_err2str(rc), packet->pts, params->url);
+        return eav_success;
+    }
+    if (!got_subtitle)
+        return eav_success;
+
+    if (subtitle.pts == AV_NOPTS_VALUE)
+        subtitle.pts = av_rescale_q(packet->pts, decoder_context->stream[index]->time_base, AV_TIME_BASE_Q);
+
+    /* Fold the display start time into pts, the same way ffmpeg does before encoding subtitles */
+    subtitle.pts += av_rescale_q(subtitle.start_display_time, (AVRational){1, 1000}, AV_TIME_BASE_Q);
+    subtitle.end_display_time -= subtitle.start_display_time;
+    subtitle.start_display_time = 0;
+    if (decoder_context->format_context->start_time != AV_NOPTS_VALUE)
+        subtitle.pts -= decoder_context->format_context->start_time;
+
+    uint8_t *buf = av_malloc(SUBTITLE_BUF_SIZE);
+    if (!buf) {
+        avsubtitle_free(&subtitle);
+        return eav_mem_alloc;
+    }
+
+    int size = avcodec_encode_subtitle(encoder_context->codec_context[index], buf, SUBTITLE_BUF_SIZE, &subtitle);
+    if (size <= 0) {
+        elv_warn("Failed to encode subtitle, rc=%d, pts=%"PRId64", url=%s", size, subtitle.pts, params->url);
+        av_free(buf);
+        avsubtitle_free(&subtitle);
+        return eav_success;
+    }
+
+    AVPacket *output_packet = av_packet_alloc();
+    if (!output_packet || av_packet_from_data(output_packet, buf, size) < 0) {
+        av_free(buf);
+        av_packet_free(&output_packet);
+        avsubtitle_free(&subtitle);
+        return eav_mem_alloc;
+    }
+
+    output_packet->stream_index = out_stream->index;
+    output_packet->pts = av_rescale_q(subtitle.pts, AV_TIME_BASE_Q, out_stream->time_base);
+    output_packet->dts = output_packet->pts;
+    output_packet->duration = av_rescale_q(subtitle.end_display_time, (AVRational){1, 1000}, out_stream->time_base);
+    output_packet->flags |= AV_PKT_FLAG_KEY;
+
+    elv_dbg("SUBTITLE OUT pts=%"PRId64", duration=%"PRId64", size=%d, url=%s",
+        output_packet->pts, output_packet->duration, size, params->url);
+
+    rc = av_interleaved_write_frame(encoder_context->format_context, output_packet);
+    av_packet_free(&output_packet);
+    avsubtitle_free(&subtitle);
+    if (rc < 0) {
+        elv_err("Failure in writing subtitle packet, rc=%d, url=%s", rc, params->url);
+        return eav_write_frame;
+    }
+
+    return eav_success;
+}
+
+/*
+ * Converts params->trim_start_sec and params->trim_end_sec to start_time_ts and duration_ts in the timebase
+ * of the input stream they apply to, the video stream or the first audio stream if there is no video.
+ * The trim takes precedence over start_time_ts and duration_ts, which must not conflict with it (up to one
+ * tick of rounding).
+ */
+static int
+set_trim_ts(
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    int stream_index = decoder_context->video_stream_index;
+    AVRational timebase;
+    int64_t ts;
+
+    if (params->trim_start_sec <= 0 && params->trim_end_sec <= 0)
+        return eav_success;
+
+    if (stream_index < 0 || !(params->xc_type & xc_video))
+        stream_index = decoder_context->audio_stream_index[0];
+    if (stream_index < 0) {
+        elv_err("No stream to trim, url=%s", params->url);
+        return eav_param;
+    }
+    timebase = decoder_context->format_context->streams[stream_index]->time_base;
+
+    if (params->trim_start_sec > 0) {
+        ts = llrint(params->trim_start_sec * timebase.den / timebase.num);
+        if (params->start_time_ts > 0 && llabs(params->start_time_ts - ts) > 1) {
+            elv_err("Conflicting trim start, trim_start_sec=%.3f (%"PRId64" ts) start_time_ts=%"PRId64", url=%s",
+                params->trim_start_sec, ts, params->start_time_ts, params->url);
+            return eav_param;
+        }
+        params->start_time_ts = ts;
+    }
+
+    if (params->trim_end_sec > 0) {
+        ts = llrint((params->trim_end_sec - params->trim_start_sec) * timebase.den / timebase.num);
+        if (params->duration_ts > 0 && llabs(params->duration_ts - ts) > 1) {
+            elv_err("Conflicting trim end, trim_end_sec=%.3f (%"PRId64" ts) duration_ts=%"PRId64", url=%s",
+                params->trim_end_sec, ts, params->duration_ts, params->url);
+            return eav_param;
+        }
+        params->duration_ts = ts;
+    }
+
+    elv_log("Set start_time_ts=%"PRId64" duration_ts=%"PRId64" from trim_start_sec=%.3f trim_end_sec=%.3f, "
+        "stream_index=%d, timebase=%d/%d, url=%s",
+        params->start_time_ts, params->duration_ts, params->trim_start_sec, params->trim_end_sec,
+        stream_index, timebase.num, timebase.den, params->url);
+    return eav_success;
+}
+
+/*
+ * Sets params->watermark_timecode to the timecode of the source at start_time_ts if watermark_timecode_auto is set.
+ * The start timecode is the one of the tmcd track (the mov demuxer copies it to the video stream) or of the container,
+ * 00:00:00:00 if the source has none. watermark_timecode_rate defaults to the frame rate of the video stream.
+ */
+static int
+set_watermark_timecode(
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    AVFormatContext *format_context = decoder_context->format_context;
+    int index = decoder_context->video_stream_index;
+    AVDictionaryEntry *tag;
+    AVStream *stream;
+    AVRational rate;
+    AVTimecode tc;
+    char tc_str[AV_TIMECODE_STR_SIZE];
+    char *escaped, *d;
+    int64_t frames = 0;
+    int rc;
+
+    if (!params->watermark_timecode_auto)
+        return eav_success;
+
+    if (index < 0 || !(params->xc_type & xc_video)) {
+        elv_err("Timecode watermark needs a video stream, url=%s", params->url);
+        return eav_param;
+    }
+    stream = format_context->streams[index];
+
+    rate = stream->avg_frame_rate.num > 0 ? stream->avg_frame_rate : stream->r_frame_rate;
+    if (params->watermark_timecode_rate > 0)
+        rate = av_d2q(params->watermark_timecode_rate, 1000000);
+    if (rate.num <= 0 || rate.den <= 0) {
+        elv_err("Timecode watermark needs a frame rate, url=%s", params->url);
+        return eav_param;
+    }
+
+    tag = av_dict_get(stream->metadata, "timecode", NULL, 0);
+    if (!tag)
+        tag = av_dict_get(format_context->metadata, "timecode", NULL, 0);
+    for (int i = 0; !tag && i < format_context->nb_streams; i++)
+        tag = av_dict_get(format_context->streams[i]->metadata, "timecode", NULL, 0);
+
+    rc = av_timecode_init_from_string(&tc, rate, tag ? tag->value : "00:00:00:00", NULL);
+    if (rc < 0) {
+        elv_err("Invalid source timecode %s, rate=%d/%d, err=%s, url=%s",
+            tag ? tag->value : "", rate.num, rate.den, av_err2str(rc), params->url);
+        return eav_param;
+    }
+
+    if (params->start_time_ts > 0)
+        frames = av_rescale_q(params->start_time_ts, stream->time_base, av_inv_q(rate));
+    av_timecode_make_string(&tc, tc_str, (int) frames);
+
+    /* The separators are escaped for the filter graph (i.e 01\:00\:00\;00 for drop frame) */
+    escaped = d = (char *) calloc(2 * strlen(tc_str) + 1, 1);
+    for (char *s = tc_str; *s != '\0'; s++) {
+        if (*s == ':' || *s == ';')
+            *d++ = '\\';
+        *d++ = *s;
+    }
+
+    free(params->watermark_timecode);
+    params->watermark_timecode = escaped;
+    params->watermark_timecode_rate = av_q2d(rate);
+
+    elv_log("Set watermark_timecode=%s rate=%.3f from source timecode=%s, url=%s",
+        params->watermark_timecode, params->watermark_timecode_rate, tag ? tag->value : "none", params->url);
+    return eav_success;
+}
+
+/*
+ * Sets params->enc_frame_rate to the average frame rate of the video stream if vfr_handling is "cfr" and
+ * enc_frame_rate is not set, so the fps filter converts a variable frame rate input to a constant frame rate.
+ */
+static int
+set_cfr_frame_rate(
+    coderctx_t *decoder_context,
+    xcparams_t *params)
+{
+    int index = decoder_context->video_stream_index;
+    AVStream *stream;
+    AVRational rate;
+    char rate_str[32];
+
+    if (!params->vfr_handling || strcmp(params->vfr_handling, "cfr") || !(params->xc_type & xc_video))
+        return eav_success;
+
+    if (params->enc_frame_rate && params->enc_frame_rate[0] != '\0')
+        return eav_success;
+
+    if (index < 0) {
+        elv_err("Constant frame rate conversion needs a video stream, url=%s", params->url);
+        return eav_param;
+    }
+    stream = decoder_context->format_context->streams[index];
+
+    rate = stream->avg_frame_rate.num > 0 ? stream->avg_frame_rate : stream->r_frame_rate;
+    if (rate.num <= 0 || rate.den <= 0) {
+        elv_err("Constant frame rate conversion needs enc_frame_rate, the source has no frame rate, url=%s", params->url);
+        return eav_param;
+    }
+
+    snprintf(rate_str, sizeof(rate_str), "%d/%d", rate.num, rate.den);
+    free(params->enc_frame_rate);
+    params->enc_frame_rate = strdup(rate_str);
+
+    elv_log("Set enc_frame_rate=%s from the source average frame rate, url=%s", params->enc_frame_rate, params->url);
+    return eav_success;
+}
+
+/* Sets the approximate frame duration of the output video stream, in the time base of the input video stream */
+static void
+set_calculated_frame_duration(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context)
+{
+    int video_stream_index = decoder_context->video_stream_index;
+
+    if (encoder_context->format_context->streams[0]->avg_frame_rate.num != 0 &&
+        decoder_context->stream[video_stream_index]->time_base.num != 0) {
+        encoder_context->calculated_frame_duration =
+            /* In very rare cases this might overflow, so type cast to 64bit int to avoid overflow */
+            ((int64_t)decoder_context->stream[video_stream_index]->time_base.den * (int64_t)encoder_context->format_context->streams[0]->avg_frame_rate.den) /
+                ((int64_t)encoder_context->format_context->streams[0]->avg_frame_rate.num * (int64_t) decoder_context->stream[video_stream_index]->time_base.num);
+    }
+    elv_log("calculated_frame_duration=%d", encoder_context->calculated_frame_duration);
+}
+
+/* Resets the decoding and encoding timestamps before reading the first packet */
+static void
+init_xc_state(
+    coderctx_t *decoder_context,
+    coderctx_t *encoder_context)
+{
+    decoder_context->video_input_start_pts = AV_NOPTS_VALUE;
+    decoder_context->video_duration = -1;
+    encoder_context->audio_duration = -1;
+    encoder_context->video_encoder_prev_pts = -1;
+    decoder_context->first_decoding_video_pts = AV_NOPTS_VALUE;
+    decoder_context->gap_next_video_pts = AV_NOPTS_VALUE;
+    encoder_context->first_encoding_video_pts = -1;
+    encoder_context->video_pts = AV_NOPTS_VALUE;
+    encoder_context->next_thumbnail_pts = AV_NOPTS_VALUE;
+    encoder_context->forced_keyframes_start_pts = AV_NOPTS_VALUE;
+    encoder_context->next_forced_keyframe = 0;
+
+    for (int j=0; j<MAX_STREAMS; j++) {
+        decoder_context->first_decoding_audio_pts[j] = AV_NOPTS_VALUE;
+        encoder_context->first_encoding_audio_pts[j] = AV_NOPTS_VALUE;
+        decoder_context->audio_input_start_pts[j] = AV_NOPTS_VALUE;
+        encoder_context->audio_pts[j] = AV_NOPTS_VALUE;
+        encoder_context->first_read_packet_pts[j] = AV_NOPTS_VALUE;
+        encoder_context->audio_last_pts_sent_encode[j] = AV_NOPTS_VALUE;
+        encoder_context->audio_last_pts_encoded[j] = AV_NOPTS_VALUE;
+    }
+    decoder_context->first_key_frame_pts = AV_NOPTS_VALUE;
+    decoder_context->is_av_synced = 0;
+    encoder_context->video_last_pts_sent_encode = -1;
+}
+
+/*
+ * Prepares a rendition of a multi-rendition transcoding: the rendition shares the decoder of the leader xctx
+ * and has its own video filters, encoder and outputs. The renditions are video only and must trim the input
+ * like the leader since the leader decides which packets are decoded.
+ */
+static int
+prepare_rendition(
+    xctx_t *xctx,
+    xctx_t *rendition)
+{
+    coderctx_t *decoder_context = &rendition->decoder_ctx;
+    coderctx_t *encoder_context = &rendition->encoder_ctx;
+    xcparams_t *leader_params = xctx->params;
+    xcparams_t *params = rendition->params;
+    char *filter_str = NULL;
+    int rc;
+
+    /* The decoder is owned by the leader, the rendition only has its own video filtergraph */
+    *decoder_context = xctx->decoder_ctx;
+    decoder_context->video_filter_graph = NULL;
+    decoder_context->video_buffersrc_ctx = NULL;
+    decoder_context->video_buffersink_ctx = NULL;
+
+    if ((rc = set_trim_ts(decoder_context, params)) != eav_success)
+        return rc;
+
+    if (leader_params->xc_type != xc_video || params->xc_type != xc_video ||
+        leader_params->bypass_transcoding || params->bypass_transcoding ||
+        leader_params->copy_mpegts || params->copy_mpegts ||
+        params->start_time_ts != leader_params->start_time_ts ||
+        params->duration_ts != leader_params->duration_ts) {
+        elv_err("Rendition must transcode the same video as the leader, xc_type=%d, leader xc_type=%d, "
+            "start_time_ts=%"PRId64", duration_ts=%"PRId64", url=%s",
+            params->xc_type, leader_params->xc_type, params->start_time_ts, params->duration_ts, params->url);
+        return eav_param;
+    }
+
+    if ((rc = set_watermark_timecode(decoder_context, params)) != eav_success)
+        return rc;
+
+    if ((rc = set_cfr_frame_rate(decoder_context, params)) != eav_success)
+        return rc;
+
+    if ((rc = prepare_encoder(encoder_context, decoder_context,
+        rendition->out_handlers, rendition->out_inctx, params)) != eav_success) {
+        elv_err("Failure in preparing rendition encoder, url=%s, rc=%d", params->url, rc);
+        return rc;
+    }
+
+    if ((rc = get_filter_str(&filter_str, encoder_context, params)) != eav_success)
+        return rc;
+
+    rc = init_video_filters(filter_str, decoder_context, encoder_context, params);
+    free(filter_str);
+    if (rc != eav_success) {
+        elv_err("Failed to initialize rendition video filter, url=%s", params->url);
+        return rc;
+    }
+
+    if ((rc = write_output_header(params, encoder_context->format_context)) != eav_success) {
+        elv_err("Failed to write rendition output file header, url=%s", params->url);
+        return rc;
+    }
+
+    set_calculated_frame_duration(decoder_context, encoder_context);
+
+    if (params->start_time_ts != -1)
+        encoder_context->format_context->start_time = params->start_time_ts;
+
+    init_xc_state(decoder_context, encoder_context);
+
+    return eav_success;
+}
+
+/*
+ * Returns the video segment duration (sec) of an output, from seg_duration or from the video_seg_duration_ts
+ * resolved by set_encoder_options() (in the timebase it used), or 0 if the output is not segmented by duration.
+ */
+static double
+video_seg_duration_sec(
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    AVCodecContext *codec_context = encoder_context->codec_context[encoder_context->video_stream_index];
+    int timebase = codec_context->time_base.den;
+
+    if (seg_duration_sec(params) > 0)
+        return seg_duration_sec(params);
+
+    if (params->video_seg_duration_ts <= 0 || timebase <= 0)
+        return 0;
+
+    if (!strcmp(params->format, "fmp4-segment") || !strcmp(params->format, "segment"))
+        timebase = calc_timebase(params, 1, timebase);
+
+    return (double) params->video_seg_duration_ts / timebase;
+}
+
+/*
+ * Checks the video segment duration of an output is a whole number of its key frame intervals (force_keyint),
+ * up to half a frame, otherwise the segments would not start on a forced key frame. Returns eav_param if not.
+ */
+static int
+check_seg_keyint(
+    coderctx_t *encoder_context,
+    xcparams_t *params)
+{
+    AVCodecContext *codec_context = encoder_context->codec_context[encoder_context->video_stream_index];
+    double seg_duration = video_seg_duration_sec(encoder_context, params);
+
+    if (seg_duration <= 0 || params->force_keyint <= 0 ||
+        codec_context->framerate.num <= 0 || codec_context->framerate.den <= 0)
+        return eav_success;
+
+    double frame_duration = av_q2d(av_inv_q(codec_context->framerate));
+    double keyint_duration = params->force_keyint * frame_duration;
+    int64_t keyints = llrint(seg_duration / keyint_duration);
+    if (keyints < 1 || fabs(seg_duration - keyints * keyint_duration) > frame_duration / 2) {
+        elv_err("Segment duration is not a multiple of the key frame interval, format=%s, seg_duration=%.3f, "
+            "force_keyint=%d (%.3f sec), url=%s",
+            params->format, seg_duration, params->force_keyint, keyint_duration, params->url);
+        return eav_param;
+    }
+
+    return eav_success;
+}
+
+/*
+ * Checks the segment durations of a multi-rendition transcoding. Each format group (the outputs with the same
+ * format) has its own segment duration, which must be the same for all the outputs of the group so their
+ * segments line up, and the segment duration of each output must be a whole number of its key frame
+ * intervals (see check_seg_keyint()).
+ */
+static int
+check_rendition_segments(
+    xctx_t *xctx)
+{
+    int n = xctx->n_renditions + 1;
+
+    for (int i=0; i<n; i++) {
+        xctx_t *output = i == 0 ? xctx : xctx->renditions[i-1];
+        xcparams_t *params = output->params;
+        double seg_duration = video_seg_duration_sec(&output->encoder_ctx, params);
+
+        for (int j=0; j<i; j++) {
+            xctx_t *other = j == 0 ? xctx : xctx->renditions[j-1];
+            double other_seg_duration = video_seg_duration_sec(&other->encoder_ctx, other->params);
+
+            if (!strcmp(params->format, other->params->format) &&
+                fabs(seg_duration - other_seg_duration) > 0.001) {
+                elv_err("Conflicting segment durations in format group %s, seg_duration=%.3f, other seg_duration=%.3f, url=%s",
+                    params->format, seg_duration, other_seg_duration, params->url);
+                return eav_param;
+            }
+        }
+
+        if (check_seg_keyint(&output->encoder_ctx, params) != eav_success) {
+            elv_err("Invalid segment duration of rendition %d, format=%s, url=%s", i, params->format, params->url);
+            return eav_param;
+        }
+    }
+
+    return eav_success;
+}
+
+/* Jumps of the input timestamps larger than this are discontinuities */
+#define TS_DISCONTINUITY_SEC    10
+
+/*
+ * Makes the timestamps of the packet monotonic if the input timestamps wrap (i.e. the 33 bit PTS of MPEG-TS,
+ * which wraps every 26.5 hours), so the start_time_ts/duration_ts math of long live recordings keeps working.
+ * A jump back of more than half the wrap period is a wraparound and adds the wrap period to the following
+ * timestamps of the stream. Any other jump of more than TS_DISCONTINUITY_SEC (i.e. the source restarted)
+ * is a discontinuity, the following timestamps are shifted to continue after the last packet.
+ * libavformat only corrects the first wraparound after the start of the input, this handles all of them.
+ */
+static void
+unwrap_packet_ts(
+    coderctx_t *decoder_context,
+    AVPacket *packet,
+    xcparams_t *params)
+{
+    int i = packet->stream_index;
+    AVStream *stream;
+    int64_t ts, delta, wrap, threshold;
+
+    if (i < 0 || i >= MAX_STREAMS || i >= decoder_context->format_context->nb_streams)
+        return;
+    stream = decoder_context->format_context->streams[i];
+    if (stream->pts_wrap_bits <= 0 || stream->pts_wrap_bits >= 63)
+        return;
+
+    ts = packet->dts != AV_NOPTS_VALUE ? packet->dts : packet->pts;
+    if (ts == AV_NOPTS_VALUE)
+        return;
+    ts += decoder_context->ts_offset[i];
+
+    if (decoder_context->has_last_ts[i]) {
+        wrap = 1LL << stream->pts_wrap_bits;
+        threshold = av_rescale_q(TS_DISCONTINUITY_SEC, (AVRational) {1, 1}, stream->time_base);
+        delta = ts - decoder_context->last_ts[i];
+
+        if (delta < -wrap / 2) {
+            decoder_context->ts_offset[i] += wrap;
+            ts += wrap;
+            elv_log("PTS wraparound stream_index=%d, ts=%"PRId64", last_ts=%"PRId64", ts_offset=%"PRId64", url=%s",
+                i, ts, decoder_context->last_ts[i], decoder_context->ts_offset[i], params->url);
+            delta = ts - decoder_context->last_ts[i];
+        }
+
+        if (delta > threshold || delta < -threshold) {
+            /* Continue one packet duration (at least one tick) after the last packet */
+            int64_t shift = decoder_context->last_ts[i] + FFMAX(decoder_context->last_ts_duration[i], 1) - ts;
+            decoder_context->ts_offset[i] += shift;
+            ts += shift;
+            elv_warn("PTS discontinuity stream_index=%d, jump=%"PRId64", ts_offset=%"PRId64", url=%s",
+                i, delta, decoder_context->ts_offset[i], params->url);
+        }
+    }
+
+    if (decoder_context->ts_offset[i] != 0) {
+        if (packet->pts != AV_NOPTS_VALUE)
+            packet->pts += decoder_context->ts_offset[i];
+        if (packet->dts != AV_NOPTS_VALUE)
+            packet->dts += decoder_context->ts_offset[i];
+    }
+
+    decoder_context->last_ts[i] = ts;
+    decoder_context->has_last_ts[i] = 1;
+    if (packet->duration > 0)
+        decoder_context->last_ts_duration[i] = packet->duration;
+}
+
+/*
+ * Opens the input of xctx and prepares its decoder, the first step of avpipe_xc() and avpipe_validate().
+ */
+static int
+prepare_xc_input(
+    xctx_t *xctx)
+{
+    coderctx_t *decoder_context = &xctx->decoder_ctx;
+    xcparams_t *params = xctx->params;
+    avpipe_io_handler_t *in_handlers = xctx->in_handlers;
+    ioctx_t *inctx = xctx->inctx;
+    int rc = 0;
+
+    if (!params->url || params->url[0] == '\0' ||
+        in_handlers->avpipe_opener(params->url, inctx) < 0) {
+        elv_err("Failed to open avpipe input \"%s\"", params->url != NULL ? params->url : "");
+        rc = eav_open_input;
+        return rc;
+    }
+
+    if ((rc = prepare_decoder(&xctx->decoder_ctx,
+            in_handlers, inctx, params, params->seekable)) != eav_success) {
+        elv_err("Failure in preparing decoder, url=%s, rc=%d", params->url, rc);
+        return rc;
+    }
+
+    if ((rc = set_trim_ts(&xctx->decoder_ctx, params)) != eav_success)
+        return rc;
+
+    if ((rc = set_watermark_timecode(&xctx->decoder_ctx, params)) != eav_success)
+        return rc;
+
+    if ((rc = set_cfr_frame_rate(&xctx->decoder_ctx, params)) != eav_success)
+        return rc;
+
+    if (params->xc_type == xc_still &&
+        (!is_image_format(decoder_context->format_context) || decoder_context->video_stream_index < 0)) {
+        elv_err("Still transcoding needs an image input, input_format=%s, url=%s",
+            decoder_context->format_context->iformat->name, params->url);
+        return eav_param;
+    }
+
+    return eav_success;
+}
+
+/*
+ * Initializes the video and audio filter graphs of xctx, once its decoder and encoder are prepared.
+ */
+static int
+init_xc_filters(
+    xctx_t *xctx)
+{
+    char *filter_str = NULL;
+    coderctx_t *decoder_context = &xctx->decoder_ctx;
+    coderctx_t *encoder_context = &xctx->encoder_ctx;
+    xcparams_t *params = xctx->params;
+    int rc = 0;
+
+    if (!params->bypass_transcoding &&
+        (params->xc_type & xc_video)) {
+        if ((rc = get_filter_str(&filter_str, encoder_context, params)) != eav_success)
+            return rc;
+
+        if ((rc = init_video_filters(filter_str, decoder_context, encoder_context, xctx->params)) != eav_success) {
+            free(filter_str);
+            elv_err("Failed to initialize video filter, url=%s", params->url);
+            return rc;
+        }
+        free(filter_str);
+    }
+
+    if (!params->bypass_transcoding &&
+        (params->xc_type & xc_audio) &&
+        params->xc_type != xc_audio_join &&
+        params->xc_type != xc_audio_pan &&
+        params->xc_type != xc_audio_merge &&
+        (rc = init_audio_filters(decoder_context, encoder_context, xctx->params)) != eav_success) {
+        elv_err("Failed to initialize audio filter, url=%s", params->url);
+        return rc;
+    }
+
+    if (!params->bypass_transcoding &&
+        params->xc_type == xc_audio_pan &&
+        (rc = init_audio_pan_filters(xctx->params->filter_descriptor, decoder_context, encoder_context)) != eav_success) {
+        elv_err("Failed to initialize audio pan filter, url=%s", params->url);
+        return rc;
+    }
+
+    if (!params->bypass_transcoding &&
+        params->xc_type == xc_audio_join &&
+        (rc = init_audio_join_filters(decoder_context, encoder_context, xctx->params)) != eav_success) {
+        elv_err("Failed to initialize audio join filter, url=%s", params->url);
+        return rc;
+    }
+
+    if (!params->bypass_transcoding &&
+        params->xc_type == xc_audio_merge &&
+        (rc = init_audio_merge_pan_filters(xctx->params->filter_descriptor, decoder_context, encoder_context)) != eav_success) {
+        elv_err("Failed to initialize audio merge pan filter, url=%s", params->url);
+        return rc;
+    }
+
+    return eav_success;
+}
+
+int
+avpipe_validate(
+    xctx_t *xctx)
+{
+    xcparams_t *params = xctx->params;
+    int rc = 0;
+
+    if ((rc = prepare_xc_input(xctx)) != eav_success)
+        return rc;
+
+    /* The remuxer and the MPEGTS bypass have no encoder or filters to check */
+    if (avpipe_is_remux(params) || params->copy_mpegts)
+        return eav_success;
+
+    if ((rc = prepare_encoder(&xctx->encoder_ctx,
+        &xctx->decoder_ctx, xctx->out_handlers, xctx->out_inctx ? xctx->out_inctx : xctx->inctx, params)) != eav_success) {
+        elv_err("Failure in preparing encoder, url=%s, rc=%d", params->url, rc);
+        return rc;
+    }
+
+    for (int i=0; i<xctx->n_renditions; i++) {
+        if ((rc = prepare_rendition(xctx, xctx->renditions[i])) != eav_success)
+            return rc;
+    }
+
+    if (xctx->n_renditions > 0 && (rc = check_rendition_segments(xctx)) != eav_success)
+        return rc;
+
+    if ((rc = init_xc_filters(xctx)) != eav_success)
+        return rc;
+
+    elv_log("avpipe_validate done url=%s", params->url);
+    return eav_success;
+}
+
+static void
+add_xc_timing(
+    xc_timing_t *total,
+    xc_timing_t *timing)
+{
+    total->decode_ns += timing->decode_ns;
+    total->filter_ns += timing->filter_ns;
+    total->encode_ns += timing->encode_ns;
+    total->mux_ns += timing->mux_ns;
+}
+
+/*
+ * Sums the time spent in each stage by the audio and video threads of the transcoding and its
+ * renditions, and reports it with in_stat_xc_timing. start is the av_gettime_relative() when the
+ * transcoding started.
+ */
+static void
+report_xc_timing(
+    xctx_t *xctx,
+    int64_t start)
+{
+    ioctx_t *inctx = xctx->inctx;
+    avpipe_io_handler_t *in_handlers = xctx->in_handlers;
+    xc_timing_t *timing = &inctx->xc_timing;
+
+    memset(timing, 0, sizeof(xc_timing_t));
+    add_xc_timing(timing, &xctx->decoder_ctx.video_timing);
+    add_xc_timing(timing, &xctx->decoder_ctx.audio_timing);
+    add_xc_timing(timing, &xctx->encoder_ctx.video_timing);
+    add_xc_timing(timing, &xctx->encoder_ctx.audio_timing);
+    for (int i=0; i<xctx->n_renditions; i++) {
+        add_xc_timing(timing, &xctx->renditions[i]->decoder_ctx.video_timing);
+        add_xc_timing(timing, &xctx->renditions[i]->encoder_ctx.video_timing);
+    }
+    add_elapsed_ns(&timing->total_ns, start);
+
+    elv_log("XC TIMING decode=%"PRId64" filter=%"PRId64" encode=%"PRId64" mux=%"PRId64" total=%"PRId64" (ns), url=%s",
+        timing->decode_ns, timing->filter_ns, timing->encode_ns, timing->mux_ns, timing->total_ns, xctx->params->url);
+
+    if (in_handlers->avpipe_stater)
+        in_handlers->avpipe_stater(inctx, -1, in_stat_xc_timing);
+}
+
+int
+avpipe_xc(
+    xctx_t *xctx,
+    int do_instrument)
+{
+    coderctx_t *decoder_context = &xctx->decoder_ctx;
+    coderctx_t *encoder_context = &xctx->encoder_ctx;
+    xcparams_t *params = xctx->params;
+    int debug_frame_level = params->debug_frame_level;
+    avpipe_io_handler_t *in_handlers = xctx->in_handlers;
+    avpipe_io_handler_t *out_handlers = xctx->out_handlers;
+    ioctx_t *inctx = xctx->inctx;
+    int rc = 0;
+    int av_read_frame_rc = 0;
+    AVPacket *input_packet = NULL;
+    AVPacket *still_packet = NULL;          // Last packet of a still image input, repeated for xc_still
+    int64_t still_frame_duration = 0;
+    int64_t xc_start = av_gettime_relative();
+    int64_t trailer_start;
+
+    if ((rc = prepare_xc_input(xctx)) != eav_success)
+        return rc;
+
+    if (avpipe_is_remux(params))
+        return avpipe_remux(xctx);
+
+    // Set up "copy" (bypass) encoder for MPEGTS
+    if (params->copy_mpegts) {
+        cp_ctx_t *cp_ctx = &xctx->cp_ctx;
+
+        rc = copy_mpegts_prepare_encoder(cp_ctx, &xctx->decoder_ctx, out_handlers, inctx, params);
+
+        if (rc != eav_success) {
+            elv_err("Failure in preparing copy encoder, url=%s, rc=%d", params->url, rc);
+            return rc;
+        }
+
+        elv_channel_init(&cp_ctx->ch, 10000, (free_elem_f) av_packet_free);
+
+        /* Create threads for the MPEGTS bypass encoder */
+        pthread_create(&cp_ctx->thread_id, NULL, copy_mpegts_func, xctx);
+    }
+
+    if ((rc = prepare_encoder(&xctx->encoder_ctx,
+        &xctx->decoder_ctx, out_handlers, xctx->out_inctx ? xctx->out_inctx : inctx, params)) != eav_success) {
+        elv_err("Failure in preparing encoder, url=%s, rc=%d", params->url, rc);
+        return rc;
+    }
+
+    for (int i=0; i<xctx->n_renditions; i++) {
+        if ((rc = prepare_rendition(xctx, xctx->renditions[i])) != eav_success)
+            return rc;
+    }
+
+    if (xctx->n_renditions > 0 && (rc = check_rendition_segments(xctx)) != eav_success)
+        return rc;
+
+    elv_channel_init(&xctx->vc, 10000, (free_elem_f) av_packet_free);
+    elv_channel_init(&xctx->ac, 10000, (free_elem_f) av_packet_free);
+
+    /* Create threads for decoder and encoder */
+    pthread_create(&xctx->vthread_id, NULL, transcode_video_func, xctx);
+    pthread_create(&xctx->athread_id, NULL, transcode_audio_func, xctx);
+
+    if ((rc = init_xc_filters(xctx)) != eav_success)
+        goto xc_done;
+
+    if ((params->xc_type & xc_video) &&
+        (rc = write_output_header(params, encoder_context->format_context)) != eav_success) {
+        elv_err("Failed to write video output file header, url=%s", params->url);
+        goto xc_done;
+    }
+
+    if (params->xc_type == xc_subtitle &&
+        (rc = write_output_header(params, encoder_context->format_context)) != eav_success) {
+        elv_err("Failed to write subtitle output file header, url=%s", params->url);
+        goto xc_done;
+    }
+
+    if (params->xc_type & xc_audio) {
+        for (int i=0; i<encoder_context->n_audio_output; i++) {
+            if ((rc = write_output_header(params, encoder_context->format_context2[i])) != eav_success) {
+                elv_err("Failed to write audio output file header, url=%s", params->url);
+                goto xc_done;
+            }
+        }
+    }
+
+    if (params->copy_mpegts) {
+        cp_ctx_t *cp_ctx = &xctx->cp_ctx;
+        rc = avformat_write_header(cp_ctx->encoder_ctx.format_context, NULL);
+        if (rc != eav_success) {
+            rc = eav_write_header;
+            goto xc_done;
+        }
+
+    }
+
+    if (params->xc_type & xc_video)
+        set_calculated_frame_duration(decoder_context, encoder_context);
+
+    xctx->do_instrument = do_instrument;
+    xctx->debug_frame_level = debug_frame_level;
+
+#if INPUT_IS_SEEKABLE
+    /* Seek to start position */
+    if (params->start_time_ts > 0) {
+        if (av_seek_frame(decoder_context->format_context,
+                decoder_context->video_stream_index, params->start_time_ts, SEEK_SET) < 0) {
+            elv_err("Failed seeking to desired start frame, url=%s", params->url);
+            rc = eav_seek;
+            goto xc_done;
+        }
+    }
+#endif
+
+    if (params->start_time_ts != -1) {
+        if (params->xc_type == xc_video || params->xc_type == xc_still)
+            encoder_context->format_context->start_time = params->start_time_ts;
+        if (params->xc_type & xc_audio) {
+            for (int i=0; i<encoder_context->n_audio_output; i++)
+               encoder_context->format_context2[i]->start_time = params->start_time_ts;
+        }
+        /* PENDING (RM) add new start_time_ts for audio */
+    }
+
+    init_xc_state(decoder_context, encoder_context);
+
+    int64_t video_last_dts = 0;
+    int frames_read_past_duration = 0;
+    const int frames_allowed_past_duration = 5;
+
+    /* If there is a transcoding error, break the main loop */
+    while (!xctx->err) {
+        if (params->fail_on_verify_error && encoder_context->segments_verify_failed > 0) {
+            elv_err("Stop transcoding, %d segment(s) failed decode verification, url=%s",
+                encoder_context->segments_verify_failed, params->url);
+            xctx->err = eav_verify_segment;
+            break;
+        }
+
+        input_packet = av_packet_alloc();
+        if (!input_packet) {
+            elv_err("Failed to allocated memory for AVPacket, url=%s", params->url);
+            return eav_mem_alloc;
+        }
+
+        rc = av_read_frame(decoder_context->format_context, input_packet);
+
+        /* Repeat the image of a still input until the end of duration_ts */
+        if ((rc == AVERROR_EOF || rc == -1) && !inctx->read_error && still_packet &&
+            still_packet->pts + still_frame_duration <
+                decoder_context->video_input_start_pts + params->start_time_ts + params->duration_ts) {
+            still_packet->pts += still_frame_duration;
+            still_packet->dts = still_packet->pts;
+            rc = av_packet_ref(input_packet, still_packet);
+        }
+
+        if (rc < 0) {
+            av_packet_free(&input_packet);
+            av_read_frame_rc = rc;
+            if ((rc == AVERROR_EOF || rc == -1) && !inctx->read_error) {
+                elv_log("av_read_frame() EOF or -1 rc=%d, url=%s", rc, params->url);
+                rc = eav_success;
+            } else if (decoder_context->stop_requested && !decoder_context->cancelled) {
+                /* The read was interrupted to stop, finalize the outputs as if the input ended */
+                elv_log("av_read_frame() stopped rc=%d, url=%s", rc, params->url);
+                rc = eav_success;
+            } else {
+                elv_err("av_read_frame() rc=%d, url=%s", rc, params->url);
+                /* The demuxer may not return the error of the input handler as is */
+                if (rc == AVERROR(ETIMEDOUT) || inctx->read_timeout)
+                    rc = eav_io_timeout;
+                else
+                    rc = eav_read_input;
+            }
+            break;
+        }
+
+        if (input_packet->flags & AV_PKT_FLAG_CORRUPT) {
+            elv_warn("packet corrupt pts=%"PRId64, input_packet->pts);
+            av_packet_free(&input_packet);
+            continue;
+        }
+
+        if (params->handle_pts_wraparound)
+            unwrap_packet_ts(decoder_context, input_packet, params);
+
+        const char *st = stream_type_str(encoder_context, input_packet->stream_index);
+        int stream_index = input_packet->stream_index;
+
+        if (params->xc_type == xc_still && stream_index == decoder_context->video_stream_index) {
+            AVStream *in_stream = decoder_context->format_context->streams[stream_index];
+
+            /* Single image demuxers don't always set timestamps */
+            if (input_packet->pts == AV_NOPTS_VALUE && input_packet->dts == AV_NOPTS_VALUE)
+                input_packet->pts = input_packet->dts = still_packet ? still_packet->pts + still_frame_duration : 0;
+
+            still_frame_duration = input_packet->duration;
+            if (still_frame_duration <= 0 && in_stream->r_frame_rate.num > 0)
+                still_frame_duration = av_rescale_q(1, av_inv_q(in_stream->r_frame_rate), in_stream->time_base);
+            if (still_frame_duration <= 0)
+                still_frame_duration = 1;
+
+            /* Keep the last image, so an animated image ends on its last frame */
+            if (!still_packet)
+                still_packet = av_packet_alloc();
+            else
+                av_packet_unref(still_packet);
+            if (!still_packet || av_packet_ref(still_packet, input_packet) < 0) {
+                elv_err("Failed to keep still image packet, url=%s", params->url);
+                av_packet_free(&input_packet);
+                rc = eav_mem_alloc;
+                break;
+            }
+        }
+
+        // Record PTS of first frame read - excute only for the desired stream
+        if ((stream_index == decoder_context->video_stream_index && (params->xc_type & xc_video)) ||
+            (selected_decoded_audio(decoder_context, stream_index) >= 0 && (params->xc_type & xc_audio))) {
+
+            if (encoder_context->first_read_packet_pts[stream_index] == AV_NOPTS_VALUE && input_packet->pts != AV_NOPTS_VALUE) {
+                encoder_context->first_read_packet_pts[stream_index] = input_packet->pts;
+                elv_log("PTS first_read_packet_pts=%"PRId64" stream=%d:%d:%s sidx=%d, url=%s",
+                    encoder_context->first_read_packet_pts[stream_index], params->xc_type, params->stream_id,
+                    st, stream_index, params->url);
+            } else if (input_packet->pts != AV_NOPTS_VALUE && input_packet->pts < encoder_context->first_read_packet_pts[stream_index]) {
+                /* Due to b-frame reordering */
+                encoder_context->first_read_packet_pts[stream_index] = input_packet->pts;
+                elv_log("PTS first_read_packet reorder new=%"PRId64" stream=%d:%d:%s, url=%s",
+                    encoder_context->first_read_packet_pts, params->xc_type, params->stream_id, st, params->url);
+            }
+        }
+
+        /* This is a very special case, sometimes pts is not set but dts has a value. */
+        if (input_packet->pts == AV_NOPTS_VALUE &&
+            input_packet->dts != AV_NOPTS_VALUE)
+            input_packet->pts = input_packet->dts;
+
+        report_decode_progress(inctx, in_handlers, input_packet, params);
+
+        /* Execute for both audio and video streams:
+         * - used for syncing audio to first video key frame
+         */
+        if (input_packet->stream_index == decoder_context->video_stream_index ||
+            selected_decoded_audio(decoder_context, input_packet->stream_index) >= 0) {
+            if (skip_for_sync(decoder_context, input_packet, params)) {
+                av_packet_unref(input_packet);
+                av_packet_free(&input_packet);
+                continue;
+            }
+        }
+
+        // Excute only for the desired stream
+        if ((input_packet->stream_index == decoder_context->video_stream_index && (params->xc_type & xc_video)) ||
+            (selected_decoded_audio(decoder_context, input_packet->stream_index) >= 0 && (params->xc_type & xc_audio))) {
+            // Stop when we reached the desired duration (duration -1 means 'entire input stream')
+            // PENDING(SSS) - this logic can be done after decoding where we know concretely that we decoded all frames
+            // we need to encode.
+            if (should_stop_decoding(input_packet, decoder_context, encoder_context,
+                    params, inctx->audio_frames_read, inctx->video_frames_read,
+                    &frames_read_past_duration, frames_allowed_past_duration)) {
+                av_packet_free(&input_packet);
+                if (decoder_context->cancelled)
+                    rc = eav_cancelled;
+                break;
+            }
+
+            /*
+             * Skip the input packet if the packet timestamp is smaller than start_time_ts.
+             * The fact that avpipe mezzanine generated files don't have B-frames let us to skip before decoding.
+             * The assumption here is that the input stream does not have any B-frames, otherwise we can not skip
+             * the input packets without decoding.
+             * Having this logic (here) before decoding increases the performance and saves CPU.
+             * PENDING(RM) - add a validation to check input stream doesn't have any B-frames.
+             */
+            if (input_packet &&
+                params->start_time_ts > 0 &&
+                (params->xc_type == xc_video || params->xc_type == xc_audio) &&
+                skip_until_start_time_pts(decoder_context, input_packet, params)) {
+                    av_packet_unref(input_packet);
+                    av_packet_free(&input_packet);
+                    continue;
+            }
+        }
+
+        // Copy MPEGTS first
+        if (params->copy_mpegts) {
+            xc_frame_t *xc_frame_cp = (xc_frame_t *) calloc(1, sizeof(xc_frame_t));
+            (void)packet_clone(input_packet, &xc_frame_cp->packet);
+            xc_frame_cp->stream_index = input_packet->stream_index;
+            elv_channel_send(xctx->cp_ctx.ch, xc_frame_cp);
+        }
+
+        if (input_packet->stream_index == decoder_context->video_stream_index &&
+            (params->xc_type & xc_video)) {
+            // Video packet
+            dump_packet(0, "IN ", input_packet, debug_frame_level);
+
+            inctx->video_frames_read++;
+            if (in_handlers->avpipe_stater)
+                in_handlers->avpipe_stater(inctx, input_packet->stream_index, in_stat_video_frame_read);
+
+            if (decoder_context->first_key_frame_pts == AV_NOPTS_VALUE &&
+                    input_packet->flags == AV_PKT_FLAG_KEY) {
+                decoder_context->first_key_frame_pts = input_packet->pts;
+                decoder_context->inctx->first_key_frame_pts = decoder_context->first_key_frame_pts;
+                elv_log("PTS first_key_frame_pts=%"PRId64" sidx=%d flags=%d dts=%"PRId64,
+                    decoder_context->first_key_frame_pts, input_packet->stream_index, input_packet->flags, input_packet->dts);
+                if (in_handlers->avpipe_stater)
+                    in_handlers->avpipe_stater(decoder_context->inctx, input_packet->stream_index, in_stat_first_keyframe_pts);
+            }
+
+            // Assert DTS is growing as expected (accommodate non integer and irregular frame duration)
+            if (video_last_dts + input_packet->duration * 1.5 < input_packet->dts &&
+                video_last_dts != 0 && input_packet->duration > 0) {
+                elv_log("Expected dts == last_dts + duration - video_last_dts=%" PRId64 " duration=%" PRId64 " dts=%" PRId64 " url=%s",
+                    video_last_dts, input_packet->duration, input_packet->dts, params->url);
+            }
+            video_last_dts = input_packet->dts;
+
+            xc_frame_t *xc_frame = (xc_frame_t *) calloc(1, sizeof(xc_frame_t));
+            xc_frame->packet = input_packet;
+            xc_frame->stream_index = input_packet->stream_index;
+            elv_channel_send(xctx->vc, xc_frame);
+
+        } else if (selected_decoded_audio(decoder_context, input_packet->stream_index) >= 0 &&
+            params->xc_type & xc_audio) {
+
+            encoder_context->audio_last_dts[input_packet->stream_index] = input_packet->dts;
+
+            dump_packet(1, "IN ", input_packet, debug_frame_level);
+
+            inctx->audio_frames_read++;
+            if (in_handlers->avpipe_stater)
+                in_handlers->avpipe_stater(inctx, input_packet->stream_index, in_stat_audio_frame_read);
+
+            xc_frame_t *xc_frame = (xc_frame_t *) calloc(1, sizeof(xc_frame_t));
+            xc_frame->packet = input_packet;
+            xc_frame->stream_index = input_packet->stream_index;
+            elv_channel_send(xctx->ac, xc_frame);
+
+        } else if (stream_index == decoder_context->subtitle_stream_index &&
+            params->xc_type == xc_subtitle) {
+            // Subtitle packet
+            dump_packet(0, "IN ", input_packet, debug_frame_level);
+
+            rc = transcode_subtitle(decoder_context, encoder_context, input_packet, params);
+            av_packet_free(&input_packet);
+            if (rc != eav_success) {
+                xctx->err = rc;
+                break;
+            }
+
+        } else {
+            if (stream_index == decoder_context->data_scte35_stream_index) {
+                uint8_t scte35_command_type;
+                int res = parse_scte35_pkt(&scte35_command_type, input_packet);
+                if (res < 0) {
+                    elv_warn("SCTE [%d] fail to parse pts=%"PRId64" size=%d",
+                        input_packet->stream_index, input_packet->pts, input_packet->size);
+                } else {
+                    char hex_str[2 * input_packet->size + 1];
+                    switch (scte35_command_type) {
+                    case 4:
+                    case 5:
+                    case 6:
+                        hex_encode(input_packet->data, input_packet->size, hex_str);
+                        elv_dbg("SCTE [%d] pts=%"PRId64" duration=%"PRId64" flag=%d size=%d "
+                            "data=%s command=%d",
+                            input_packet->stream_index, input_packet->pts, input_packet->duration,
+                            input_packet->flags, input_packet->size,
+                            hex_str, scte35_command_type);
+
+                        if (in_handlers->avpipe_stater) {
+                            inctx->data = (uint8_t *)hex_str;
+                            in_handlers->avpipe_stater(inctx, input_packet->stream_index, in_stat_data_scte35);
+
+                            inctx->scte35_event.pts = input_packet->pts;
+                            inctx->scte35_event.command_type = scte35_command_type;
+                            inctx->scte35_event.data = input_packet->data;
+                            inctx->scte35_event.data_len = input_packet->size;
+                            in_handlers->avpipe_stater(inctx, input_packet->stream_index, in_stat_scte35);
+                            inctx->scte35_event.data = NULL;
+                            inctx->scte35_event.data_len = 0;
                         }
                         break;
-                    }
+                    }
+                }
+            } else {
+                if (debug_frame_level)
+                    elv_dbg("Skip stream - packet index=%d, pts=%"PRId64" dts=%"PRId64" url=%s",
+                        input_packet->stream_index, input_packet->pts, input_packet->dts, params->url);
+            }
+            av_packet_free(&input_packet);
+        }
+    }
+
+xc_done:
+    av_packet_free(&still_packet);
+    elv_dbg("av_read_frame() av_read_frame_rc=%d, rc=%d, url=%s", av_read_frame_rc, rc, params->url);
+
+    xctx->stop = 1;
+    /* Don't purge the channels, let the receiver to drain it */
+    elv_channel_close(xctx->vc, 0);
+    elv_channel_close(xctx->ac, 0);
+    pthread_join(xctx->vthread_id, NULL);
+    pthread_join(xctx->athread_id, NULL);
+
+    if (params->copy_mpegts) {
+        cp_ctx_t *cp_ctx = &xctx->cp_ctx;
+        elv_channel_close(cp_ctx->ch, 0);
+        pthread_join(cp_ctx->thread_id, NULL);
+    }
+
+    /*
+     * Flush all frames, first flush decoder buffers, then encoder buffers by passing NULL frame.
+     */
+    if (params->xc_type & xc_video && xctx->err != eav_write_frame)
+        flush_decoder(decoder_context, encoder_context, xctx->renditions, xctx->n_renditions,
+            encoder_context->video_stream_index, params, debug_frame_level);
+    /* Includes audio join, merge and pan, the decoder of each input audio stream is flushed */
+    if (params->xc_type & xc_audio && xctx->err != eav_write_frame) {
+        for (int i=0; i<decoder_context->n_audio; i++)
+            flush_decoder(decoder_context, encoder_context, NULL, 0, decoder_context->audio_stream_index[i], params, debug_frame_level);
+    }
+
+    if (!params->bypass_transcoding && (params->xc_type & xc_video) && xctx->err != eav_write_frame)
+        encode_frame(decoder_context, encoder_context, NULL, decoder_context->video_stream_index, params, debug_frame_level);
+    for (int i=0; i<xctx->n_renditions && xctx->err != eav_write_frame; i++) {
+        xctx_t *rendition = xctx->renditions[i];
+        encode_frame(&rendition->decoder_ctx, &rendition->encoder_ctx, NULL,
+            decoder_context->video_stream_index, rendition->params, debug_frame_level);
+    }
+    /* Loop through and flush all audio encoders, audio join, merge and pan have a single encoder */
+    if (!params->bypass_transcoding && params->xc_type & xc_audio && xctx->err != eav_write_frame) {
+        for (int i=0; i<decoder_context->n_audio; i++) {
+            if (i > 0 && (params->xc_type == xc_audio_join || params->xc_type == xc_audio_merge ||
+                params->xc_type == xc_audio_pan))
+                break;
+            encode_frame(decoder_context, encoder_context, NULL, decoder_context->audio_stream_index[i], params, debug_frame_level);
+        }
+    }
+
+    dump_trackers(decoder_context->format_context, encoder_context->format_context);
+
+    trailer_start = av_gettime_relative();
+    if ((params->xc_type & xc_video || params->xc_type == xc_subtitle) && rc == eav_success)
+        av_write_trailer(encoder_context->format_context);
+    for (int i=0; i<xctx->n_renditions && rc == eav_success; i++)
+        av_write_trailer(xctx->renditions[i]->encoder_ctx.format_context);
+    if ((params->xc_type & xc_audio) && rc == eav_success) {
+        for (int i=0; i<encoder_context->n_audio_output; i++)
+            av_write_trailer(encoder_context->format_context2[i]);
+    }
+    add_elapsed_ns(&encoder_context->video_timing.mux_ns, trailer_start);
+
+    /* Purge the audio/video channels */
+    elv_channel_close(xctx->vc, 1);
+    elv_channel_close(xctx->ac, 1);
+
+    char audio_last_dts_buf[(MAX_STREAMS + 1) * 20];
+    char audio_input_start_pts_buf[(MAX_STREAMS + 1) * 20];
+    char audio_last_pts_read_buf[(MAX_STREAMS + 1) * 20];
+    char audio_last_pts_sent_encode_buf[(MAX_STREAMS + 1) * 20];
+    char audio_last_pts_encoded_buf[(MAX_STREAMS + 1) * 20];
+    audio_last_dts_buf[0] = '\0';
+    audio_input_start_pts_buf[0] = '\0';
+    audio_last_pts_read_buf[0] = '\0';
+    audio_last_pts_sent_encode_buf[0] = '\0';
+    audio_last_pts_encoded_buf[0] = '\0';
+    for (int i=0; i<params->n_audio; i++) {
+        char buf[32];
+        int audio_index = params->audio_index[i];
+        if (i > 0) {
+            strncat(audio_last_dts_buf, ",", (MAX_STREAMS + 1) * 20 - strlen(audio_last_dts_buf));
+            strncat(audio_input_start_pts_buf, ",", (MAX_STREAMS + 1) * 20 - strlen(audio_input_start_pts_buf));
+            strncat(audio_last_pts_read_buf, ",", (MAX_STREAMS + 1) * 20 - strlen(audio_last_pts_read_buf));
+            strncat(audio_last_pts_sent_encode_buf, ",", (MAX_STREAMS + 1) * 20 - strlen(audio_last_pts_sent_encode_buf));
+            strncat(audio_last_pts_encoded_buf, ",", (MAX_STREAMS + 1) * 20 - strlen(audio_last_pts_encoded_buf));
+        }
+        sprintf(buf, "%"PRId64, encoder_context->audio_last_dts[audio_index]);
+        strncat(audio_last_dts_buf, buf, (MAX_STREAMS + 1) * 20 - strlen(audio_last_dts_buf));
+        sprintf(buf, "%"PRId64, encoder_context->audio_input_start_pts[audio_index]);
+        strncat(audio_input_start_pts_buf, buf, (MAX_STREAMS + 1) * 20 - strlen(audio_input_start_pts_buf));
+        sprintf(buf, "%"PRId64, encoder_context->audio_last_pts_read[audio_index]);
+        strncat(audio_last_pts_read_buf, buf, (MAX_STREAMS + 1) * 20 - strlen(audio_last_pts_read_buf));
+        sprintf(buf, "%"PRId64, encoder_context->audio_last_pts_sent_encode[audio_index]);
+        strncat(audio_last_pts_sent_encode_buf, buf, (MAX_STREAMS + 1) * 20 - strlen(audio_last_pts_sent_encode_buf));
+        sprintf(buf, "%"PRId64, encoder_context->audio_last_pts_encoded[audio_index]);
+        strncat(audio_last_pts_encoded_buf, buf, (MAX_STREAMS + 1) * 20 - strlen(audio_last_pts_encoded_buf));
+    } 
+
+    elv_log("avpipe_xc done url=%s, rc=%d, xctx->err=%d, xc-type=%d, "
+        "last video_pts=%"PRId64" audio_pts=%"PRId64
+        " video_input_start_pts=%"PRId64" audio_input_start_pts=[%s]"
+        " video_last_dts=%"PRId64" audio_last_dts=[%s]"
+        " video_last_pts_read=%"PRId64" audio_last_pts_read=[%s]"
+        " video_pts_sent_encode=%"PRId64" audio_last_pts_sent_encode=[%s]"
+        " last_pts_encoded=%"PRId64" audio_last_pts_encoded=[%s]",
+        params->url,
+        rc, xctx->err, params->xc_type,
+        encoder_context->video_pts,
+        encoder_context->audio_pts,
+        encoder_context->video_input_start_pts,
+        audio_input_start_pts_buf,
+        encoder_context->video_last_dts,
+        audio_last_dts_buf,
+        encoder_context->video_last_pts_read,
+        audio_last_pts_read_buf,
+        encoder_context->video_last_pts_sent_encode,
+        audio_last_pts_sent_encode_buf,
+        encoder_context->video_last_pts_encoded,
+        audio_last_pts_encoded_buf);
+
+    report_xc_timing(xctx, xc_start);
+
+    decoder_context->stopped = 1;
+    encoder_context->stopped = 1;
+
+    if (decoder_context->cancelled) {
+        elv_warn("transcoding session cancelled, handle=%d, url=%s", xctx->handle, params->url);
+        return eav_cancelled;
+    }
+
+    /* If there was an error in reading frames, return that error */
+    if (rc != eav_success)
+        return rc;
+
+    /* The last segments are closed by av_write_trailer() */
+    if (params->fail_on_verify_error && encoder_context->segments_verify_failed > 0 && xctx->err == eav_success) {
+        elv_err("%d segment(s) failed decode verification, url=%s", encoder_context->segments_verify_failed, params->url);
+        return eav_verify_segment;
+    }
+
+    /* Return transcoding error code */
+    return xctx->err;
+}
+
+typedef struct channel_layout_info_t {
+    const char *name;
+    int         nb_channels;
+    uint64_t    layout;
+} channel_layout_info_t;
+
+typedef struct channel_name_t {
+    const char *name;
+    const char *description;
+} channel_name_t;
+
+const channel_layout_info_t channel_layout_map[] = {
+    { "mono",        1,  AV_CH_LAYOUT_MONO },
+    { "stereo",      2,  AV_CH_LAYOUT_STEREO },
+    { "2.1",         3,  AV_CH_LAYOUT_2POINT1 },
+    { "3.0",         3,  AV_CH_LAYOUT_SURROUND },
+    { "3.0(back)",   3,  AV_CH_LAYOUT_2_1 },
+    { "4.0",         4,  AV_CH_LAYOUT_4POINT0 },
+    { "quad",        4,  AV_CH_LAYOUT_QUAD },
+    { "quad(side)",  4,  AV_CH_LAYOUT_2_2 },
+    { "3.1",         4,  AV_CH_LAYOUT_3POINT1 },
+    { "5.0",         5,  AV_CH_LAYOUT_5POINT0_BACK },
+    { "5.0(side)",   5,  AV_CH_LAYOUT_5POINT0 },
+    { "4.1",         5,  AV_CH_LAYOUT_4POINT1 },
+    { "5.1",         6,  AV_CH_LAYOUT_5POINT1_BACK },
+    { "5.1(side)",   6,  AV_CH_LAYOUT_5POINT1 },
+    { "6.0",         6,  AV_CH_LAYOUT_6POINT0 },
+    { "6.0(front)",  6,  AV_CH_LAYOUT_6POINT0_FRONT },
+    { "hexagonal",   6,  AV_CH_LAYOUT_HEXAGONAL },
+    { "6.1",         7,  AV_CH_LAYOUT_6POINT1 },
+    { "6.1(back)",   7,  AV_CH_LAYOUT_6POINT1_BACK },
+    { "6.1(front)",  7,  AV_CH_LAYOUT_6POINT1_FRONT },
+    { "7.0",         7,  AV_CH_LAYOUT_7POINT0 },
+    { "7.0(front)",  7,  AV_CH_LAYOUT_7POINT0_FRONT },
+    { "7.1",         8,  AV_CH_LAYOUT_7POINT1 },
+    { "7.1(wide)",   8,  AV_CH_LAYOUT_7POINT1_WIDE_BACK },
+    { "7.1(wide-side)",   8,  AV_CH_LAYOUT_7POINT1_WIDE },
+    { "octagonal",   8,  AV_CH_LAYOUT_OCTAGONAL },
+    { "hexadecagonal", 16, AV_CH_LAYOUT_HEXADECAGONAL },
+    { "downmix",     2,  AV_CH_LAYOUT_STEREO_DOWNMIX, },
+};
+
+static const struct channel_name_t channel_names[] = {
+     [0] = { "FL",        "front left"            },
+     [1] = { "FR",        "front right"           },
+     [2] = { "FC",        "front center"          },
+     [3] = { "LFE",       "low frequency"         },
+     [4] = { "BL",        "back left"             },
+     [5] = { "BR",        "back right"            },
+     [6] = { "FLC",       "front left-of-center"  },
+     [7] = { "FRC",       "front right-of-center" },
+     [8] = { "BC",        "back center"           },
+     [9] = { "SL",        "side left"             },
+    [10] = { "SR",        "side right"            },
+    [11] = { "TC",        "top center"            },
+    [12] = { "TFL",       "top front left"        },
+    [13] = { "TFC",       "top front center"      },
+    [14] = { "TFR",       "top front right"       },
+    [15] = { "TBL",       "top back left"         },
+    [16] = { "TBC",       "top back center"       },
+    [17] = { "TBR",       "top back right"        },
+    [29] = { "DL",        "downmix left"          },
+    [30] = { "DR",        "downmix right"         },
+    [31] = { "WL",        "wide left"             },
+    [32] = { "WR",        "wide right"            },
+    [33] = { "SDL",       "surround direct left"  },
+    [34] = { "SDR",       "surround direct right" },
+    [35] = { "LFE2",      "low frequency 2"       },
+};
+
+static const channel_layout_info_t*
+get_channel_layout_info(
+    int nb_channels,
+    int channel_layout)
+{
+    for (int i = 0; i < sizeof(channel_layout_map)/sizeof(channel_layout_map[0]); i++) {
+        if (nb_channels == channel_layout_map[i].nb_channels &&
+            channel_layout_map[i].layout == channel_layout)
+            return &channel_layout_map[i];
+    }
+
+    return NULL;
+}
+
+static const char*
+get_channel_name(
+    int channel_layout)
+{
+    if (channel_layout < 0 || channel_layout >= sizeof(channel_names)/sizeof(channel_names[0]))
+        return "";
+    return channel_names[channel_layout].name;
+}
+
+const char*
+avpipe_channel_layout_name(
+    int channel_layout)
+{
+    for (int i = 0; i < sizeof(channel_layout_map)/sizeof(channel_layout_map[0]); i++) {
+        if (channel_layout_map[i].layout == channel_layout)
+            return channel_layout_map[i].name;
+    }
+
+    return "";
+}
+
+const char*
+avpipe_channel_name(
+    int nb_channels,
+    int channel_layout)
+{
+    const channel_layout_info_t *info = get_channel_layout_info(nb_channels, channel_layout);
+    if (info != NULL) {
+        return info->name;
+    }
+
+    for (int i = 0; i < 64; i++) {
+        if ((channel_layout & (UINT64_C(1) << i))) {
+            const char *name = get_channel_name(i);
+            if (name)
+                return name;
+        }
+    }
+
+    return "";
+}
+
+static const char*
+get_xc_type_name(
+    xc_type_t xc_type)
+{
+    switch (xc_type) {
+    case xc_video:
+        return "xc_video";
+    case xc_audio:
+        return "xc_audio";
+    case xc_all:
+        return "xc_all";
+    case xc_audio_join:
+        return "xc_audio_join";
+    case xc_audio_pan:
+        return "xc_audio_pan";
+    case xc_audio_merge:
+        return "xc_audio_merge";
+    case xc_mux:
+        return "xc_mux";
+    case xc_extract_images:
+        return "xc_extract_images";
+    case xc_extract_all_images:
+        return "xc_extract_all_images";
+    case xc_probe:
+        return "xc_probe";
+    case xc_subtitle:
+        return "xc_subtitle";
+    case xc_still:
+        return "xc_still";
+    default:
+        return "none";
+    }
+
+    return "none";
+}
+
+/*
+ * Returns 1 if the input is a still image (JPEG, PNG, WebP, ...) or an animated image (GIF, APNG).
+ */
+static int
+is_image_format(
+    AVFormatContext *format_context)
+{
+    const char *name = format_context->iformat ? format_context->iformat->name : NULL;
+    size_t len;
+
+    if (!name)
+        return 0;
+
+    if (!strcmp(name, "image2") || !strcmp(name, "gif") || !strcmp(name, "apng"))
+        return 1;
+
+    /* Single image demuxers are named after the codec, i.e. png_pipe, jpeg_pipe, webp_pipe */
+    len = strlen(name);
+    return len > 5 && !strcmp(name + len - 5, "_pipe");
+}
+
+/* Number of packets read by probe to detect a variable frame rate */
+#define VFR_PROBE_PACKETS   300
+
+static int
+cmp_int64(
+    const void *a,
+    const void *b)
+{
+    int64_t x = *(const int64_t *) a, y = *(const int64_t *) b;
+    return x < y ? -1 : x > y;
+}
+
+/*
+ * Returns 1 if the frame durations of the n timestamps (sorted in place) vary by more than 25%, ignoring
+ * differences of one tick due to rounding.
+ */
+static int
+is_vfr_timestamps(
+    int64_t *pts,
+    int n)
+{
+    int64_t min = INT64_MAX, max = 0;
+
+    qsort(pts, n, sizeof(int64_t), cmp_int64);
+    for (int i = 1; i < n; i++) {
+        int64_t d = pts[i] - pts[i-1];
+        if (d <= 0)
+            continue;
+        if (d < min)
+            min = d;
+        if (d > max)
+            max = d;
+    }
+
+    return max > 0 && max - min > 1 && max * 4 > min * 5;
+}
+
+/*
+ * Reads the first packets of the input to detect the video streams with a variable frame rate. Image
+ * demuxers don't report the number of frames, so for images all the packets are read to count them.
+ * This is only done for images which are small enough to be read entirely while probing.
+ */
+static void
+scan_packets(
+    coderctx_t *decoder_context,
+    int is_image,
+    int is_vfr[MAX_STREAMS])
+{
+    AVFormatContext *format_context = decoder_context->format_context;
+    int nb_streams = format_context->nb_streams < MAX_STREAMS ? format_context->nb_streams : MAX_STREAMS;
+    int64_t nb_frames[MAX_STREAMS] = {0};
+    int64_t *pts[MAX_STREAMS] = {0};
+    int n_pts[MAX_STREAMS] = {0};
+    int n_packets = 0;
+    AVPacket *pkt;
+
+    /* Reading ahead would hold a live source */
+    if (is_live_source(decoder_context))
+        return;
+
+    pkt = av_packet_alloc();
+    if (!pkt)
+        return;
+
+    for (int i = 0; i < nb_streams; i++) {
+        if (format_context->streams[i]->codecpar->codec_type == AVMEDIA_TYPE_VIDEO)
+            pts[i] = (int64_t *) calloc(VFR_PROBE_PACKETS, sizeof(int64_t));
+    }
+
+    while ((is_image || n_packets < VFR_PROBE_PACKETS) && av_read_frame(format_context, pkt) >= 0) {
+        int i = pkt->stream_index;
+        int64_t ts = pkt->pts != AV_NOPTS_VALUE ? pkt->pts : pkt->dts;
+        n_packets++;
+        if (i < nb_streams) {
+            nb_frames[i]++;
+            if (pts[i] && n_pts[i] < VFR_PROBE_PACKETS && ts != AV_NOPTS_VALUE)
+                pts[i][n_pts[i]++] = ts;
+        }
+        av_packet_unref(pkt);
+    }
+    av_packet_free(&pkt);
+
+    for (int i = 0; i < nb_streams; i++) {
+        if (is_image && format_context->streams[i]->nb_frames <= 0)
+            format_context->streams[i]->nb_frames = nb_frames[i];
+        if (pts[i]) {
+            is_vfr[i] = n_pts[i] > 2 && is_vfr_timestamps(pts[i], n_pts[i]);
+            free(pts[i]);
+        }
+    }
+}
+
+int
+avpipe_probe(
+    avpipe_io_handler_t *in_handlers,
+    xcparams_t *params,
+    xcprobe_t **xcprobe,
+    int *n_streams)
+{
+    ioctx_t inctx;
+    coderctx_t decoder_ctx;
+    stream_info_t *stream_probes, *stream_probes_ptr;
+    xcprobe_t *probe;
+    int rc = 0;
+    char *url;
+
+    memset(&inctx, 0, sizeof(ioctx_t));
+    memset(&decoder_ctx, 0, sizeof(coderctx_t));
+
+    if (!params) {
+        elv_err("avpipe_probe parameters are not set");
+        rc = eav_param;
+        goto avpipe_probe_end;
+    }
+
+    url = params->url;
+    // Disable sync audio to stream id when probing
+    params->sync_audio_to_stream_id = -1;
+    params->stream_id = -1;
+
+    if (!in_handlers) {
+        elv_err("avpipe_probe NULL handlers, url=%s", url);
+        rc = eav_param;
+        goto avpipe_probe_end;
+    }
+
+    inctx.params = params;
+    if (in_handlers->avpipe_opener(url, &inctx) < 0) {
+        elv_err("avpipe_probe failed to open the input, url=%s", url);
+        rc = eav_open_input;
+        goto avpipe_probe_end;
+    }
+
+    if ((rc = prepare_decoder(&decoder_ctx, in_handlers, &inctx, params, params->seekable)) != eav_success) {
+        /* Tell apart the inputs that can't be read from the ones that are not media, to help deciding on a retry */
+        if (rc == eav_open_input && decoder_ctx.open_input_err == AVERROR_INVALIDDATA)
+            rc = eav_unsupported_format;
+        else if (rc == eav_open_input && decoder_ctx.open_input_err == AVERROR(ETIMEDOUT))
+            rc = eav_io_timeout;
+        elv_err("avpipe_probe failed to prepare decoder, url=%s, rc=%d", url, rc);
+        goto avpipe_probe_end;
+    }
+
+    int nb_streams = decoder_ctx.format_context->nb_streams;
+    if (nb_streams <= 0) {
+        elv_err("avpipe_probe found no streams, url=%s", url);
+        rc = eav_num_streams;
+        goto avpipe_probe_end;
+    }
+
+    int is_image = is_image_format(decoder_ctx.format_context);
+    int is_vfr[MAX_STREAMS] = {0};
+    scan_packets(&decoder_ctx, is_image, is_vfr);
+
+    int nb_skipped_streams = 0;
+    probe = (xcprobe_t *)calloc(1, sizeof(xcprobe_t));
+    probe->container_info.is_image = is_image;
+    stream_probes = (stream_info_t *)calloc(1, sizeof(stream_info_t)*nb_streams);
+    for (int i=0; i<nb_streams; i++) {
+        AVStream *s = decoder_ctx.format_context->streams[i];
+        AVCodecContext *codec_context = decoder_ctx.codec_context[i];
+        AVCodec *codec = decoder_ctx.codec[i];
+        AVRational sar, dar;
+
+        if (!codec_context) {
+            nb_skipped_streams++;
+            continue;
+        }
+        stream_probes_ptr = &stream_probes[i-nb_skipped_streams];
+        stream_probes_ptr->stream_index = i;
+        stream_probes_ptr->stream_id = s->id;
+        if (codec) {
+            stream_probes_ptr->codec_type = codec->type;
+            stream_probes_ptr->codec_id = codec->id;
+            strncpy(stream_probes_ptr->codec_name, codec->name, MAX_CODEC_NAME);
+        } else {
+            stream_probes_ptr->codec_type = decoder_ctx.format_context->streams[i]->codecpar->codec_type;
+        }
+        stream_probes_ptr->codec_name[MAX_CODEC_NAME] = '\0';
+
+        // Estimate duration if not provided by the stream format
+        if (s->duration <= 0) {
+            // Check for tag 'duration' of format "HH:MM:SS.SUB"
+            AVDictionaryEntry *d = NULL;
+            d = av_dict_get(s->metadata, "duration", NULL, 0);
+            if (d) {
+                int64_t duration_ts = parse_duration(d->value, s->time_base);
+                if (duration_ts > 0) {
+                    s->duration = duration_ts;
+                    av_dict_set(&s->metadata,"avpipe", "duration estimated from tag", 0);
+                }
+            }
+        }
+
+        // Start time is optional - set to 0 if not explicitly specified
+        if (s->start_time == AV_NOPTS_VALUE) {
+            s->start_time = 0;
+        }
+
+        stream_probes_ptr->duration_ts = s->duration;
+        stream_probes_ptr->time_base = s->time_base;
+        stream_probes_ptr->nb_frames = s->nb_frames;
+        stream_probes_ptr->start_time = s->start_time;
+        stream_probes_ptr->avg_frame_rate = s->avg_frame_rate;
+        stream_probes_ptr->disposition = s->disposition;
+        stream_probes_ptr->is_vfr = i < MAX_STREAMS ? is_vfr[i] : 0;
+
+        // Find sample asperct ratio and diplay aspect ratio
+        sar = av_guess_sample_aspect_ratio(decoder_ctx.format_context, s, NULL);
+        if (sar.num) {
+            stream_probes_ptr->sample_aspect_ratio = sar;
+            av_reduce(&dar.num, &dar.den,
+                      codec_context->width  * sar.num,
+                      codec_context->height * sar.den,
+                      1024*1024);
+            stream_probes_ptr->display_aspect_ratio = dar;
+        } else {
+            stream_probes_ptr->sample_aspect_ratio = codec_context->sample_aspect_ratio;
+        }
+
+        stream_probes_ptr->frame_rate = s->r_frame_rate;
+        stream_probes_ptr->ticks_per_frame = codec_context->ticks_per_frame;
+        stream_probes_ptr->bit_rate = codec_context->bit_rate;
+        stream_probes_ptr->has_b_frames = codec_context->has_b_frames;
+        stream_probes_ptr->sample_rate = codec_context->sample_rate;
+        stream_probes_ptr->channels = codec_context->channels;
+        if (codec && codec->type == AVMEDIA_TYPE_AUDIO)
+            stream_probes_ptr->channel_layout = codec_context->channel_layout;
+        else
+            stream_probes_ptr->channel_layout = -1;
+        stream_probes_ptr->width = codec_context->width;
+        stream_probes_ptr->height = codec_context->height;
+        stream_probes_ptr->pix_fmt = codec_context->pix_fmt;
+        stream_probes_ptr->field_order = codec_context->field_order;
+        if (s->codecpar->codec_type == AVMEDIA_TYPE_VIDEO) {
+            stream_probes_ptr->color_primaries = av_color_primaries_name(s->codecpar->color_primaries);
+            stream_probes_ptr->color_trc = av_color_transfer_name(s->codecpar->color_trc);
+            stream_probes_ptr->color_space = av_color_space_name(s->codecpar->color_space);
+            stream_probes_ptr->color_range = av_color_range_name(s->codecpar->color_range);
+        }
+        stream_probes_ptr->bits_per_raw_sample = s->codecpar->bits_per_raw_sample > 0 ?
+            s->codecpar->bits_per_raw_sample : codec_context->bits_per_raw_sample;
+        if (stream_probes_ptr->bits_per_raw_sample <= 0 && s->codecpar->codec_type == AVMEDIA_TYPE_VIDEO) {
+            const AVPixFmtDescriptor *desc = av_pix_fmt_desc_get(codec_context->pix_fmt);
+            stream_probes_ptr->bits_per_raw_sample = desc ? desc->comp[0].depth : 0;
+        }
+        stream_probes_ptr->profile = codec_context->profile;
+        stream_probes_ptr->level = codec_context->level;
+
+        // Set container duration if necessary
+        if (probe->container_info.duration <
+            ((float)stream_probes_ptr->duration_ts)/stream_probes_ptr->time_base.den)
+            probe->container_info.duration =
+                ((float)stream_probes_ptr->duration_ts)/stream_probes_ptr->time_base.den;
+
+        /* Keep duplicate keys (i.e multiple language or title entries) instead of overwriting them */
+        av_dict_copy(&stream_probes_ptr->tags, s->metadata, AV_DICT_MULTIKEY);
+
+        stream_probes_ptr->rotation = get_display_rotation(s);
+
+        for (int i = 0; i < s->nb_side_data; i++) {
+            const AVPacketSideData *sd = &s->side_data[i];
+            switch (sd->type) {
+                case AV_PKT_DATA_DISPLAYMATRIX:
+                    stream_probes_ptr->side_data.display_matrix.rotation = av_display_rotation_get((int32_t *)sd->data);
+                    double rot = stream_probes_ptr->side_data.display_matrix.rotation;
+                    // Convert from CCW [-180:180] value to straight CW
+                    rot = rot >= 0 ? rot : 360.0 + rot;
+                    rot = rot > 0 ? 360 - rot : 0;
+                    stream_probes_ptr->side_data.display_matrix.rotation_cw = rot;
+                    break;
+                case AV_PKT_DATA_MASTERING_DISPLAY_METADATA: {
+                    const AVMasteringDisplayMetadata *mdm = (const AVMasteringDisplayMetadata *) sd->data;
+                    side_data_mastering_display_t *md = &stream_probes_ptr->side_data.mastering_display;
+                    if (!mdm->has_primaries || !mdm->has_luminance)
+                        break;
+                    md->present = 1;
+                    md->red_x = av_q2d(mdm->display_primaries[0][0]);
+                    md->red_y = av_q2d(mdm->display_primaries[0][1]);
+                    md->green_x = av_q2d(mdm->display_primaries[1][0]);
+                    md->green_y = av_q2d(mdm->display_primaries[1][1]);
+                    md->blue_x = av_q2d(mdm->display_primaries[2][0]);
+                    md->blue_y = av_q2d(mdm->display_primaries[2][1]);
+                    md->white_point_x = av_q2d(mdm->white_point[0]);
+                    md->white_point_y = av_q2d(mdm->white_point[1]);
+                    md->min_luminance = av_q2d(mdm->min_luminance);
+                    md->max_luminance = av_q2d(mdm->max_luminance);
+                    break;
+                }
+                case AV_PKT_DATA_CONTENT_LIGHT_LEVEL: {
+                    const AVContentLightMetadata *clm = (const AVContentLightMetadata *) sd->data;
+                    stream_probes_ptr->side_data.content_light.present = 1;
+                    stream_probes_ptr->side_data.content_light.max_content = clm->MaxCLL;
+                    stream_probes_ptr->side_data.content_light.max_average = clm->MaxFALL;
+                    break;
                 }
+                default:
+                    // Not handled
+                    break;
+            }
+        }
+    }
+
+    inctx.closed = 1;
+    probe->stream_info = stream_probes;
+
+    /* Programs of a multi-program input (i.e. the services of an MPEG-TS), all of them even if program_id is set */
+    AVFormatContext *format_context = decoder_ctx.format_context;
+    if (format_context->nb_programs > 0) {
+        probe->program_info = (program_info_t *)calloc(format_context->nb_programs, sizeof(program_info_t));
+        probe->n_programs = format_context->nb_programs;
+        for (int i = 0; i < format_context->nb_programs; i++) {
+            AVProgram *program = format_context->programs[i];
+            program_info_t *program_info = &probe->program_info[i];
+            program_info->program_id = program->id;
+            if (program->nb_stream_indexes > 0) {
+                program_info->stream_indexes = (int *)calloc(program->nb_stream_indexes, sizeof(int));
+                for (unsigned int j = 0; j < program->nb_stream_indexes; j++)
+                    program_info->stream_indexes[j] = program->stream_index[j];
+                program_info->n_stream_indexes = program->nb_stream_indexes;
+            }
+            av_dict_copy(&program_info->tags, program->metadata, AV_DICT_MULTIKEY);
+        }
+    }
+    probe->container_info.format_name = strdup(decoder_ctx.format_context->iformat->name);
+    probe->container_info.bit_rate = decoder_ctx.format_context->bit_rate;
+    av_dict_copy(&probe->container_info.tags, decoder_ctx.format_context->metadata, AV_DICT_MULTIKEY);
+    *xcprobe = probe;
+    *n_streams = nb_streams - nb_skipped_streams;
+
+avpipe_probe_end:
+    if (decoder_ctx.format_context) {
+        if (decoder_ctx.format_context->flags & AVFMT_FLAG_CUSTOM_IO) {
+            AVIOContext *avioctx = decoder_ctx.format_context->pb;
+            if (avioctx) {
+                av_freep(&avioctx->buffer);
+                av_freep(&avioctx);
+            }
+        }
+        avformat_close_input(&decoder_ctx.format_context);
+    }
+
+    for (int i=0; i<MAX_STREAMS; i++) {
+        if (decoder_ctx.codec_context[i]) {
+            /* Corresponds to avcodec_open2() */
+            avcodec_close(decoder_ctx.codec_context[i]);
+            avcodec_free_context(&decoder_ctx.codec_context[i]);
+        }
+    }
+
+    /* Close input handler resources */
+    in_handlers->avpipe_closer(&inctx);
+
+    return rc;
+}
+
+int
+avpipe_probe_header(
+    avpipe_io_handler_t *in_handlers,
+    xcparams_t *params,
+    container_info_t *container_info)
+{
+    ioctx_t inctx;
+    coderctx_t decoder_ctx;
+    AVFormatContext *format_context;
+    int rc = eav_success;
+    char *url;
+
+    memset(&inctx, 0, sizeof(ioctx_t));
+    memset(&decoder_ctx, 0, sizeof(coderctx_t));
+
+    if (!params || !in_handlers || !container_info) {
+        elv_err("avpipe_probe_header parameters are not set");
+        return eav_param;
+    }
+
+    url = params->url;
+    inctx.params = params;
+    if (in_handlers->avpipe_opener(url, &inctx) < 0) {
+        elv_err("avpipe_probe_header failed to open the input, url=%s", url);
+        rc = eav_open_input;
+        goto avpipe_probe_header_end;
+    }
+
+    decoder_ctx.format_context = avformat_alloc_context();
+    if (!decoder_ctx.format_context) {
+        elv_err("Could not allocate memory for Format Context, url=%s", url);
+        rc = eav_mem_alloc;
+        goto avpipe_probe_header_end;
+    }
+    decoder_ctx.live_proto = find_live_proto(&inctx);
+    prepare_input(in_handlers, &inctx, &decoder_ctx, params->seekable, params->io_buffer_size);
+
+    rc = avformat_open_input(&decoder_ctx.format_context, inctx.url, NULL, NULL);
+    if (rc != 0) {
+        elv_err("avpipe_probe_header could not open input, err=%s (%d), url=%s", av_err2str(rc), rc, url);
+        rc = rc == AVERROR_INVALIDDATA ? eav_unsupported_format : eav_open_input;
+        goto avpipe_probe_header_end;
+    }
+    format_context = decoder_ctx.format_context;
+
+    /* The containers without a global header (i.e. MPEG-TS) have no duration until their first packets are read */
+    if (format_context->duration == AV_NOPTS_VALUE || format_context->duration <= 0) {
+        if (avformat_find_stream_info(format_context, NULL) < 0)
+            elv_warn("avpipe_probe_header could not get input stream info, url=%s", url);
+    }
+
+    container_info->format_name = strdup(format_context->iformat->name);
+    if (format_context->duration != AV_NOPTS_VALUE && format_context->duration > 0)
+        container_info->duration = (float)format_context->duration / AV_TIME_BASE;
+    container_info->bit_rate = format_context->bit_rate;
+    if (container_info->bit_rate <= 0 && container_info->duration > 0 && inctx.sz > 0)
+        container_info->bit_rate = (int64_t)(inctx.sz * 8 / container_info->duration);
+    container_info->is_image = is_image_format(format_context);
+    av_dict_copy(&container_info->tags, format_context->metadata, AV_DICT_MULTIKEY);
+    inctx.closed = 1;
+
+    elv_log("avpipe_probe_header format=%s duration=%f bit_rate=%"PRId64" read_bytes=%"PRId64", url=%s",
+        container_info->format_name, container_info->duration, container_info->bit_rate, inctx.read_bytes, url);
+
+avpipe_probe_header_end:
+    if (decoder_ctx.format_context) {
+        if (decoder_ctx.format_context->flags & AVFMT_FLAG_CUSTOM_IO) {
+            AVIOContext *avioctx = decoder_ctx.format_context->pb;
+            if (avioctx) {
+                av_freep(&avioctx->buffer);
+                av_freep(&avioctx);
+            }
+        }
+        avformat_close_input(&decoder_ctx.format_context);
+    }
+
+    /* Close input handler resources */
+    in_handlers->avpipe_closer(&inctx);
+
+    return rc;
+}
+
+int avpipe_probe_free(xcprobe_t *probe, int n_streams) {
+    if (probe == NULL)
+        return 0;
+
+    for (int i=0; i<n_streams; i++) {
+        av_dict_free(&probe->stream_info[i].tags);
+    }
+    free(probe->stream_info);
+    av_dict_free(&probe->container_info.tags);
+    for (int i=0; i<probe->n_programs; i++) {
+        free(probe->program_info[i].stream_indexes);
+        av_dict_free(&probe->program_info[i].tags);
+    }
+    free(probe->program_info);
+
+    free(probe);
+    return 0;
+}
+
+/*
+ * Appends the decoded frame to the frames array, growing the array if necessary.
+ */
+static int
+append_frame_info(
+    AVFrame *frame,
+    frame_info_t **frames,
+    int *n_frames,
+    int *capacity)
+{
+    frame_info_t *info;
+
+    if (*n_frames >= *capacity) {
+        int new_capacity = *capacity > 0 ? *capacity * 2 : 256;
+        frame_info_t *new_frames = (frame_info_t *) realloc(*frames, sizeof(frame_info_t) * new_capacity);
+        if (!new_frames)
+            return eav_mem_alloc;
+        *frames = new_frames;
+        *capacity = new_capacity;
+    }
+
+    info = &(*frames)[*n_frames];
+    info->pts = frame->best_effort_timestamp;
+    info->dts = frame->pkt_dts;
+    info->key_frame = frame->key_frame;
+    info->pict_type = av_get_picture_type_char(frame->pict_type);
+    info->packet_size = frame->pkt_size;
+    (*n_frames)++;
+
+    return eav_success;
+}
+
+int
+avpipe_probe_frames(
+    avpipe_io_handler_t *in_handlers,
+    xcparams_t *params,
+    int stream_index,
+    int max_frames,
+    frame_info_t **frames,
+    int *n_frames)
+{
+    ioctx_t inctx;
+    coderctx_t decoder_ctx;
+    AVCodecContext *codec_context;
+    AVPacket *packet = NULL;
+    AVFrame *frame = NULL;
+    frame_info_t *frame_infos = NULL;
+    int capacity = 0;
+    int count = 0;
+    int eof = 0;
+    int rc = 0;
+    int ret;
+    char *url;
+
+    memset(&inctx, 0, sizeof(ioctx_t));
+    memset(&decoder_ctx, 0, sizeof(coderctx_t));
+
+    if (!params || !in_handlers) {
+        elv_err("avpipe_probe_frames parameters are not set");
+        return eav_param;
+    }
+
+    url = params->url;
+    params->sync_audio_to_stream_id = -1;
+    params->stream_id = -1;
+
+    inctx.params = params;
+    if (in_handlers->avpipe_opener(url, &inctx) < 0) {
+        rc = eav_open_input;
+        goto avpipe_probe_frames_end;
+    }
+
+    if ((rc = prepare_decoder(&decoder_ctx, in_handlers, &inctx, params, params->seekable)) != eav_success) {
+        elv_err("avpipe_probe_frames failed to prepare decoder, url=%s", url);
+        goto avpipe_probe_frames_end;
+    }
+
+    if (stream_index < 0 || stream_index >= decoder_ctx.format_context->nb_streams ||
+        stream_index >= MAX_STREAMS || !decoder_ctx.codec_context[stream_index]) {
+        elv_err("avpipe_probe_frames invalid stream_index=%d, url=%s", stream_index, url);
+        rc = eav_stream_index;
+        goto avpipe_probe_frames_end;
+    }
+    codec_context = decoder_ctx.codec_context[stream_index];
+
+    packet = av_packet_alloc();
+    frame = av_frame_alloc();
+    if (!packet || !frame) {
+        rc = eav_mem_alloc;
+        goto avpipe_probe_frames_end;
+    }
+
+    while (max_frames <= 0 || count < max_frames) {
+        if (!eof) {
+            ret = av_read_frame(decoder_ctx.format_context, packet);
+            if (ret < 0) {
+                /* Flush the decoder to get the remaining frames */
+                eof = 1;
+                ret = avcodec_send_packet(codec_context, NULL);
+            } else if (packet->stream_index != stream_index) {
+                av_packet_unref(packet);
+                continue;
             } else {
-                if (debug_frame_level)
-                    elv_dbg("Skip stream - packet index=%d, pts=%"PRId64" dts=%"PRId64" url=%s",
-                        input_packet->stream_index, input_packet->pts, input_packet->dts, params->url);
+                ret = avcodec_send_packet(codec_context, packet);
+                av_packet_unref(packet);
+            }
+
+            if (ret < 0 && ret != AVERROR_INVALIDDATA && ret != AVERROR_EOF) {
+                elv_err("avpipe_probe_frames failed to send packet to the decoder: %s, url=%s", av_err2str(ret), url);
+                rc = eav_send_packet;
+                goto avpipe_probe_frames_end;
+            }
+        }
+
+        while (max_frames <= 0 || count < max_frames) {
+            ret = avcodec_receive_frame(codec_context, frame);
+            if (ret == AVERROR(EAGAIN) || ret == AVERROR_EOF)
+                break;
+            if (ret < 0) {
+                elv_err("avpipe_probe_frames failed to receive frame from the decoder: %s, url=%s", av_err2str(ret), url);
+                rc = eav_receive_frame;
+                goto avpipe_probe_frames_end;
+            }
+
+            rc = append_frame_info(frame, &frame_infos, &count, &capacity);
+            av_frame_unref(frame);
+            if (rc != eav_success)
+                goto avpipe_probe_frames_end;
+        }
+
+        /* The decoder is drained after flushing */
+        if (eof)
+            break;
+    }
+
+    elv_dbg("avpipe_probe_frames stream_index=%d, n_frames=%d, url=%s", stream_index, count, url);
+    inctx.closed = 1;
+
+avpipe_probe_frames_end:
+    if (rc == eav_success) {
+        *frames = frame_infos;
+        *n_frames = count;
+    } else {
+        free(frame_infos);
+    }
+
+    av_packet_free(&packet);
+    av_frame_free(&frame);
+
+    if (decoder_ctx.format_context) {
+        if (decoder_ctx.format_context->flags & AVFMT_FLAG_CUSTOM_IO) {
+            AVIOContext *avioctx = decoder_ctx.format_context->pb;
+            if (avioctx) {
+                av_freep(&avioctx->buffer);
+                av_freep(&avioctx);
             }
-            av_packet_free(&input_packet);
         }
+        avformat_close_input(&decoder_ctx.format_context);
     }
 
-xc_done:
-    elv_dbg("av_read_frame() av_read_frame_rc=%d, rc=%d, url=%s", av_read_frame_rc, rc, params->url);
+    for (int i=0; i<MAX_STREAMS; i++) {
+        if (decoder_ctx.codec_context[i]) {
+            /* Corresponds to avcodec_open2() */
+            avcodec_close(decoder_ctx.codec_context[i]);
+            avcodec_free_context(&decoder_ctx.codec_context[i]);
+        }
+    }
 
-    xctx->stop = 1;
-    /* Don't purge the channels, let the receiver to drain it */
-    elv_channel_close(xctx->vc, 0);
-    elv_channel_close(xctx->ac, 0);
-    pthread_join(xctx->vthread_id, NULL);
-    pthread_join(xctx->athread_id, NULL);
+    /* Close input handler resources */
+    in_handlers->avpipe_closer(&inctx);
 
-    if (params->copy_mpegts) {
-        cp_ctx_t *cp_ctx = &xctx->cp_ctx;
-        elv_channel_close(cp_ctx->ch, 0);
-        pthread_join(cp_ctx->thread_id, NULL);
+    return rc;
+}
+
+/* In memory input of avpipe_verify_segment: the init segment followed by the segment */
+typedef struct verify_input_t {
+    const uint8_t   *init_buf;
+    int64_t         init_len;
+    const uint8_t   *seg_buf;
+    int64_t         seg_len;
+    int64_t         pos;
+} verify_input_t;
+
+static int
+verify_read_packet(
+    void *opaque,
+    uint8_t *buf,
+    int buf_size)
+{
+    verify_input_t *input = (verify_input_t *) opaque;
+    int64_t total = input->init_len + input->seg_len;
+    int n = 0;
+
+    if (input->pos >= total)
+        return AVERROR_EOF;
+
+    while (n < buf_size && input->pos < total) {
+        int64_t len;
+        if (input->pos < input->init_len) {
+            len = FFMIN(buf_size - n, input->init_len - input->pos);
+            memcpy(buf + n, input->init_buf + input->pos, len);
+        } else {
+            len = FFMIN(buf_size - n, total - input->pos);
+            memcpy(buf + n, input->seg_buf + input->pos - input->init_len, len);
+        }
+        n += len;
+        input->pos += len;
+    }
+
+    return n;
+}
+
+static int64_t
+verify_seek(
+    void *opaque,
+    int64_t offset,
+    int whence)
+{
+    verify_input_t *input = (verify_input_t *) opaque;
+    int64_t total = input->init_len + input->seg_len;
+    int64_t pos;
+
+    switch (whence & ~AVSEEK_FORCE) {
+    case AVSEEK_SIZE:
+        return total;
+    case SEEK_SET:
+        pos = offset;
+        break;
+    case SEEK_CUR:
+        pos = input->pos + offset;
+        break;
+    case SEEK_END:
+        pos = total + offset;
+        break;
+    default:
+        return -1;
+    }
+
+    if (pos < 0 || pos > total)
+        return -1;
+
+    input->pos = pos;
+    return pos;
+}
+
+/*
+ * Sends the packet to the decoder (NULL flushes the decoder) and discards the decoded frames.
+ * Frames that are flagged corrupt by the decoder fail the verification.
+ */
+static int
+verify_decode(
+    AVCodecContext *codec_context,
+    AVPacket *packet,
+    AVFrame *frame,
+    int *n_frames,
+    const char *url)
+{
+    int ret = avcodec_send_packet(codec_context, packet);
+    if (ret < 0 && ret != AVERROR_EOF) {
+        elv_err("Segment verification failed to decode packet: %s, url=%s", av_err2str(ret), url);
+        return eav_send_packet;
+    }
+
+    while ((ret = avcodec_receive_frame(codec_context, frame)) >= 0) {
+        int corrupt = frame->decode_error_flags || (frame->flags & AV_FRAME_FLAG_CORRUPT);
+        av_frame_unref(frame);
+        if (corrupt) {
+            elv_err("Segment verification decoded a corrupt frame, url=%s", url);
+            return eav_receive_frame;
+        }
+        (*n_frames)++;
+    }
+
+    if (ret != AVERROR(EAGAIN) && ret != AVERROR_EOF) {
+        elv_err("Segment verification failed to receive frame: %s, url=%s", av_err2str(ret), url);
+        return eav_receive_frame;
+    }
+
+    return eav_success;
+}
+
+int
+avpipe_verify_segment(
+    const uint8_t *init_buf,
+    int64_t init_len,
+    const uint8_t *seg_buf,
+    int64_t seg_len,
+    const char *url)
+{
+    verify_input_t input;
+    AVFormatContext *format_context = NULL;
+    AVIOContext *avioctx = NULL;
+    AVCodecContext *codec_contexts[MAX_STREAMS];
+    AVPacket *packet = NULL;
+    AVFrame *frame = NULL;
+    uint8_t *avio_buf;
+    int n_packets = 0;
+    int n_frames = 0;
+    int rc = eav_success;
+    int ret;
+
+    if (!url)
+        url = "";
+
+    if (!seg_buf || seg_len <= 0 || (init_len > 0 && !init_buf)) {
+        elv_err("avpipe_verify_segment invalid segment, seg_len=%"PRId64", init_len=%"PRId64", url=%s",
+            seg_len, init_len, url);
+        return eav_param;
+    }
+
+    memset(codec_contexts, 0, sizeof(codec_contexts));
+    input.init_buf = init_buf;
+    input.init_len = init_buf ? init_len : 0;
+    input.seg_buf = seg_buf;
+    input.seg_len = seg_len;
+    input.pos = 0;
+
+    avio_buf = (uint8_t *) av_malloc(AVIO_IN_BUF_SIZE);
+    avioctx = avio_alloc_context(avio_buf, AVIO_IN_BUF_SIZE, 0, &input, verify_read_packet, NULL, verify_seek);
+    format_context = avformat_alloc_context();
+    if (!avio_buf || !avioctx || !format_context) {
+        rc = eav_mem_alloc;
+        goto avpipe_verify_segment_end;
+    }
+    format_context->pb = avioctx;
+    format_context->flags |= AVFMT_FLAG_CUSTOM_IO;
+
+    if ((ret = avformat_open_input(&format_context, NULL, NULL, NULL)) < 0) {
+        elv_err("Segment verification failed to open segment: %s, url=%s", av_err2str(ret), url);
+        rc = eav_open_input;
+        goto avpipe_verify_segment_end;
+    }
+
+    if ((ret = avformat_find_stream_info(format_context, NULL)) < 0) {
+        elv_err("Segment verification failed to get stream info: %s, url=%s", av_err2str(ret), url);
+        rc = eav_stream_info;
+        goto avpipe_verify_segment_end;
+    }
+
+    for (int i=0; i<format_context->nb_streams && i<MAX_STREAMS; i++) {
+        AVCodecParameters *codecpar = format_context->streams[i]->codecpar;
+        const AVCodec *codec;
+
+        if (codecpar->codec_type != AVMEDIA_TYPE_VIDEO && codecpar->codec_type != AVMEDIA_TYPE_AUDIO)
+            continue;
+
+        if (!(codec = avcodec_find_decoder(codecpar->codec_id))) {
+            elv_err("Segment verification found no decoder for stream_index=%d, codec_id=%d, url=%s",
+                i, codecpar->codec_id, url);
+            rc = eav_codec_context;
+            goto avpipe_verify_segment_end;
+        }
+
+        codec_contexts[i] = avcodec_alloc_context3(codec);
+        if (!codec_contexts[i] || avcodec_parameters_to_context(codec_contexts[i], codecpar) < 0) {
+            rc = eav_codec_context;
+            goto avpipe_verify_segment_end;
+        }
+        /* Report bitstream errors instead of concealing them */
+        codec_contexts[i]->err_recognition |= AV_EF_EXPLODE;
+
+        if ((ret = avcodec_open2(codec_contexts[i], codec, NULL)) < 0) {
+            elv_err("Segment verification failed to open decoder for stream_index=%d: %s, url=%s",
+                i, av_err2str(ret), url);
+            rc = eav_open_codec;
+            goto avpipe_verify_segment_end;
+        }
+    }
+
+    packet = av_packet_alloc();
+    frame = av_frame_alloc();
+    if (!packet || !frame) {
+        rc = eav_mem_alloc;
+        goto avpipe_verify_segment_end;
+    }
+
+    while ((ret = av_read_frame(format_context, packet)) >= 0) {
+        if (packet->stream_index >= MAX_STREAMS || !codec_contexts[packet->stream_index]) {
+            av_packet_unref(packet);
+            continue;
+        }
+        n_packets++;
+        rc = verify_decode(codec_contexts[packet->stream_index], packet, frame, &n_frames, url);
+        av_packet_unref(packet);
+        if (rc != eav_success)
+            goto avpipe_verify_segment_end;
+    }
+
+    if (ret != AVERROR_EOF) {
+        elv_err("Segment verification failed to read packet: %s, url=%s", av_err2str(ret), url);
+        rc = eav_read_input;
+        goto avpipe_verify_segment_end;
+    }
+
+    for (int i=0; i<MAX_STREAMS; i++) {
+        if (!codec_contexts[i])
+            continue;
+        if ((rc = verify_decode(codec_contexts[i], NULL, frame, &n_frames, url)) != eav_success)
+            goto avpipe_verify_segment_end;
+    }
+
+    if (n_frames == 0) {
+        elv_err("Segment verification decoded no frames, n_packets=%d, url=%s", n_packets, url);
+        rc = eav_receive_frame;
+        goto avpipe_verify_segment_end;
+    }
+
+    elv_dbg("avpipe_verify_segment n_packets=%d, n_frames=%d, url=%s", n_packets, n_frames, url);
+
+avpipe_verify_segment_end:
+    av_packet_free(&packet);
+    av_frame_free(&frame);
+
+    for (int i=0; i<MAX_STREAMS; i++) {
+        if (codec_contexts[i])
+            avcodec_free_context(&codec_contexts[i]);
+    }
+
+    if (format_context)
+        avformat_close_input(&format_context);
+
+    if (avioctx) {
+        av_freep(&avioctx->buffer);
+        avio_context_free(&avioctx);
+    } else {
+        av_free(avio_buf);
+    }
+
+    return rc;
+}
+
+/*
+ * Checks params->burn_subtitle is a file of text subtitles with at least one cue in the stream
+ * burn_subtitle_stream_index, demuxing it like the subtitles filter does when the filter graph is made.
+ * A bad subtitle file then fails the init instead of the transcoding.
+ */
+static int
+check_burn_subtitle(
+    xcparams_t *params)
+{
+    verify_input_t input;
+    AVFormatContext *format_context = NULL;
+    AVIOContext *avioctx = NULL;
+    AVPacket *packet = NULL;
+    const AVCodecDescriptor *desc;
+    uint8_t *avio_buf;
+    int index = params->burn_subtitle_stream_index;
+    int n_packets = 0;
+    int rc = eav_success;
+    int ret;
+
+    memset(&input, 0, sizeof(input));
+    input.seg_buf = (const uint8_t *) params->burn_subtitle;
+    input.seg_len = params->burn_subtitle_len;
+
+    avio_buf = (uint8_t *) av_malloc(AVIO_IN_BUF_SIZE);
+    avioctx = avio_alloc_context(avio_buf, AVIO_IN_BUF_SIZE, 0, &input, verify_read_packet, NULL, verify_seek);
+    format_context = avformat_alloc_context();
+    packet = av_packet_alloc();
+    if (!avio_buf || !avioctx || !format_context || !packet) {
+        rc = eav_mem_alloc;
+        goto check_burn_subtitle_end;
+    }
+    format_context->pb = avioctx;
+    format_context->flags |= AVFMT_FLAG_CUSTOM_IO;
+
+    if ((ret = avformat_open_input(&format_context, NULL, NULL, NULL)) < 0) {
+        elv_err("Failed to open burn subtitle: %s, url=%s", av_err2str(ret), params->url);
+        rc = eav_param;
+        goto check_burn_subtitle_end;
+    }
+
+    if (index >= format_context->nb_streams ||
+        format_context->streams[index]->codecpar->codec_type != AVMEDIA_TYPE_SUBTITLE ||
+        !(desc = avcodec_descriptor_get(format_context->streams[index]->codecpar->codec_id)) ||
+        (desc->props & AV_CODEC_PROP_BITMAP_SUB)) {
+        elv_err("Burn subtitle has no text subtitle stream_index=%d, format=%s, url=%s",
+            index, format_context->iformat->name, params->url);
+        rc = eav_param;
+        goto check_burn_subtitle_end;
+    }
+
+    while ((ret = av_read_frame(format_context, packet)) >= 0) {
+        if (packet->stream_index == index)
+            n_packets++;
+        av_packet_unref(packet);
+    }
+
+    if (ret != AVERROR_EOF || n_packets == 0) {
+        elv_err("Burn subtitle has no valid cues, n_packets=%d, err=%s, format=%s, url=%s",
+            n_packets, av_err2str(ret), format_context->iformat->name, params->url);
+        rc = eav_param;
+    }
+
+check_burn_subtitle_end:
+    av_packet_free(&packet);
+
+    if (format_context)
+        avformat_close_input(&format_context);
+
+    if (avioctx) {
+        av_freep(&avioctx->buffer);
+        avio_context_free(&avioctx);
+    } else {
+        av_free(avio_buf);
+    }
+
+    return rc;
+}
+
+/*
+ * Simple parameter validation (without knowledge of source stream info)
+ */
+/*
+ * Sets the rate control params of the explicit rate_control mode, so that only the params of the mode
+ * are passed to the encoder:
+ *   - "cbr": constant video_bitrate, rc_max_rate and rc_buffer_size are set to video_bitrate.
+ *   - "vbr": average video_bitrate, rc_max_rate defaults to 2 * video_bitrate.
+ *   - "crf": constant quality crf_str, without rc_max_rate and rc_buffer_size.
+ *   - "cvbr": constant quality crf_str capped at rc_max_rate.
+ * For "vbr" and "cvbr" rc_buffer_size defaults to 2 * rc_max_rate.
+ */
+static avpipe_error_t
+set_rate_control_params(
+    xcparams_t *params)
+{
+    int has_crf = params->crf_str && params->crf_str[0] != '\0';
+
+    if (!strcmp(params->rate_control, "cbr") || !strcmp(params->rate_control, "vbr")) {
+        if (params->video_bitrate <= 0) {
+            elv_err("Rate control %s needs video_bitrate, url=%s", params->rate_control, params->url);
+            return eav_param;
+        }
+
+        /* crf_str has a default value, it is dropped rather than rejected */
+        free(params->crf_str);
+        params->crf_str = NULL;
+
+        if (!strcmp(params->rate_control, "cbr")) {
+            if ((params->rc_max_rate > 0 && params->rc_max_rate != params->video_bitrate) ||
+                (params->rc_buffer_size > 0 && params->rc_buffer_size != params->video_bitrate)) {
+                elv_err("Rate control cbr needs rc_max_rate and rc_buffer_size equal to video_bitrate=%d, "
+                    "rc_max_rate=%d, rc_buffer_size=%d, url=%s",
+                    params->video_bitrate, params->rc_max_rate, params->rc_buffer_size, params->url);
+                return eav_param;
+            }
+            params->rc_max_rate = params->video_bitrate;
+            params->rc_buffer_size = params->video_bitrate;
+        } else {
+            if (params->rc_max_rate <= 0)
+                params->rc_max_rate = 2 * params->video_bitrate;
+            if (params->rc_max_rate < params->video_bitrate) {
+                elv_err("Rate control vbr needs rc_max_rate=%d >= video_bitrate=%d, url=%s",
+                    params->rc_max_rate, params->video_bitrate, params->url);
+                return eav_param;
+            }
+        }
+    } else if (!strcmp(params->rate_control, "crf") || !strcmp(params->rate_control, "cvbr")) {
+        if (!has_crf) {
+            elv_err("Rate control %s needs crf_str, url=%s", params->rate_control, params->url);
+            return eav_param;
+        }
+        if (params->video_bitrate > 0) {
+            elv_err("Rate control %s and video_bitrate=%d are mutually exclusive, url=%s",
+                params->rate_control, params->video_bitrate, params->url);
+            return eav_param;
+        }
+
+        if (!strcmp(params->rate_control, "crf")) {
+            if (params->rc_max_rate > 0 || params->rc_buffer_size > 0) {
+                elv_err("Rate control crf has no bit rate limits, use cvbr with rc_max_rate=%d, url=%s",
+                    params->rc_max_rate, params->url);
+                return eav_param;
+            }
+        } else if (params->rc_max_rate <= 0) {
+            elv_err("Rate control cvbr needs rc_max_rate, url=%s", params->url);
+            return eav_param;
+        }
+    } else {
+        elv_err("Invalid rate_control=%s, must be \"cbr\", \"vbr\", \"crf\" or \"cvbr\", url=%s",
+            params->rate_control, params->url);
+        return eav_param;
+    }
+
+    if (params->rc_max_rate > 0 && params->rc_buffer_size <= 0)
+        params->rc_buffer_size = 2 * params->rc_max_rate;
+
+    elv_log("Rate control %s, video_bitrate=%d, crf=%s, rc_max_rate=%d, rc_buffer_size=%d, url=%s",
+        params->rate_control, params->video_bitrate, params->crf_str ? params->crf_str : "",
+        params->rc_max_rate, params->rc_buffer_size, params->url);
+    return eav_success;
+}
+
+/*
+ * WebM only carries VP8/VP9/AV1 video and Opus/Vorbis audio. The encoders default to libvpx-vp9
+ * and libopus if they are not set.
+ */
+static int
+check_webm_params(
+    xcparams_t *params)
+{
+    if (!params->ecodec || params->ecodec[0] == '\0') {
+        free(params->ecodec);
+        params->ecodec = strdup("libvpx-vp9");
+    }
+    if (!params->ecodec2 || params->ecodec2[0] == '\0') {
+        free(params->ecodec2);
+        params->ecodec2 = strdup("libopus");
+    }
+
+    /* The codecs of the input are copied with bypass_transcoding, the muxer rejects them if they don't fit */
+    if (params->bypass_transcoding)
+        return eav_success;
+
+    if ((params->xc_type & xc_video) && params->xc_type != xc_extract_images &&
+        params->xc_type != xc_extract_all_images &&
+        strcmp(params->ecodec, "libvpx") && !is_vp9_av1_encoder(params->ecodec)) {
+        elv_err("Invalid ecodec=%s for webm, must be libvpx-vp9, libaom-av1, libsvtav1 or libvpx, url=%s",
+            params->ecodec, params->url);
+        return eav_param;
+    }
+
+    return eav_success;
+}
+
+/*
+ * WebM only carries Opus and Vorbis audio, all the other output formats are mp4 based.
+ */
+static int
+is_valid_audio_codec_for_format(
+    const char *format,
+    const char *ecodec)
+{
+    const char *webm_codecs[] = {"libopus", "libvorbis"};
+    const char *mp4_codecs[] = {"aac", "ac3", "eac3", "libopus", "mp2", "mp3", "libmp3lame", "flac", "alac"};
+    const char **codecs = mp4_codecs;
+    int n_codecs = sizeof(mp4_codecs)/sizeof(char *);
+
+    if (!strcmp(format, "webm")) {
+        codecs = webm_codecs;
+        n_codecs = sizeof(webm_codecs)/sizeof(char *);
+    }
+
+    for (int i=0; i<n_codecs; i++) {
+        if (!strcmp(ecodec, codecs[i]))
+            return 1;
+    }
+
+    return 0;
+}
+
+static int
+check_audio_codec_params(
+    xcparams_t *params)
+{
+    if (!params->ecodec2 || !is_valid_audio_codec_for_format(params->format, params->ecodec2)) {
+        elv_err("Invalid ecodec2=%s for format=%s, url=%s",
+            params->ecodec2 ? params->ecodec2 : "", params->format, params->url);
+        return eav_param;
+    }
+
+    if (params->opus_vbr && params->opus_vbr[0] != '\0' &&
+        (strcmp(params->ecodec2, "libopus") ||
+         (strcmp(params->opus_vbr, "on") && strcmp(params->opus_vbr, "off") && strcmp(params->opus_vbr, "constrained")))) {
+        elv_err("Invalid opus_vbr=%s, must be \"on\", \"off\" or \"constrained\" with libopus, ecodec2=%s, url=%s",
+            params->opus_vbr, params->ecodec2, params->url);
+        return eav_param;
+    }
+
+    if (params->audio_channel_bitrate < 0 ||
+        (params->audio_channel_bitrate > 0 && !is_ac3_encoder(params->ecodec2))) {
+        elv_err("Invalid audio_channel_bitrate=%d, only valid with ac3 and eac3, ecodec2=%s, url=%s",
+            params->audio_channel_bitrate, params->ecodec2, params->url);
+        return eav_param;
+    }
+
+    if (!strcmp(params->ecodec2, "libopus")) {
+        if (params->sample_rate > 0 && !is_valid_opus_sample_rate(params->sample_rate)) {
+            elv_err("Invalid sample_rate=%d for libopus, must be 48000, 24000, 16000, 12000 or 8000, url=%s",
+                params->sample_rate, params->url);
+            return eav_param;
+        }
+        /* Opus bit rates go from 6 kb/s to 510 kb/s */
+        if (params->audio_bitrate > 0 && (params->audio_bitrate < 6000 || params->audio_bitrate > 510000)) {
+            elv_err("Invalid audio_bitrate=%d for libopus, must be between 6000 and 510000, url=%s",
+                params->audio_bitrate, params->url);
+            return eav_param;
+        }
+    }
+
+    if (is_ac3_encoder(params->ecodec2)) {
+        if (params->sample_rate > 0 && !is_valid_ac3_sample_rate(params->sample_rate)) {
+            elv_err("Invalid sample_rate=%d for %s, must be 48000, 44100 or 32000, url=%s",
+                params->sample_rate, params->ecodec2, params->url);
+            return eav_param;
+        }
+        /* AC-3 is limited to 640 kb/s, E-AC-3 goes higher */
+        if (!strcmp(params->ecodec2, "ac3") && params->audio_bitrate > 640000) {
+            elv_err("Invalid audio_bitrate=%d for ac3, must be at most 640000, url=%s",
+                params->audio_bitrate, params->url);
+            return eav_param;
+        }
     }
 
-    /*
-     * Flush all frames, first flush decoder buffers, then encoder buffers by passing NULL frame.
-     */
-    if (params->xc_type & xc_video && xctx->err != eav_write_frame)
-        flush_decoder(decoder_context, encoder_context, encoder_context->video_stream_index, params, debug_frame_level);
-    if (params->xc_type & xc_audio && xctx->err != eav_write_frame) {
-        for (int i=0; i<decoder_context->n_audio; i++)
-            flush_decoder(decoder_context, encoder_context, encoder_context->audio_stream_index[i], params, debug_frame_level);
-    }
-    if (params->xc_type & xc_audio_join || params->xc_type & xc_audio_merge) {
-        for (int i=0; i<decoder_context->n_audio; i++)
-            flush_decoder(decoder_context, encoder_context, decoder_context->audio_stream_index[i], params, debug_frame_level);
+    return eav_success;
+}
+
+/*
+ * The bitstream filters only apply to the packets that are copied, each one must exist.
+ */
+static int
+check_bitstream_filters(
+    xcparams_t *params)
+{
+    if (!params->bypass_transcoding) {
+        elv_err("Invalid bitstream_filters=%s, only valid with bypass_transcoding, url=%s",
+            params->bitstream_filters, params->url);
+        return eav_param;
     }
 
-    if (!params->bypass_transcoding && (params->xc_type & xc_video) && xctx->err != eav_write_frame)
-        encode_frame(decoder_context, encoder_context, NULL, decoder_context->video_stream_index, params, debug_frame_level);
-    /* Loop through and flush all audio frames */
-    if (!params->bypass_transcoding && params->xc_type & xc_audio && xctx->err != eav_write_frame) {
-        for (int i=0; i<decoder_context->n_audio; i++)
-            encode_frame(decoder_context, encoder_context, NULL, decoder_context->audio_stream_index[i], params, debug_frame_level);
+    char *filters = strdup(params->bitstream_filters);
+    char *saveptr;
+    int rc = eav_success;
+    for (char *spec = strtok_r(filters, ",", &saveptr); spec; spec = strtok_r(NULL, ",", &saveptr)) {
+        if (bitstream_filter_supports_codec(spec, AV_CODEC_ID_NONE) < 0) {
+            elv_err("Invalid bitstream filter %s, bitstream_filters=%s, url=%s", spec, params->bitstream_filters, params->url);
+            rc = eav_param;
+            break;
+        }
     }
+    free(filters);
 
-    dump_trackers(decoder_context->format_context, encoder_context->format_context);
+    return rc;
+}
 
-    if ((params->xc_type & xc_video) && rc == eav_success)
-        av_write_trailer(encoder_context->format_context);
-    if ((params->xc_type & xc_audio) && rc == eav_success) {
-        for (int i=0; i<encoder_context->n_audio_output; i++)
-            av_write_trailer(encoder_context->format_context2[i]);
+static int
+check_params(
+    xcparams_t *params)
+{
+    if (!params->format ||
+        (strcmp(params->format, "dash") &&
+         strcmp(params->format, "hls") &&
+         strcmp(params->format, "image2") &&
+         strcmp(params->format, "mp4") &&
+         strcmp(params->format, "fmp4") &&
+         strcmp(params->format, "cmaf") &&
+         strcmp(params->format, "segment") &&
+         strcmp(params->format, "fmp4-segment") &&
+         strcmp(params->format, "webm"))) {
+        elv_err("Output format can be only \"dash\", \"hls\", \"image2\", \"mp4\", \"fmp4\", \"cmaf\", \"segment\", \"fmp4-segment\", or \"webm\", url=%s", params->url);
+        return eav_param;
     }
 
-    /* Purge the audio/video channels */
-    elv_channel_close(xctx->vc, 1);
-    elv_channel_close(xctx->ac, 1);
+    if (!params->url) {
+        elv_err("Invalid params, url is null");
+        return eav_param;
+    }
 
-    char audio_last_dts_buf[(MAX_STREAMS + 1) * 20];
-    char audio_input_start_pts_buf[(MAX_STREAMS + 1) * 20];
-    char audio_last_pts_read_buf[(MAX_STREAMS + 1) * 20];
-    char audio_last_pts_sent_encode_buf[(MAX_STREAMS + 1) * 20];
-    char audio_last_pts_encoded_buf[(MAX_STREAMS + 1) * 20];
-    audio_last_dts_buf[0] = '\0';
-    audio_input_start_pts_buf[0] = '\0';
-    audio_last_pts_read_buf[0] = '\0';
-    audio_last_pts_sent_encode_buf[0] = '\0';
-    audio_last_pts_encoded_buf[0] = '\0';
-    for (int i=0; i<params->n_audio; i++) {
-        char buf[32];
-        int audio_index = params->audio_index[i];
-        if (i > 0) {
-            strncat(audio_last_dts_buf, ",", (MAX_STREAMS + 1) * 20 - strlen(audio_last_dts_buf));
-            strncat(audio_input_start_pts_buf, ",", (MAX_STREAMS + 1) * 20 - strlen(audio_input_start_pts_buf));
-            strncat(audio_last_pts_read_buf, ",", (MAX_STREAMS + 1) * 20 - strlen(audio_last_pts_read_buf));
-            strncat(audio_last_pts_sent_encode_buf, ",", (MAX_STREAMS + 1) * 20 - strlen(audio_last_pts_sent_encode_buf));
-            strncat(audio_last_pts_encoded_buf, ",", (MAX_STREAMS + 1) * 20 - strlen(audio_last_pts_encoded_buf));
-        }
-        sprintf(buf, "%"PRId64, encoder_context->audio_last_dts[audio_index]);
-        strncat(audio_last_dts_buf, buf, (MAX_STREAMS + 1) * 20 - strlen(audio_last_dts_buf));
-        sprintf(buf, "%"PRId64, encoder_context->audio_input_start_pts[audio_index]);
-        strncat(audio_input_start_pts_buf, buf, (MAX_STREAMS + 1) * 20 - strlen(audio_input_start_pts_buf));
-        sprintf(buf, "%"PRId64, encoder_context->audio_last_pts_read[audio_index]);
-        strncat(audio_last_pts_read_buf, buf, (MAX_STREAMS + 1) * 20 - strlen(audio_last_pts_read_buf));
-        sprintf(buf, "%"PRId64, encoder_context->audio_last_pts_sent_encode[audio_index]);
-        strncat(audio_last_pts_sent_encode_buf, buf, (MAX_STREAMS + 1) * 20 - strlen(audio_last_pts_sent_encode_buf));
-        sprintf(buf, "%"PRId64, encoder_context->audio_last_pts_encoded[audio_index]);
-        strncat(audio_last_pts_encoded_buf, buf, (MAX_STREAMS + 1) * 20 - strlen(audio_last_pts_encoded_buf));
-    } 
+    if (params->stream_id >= 0 && (params->xc_type != xc_none || params->n_audio > 0)) {
+        elv_err("Incompatible params, stream_id=%d, xc_type=%d, n_audio=%d, url=%s",
+            params->stream_id, params->xc_type, params->n_audio, params->url);
+        return eav_param;
+    }
 
-    elv_log("avpipe_xc done url=%s, rc=%d, xctx->err=%d, xc-type=%d, "
-        "last video_pts=%"PRId64" audio_pts=%"PRId64
-        " video_input_start_pts=%"PRId64" audio_input_start_pts=[%s]"
-        " video_last_dts=%"PRId64" audio_last_dts=[%s]"
-        " video_last_pts_read=%"PRId64" audio_last_pts_read=[%s]"
-        " video_pts_sent_encode=%"PRId64" audio_last_pts_sent_encode=[%s]"
-        " last_pts_encoded=%"PRId64" audio_last_pts_encoded=[%s]",
-        params->url,
-        rc, xctx->err, params->xc_type,
-        encoder_context->video_pts,
-        encoder_context->audio_pts,
-        encoder_context->video_input_start_pts,
-        audio_input_start_pts_buf,
-        encoder_context->video_last_dts,
-        audio_last_dts_buf,
-        encoder_context->video_last_pts_read,
-        audio_last_pts_read_buf,
-        encoder_context->video_last_pts_sent_encode,
-        audio_last_pts_sent_encode_buf,
-        encoder_context->video_last_pts_encoded,
-        audio_last_pts_encoded_buf);
+    // By default transcode 'everything' if streamId < 0
+    if (params->xc_type == xc_none && params->stream_id < 0) {
+        params->xc_type = xc_all;
+    }
 
-    decoder_context->stopped = 1;
-    encoder_context->stopped = 1;
+    /* audio_language selects a single audio stream */
+    if (params->audio_language && params->audio_language[0] != '\0' &&
+        (params->n_audio > 0 || params->stream_id >= 0 ||
+         params->xc_type == xc_audio_join || params->xc_type == xc_audio_merge)) {
+        elv_err("Incompatible params, audio_language=%s with n_audio=%d, stream_id=%d, xc_type=%d, url=%s",
+            params->audio_language, params->n_audio, params->stream_id, params->xc_type, params->url);
+        return eav_param;
+    }
 
-    if (decoder_context->cancelled) {
-        elv_warn("transcoding session cancelled, handle=%d, url=%s", xctx->handle, params->url);
-        return eav_cancelled;
+    if (params->start_pts < 0) {
+        elv_err("Start PTS can not be negative, url=%s", params->url);
+        return eav_param;
     }
 
-    /* If there was an error in reading frames, return that error */
-    if (rc != eav_success)
-        return rc;
+    if (params->output_base_pts < 0) {
+        elv_err("Output base PTS can not be negative, url=%s", params->url);
+        return eav_param;
+    }
 
-    /* Return transcoding error code */
-    return xctx->err;
-}
+    if (params->output_base_pts > 0 && params->start_pts > 0) {
+        elv_err("Output base PTS and start PTS are mutually exclusive, url=%s", params->url);
+        return eav_param;
+    }
 
-typedef struct channel_layout_info_t {
-    const char *name;
-    int         nb_channels;
-    uint64_t    layout;
-} channel_layout_info_t;
+    if (params->watermark_text != NULL && (strlen(params->watermark_text) > (WATERMARK_STRING_SZ-1))){
+        elv_err("Watermark too large, url=%s, wm_text size=%d", params->url, (int) strlen(params->watermark_text));
+        return eav_param;
+    }
 
-typedef struct channel_name_t {
-    const char *name;
-    const char *description;
-} channel_name_t;
+    /*
+     * Automatically set encoder rate control parameters: Currently constrains
+     * bit rate over a 1 second interval (bufsize == maxrate) to the average bit
+     * rate (video_bitrate). For CRF/VBV (crf_str instead of video_bitrate),
+     * the RC paramters limit bitrate spikes.
+     *
+     * Increasing the bufsize may improve image quality at the cost of increased
+     * bitrate variation.
+     *
+     * References:
+     *   - https://trac.ffmpeg.org/wiki/Limiting%20the%20output%20bitrate
+     *   - https://trac.ffmpeg.org/wiki/Encode/H.264
+     *
+     * An explicit rate_control mode sets them instead (see set_rate_control_params()).
+     */
+    if (params->rate_control && params->rate_control[0] != '\0') {
+        avpipe_error_t rc = set_rate_control_params(params);
+        if (rc != eav_success)
+            return rc;
+    } else if (params->video_bitrate > 0) {
+        if (params->video_bitrate > params->rc_max_rate) {
+            elv_log("Replacing rc_max_rate %d with video_bitrate %d, url=%s",
+                params->rc_max_rate, params->video_bitrate, params->url);
+            params->rc_max_rate = params->video_bitrate;
+        }
+        if (params->video_bitrate > params->rc_buffer_size) {
+            elv_log("Replacing rc_buffer_size %d with video_bitrate %d, url=%s",
+                params->rc_buffer_size, params->video_bitrate, params->url);
+            params->rc_buffer_size = params->video_bitrate;
+        }
+    }
 
-const channel_layout_info_t channel_layout_map[] = {
-    { "mono",        1,  AV_CH_LAYOUT_MONO },
-    { "stereo",      2,  AV_CH_LAYOUT_STEREO },
-    { "2.1",         3,  AV_CH_LAYOUT_2POINT1 },
-    { "3.0",         3,  AV_CH_LAYOUT_SURROUND },
-    { "3.0(back)",   3,  AV_CH_LAYOUT_2_1 },
-    { "4.0",         4,  AV_CH_LAYOUT_4POINT0 },
-    { "quad",        4,  AV_CH_LAYOUT_QUAD },
-    { "quad(side)",  4,  AV_CH_LAYOUT_2_2 },
-    { "3.1",         4,  AV_CH_LAYOUT_3POINT1 },
-    { "5.0",         5,  AV_CH_LAYOUT_5POINT0_BACK },
-    { "5.0(side)",   5,  AV_CH_LAYOUT_5POINT0 },
-    { "4.1",         5,  AV_CH_LAYOUT_4POINT1 },
-    { "5.1",         6,  AV_CH_LAYOUT_5POINT1_BACK },
-    { "5.1(side)",   6,  AV_CH_LAYOUT_5POINT1 },
-    { "6.0",         6,  AV_CH_LAYOUT_6POINT0 },
-    { "6.0(front)",  6,  AV_CH_LAYOUT_6POINT0_FRONT },
-    { "hexagonal",   6,  AV_CH_LAYOUT_HEXAGONAL },
-    { "6.1",         7,  AV_CH_LAYOUT_6POINT1 },
-    { "6.1(back)",   7,  AV_CH_LAYOUT_6POINT1_BACK },
-    { "6.1(front)",  7,  AV_CH_LAYOUT_6POINT1_FRONT },
-    { "7.0",         7,  AV_CH_LAYOUT_7POINT0 },
-    { "7.0(front)",  7,  AV_CH_LAYOUT_7POINT0_FRONT },
-    { "7.1",         8,  AV_CH_LAYOUT_7POINT1 },
-    { "7.1(wide)",   8,  AV_CH_LAYOUT_7POINT1_WIDE_BACK },
-    { "7.1(wide-side)",   8,  AV_CH_LAYOUT_7POINT1_WIDE },
-    { "octagonal",   8,  AV_CH_LAYOUT_OCTAGONAL },
-    { "hexadecagonal", 16, AV_CH_LAYOUT_HEXADECAGONAL },
-    { "downmix",     2,  AV_CH_LAYOUT_STEREO_DOWNMIX, },
-};
+    /*
+     * PENDING (RM), this is just a short cut to convert joining the same MONO audio index
+     * into a normal audio transcoding and produce stereo (this will prevent a crash).
+     */
+    if (params->xc_type == xc_audio_join &&
+        params->n_audio == 2 &&
+        params->audio_index[0] == params->audio_index[1]) {
+        params->xc_type = xc_audio;
+        params->channel_layout = AV_CH_LAYOUT_STEREO;
+        params->n_audio = 1;
+    }
 
-static const struct channel_name_t channel_names[] = {
-     [0] = { "FL",        "front left"            },
-     [1] = { "FR",        "front right"           },
-     [2] = { "FC",        "front center"          },
-     [3] = { "LFE",       "low frequency"         },
-     [4] = { "BL",        "back left"             },
-     [5] = { "BR",        "back right"            },
-     [6] = { "FLC",       "front left-of-center"  },
-     [7] = { "FRC",       "front right-of-center" },
-     [8] = { "BC",        "back center"           },
-     [9] = { "SL",        "side left"             },
-    [10] = { "SR",        "side right"            },
-    [11] = { "TC",        "top center"            },
-    [12] = { "TFL",       "top front left"        },
-    [13] = { "TFC",       "top front center"      },
-    [14] = { "TFR",       "top front right"       },
-    [15] = { "TBL",       "top back left"         },
-    [16] = { "TBC",       "top back center"       },
-    [17] = { "TBR",       "top back right"        },
-    [29] = { "DL",        "downmix left"          },
-    [30] = { "DR",        "downmix right"         },
-    [31] = { "WL",        "wide left"             },
-    [32] = { "WR",        "wide right"            },
-    [33] = { "SDL",       "surround direct left"  },
-    [34] = { "SDR",       "surround direct right" },
-    [35] = { "LFE2",      "low frequency 2"       },
-};
+    for (int i=0; i<params->n_audio; i++) {
+        for (int j=i+1; j<params->n_audio; j++) {
+            if (params->audio_index[i] == params->audio_index[j])
+                return eav_param;
+        }
+    }
 
-static const channel_layout_info_t*
-get_channel_layout_info(
-    int nb_channels,
-    int channel_layout)
-{
-    for (int i = 0; i < sizeof(channel_layout_map)/sizeof(channel_layout_map[0]); i++) {
-        if (nb_channels == channel_layout_map[i].nb_channels &&
-            channel_layout_map[i].layout == channel_layout)
-            return &channel_layout_map[i];
+    if (params->trim_start_sec < 0 || params->trim_end_sec < 0 ||
+        (params->trim_end_sec > 0 && params->trim_end_sec <= params->trim_start_sec)) {
+        elv_err("Invalid trim_start_sec=%.3f trim_end_sec=%.3f, trim_end_sec must be after trim_start_sec, url=%s",
+            params->trim_start_sec, params->trim_end_sec, params->url);
+        return eav_param;
     }
 
-    return NULL;
-}
-
-static const char*
-get_channel_name(
-    int channel_layout)
-{
-    if (channel_layout < 0 || channel_layout >= sizeof(channel_names)/sizeof(channel_names[0]))
-        return "";
-    return channel_names[channel_layout].name;
-}
+    /* Transcoding decodes every frame, so it is always frame accurate */
+    if (params->frame_accurate && params->bypass_transcoding &&
+        !(avpipe_is_remux(params) && !strcmp(params->format, "mp4"))) {
+        elv_err("frame_accurate with bypass_transcoding needs xc_type all and \"mp4\" format, url=%s", params->url);
+        return eav_param;
+    }
 
-const char*
-avpipe_channel_layout_name(
-    int channel_layout)
-{
-    for (int i = 0; i < sizeof(channel_layout_map)/sizeof(channel_layout_map[0]); i++) {
-        if (channel_layout_map[i].layout == channel_layout)
-            return channel_layout_map[i].name;
+    if (params->input_format && params->input_format[0] != '\0' && !av_find_input_format(params->input_format)) {
+        elv_err("Invalid input_format=%s, url=%s", params->input_format, params->url);
+        return eav_param;
     }
 
-    return "";
-}
+    if (params->enc_pix_fmt && params->enc_pix_fmt[0] != '\0') {
+        if ((params->xc_type & xc_video) && !params->bypass_transcoding && check_enc_pix_fmt(params) != eav_success)
+            return eav_param;
 
-const char*
-avpipe_channel_name(
-    int nb_channels,
-    int channel_layout)
-{
-    const channel_layout_info_t *info = get_channel_layout_info(nb_channels, channel_layout);
-    if (info != NULL) {
-        return info->name;
+        /* The h264 and h265 profiles follow the bit depth of the pixel format */
+        const AVPixFmtDescriptor *desc = av_pix_fmt_desc_get(av_get_pix_fmt(params->enc_pix_fmt));
+        if (!desc) {
+            elv_err("Invalid enc_pix_fmt=%s, url=%s", params->enc_pix_fmt, params->url);
+            return eav_param;
+        }
+        if (params->bitdepth != desc->comp[0].depth) {
+            params->bitdepth = desc->comp[0].depth;
+            elv_log("Set bitdepth=%d from enc_pix_fmt=%s, url=%s", params->bitdepth, params->enc_pix_fmt, params->url);
+        }
     }
 
-    for (int i = 0; i < 64; i++) {
-        if ((channel_layout & (UINT64_C(1) << i))) {
-            const char *name = get_channel_name(i);
-            if (name)
-                return name;
-        }
+    if (params->bitdepth == 0) {
+        params->bitdepth = 8;
+        elv_log("Set bitdepth=%d, url=%s", params->bitdepth, params->url);
     }
 
-    return "";
-}
+    if (!strcmp(params->format, "webm") && check_webm_params(params) != eav_success)
+        return eav_param;
 
-static const char*
-get_xc_type_name(
-    xc_type_t xc_type)
-{
-    switch (xc_type) {
-    case xc_video:
-        return "xc_video";
-    case xc_audio:
-        return "xc_audio";
-    case xc_all:
-        return "xc_all";
-    case xc_audio_join:
-        return "xc_audio_join";
-    case xc_audio_pan:
-        return "xc_audio_pan";
-    case xc_audio_merge:
-        return "xc_audio_merge";
-    case xc_mux:
-        return "xc_mux";
-    case xc_extract_images:
-        return "xc_extract_images";
-    case xc_extract_all_images:
-        return "xc_extract_all_images";
-    case xc_probe:
-        return "xc_probe";
-    default:
-        return "none";
+    /* The codecs of the input are copied with bypass_transcoding */
+    if ((params->xc_type & xc_audio) && !params->bypass_transcoding &&
+        strcmp(params->format, "image2") && check_audio_codec_params(params) != eav_success)
+        return eav_param;
+
+    if (params->xc_type & xc_audio &&
+        params->sample_rate > 0 &&
+        !strcmp(params->ecodec2, "aac") &&
+        !is_valid_aac_sample_rate(params->sample_rate)) {
+        elv_err("Invalid sample_rate for aac encoder, url=%s", params->url);
+        return eav_param;
     }
 
-    return "none";
-}
+    if (params->seg_duration && params->seg_duration[0] != '\0' && seg_duration_sec(params) <= 0) {
+        elv_err("Invalid seg_duration=%s, url=%s", params->seg_duration, params->url);
+        return eav_param;
+    }
 
-int
-avpipe_probe(
-    avpipe_io_handler_t *in_handlers,
-    xcparams_t *params,
-    xcprobe_t **xcprobe,
-    int *n_streams)
-{
-    ioctx_t inctx;
-    coderctx_t decoder_ctx;
-    stream_info_t *stream_probes, *stream_probes_ptr;
-    xcprobe_t *probe;
-    int rc = 0;
-    char *url;
+    /* A remux has no segments */
+    if (params->xc_type & xc_audio &&
+        !avpipe_is_remux(params) &&
+        seg_duration_sec(params) <= 0 &&
+        params->audio_seg_duration_ts <= 0 &&
+        strcmp(params->format, "mp4") &&
+        strcmp(params->format, "webm")) {
+        elv_err("Segment duration is not set for audio (invalid seg_duration and audio_seg_duration_ts), url=%s", params->url);
+        return eav_param;
+    }
 
-    memset(&inctx, 0, sizeof(ioctx_t));
-    memset(&decoder_ctx, 0, sizeof(coderctx_t));
+    if (params->xc_type & xc_video &&
+        params->xc_type != xc_extract_images &&
+        params->xc_type != xc_extract_all_images &&
+        !avpipe_is_remux(params) &&
+        seg_duration_sec(params) <= 0 &&
+        params->video_seg_duration_ts <= 0 &&
+        strcmp(params->format, "mp4") &&
+        strcmp(params->format, "webm")) {
+        elv_err("Segment duration is not set for video (invalid seg_duration and video_seg_duration_ts), url=%s", params->url);
+        return eav_param;
+    }
 
-    if (!params) {
-        elv_err("avpipe_probe parameters are not set");
-        rc = eav_param;
-        goto avpipe_probe_end;
+    if (params->xc_type == xc_subtitle &&
+        seg_duration_sec(params) <= 0) {
+        elv_err("Segment duration is not set for subtitle (invalid seg_duration), url=%s", params->url);
+        return eav_param;
     }
 
-    url = params->url;
-    // Disable sync audio to stream id when probing
-    params->sync_audio_to_stream_id = -1;
-    params->stream_id = -1;
+    /* The image is repeated until the end of the duration, so it has to be set */
+    if (params->xc_type == xc_still &&
+        ((params->duration_ts <= 0 && params->trim_end_sec <= 0) || params->bypass_transcoding)) {
+        elv_err("Invalid still params, duration_ts=%"PRId64", trim_end_sec=%.3f, bypass=%d, url=%s",
+            params->duration_ts, params->trim_end_sec, params->bypass_transcoding, params->url);
+        return eav_param;
+    }
 
-    if (!in_handlers) {
-        elv_err("avpipe_probe NULL handlers, url=%s", url);
-        rc = eav_param;
-        goto avpipe_probe_end;
+    if (params->extract_thumbnails &&
+        (!(params->xc_type & xc_video) || params->thumbnail_interval_sec <= 0 || params->thumbnail_width < 0)) {
+        elv_err("Invalid thumbnail params, xc_type=%d, thumbnail_interval_sec=%.2f, thumbnail_width=%d, url=%s",
+            params->xc_type, params->thumbnail_interval_sec, params->thumbnail_width, params->url);
+        return eav_param;
     }
 
-    inctx.params = params;
-    if (in_handlers->avpipe_opener(url, &inctx) < 0) {
-        rc = eav_open_input;
-        goto avpipe_probe_end;
+    if (params->crop_x < 0 || params->crop_y < 0 || params->crop_w < 0 || params->crop_h < 0 ||
+        (params->crop_w > 0) != (params->crop_h > 0) ||
+        ((params->crop_x > 0 || params->crop_y > 0) && params->crop_w == 0)) {
+        elv_err("Invalid crop params, crop_x=%d, crop_y=%d, crop_w=%d, crop_h=%d, url=%s",
+            params->crop_x, params->crop_y, params->crop_w, params->crop_h, params->url);
+        return eav_param;
     }
 
-    if ((rc = prepare_decoder(&decoder_ctx, in_handlers, &inctx, params, params->seekable)) != eav_success) {
-        elv_err("avpipe_probe failed to prepare decoder, url=%s", url);
-        goto avpipe_probe_end;
+    if (params->pad_left < 0 || params->pad_right < 0 || params->pad_top < 0 || params->pad_bottom < 0) {
+        elv_err("Invalid pad params, pad_left=%d, pad_right=%d, pad_top=%d, pad_bottom=%d, url=%s",
+            params->pad_left, params->pad_right, params->pad_top, params->pad_bottom, params->url);
+        return eav_param;
     }
 
-    int nb_streams = decoder_ctx.format_context->nb_streams;
-    if (nb_streams <= 0) {
-        rc = eav_num_streams;
-        goto avpipe_probe_end;
+    if (params->pad_color && strpbrk(params->pad_color, ":,'")) {
+        elv_err("Invalid pad_color=%s, url=%s", params->pad_color, params->url);
+        return eav_param;
     }
 
-    int nb_skipped_streams = 0;
-    probe = (xcprobe_t *)calloc(1, sizeof(xcprobe_t));
-    stream_probes = (stream_info_t *)calloc(1, sizeof(stream_info_t)*nb_streams);
-    for (int i=0; i<nb_streams; i++) {
-        AVStream *s = decoder_ctx.format_context->streams[i];
-        AVCodecContext *codec_context = decoder_ctx.codec_context[i];
-        AVCodec *codec = decoder_ctx.codec[i];
-        AVRational sar, dar;
+    if (params->deinterlace < dif_none || params->deinterlace > dif_yadif_frame) {
+        elv_err("Invalid deinterlace=%d, url=%s", params->deinterlace, params->url);
+        return eav_param;
+    }
 
-        if (!codec_context) {
-            nb_skipped_streams++;
-            continue;
+    if (params->enc_frame_rate && params->enc_frame_rate[0] != '\0') {
+        AVRational frame_rate;
+        if (av_parse_video_rate(&frame_rate, params->enc_frame_rate) < 0) {
+            elv_err("Invalid enc_frame_rate=%s, url=%s", params->enc_frame_rate, params->url);
+            return eav_param;
         }
-        stream_probes_ptr = &stream_probes[i-nb_skipped_streams];
-        stream_probes_ptr->stream_index = i;
-        stream_probes_ptr->stream_id = s->id;
-        if (codec) {
-            stream_probes_ptr->codec_type = codec->type;
-            stream_probes_ptr->codec_id = codec->id;
-            strncpy(stream_probes_ptr->codec_name, codec->name, MAX_CODEC_NAME);
-        } else {
-            stream_probes_ptr->codec_type = decoder_ctx.format_context->streams[i]->codecpar->codec_type;
+        if (params->bypass_transcoding) {
+            elv_err("Incompatible params, enc_frame_rate=%s with bypass, url=%s", params->enc_frame_rate, params->url);
+            return eav_param;
         }
-        stream_probes_ptr->codec_name[MAX_CODEC_NAME] = '\0';
+    }
 
-        // Estimate duration if not provided by the stream format
-        if (s->duration <= 0) {
-            // Check for tag 'duration' of format "HH:MM:SS.SUB"
-            AVDictionaryEntry *d = NULL;
-            d = av_dict_get(s->metadata, "duration", NULL, 0);
-            if (d) {
-                int64_t duration_ts = parse_duration(d->value, s->time_base);
-                if (duration_ts > 0) {
-                    s->duration = duration_ts;
-                    av_dict_set(&s->metadata,"avpipe", "duration estimated from tag", 0);
-                }
-            }
+    if (params->vfr_handling && params->vfr_handling[0] != '\0') {
+        if (strcmp(params->vfr_handling, "cfr") && strcmp(params->vfr_handling, "vfr") &&
+            strcmp(params->vfr_handling, "passthrough")) {
+            elv_err("Invalid vfr_handling=%s, must be \"cfr\", \"vfr\" or \"passthrough\", url=%s", params->vfr_handling, params->url);
+            return eav_param;
         }
-
-        // Start time is optional - set to 0 if not explicitly specified
-        if (s->start_time == AV_NOPTS_VALUE) {
-            s->start_time = 0;
+        if (!strcmp(params->vfr_handling, "cfr") && params->bypass_transcoding) {
+            elv_err("Incompatible params, vfr_handling=%s with bypass, url=%s", params->vfr_handling, params->url);
+            return eav_param;
+        }
+        if (strcmp(params->vfr_handling, "cfr") &&
+            ((params->enc_frame_rate && params->enc_frame_rate[0] != '\0') || params->force_equal_fduration)) {
+            elv_err("Incompatible params, vfr_handling=%s with enc_frame_rate=%s force_equal_fduration=%d, url=%s",
+                params->vfr_handling, params->enc_frame_rate ? params->enc_frame_rate : "",
+                params->force_equal_fduration, params->url);
+            return eav_param;
         }
+    }
 
-        stream_probes_ptr->duration_ts = s->duration;
-        stream_probes_ptr->time_base = s->time_base;
-        stream_probes_ptr->nb_frames = s->nb_frames;
-        stream_probes_ptr->start_time = s->start_time;
-        stream_probes_ptr->avg_frame_rate = s->avg_frame_rate;
+    if (params->low_latency && params->max_b_frames > 0) {
+        elv_err("Incompatible params, low_latency with max_b_frames=%d, url=%s", params->max_b_frames, params->url);
+        return eav_param;
+    }
 
-        // Find sample asperct ratio and diplay aspect ratio
-        sar = av_guess_sample_aspect_ratio(decoder_ctx.format_context, s, NULL);
-        if (sar.num) {
-            stream_probes_ptr->sample_aspect_ratio = sar;
-            av_reduce(&dar.num, &dar.den,
-                      codec_context->width  * sar.num,
-                      codec_context->height * sar.den,
-                      1024*1024);
-            stream_probes_ptr->display_aspect_ratio = dar;
-        } else {
-            stream_probes_ptr->sample_aspect_ratio = codec_context->sample_aspect_ratio;
-        }
+    if (params->intra_refresh &&
+        (!params->low_latency || !params->ecodec || strcmp(params->ecodec, "libx264"))) {
+        elv_err("Invalid intra_refresh, only valid with low_latency and libx264, ecodec=%s, url=%s",
+            params->ecodec ? params->ecodec : "", params->url);
+        return eav_param;
+    }
 
-        stream_probes_ptr->frame_rate = s->r_frame_rate;
-        stream_probes_ptr->ticks_per_frame = codec_context->ticks_per_frame;
-        stream_probes_ptr->bit_rate = codec_context->bit_rate;
-        stream_probes_ptr->has_b_frames = codec_context->has_b_frames;
-        stream_probes_ptr->sample_rate = codec_context->sample_rate;
-        stream_probes_ptr->channels = codec_context->channels;
-        if (codec && codec->type == AVMEDIA_TYPE_AUDIO)
-            stream_probes_ptr->channel_layout = codec_context->channel_layout;
-        else
-            stream_probes_ptr->channel_layout = -1;
-        stream_probes_ptr->width = codec_context->width;
-        stream_probes_ptr->height = codec_context->height;
-        stream_probes_ptr->pix_fmt = codec_context->pix_fmt;
-        stream_probes_ptr->field_order = codec_context->field_order;
-        stream_probes_ptr->profile = codec_context->profile;
-        stream_probes_ptr->level = codec_context->level;
+    if (params->bitstream_filters && params->bitstream_filters[0] != '\0' &&
+        check_bitstream_filters(params) != eav_success)
+        return eav_param;
 
-        // Set container duration if necessary
-        if (probe->container_info.duration <
-            ((float)stream_probes_ptr->duration_ts)/stream_probes_ptr->time_base.den)
-            probe->container_info.duration =
-                ((float)stream_probes_ptr->duration_ts)/stream_probes_ptr->time_base.den;
+    if (params->gap_threshold_ms < 0 || (params->fill_gaps && params->bypass_transcoding)) {
+        elv_err("Invalid fill_gaps=%d, gap_threshold_ms=%d, must be >= 0 and not with bypass, url=%s",
+            params->fill_gaps, params->gap_threshold_ms, params->url);
+        return eav_param;
+    }
 
-        av_dict_copy(&stream_probes_ptr->tags, s->metadata, 0);
+    if (params->align_segments &&
+        (strcmp(params->format, "fmp4-segment") || params->bypass_transcoding || params->seg_origin_pts < 0 ||
+         (params->xc_type != xc_video && params->xc_type != xc_audio && params->xc_type != xc_all))) {
+        elv_err("Invalid align_segments, only valid with fmp4-segment format, xc_video, xc_audio or xc_all and without bypass, "
+            "seg_origin_pts=%"PRId64", format=%s, xc_type=%d, url=%s",
+            params->seg_origin_pts, params->format, params->xc_type, params->url);
+        return eav_param;
+    }
 
-        for (int i = 0; i < s->nb_side_data; i++) {
-            const AVPacketSideData *sd = &s->side_data[i];
-            switch (sd->type) {
-                case AV_PKT_DATA_DISPLAYMATRIX:
-                    stream_probes_ptr->side_data.display_matrix.rotation = av_display_rotation_get((int32_t *)sd->data);
-                    double rot = stream_probes_ptr->side_data.display_matrix.rotation;
-                    // Convert from CCW [-180:180] value to straight CW
-                    rot = rot >= 0 ? rot : 360.0 + rot;
-                    rot = rot > 0 ? 360 - rot : 0;
-                    stream_probes_ptr->side_data.display_matrix.rotation_cw = rot;
-                    break;
-                default:
-                    // Not handled
-                    break;
-            }
-        }
+    if (params->audio_delay_ms != 0 && (params->bypass_transcoding || !(params->xc_type & xc_audio))) {
+        elv_err("Invalid audio_delay_ms=%d, only valid when transcoding audio, xc_type=%d, bypass=%d, url=%s",
+            params->audio_delay_ms, params->xc_type, params->bypass_transcoding, params->url);
+        return eav_param;
+    }
+
+    if (params->program_id < 0) {
+        elv_err("Invalid program_id=%d, url=%s", params->program_id, params->url);
+        return eav_param;
     }
 
-    inctx.closed = 1;
-    probe->stream_info = stream_probes;
-    probe->container_info.format_name = strdup(decoder_ctx.format_context->iformat->name);
-    *xcprobe = probe;
-    *n_streams = nb_streams - nb_skipped_streams;
+    if (params->video_filter && params->video_filter[0] != '\0') {
+        if (params->bypass_transcoding || !(params->xc_type & xc_video)) {
+            elv_err("Invalid video_filter, only valid when transcoding video, xc_type=%d, bypass=%d, url=%s",
+                params->xc_type, params->bypass_transcoding, params->url);
+            return eav_param;
+        }
+        if (check_filter_descr(params->video_filter, AVMEDIA_TYPE_VIDEO, params) != eav_success)
+            return eav_filter_init;
+    }
 
-avpipe_probe_end:
-    if (decoder_ctx.format_context) {
-        if (decoder_ctx.format_context->flags & AVFMT_FLAG_CUSTOM_IO) {
-            AVIOContext *avioctx = decoder_ctx.format_context->pb;
-            if (avioctx) {
-                av_freep(&avioctx->buffer);
-                av_freep(&avioctx);
-            }
+    /* The audio join, merge and pan graphs are described by filter_descriptor */
+    if (params->audio_filter && params->audio_filter[0] != '\0') {
+        if (params->bypass_transcoding || !(params->xc_type & xc_audio) ||
+            params->xc_type == xc_audio_join || params->xc_type == xc_audio_merge || params->xc_type == xc_audio_pan) {
+            elv_err("Invalid audio_filter, only valid when transcoding audio without join, merge or pan, xc_type=%d, bypass=%d, url=%s",
+                params->xc_type, params->bypass_transcoding, params->url);
+            return eav_param;
         }
-        avformat_close_input(&decoder_ctx.format_context);
+        if (check_filter_descr(params->audio_filter, AVMEDIA_TYPE_AUDIO, params) != eav_success)
+            return eav_filter_init;
     }
 
-    for (int i=0; i<MAX_STREAMS; i++) {
-        if (decoder_ctx.codec_context[i]) {
-            /* Corresponds to avcodec_open2() */
-            avcodec_close(decoder_ctx.codec_context[i]);
-            avcodec_free_context(&decoder_ctx.codec_context[i]);
+    if (params->burn_subtitle && params->burn_subtitle_len > 0) {
+        if (params->burn_subtitle_relative_sz > 1 || params->burn_subtitle_relative_sz <= 0 ||
+            params->burn_subtitle_alignment < 1 || params->burn_subtitle_alignment > 9 ||
+            params->burn_subtitle_stream_index < 0) {
+            elv_err("Burn subtitle params are not set correctly. relative_size=\"%f\", alignment=%d, stream_index=%d, url=%s",
+                params->burn_subtitle_relative_sz, params->burn_subtitle_alignment,
+                params->burn_subtitle_stream_index, params->url);
+            return eav_param;
         }
+        if (check_burn_subtitle(params) != eav_success)
+            return eav_param;
     }
 
-    /* Close input handler resources */
-    in_handlers->avpipe_closer(&inctx);
+    /* The pssh boxes added to the audio moov box would shift the offsets of the fragments */
+    if (params->sidecar_index && (!params->format ||
+        (strcmp(params->format, "fmp4") && strcmp(params->format, "cmaf")) || params->n_drm_systems > 0)) {
+        elv_err("Invalid sidecar_index, only valid with fmp4 and cmaf formats and without drm_systems, format=%s, url=%s",
+            params->format ? params->format : "", params->url);
+        return eav_param;
+    }
 
-    return rc;
-}
+    if (params->muxer_opts && params->muxer_opts[0] != '\0') {
+        AVDictionary *opts = NULL;
+        int parsed = av_dict_parse_string(&opts, params->muxer_opts, "=", ":", 0);
+        av_dict_free(&opts);
+        if (parsed < 0) {
+            elv_err("Invalid muxer_opts=%s, url=%s", params->muxer_opts, params->url);
+            return eav_param;
+        }
+    }
 
-int avpipe_probe_free(xcprobe_t *probe, int n_streams) {
-    if (probe == NULL)
-        return 0;
+    if (params->decode_threads < 0 || params->encode_threads < 0) {
+        elv_err("Invalid decode_threads=%d or encode_threads=%d, url=%s",
+            params->decode_threads, params->encode_threads, params->url);
+        return eav_param;
+    }
 
-    for (int i=0; i<n_streams; i++) {
-        av_dict_free(&probe->stream_info[i].tags);
+    if (params->chunk_key_frame_ts < 0 || (params->chunk_key_frame_ts > 0 &&
+        (params->chunk_key_frame_ts > params->start_time_ts || params->bypass_transcoding))) {
+        elv_err("Invalid chunk_key_frame_ts=%"PRId64", must be at or before start_time_ts=%"PRId64" and not with bypass, url=%s",
+            params->chunk_key_frame_ts, params->start_time_ts, params->url);
+        return eav_param;
     }
-    free(probe->stream_info);
 
-    free(probe);
-    return 0;
-}
+    if (params->io_buffer_size < 0) {
+        elv_err("Invalid io_buffer_size=%d, url=%s", params->io_buffer_size, params->url);
+        return eav_param;
+    }
 
-/*
- * Simple parameter validation (without knowledge of source stream info)
- */
-static int
-check_params(
-    xcparams_t *params)
-{
-    if (!params->format ||
-        (strcmp(params->format, "dash") &&
-         strcmp(params->format, "hls") &&
-         strcmp(params->format, "image2") &&
-         strcmp(params->format, "mp4") &&
-         strcmp(params->format, "fmp4") &&
-         strcmp(params->format, "segment") &&
-         strcmp(params->format, "fmp4-segment"))) {
-        elv_err("Output format can be only \"dash\", \"hls\", \"image2\", \"mp4\", \"fmp4\", \"segment\", or \"fmp4-segment\", url=%s", params->url);
+    if (params->thread_type && params->thread_type[0] != '\0' &&
+        strcmp(params->thread_type, "frame") && strcmp(params->thread_type, "slice")) {
+        elv_err("Invalid thread_type=%s, must be \"frame\" or \"slice\", url=%s", params->thread_type, params->url);
         return eav_param;
     }
 
-    if (!params->url) {
-        elv_err("Invalid params, url is null");
+    if (params->tone_map && params->tone_map[0] != '\0' &&
+        strcmp(params->tone_map, "hable") && strcmp(params->tone_map, "mobius") && strcmp(params->tone_map, "reinhard")) {
+        elv_err("Invalid tone_map=%s, must be \"hable\", \"mobius\" or \"reinhard\", url=%s", params->tone_map, params->url);
         return eav_param;
     }
 
-    if (params->stream_id >= 0 && (params->xc_type != xc_none || params->n_audio > 0)) {
-        elv_err("Incompatible params, stream_id=%d, xc_type=%d, n_audio=%d, url=%s",
-            params->stream_id, params->xc_type, params->n_audio, params->url);
+    if (params->tone_map_peak < 0) {
+        elv_err("Invalid tone_map_peak=%.2f, url=%s", params->tone_map_peak, params->url);
         return eav_param;
     }
 
-    // By default transcode 'everything' if streamId < 0
-    if (params->xc_type == xc_none && params->stream_id < 0) {
-        params->xc_type = xc_all;
+    if (params->max_b_frames < -1 || params->max_b_frames > MAX_B_FRAMES) {
+        elv_err("Invalid max_b_frames=%d, must be -1 to %d, url=%s", params->max_b_frames, MAX_B_FRAMES, params->url);
+        return eav_param;
     }
 
-    if (params->start_pts < 0) {
-        elv_err("Start PTS can not be negative, url=%s", params->url);
+    if (params->ref_frames < 0 || params->ref_frames > MAX_REF_FRAMES) {
+        elv_err("Invalid ref_frames=%d, must be 0 to %d, url=%s", params->ref_frames, MAX_REF_FRAMES, params->url);
         return eav_param;
     }
 
-    if (params->watermark_text != NULL && (strlen(params->watermark_text) > (WATERMARK_STRING_SZ-1))){
-        elv_err("Watermark too large, url=%s, wm_text size=%d", params->url, (int) strlen(params->watermark_text));
+    if (params->decode_progress_interval < 0 ||
+        (params->decode_progress_interval > 0 && params->decode_progress_interval < MIN_DECODE_PROGRESS_INTERVAL)) {
+        elv_err("Invalid decode_progress_interval=%d, must be 0 or at least %d ms, url=%s",
+            params->decode_progress_interval, MIN_DECODE_PROGRESS_INTERVAL, params->url);
         return eav_param;
     }
 
-    /*
-     * Automatically set encoder rate control parameters: Currently constrains
-     * bit rate over a 1 second interval (bufsize == maxrate) to the average bit
-     * rate (video_bitrate). For CRF/VBV (crf_str instead of video_bitrate),
-     * the RC paramters limit bitrate spikes.
-     *
-     * Increasing the bufsize may improve image quality at the cost of increased
-     * bitrate variation.
-     *
-     * References:
-     *   - https://trac.ffmpeg.org/wiki/Limiting%20the%20output%20bitrate
-     *   - https://trac.ffmpeg.org/wiki/Encode/H.264
-     */
-    if (params->video_bitrate > 0) {
-        if (params->video_bitrate > params->rc_max_rate) {
-            elv_log("Replacing rc_max_rate %d with video_bitrate %d, url=%s",
-                params->rc_max_rate, params->video_bitrate, params->url);
-            params->rc_max_rate = params->video_bitrate;
+    if (params->n_drm_systems > 0) {
+        uint8_t id[16];
+
+        if (params->crypt_scheme != crypt_cenc && params->crypt_scheme != crypt_cbc1 &&
+            params->crypt_scheme != crypt_cens && params->crypt_scheme != crypt_cbcs) {
+            elv_err("DRM systems need a CENC crypt scheme, crypt_scheme=%d, url=%s", params->crypt_scheme, params->url);
+            return eav_param;
         }
-        if (params->video_bitrate > params->rc_buffer_size) {
-            elv_log("Replacing rc_buffer_size %d with video_bitrate %d, url=%s",
-                params->rc_buffer_size, params->video_bitrate, params->url);
-            params->rc_buffer_size = params->video_bitrate;
+
+        /* The whole output is held in memory to add the pssh boxes, so it is limited to init segments and fmp4 segments */
+        if (strcmp(params->format, "dash") && strcmp(params->format, "hls") && strcmp(params->format, "fmp4-segment")) {
+            elv_err("DRM systems are only supported with \"dash\", \"hls\" or \"fmp4-segment\" format, format=%s, url=%s",
+                params->format, params->url);
+            return eav_param;
         }
-    }
 
-    /*
-     * PENDING (RM), this is just a short cut to convert joining the same MONO audio index
-     * into a normal audio transcoding and produce stereo (this will prevent a crash).
-     */
-    if (params->xc_type == xc_audio_join &&
-        params->n_audio == 2 &&
-        params->audio_index[0] == params->audio_index[1]) {
-        params->xc_type = xc_audio;
-        params->channel_layout = AV_CH_LAYOUT_STEREO;
-        params->n_audio = 1;
+        for (int i = 0; i < params->n_drm_systems; i++) {
+            if (parse_hex_id(params->drm_systems[i].system_id, id) < 0) {
+                elv_err("Invalid DRM system %d, system_id=%s must be 16 bytes in hex, url=%s",
+                    i, params->drm_systems[i].system_id ? params->drm_systems[i].system_id : "", params->url);
+                return eav_param;
+            }
+        }
     }
 
-    for (int i=0; i<params->n_audio; i++) {
-        for (int j=i+1; j<params->n_audio; j++) {
-            if (params->audio_index[i] == params->audio_index[j])
+    if (params->n_key_periods > 0) {
+        if (params->crypt_scheme != crypt_cenc && params->crypt_scheme != crypt_cbc1 &&
+            params->crypt_scheme != crypt_cens && params->crypt_scheme != crypt_cbcs) {
+            elv_err("Key rotation needs a CENC crypt scheme, crypt_scheme=%d, url=%s", params->crypt_scheme, params->url);
+            return eav_param;
+        }
+
+        /* Each segment of the segment muxers has its own header, so the key can change at any segment */
+        if (strcmp(params->format, "segment") && strcmp(params->format, "fmp4-segment")) {
+            elv_err("Key rotation is only supported with \"segment\" or \"fmp4-segment\" format, format=%s, url=%s",
+                params->format, params->url);
+            return eav_param;
+        }
+
+        if (!params->key_periods || params->key_periods[0].start_segment > atoi(params->start_segment_str)) {
+            elv_err("Invalid key periods, the first period must start at or before start_segment=%s, url=%s",
+                params->start_segment_str, params->url);
+            return eav_param;
+        }
+
+        for (int i = 0; i < params->n_key_periods; i++) {
+            crypt_key_period_t *key_period = &params->key_periods[i];
+            if (!key_period->key || strlen(key_period->key) != 32 ||
+                !key_period->kid || strlen(key_period->kid) != 32 ||
+                (key_period->iv && key_period->iv[0] != '\0' && strlen(key_period->iv) != 32)) {
+                elv_err("Invalid key period %d, key, kid and iv must be 16 bytes in hex, url=%s", i, params->url);
+                return eav_param;
+            }
+            if (i > 0 && key_period->start_segment <= params->key_periods[i-1].start_segment) {
+                elv_err("Invalid key period %d, start_segment=%d must be after start_segment=%d, url=%s",
+                    i, key_period->start_segment, params->key_periods[i-1].start_segment, params->url);
                 return eav_param;
+            }
         }
     }
 
-    if (params->bitdepth == 0) {
-        params->bitdepth = 8;
-        elv_log("Set bitdepth=%d, url=%s", params->bitdepth, params->url);
+    if (params->scale_algo && params->scale_algo[0] != '\0' && get_sws_flags(params->scale_algo) < 0) {
+        elv_err("Invalid scale_algo=%s, url=%s", params->scale_algo, params->url);
+        return eav_param;
     }
 
-    if (params->xc_type & xc_audio &&
-        params->sample_rate > 0 &&
-        !strcmp(params->ecodec2, "aac") &&
-        !is_valid_aac_sample_rate(params->sample_rate)) {
-        elv_err("Invalid sample_rate for aac encoder, url=%s", params->url);
+    if (params->color_range && params->color_range[0] != '\0' &&
+        strcmp(params->color_range, "tv") && strcmp(params->color_range, "pc")) {
+        elv_err("Invalid color_range=%s, must be \"tv\" or \"pc\", url=%s", params->color_range, params->url);
         return eav_param;
     }
 
-    if (params->xc_type & xc_audio &&
-        params->seg_duration <= 0 &&
-        params->audio_seg_duration_ts <= 0 &&
-        strcmp(params->format, "mp4")) {
-        elv_err("Segment duration is not set for audio (invalid seg_duration and audio_seg_duration_ts), url=%s", params->url);
+    if (params->color_space && params->color_space[0] != '\0' && get_color_space_index(params->color_space) < 0) {
+        elv_err("Invalid color_space=%s, url=%s", params->color_space, params->url);
         return eav_param;
     }
 
-    if (params->xc_type & xc_video &&
-        params->xc_type != xc_extract_images &&
-        params->xc_type != xc_extract_all_images &&
-        params->seg_duration <= 0 &&
-        params->video_seg_duration_ts <= 0 &&
-        strcmp(params->format, "mp4")) {
-        elv_err("Segment duration is not set for video (invalid seg_duration and video_seg_duration_ts), url=%s", params->url);
+    if (params->fail_on_verify_error && !params->verify_segments) {
+        elv_err("fail_on_verify_error is set without verify_segments, url=%s", params->url);
         return eav_param;
     }
 
     if (params->stream_id >=0 &&
-        params->seg_duration <= 0) {
+        seg_duration_sec(params) <= 0) {
         elv_err("Segment duration is not set for stream id=%d, url=%s", params->stream_id, params->url);
         return eav_param;
     }
@@ -4253,9 +9034,10 @@ check_params(
         return eav_param;
     }
 
-    /* Set n_audio to zero if n_audio < 0 or xc_type == xc_video */
+    /* Set n_audio to zero if n_audio < 0 or xc_type is video only */
     if (params->n_audio < 0 ||
-        params->xc_type == xc_video)
+        params->xc_type == xc_video ||
+        params->xc_type == xc_still)
         params->n_audio = 0;
 
     if ((params->xc_type == xc_audio_join ||
@@ -4276,6 +9058,44 @@ check_params(
         }
     }
 
+    for (int i = 0; i < params->force_keyframes_at_sz; i++) {
+        if (params->force_keyframes_at[i] < 0 || (i > 0 && params->force_keyframes_at[i] <= params->force_keyframes_at[i-1])) {
+            elv_err("Invalid force_keyframes_at[%d]=%.3f, times must be >= 0 and ascending, url=%s",
+                i, params->force_keyframes_at[i], params->url);
+            return eav_param;
+        }
+    }
+
+    if (params->n_inject_metadata > 0) {
+        /* The emsg boxes are added to the held video segments, the single file formats are not held */
+        if (strcmp(params->format, "dash") && strcmp(params->format, "hls") && strcmp(params->format, "fmp4-segment")) {
+            elv_err("Timed metadata is only supported with \"dash\", \"hls\" or \"fmp4-segment\" format, format=%s, url=%s",
+                params->format, params->url);
+            return eav_param;
+        }
+
+        if (!(params->xc_type & xc_video)) {
+            elv_err("Timed metadata needs xc_type video, xc_type=%d, url=%s", params->xc_type, params->url);
+            return eav_param;
+        }
+
+        for (int i = 0; i < params->n_inject_metadata; i++) {
+            timed_metadata_t *metadata = &params->inject_metadata[i];
+            if (metadata->pts < 0 || (i > 0 && metadata->pts < params->inject_metadata[i-1].pts) ||
+                metadata->payload_len <= 0) {
+                elv_err("Invalid inject_metadata[%d] pts=%"PRId64" payload_len=%d, pts must be >= 0 and ascending, url=%s",
+                    i, metadata->pts, metadata->payload_len, params->url);
+                return eav_param;
+            }
+        }
+    }
+
+    if (params->faststart && strcmp(params->format, "mp4") && strcmp(params->format, "segment")) {
+        elv_err("faststart is only supported with \"mp4\" or \"segment\" format, format=%s, url=%s",
+            params->format, params->url);
+        return eav_param;
+    }
+
     if (avpipe_check_level(params->level) < 0) {
         elv_err("Invalid level %d", params->level);
         return eav_param;
@@ -4327,11 +9147,16 @@ log_params(
         "preset=%s "
         "rc_max_rate=%d "
         "rc_buffer_size=%d "
+        "rate_control=%s "
         "video_seg_duration_ts=%"PRId64" "
         "audio_seg_duration_ts=%"PRId64" "
         "seg_duration=%s "
         "start_fragment_index=%d "
         "force_keyint=%d "
+        "max_b_frames=%d "
+        "ref_frames=%d "
+        "closed_gop=%d "
+        "force_keyframes_at_sz=%d "
         "force_equal_fduration=%d "
         "ecodec=%s "
         "ecodec2=%s "
@@ -4363,7 +9188,33 @@ log_params(
         "rotate=%d "
         "profile=%s "
         "level=%d "
-        "deinterlace=%d",
+        "deinterlace=%d "
+        "subtitle_index=%d "
+        "burn_subtitle_len=%d "
+        "burn_subtitle_stream_index=%d "
+        "burn_subtitle_font=%s "
+        "burn_subtitle_relative_sz=%.3f "
+        "burn_subtitle_alignment=%d "
+        "burn_subtitle_margin_v=%d "
+        "live_drop_threshold=%d "
+        "extract_thumbnails=%d "
+        "thumbnail_interval_sec=%.2f "
+        "thumbnail_width=%d "
+        "output_base_pts=%"PRId64" "
+        "lut_file=%s "
+        "crop_x=%d crop_y=%d crop_w=%d crop_h=%d "
+        "pad_left=%d pad_right=%d pad_top=%d pad_bottom=%d pad_color=%s "
+        "verify_segments=%d fail_on_verify_error=%d auto_rotate=%d deinterlace_auto=%d "
+        "enc_frame_rate=%s scale_algo=%s color_range=%s color_space=%s "
+        "tone_map=%s tone_map_peak=%.2f preserve_hdr_metadata=%d n_key_periods=%d n_drm_systems=%d n_inject_metadata=%d "
+        "decode_progress_interval=%d faststart=%d enc_pix_fmt=%s input_format=%s input_options=%s "
+        "trim_start_sec=%.3f trim_end_sec=%.3f frame_accurate=%d "
+        "watermark_image_xloc=%s watermark_image_yloc=%s watermark_image_scale=%.3f watermark_image_opacity=%.3f "
+        "watermark_timecode_auto=%d log_prefix=%s vfr_handling=%s handle_pts_wraparound=%d "
+        "decode_threads=%d encode_threads=%d thread_type=%s low_latency=%d intra_refresh=%d "
+        "opus_vbr=%s audio_channel_bitrate=%d bitstream_filters=%s audio_language=%s video_index=%d "
+        "frame_stats=%d io_buffer_size=%d chunk_key_frame_ts=%"PRId64" muxer_opts=%s fill_gaps=%d gap_threshold_ms=%d sidecar_index=%d "
+        "align_segments=%d seg_origin_pts=%"PRId64" program_id=%d audio_delay_ms=%d video_filter=\"%s\" audio_filter=\"%s\"",
         params->stream_id, params->url,
         avpipe_version(),
         params->bypass_transcoding, params->skip_decoding,
@@ -4372,8 +9223,11 @@ log_params(
         params->start_pts, params->duration_ts, params->start_segment_str,
         params->video_bitrate, params->audio_bitrate, params->sample_rate,
         params->crf_str, params->preset, params->rc_max_rate, params->rc_buffer_size,
+        params->rate_control ? params->rate_control : "",
         params->video_seg_duration_ts, params->audio_seg_duration_ts, params->seg_duration,
-        params->start_fragment_index, params->force_keyint, params->force_equal_fduration,
+        params->start_fragment_index, params->force_keyint,
+        params->max_b_frames, params->ref_frames, params->closed_gop, params->force_keyframes_at_sz,
+        params->force_equal_fduration,
         params->ecodec, params->ecodec2, params->dcodec, params->dcodec2,
         params->gpu_index, params->enc_height, params->enc_width,
         params->crypt_iv, params->crypt_key, params->crypt_kid, params->crypt_key_url,
@@ -4387,7 +9241,48 @@ log_params(
         params->filter_descriptor,
         params->extract_image_interval_ts, params->extract_images_sz,
         1, params->video_time_base, params->video_frame_duration_ts, params->rotate,
-        params->profile ? params->profile : "", params->level,  params->deinterlace);
+        params->profile ? params->profile : "", params->level,  params->deinterlace,
+        params->subtitle_index,
+        params->burn_subtitle_len, params->burn_subtitle_stream_index,
+        params->burn_subtitle_font ? params->burn_subtitle_font : "",
+        params->burn_subtitle_relative_sz, params->burn_subtitle_alignment,
+        params->burn_subtitle_margin_v, params->live_drop_threshold,
+        params->extract_thumbnails, params->thumbnail_interval_sec, params->thumbnail_width,
+        params->output_base_pts,
+        params->lut_file ? params->lut_file : "",
+        params->crop_x, params->crop_y, params->crop_w, params->crop_h,
+        params->pad_left, params->pad_right, params->pad_top, params->pad_bottom,
+        params->pad_color ? params->pad_color : "",
+        params->verify_segments, params->fail_on_verify_error, params->auto_rotate, params->deinterlace_auto,
+        params->enc_frame_rate ? params->enc_frame_rate : "",
+        params->scale_algo ? params->scale_algo : "",
+        params->color_range ? params->color_range : "",
+        params->color_space ? params->color_space : "",
+        params->tone_map ? params->tone_map : "", params->tone_map_peak, params->preserve_hdr_metadata,
+        params->n_key_periods, params->n_drm_systems, params->n_inject_metadata,
+        params->decode_progress_interval, params->faststart,
+        params->enc_pix_fmt ? params->enc_pix_fmt : "",
+        params->input_format ? params->input_format : "",
+        params->input_options ? params->input_options : "",
+        params->trim_start_sec, params->trim_end_sec, params->frame_accurate,
+        params->watermark_image_xloc ? params->watermark_image_xloc : "",
+        params->watermark_image_yloc ? params->watermark_image_yloc : "",
+        params->watermark_image_scale, params->watermark_image_opacity,
+        params->watermark_timecode_auto,
+        params->log_prefix ? params->log_prefix : "",
+        params->vfr_handling ? params->vfr_handling : "",
+        params->handle_pts_wraparound,
+        params->decode_threads, params->encode_threads,
+        params->thread_type ? params->thread_type : "",
+        params->low_latency, params->intra_refresh,
+        params->opus_vbr ? params->opus_vbr : "", params->audio_channel_bitrate,
+        params->bitstream_filters ? params->bitstream_filters : "",
+        params->audio_language ? params->audio_language : "", params->video_index,
+        params->frame_stats, params->io_buffer_size, params->chunk_key_frame_ts,
+        params->muxer_opts ? params->muxer_opts : "", params->fill_gaps, params->gap_threshold_ms,
+        params->sidecar_index, params->align_segments, params->seg_origin_pts, params->program_id,
+        params->audio_delay_ms, params->video_filter ? params->video_filter : "",
+        params->audio_filter ? params->audio_filter : "");
     elv_log("AVPIPE XCPARAMS %s", buf);
 }
 
@@ -4410,6 +9305,7 @@ avpipe_copy_xcparams(
     *p2 = *p;
     p2->url = safe_strdup(p->url);
     p2->crf_str = safe_strdup(p->crf_str);
+    p2->rate_control = safe_strdup(p->rate_control);
     p2->crypt_iv = safe_strdup(p->crypt_iv);
     p2->crypt_key = safe_strdup(p->crypt_key);
     p2->crypt_key_url = safe_strdup(p->crypt_key_url);
@@ -4426,18 +9322,84 @@ avpipe_copy_xcparams(
     p2->start_segment_str = safe_strdup(p->start_segment_str);
     p2->watermark_text = safe_strdup(p->watermark_text);
     p2->watermark_timecode = safe_strdup(p->watermark_timecode);
+    p2->watermark_xloc = safe_strdup(p->watermark_xloc);
+    p2->watermark_yloc = safe_strdup(p->watermark_yloc);
+    p2->watermark_font_color = safe_strdup(p->watermark_font_color);
     p2->overlay_filename = safe_strdup(p->overlay_filename);
     if (p->watermark_overlay_len > 0) {
         p2->watermark_overlay = (char *) calloc(1, p->watermark_overlay_len);
         memcpy(p2->watermark_overlay, p->watermark_overlay, p->watermark_overlay_len);
     }
     p2->watermark_shadow_color = safe_strdup(p->watermark_shadow_color);
+    if (p->burn_subtitle_len > 0) {
+        p2->burn_subtitle = (char *) calloc(1, p->burn_subtitle_len);
+        memcpy(p2->burn_subtitle, p->burn_subtitle, p->burn_subtitle_len);
+    }
+    p2->burn_subtitle_font = safe_strdup(p->burn_subtitle_font);
+    p2->lut_file = safe_strdup(p->lut_file);
+    p2->pad_color = safe_strdup(p->pad_color);
+    p2->enc_frame_rate = safe_strdup(p->enc_frame_rate);
+    p2->scale_algo = safe_strdup(p->scale_algo);
+    p2->color_range = safe_strdup(p->color_range);
+    p2->color_space = safe_strdup(p->color_space);
+    p2->tone_map = safe_strdup(p->tone_map);
+    p2->enc_pix_fmt = safe_strdup(p->enc_pix_fmt);
+    p2->input_format = safe_strdup(p->input_format);
+    p2->input_options = safe_strdup(p->input_options);
+    p2->muxer_opts = safe_strdup(p->muxer_opts);
+    p2->watermark_image_xloc = safe_strdup(p->watermark_image_xloc);
+    p2->watermark_image_yloc = safe_strdup(p->watermark_image_yloc);
+    p2->log_prefix = safe_strdup(p->log_prefix);
+    p2->vfr_handling = safe_strdup(p->vfr_handling);
+    p2->thread_type = safe_strdup(p->thread_type);
+    p2->opus_vbr = safe_strdup(p->opus_vbr);
+    p2->bitstream_filters = safe_strdup(p->bitstream_filters);
+    p2->audio_language = safe_strdup(p->audio_language);
+    p2->video_filter = safe_strdup(p->video_filter);
+    p2->audio_filter = safe_strdup(p->audio_filter);
     if (p2->extract_images_sz != 0) {
         p2->extract_images_ts = calloc(p2->extract_images_sz, sizeof(int64_t));
         int size = p2->extract_images_sz * sizeof(int64_t);
         memcpy(p2->extract_images_ts, p->extract_images_ts, size);
     }
+    if (p2->force_keyframes_at_sz != 0) {
+        p2->force_keyframes_at = calloc(p2->force_keyframes_at_sz, sizeof(double));
+        memcpy(p2->force_keyframes_at, p->force_keyframes_at, p2->force_keyframes_at_sz * sizeof(double));
+    }
+    if (p2->n_key_periods != 0) {
+        p2->key_periods = calloc(p2->n_key_periods, sizeof(crypt_key_period_t));
+        for (int i = 0; i < p2->n_key_periods; i++) {
+            p2->key_periods[i].start_segment = p->key_periods[i].start_segment;
+            p2->key_periods[i].key = safe_strdup(p->key_periods[i].key);
+            p2->key_periods[i].kid = safe_strdup(p->key_periods[i].kid);
+            p2->key_periods[i].iv = safe_strdup(p->key_periods[i].iv);
+        }
+    }
+    if (p2->n_drm_systems != 0) {
+        p2->drm_systems = calloc(p2->n_drm_systems, sizeof(drm_system_t));
+        for (int i = 0; i < p2->n_drm_systems; i++) {
+            p2->drm_systems[i].system_id = safe_strdup(p->drm_systems[i].system_id);
+            if (p->drm_systems[i].pssh_data_len > 0) {
+                p2->drm_systems[i].pssh_data = (uint8_t *) calloc(1, p->drm_systems[i].pssh_data_len);
+                memcpy(p2->drm_systems[i].pssh_data, p->drm_systems[i].pssh_data, p->drm_systems[i].pssh_data_len);
+                p2->drm_systems[i].pssh_data_len = p->drm_systems[i].pssh_data_len;
+            }
+        }
+    }
+    if (p2->n_inject_metadata != 0) {
+        p2->inject_metadata = calloc(p2->n_inject_metadata, sizeof(timed_metadata_t));
+        for (int i = 0; i < p2->n_inject_metadata; i++) {
+            p2->inject_metadata[i].pts = p->inject_metadata[i].pts;
+            if (p->inject_metadata[i].payload_len > 0) {
+                p2->inject_metadata[i].payload = (uint8_t *) calloc(1, p->inject_metadata[i].payload_len);
+                memcpy(p2->inject_metadata[i].payload, p->inject_metadata[i].payload, p->inject_metadata[i].payload_len);
+                p2->inject_metadata[i].payload_len = p->inject_metadata[i].payload_len;
+            }
+        }
+    }
     p2->seg_duration = safe_strdup(p->seg_duration);
+    p2->mux_spec = safe_strdup(p->mux_spec);
+    p2->profile = safe_strdup(p->profile);
 
     return p2;
 }
@@ -4498,18 +9460,18 @@ avpipe_init_failed:
     return rc;
 }
 
-static void
-avpipe_free_params(
-    xctx_t *xctx)
+void
+avpipe_release_xcparams(
+    xcparams_t *params)
 {
-    xcparams_t *params = xctx->params;
-
     if (!params)
         return;
 
+    free(params->url);
     free(params->format);
     free(params->start_segment_str);
     free(params->crf_str);
+    free(params->rate_control);
     free(params->preset);
     free(params->seg_duration);
     free(params->ecodec);
@@ -4528,15 +9490,77 @@ avpipe_free_params(
     free(params->watermark_overlay);
     free(params->watermark_shadow_color);
     free(params->watermark_timecode);
+    free(params->burn_subtitle);
+    free(params->burn_subtitle_font);
+    free(params->lut_file);
+    free(params->pad_color);
+    free(params->enc_frame_rate);
+    free(params->scale_algo);
+    free(params->color_range);
+    free(params->color_space);
+    free(params->tone_map);
+    free(params->enc_pix_fmt);
+    free(params->input_format);
+    free(params->input_options);
+    free(params->muxer_opts);
+    free(params->watermark_image_xloc);
+    free(params->watermark_image_yloc);
+    free(params->log_prefix);
+    free(params->vfr_handling);
+    free(params->thread_type);
+    free(params->opus_vbr);
+    free(params->bitstream_filters);
+    free(params->audio_language);
+    free(params->video_filter);
+    free(params->audio_filter);
     free(params->max_cll);
     free(params->master_display);
     free(params->filter_descriptor);
     free(params->mux_spec);
     free(params->extract_images_ts);
+    free(params->force_keyframes_at);
+    for (int i = 0; i < params->n_key_periods; i++) {
+        free(params->key_periods[i].key);
+        free(params->key_periods[i].kid);
+        free(params->key_periods[i].iv);
+    }
+    free(params->key_periods);
+    for (int i = 0; i < params->n_drm_systems; i++) {
+        free(params->drm_systems[i].system_id);
+        free(params->drm_systems[i].pssh_data);
+    }
+    free(params->drm_systems);
+    for (int i = 0; i < params->n_inject_metadata; i++)
+        free(params->inject_metadata[i].payload);
+    free(params->inject_metadata);
+    free(params->profile);
+}
+
+static void
+avpipe_free_params(
+    xctx_t *xctx)
+{
+    xcparams_t *params = xctx->params;
+
+    if (!params)
+        return;
+
+    avpipe_release_xcparams(params);
     free(params);
     xctx->params = NULL;
 }
 
+static void
+free_out_tracker(
+    out_tracker_t *out_tracker)
+{
+    if (!out_tracker)
+        return;
+
+    free(out_tracker->verify_init_buf);
+    free(out_tracker);
+}
+
 int
 avpipe_fini(
     xctx_t **xctx)
@@ -4551,6 +9575,11 @@ avpipe_fini(
     if ((*xctx)->inctx && (*xctx)->inctx->url)
         elv_dbg("Releasing all the resources, url=%s", (*xctx)->inctx->url);
 
+    /* The renditions share the decoder of the leader, release them first */
+    for (int i=0; i<(*xctx)->n_renditions; i++)
+        avpipe_fini(&(*xctx)->renditions[i]);
+    free((*xctx)->renditions);
+
     /* Close input handler resources if it is not a muxing command */
     if (!(*xctx)->in_mux_ctx && (*xctx)->in_handlers) {
         if ((rc = (*xctx)->in_handlers->avpipe_closer((*xctx)->inctx)) < 0)
@@ -4561,7 +9590,7 @@ avpipe_fini(
     encoder_context = &(*xctx)->encoder_ctx;
 
     /* note: the internal buffer could have changed, and be != avio_ctx_buffer */
-    if (decoder_context && decoder_context->format_context) {
+    if (decoder_context && decoder_context->format_context && !(*xctx)->leader) {
         if (decoder_context->format_context->flags & AVFMT_FLAG_CUSTOM_IO) {
             AVIOContext *avioctx = decoder_context->format_context->pb;
             if (avioctx) {
@@ -4572,13 +9601,13 @@ avpipe_fini(
     }
 
     /* Corresponds to avformat_open_input */
-    if (decoder_context && decoder_context->format_context)
+    if (decoder_context && decoder_context->format_context && !(*xctx)->leader)
         avformat_close_input(&decoder_context->format_context);
 
     /* Free filter graph resources */
     if (decoder_context && decoder_context->video_filter_graph)
         avfilter_graph_free(&decoder_context->video_filter_graph);
-    if (decoder_context && decoder_context->n_audio > 0) {
+    if (decoder_context && decoder_context->n_audio > 0 && !(*xctx)->leader) {
         for (int i=0; i<decoder_context->n_audio; i++)
             avfilter_graph_free(&decoder_context->audio_filter_graph[i]);
     }
@@ -4586,18 +9615,18 @@ avpipe_fini(
     if (encoder_context && encoder_context->format_context) {
         void *avpipe_opaque = encoder_context->format_context->avpipe_opaque;
         avformat_free_context(encoder_context->format_context);
-        free(avpipe_opaque);
+        free_out_tracker(avpipe_opaque);
     }
     if (encoder_context) {
         for (int i=0; i<encoder_context->n_audio_output; i++) {
             void *avpipe_opaque = encoder_context->format_context2[i]->avpipe_opaque;
             avformat_free_context(encoder_context->format_context2[i]);
-            free(avpipe_opaque);
+            free_out_tracker(avpipe_opaque);
         }
     }
 
     for (int i=0; i<MAX_STREAMS; i++) {
-        if (decoder_context->codec_context[i]) {
+        if (decoder_context->codec_context[i] && !(*xctx)->leader) {
             /* Corresponds to avcodec_open2() */
             avcodec_close(decoder_context->codec_context[i]);
             avcodec_free_context(&decoder_context->codec_context[i]);
@@ -4608,6 +9637,14 @@ avpipe_fini(
             avcodec_close(encoder_context->codec_context[i]);
             avcodec_free_context(&encoder_context->codec_context[i]);
         }
+        av_bsf_free(&encoder_context->bsf_context[i]);
+    }
+
+    if (encoder_context->thumbnail_codec_context)
+        avcodec_free_context(&encoder_context->thumbnail_codec_context);
+    if (encoder_context->thumbnail_sws_context) {
+        sws_freeContext(encoder_context->thumbnail_sws_context);
+        encoder_context->thumbnail_sws_context = NULL;
     }
 
     if ((*xctx)->params->copy_mpegts) {
@@ -4633,8 +9670,7 @@ avpipe_fini(
             // We hold a reference to it and free it after, as it is not freed there.
             avpipe_opaque = mpegts_encoder_ctx->format_context->avpipe_opaque;
             avformat_free_context(mpegts_encoder_ctx->format_context);
-            if (avpipe_opaque)
-                free(avpipe_opaque);
+            free_out_tracker(avpipe_opaque);
         }
     }
 
@@ -4698,3 +9734,111 @@ set_extract_images(
     }
     params->extract_images_ts[index] = value;
 }
+
+void
+init_force_keyframes(
+    xcparams_t *params,
+    int size)
+{
+    params->force_keyframes_at = calloc(size, sizeof(double));
+    params->force_keyframes_at_sz = size;
+}
+
+void
+set_force_keyframe(
+    xcparams_t *params,
+    int index,
+    double value)
+{
+    if (index >= params->force_keyframes_at_sz) {
+        elv_err("set_force_keyframe - index out of bounds: %d, url=%s", index, params->url);
+        return;
+    }
+    params->force_keyframes_at[index] = value;
+}
+
+void
+init_key_periods(
+    xcparams_t *params,
+    int size)
+{
+    params->key_periods = calloc(size, sizeof(crypt_key_period_t));
+    params->n_key_periods = size;
+}
+
+void
+set_key_period(
+    xcparams_t *params,
+    int index,
+    int start_segment,
+    char *key,
+    char *kid,
+    char *iv)
+{
+    if (index >= params->n_key_periods) {
+        elv_err("set_key_period - index out of bounds: %d, url=%s", index, params->url);
+        return;
+    }
+    params->key_periods[index].start_segment = start_segment;
+    params->key_periods[index].key = safe_strdup(key);
+    params->key_periods[index].kid = safe_strdup(kid);
+    params->key_periods[index].iv = safe_strdup(iv);
+}
+
+void
+init_drm_systems(
+    xcparams_t *params,
+    int size)
+{
+    params->drm_systems = calloc(size, sizeof(drm_system_t));
+    params->n_drm_systems = size;
+}
+
+void
+set_drm_system(
+    xcparams_t *params,
+    int index,
+    char *system_id,
+    uint8_t *pssh_data,
+    int pssh_data_len)
+{
+    if (index >= params->n_drm_systems) {
+        elv_err("set_drm_system - index out of bounds: %d, url=%s", index, params->url);
+        return;
+    }
+    params->drm_systems[index].system_id = safe_strdup(system_id);
+    if (pssh_data_len > 0) {
+        params->drm_systems[index].pssh_data = (uint8_t *) calloc(1, pssh_data_len);
+        memcpy(params->drm_systems[index].pssh_data, pssh_data, pssh_data_len);
+        params->drm_systems[index].pssh_data_len = pssh_data_len;
+    }
+}
+
+void
+init_inject_metadata(
+    xcparams_t *params,
+    int size)
+{
+    params->inject_metadata = calloc(size, sizeof(timed_metadata_t));
+    params->n_inject_metadata = size;
+}
+
+void
+set_inject_metadata(
+    xcparams_t *params,
+    int index,
+    int64_t pts,
+    uint8_t *payload,
+    int payload_len)
+{
+    if (index >= params->n_inject_metadata) {
+        elv_err("set_inject_metadata - index out of bounds: %d, url=%s", index, params->url);
+        return;
+    }
+    params->inject_metadata[index].pts = pts;
+    if (payload_len > 0) {
+        params->inject_metadata[index].payload = (uint8_t *) calloc(1, payload_len);
+        memcpy(params->inject_metadata[index].payload, payload, payload_len);
+        params->inject_metadata[index].payload_len = payload_len;
+    }
+}
@@ -1,8 +1,11 @@
 package live
 
 import (
+	"bytes"
+	"context"
 	"crypto/aes"
 	"crypto/cipher"
+	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
@@ -11,6 +14,7 @@ import (
 	"net/url"
 	"os"
 	"path"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
@@ -26,7 +30,7 @@ import (
 var log = elog.Get("/eluvio/avpipe/live")
 
 // HLSReader provides a reader interface to an HLS playlist that serves a
-// live MPEG-TS stream. Close the Pipe to clean up.
+// live MPEG-TS stream. Close the HLSReader to clean up.
 //
 // An HLS playlist may have zero or more audio and video streams. We choose the
 // highest bitrate stream of each type to record. If the master playlist
@@ -36,10 +40,33 @@ type HLSReader struct {
 	Pipe            io.ReadWriteCloser //
 	Type            goavpipe.XcType    //
 	client          *http.Client       //
+	ctx             context.Context    // Done when the reader is closed, cancels the pending requests and retries
+	cancel          context.CancelFunc //
 	durationReadSec float64            //
 	nextSeqNo       int                // The next segment sequence number to record (the first sequence number in a stream is 0)
 	playlistPollSec float64            // How often to poll for the manifest - HLS spec recommends half the advertised duration
 	playlistURL     *url.URL           //
+	segmentFailTime time.Time          // When the current run of failed segment reads started, zero if the last segment read succeeded
+	playlistSeqNo   int                // The media sequence number (EXT-X-MEDIA-SEQUENCE) of the last playlist read, -1 before the first one
+	discSeqNo       int                // The discontinuity sequence number of the last segment recorded, -1 before the first one
+	resetPending    bool               // The media sequence was reset, signal a discontinuity before the next segment
+	keys            keyCache           // The last AES-128 key downloaded
+
+	// OnDiscontinuity is called, if set, before the first segment following a discontinuity
+	// boundary is written to the Pipe so downstream packaging can insert the boundary
+	OnDiscontinuity func(d *Discontinuity)
+
+	MaxRetries   int           // Number of times a request failing with a network error or a 5xx, 408 or 429 status is retried
+	RetryDelay   time.Duration // Delay before the first retry of a request, doubled for each following retry
+	RetryTimeout time.Duration // The recording fails if the playlist or the segments can't be read for this long
+}
+
+// Discontinuity describes a discontinuity boundary in the recorded stream, either signalled by the
+// playlist with EXT-X-DISCONTINUITY or caused by a reset of the media sequence number
+type Discontinuity struct {
+	SeqNo            int  // Sequence number of the first segment after the boundary
+	DiscontinuitySeq int  // Discontinuity sequence number of the first segment after the boundary
+	Reset            bool // True if the media sequence number of the playlist went backwards
 }
 
 // TESTSaveToDir save manifests and segments to this path if not empty string
@@ -114,6 +141,76 @@ func findTopVariant(variants []*m3u8.Variant, compare compareVariant) (
 	return
 }
 
+// VariantSelect is how SelectVariant selects a variant of a master playlist
+type VariantSelect int
+
+const (
+	HighestBandwidth  VariantSelect = iota // The variant with the highest bandwidth
+	LowestBandwidth                        // The variant with the lowest bandwidth
+	NearestResolution                      // The variant with the resolution nearest to Width x Height
+	VariantIndex                           // The variant at Index in the master playlist
+)
+
+// VariantCriteria are the criteria to select the variant to record from a master playlist
+type VariantCriteria struct {
+	By     VariantSelect //
+	Width  int           // Width of the resolution for NearestResolution
+	Height int           // Height of the resolution for NearestResolution
+	Index  int           // Index of the variant, ignoring I-frame variants, for VariantIndex
+}
+
+// SelectVariant returns the variant matching the criteria. I-frame only variants are ignored,
+// and variants with the same bandwidth or resolution are ordered as in the master playlist.
+func SelectVariant(variants []*m3u8.Variant, by VariantCriteria) (v *m3u8.Variant, err error) {
+	var candidates []*m3u8.Variant
+	for _, v := range variants {
+		if !v.Iframe {
+			candidates = append(candidates, v)
+		}
+	}
+	if len(candidates) == 0 {
+		return nil, errors.E("SelectVariant", errors.K.NotExist, "reason", "no variants")
+	}
+
+	switch by.By {
+	case HighestBandwidth:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].Bandwidth > candidates[j].Bandwidth
+		})
+	case LowestBandwidth:
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return candidates[i].Bandwidth < candidates[j].Bandwidth
+		})
+	case NearestResolution:
+		target := by.Width * by.Height
+		distance := func(v *m3u8.Variant) int {
+			var w, h int
+			if _, err := fmt.Sscanf(v.Resolution, "%dx%d", &w, &h); err != nil {
+				return int(^uint(0) >> 1)
+			}
+			if w*h > target {
+				return w*h - target
+			}
+			return target - w*h
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			return distance(candidates[i]) < distance(candidates[j])
+		})
+		if !hasVideo(candidates[0]) {
+			return nil, errors.E("SelectVariant", errors.K.NotExist, "reason", "no variants with a resolution")
+		}
+	case VariantIndex:
+		if by.Index < 0 || by.Index >= len(candidates) {
+			return nil, errors.E("SelectVariant", errors.K.Invalid, "reason", "variant index out of range",
+				"index", by.Index, "variants", len(candidates))
+		}
+		return candidates[by.Index], nil
+	default:
+		return nil, errors.E("SelectVariant", errors.K.Invalid, "reason", "invalid variant selection", "by", by.By)
+	}
+	return candidates[0], nil
+}
+
 func hasVideo(v *m3u8.Variant) bool {
 	return v != nil && len(v.Resolution) > 0
 }
@@ -142,18 +239,33 @@ func isVideoOnly(v *m3u8.Variant) bool {
 func NewHLSReaders(playlistURL *url.URL, xcType goavpipe.XcType) (
 	readers []*HLSReader, err error) {
 
+	return newHLSReaders(playlistURL, xcType, nil)
+}
+
+// NewHLSReadersForVariant is like NewHLSReaders, but records only the variant of the master
+// playlist selected by the criteria (see SelectVariant) and its audio alternative. The criteria
+// are ignored if playlistURL is a media playlist.
+func NewHLSReadersForVariant(playlistURL *url.URL, xcType goavpipe.XcType, by VariantCriteria) (
+	readers []*HLSReader, err error) {
+
+	return newHLSReaders(playlistURL, xcType, &by)
+}
+
+func newHLSReaders(playlistURL *url.URL, xcType goavpipe.XcType, by *VariantCriteria) (
+	readers []*HLSReader, err error) {
+
 	logContext := fmt.Sprintf("url=%s", playlistURL.String())
 	et := errors.Template("NewHLSReaders", "url", playlistURL.String())
 	log.Debug("checking HLS playlist", "c", logContext)
 
 	if len(TESTSaveToDir) > 0 {
-		if e := saveManifestToFile(http.DefaultClient, playlistURL, TESTSaveToDir); e != nil {
+		if e := saveManifestToFile(context.Background(), http.DefaultClient, playlistURL, TESTSaveToDir); e != nil {
 			log.Error("saveManifestToFile", "err", e)
 		}
 	}
 
 	var content io.ReadCloser
-	if content, err = openURL(http.DefaultClient, playlistURL); err != nil {
+	if content, err = openURL(context.Background(), http.DefaultClient, playlistURL); err != nil {
 		return nil, et(err)
 	}
 	defer log.Call(content.Close, "close hls playlist", log.Error)
@@ -173,8 +285,15 @@ func NewHLSReaders(playlistURL *url.URL, xcType goavpipe.XcType) (
 		return
 	}
 
-	// From the master playlist, choose the variant with the highest bandwidth
 	master := playlist.(*m3u8.MasterPlaylist)
+	if by != nil {
+		if readers, err = newVariantReaders(master, playlistURL, xcType, *by); err != nil {
+			err = et(err)
+		}
+		return
+	}
+
+	// From the master playlist, choose the variant with the highest bandwidth
 
 	if v := findTopVariant(master.Variants, compareMuxedVariant); v != nil {
 		if lhr, err = NewHLSReaderV(v, playlistURL, goavpipe.XcMux); err == nil {
@@ -224,7 +343,7 @@ func NewHLSReaders(playlistURL *url.URL, xcType goavpipe.XcType) (
 
 		if err != nil {
 			if len(readers) > 0 {
-				log.Call(readers[0].Pipe.Close, "close hls reader", log.Error)
+				log.Call(readers[0].Close, "close hls reader", log.Error)
 			}
 			return nil, et(err)
 		}
@@ -242,17 +361,95 @@ func NewHLSReaders(playlistURL *url.URL, xcType goavpipe.XcType) (
 	return
 }
 
+// newVariantReaders creates the readers of the variant of the master playlist selected by the
+// criteria: a single reader if the variant is muxed or audio only, otherwise a reader for the
+// video of the variant and one for its audio alternative
+func newVariantReaders(master *m3u8.MasterPlaylist, masterPlaylistURL *url.URL,
+	xcType goavpipe.XcType, by VariantCriteria) (readers []*HLSReader, err error) {
+
+	v, err := SelectVariant(master.Variants, by)
+	if err != nil {
+		return
+	}
+
+	var lhr *HLSReader
+	if isMuxed(v) {
+		if lhr, err = NewHLSReaderV(v, masterPlaylistURL, goavpipe.XcMux); err != nil {
+			return
+		}
+		return []*HLSReader{lhr}, nil
+	}
+
+	if xcType != goavpipe.XcAudio && hasVideo(v) {
+		if lhr, err = NewHLSReaderV(v, masterPlaylistURL, goavpipe.XcVideo); err != nil {
+			return
+		}
+		readers = append(readers, lhr)
+	}
+
+	if xcType != goavpipe.XcVideo {
+		lhr = nil
+		if isAudioOnly(v) {
+			lhr, err = NewHLSReaderV(v, masterPlaylistURL, goavpipe.XcAudio)
+		} else if alt := audioAlternative(v); alt != nil {
+			lhr, err = NewHLSReaderA(alt, masterPlaylistURL)
+		} else {
+			// grafov doesn't populate the alternatives of every variant, look
+			// for the audio group of the variant in the others
+			for _, other := range master.Variants {
+				if other.Audio == v.Audio {
+					if alt = audioAlternative(other); alt != nil {
+						lhr, err = NewHLSReaderA(alt, masterPlaylistURL)
+						break
+					}
+				}
+			}
+		}
+		if err != nil {
+			if len(readers) > 0 {
+				log.Call(readers[0].Close, "close hls reader", log.Error)
+			}
+			return nil, err
+		}
+		if lhr != nil {
+			readers = append(readers, lhr)
+		}
+	}
+
+	if len(readers) == 0 {
+		err = errors.E("select variant", errors.K.NotExist,
+			"reason", "selected variant has no stream of the type", "type", xcType,
+			"URI", v.URI)
+	}
+	return
+}
+
 // NewHLSReader creates and returns a media playlist reader, and starts
 // goroutines to download the segments. Close the Reader to clean up.
 func NewHLSReader(playlistURL *url.URL, xcType goavpipe.XcType) *HLSReader {
-	return &HLSReader{
-		client:          &http.Client{},
+	ctx, cancel := context.WithCancel(context.Background())
+	lhr := &HLSReader{
+		ctx:             ctx,
+		cancel:          cancel,
 		nextSeqNo:       -1,
+		playlistSeqNo:   -1,
+		discSeqNo:       -1,
 		playlistPollSec: 5,
 		playlistURL:     playlistURL,
-		Pipe:            NewRWBuffer(10000),
+		Pipe:            NewRWBuffer(RWBufferDefaultCapacity),
 		Type:            xcType,
+		MaxRetries:      5,
+		RetryDelay:      500 * time.Millisecond,
+		RetryTimeout:    60 * time.Second,
 	}
+	lhr.client = &http.Client{Transport: &retryTransport{lhr: lhr}}
+	return lhr
+}
+
+// Close cancels the pending requests (and their retries) and closes the Pipe
+func (lhr *HLSReader) Close() error {
+	lhr.cancel()
+	return lhr.Pipe.Close()
 }
 
 func NewHLSReaderV(v *m3u8.Variant, masterPlaylistURL *url.URL, xcType goavpipe.XcType) (
@@ -292,8 +489,8 @@ func NewHLSReaderA(a *m3u8.Alternative, masterPlaylistURL *url.URL) (
 	return
 }
 
-func openURL(client *http.Client, u *url.URL) (io.ReadCloser, error) {
-	req, err := http.NewRequest("GET", u.String(), nil)
+func openURL(ctx context.Context, client *http.Client, u *url.URL) (io.ReadCloser, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
 	if err != nil {
 		return nil, err
 	}
@@ -301,13 +498,69 @@ func openURL(client *http.Client, u *url.URL) (io.ReadCloser, error) {
 	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
-	} else if resp.StatusCode != 200 {
-		return nil, errors.E("AVLR HTTP GET failed", "status", resp.StatusCode, "URL", u.String())
+	} else if resp.StatusCode != http.StatusOK {
+		log.Call(resp.Body.Close, "close response body", log.Error)
+		kind := errors.K.IO
+		if transientStatus(resp.StatusCode) {
+			kind = errors.K.Unavailable
+		}
+		return nil, errors.E("AVLR HTTP GET failed", kind, "status", resp.StatusCode, "URL", u.String())
 	}
 
 	return resp.Body, nil
 }
 
+// transientStatus returns true if a request failing with the HTTP status code may succeed when retried
+func transientStatus(code int) bool {
+	return code >= http.StatusInternalServerError ||
+		code == http.StatusRequestTimeout ||
+		code == http.StatusTooManyRequests
+}
+
+// isTransient returns true if err is a network error or an HTTP error that may go away
+func isTransient(err error) bool {
+	if _, ok := errors.GetRootCause(err).(*url.Error); ok {
+		return true
+	}
+	return errors.IsKind(errors.K.Unavailable, err)
+}
+
+// retryTransport retries the requests of an HLSReader that fail with a network error or a
+// transient HTTP status, up to MaxRetries times with exponential backoff starting at RetryDelay.
+// The backoff stops as soon as the context of the request is done.
+type retryTransport struct {
+	lhr *HLSReader
+}
+
+func (t *retryTransport) RoundTrip(req *http.Request) (resp *http.Response, err error) {
+	delay := t.lhr.RetryDelay
+	for retry := 0; ; retry++ {
+		resp, err = http.DefaultTransport.RoundTrip(req)
+		if err == nil && !transientStatus(resp.StatusCode) {
+			return
+		}
+		if retry >= t.lhr.MaxRetries || req.Context().Err() != nil {
+			return
+		}
+		if err == nil {
+			log.Call(resp.Body.Close, "close response body", log.Error)
+			log.Warn("AVLR HTTP GET failed, retrying", "status", resp.StatusCode, "URL", req.URL.String(),
+				"retry", retry+1, "delay", delay)
+		} else {
+			log.Warn("AVLR HTTP GET failed, retrying", "err", err, "URL", req.URL.String(),
+				"retry", retry+1, "delay", delay)
+		}
+		timer := time.NewTimer(delay)
+		select {
+		case <-req.Context().Done():
+			timer.Stop()
+			return nil, req.Context().Err()
+		case <-timer.C:
+		}
+		delay *= 2
+	}
+}
+
 func (lhr *HLSReader) Start(endChan chan<- error) {
 	go func() {
 		err := lhr.fill()
@@ -324,7 +577,7 @@ func resolve(urlStr string, base *url.URL) (u *url.URL, err error) {
 	return base.ResolveReference(u), nil
 }
 
-func saveToFile(client *http.Client, u *url.URL, savePath string) (err error) {
+func saveToFile(ctx context.Context, client *http.Client, u *url.URL, savePath string) (err error) {
 	log.Info("AVLR Saving file to", "path", savePath)
 	if err = os.MkdirAll(path.Dir(savePath), 0755); err != nil {
 		return
@@ -336,7 +589,7 @@ func saveToFile(client *http.Client, u *url.URL, savePath string) (err error) {
 	defer log.Call(file.Close, "close file", log.Error)
 
 	var content io.ReadCloser
-	if content, err = openURL(client, u); err != nil {
+	if content, err = openURL(ctx, client, u); err != nil {
 		return
 	}
 	defer log.Call(content.Close, "close url reader", log.Error)
@@ -350,7 +603,7 @@ func saveToFile(client *http.Client, u *url.URL, savePath string) (err error) {
 	return nil
 }
 
-func saveManifestToFile(client *http.Client, u *url.URL, parentPath string) (
+func saveManifestToFile(ctx context.Context, client *http.Client, u *url.URL, parentPath string) (
 	err error) {
 
 	savePath := path.Join(parentPath, "manifest", u.Path)
@@ -359,13 +612,16 @@ func saveManifestToFile(client *http.Client, u *url.URL, parentPath string) (
 	// Prepend timestamp to save snapshots of the changing live manifest
 	saveFile = strings.Join([]string{strconv.FormatInt(time.Now().Unix(), 10), saveFile}, "-")
 	savePath = path.Join(saveDir, saveFile)
-	return saveToFile(client, u, savePath)
+	return saveToFile(ctx, client, u, savePath)
 }
 
 func saveSegment(
+	ctx context.Context,
 	client *http.Client,
 	u *url.URL,
 	s *m3u8.MediaSegment,
+	key *m3u8.Key,
+	keys *keyCache,
 	parentPath string) (written int64, err error) {
 
 	msURL, err := resolve(s.URI, u)
@@ -382,13 +638,18 @@ func saveSegment(
 		return
 	}
 	defer log.Call(file.Close, "close file", log.Error)
-	return readSegment(client, u, s, file)
+	return readSegment(ctx, client, u, s, key, keys, file)
 }
 
+// readSegment writes the segment to w, decrypting it if key is an AES-128 EXT-X-KEY. The
+// key is downloaded through keys if not nil.
 func readSegment(
+	ctx context.Context,
 	client *http.Client,
 	u *url.URL,
 	s *m3u8.MediaSegment,
+	key *m3u8.Key,
+	keys *keyCache,
 	w io.Writer) (written int64, err error) {
 
 	log.Debug("AVLR readSegment start", "segment", fmt.Sprintf("%+v", *s))
@@ -400,38 +661,48 @@ func readSegment(
 	}
 
 	// Handle AES-128 encryption
-	// Key should only be set if it changed from the last segment
+	encrypted := key != nil && strings.ToUpper(key.Method) != "NONE"
 	var dw *decryptWriter
-	if s.Key != nil && strings.ToUpper(s.Key.Method) != "NONE" {
-		var key []byte
-		if key, err = httpGetBytes(u, s.Key.URI); err != nil {
-			log.Error("AVLR Failed to download AES key", "err", err, "uri", s.Key.URI)
+	if encrypted {
+		if strings.ToUpper(key.Method) != "AES-128" {
+			return 0, errors.E("Unsupported encryption method", errors.K.Invalid, "method", key.Method, "uri", key.URI)
+		}
+
+		if keys == nil {
+			keys = &keyCache{}
+		}
+		var keyBytes []byte
+		if keyBytes, err = keys.get(ctx, client, u, key); err != nil {
 			return
-		} else if len(key) != 16 { // Assumption: s.Key.Method is AES-128
-			return 0, errors.E("Bad AES key size", "len", len(key), "uri", s.Key.URI, "method", s.Key.Method, "format", s.Key.Keyformat)
 		}
 
-		var iv []byte
-		if len(s.Key.IV) > 0 {
-			if iv, err = hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(s.Key.IV, "0x"), "0X")); err != nil {
-				log.Error("AVLR Failed to decode AES IV", "err", err, "iv", s.Key.IV)
+		// 5.2. Without an IV attribute, the media sequence number of the segment
+		// is used as the IV, as a big-endian 16 byte integer
+		iv := make([]byte, aes.BlockSize)
+		if len(key.IV) > 0 {
+			if iv, err = hex.DecodeString(strings.TrimPrefix(strings.TrimPrefix(key.IV, "0x"), "0X")); err != nil {
+				log.Error("AVLR Failed to decode AES IV", "err", err, "iv", key.IV)
 				return
+			} else if len(iv) != aes.BlockSize {
+				return 0, errors.E("Bad AES IV size", errors.K.Invalid, "len", len(iv), "iv", key.IV)
 			}
+		} else {
+			binary.BigEndian.PutUint64(iv[8:], s.SeqId)
 		}
 
-		if dw, err = newDecryptWriter(w, key, iv); err != nil {
+		if dw, err = newDecryptWriter(w, keyBytes, iv); err != nil {
 			return
 		}
 	}
 
 	t := time.Now()
 	var content io.ReadCloser
-	if content, err = openURL(client, msURL); err != nil {
+	if content, err = openURL(ctx, client, msURL); err != nil {
 		return
 	}
 	defer log.Call(content.Close, "close url reader", log.Error)
 
-	if s.Key != nil && strings.ToUpper(s.Key.Method) != "NONE" {
+	if encrypted {
 		if written, err = io.Copy(dw, content); err != nil {
 			return
 		}
@@ -457,13 +728,13 @@ func (lhr *HLSReader) readPlaylist() (complete bool, err error) {
 		"seqNo", lhr.nextSeqNo, "type", lhr.Type)
 
 	if len(TESTSaveToDir) > 0 {
-		if err = saveManifestToFile(lhr.client, lhr.playlistURL, TESTSaveToDir); err != nil {
+		if err = saveManifestToFile(lhr.ctx, lhr.client, lhr.playlistURL, TESTSaveToDir); err != nil {
 			log.Error("saveManifestToFile", "err", e(err))
 		}
 	}
 
 	// HTTP GET playlist
-	content, err := openURL(lhr.client, lhr.playlistURL)
+	content, err := openURL(lhr.ctx, lhr.client, lhr.playlistURL)
 	if err != nil {
 		log.Debug("failed to get playlist", "err", err, "c", logContext)
 		return // url.Error
@@ -482,6 +753,16 @@ func (lhr *HLSReader) readPlaylist() (complete bool, err error) {
 	}
 	mediaPlaylist := playlist.(*m3u8.MediaPlaylist)
 
+	// 6.2.1. The server MUST NOT decrease the media sequence number, a smaller one means
+	// the stream was restarted and none of the segments of the playlist were recorded
+	if lhr.playlistSeqNo != -1 && int(mediaPlaylist.SeqNo) < lhr.playlistSeqNo && lhr.nextSeqNo != -1 {
+		log.Warn("media sequence reset, restarting at the first segment",
+			"seqNo", mediaPlaylist.SeqNo, "previousSeqNo", lhr.playlistSeqNo, "c", logContext)
+		lhr.nextSeqNo = int(mediaPlaylist.SeqNo)
+		lhr.resetPending = true
+	}
+	lhr.playlistSeqNo = int(mediaPlaylist.SeqNo)
+
 	// 4.3.3.4. EXT-X-ENDLIST indicates that no more Media Segments will be added
 	complete = mediaPlaylist.Closed
 	if complete {
@@ -552,25 +833,38 @@ func (lhr *HLSReader) readPlaylist() (complete bool, err error) {
 			lhr.nextSeqNo = int(segment.SeqId)
 		}
 
+		lhr.checkDiscontinuity(mediaPlaylist, i, logContext)
+
 		log.Debug("processing ingest segment", "URI", segment.URI,
 			"segment.Duration", segment.Duration, "c", logContext)
 		lhr.durationReadSec += segment.Duration
 		var written int64
+		key := segmentKey(mediaPlaylist, i)
 		if len(TESTSaveToDir) == 0 {
-			written, err = readSegment(lhr.client, lhr.playlistURL, segment, lhr.Pipe)
+			// Write the segment to the Pipe only once it is read (and decrypted) completely, so
+			// a segment failing partway doesn't leave a truncated segment in the MPEG-TS stream
+			var buf bytes.Buffer
+			if _, err = readSegment(lhr.ctx, lhr.client, lhr.playlistURL, segment, key, &lhr.keys, &buf); err == nil {
+				written, err = buf.WriteTo(lhr.Pipe)
+			}
 		} else {
-			written, err = saveSegment(lhr.client, lhr.playlistURL, segment, TESTSaveToDir)
+			written, err = saveSegment(lhr.ctx, lhr.client, lhr.playlistURL, segment, key, &lhr.keys, TESTSaveToDir)
 		}
-		if err != nil {
-			if err != io.ErrClosedPipe {
-				log.Error("error reading HLS segment", "written", written,
-					"err", e(err), "durationReadSec", lhr.durationReadSec)
-				return
-			} else {
-				log.Debug("done reading media playlist (transcoding stopped)",
-					"written", written, "c", logContext)
-				return true, nil
+		if err == io.ErrClosedPipe || lhr.ctx.Err() != nil {
+			log.Debug("done reading media playlist (transcoding stopped)",
+				"written", written, "c", logContext)
+			return true, nil
+		} else if err != nil {
+			// Skip the bad segment, none of which was written, and continue with the
+			// next one, fill() fails the recording if segments can't be read for RetryTimeout
+			log.Error("error reading HLS segment, skipping", "written", written,
+				"err", e(err), "durationReadSec", lhr.durationReadSec)
+			if lhr.segmentFailTime.IsZero() {
+				lhr.segmentFailTime = time.Now()
 			}
+			err = nil
+		} else {
+			lhr.segmentFailTime = time.Time{}
 		}
 		lhr.nextSeqNo++
 	}
@@ -580,6 +874,49 @@ func (lhr *HLSReader) readPlaylist() (complete bool, err error) {
 	return
 }
 
+// segmentKey returns the EXT-X-KEY that applies to the segment at index i of the playlist, which
+// is the last one before the segment. grafov only sets Key on the segment following the tag.
+func segmentKey(mediaPlaylist *m3u8.MediaPlaylist, i int) *m3u8.Key {
+	for ; i >= 0; i-- {
+		if key := mediaPlaylist.Segments[i].Key; key != nil {
+			return key
+		}
+	}
+	return nil
+}
+
+// checkDiscontinuity signals a discontinuity with OnDiscontinuity if the segment at index i of the
+// playlist follows a discontinuity boundary, i.e. it has EXT-X-DISCONTINUITY, a segment with it was
+// skipped or the media sequence was reset
+func (lhr *HLSReader) checkDiscontinuity(mediaPlaylist *m3u8.MediaPlaylist, i int, logContext string) {
+	// 6.2.2. The discontinuity sequence number of a segment is EXT-X-DISCONTINUITY-SEQUENCE
+	// plus the number of EXT-X-DISCONTINUITY tags up to and including the segment
+	discontinuitySeq := int(mediaPlaylist.DiscontinuitySeq)
+	for j := 0; j <= i; j++ {
+		if mediaPlaylist.Segments[j].Discontinuity {
+			discontinuitySeq++
+		}
+	}
+
+	segment := mediaPlaylist.Segments[i]
+	discontinuity := lhr.resetPending || (lhr.discSeqNo != -1 &&
+		(segment.Discontinuity || discontinuitySeq > lhr.discSeqNo))
+	if discontinuity {
+		d := &Discontinuity{
+			SeqNo:            int(segment.SeqId),
+			DiscontinuitySeq: discontinuitySeq,
+			Reset:            lhr.resetPending,
+		}
+		log.Info("discontinuity", "seqNo", d.SeqNo, "discontinuitySeq", d.DiscontinuitySeq,
+			"reset", d.Reset, "c", logContext)
+		if lhr.OnDiscontinuity != nil {
+			lhr.OnDiscontinuity(d)
+		}
+	}
+	lhr.discSeqNo = discontinuitySeq
+	lhr.resetPending = false
+}
+
 // fill periodically retrieves the media playlist and reads segments
 func (lhr *HLSReader) fill() (err error) {
 	logContext := fmt.Sprintf("url=%s type=%d",
@@ -588,6 +925,7 @@ func (lhr *HLSReader) fill() (err error) {
 
 	lastSeqNo := -1
 	lastPlaylistChangeTime := time.Now()
+	var playlistFailTime time.Time
 	for {
 		var complete bool
 		complete, err = lhr.readPlaylist()
@@ -596,15 +934,29 @@ func (lhr *HLSReader) fill() (err error) {
 			log.Info("HLSReader fill() got EOF")
 			break
 		} else if err != nil {
-			if _, ok := err.(*url.Error); ok {
-				// don't break - retry for HTTP error
-			} else if err == io.ErrClosedPipe {
-				// the pipe reader was closed
+			if err == io.ErrClosedPipe || lhr.ctx.Err() != nil {
+				// the pipe reader or the HLSReader was closed
 				err = nil
 				break
-			} else {
+			} else if !isTransient(err) {
+				break
+			}
+			// don't break - retry for transient HTTP errors until RetryTimeout
+			if playlistFailTime.IsZero() {
+				playlistFailTime = time.Now()
+			} else if time.Since(playlistFailTime) > lhr.RetryTimeout {
+				err = errors.E("lhr.fill", errors.K.Timeout, err,
+					"reason", "failed to read media playlist", "timeout", lhr.RetryTimeout)
 				break
 			}
+			log.Warn("failed to read media playlist, retrying", "err", err, "c", logContext)
+		} else {
+			playlistFailTime = time.Time{}
+		}
+		if !lhr.segmentFailTime.IsZero() && time.Since(lhr.segmentFailTime) > lhr.RetryTimeout {
+			err = errors.E("lhr.fill", errors.K.Timeout,
+				"reason", "failed to read segments", "timeout", lhr.RetryTimeout)
+			break
 		}
 		if lastSeqNo != -1 && lastSeqNo == lhr.nextSeqNo &&
 			time.Since(lastPlaylistChangeTime) > pollingPeriod*6 {
@@ -617,7 +969,14 @@ func (lhr *HLSReader) fill() (err error) {
 			lastPlaylistChangeTime = time.Now()
 			lastSeqNo = lhr.nextSeqNo
 		}
-		time.Sleep(pollingPeriod)
+		timer := time.NewTimer(pollingPeriod)
+		select {
+		case <-lhr.ctx.Done():
+			timer.Stop()
+			log.Debug("fill cancelled (HLSReader closed)", "c", logContext)
+			return nil
+		case <-timer.C:
+		}
 	}
 
 	log.Debug("fill done", "err", err, "c", logContext)
@@ -668,6 +1027,10 @@ func (dw *decryptWriter) Flush() (n int, err error) {
 		return 0, errors.E("Expected a 16 byte block remainder", len(dw.remainder))
 	}
 	dw.cipher.CryptBlocks(dw.remainder, dw.remainder)
+	if padlen := int(dw.remainder[len(dw.remainder)-1]); padlen == 0 || padlen > len(dw.remainder) {
+		// Most likely the wrong key or IV
+		return 0, errors.E("Bad PKCS5 padding", errors.K.Invalid, "padlen", padlen)
+	}
 	return dw.writer.Write(unpadPKCS5(dw.remainder))
 }
 
@@ -686,17 +1049,45 @@ func newDecryptWriter(writer io.Writer, key []byte, iv []byte) (*decryptWriter,
 	return dw, nil
 }
 
-func httpGetBytes(base *url.URL, uri string) (body []byte, err error) {
+// keyCache holds the last AES-128 key downloaded, keys usually don't change from one segment
+// to the next
+type keyCache struct {
+	uri string
+	key []byte
+}
+
+// get returns the key of the EXT-X-KEY, downloading it if it isn't the cached one
+func (kc *keyCache) get(ctx context.Context, client *http.Client, base *url.URL, k *m3u8.Key) (key []byte, err error) {
+	u, err := resolve(k.URI, base)
+	if err != nil {
+		return
+	}
+	if kc.key != nil && kc.uri == u.String() {
+		return kc.key, nil
+	}
+
+	if key, err = httpGetBytes(ctx, client, base, k.URI); err != nil {
+		log.Error("AVLR Failed to download AES key", "err", err, "uri", k.URI)
+		return
+	} else if len(key) != 16 {
+		return nil, errors.E("Bad AES key size", "len", len(key), "uri", k.URI, "method", k.Method, "format", k.Keyformat)
+	}
+	kc.uri = u.String()
+	kc.key = key
+	return
+}
+
+func httpGetBytes(ctx context.Context, client *http.Client, base *url.URL, uri string) (body []byte, err error) {
 	u, err := resolve(uri, base)
 	if err != nil {
 		return
 	}
 
 	log.Debug("HTTP GET", "url", u.String())
-	resp, err := http.Get(u.String())
+	content, err := openURL(ctx, client, u)
 	if err != nil {
 		return
 	}
-	defer log.Call(resp.Body.Close, "close response body", log.Error)
-	return ioutil.ReadAll(resp.Body)
+	defer log.Call(content.Close, "close response body", log.Error)
+	return ioutil.ReadAll(content)
 }
@@ -5,9 +5,23 @@ import (
 	"io"
 	"sync"
 
+	"github.com/eluv-io/errors-go"
 	elog "github.com/eluv-io/log-go"
 )
 
+// RWBuffer is an in-memory pipe between a writer, i.e. the HLS reader or the UDP recorder, and a
+// reader, usually avpipe reading its input. It queues up to capacity writes (packets), regardless
+// of their size, and each Read returns the data of at most one packet.
+//
+// Backpressure: when the queue is full, Write blocks until the reader makes room in the default
+// RWBufferBlocking mode, which in turn slows down the writer (and for UDP makes the socket buffer
+// fill up and drop datagrams). In RWBufferNonBlocking mode Write fails with ErrRWBufferFull
+// instead and the data is dropped, so a slow reader never stalls the writer.
+//
+// Closing: CloseSide(RWBufferWriteClosed) (or Close) signals the end of the data, the reader
+// gets the data still queued and then io.EOF. CloseSide(RWBufferReadClosed) signals the reader
+// is gone, the queued data is discarded and both Read and Write (even one blocked on a full
+// queue) fail with io.ErrClosedPipe.
 type RWBuffer struct {
 	ch          [][]byte
 	front       int
@@ -20,17 +34,33 @@ type RWBuffer struct {
 	m           *sync.Mutex
 	cond        *sync.Cond
 	closed      RWBufferCloseState
+	mode        RWBufferWriteMode
 }
 
+// RWBufferCloseState is the side(s) of a RWBuffer that are closed
 type RWBufferCloseState int
 
 const (
-	RWBufferOpen RWBufferCloseState = iota
-	RWBufferReadClosed
-	RWBufferWriteClosed
-	RWBufferClosed
+	RWBufferOpen        RWBufferCloseState = iota // Open for reading and writing
+	RWBufferReadClosed                            // The reader is done, reads and writes fail
+	RWBufferWriteClosed                           // The writer is done, the reader gets the queued data and then io.EOF
+	RWBufferClosed                                // Both sides are closed
 )
 
+// RWBufferWriteMode is what Write does when the queue of a RWBuffer is full
+type RWBufferWriteMode int
+
+const (
+	RWBufferBlocking    RWBufferWriteMode = iota // Write waits for the reader to make room
+	RWBufferNonBlocking                          // Write fails with ErrRWBufferFull
+)
+
+// RWBufferDefaultCapacity is the capacity of a RWBuffer created with a capacity that is not positive
+const RWBufferDefaultCapacity = 10000
+
+// ErrRWBufferFull is returned by Write in RWBufferNonBlocking mode when the queue is full
+var ErrRWBufferFull = errors.Str("RWBuffer full")
+
 var blog = elog.Get("/eluvio/avpipe/live/rwb")
 
 /*
@@ -40,10 +70,19 @@ var blog = elog.Get("/eluvio/avpipe/live/rwb")
  * EOF is issued.
  * An EOF is issued for reader when the writer closed the buffer and there is no data
  * in the buffer.
+ * Writes block when the buffer is full, see NewRWBufferMode.
+ * A capacity that is not positive creates a buffer of RWBufferDefaultCapacity.
  */
 func NewRWBuffer(capacity int) avpipe.SeekReadWriteCloser {
-	if capacity < 0 {
-		return nil
+	return NewRWBufferMode(capacity, RWBufferBlocking)
+}
+
+// NewRWBufferMode creates a RWBuffer queuing up to capacity writes, with the given behaviour
+// of Write when the buffer is full. A capacity that is not positive queues up to
+// RWBufferDefaultCapacity writes.
+func NewRWBufferMode(capacity int, mode RWBufferWriteMode) avpipe.SeekReadWriteCloser {
+	if capacity <= 0 {
+		capacity = RWBufferDefaultCapacity
 	}
 
 	rwb := &RWBuffer{
@@ -54,6 +93,7 @@ func NewRWBuffer(capacity int) avpipe.SeekReadWriteCloser {
 		rear:     -1,
 		capacity: capacity,
 		closed:   0,
+		mode:     mode,
 	}
 
 	rwb.m = &sync.Mutex{}
@@ -72,17 +112,25 @@ func (rwb *RWBuffer) Write(buf []byte) (n int, err error) {
 	rwb.m.Lock()
 	defer rwb.m.Unlock()
 
-	if rwb.closed&RWBufferWriteClosed != 0 {
-		blog.Debug("Write RWBuffer WRITE closed")
-		return 0, io.ErrClosedPipe
-	}
+	for {
+		if rwb.closed&RWBufferWriteClosed != 0 {
+			blog.Debug("Write RWBuffer WRITE closed")
+			return 0, io.ErrClosedPipe
+		}
 
-	if rwb.closed&RWBufferReadClosed != 0 {
-		blog.Debug("Write RWBuffer READ closed")
-		return 0, io.ErrClosedPipe
-	}
+		if rwb.closed&RWBufferReadClosed != 0 {
+			blog.Debug("Write RWBuffer READ closed")
+			return 0, io.ErrClosedPipe
+		}
 
-	if rwb.count >= rwb.capacity {
+		if rwb.count < rwb.capacity {
+			break
+		}
+
+		if rwb.mode == RWBufferNonBlocking {
+			blog.Warn("RWBuffer buffer queue is full, dropping write", "capacity", rwb.capacity, "len", len(buf))
+			return 0, ErrRWBufferFull
+		}
 		blog.Warn("RWBuffer buffer queue is full", "capacity", rwb.capacity)
 		rwb.cond.Wait()
 	}
@@ -176,6 +224,11 @@ func (rwb *RWBuffer) Read(buf []byte) (n int, err error) {
 	}
 	rwb.cond.Broadcast()
 
+	if rwb.closed&RWBufferReadClosed != 0 {
+		// Closed while waiting for a Write()
+		return 0, io.ErrClosedPipe
+	}
+
 	if rwb.closed&RWBufferWriteClosed != 0 && rwb.count <= 0 && nCopied == 0 {
 		blog.Debug("Read RWBuffer EOF")
 		return 0, io.EOF
@@ -184,12 +237,14 @@ func (rwb *RWBuffer) Read(buf []byte) (n int, err error) {
 	return nCopied, nil
 }
 
+// Size returns the number of bytes queued
 func (rwb *RWBuffer) Size() int {
 	rwb.m.Lock()
 	defer rwb.m.Unlock()
 	return rwb.sz
 }
 
+// Len returns the number of writes (packets) queued
 func (rwb *RWBuffer) Len() int {
 	rwb.m.Lock()
 	defer rwb.m.Unlock()
@@ -201,16 +256,27 @@ func (rwb *RWBuffer) Seek(offset int64, whence int) (int64, error) {
 	return 0, nil
 }
 
-// io.Closer
+// Close implements io.Closer, it closes the write side of the buffer
 func (rwb *RWBuffer) Close() error {
 	return rwb.CloseSide(RWBufferWriteClosed)
 }
 
+// CloseSide closes the given side(s) of the buffer and wakes up a blocked Read or Write.
+// Closing the read side discards the queued data.
 func (rwb *RWBuffer) CloseSide(state RWBufferCloseState) error {
 	rwb.m.Lock()
 	defer rwb.m.Unlock()
 
 	rwb.closed |= state
+	if rwb.closed&RWBufferReadClosed != 0 {
+		for i := range rwb.ch {
+			rwb.ch[i] = nil
+		}
+		rwb.count = 0
+		rwb.sz = 0
+		rwb.inReadBuf = nil
+		rwb.inReadIndex = 0
+	}
 	blog.Debug("Close RWBuffer", "state", state)
 	rwb.cond.Broadcast()
 	return nil
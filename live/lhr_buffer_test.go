@@ -6,8 +6,10 @@ import (
 	"math/rand"
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 func randBuf(t *testing.T, sz int) []byte {
@@ -119,5 +121,157 @@ func _TestConcurrentRWBuffer(t *testing.T) {
 }
 
 func TestClose(t *testing.T) {
-	// TODO
+	rwb := NewRWBuffer(10)
+	n, err := rwb.Write([]byte("Hello"))
+	assert.NoError(t, err)
+	assert.Equal(t, 5, n)
+
+	// The reader gets the queued data, then EOF
+	assert.NoError(t, rwb.Close())
+	_, err = rwb.Write([]byte("World"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+
+	buf := make([]byte, 100)
+	n, err = rwb.Read(buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "Hello", string(buf[:n]))
+	_, err = rwb.Read(buf)
+	assert.Equal(t, io.EOF, err)
+
+	// Closing the read side discards the queued data
+	rwb = NewRWBuffer(10)
+	_, err = rwb.Write([]byte("Hello"))
+	assert.NoError(t, err)
+	assert.NoError(t, rwb.(*RWBuffer).CloseSide(RWBufferReadClosed))
+	assert.Equal(t, 0, rwb.(*RWBuffer).Len())
+	assert.Equal(t, 0, rwb.(*RWBuffer).Size())
+	_, err = rwb.Read(buf)
+	assert.Equal(t, io.ErrClosedPipe, err)
+	_, err = rwb.Write([]byte("World"))
+	assert.Equal(t, io.ErrClosedPipe, err)
+}
+
+func TestNonBlockingRWBuffer(t *testing.T) {
+	rwb := NewRWBufferMode(2, RWBufferNonBlocking)
+	for i := 0; i < 2; i++ {
+		_, err := rwb.Write([]byte("Hello"))
+		assert.NoError(t, err)
+	}
+	n, err := rwb.Write([]byte("World"))
+	assert.Equal(t, ErrRWBufferFull, err)
+	assert.Equal(t, 0, n)
+
+	buf := make([]byte, 100)
+	_, err = rwb.Read(buf)
+	assert.NoError(t, err)
+	_, err = rwb.Write([]byte("World"))
+	assert.NoError(t, err)
+}
+
+// TestDefaultCapacityRWBuffer checks a buffer created without a capacity is usable
+func TestDefaultCapacityRWBuffer(t *testing.T) {
+	for _, capacity := range []int{0, -1} {
+		rwb := NewRWBuffer(capacity)
+		require.NotNil(t, rwb)
+		assert.Equal(t, RWBufferDefaultCapacity, rwb.(*RWBuffer).capacity)
+
+		n, err := rwb.Write([]byte("Hello"))
+		assert.NoError(t, err)
+		assert.Equal(t, 5, n)
+		assert.NoError(t, rwb.Close())
+
+		buf := make([]byte, 100)
+		n, err = rwb.Read(buf)
+		assert.NoError(t, err)
+		assert.Equal(t, "Hello", string(buf[:n]))
+		_, err = rwb.Read(buf)
+		assert.Equal(t, io.EOF, err)
+	}
+	assert.NotNil(t, NewRWBufferMode(0, RWBufferNonBlocking))
+}
+
+// TestCloseBlockedWriter closes the read side while a writer is blocked on a full buffer
+func TestCloseBlockedWriter(t *testing.T) {
+	rwb := NewRWBuffer(1)
+	_, err := rwb.Write([]byte("Hello"))
+	assert.NoError(t, err)
+
+	errChan := make(chan error)
+	go func() {
+		_, err := rwb.Write([]byte("World"))
+		errChan <- err
+	}()
+
+	select {
+	case err = <-errChan:
+		t.Fatal("Write didn't block on a full buffer", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	assert.NoError(t, rwb.(*RWBuffer).CloseSide(RWBufferReadClosed))
+	assert.Equal(t, io.ErrClosedPipe, <-errChan)
+}
+
+// TestCloseBlockedReader closes each side while a reader is blocked on an empty buffer
+func TestCloseBlockedReader(t *testing.T) {
+	for _, state := range []RWBufferCloseState{RWBufferWriteClosed, RWBufferReadClosed} {
+		rwb := NewRWBuffer(1)
+		errChan := make(chan error)
+		go func() {
+			_, err := rwb.Read(make([]byte, 100))
+			errChan <- err
+		}()
+
+		time.Sleep(10 * time.Millisecond)
+		assert.NoError(t, rwb.(*RWBuffer).CloseSide(state))
+		err := <-errChan
+		if state == RWBufferWriteClosed {
+			assert.Equal(t, io.EOF, err)
+		} else {
+			assert.Equal(t, io.ErrClosedPipe, err)
+		}
+	}
+}
+
+// TestConcurrentRWBufferClose races writers and a reader against closing either side,
+// none of them may block once the buffer is closed
+func TestConcurrentRWBufferClose(t *testing.T) {
+	for i := 0; i < 100; i++ {
+		state := RWBufferWriteClosed
+		if i%2 == 1 {
+			state = RWBufferReadClosed
+		}
+
+		rwb := NewRWBuffer(4)
+		wg := &sync.WaitGroup{}
+		for w := 0; w < 4; w++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				b := make([]byte, 188)
+				for {
+					if _, err := rwb.Write(b); err != nil {
+						assert.Equal(t, io.ErrClosedPipe, err)
+						return
+					}
+				}
+			}()
+		}
+
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			b := make([]byte, 100)
+			for {
+				if _, err := rwb.Read(b); err != nil {
+					assert.Contains(t, []error{io.EOF, io.ErrClosedPipe}, err)
+					return
+				}
+			}
+		}()
+
+		time.Sleep(time.Millisecond)
+		assert.NoError(t, rwb.(*RWBuffer).CloseSide(state))
+		wg.Wait()
+	}
 }
@@ -0,0 +1,457 @@
+package live
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/hex"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/eluv-io/avpipe/goavpipe"
+	"github.com/eluv-io/errors-go"
+	"github.com/grafov/m3u8"
+	"github.com/stretchr/testify/require"
+)
+
+const testMediaPlaylist = `#EXTM3U
+#EXT-X-VERSION:3
+#EXT-X-TARGETDURATION:2
+#EXT-X-MEDIA-SEQUENCE:0
+#EXTINF:2.0,
+0.ts
+#EXTINF:2.0,
+1.ts
+#EXTINF:2.0,
+2.ts
+#EXTINF:2.0,
+3.ts
+#EXTINF:2.0,
+4.ts
+#EXT-X-ENDLIST
+`
+
+func newTestHLSReader(t *testing.T, serverURL string) *HLSReader {
+	u, err := url.Parse(serverURL + "/playlist.m3u8")
+	require.NoError(t, err)
+
+	lhr := NewHLSReader(u, goavpipe.XcVideo)
+	lhr.MaxRetries = 2
+	lhr.RetryDelay = time.Millisecond
+	lhr.playlistPollSec = 0.01
+	return lhr
+}
+
+// TestHLSReaderRetry checks transient errors are retried and a bad segment is skipped
+func TestHLSReaderRetry(t *testing.T) {
+	var playlistRequests, segmentRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/playlist.m3u8":
+			if atomic.AddInt32(&playlistRequests, 1) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.Write([]byte(testMediaPlaylist))
+		case "/2.ts":
+			if atomic.AddInt32(&segmentRequests, 1) == 1 {
+				w.WriteHeader(http.StatusBadGateway)
+				return
+			}
+			w.Write([]byte("segment2"))
+		case "/4.ts":
+			w.Write([]byte("segment4"))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer ts.Close()
+
+	lhr := newTestHLSReader(t, ts.URL)
+	lhr.nextSeqNo = 2
+	require.NoError(t, lhr.fill())
+	lhr.Pipe.(*RWBuffer).CloseSide(RWBufferWriteClosed)
+
+	content, err := ioutil.ReadAll(lhr.Pipe)
+	require.NoError(t, err)
+	require.Equal(t, "segment2segment4", string(content))
+	require.Equal(t, int32(2), atomic.LoadInt32(&playlistRequests))
+	require.Equal(t, int32(2), atomic.LoadInt32(&segmentRequests))
+	require.Equal(t, 5, lhr.nextSeqNo)
+}
+
+// TestHLSReaderRetryTimeout checks fill() fails once the playlist can't be read for RetryTimeout
+func TestHLSReaderRetryTimeout(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	lhr := newTestHLSReader(t, ts.URL)
+	lhr.RetryTimeout = 100 * time.Millisecond
+	err := lhr.fill()
+	require.Error(t, err)
+	require.True(t, errors.IsKind(errors.K.Timeout, err))
+}
+
+// TestHLSReaderNotFound checks fill() fails right away on an error that isn't transient
+func TestHLSReaderNotFound(t *testing.T) {
+	ts := httptest.NewServer(http.NotFoundHandler())
+	defer ts.Close()
+
+	lhr := newTestHLSReader(t, ts.URL)
+	err := lhr.fill()
+	require.Error(t, err)
+	require.False(t, isTransient(err))
+}
+
+// TestHLSReaderTruncatedSegment checks a segment failing partway is skipped whole, none of it is
+// written to the Pipe
+func TestHLSReaderTruncatedSegment(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/playlist.m3u8":
+			w.Write([]byte(testMediaPlaylist))
+		case "/3.ts":
+			// The connection is closed before the announced content length
+			w.Header().Set("Content-Length", "100")
+			w.Write([]byte("partial"))
+		default:
+			w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+		}
+	}))
+	defer ts.Close()
+
+	lhr := newTestHLSReader(t, ts.URL)
+	lhr.nextSeqNo = 2
+	require.NoError(t, lhr.fill())
+	lhr.Pipe.(*RWBuffer).CloseSide(RWBufferWriteClosed)
+
+	content, err := ioutil.ReadAll(lhr.Pipe)
+	require.NoError(t, err)
+	require.Equal(t, "2.ts4.ts", string(content))
+	require.Equal(t, 5, lhr.nextSeqNo)
+}
+
+// TestHLSReaderRetryCancel checks the retry backoff stops when the request is cancelled
+func TestHLSReaderRetryCancel(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	lhr := newTestHLSReader(t, ts.URL)
+	lhr.RetryDelay = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", ts.URL+"/playlist.m3u8", nil)
+	require.NoError(t, err)
+
+	start := time.Now()
+	_, err = lhr.client.Do(req)
+	require.ErrorIs(t, err, context.DeadlineExceeded)
+	require.Less(t, time.Since(start), 10*time.Second)
+}
+
+// TestHLSReaderCloseDuringBackoff checks closing the HLSReader stops fill() while a request is
+// waiting to be retried
+func TestHLSReaderCloseDuringBackoff(t *testing.T) {
+	var requests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	defer ts.Close()
+
+	lhr := newTestHLSReader(t, ts.URL)
+	lhr.RetryDelay = time.Hour
+
+	endChan := make(chan error, 1)
+	lhr.Start(endChan)
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&requests) > 0 }, 10*time.Second, time.Millisecond)
+
+	start := time.Now()
+	require.NoError(t, lhr.Close())
+	select {
+	case err := <-endChan:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		require.Fail(t, "fill() did not stop when the HLSReader was closed")
+	}
+	require.Less(t, time.Since(start), 10*time.Second)
+	require.Equal(t, int32(1), atomic.LoadInt32(&requests))
+}
+
+// servePlaylists serves each playlist in turn, repeating the last one, and the segments
+// with their name as content
+func servePlaylists(playlists ...string) *httptest.Server {
+	var m sync.Mutex
+	next := 0
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/playlist.m3u8" {
+			w.Write([]byte(strings.TrimPrefix(r.URL.Path, "/")))
+			return
+		}
+		m.Lock()
+		defer m.Unlock()
+		w.Write([]byte(playlists[next]))
+		if next < len(playlists)-1 {
+			next++
+		}
+	}))
+}
+
+func readDiscontinuities(t *testing.T, lhr *HLSReader) (string, []*Discontinuity) {
+	var discontinuities []*Discontinuity
+	lhr.OnDiscontinuity = func(d *Discontinuity) {
+		// Mark the boundary in the recorded content
+		lhr.Pipe.Write([]byte("|"))
+		discontinuities = append(discontinuities, d)
+	}
+	require.NoError(t, lhr.fill())
+	lhr.Pipe.(*RWBuffer).CloseSide(RWBufferWriteClosed)
+
+	content, err := ioutil.ReadAll(lhr.Pipe)
+	require.NoError(t, err)
+	return string(content), discontinuities
+}
+
+func TestHLSReaderDiscontinuity(t *testing.T) {
+	ts := servePlaylists(`#EXTM3U
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:0
+#EXTINF:1.0,
+s0
+#EXTINF:1.0,
+s1
+#EXTINF:1.0,
+s2
+#EXTINF:1.0,
+s3
+`, `#EXTM3U
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:2
+#EXTINF:1.0,
+s2
+#EXTINF:1.0,
+s3
+#EXT-X-DISCONTINUITY
+#EXTINF:1.0,
+ad4
+#EXTINF:1.0,
+ad5
+#EXT-X-DISCONTINUITY
+#EXTINF:1.0,
+s6
+`, `#EXTM3U
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:5
+#EXT-X-DISCONTINUITY-SEQUENCE:1
+#EXTINF:1.0,
+ad5
+#EXT-X-DISCONTINUITY
+#EXTINF:1.0,
+s6
+#EXTINF:1.0,
+s7
+#EXT-X-ENDLIST
+`)
+	defer ts.Close()
+
+	lhr := newTestHLSReader(t, ts.URL)
+	lhr.nextSeqNo = 0
+	content, discontinuities := readDiscontinuities(t, lhr)
+
+	require.Equal(t, "s0s1s2s3|ad4ad5|s6s7", content)
+	require.Equal(t, []*Discontinuity{
+		{SeqNo: 4, DiscontinuitySeq: 1},
+		{SeqNo: 6, DiscontinuitySeq: 2},
+	}, discontinuities)
+}
+
+func TestHLSReaderSequenceReset(t *testing.T) {
+	ts := servePlaylists(`#EXTM3U
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:10
+#EXTINF:1.0,
+a10
+#EXTINF:1.0,
+a11
+#EXTINF:1.0,
+a12
+`, `#EXTM3U
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:0
+#EXTINF:1.0,
+b0
+#EXTINF:1.0,
+b1
+#EXT-X-ENDLIST
+`)
+	defer ts.Close()
+
+	lhr := newTestHLSReader(t, ts.URL)
+	lhr.nextSeqNo = 10
+	content, discontinuities := readDiscontinuities(t, lhr)
+
+	require.Equal(t, "a10a11a12|b0b1", content)
+	require.Equal(t, []*Discontinuity{
+		{SeqNo: 0, DiscontinuitySeq: 0, Reset: true},
+	}, discontinuities)
+	require.Equal(t, 2, lhr.nextSeqNo)
+}
+
+const testMasterPlaylist = `#EXTM3U
+#EXT-X-MEDIA:TYPE=AUDIO,GROUP-ID="aac",NAME="English",DEFAULT=YES,URI="audio.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=800000,RESOLUTION=640x360,AUDIO="aac"
+360p.m3u8
+#EXT-X-STREAM-INF:BANDWIDTH=5000000,RESOLUTION=1920x1080,AUDIO="aac"
+1080p.m3u8
+#EXT-X-I-FRAME-STREAM-INF:BANDWIDTH=9000000,RESOLUTION=1920x1080,URI="iframe.m3u8"
+#EXT-X-STREAM-INF:BANDWIDTH=2500000,RESOLUTION=1280x720,AUDIO="aac"
+720p.m3u8
+`
+
+func TestSelectVariant(t *testing.T) {
+	playlist, listType, err := m3u8.DecodeFrom(strings.NewReader(testMasterPlaylist), true)
+	require.NoError(t, err)
+	require.Equal(t, m3u8.MASTER, listType)
+	variants := playlist.(*m3u8.MasterPlaylist).Variants
+
+	tests := []struct {
+		by   VariantCriteria
+		want string
+	}{
+		{VariantCriteria{By: HighestBandwidth}, "1080p.m3u8"},
+		{VariantCriteria{By: LowestBandwidth}, "360p.m3u8"},
+		{VariantCriteria{By: NearestResolution, Width: 1280, Height: 800}, "720p.m3u8"},
+		{VariantCriteria{By: NearestResolution, Width: 3840, Height: 2160}, "1080p.m3u8"},
+		{VariantCriteria{By: VariantIndex, Index: 2}, "720p.m3u8"},
+	}
+	for _, tt := range tests {
+		v, err := SelectVariant(variants, tt.by)
+		require.NoError(t, err)
+		require.Equal(t, tt.want, v.URI)
+	}
+
+	_, err = SelectVariant(variants, VariantCriteria{By: VariantIndex, Index: 3})
+	require.Error(t, err)
+	_, err = SelectVariant(nil, VariantCriteria{})
+	require.Error(t, err)
+}
+
+func TestNewHLSReadersForVariant(t *testing.T) {
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/master.m3u8" {
+			w.Write([]byte(testMasterPlaylist))
+		} else {
+			w.Write([]byte(testMediaPlaylist))
+		}
+	}))
+	defer ts.Close()
+
+	masterURL, err := url.Parse(ts.URL + "/master.m3u8")
+	require.NoError(t, err)
+	readers, err := NewHLSReadersForVariant(masterURL, goavpipe.XcAll,
+		VariantCriteria{By: LowestBandwidth})
+	require.NoError(t, err)
+	require.Equal(t, 2, len(readers))
+	require.Equal(t, ts.URL+"/360p.m3u8", readers[0].playlistURL.String())
+	require.Equal(t, goavpipe.XcVideo, readers[0].Type)
+	require.Equal(t, ts.URL+"/audio.m3u8", readers[1].playlistURL.String())
+	require.Equal(t, goavpipe.XcAudio, readers[1].Type)
+
+	readers, err = NewHLSReadersForVariant(masterURL, goavpipe.XcVideo,
+		VariantCriteria{By: NearestResolution, Width: 1280, Height: 720})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(readers))
+	require.Equal(t, ts.URL+"/720p.m3u8", readers[0].playlistURL.String())
+
+	// The criteria are ignored for a media playlist
+	mediaURL, err := url.Parse(ts.URL + "/playlist.m3u8")
+	require.NoError(t, err)
+	readers, err = NewHLSReadersForVariant(mediaURL, goavpipe.XcVideo,
+		VariantCriteria{By: VariantIndex, Index: 5})
+	require.NoError(t, err)
+	require.Equal(t, 1, len(readers))
+	require.Equal(t, mediaURL, readers[0].playlistURL)
+}
+
+func encryptSegment(t *testing.T, plaintext, key, iv []byte) []byte {
+	block, err := aes.NewCipher(key)
+	require.NoError(t, err)
+	ciphertext := padPKCS5(plaintext, aes.BlockSize)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(ciphertext, ciphertext)
+	return ciphertext
+}
+
+// TestHLSReaderDecrypt checks segments are decrypted with the key and IV that apply to them
+func TestHLSReaderDecrypt(t *testing.T) {
+	key1 := []byte("0123456789abcdef")
+	key2 := []byte("fedcba9876543210")
+	iv1 := []byte("ivivivivivivivi1")
+	seqIV := func(seqNo byte) []byte {
+		iv := make([]byte, aes.BlockSize)
+		iv[aes.BlockSize-1] = seqNo
+		return iv
+	}
+
+	segments := map[string][]byte{
+		"/0.ts": encryptSegment(t, []byte("segment 0 with key 1"), key1, iv1),
+		"/1.ts": encryptSegment(t, []byte("segment 1 with key 1 and a longer content"), key1, iv1),
+		"/2.ts": encryptSegment(t, []byte("segment 2 with key 2"), key2, seqIV(2)),
+		"/3.ts": []byte("segment 3 in clear"),
+	}
+	var keyRequests int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/playlist.m3u8":
+			w.Write([]byte(`#EXTM3U
+#EXT-X-TARGETDURATION:1
+#EXT-X-MEDIA-SEQUENCE:0
+#EXT-X-KEY:METHOD=AES-128,URI="key1.bin",IV=0x` + hex.EncodeToString(iv1) + `
+#EXTINF:1.0,
+0.ts
+#EXTINF:1.0,
+1.ts
+#EXT-X-KEY:METHOD=AES-128,URI="key2.bin"
+#EXTINF:1.0,
+2.ts
+#EXT-X-KEY:METHOD=NONE
+#EXTINF:1.0,
+3.ts
+#EXT-X-ENDLIST
+`))
+		case "/key1.bin":
+			atomic.AddInt32(&keyRequests, 1)
+			w.Write(key1)
+		case "/key2.bin":
+			atomic.AddInt32(&keyRequests, 1)
+			w.Write(key2)
+		default:
+			w.Write(segments[r.URL.Path])
+		}
+	}))
+	defer ts.Close()
+
+	lhr := newTestHLSReader(t, ts.URL)
+	lhr.nextSeqNo = 0
+	require.NoError(t, lhr.fill())
+	lhr.Pipe.(*RWBuffer).CloseSide(RWBufferWriteClosed)
+
+	content, err := ioutil.ReadAll(lhr.Pipe)
+	require.NoError(t, err)
+	require.Equal(t, "segment 0 with key 1"+
+		"segment 1 with key 1 and a longer content"+
+		"segment 2 with key 2"+
+		"segment 3 in clear", string(content))
+	require.Equal(t, int32(2), atomic.LoadInt32(&keyRequests))
+}
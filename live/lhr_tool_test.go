@@ -162,7 +162,7 @@ func TestHLSVideoOnly(t *testing.T) {
 		t.Error("video transcoding error", "errXc", err)
 	}
 
-	log.Call(reader.Pipe.Close, "close hls reader", tlog.Error)
+	log.Call(reader.Close, "close hls reader", tlog.Error)
 	err = <-endChan
 	tlog.Info("HLSReader done", "err", err)
 	if err != nil {
@@ -214,7 +214,7 @@ func TestHLSAudioOnly(t *testing.T) {
 		t.Error("video transcoding error", "errXc", err)
 	}
 
-	log.Call(reader.Pipe.Close, "close hls reader", tlog.Error)
+	log.Call(reader.Close, "close hls reader", tlog.Error)
 	err = <-endChan
 	tlog.Info("HLSReader done", "err", err)
 	if err != nil {
@@ -306,7 +306,7 @@ func TestHLSAudioVideoLive(t *testing.T) {
 	// Wait for audio/video mez making to be finished
 	<-done
 	<-done
-	log.Call(reader.Pipe.Close, "close hls reader", tlog.Error)
+	log.Call(reader.Close, "close hls reader", tlog.Error)
 	err = <-endChan
 	tlog.Info("HLSReader done", "err", err)
 	if err != nil {
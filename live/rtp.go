@@ -0,0 +1,145 @@
+package live
+
+import (
+	"encoding/binary"
+
+	"github.com/eluv-io/errors-go"
+)
+
+const rtpHeaderSize = 12
+
+// RTPStats are the statistics of an RTP stream received by a TsReader
+type RTPStats struct {
+	Received   uint64 // Packets received
+	Lost       uint64 // Packets missing from the sequence, the gap is skipped once the jitter window is full
+	Reordered  uint64 // Packets received after a packet following them and put back in order
+	Duplicates uint64 // Packets received more than once, dropped
+	Late       uint64 // Packets received after the stream moved past them, dropped
+}
+
+// rtpDepacketizer strips the RTP headers of the packets of a stream and returns their payloads
+// in sequence number order, holding up to window packets to wait for the missing ones
+type rtpDepacketizer struct {
+	window  int               // Maximum number of packets held while waiting for a missing one
+	started bool              // True once the first packet was received
+	next    uint16            // Sequence number of the next payload to return
+	highest uint16            // Highest sequence number received
+	pending map[uint16][]byte // Payloads received ahead of next, by sequence number
+	stats   RTPStats
+}
+
+func newRTPDepacketizer(window int) *rtpDepacketizer {
+	if window < 1 {
+		window = 1
+	}
+	return &rtpDepacketizer{
+		window:  window,
+		pending: make(map[uint16][]byte),
+	}
+}
+
+// rtpPayload returns the sequence number and the payload of an RTP packet (RFC 3550 5.1)
+func rtpPayload(pkt []byte) (seq uint16, payload []byte, err error) {
+	e := errors.Template("rtpPayload", errors.K.Invalid, "len", len(pkt))
+	if len(pkt) < rtpHeaderSize {
+		return 0, nil, e("reason", "packet too short")
+	}
+	if version := pkt[0] >> 6; version != 2 {
+		return 0, nil, e("reason", "unsupported RTP version", "version", version)
+	}
+
+	seq = binary.BigEndian.Uint16(pkt[2:4])
+	start := rtpHeaderSize + 4*int(pkt[0]&0x0f) // CSRC identifiers
+	end := len(pkt)
+	if pkt[0]&0x10 != 0 {
+		// Header extension: 16 bit profile, 16 bit length in 32 bit words
+		if len(pkt) < start+4 {
+			return 0, nil, e("reason", "truncated header extension", "seq", seq)
+		}
+		start += 4 + 4*int(binary.BigEndian.Uint16(pkt[start+2:start+4]))
+	}
+	if pkt[0]&0x20 != 0 {
+		// Padding: the last byte is the number of padding bytes
+		end -= int(pkt[len(pkt)-1])
+	}
+	if start > end {
+		return 0, nil, e("reason", "invalid header or padding length", "seq", seq)
+	}
+	return seq, pkt[start:end], nil
+}
+
+// push adds an RTP packet and returns the payloads that are ready, in order
+func (d *rtpDepacketizer) push(pkt []byte) (payloads [][]byte, err error) {
+	seq, payload, err := rtpPayload(pkt)
+	if err != nil {
+		return nil, err
+	}
+	d.stats.Received++
+
+	if !d.started {
+		d.started = true
+		d.next = seq
+		d.highest = seq
+	}
+
+	if int16(seq-d.next) < 0 {
+		d.stats.Late++
+		return nil, nil
+	}
+	if _, ok := d.pending[seq]; ok {
+		d.stats.Duplicates++
+		return nil, nil
+	}
+	if int16(seq-d.highest) < 0 {
+		d.stats.Reordered++
+	} else {
+		d.highest = seq
+	}
+
+	// The payload is copied since the caller reuses its read buffer
+	d.pending[seq] = append([]byte(nil), payload...)
+
+	payloads = d.pop()
+	for len(d.pending) > d.window {
+		// The missing packet didn't arrive in time, skip to the first one held
+		d.skip()
+		payloads = append(payloads, d.pop()...)
+	}
+	return payloads, nil
+}
+
+// flush returns all the payloads held, in order, skipping the missing packets
+func (d *rtpDepacketizer) flush() (payloads [][]byte) {
+	for len(d.pending) > 0 {
+		d.skip()
+		payloads = append(payloads, d.pop()...)
+	}
+	return
+}
+
+// pop removes and returns the consecutive payloads starting at next
+func (d *rtpDepacketizer) pop() (payloads [][]byte) {
+	for {
+		payload, ok := d.pending[d.next]
+		if !ok {
+			return
+		}
+		payloads = append(payloads, payload)
+		delete(d.pending, d.next)
+		d.next++
+	}
+}
+
+// skip moves next to the lowest sequence number held, counting the packets skipped as lost
+func (d *rtpDepacketizer) skip() {
+	var gap uint16
+	first := true
+	for seq := range d.pending {
+		if first || seq-d.next < gap {
+			gap = seq - d.next
+			first = false
+		}
+	}
+	d.stats.Lost += uint64(gap)
+	d.next += gap
+}
@@ -0,0 +1,121 @@
+package live
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// rtpPacket returns an RTP packet with the sequence number and a payload of 7 TS packets
+// filled with the sequence number
+func rtpPacket(seq uint16) (pkt, payload []byte) {
+	payload = bytes.Repeat([]byte{byte(seq)}, 7*188)
+	header := make([]byte, rtpHeaderSize)
+	header[0] = 0x80 // Version 2
+	header[1] = 33   // MP2T
+	binary.BigEndian.PutUint16(header[2:4], seq)
+	return append(header, payload...), payload
+}
+
+func TestRTPPayload(t *testing.T) {
+	pkt, payload := rtpPacket(7)
+
+	// CSRC, header extension and padding
+	ext := []byte{0x80 | 0x20 | 0x10 | 0x01, 33, 0, 7, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 2, 3, 4, // CSRC
+		0xbe, 0xde, 0, 1, 5, 6, 7, 8} // Extension of one word
+	ext = append(ext, payload...)
+	ext = append(ext, 0, 0, 3) // Padding
+
+	for _, p := range [][]byte{pkt, ext} {
+		seq, got, err := rtpPayload(p)
+		assert.NoError(t, err)
+		assert.Equal(t, uint16(7), seq)
+		assert.Equal(t, payload, got)
+	}
+
+	_, _, err := rtpPayload(pkt[:8])
+	assert.Error(t, err)
+	_, _, err = rtpPayload(append([]byte{0x40}, pkt[1:]...))
+	assert.Error(t, err)
+}
+
+func TestRTPDepacketizer(t *testing.T) {
+	d := newRTPDepacketizer(4)
+
+	var expected, got []byte
+	push := func(seq uint16) {
+		pkt, _ := rtpPacket(seq)
+		payloads, err := d.push(pkt)
+		assert.NoError(t, err)
+		for _, p := range payloads {
+			got = append(got, p...)
+		}
+	}
+
+	// Sequence numbers wrap around, 65535 and 1 arrive out of order, 5 is duplicated,
+	// 4 is lost and 65535 arrives again after the stream moved past it
+	for _, seq := range []uint16{65534, 0, 65535, 2, 1, 3, 5, 5, 6, 7, 8, 9, 65535} {
+		push(seq)
+	}
+	for _, p := range d.flush() {
+		got = append(got, p...)
+	}
+
+	for _, seq := range []uint16{65534, 65535, 0, 1, 2, 3, 5, 6, 7, 8, 9} {
+		_, payload := rtpPacket(seq)
+		expected = append(expected, payload...)
+	}
+	assert.Equal(t, expected, got)
+	assert.Equal(t, RTPStats{Received: 13, Lost: 1, Reordered: 2, Duplicates: 1, Late: 1}, d.stats)
+}
+
+func TestTsReaderRTP(t *testing.T) {
+	var stats []RTPStats
+	var statsMutex sync.Mutex
+	tsr, rwc, err := NewTsReaderV2("127.0.0.1:0", TsReaderConfig{
+		ReadTimeout:      100 * time.Millisecond,
+		RTP:              true,
+		RTPJitterPackets: 2,
+		OnRTPStats: func(s RTPStats) {
+			statsMutex.Lock()
+			defer statsMutex.Unlock()
+			stats = append(stats, s)
+		},
+	})
+	assert.NoError(t, err)
+
+	conn, err := net.Dial("udp", tsr.conn.LocalAddr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+
+	// 11 arrives out of order and 14 is lost
+	for _, seq := range []uint16{10, 12, 11, 13, 15, 16, 17} {
+		pkt, _ := rtpPacket(seq)
+		_, err = conn.Write(pkt)
+		assert.NoError(t, err)
+	}
+	var expected []byte
+	for _, seq := range []uint16{10, 11, 12, 13, 15, 16, 17} {
+		_, payload := rtpPacket(seq)
+		expected = append(expected, payload...)
+	}
+
+	data, err := ioutil.ReadAll(rwc)
+	assert.NoError(t, err)
+	assert.Equal(t, expected, data)
+
+	statsMutex.Lock()
+	defer statsMutex.Unlock()
+	if assert.Equal(t, 2, len(stats)) {
+		// Reported when 14 is skipped and when the recording stops
+		assert.Equal(t, uint64(1), stats[0].Lost)
+		assert.Equal(t, RTPStats{Received: 7, Lost: 1, Reordered: 1}, stats[1])
+	}
+}
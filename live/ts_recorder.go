@@ -3,15 +3,37 @@ package live
 import (
 	"io"
 	"net"
+	"os"
 	"strings"
 	"time"
 
 	"github.com/eluv-io/avpipe"
+	"github.com/eluv-io/errors-go"
 )
 
+// TsReaderConfig configures the UDP socket of a TsReader, fields left 0 take the value
+// of DefaultTsReaderConfig
+type TsReaderConfig struct {
+	ReadTimeout      time.Duration  // Recording stops if no packet was received for this long (after the first one)
+	SocketBufferSize int            // Size of the UDP socket receive buffer in bytes
+	PacketLimit      int            // Recording stops after this many packets, no limit if 0
+	RTP              bool           // The datagrams are RTP packets carrying MPEG-TS, the RTP headers are stripped
+	RTPJitterPackets int            // Number of RTP packets held to put out of order packets back in order
+	OnRTPStats       func(RTPStats) // Called with the RTP stats when packets are lost and when recording stops
+	Interface        string         // Name of the network interface joining the group of a multicast address, i.e. "eth1", the system default if empty
+	NoPacing         bool           // Read a file as fast as possible instead of at the rate of the stream (PCR)
+}
+
+// DefaultTsReaderConfig is the configuration of a TsReader created without one
+var DefaultTsReaderConfig = TsReaderConfig{
+	ReadTimeout:      5 * time.Second,
+	SocketBufferSize: 16 * 1024 * 1024,
+	RTPJitterPackets: 32,
+}
+
 type TsReader struct {
 	addr       string // For example ":21001" (for localhost port 21001)
-	pktLimit   int
+	config     TsReaderConfig
 	w          io.Writer
 	done       chan bool
 	ErrChannel chan error
@@ -23,6 +45,7 @@ func NewTsReader(addr string, w io.Writer) *TsReader {
 
 	tsr := &TsReader{
 		addr:       addr,
+		config:     DefaultTsReaderConfig,
 		w:          w,
 		ErrChannel: make(chan error, 10),
 	}
@@ -46,15 +69,20 @@ func NewTsReader(addr string, w io.Writer) *TsReader {
 // NewTsReaderV2 creates a UDP MPEG-TS reader and returns a TsReader and an io.Reader
 // Starts the necessary goroutines - when the returned reader is closed, it stops
 // all goroutines and cleans up.
-func NewTsReaderV2(addr string) (*TsReader, io.ReadWriteCloser, error) {
+// An optional TsReaderConfig overrides DefaultTsReaderConfig.
+func NewTsReaderV2(addr string, config ...TsReaderConfig) (*TsReader, io.ReadWriteCloser, error) {
 
 	rwb := NewRWBuffer(100000)
 
 	tsr := &TsReader{
 		addr:       addr,
+		config:     DefaultTsReaderConfig,
 		w:          rwb,
 		ErrChannel: make(chan error, 10),
 	}
+	if len(config) > 0 {
+		tsr.config.merge(config[0])
+	}
 
 	var err error
 	if strings.HasPrefix(addr, "/") || strings.HasPrefix(addr, "./") {
@@ -75,16 +103,21 @@ func (tsr *TsReader) serveOneConnection(w io.Writer) (err error) {
 	if err != nil {
 		return
 	}
-	conn, err := net.ListenUDP("udp", sAddr)
+
+	var conn *net.UDPConn
+	if sAddr.IP.IsMulticast() {
+		conn, err = listenMulticast(sAddr, tsr.config.Interface)
+	} else {
+		conn, err = net.ListenUDP("udp", sAddr)
+	}
 	if err != nil {
 		log.Error("Failed to listen UDP network ...", err)
 		return
 	}
 
-	// TODO: Make it a config param (RM)
-	err = conn.SetReadBuffer(16 * 1024 * 1024)
+	err = conn.SetReadBuffer(tsr.config.SocketBufferSize)
 	if err != nil {
-		log.Error("Failed to set UDP buffer size, continue ...", err)
+		log.Error("Failed to set UDP buffer size, continue ...", err, "size", tsr.config.SocketBufferSize)
 	}
 
 	log.Info("ts_recorder server accepted", "addr", tsr.addr)
@@ -92,7 +125,7 @@ func (tsr *TsReader) serveOneConnection(w io.Writer) (err error) {
 	var pc net.PacketConn
 	pc = conn
 	go func(tsr *TsReader) {
-		if err := readUdp(pc, w); err != nil {
+		if err := readUdp(pc, w, tsr.config); err != nil {
 			log.Error("Failed reading UDP stream", "err", err)
 			tsr.ErrChannel <- err
 		}
@@ -103,6 +136,32 @@ func (tsr *TsReader) serveOneConnection(w io.Writer) (err error) {
 	return
 }
 
+// listenMulticast joins the multicast group of addr on the network interface with the given
+// name, or the system default interface if name is empty
+func listenMulticast(addr *net.UDPAddr, name string) (conn *net.UDPConn, err error) {
+	e := errors.Template("listenMulticast", "addr", addr.String(), "interface", name)
+
+	var ifi *net.Interface
+	if name != "" {
+		if ifi, err = net.InterfaceByName(name); err != nil {
+			return nil, e(err)
+		}
+		if ifi.Flags&net.FlagMulticast == 0 {
+			return nil, e(errors.K.Invalid, "reason", "network interface has no multicast capability",
+				"flags", ifi.Flags.String())
+		}
+		if ifi.Flags&net.FlagUp == 0 {
+			return nil, e(errors.K.Invalid, "reason", "network interface is down")
+		}
+	}
+
+	if conn, err = net.ListenMulticastUDP("udp", ifi, addr); err != nil {
+		return nil, e(err, "reason", "failed to join multicast group")
+	}
+	log.Info("ts_recorder joined multicast group", "addr", addr.String(), "interface", name)
+	return
+}
+
 func (tsr *TsReader) Close() {
 	if tsr.conn != nil {
 		err := tsr.conn.Close()
@@ -119,20 +178,65 @@ func (tsr *TsReader) Close() {
 	}
 }
 
-func readUdp(conn net.PacketConn, w io.Writer) error {
+// merge sets the non zero fields of c from other
+func (c *TsReaderConfig) merge(other TsReaderConfig) {
+	if other.ReadTimeout > 0 {
+		c.ReadTimeout = other.ReadTimeout
+	}
+	if other.SocketBufferSize > 0 {
+		c.SocketBufferSize = other.SocketBufferSize
+	}
+	if other.PacketLimit > 0 {
+		c.PacketLimit = other.PacketLimit
+	}
+	if other.RTP {
+		c.RTP = true
+	}
+	if other.RTPJitterPackets > 0 {
+		c.RTPJitterPackets = other.RTPJitterPackets
+	}
+	if other.OnRTPStats != nil {
+		c.OnRTPStats = other.OnRTPStats
+	}
+	if other.Interface != "" {
+		c.Interface = other.Interface
+	}
+	if other.NoPacing {
+		c.NoPacing = true
+	}
+}
+
+func readUdp(conn net.PacketConn, w io.Writer, config TsReaderConfig) error {
+
+	var rtp *rtpDepacketizer
+	if config.RTP {
+		rtp = newRTPDepacketizer(config.RTPJitterPackets)
+	}
 
 	// Assume that Close() is implemented, and that writer is not used after
 	// this call
 	defer func() {
+		if rtp != nil {
+			for _, payload := range rtp.flush() {
+				if _, err := w.Write(payload); err != nil {
+					break
+				}
+			}
+			log.Info("RTP stream stats", "stats", rtp.stats)
+			if config.OnRTPStats != nil {
+				config.OnRTPStats(rtp.stats)
+			}
+		}
 		w.(io.WriteCloser).Close()
 		err := conn.Close()
 		log.Info("Closing UDP socket", "err", err, "addr", conn.LocalAddr().String())
 	}()
 
 	// Stop recording if nothing was read for timeout
-	timeout := 5 * time.Second
+	timeout := config.ReadTimeout
 
 	bytesRead := 0
+	pktsRead := 0
 	buf := make([]byte, 65536)
 
 	first := true
@@ -161,26 +265,152 @@ func readUdp(conn net.PacketConn, w io.Writer) error {
 			return err
 		}
 
-		t := time.Now()
-		bw, err := w.Write(buf[:n])
-		if first {
-			log.Info("UDP WRITE", "bw", bw, "err", err)
-			first = false
+		payloads := [][]byte{buf[:n]}
+		if rtp != nil {
+			lost := rtp.stats.Lost
+			if payloads, err = rtp.push(buf[:n]); err != nil {
+				log.Warn("Dropping invalid RTP packet", "err", err, "sender", sender)
+				continue
+			}
+			if rtp.stats.Lost != lost {
+				log.Warn("RTP packets lost", "lost", rtp.stats.Lost-lost, "stats", rtp.stats)
+				if config.OnRTPStats != nil {
+					config.OnRTPStats(rtp.stats)
+				}
+			}
 		}
 
-		if err != nil || bw != n {
-			log.Error("Failed to write UDP packet", "err", err, "bw", bw, "n", n, "sender", sender)
-			return err
+		for _, payload := range payloads {
+			t := time.Now()
+			bw, err := w.Write(payload)
+			if first {
+				log.Info("UDP WRITE", "bw", bw, "err", err)
+				first = false
+			}
+
+			if err != nil || bw != len(payload) {
+				log.Error("Failed to write UDP packet", "err", err, "bw", bw, "n", len(payload), "sender", sender)
+				return err
+			}
+			if time.Since(t) > time.Millisecond*10 || bw > 1500 {
+				log.Warn("Writing UDP to avpipe took longer than expected", "timeSpent", time.Since(t), "written", bw)
+			}
 		}
-		if time.Since(t) > time.Millisecond*10 || bw > 1500 {
-			log.Warn("Writing UDP to avpipe took longer than expected", "timeSpent", time.Since(t), "written", bw)
+
+		pktsRead++
+		if config.PacketLimit > 0 && pktsRead >= config.PacketLimit {
+			log.Info("UDP packet limit reached", "pktsRead", pktsRead, "bytesRead", bytesRead)
+			return nil
 		}
 	}
 	return nil
 }
 
+// serveFromFile writes the MPEG-TS file at tsr.addr to w, at the rate of the stream given by its
+// PCRs unless NoPacing is set, and closes w at the end of the file
 func (tsr *TsReader) serveFromFile(w io.Writer) (err error) {
+	f, err := os.Open(tsr.addr)
+	if err != nil {
+		log.Error("Failed to open MPEG-TS file", "err", err, "path", tsr.addr)
+		return
+	}
+
+	log.Info("ts_recorder reading file", "path", tsr.addr, "noPacing", tsr.config.NoPacing)
+
+	go func(tsr *TsReader) {
+		if err := readFile(f, w, tsr.config); err != nil {
+			log.Error("Failed reading MPEG-TS file", "err", err, "path", tsr.addr)
+			tsr.ErrChannel <- err
+		}
+	}(tsr)
 
-	/* Not implemented */
 	return
 }
+
+const (
+	tsPacketSize = 188
+	pcrClock     = 27000000        // PCR ticks per second
+	pcrWrap      = (1 << 33) * 300 // PCR wraps around after 2^33 ticks of the 90kHz base
+	pcrMaxGap    = pcrClock        // Larger gaps between PCRs (at most 100ms apart) are discontinuities
+)
+
+// readFile writes the MPEG-TS stream read from r to w in chunks of 7 TS packets, the payload
+// of a UDP datagram, waiting before each PCR until its time has come (unless config.NoPacing).
+// The pacing restarts from a PCR that jumps forward by more than pcrMaxGap or goes backwards,
+// i.e. at a discontinuity or where files were concatenated.
+func readFile(r io.ReadCloser, w io.Writer, config TsReaderConfig) error {
+	defer func() {
+		if closer, ok := w.(io.Closer); ok {
+			log.Call(closer.Close, "close writer", log.Error)
+		}
+		log.Call(r.Close, "close MPEG-TS file", log.Error)
+	}()
+
+	buf := make([]byte, 7*tsPacketSize)
+	pcrPid := -1
+	var firstPcr, lastPcr int64
+	var start time.Time
+	pktsRead := 0
+
+	for {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			return nil
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+
+		if !config.NoPacing {
+			for i := 0; i+tsPacketSize <= n; i += tsPacketSize {
+				pid, pcr, ok := tsPacketPCR(buf[i : i+tsPacketSize])
+				if !ok || (pcrPid != -1 && pid != pcrPid) {
+					continue
+				}
+				gap := (pcr - lastPcr + pcrWrap) % pcrWrap
+				lastPcr = pcr
+				if pcrPid == -1 || gap > pcrMaxGap {
+					if pcrPid != -1 {
+						log.Info("MPEG-TS file PCR discontinuity, restarting pacing", "pcr", pcr, "gap", gap)
+					}
+					pcrPid = pid
+					firstPcr = pcr
+					start = time.Now()
+					continue
+				}
+				elapsed := (pcr - firstPcr + pcrWrap) % pcrWrap
+				if wait := time.Until(start.Add(time.Duration(elapsed/(pcrClock/1000000)) * time.Microsecond)); wait > 0 {
+					time.Sleep(wait)
+				}
+			}
+		}
+
+		if _, err = w.Write(buf[:n]); err != nil {
+			return err
+		}
+
+		pktsRead++
+		if config.PacketLimit > 0 && pktsRead >= config.PacketLimit {
+			log.Info("MPEG-TS file packet limit reached", "pktsRead", pktsRead)
+			return nil
+		}
+		if n < len(buf) {
+			return nil
+		}
+	}
+}
+
+// tsPacketPCR returns the PID and the PCR, in 27MHz ticks, of the TS packet if it has one
+// (ISO/IEC 13818-1 2.4.3.4)
+func tsPacketPCR(pkt []byte) (pid int, pcr int64, ok bool) {
+	if len(pkt) < tsPacketSize || pkt[0] != 0x47 {
+		return
+	}
+	pid = int(pkt[1]&0x1f)<<8 | int(pkt[2])
+	if pkt[3]&0x20 == 0 || pkt[4] < 7 || pkt[5]&0x10 == 0 {
+		// No adaptation field, too short for a PCR or no PCR flag
+		return
+	}
+	base := int64(pkt[6])<<25 | int64(pkt[7])<<17 | int64(pkt[8])<<9 | int64(pkt[9])<<1 | int64(pkt[10])>>7
+	ext := int64(pkt[10]&0x01)<<8 | int64(pkt[11])
+	return pid, base*300 + ext, true
+}
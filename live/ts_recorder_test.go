@@ -1,7 +1,10 @@
 package live
 
 import (
+	"bytes"
 	"fmt"
+	"io/ioutil"
+	"net"
 	"path"
 	"testing"
 	"time"
@@ -64,6 +67,8 @@ func TestUdpToMp4(t *testing.T) {
 
 	xcParams.Format = "dash"
 	xcParams.Dcodec2 = "aac"
+	// The ABR segment duration is set in ts, clear the mez SegDuration which would conflict with it
+	xcParams.SegDuration = ""
 	xcParams.AudioSegDurationTs = 96106 // almost 2 * 48000
 	xcParams.XcType = goavpipe.XcAudio
 	audioMezFiles := [3]string{"audio-mez-segment0-1.mp4", "audio-mez-segment0-2.mp4", "audio-mez-segment0-3.mp4"}
@@ -471,3 +476,148 @@ func TestUdpToMp4WithCancelling4(t *testing.T) {
 
 	<-done
 }
+
+func TestTsReaderConfig(t *testing.T) {
+	tsr, rwc, err := NewTsReaderV2("127.0.0.1:0", TsReaderConfig{
+		ReadTimeout: 100 * time.Millisecond,
+		PacketLimit: 3,
+	})
+	assert.NoError(t, err)
+	assert.Equal(t, 100*time.Millisecond, tsr.config.ReadTimeout)
+	assert.Equal(t, DefaultTsReaderConfig.SocketBufferSize, tsr.config.SocketBufferSize)
+
+	conn, err := net.Dial("udp", tsr.conn.LocalAddr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	for i := 0; i < 5; i++ {
+		_, err = conn.Write(make([]byte, 188))
+		assert.NoError(t, err)
+	}
+
+	// Recording stops after PacketLimit packets
+	data, err := ioutil.ReadAll(rwc)
+	assert.NoError(t, err)
+	assert.Equal(t, 3*188, len(data))
+}
+
+func TestTsReaderReadTimeout(t *testing.T) {
+	tsr, rwc, err := NewTsReaderV2("127.0.0.1:0", TsReaderConfig{ReadTimeout: 100 * time.Millisecond})
+	assert.NoError(t, err)
+
+	conn, err := net.Dial("udp", tsr.conn.LocalAddr().String())
+	assert.NoError(t, err)
+	defer conn.Close()
+	_, err = conn.Write(make([]byte, 188))
+	assert.NoError(t, err)
+
+	// Recording stops ReadTimeout after the last packet
+	start := time.Now()
+	data, err := ioutil.ReadAll(rwc)
+	assert.NoError(t, err)
+	assert.Equal(t, 188, len(data))
+	assert.Equal(t, avpipe.EAV_IO_TIMEOUT, <-tsr.ErrChannel)
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}
+
+func TestTsReaderMulticastInterface(t *testing.T) {
+	_, _, err := NewTsReaderV2("239.0.0.1:21099", TsReaderConfig{Interface: "nosuchif0"})
+	assert.Error(t, err)
+
+	// The loopback interface usually can't join multicast groups
+	ifs, err := net.Interfaces()
+	assert.NoError(t, err)
+	for _, ifi := range ifs {
+		if ifi.Flags&net.FlagMulticast == 0 {
+			_, _, err = NewTsReaderV2("239.0.0.1:21099", TsReaderConfig{Interface: ifi.Name})
+			assert.Error(t, err)
+			assert.Contains(t, err.Error(), "no multicast capability")
+			break
+		}
+	}
+}
+
+// tsPacket returns a TS packet of the PID with a PCR in its adaptation field if pcr >= 0
+func tsPacket(pid int, pcr int64) []byte {
+	pkt := bytes.Repeat([]byte{0xff}, tsPacketSize)
+	pkt[0] = 0x47
+	pkt[1] = byte(pid >> 8)
+	pkt[2] = byte(pid)
+	pkt[3] = 0x10 // Payload only
+	if pcr >= 0 {
+		base, ext := pcr/300, pcr%300
+		pkt[3] = 0x30 // Adaptation field and payload
+		pkt[4] = 7
+		pkt[5] = 0x10 // PCR flag
+		pkt[6] = byte(base >> 25)
+		pkt[7] = byte(base >> 17)
+		pkt[8] = byte(base >> 9)
+		pkt[9] = byte(base >> 1)
+		pkt[10] = byte(base<<7) | 0x7e | byte(ext>>8)
+		pkt[11] = byte(ext)
+	}
+	return pkt
+}
+
+func TestTsReaderFile(t *testing.T) {
+	// 200ms of stream with a PCR every 20ms, one PCR close to the wrap around
+	var ts []byte
+	firstPcr := int64(pcrWrap - pcrClock/10)
+	for i := int64(0); i <= 10; i++ {
+		ts = append(ts, tsPacket(0x100, (firstPcr+i*pcrClock/50)%pcrWrap)...)
+		for j := 0; j < 20; j++ {
+			ts = append(ts, tsPacket(0x101, -1)...)
+		}
+	}
+	for _, i := range []int64{0, 12345, pcrWrap - 1} {
+		pid, pcr, ok := tsPacketPCR(tsPacket(0x100, i))
+		assert.True(t, ok)
+		assert.Equal(t, 0x100, pid)
+		assert.Equal(t, i, pcr)
+	}
+
+	filename := path.Join(t.TempDir(), "test.ts")
+	assert.NoError(t, ioutil.WriteFile(filename, ts, 0644))
+
+	for _, noPacing := range []bool{false, true} {
+		start := time.Now()
+		_, rwc, err := NewTsReaderV2(filename, TsReaderConfig{NoPacing: noPacing})
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(rwc)
+		assert.NoError(t, err)
+		assert.Equal(t, ts, data)
+		if noPacing {
+			assert.Less(t, int64(time.Since(start)), int64(100*time.Millisecond))
+		} else {
+			assert.GreaterOrEqual(t, int64(time.Since(start)), int64(190*time.Millisecond))
+		}
+	}
+}
+
+// TestTsReaderFileDiscontinuity checks the pacing restarts at a PCR jumping forward or backwards
+func TestTsReaderFileDiscontinuity(t *testing.T) {
+	for _, jump := range []int64{3600 * pcrClock, -3600 * pcrClock, -pcrClock / 10} {
+		// Two runs of 100ms of stream with a PCR every 20ms, the second one starting at the jump
+		var ts []byte
+		for run := int64(0); run < 2; run++ {
+			firstPcr := (run*(pcrClock/10+jump) + pcrWrap) % pcrWrap
+			for i := int64(0); i <= 5; i++ {
+				ts = append(ts, tsPacket(0x100, (firstPcr+i*pcrClock/50)%pcrWrap)...)
+				for j := 0; j < 20; j++ {
+					ts = append(ts, tsPacket(0x101, -1)...)
+				}
+			}
+		}
+
+		filename := path.Join(t.TempDir(), "test.ts")
+		assert.NoError(t, ioutil.WriteFile(filename, ts, 0644))
+
+		start := time.Now()
+		_, rwc, err := NewTsReaderV2(filename, TsReaderConfig{})
+		assert.NoError(t, err)
+		data, err := ioutil.ReadAll(rwc)
+		assert.NoError(t, err)
+		assert.Equal(t, ts, data)
+		assert.GreaterOrEqual(t, int64(time.Since(start)), int64(190*time.Millisecond), fmt.Sprintf("jump %d", jump))
+		assert.Less(t, int64(time.Since(start)), int64(2*time.Second), fmt.Sprintf("jump %d", jump))
+	}
+}